@@ -0,0 +1,138 @@
+// Package artifact writes the files a benchmark leaves behind, such as
+// server logs, metrics samples and captured streams, compressed with
+// zstd, and reads them back compressed or not, so tools that export or
+// replay them need not care which.
+package artifact
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Ext is the extension of compressed artifacts.
+const Ext = ".zst"
+
+// magic starts every zstd frame.
+var magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// The encoder and decoder of Compress and Decompress, which are safe for
+// concurrent use.
+var (
+	encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// Compress appends src, compressed as one zstd frame, to dst.
+func Compress(dst, src []byte) []byte {
+	return encoder.EncodeAll(src, dst)
+}
+
+// Decompress appends the frames of src, decompressed, to dst.
+func Decompress(dst, src []byte) ([]byte, error) {
+	return decoder.DecodeAll(src, dst)
+}
+
+// NewWriter returns a writer compressing to w; Close flushes it, but
+// does not close w.
+func NewWriter(w io.Writer) io.WriteCloser {
+	zw, _ := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	return zw
+}
+
+// NewReader returns a reader of r, decompressed if it is zstd and as is if
+// not.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(magic))
+	if !bytes.Equal(head, magic) {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return io.NopCloser(br), nil
+	}
+	zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// Create creates the file path to write an artifact to, compressed into
+// path+Ext if compress is set. Close closes the file.
+func Create(path string, compress bool) (io.WriteCloser, error) {
+	if !compress {
+		return os.Create(path)
+	}
+	f, err := os.Create(path + Ext)
+	if err != nil {
+		return nil, err
+	}
+	return &file{WriteCloser: NewWriter(f), f: f}, nil
+}
+
+type file struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (f *file) Close() error {
+	return errors.Join(f.WriteCloser.Close(), f.f.Close())
+}
+
+// Open opens the artifact at path, or at path+Ext if there is none at
+// path, decompressing it if it is compressed.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		var err2 error
+		if f, err2 = os.Open(path + Ext); err2 == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &readFile{ReadCloser: r, f: f}, nil
+}
+
+type readFile struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (f *readFile) Close() error {
+	return errors.Join(f.ReadCloser.Close(), f.f.Close())
+}
+
+// CompressFile replaces the file at path with path+Ext, compressed.
+func CompressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := Create(path, true)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(path + Ext)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + Ext)
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,88 @@
+package artifact
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateOpen(t *testing.T) {
+	dir := t.TempDir()
+	text := strings.Repeat("data: {\"choices\":[{\"delta\":{\"content\":\"token\"}}]}\n\n", 1000)
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(dir, "stream")
+		w, err := Create(path, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, text)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if compress {
+			info, err := os.Stat(path + Ext)
+			if err != nil || info.Size() > int64(len(text))/10 {
+				t.Errorf("compressed to %v, %v", info, err)
+			}
+		}
+
+		// Named with or without the extension
+		for _, name := range []string{path, path + Ext} {
+			if !compress && name != path {
+				continue
+			}
+			r, err := Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(got) != text {
+				t.Errorf("compress %v: read %d bytes of %s, %v", compress, len(got), name, err)
+			}
+		}
+		os.Remove(path)
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	os.WriteFile(path, []byte(`{"ok":true}`), 0644)
+	if err := CompressFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("uncompressed file left: %v", err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, _ := io.ReadAll(r); string(got) != `{"ok":true}` {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	a, b := []byte("id: 1\ndata: one\n\n"), []byte("")
+	frames := Compress(Compress(nil, a), b)
+	got, err := Decompress(nil, frames)
+	if err != nil || !bytes.Equal(got, a) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := Decompress(nil, frames[:len(frames)-2]); err == nil {
+		t.Error("truncated frame decompressed")
+	}
+	// Short plain input is passed through
+	r, err := NewReader(strings.NewReader("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "ab" {
+		t.Errorf("read %q", got)
+	}
+}
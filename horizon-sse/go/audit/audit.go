@@ -0,0 +1,214 @@
+// Package audit keeps prompts out of logs that capture request payloads.
+// A Policy redacts the prompt fields of a JSON payload, such as the
+// content of chat messages, by hashing, truncating or dropping them while
+// leaving the model and parameters readable. A Hook applies it to every
+// entry of a logger, so a payload or prompt logged anywhere is redacted
+// before it is written.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mode is how a Policy redacts a prompt.
+type Mode string
+
+const (
+	// ModeHash replaces a prompt with a short SHA-256 of it and its
+	// length, so identical prompts can still be told apart.
+	ModeHash Mode = "hash"
+	// ModeTruncate keeps the first MaxChars characters.
+	ModeTruncate Mode = "truncate"
+	// ModeDrop replaces a prompt with "[redacted]".
+	ModeDrop Mode = "drop"
+	// ModeFull logs prompts as they are, for environments allowed to.
+	ModeFull Mode = "full"
+)
+
+// DefaultTruncate is how many characters ModeTruncate keeps if MaxChars is
+// not set.
+const DefaultTruncate = 32
+
+// DefaultFields are the prompt fields of the chat, completion, embedding
+// and moderation requests.
+var DefaultFields = []string{"messages.content", "prompt", "input", "system", "instructions"}
+
+// Log fields a Hook redacts: PayloadField holds a request payload, raw
+// JSON as bytes or a string, and PromptField a single prompt.
+const (
+	PayloadField = "payload"
+	PromptField  = "prompt"
+)
+
+// Policy is how prompts are redacted. The zero Policy hashes the
+// DefaultFields.
+type Policy struct {
+	Mode     Mode
+	MaxChars int
+	// Fields are the prompt fields of a payload, as dotted paths through
+	// its objects; arrays on the way are gone through element by element,
+	// so "messages.content" is the content of every message. Everything
+	// in a field is redacted, strings nested in it included, but for the
+	// type of each part of multi-part content.
+	Fields []string
+}
+
+// ParsePolicy parses a mode, "hash", "truncate[:N]", "drop" or "full",
+// and a comma-separated list of fields, DefaultFields if empty.
+func ParsePolicy(mode, fields string) (Policy, error) {
+	var p Policy
+	name, chars, hasChars := strings.Cut(strings.TrimSpace(mode), ":")
+	switch p.Mode = Mode(name); p.Mode {
+	case ModeHash, ModeDrop, ModeFull:
+		if hasChars {
+			return p, fmt.Errorf("redaction mode %q takes no length", mode)
+		}
+	case ModeTruncate:
+		if hasChars {
+			n, err := strconv.Atoi(chars)
+			if err != nil || n < 1 {
+				return p, fmt.Errorf("invalid truncation length %q", chars)
+			}
+			p.MaxChars = n
+		}
+	default:
+		return p, fmt.Errorf("unknown redaction mode %q", mode)
+	}
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			p.Fields = append(p.Fields, field)
+		}
+	}
+	return p, nil
+}
+
+// Text redacts one prompt.
+func (p Policy) Text(s string) string {
+	switch p.Mode {
+	case ModeFull:
+		return s
+	case ModeDrop:
+		return "[redacted]"
+	case ModeTruncate:
+		max := p.MaxChars
+		if max <= 0 {
+			max = DefaultTruncate
+		}
+		if n := utf8.RuneCountInString(s); n > max {
+			cut := 0
+			for i := 0; i < max; i++ {
+				_, size := utf8.DecodeRuneInString(s[cut:])
+				cut += size
+			}
+			return fmt.Sprintf("%s…[+%d chars]", s[:cut], n-max)
+		}
+		return s
+	default:
+		sum := sha256.Sum256([]byte(s))
+		return fmt.Sprintf("sha256:%s len=%d", hex.EncodeToString(sum[:6]), len(s))
+	}
+}
+
+// Payload redacts the prompt fields of a JSON payload. A payload that is
+// not JSON, or was cut short, is redacted whole as one prompt.
+func (p Policy) Payload(payload []byte) string {
+	if p.Mode == ModeFull {
+		return string(payload)
+	}
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return p.Text(string(payload))
+	}
+	fields := p.Fields
+	if len(fields) == 0 {
+		fields = DefaultFields
+	}
+	for _, field := range fields {
+		v = p.redactPath(v, strings.Split(field, "."))
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return p.Text(string(payload))
+	}
+	return string(out)
+}
+
+// redactPath redacts what path leads to within v.
+func (p Policy) redactPath(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return p.redactAll(v)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if child, ok := v[path[0]]; ok {
+			v[path[0]] = p.redactPath(child, path[1:])
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = p.redactPath(child, path)
+		}
+	}
+	return v
+}
+
+// redactAll redacts every string in v, such as the text of each part of
+// a multi-part message, but for the parts' types.
+func (p Policy) redactAll(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return p.Text(v)
+	case map[string]interface{}:
+		for k, child := range v {
+			if k != "type" {
+				v[k] = p.redactAll(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = p.redactAll(child)
+		}
+	}
+	return v
+}
+
+// Hook redacts the PayloadField and PromptField of every entry a logger
+// writes with its Policy.
+type Hook struct {
+	Policy Policy
+}
+
+// NewHook returns a hook for p, to add to a logger with AddHook.
+func NewHook(p Policy) *Hook {
+	return &Hook{Policy: p}
+}
+
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	switch v := entry.Data[PayloadField].(type) {
+	case []byte:
+		entry.Data[PayloadField] = h.Policy.Payload(v)
+	case json.RawMessage:
+		entry.Data[PayloadField] = h.Policy.Payload(v)
+	case string:
+		entry.Data[PayloadField] = h.Policy.Payload([]byte(v))
+	case nil:
+	default:
+		// Anything else is logged as it would be formatted, redacted
+		entry.Data[PayloadField] = h.Policy.Text(fmt.Sprint(v))
+	}
+	if v, ok := entry.Data[PromptField]; ok {
+		entry.Data[PromptField] = h.Policy.Text(fmt.Sprint(v))
+	}
+	return nil
+}
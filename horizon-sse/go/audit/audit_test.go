@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("truncate:8", "messages.content, input")
+	if err != nil || p.Mode != ModeTruncate || p.MaxChars != 8 || len(p.Fields) != 2 {
+		t.Errorf("truncate:8: %+v %v", p, err)
+	}
+	for _, mode := range []string{"", "mask", "truncate:0", "truncate:x", "hash:4"} {
+		if _, err := ParsePolicy(mode, ""); err == nil {
+			t.Errorf("ParsePolicy(%q) accepted", mode)
+		}
+	}
+}
+
+func TestPayload(t *testing.T) {
+	if got := (Policy{}).Text("be terse"); !strings.HasPrefix(got, "sha256:") || !strings.HasSuffix(got, " len=8") {
+		t.Errorf("hash: %s", got)
+	}
+	payload := `{"model":"gpt-4","messages":[{"role":"system","content":"be terse"},{"role":"user","content":[{"type":"text","text":"my card is 4111"}]}],"max_tokens":5}`
+	for _, tc := range []struct {
+		policy Policy
+		want   string
+	}{
+		// The model and parameters stay, every string of a message's content goes
+		{Policy{}, `{"max_tokens":5,"messages":[{"content":"` + Policy{}.Text("be terse") + `","role":"system"},{"content":[{"text":"` + Policy{}.Text("my card is 4111") + `","type":"text"}],"role":"user"}],"model":"gpt-4"}`},
+		{Policy{Mode: ModeDrop, Fields: []string{"messages.content.text"}}, `{"max_tokens":5,"messages":[{"content":"be terse","role":"system"},{"content":[{"text":"[redacted]","type":"text"}],"role":"user"}],"model":"gpt-4"}`},
+		{Policy{Mode: ModeTruncate, MaxChars: 2, Fields: []string{"messages.content"}}, `{"max_tokens":5,"messages":[{"content":"be…[+6 chars]","role":"system"},{"content":[{"text":"my…[+13 chars]","type":"text"}],"role":"user"}],"model":"gpt-4"}`},
+		{Policy{Mode: ModeFull}, payload},
+	} {
+		if got := tc.policy.Payload([]byte(payload)); got != tc.want {
+			t.Errorf("%+v:\n got %s\nwant %s", tc.policy, got, tc.want)
+		}
+	}
+
+	// What is not JSON is redacted whole
+	if got := (Policy{Mode: ModeDrop}).Payload([]byte(`{"messages":[{"content":"cut sh`)); got != "[redacted]" {
+		t.Errorf("cut payload: %s", got)
+	}
+	if got := (Policy{Mode: ModeTruncate, MaxChars: 3}).Text("héllo"); got != "hél…[+2 chars]" {
+		t.Errorf("truncate: %s", got)
+	}
+}
+
+func TestHook(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(NewHook(Policy{Mode: ModeDrop}))
+
+	entry := logger.WithField(PromptField, "secret plans")
+	entry.WithField(PayloadField, []byte(`{"prompt":"secret plans","model":"m"}`)).Info("captured")
+	if got := out.String(); strings.Contains(got, "secret") || !strings.Contains(got, `"model\":\"m\"`) {
+		t.Errorf("logged %s", got)
+	}
+	// The entry the field was added to is left as it was
+	if entry.Data[PromptField] != "secret plans" {
+		t.Errorf("entry changed to %v", entry.Data[PromptField])
+	}
+}
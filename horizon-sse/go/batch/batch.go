@@ -0,0 +1,584 @@
+// Package batch simulates OpenAI's batch API: input files uploaded to
+// /v1/files, and batches over them under /v1/batches that run in the
+// background, a request at a time, while clients poll them. What each
+// request gets back is up to the server the Simulator is mounted on.
+//
+//	sim := batch.New(answer, clock, logger)
+//	sim.Route(router)
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"horizon-sse-go/server"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxFileBytes and MaxRequests are OpenAI's limits on a batch's input
+	// file.
+	MaxFileBytes = 200 << 20
+	MaxRequests  = 50000
+	// DefaultRate is how many requests of a batch run per second.
+	DefaultRate = 100
+)
+
+// Endpoints are the endpoints a batch can run requests against.
+var Endpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/embeddings":       true,
+	"/v1/moderations":      true,
+}
+
+// FileObject describes a file, uploaded for a batch or holding its
+// results, as /v1/files does.
+type FileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+// Batch is a batch as /v1/batches reports it. The times a batch has not
+// reached yet, and the files it has not written, are null.
+type Batch struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Endpoint         string            `json:"endpoint"`
+	Errors           *Errors           `json:"errors"`
+	InputFileID      string            `json:"input_file_id"`
+	CompletionWindow string            `json:"completion_window"`
+	Status           string            `json:"status"`
+	OutputFileID     *string           `json:"output_file_id"`
+	ErrorFileID      *string           `json:"error_file_id"`
+	CreatedAt        int64             `json:"created_at"`
+	InProgressAt     *int64            `json:"in_progress_at"`
+	CompletedAt      *int64            `json:"completed_at"`
+	FailedAt         *int64            `json:"failed_at"`
+	CancellingAt     *int64            `json:"cancelling_at"`
+	CancelledAt      *int64            `json:"cancelled_at"`
+	RequestCounts    Counts            `json:"request_counts"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// Counts counts the requests of a batch and how they went.
+type Counts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// Errors lists what is wrong with the input of a failed batch.
+type Errors struct {
+	Object string  `json:"object"`
+	Data   []Error `json:"data"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    *int   `json:"line"`
+}
+
+// Stats is what /metrics reports about batches.
+type Stats struct {
+	Submitted  int64 `json:"submitted"`
+	InProgress int64 `json:"in_progress"`
+	Completed  int64 `json:"completed"`
+	Failed     int64 `json:"failed"`
+	Cancelled  int64 `json:"cancelled"`
+	Requests   int64 `json:"requests"`
+	Files      int64 `json:"files"`
+	FileBytes  int64 `json:"file_bytes"`
+}
+
+// Answer answers one request of a batch: the status and body it would
+// have got on its own, without the wait.
+type Answer func(endpoint string, body json.RawMessage) (int, interface{})
+
+// line is one request of a batch's input file.
+type line struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+type storedFile struct {
+	FileObject
+	data []byte
+}
+
+// Simulator holds the files and batches of the batch API, in memory until
+// deleted, and runs the batches.
+type Simulator struct {
+	// Rate is how many requests of a batch run per second of the clock's
+	// time; DefaultRate if zero. A batch takes the rate it starts with.
+	Rate float64
+
+	answer Answer
+	clock  server.Clock
+	logger *logrus.Logger
+
+	mu       sync.Mutex
+	files    map[string]*storedFile
+	batches  map[string]*Batch
+	order    []*Batch                 // oldest first
+	cancels  map[string]chan struct{} // of the batches still running
+	requests int64
+}
+
+// New returns a Simulator that answers the requests of its batches with
+// answer, on clock's time.
+func New(answer Answer, clock server.Clock, logger *logrus.Logger) *Simulator {
+	return &Simulator{
+		answer:  answer,
+		clock:   clock,
+		logger:  logger,
+		files:   make(map[string]*storedFile),
+		batches: make(map[string]*Batch),
+		cancels: make(map[string]chan struct{}),
+	}
+}
+
+// Route adds the file and batch endpoints to router.
+func (s *Simulator) Route(router *mux.Router) {
+	router.HandleFunc("/v1/files", s.handleFileUpload).Methods("POST")
+	router.HandleFunc("/v1/files/{id}", s.handleFile).Methods("GET", "DELETE")
+	router.HandleFunc("/v1/files/{id}/content", s.handleFileContent).Methods("GET")
+	router.HandleFunc("/v1/batches", s.handleBatchCreate).Methods("POST")
+	router.HandleFunc("/v1/batches", s.handleBatchList).Methods("GET")
+	router.HandleFunc("/v1/batches/{id}", s.handleBatch).Methods("GET")
+	router.HandleFunc("/v1/batches/{id}/cancel", s.handleBatchCancel).Methods("POST")
+}
+
+// NewID returns a fresh ID for a file, batch or batch request.
+func NewID(prefix string) string {
+	return fmt.Sprintf("%s%016x", prefix, rand.Uint64())
+}
+
+func (s *Simulator) addFile(name, purpose string, data []byte, now int64) FileObject {
+	f := &storedFile{FileObject: FileObject{
+		ID:        NewID("file-"),
+		Object:    "file",
+		Bytes:     len(data),
+		CreatedAt: now,
+		Filename:  name,
+		Purpose:   purpose,
+	}, data: data}
+	s.mu.Lock()
+	s.files[f.ID] = f
+	s.mu.Unlock()
+	return f.FileObject
+}
+
+func (s *Simulator) file(id string) (*storedFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	return f, ok
+}
+
+// batch returns a copy of the batch with id, safe to encode while it runs.
+func (s *Simulator) batch(id string) (Batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	if !ok {
+		return Batch{}, false
+	}
+	return *b, true
+}
+
+// update changes the batch with id under the simulator's lock and returns
+// a copy of it.
+func (s *Simulator) update(id string, change func(b *Batch)) Batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.batches[id]
+	change(b)
+	return *b
+}
+
+// Stats counts the batches by state, the requests they have run and the
+// files held.
+func (s *Simulator) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := Stats{Submitted: int64(len(s.order)), Requests: s.requests, Files: int64(len(s.files))}
+	for _, b := range s.order {
+		switch b.Status {
+		case "validating", "in_progress", "cancelling":
+			stats.InProgress++
+		case "completed":
+			stats.Completed++
+		case "failed":
+			stats.Failed++
+		case "cancelled":
+			stats.Cancelled++
+		}
+	}
+	for _, f := range s.files {
+		stats.FileBytes += int64(f.Bytes)
+	}
+	return stats
+}
+
+// writeJSON answers a request with status and v.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers a request with an error in OpenAI's format.
+func writeError(w http.ResponseWriter, status int, message string) {
+	typ := "invalid_request_error"
+	if status != http.StatusBadRequest && status != http.StatusNotFound {
+		typ = "server_error"
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": typ, "code": nil},
+	})
+}
+
+// handleFileUpload takes a batch's input file, uploaded as OpenAI's
+// clients do: multipart, with purpose "batch".
+func (s *Simulator) handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxFileBytes+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid upload: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	if purpose := r.FormValue("purpose"); purpose != "batch" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported purpose %q, only batch files are taken", purpose))
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid upload: "+err.Error())
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, MaxFileBytes+1))
+	if err != nil || len(data) > MaxFileBytes {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Files are limited to %d bytes", MaxFileBytes))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.addFile(header.Filename, "batch", data, s.clock.Now().Unix()))
+}
+
+// handleFile describes a file, or with DELETE removes it.
+func (s *Simulator) handleFile(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	f, ok := s.file(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such File object: %s", id))
+		return
+	}
+	if r.Method == http.MethodDelete {
+		s.mu.Lock()
+		delete(s.files, id)
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "object": "file", "deleted": true})
+		return
+	}
+	writeJSON(w, http.StatusOK, f.FileObject)
+}
+
+// handleFileContent sends a file's content: an input file as uploaded, or
+// the JSONL results of a batch.
+func (s *Simulator) handleFileContent(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	f, ok := s.file(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such File object: %s", id))
+		return
+	}
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+	w.Write(f.data)
+}
+
+// handleBatchCreate starts a batch over an uploaded file. It runs in the
+// background, at Rate requests a second, while clients poll it.
+func (s *Simulator) handleBatchCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	switch {
+	case !Endpoints[req.Endpoint]:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported endpoint %q", req.Endpoint))
+		return
+	case req.CompletionWindow != "24h":
+		writeError(w, http.StatusBadRequest, "completion_window must be 24h")
+		return
+	}
+	input, ok := s.file(req.InputFileID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such File object: %s", req.InputFileID))
+		return
+	}
+	if input.Purpose != "batch" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("File %s is not a batch input file", input.ID))
+		return
+	}
+
+	b := &Batch{
+		ID:               NewID("batch_"),
+		Object:           "batch",
+		Endpoint:         req.Endpoint,
+		InputFileID:      input.ID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           "validating",
+		CreatedAt:        s.clock.Now().Unix(),
+		Metadata:         req.Metadata,
+	}
+	cancel := make(chan struct{})
+	s.mu.Lock()
+	s.batches[b.ID] = b
+	s.order = append(s.order, b)
+	s.cancels[b.ID] = cancel
+	created := *b
+	s.mu.Unlock()
+
+	s.logger.WithFields(logrus.Fields{
+		"batch_id": b.ID,
+		"endpoint": b.Endpoint,
+		"file_id":  input.ID,
+	}).Info("Batch submitted")
+	go s.run(b.ID, b.Endpoint, input.data, s.Rate, cancel)
+	writeJSON(w, http.StatusOK, created)
+}
+
+// handleBatch reports a batch's status.
+func (s *Simulator) handleBatch(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	b, ok := s.batch(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such Batch object: %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+// handleBatchList lists batches newest first, limit at a time (20 by
+// default), after the batch with ID after if given.
+func (s *Simulator) handleBatchList(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+	after := r.URL.Query().Get("after")
+	s.mu.Lock()
+	data := []Batch{}
+	more := false
+	for i := len(s.order) - 1; i >= 0; i-- {
+		b := s.order[i]
+		if after != "" {
+			if b.ID == after {
+				after = ""
+			}
+			continue
+		}
+		if len(data) == limit {
+			more = true
+			break
+		}
+		data = append(data, *b)
+	}
+	s.mu.Unlock()
+	list := map[string]interface{}{"object": "list", "data": data, "has_more": more, "first_id": nil, "last_id": nil}
+	if len(data) > 0 {
+		list["first_id"], list["last_id"] = data[0].ID, data[len(data)-1].ID
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleBatchCancel stops a running batch. It is "cancelling" until the
+// request in progress finishes, then "cancelled" with the results so far.
+func (s *Simulator) handleBatchCancel(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s.mu.Lock()
+	b, ok := s.batches[id]
+	cancel, running := s.cancels[id]
+	if ok && running && b.Status != "cancelling" {
+		now := s.clock.Now().Unix()
+		b.Status, b.CancellingAt = "cancelling", &now
+		close(cancel)
+	}
+	var snapshot Batch
+	if ok {
+		snapshot = *b
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such Batch object: %s", id))
+	case !running:
+		writeError(w, http.StatusConflict, fmt.Sprintf("Cannot cancel a batch that is %s", snapshot.Status))
+	default:
+		writeJSON(w, http.StatusOK, snapshot)
+	}
+}
+
+// parseInput reads the requests of an input file, one JSON object a line,
+// or lists what is wrong with it.
+func parseInput(endpoint string, data []byte) ([]line, []Error) {
+	var lines []line
+	var errs []Error
+	seen := make(map[string]bool)
+	fail := func(n int, code, message string) {
+		line := n
+		errs = append(errs, Error{Code: code, Message: message, Line: &line})
+	}
+	for i, raw := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		n := i + 1
+		var l line
+		switch err := json.Unmarshal(raw, &l); {
+		case err != nil:
+			fail(n, "invalid_json_line", "This line is not parseable as valid JSON.")
+		case l.CustomID == "":
+			fail(n, "missing_required_parameter", "custom_id is required.")
+		case seen[l.CustomID]:
+			fail(n, "duplicate_custom_id", fmt.Sprintf("The custom_id %s is used more than once.", l.CustomID))
+		case l.Method != http.MethodPost:
+			fail(n, "invalid_method", "method must be POST.")
+		case l.URL != endpoint:
+			fail(n, "mismatched_endpoint", fmt.Sprintf("The url %s does not match the batch's endpoint %s.", l.URL, endpoint))
+		case len(l.Body) == 0 || l.Body[0] != '{':
+			fail(n, "missing_required_parameter", "body must be a JSON object.")
+		default:
+			seen[l.CustomID] = true
+			lines = append(lines, l)
+		}
+	}
+	switch {
+	case len(errs) > 0:
+	case len(lines) == 0:
+		errs = append(errs, Error{Code: "empty_file", Message: "The input file has no requests."})
+	case len(lines) > MaxRequests:
+		errs = append(errs, Error{Code: "too_many_requests", Message: fmt.Sprintf("A batch holds at most %d requests.", MaxRequests)})
+	}
+	return lines, errs
+}
+
+// run runs the requests of a batch, one every 1/rate seconds of the
+// clock's time, and writes their results to an output file and, for those
+// that failed, an error file.
+func (s *Simulator) run(id, endpoint string, input []byte, rate float64, cancel chan struct{}) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.cancels, id)
+		s.mu.Unlock()
+	}()
+	lines, errs := parseInput(endpoint, input)
+	if len(errs) > 0 {
+		s.update(id, func(b *Batch) {
+			now := s.clock.Now().Unix()
+			b.Status, b.FailedAt = "failed", &now
+			b.Errors = &Errors{Object: "list", Data: errs}
+		})
+		s.logger.WithFields(logrus.Fields{"batch_id": id, "errors": len(errs)}).Warn("Batch input invalid")
+		return
+	}
+	s.update(id, func(b *Batch) {
+		now := s.clock.Now().Unix()
+		b.Status, b.InProgressAt = "in_progress", &now
+		b.RequestCounts.Total = len(lines)
+	})
+
+	if rate <= 0 {
+		rate = DefaultRate
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	var output, errorOutput bytes.Buffer
+	cancelled := false
+	for _, l := range lines {
+		select {
+		case <-cancel:
+			cancelled = true
+		case <-s.clock.After(interval):
+		}
+		if cancelled {
+			break
+		}
+		status, body := s.answer(endpoint, l.Body)
+		data, _ := json.Marshal(map[string]interface{}{
+			"id":        NewID("batch_req_"),
+			"custom_id": l.CustomID,
+			"response": map[string]interface{}{
+				"status_code": status,
+				"request_id":  NewID("req_"),
+				"body":        body,
+			},
+			"error": nil,
+		})
+		out := &output
+		if status != http.StatusOK {
+			out = &errorOutput
+		}
+		out.Write(data)
+		out.WriteByte('\n')
+		s.update(id, func(b *Batch) {
+			s.requests++
+			if status == http.StatusOK {
+				b.RequestCounts.Completed++
+			} else {
+				b.RequestCounts.Failed++
+			}
+		})
+	}
+
+	now := s.clock.Now().Unix()
+	var outputID, errorID *string
+	if output.Len() > 0 {
+		f := s.addFile(id+"_output.jsonl", "batch_output", output.Bytes(), now)
+		outputID = &f.ID
+	}
+	if errorOutput.Len() > 0 {
+		f := s.addFile(id+"_error.jsonl", "batch_output", errorOutput.Bytes(), now)
+		errorID = &f.ID
+	}
+	b := s.update(id, func(b *Batch) {
+		b.OutputFileID, b.ErrorFileID = outputID, errorID
+		if cancelled {
+			b.Status, b.CancelledAt = "cancelled", &now
+		} else {
+			b.Status, b.CompletedAt = "completed", &now
+		}
+	})
+	s.logger.WithFields(logrus.Fields{
+		"batch_id":  id,
+		"status":    b.Status,
+		"completed": b.RequestCounts.Completed,
+		"failed":    b.RequestCounts.Failed,
+	}).Info("Batch finished")
+}
@@ -0,0 +1,153 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"horizon-sse-go/server"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func newSimulator(answer Answer) (*Simulator, http.Handler) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	sim := New(answer, server.NewScaledClock(1000), logger)
+	router := mux.NewRouter()
+	sim.Route(router)
+	return sim, router
+}
+
+// upload uploads lines as a batch input file and returns its ID.
+func upload(t *testing.T, h http.Handler, lines ...string) string {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", "batch")
+	part, _ := form.CreateFormFile("file", "input.jsonl")
+	io.WriteString(part, strings.Join(lines, "\n")+"\n")
+	form.Close()
+	r := httptest.NewRequest("POST", "/v1/files", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var file FileObject
+	if err := json.Unmarshal(w.Body.Bytes(), &file); err != nil || w.Code != 200 || file.Purpose != "batch" {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	return file.ID
+}
+
+// wait polls a batch until it has finished.
+func wait(t *testing.T, h http.Handler, id string) Batch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/batches/"+id, nil))
+		var b Batch
+		if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil {
+			t.Fatalf("batch: %d %s", w.Code, w.Body)
+		}
+		switch b.Status {
+		case "completed", "failed", "cancelled":
+			return b
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batch still %s", b.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	sim, h := newSimulator(func(endpoint string, body json.RawMessage) (int, interface{}) {
+		if strings.Contains(string(body), "missing") {
+			return http.StatusNotFound, map[string]string{"error": "no such model"}
+		}
+		return http.StatusOK, map[string]string{"endpoint": endpoint}
+	})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	create := func(file, endpoint string) Batch {
+		w := do("POST", "/v1/batches", `{"input_file_id":"`+file+`","endpoint":"`+endpoint+`","completion_window":"24h"}`)
+		var b Batch
+		if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil || w.Code != 200 || b.Status != "validating" {
+			t.Fatalf("create: %d %s", w.Code, w.Body)
+		}
+		return b
+	}
+
+	file := upload(t, h,
+		`{"custom_id":"a","method":"POST","url":"/v1/embeddings","body":{"model":"small"}}`,
+		`{"custom_id":"b","method":"POST","url":"/v1/embeddings","body":{"model":"missing"}}`,
+	)
+	b := wait(t, h, create(file, "/v1/embeddings").ID)
+	if b.Status != "completed" || b.RequestCounts != (Counts{Total: 2, Completed: 1, Failed: 1}) || b.OutputFileID == nil || b.ErrorFileID == nil {
+		t.Fatalf("batch %+v", b)
+	}
+	if w := do("GET", "/v1/files/"+*b.OutputFileID+"/content", ""); !strings.Contains(w.Body.String(), `"custom_id":"a"`) ||
+		!strings.Contains(w.Body.String(), `"body":{"endpoint":"/v1/embeddings"}`) {
+		t.Errorf("output: %s", w.Body)
+	}
+	if w := do("GET", "/v1/files/"+*b.ErrorFileID+"/content", ""); !strings.Contains(w.Body.String(), `"status_code":404`) {
+		t.Errorf("errors: %s", w.Body)
+	}
+
+	// Invalid input fails the whole batch, line by line
+	file = upload(t, h,
+		`{"custom_id":"a","method":"POST","url":"/v1/embeddings","body":{}}`,
+		`{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{}}`,
+		`not json`,
+	)
+	b = wait(t, h, create(file, "/v1/chat/completions").ID)
+	if b.Status != "failed" || b.Errors == nil || len(b.Errors.Data) != 2 || *b.Errors.Data[1].Line != 3 {
+		t.Errorf("invalid batch %+v", b)
+	}
+	for body, want := range map[string]int{
+		`{"input_file_id":"file-x","endpoint":"/v1/embeddings","completion_window":"24h"}`:      http.StatusNotFound,
+		`{"input_file_id":"` + file + `","endpoint":"/v1/images","completion_window":"24h"}`:    http.StatusBadRequest,
+		`{"input_file_id":"` + file + `","endpoint":"/v1/embeddings","completion_window":"1h"}`: http.StatusBadRequest,
+	} {
+		if w := do("POST", "/v1/batches", body); w.Code != want {
+			t.Errorf("%s: %d, want %d", body, w.Code, want)
+		}
+	}
+
+	w := do("GET", "/v1/batches?limit=1", "")
+	var list struct {
+		Data    []Batch `json:"data"`
+		HasMore bool    `json:"has_more"`
+	}
+	if json.Unmarshal(w.Body.Bytes(), &list); len(list.Data) != 1 || list.Data[0].Status != "failed" || !list.HasMore {
+		t.Errorf("list: %s", w.Body)
+	}
+
+	// A slow batch is cancelled with what it has done
+	sim.Rate = 0.001
+	file = upload(t, h, `{"custom_id":"a","method":"POST","url":"/v1/moderations","body":{"input":"x"}}`)
+	id := create(file, "/v1/moderations").ID
+	if w := do("POST", "/v1/batches/"+id+"/cancel", ""); w.Code != 200 {
+		t.Errorf("cancel: %d %s", w.Code, w.Body)
+	}
+	if b := wait(t, h, id); b.Status != "cancelled" || b.CancelledAt == nil || b.RequestCounts.Completed != 0 {
+		t.Errorf("cancelled batch %+v", b)
+	}
+	if w := do("POST", "/v1/batches/"+id+"/cancel", ""); w.Code != http.StatusConflict {
+		t.Errorf("cancel again: %d", w.Code)
+	}
+
+	if st := sim.Stats(); st.Submitted != 3 || st.Completed != 1 || st.Failed != 1 || st.Cancelled != 1 || st.Requests != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AnomalyConfig tunes an AnomalyDetector.
+type AnomalyConfig struct {
+	// Window is how long each rate is measured over.
+	Window time.Duration
+	// Baseline is how many earlier windows a window is compared with.
+	Baseline int
+	// Threshold is how many times its baseline a rate must reach to be
+	// anomalous.
+	Threshold float64
+	// MinSamples is the fewest observations a window needs to be judged;
+	// quieter windows are skipped and left out of the baseline.
+	MinSamples int
+	// Webhook, if set, is POSTed each anomaly as JSON.
+	Webhook string
+}
+
+// DefaultAnomalyConfig compares 5s windows with the minute before them.
+var DefaultAnomalyConfig = AnomalyConfig{
+	Window:     5 * time.Second,
+	Baseline:   12,
+	Threshold:  3,
+	MinSamples: 10,
+}
+
+// anomalyFloors are the least a rate must rise above its baseline, besides
+// the ratio, to be anomalous: a baseline of no failures would otherwise
+// make the first one a spike.
+var anomalyFloors = map[string]float64{
+	"failure_rate":    0.05,
+	"disconnect_rate": 0.05,
+	"ttfb_p95_ms":     50,
+}
+
+// Anomaly is a rate that rose sharply above its recent baseline.
+type Anomaly struct {
+	Time     time.Time `json:"time"`
+	Metric   string    `json:"metric"`
+	Value    float64   `json:"value"`
+	Baseline float64   `json:"baseline"`
+	Ratio    float64   `json:"ratio"`
+	Samples  int       `json:"samples"`
+}
+
+// AnomalyDetector watches the failure rate, disconnect rate and TTFB p95
+// of a load test window by window, and warns when one deviates sharply
+// from the windows before it, before the run's final numbers would show
+// it. A nil detector observes nothing.
+type AnomalyDetector struct {
+	cfg    AnomalyConfig
+	logger logrus.FieldLogger
+	client *http.Client
+
+	mu      sync.Mutex
+	window  anomalyWindow
+	history map[string][]float64 // recent normal values, oldest first
+	firing  map[string]bool
+	alerts  []Anomaly
+}
+
+type anomalyWindow struct {
+	completed, failed, disconnected int
+	ttfbs                           []time.Duration
+}
+
+// NewAnomalyDetector returns a detector logging to logger. Zero fields of
+// cfg take their DefaultAnomalyConfig values.
+func NewAnomalyDetector(cfg AnomalyConfig, logger logrus.FieldLogger) *AnomalyDetector {
+	def := DefaultAnomalyConfig
+	if cfg.Window <= 0 {
+		cfg.Window = def.Window
+	}
+	if cfg.Baseline <= 0 {
+		cfg.Baseline = def.Baseline
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = def.Threshold
+	}
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = def.MinSamples
+	}
+	return &AnomalyDetector{
+		cfg:     cfg,
+		logger:  logger,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		history: make(map[string][]float64),
+		firing:  make(map[string]bool),
+	}
+}
+
+// observeTTFB records a client's first data arriving, as it happens rather
+// than when the client finishes.
+func (d *AnomalyDetector) observeTTFB(ttfb time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.window.ttfbs = append(d.window.ttfbs, ttfb)
+	d.mu.Unlock()
+}
+
+// observeResult records a finished client. Clients that hung up on
+// purpose are neither failures nor disconnects; a disconnect is a failed
+// client whose stream had started.
+func (d *AnomalyDetector) observeResult(r ClientResult) {
+	if d == nil || r.Aborted {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.window.completed++
+	if !r.Success {
+		d.window.failed++
+		if r.MessageCount > 0 && !r.TimedOut {
+			d.window.disconnected++
+		}
+	}
+}
+
+// Run closes a window every cfg.Window until ctx is done.
+func (d *AnomalyDetector) Run(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	ticker := time.NewTicker(d.cfg.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, a := range d.roll(now) {
+				d.report(a)
+			}
+		}
+	}
+}
+
+// roll closes the current window and returns the rates in it that are
+// anomalous. A rate alerts once when it turns anomalous, not on every
+// window it stays so, and anomalous windows stay out of the baseline.
+func (d *AnomalyDetector) roll(now time.Time) []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := d.window
+	d.window = anomalyWindow{}
+
+	var found []Anomaly
+	check := func(metric string, value float64, samples int) {
+		if samples < d.cfg.MinSamples {
+			return
+		}
+		past := d.history[metric]
+		if len(past) == d.cfg.Baseline {
+			var baseline float64
+			for _, v := range past {
+				baseline += v
+			}
+			baseline /= float64(len(past))
+			if value >= baseline*d.cfg.Threshold && value-baseline >= anomalyFloors[metric] {
+				if !d.firing[metric] {
+					a := Anomaly{Time: now, Metric: metric, Value: value, Baseline: baseline, Samples: samples}
+					if baseline > 0 {
+						a.Ratio = value / baseline
+					}
+					found = append(found, a)
+					d.alerts = append(d.alerts, a)
+				}
+				d.firing[metric] = true
+				return
+			}
+			d.firing[metric] = false
+			past = past[1:]
+		}
+		d.history[metric] = append(past, value)
+	}
+
+	if w.completed > 0 {
+		check("failure_rate", float64(w.failed)/float64(w.completed), w.completed)
+		check("disconnect_rate", float64(w.disconnected)/float64(w.completed), w.completed)
+	}
+	if len(w.ttfbs) > 0 {
+		sort.Slice(w.ttfbs, func(i, j int) bool { return w.ttfbs[i] < w.ttfbs[j] })
+		p95 := percentile(w.ttfbs, 95)
+		check("ttfb_p95_ms", float64(p95)/float64(time.Millisecond), len(w.ttfbs))
+	}
+	return found
+}
+
+// report logs an anomaly and sends it to the webhook, if any.
+func (d *AnomalyDetector) report(a Anomaly) {
+	d.logger.WithFields(logrus.Fields{
+		"metric":   a.Metric,
+		"value":    fmt.Sprintf("%.3f", a.Value),
+		"baseline": fmt.Sprintf("%.3f", a.Baseline),
+		"ratio":    fmt.Sprintf("%.1f", a.Ratio),
+		"samples":  a.Samples,
+	}).Warn("Anomaly: rate deviates sharply from its recent baseline")
+	if d.cfg.Webhook == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(a)
+		if err != nil {
+			return
+		}
+		resp, err := d.client.Post(d.cfg.Webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			d.logger.WithError(err).Error("Failed to send anomaly webhook")
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			d.logger.WithField("status", resp.StatusCode).Error("Anomaly webhook rejected")
+		}
+	}()
+}
+
+// Alerts returns the anomalies found so far.
+func (d *AnomalyDetector) Alerts() []Anomaly {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Anomaly{}, d.alerts...)
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// feed adds a window of results with the given failures, of which
+// disconnects had started streaming, and TTFBs of ttfb.
+func feed(d *AnomalyDetector, clients, failures, disconnects int, ttfb time.Duration) {
+	for i := 0; i < clients; i++ {
+		r := ClientResult{Success: i >= failures}
+		if i < disconnects {
+			r.MessageCount = 3
+			r.Error = errors.New("stream ended without completion marker")
+		}
+		d.observeTTFB(ttfb)
+		d.observeResult(r)
+	}
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	d := NewAnomalyDetector(AnomalyConfig{Baseline: 3, Threshold: 3, MinSamples: 10}, logger)
+	now := time.Now()
+
+	// Until the baseline is full nothing is judged
+	feed(d, 20, 10, 0, 100*time.Millisecond)
+	if found := d.roll(now); len(found) != 0 {
+		t.Fatalf("anomalies without a baseline: %+v", found)
+	}
+	for i := 0; i < 2; i++ {
+		feed(d, 20, 1, 0, 100*time.Millisecond)
+		d.roll(now)
+	}
+	// Too few clients to judge, and kept out of the baseline
+	feed(d, 5, 5, 5, time.Second)
+	if found := d.roll(now); len(found) != 0 {
+		t.Fatalf("anomalies in a quiet window: %+v", found)
+	}
+
+	feed(d, 20, 10, 8, 800*time.Millisecond)
+	found := d.roll(now)
+	got := make(map[string]Anomaly)
+	for _, a := range found {
+		got[a.Metric] = a
+	}
+	if a, ok := got["disconnect_rate"]; !ok || a.Value != 0.4 || a.Baseline != 0 {
+		t.Errorf("disconnect_rate anomaly = %+v", a)
+	}
+	if a, ok := got["ttfb_p95_ms"]; !ok || a.Value != 800 {
+		t.Errorf("ttfb_p95_ms anomaly = %+v", a)
+	}
+	// The first window's failures are in the baseline: 50%, 5%, 5% make
+	// 20%, which 50% does not triple
+	if _, ok := got["failure_rate"]; ok {
+		t.Errorf("failure_rate reported against a high baseline")
+	}
+
+	// Still anomalous: no new alert
+	feed(d, 20, 10, 8, 800*time.Millisecond)
+	if found := d.roll(now); len(found) != 0 {
+		t.Errorf("alerted again while still anomalous: %+v", found)
+	}
+	// Back to normal, then anomalous again: a new alert
+	feed(d, 20, 1, 0, 100*time.Millisecond)
+	d.roll(now)
+	feed(d, 20, 10, 8, 100*time.Millisecond)
+	if found := d.roll(now); len(found) != 1 || found[0].Metric != "disconnect_rate" {
+		t.Errorf("after recovering: %+v, want one disconnect_rate anomaly", found)
+	}
+	if n := len(d.Alerts()); n != 3 {
+		t.Errorf("%d alerts recorded, want 3", n)
+	}
+}
+
+func TestAnomalyWebhook(t *testing.T) {
+	received := make(chan Anomaly, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Anomaly
+		json.NewDecoder(r.Body).Decode(&a)
+		received <- a
+	}))
+	defer srv.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	d := NewAnomalyDetector(AnomalyConfig{Webhook: srv.URL}, logger)
+	d.report(Anomaly{Metric: "failure_rate", Value: 0.5, Baseline: 0.1, Ratio: 5})
+	select {
+	case a := <-received:
+		if a.Metric != "failure_rate" || a.Ratio != 5 {
+			t.Errorf("webhook got %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
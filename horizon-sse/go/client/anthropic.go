@@ -0,0 +1,208 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// AnthropicEvent is one event of an Anthropic Messages stream. Which fields
+// are set depends on Type.
+type AnthropicEvent struct {
+	Type         string                 `json:"type"`
+	Message      *AnthropicMessage      `json:"message,omitempty"`
+	Index        int                    `json:"index"`
+	ContentBlock *AnthropicContentBlock `json:"content_block,omitempty"`
+	Delta        *AnthropicDelta        `json:"delta,omitempty"`
+	Usage        *AnthropicUsage        `json:"usage,omitempty"`
+	Error        *AnthropicError        `json:"error,omitempty"`
+}
+
+// AnthropicMessage is the message a stream describes. message_start carries
+// it with empty content; the accumulator fills in the rest.
+type AnthropicMessage struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   string                  `json:"stop_reason,omitempty"`
+	StopSequence string                  `json:"stop_sequence,omitempty"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// AnthropicContentBlock is a text or tool_use block. Input holds the tool
+// arguments once all of their input_json_delta fragments have arrived.
+type AnthropicContentBlock struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+// AnthropicDelta is the delta of content_block_delta (text_delta or
+// input_json_delta) and of message_delta (stop reason).
+type AnthropicDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	PartialJSON  string  `json:"partial_json,omitempty"`
+	StopReason   *string `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicError is the payload of an error event sent mid-stream.
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (e *AnthropicError) Error() string {
+	return fmt.Sprintf("client: anthropic %s: %s", e.Type, e.Message)
+}
+
+// Is reports the error event as ErrStreamError.
+func (e *AnthropicError) Is(target error) bool {
+	return target == ErrStreamError
+}
+
+// DecodeAnthropicEvent decodes one stream event. eventType is the SSE event
+// name; it is used when the payload does not repeat it. It returns
+// ErrStreamDone for message_stop.
+func DecodeAnthropicEvent(eventType, data string) (*AnthropicEvent, error) {
+	var ev AnthropicEvent
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		return nil, err
+	}
+	if ev.Type == "" {
+		ev.Type = eventType
+	}
+	if ev.Type == "message_stop" {
+		return &ev, ErrStreamDone
+	}
+	return &ev, nil
+}
+
+// AnthropicAccumulator merges stream events into an AnthropicMessage.
+// The zero value is ready to use.
+type AnthropicAccumulator struct {
+	message AnthropicMessage
+	blocks  map[int]*accumulatedBlock
+}
+
+type accumulatedBlock struct {
+	block       AnthropicContentBlock
+	partialJSON strings.Builder
+}
+
+// Add merges ev into the accumulated message. It returns the stream's error
+// for error events.
+func (a *AnthropicAccumulator) Add(ev *AnthropicEvent) error {
+	if a.blocks == nil {
+		a.blocks = make(map[int]*accumulatedBlock)
+	}
+
+	switch ev.Type {
+	case "message_start":
+		if ev.Message != nil {
+			a.message = *ev.Message
+			a.message.Content = nil
+		}
+	case "content_block_start":
+		acc := &accumulatedBlock{}
+		if ev.ContentBlock != nil {
+			acc.block = *ev.ContentBlock
+		}
+		a.blocks[ev.Index] = acc
+	case "content_block_delta":
+		acc, ok := a.blocks[ev.Index]
+		if !ok {
+			acc = &accumulatedBlock{block: AnthropicContentBlock{Type: "text"}}
+			a.blocks[ev.Index] = acc
+		}
+		if ev.Delta != nil {
+			acc.block.Text += ev.Delta.Text
+			acc.partialJSON.WriteString(ev.Delta.PartialJSON)
+		}
+	case "message_delta":
+		if ev.Delta != nil {
+			if ev.Delta.StopReason != nil {
+				a.message.StopReason = *ev.Delta.StopReason
+			}
+			if ev.Delta.StopSequence != nil {
+				a.message.StopSequence = *ev.Delta.StopSequence
+			}
+		}
+		if ev.Usage != nil {
+			// message_delta usage is cumulative
+			a.message.Usage.OutputTokens = ev.Usage.OutputTokens
+			if ev.Usage.InputTokens > 0 {
+				a.message.Usage.InputTokens = ev.Usage.InputTokens
+			}
+		}
+	case "error":
+		if ev.Error != nil {
+			return ev.Error
+		}
+		return ErrStreamError
+	}
+	return nil
+}
+
+// Result returns the message accumulated so far.
+func (a *AnthropicAccumulator) Result() *AnthropicMessage {
+	result := a.message
+	if result.Role == "" {
+		result.Role = "assistant"
+	}
+
+	indexes := make([]int, 0, len(a.blocks))
+	for i := range a.blocks {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	result.Content = make([]AnthropicContentBlock, 0, len(indexes))
+	for _, i := range indexes {
+		acc := a.blocks[i]
+		block := acc.block
+		if acc.partialJSON.Len() > 0 {
+			block.Input = json.RawMessage(acc.partialJSON.String())
+		}
+		result.Content = append(result.Content, block)
+	}
+	return &result
+}
+
+// DecodeAnthropicStream reads an Anthropic SSE stream from r, calling fn (if
+// not nil) for every event, and returns the accumulated message once the
+// stream ends.
+func DecodeAnthropicStream(r io.Reader, fn func(*AnthropicEvent) error) (*AnthropicMessage, error) {
+	var acc AnthropicAccumulator
+	err := readEvents(r, func(sse Event) error {
+		ev, decodeErr := DecodeAnthropicEvent(sse.Type, sse.Data)
+		if ev == nil {
+			return decodeErr
+		}
+		if err := acc.Add(ev); err != nil {
+			return err
+		}
+		if fn != nil {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		return decodeErr
+	})
+	if err != nil && err != ErrStreamDone {
+		return acc.Result(), err
+	}
+	return acc.Result(), nil
+}
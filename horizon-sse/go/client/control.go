@@ -0,0 +1,230 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrNoRun is returned by the control methods when no load test is running.
+var ErrNoRun = errors.New("client: no load test running")
+
+// LoadTestPhase is where a load test run is.
+type LoadTestPhase string
+
+const (
+	PhaseIdle    LoadTestPhase = "idle"
+	PhaseRamping LoadTestPhase = "ramping"
+	PhasePaused  LoadTestPhase = "paused"
+	// PhaseHolding means every client has been spawned and the run is
+	// waiting for their streams to finish.
+	PhaseHolding LoadTestPhase = "holding"
+	PhaseDone    LoadTestPhase = "done"
+	PhaseAborted LoadTestPhase = "aborted"
+)
+
+// LoadTestProgress is a snapshot of a load test run.
+type LoadTestProgress struct {
+	Phase      LoadTestPhase `json:"phase"`
+	Target     int           `json:"target"`
+	Spawned    int           `json:"spawned"`
+	Active     int64         `json:"active"`
+	Successful int64         `json:"successful"`
+	Failed     int64         `json:"failed"`
+	TimedOut   int64         `json:"timed_out"`
+	// ErrorRate is failed / (successful + failed), over finished clients.
+	ErrorRate float64 `json:"error_rate"`
+	Elapsed   string  `json:"elapsed"`
+}
+
+// loadRun is the control state of the run in progress.
+type loadRun struct {
+	scheduler *arrivalScheduler
+	cancel    func()
+	started   time.Time
+
+	mu      sync.Mutex
+	aborted bool
+	done    bool
+}
+
+func (c *SSEClient) currentRun() *loadRun {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	return c.run
+}
+
+// Progress reports the phase and counters of the current or last run.
+func (c *SSEClient) Progress() LoadTestProgress {
+	p := LoadTestProgress{
+		Phase:      PhaseIdle,
+		Active:     atomic.LoadInt64(&c.activeClients),
+		Successful: atomic.LoadInt64(&c.successfulClients),
+		Failed:     atomic.LoadInt64(&c.failedClients),
+		TimedOut:   atomic.LoadInt64(&c.timedOutClients),
+	}
+	if finished := p.Successful + p.Failed; finished > 0 {
+		p.ErrorRate = float64(p.Failed) / float64(finished)
+	}
+
+	run := c.currentRun()
+	if run == nil {
+		return p
+	}
+	st := run.scheduler.state()
+	p.Target = st.target
+	p.Spawned = st.spawned
+	p.Elapsed = time.Since(run.started).Round(time.Millisecond).String()
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	switch {
+	case run.aborted:
+		p.Phase = PhaseAborted
+	case run.done:
+		p.Phase = PhaseDone
+	case st.paused:
+		p.Phase = PhasePaused
+	case st.spawned < st.target:
+		p.Phase = PhaseRamping
+	default:
+		p.Phase = PhaseHolding
+	}
+	return p
+}
+
+// Pause stops spawning new clients; running clients are unaffected.
+func (c *SSEClient) Pause() error {
+	run := c.currentRun()
+	if run == nil {
+		return ErrNoRun
+	}
+	run.scheduler.setPaused(true)
+	c.logger.Info("Load test paused")
+	return nil
+}
+
+// Resume continues spawning at the configured interval.
+func (c *SSEClient) Resume() error {
+	run := c.currentRun()
+	if run == nil {
+		return ErrNoRun
+	}
+	run.scheduler.setPaused(false)
+	c.logger.Info("Load test resumed")
+	return nil
+}
+
+// RampTo changes the total number of clients to spawn. New clients arrive
+// at the configured interval; a target below the number already spawned
+// just stops spawning. It returns the effective target.
+func (c *SSEClient) RampTo(n int) (int, error) {
+	run := c.currentRun()
+	if run == nil {
+		return 0, ErrNoRun
+	}
+	target := run.scheduler.setTarget(n)
+	c.logger.WithField("target", target).Info("Load test target changed")
+	return target, nil
+}
+
+// Abort cancels every running client and stops the run; results are still
+// reported.
+func (c *SSEClient) Abort() error {
+	run := c.currentRun()
+	if run == nil {
+		return ErrNoRun
+	}
+	run.mu.Lock()
+	run.aborted = true
+	run.mu.Unlock()
+	run.cancel()
+	c.logger.Warn("Load test aborted")
+	return nil
+}
+
+// ControlHandler serves the remote control interface of a load test:
+//
+//	GET  /status           progress as JSON
+//	GET  /events           progress as a server-sent event stream
+//	POST /pause, /resume   stop and restart spawning
+//	POST /ramp?clients=N   change the total number of clients
+//	POST /abort            cancel the run
+func (c *SSEClient) ControlHandler() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/status", c.handleStatus).Methods("GET")
+	router.HandleFunc("/events", c.handleProgressEvents).Methods("GET")
+	router.HandleFunc("/pause", c.handleControl(func(*http.Request) error { return c.Pause() })).Methods("POST")
+	router.HandleFunc("/resume", c.handleControl(func(*http.Request) error { return c.Resume() })).Methods("POST")
+	router.HandleFunc("/abort", c.handleControl(func(*http.Request) error { return c.Abort() })).Methods("POST")
+	router.HandleFunc("/ramp", c.handleControl(func(r *http.Request) error {
+		n, err := strconv.Atoi(r.URL.Query().Get("clients"))
+		if err != nil || n < 0 {
+			return fmt.Errorf("clients must be a non-negative integer")
+		}
+		_, err = c.RampTo(n)
+		return err
+	})).Methods("POST")
+	return router
+}
+
+func (c *SSEClient) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Progress())
+}
+
+func (c *SSEClient) handleControl(action func(*http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := action(r); err != nil {
+			status := http.StatusBadRequest
+			if err == ErrNoRun {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		c.handleStatus(w, r)
+	}
+}
+
+// handleProgressEvents sends a progress event every second until the client
+// disconnects or the run ends.
+func (c *SSEClient) handleProgressEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		progress := c.Progress()
+		data, _ := json.Marshal(progress)
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+		if progress.Phase == PhaseDone || progress.Phase == PhaseAborted {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
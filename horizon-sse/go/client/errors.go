@@ -0,0 +1,49 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors the clients report, for callers to tell failures apart with
+// errors.Is rather than by their messages. Errors of one feature, such as
+// ErrHostLimit, are declared next to it.
+var (
+	// ErrUpstreamUnavailable is matched by a StatusError of 502, 503 or
+	// 504: the server answered, but what it fronts could not.
+	ErrUpstreamUnavailable = errors.New("client: upstream unavailable")
+	// ErrStreamTruncated is returned for a stream that ended without its
+	// completion marker.
+	ErrStreamTruncated = errors.New("client: stream ended without completion marker")
+	// ErrStreamError is matched by the error events of a stream, with or
+	// without an AnthropicError describing them.
+	ErrStreamError = errors.New("client: stream error event")
+	// ErrAbortNotPropagated is returned when the upstream side of a stream
+	// a client hung up on stayed active past the abort bound.
+	ErrAbortNotPropagated = errors.New("client: upstream stream still active after the client hung up")
+)
+
+// StatusError is a response with a status other than the one expected,
+// over HTTP or as the close code of a WebSocket. Reason is the close
+// reason, if any.
+type StatusError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *StatusError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("unexpected status code: %d (%s)", e.StatusCode, e.Reason)
+	}
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// Is reports a gateway status as ErrUpstreamUnavailable.
+func (e *StatusError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return target == ErrUpstreamUnavailable
+	}
+	return false
+}
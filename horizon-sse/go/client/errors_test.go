@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Callers can tell failures apart by their errors rather than messages.
+func TestErrors(t *testing.T) {
+	for code, unavailable := range map[int]bool{
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+		http.StatusNotFound:            false,
+		http.StatusInternalServerError: false,
+	} {
+		err := error(&StatusError{StatusCode: code})
+		if errors.Is(err, ErrUpstreamUnavailable) != unavailable {
+			t.Errorf("%d: unavailable is %v", code, !unavailable)
+		}
+	}
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	pool := NewPool(PoolConfig{ReconnectDelay: 10 * time.Millisecond, MaxReconnectDelay: time.Second})
+	defer pool.Close()
+	sub, err := pool.Subscribe(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range sub.Events {
+	}
+	var status *StatusError
+	if !errors.As(sub.Err(), &status) || status.StatusCode != http.StatusNotFound {
+		t.Errorf("subscription to a 404 ended with %v", sub.Err())
+	}
+
+	sr := NewStreamReader(strings.NewReader("data: {\"choices\":[]}\n\n"), DialectAuto)
+	for err == nil {
+		_, err = sr.Next()
+	}
+	if !errors.Is(err, ErrStreamTruncated) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated stream: %v", err)
+	}
+
+	for _, data := range []string{"{}", `{"type":"error","error":{"type":"overloaded_error","message":"busy"}}`} {
+		sr := NewStreamReader(strings.NewReader("event: error\ndata: "+data+"\n\n"), DialectAnthropic)
+		if _, err := sr.Next(); !errors.Is(err, ErrStreamError) {
+			t.Errorf("error event %s: %v", data, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is one server-sent event.
+type Event struct {
+	// ID is the event's id field, empty if it had none.
+	ID   string
+	Type string
+	Data string
+	// Channel is the broadcast channel the event was published on, from
+	// the channel field of a server's multi-channel subscriptions.
+	Channel string
+	// LastEventID is the id to resume the stream from after this event:
+	// the last id field the stream sent, with this event or before it.
+	LastEventID string
+	// Retry is the reconnection delay the stream last asked for with a
+	// retry field, zero if it has not.
+	Retry time.Duration
+	// Proto is the decoded payload of a protobuf event, on subscriptions
+	// of a Pool with DecodeProto set.
+	Proto *ProtoEvent
+}
+
+// maxLineSize is the longest line the client reads, enough for
+// multi-megabyte events.
+const maxLineSize = 8 << 20
+
+// eventReader reads SSE events one at a time, as the HTML event stream
+// parser does: lines end in CRLF, LF or a lone CR, comments and unknown
+// fields are skipped, data lines of an event are joined with newlines,
+// and the last id and retry carry over to the events after them.
+type eventReader struct {
+	scanner *bufio.Scanner
+	started bool
+	lastID  string
+	retry   time.Duration
+}
+
+func newEventReader(r io.Reader) *eventReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	scanner.Split(scanLines())
+	return &eventReader{scanner: scanner}
+}
+
+// scanLines splits the lines of an event stream. A CR ends its line at
+// once, rather than after waiting for the next byte to see whether it is
+// an LF, which is then skipped.
+func scanLines() bufio.SplitFunc {
+	afterCR := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		skip := 0
+		if afterCR && len(data) > 0 && data[0] == '\n' {
+			skip = 1
+		}
+		if i := bytes.IndexAny(data[skip:], "\r\n"); i >= 0 {
+			afterCR = data[skip+i] == '\r'
+			return skip + i + 1, data[skip : skip+i], nil
+		}
+		if atEOF && len(data) > skip {
+			return len(data), data[skip:], nil
+		}
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// next returns the next event, or io.EOF once r is exhausted. An event
+// cut off by the end of r is dropped.
+func (er *eventReader) next() (Event, error) {
+	var ev Event
+	var data []string
+	for er.scanner.Scan() {
+		line := er.scanner.Text()
+		if !er.started {
+			er.started = true
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" {
+			if data != nil {
+				ev.Data = strings.Join(data, "\n")
+				ev.LastEventID, ev.Retry = er.lastID, er.retry
+				return ev, nil
+			}
+			ev = Event{}
+			continue
+		}
+		if line[0] == ':' {
+			// A comment, such as a keep-alive
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "data":
+			data = append(data, value)
+		case "id":
+			// An id with a NUL is ignored, so it can't be resumed from
+			if !strings.ContainsRune(value, 0) {
+				ev.ID, er.lastID = value, value
+			}
+		case "event":
+			ev.Type = value
+		case "channel":
+			ev.Channel = value
+		case "retry":
+			ms, err := strconv.ParseUint(value, 10, 64)
+			if err == nil && ms <= math.MaxInt64/uint64(time.Millisecond) {
+				er.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if err := er.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// readEvents reads SSE events from r and calls fn for each one until r is
+// exhausted or fn returns an error.
+func readEvents(r io.Reader, fn func(Event) error) error {
+	er := newEventReader(r)
+	for {
+		ev, err := er.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// ParseEvents reads the SSE events of r on a goroutine and delivers them
+// on the returned channel, which is closed once r is exhausted or ctx is
+// done. The error channel then yields why: nil at the end of r, the read
+// error, or ctx's. Only closing r interrupts a read blocked on it, as
+// cancelling the context of a request does to its response body.
+func ParseEvents(ctx context.Context, r io.Reader) (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(events)
+		errc <- readEvents(r, func(ev Event) error {
+			select {
+			case events <- ev:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return events, errc
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The noise the deep server's -noise flag adds before events: keep-alive
+// blank lines, comments and unknown fields, alone and together.
+var noise = []string{"", "\n", ": noise 17\n", "meta: 7\n", "\n: noise 3\nx-trace: 9\nData: 1\n"}
+
+func TestEventReaderSkipsNoise(t *testing.T) {
+	const tokens = 40
+	var b strings.Builder
+	for i := 0; i < tokens; i++ {
+		fmt.Fprintf(&b, "%sid: %d\ndata: {\"token\":%d}\n\n", noise[i%len(noise)], i+1, i)
+	}
+	fmt.Fprintf(&b, "%sdata: {\"finish_reason\":\"stop\"}\n\n", noise[4])
+	fmt.Fprintf(&b, "%sdata: [DONE]\n\n", noise[2])
+	// A comment on its own is not an event either
+	b.WriteString(": bye\n\n")
+
+	er := newEventReader(strings.NewReader(b.String()))
+	var events []Event
+	for {
+		ev, err := er.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	// The tokens, the finish chunk and [DONE]
+	if len(events) != tokens+2 {
+		t.Fatalf("read %d events, want %d", len(events), tokens+2)
+	}
+	for i := 0; i < tokens; i++ {
+		if want := fmt.Sprintf(`{"token":%d}`, i); events[i].Data != want || events[i].ID != fmt.Sprint(i+1) {
+			t.Errorf("event %d = %+v, want data %s", i, events[i], want)
+		}
+	}
+	if events[tokens+1].Data != "[DONE]" {
+		t.Errorf("last event = %+v", events[tokens+1])
+	}
+}
+
+func TestEventReaderFields(t *testing.T) {
+	stream := "\ufeff: keepalive\r\n" +
+		"retry: 1500\r\nid: 1\r\nevent: delta\r\ndata: one\r\ndata:two\r\ndata\r\n\r\n" +
+		// Lone CRs, an event without an id and an invalid retry
+		"retry: 2s\rdata:  three\r\r" +
+		"id\ndata: four\n\n" +
+		"id: 5\x00\nretry: 10\ndata: five\n\n" +
+		// Cut off by the end of the stream
+		"data: six\n"
+
+	var events []Event
+	if err := readEvents(strings.NewReader(stream), func(ev Event) error {
+		events = append(events, ev)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{ID: "1", Type: "delta", Data: "one\ntwo\n", LastEventID: "1", Retry: 1500 * time.Millisecond},
+		{Data: " three", LastEventID: "1", Retry: 1500 * time.Millisecond},
+		{Data: "four", Retry: 1500 * time.Millisecond},
+		{Data: "five", Retry: 10 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got %+v, want %+v", events, want)
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	events, errc := ParseEvents(context.Background(), strings.NewReader("data: a\n\ndata: [DONE]\n\n"))
+	var data []string
+	for ev := range events {
+		data = append(data, ev.Data)
+	}
+	if err := <-errc; err != nil || strings.Join(data, ",") != "a,[DONE]" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	// A reader gone away stops delivery
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	events, errc = ParseEvents(ctx, r)
+	go fmt.Fprint(w, "data: a\n\ndata: b\n\n")
+	<-events
+	cancel()
+	w.Close()
+	for range events {
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestEndsStream(t *testing.T) {
+	for _, tt := range []struct {
+		ev   Event
+		want bool
+	}{
+		{Event{Data: "[DONE]"}, true},
+		{Event{Type: "message_stop", Data: "{}"}, true},
+		{Event{Data: `{"type":"message_stop"}`}, true},
+		{Event{Data: `{"client_id": "c1", "message": "Stream completed", "total_messages": 3}`}, true},
+		{Event{Data: `{"content":"[DONE]"}`}, false},
+		{Event{Data: `{"message":{"content":"Stream completed"}}`}, false},
+	} {
+		if got := endsStream(tt.ev); got != tt.want {
+			t.Errorf("endsStream(%+v) = %v", tt.ev, got)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+)
+
+// ErrStreamDone is returned when decoding the "[DONE]" sentinel that ends
+// an OpenAI stream.
+var ErrStreamDone = errors.New("client: stream done")
+
+// ChatCompletionChunk is one streamed chat.completion.chunk object.
+type ChatCompletionChunk struct {
+	ID                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint,omitempty"`
+	Choices           []ChunkChoice `json:"choices"`
+	Usage             *Usage        `json:"usage,omitempty"`
+}
+
+type ChunkChoice struct {
+	Index        int        `json:"index"`
+	Delta        ChunkDelta `json:"delta"`
+	FinishReason *string    `json:"finish_reason"`
+}
+
+type ChunkDelta struct {
+	Role      string          `json:"role,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	Refusal   string          `json:"refusal,omitempty"`
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// ToolCallDelta is a fragment of a tool call. Fragments with the same Index
+// belong to the same call; Arguments arrive in pieces.
+type ToolCallDelta struct {
+	Index    int               `json:"index"`
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Function FunctionCallDelta `json:"function"`
+}
+
+type FunctionCallDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatCompletion is the message a stream of chunks adds up to.
+type ChatCompletion struct {
+	ID                string             `json:"id"`
+	Object            string             `json:"object"`
+	Created           int64              `json:"created"`
+	Model             string             `json:"model"`
+	SystemFingerprint string             `json:"system_fingerprint,omitempty"`
+	Choices           []CompletionChoice `json:"choices"`
+	Usage             *Usage             `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Index        int         `json:"index"`
+	Message      ChatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+type ChatMessage struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Refusal   string     `json:"refusal,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// DecodeChatCompletionChunk decodes the data of one stream event. It
+// returns ErrStreamDone for the "[DONE]" sentinel.
+func DecodeChatCompletionChunk(data string) (*ChatCompletionChunk, error) {
+	if data == "[DONE]" {
+		return nil, ErrStreamDone
+	}
+	var chunk ChatCompletionChunk
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+// ChatCompletionAccumulator merges streamed chunks into a ChatCompletion.
+// The zero value is ready to use.
+type ChatCompletionAccumulator struct {
+	completion ChatCompletion
+	choices    map[int]*accumulatedChoice
+}
+
+type accumulatedChoice struct {
+	choice    CompletionChoice
+	toolCalls map[int]*ToolCall
+}
+
+// Add merges chunk into the accumulated completion.
+func (a *ChatCompletionAccumulator) Add(chunk *ChatCompletionChunk) {
+	if a.choices == nil {
+		a.choices = make(map[int]*accumulatedChoice)
+	}
+
+	c := &a.completion
+	if c.ID == "" {
+		c.ID = chunk.ID
+		c.Object = "chat.completion"
+		c.Created = chunk.Created
+		c.Model = chunk.Model
+	}
+	if chunk.SystemFingerprint != "" {
+		c.SystemFingerprint = chunk.SystemFingerprint
+	}
+	if chunk.Usage != nil {
+		usage := *chunk.Usage
+		c.Usage = &usage
+	}
+
+	for _, ch := range chunk.Choices {
+		acc, ok := a.choices[ch.Index]
+		if !ok {
+			acc = &accumulatedChoice{
+				choice:    CompletionChoice{Index: ch.Index},
+				toolCalls: make(map[int]*ToolCall),
+			}
+			a.choices[ch.Index] = acc
+		}
+
+		msg := &acc.choice.Message
+		if ch.Delta.Role != "" {
+			msg.Role = ch.Delta.Role
+		}
+		msg.Content += ch.Delta.Content
+		msg.Refusal += ch.Delta.Refusal
+		for _, tc := range ch.Delta.ToolCalls {
+			call, ok := acc.toolCalls[tc.Index]
+			if !ok {
+				call = &ToolCall{Type: "function"}
+				acc.toolCalls[tc.Index] = call
+			}
+			if tc.ID != "" {
+				call.ID = tc.ID
+			}
+			if tc.Type != "" {
+				call.Type = tc.Type
+			}
+			if tc.Function.Name != "" {
+				call.Function.Name = tc.Function.Name
+			}
+			call.Function.Arguments += tc.Function.Arguments
+		}
+		if ch.FinishReason != nil {
+			acc.choice.FinishReason = *ch.FinishReason
+		}
+	}
+}
+
+// Result returns the completion accumulated so far.
+func (a *ChatCompletionAccumulator) Result() *ChatCompletion {
+	result := a.completion
+	result.Choices = make([]CompletionChoice, 0, len(a.choices))
+	for _, acc := range a.choices {
+		choice := acc.choice
+		if len(acc.toolCalls) > 0 {
+			indexes := make([]int, 0, len(acc.toolCalls))
+			for i := range acc.toolCalls {
+				indexes = append(indexes, i)
+			}
+			sort.Ints(indexes)
+			for _, i := range indexes {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, *acc.toolCalls[i])
+			}
+		}
+		if choice.Message.Role == "" {
+			choice.Message.Role = "assistant"
+		}
+		result.Choices = append(result.Choices, choice)
+	}
+	sort.Slice(result.Choices, func(i, j int) bool {
+		return result.Choices[i].Index < result.Choices[j].Index
+	})
+	return &result
+}
+
+// DecodeChatCompletionStream reads an OpenAI SSE stream from r, calling fn
+// (if not nil) for every chunk, and returns the accumulated completion once
+// the stream ends.
+func DecodeChatCompletionStream(r io.Reader, fn func(*ChatCompletionChunk) error) (*ChatCompletion, error) {
+	var acc ChatCompletionAccumulator
+	err := readEvents(r, func(ev Event) error {
+		chunk, err := DecodeChatCompletionChunk(ev.Data)
+		if err != nil {
+			return err
+		}
+		acc.Add(chunk)
+		if fn != nil {
+			return fn(chunk)
+		}
+		return nil
+	})
+	if err != nil && err != ErrStreamDone {
+		return acc.Result(), err
+	}
+	return acc.Result(), nil
+}
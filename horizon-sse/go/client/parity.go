@@ -0,0 +1,259 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StreamCapture is what a parity check records of one stream.
+type StreamCapture struct {
+	Status int
+	// Tokens counts the events carrying text, Content is their text.
+	Tokens  int
+	Content string
+	// Done is set if the stream ended with its dialect's end marker.
+	Done       bool
+	StopReason string
+	TTFB       time.Duration
+	// Gaps are the times between consecutive tokens.
+	Gaps     []time.Duration
+	Duration time.Duration
+	Err      string
+}
+
+// Capture opens a stream with params, as a load test client would, and
+// records it to the end.
+func (c *SSEClient) Capture(ctx context.Context, params ClientParams) (capture StreamCapture) {
+	start := time.Now()
+	defer func() { capture.Duration = time.Since(start) }()
+
+	req, err := c.newRequest(ctx, fmt.Sprintf("parity-%d", start.UnixNano()), "", params)
+	if err != nil {
+		capture.Err = err.Error()
+		return capture
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		capture.Err = err.Error()
+		return capture
+	}
+	defer resp.Body.Close()
+	capture.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		capture.Err = (&StatusError{StatusCode: resp.StatusCode}).Error()
+		return capture
+	}
+
+	var content strings.Builder
+	last := start
+	sr := NewStreamReader(resp.Body, DialectAuto)
+	for {
+		ev, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				capture.Err = err.Error()
+			}
+			break
+		}
+		switch ev.Kind {
+		case KindToken:
+			now := time.Now()
+			if capture.Tokens == 0 {
+				capture.TTFB = now.Sub(start)
+			} else {
+				capture.Gaps = append(capture.Gaps, now.Sub(last))
+			}
+			last = now
+			capture.Tokens++
+			content.WriteString(ev.Text)
+		case KindDone:
+			capture.Done = true
+			capture.StopReason = ev.StopReason
+		}
+	}
+	capture.Content = content.String()
+	return capture
+}
+
+// ContentCheck says how strictly parity compares the text of two streams.
+type ContentCheck string
+
+const (
+	ContentExact  ContentCheck = "exact"
+	ContentLength ContentCheck = "length"
+	ContentOff    ContentCheck = "off"
+)
+
+// ParseContentCheck parses a -content setting.
+func ParseContentCheck(s string) (ContentCheck, error) {
+	switch c := ContentCheck(s); c {
+	case ContentExact, ContentLength, ContentOff:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown content check %q (want exact, length or off)", s)
+}
+
+// Divergence is a difference between the two streams one request got.
+type Divergence struct {
+	Request int
+	Params  ClientParams
+	Field   string
+	A, B    string
+}
+
+// TimingComparison is a timing percentile over all streams of each side.
+// Diff is B's relative to A's.
+type TimingComparison struct {
+	Metric   string
+	A, B     time.Duration
+	Diff     float64
+	Diverged bool
+}
+
+// ParityReport is the outcome of a parity check between two targets.
+type ParityReport struct {
+	Names       [2]string
+	Requests    int
+	Divergences []Divergence
+	Timing      []TimingComparison
+}
+
+// Diverged reports whether the targets differed anywhere.
+func (r ParityReport) Diverged() bool {
+	if len(r.Divergences) > 0 {
+		return true
+	}
+	for _, t := range r.Timing {
+		if t.Diverged {
+			return true
+		}
+	}
+	return false
+}
+
+// CompareCaptures lists how the streams b and a got for request i differ.
+func CompareCaptures(i int, params ClientParams, a, b StreamCapture, content ContentCheck) []Divergence {
+	var out []Divergence
+	diff := func(field string, x, y interface{}) {
+		if xs, ys := fmt.Sprint(x), fmt.Sprint(y); xs != ys {
+			out = append(out, Divergence{Request: i, Params: params, Field: field, A: xs, B: ys})
+		}
+	}
+	diff("status", a.Status, b.Status)
+	diff("error", a.Err, b.Err)
+	diff("tokens", a.Tokens, b.Tokens)
+	diff("done", a.Done, b.Done)
+	diff("stop_reason", a.StopReason, b.StopReason)
+	switch content {
+	case ContentExact:
+		if a.Content != b.Content {
+			diff("content", abbreviate(a.Content), abbreviate(b.Content))
+		}
+	case ContentLength:
+		diff("content_length", len(a.Content), len(b.Content))
+	}
+	return out
+}
+
+// abbreviate shortens text for a report.
+func abbreviate(s string) string {
+	const n = 60
+	if len(s) <= n {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%q... (%d bytes)", s[:n], len(s))
+}
+
+// CompareTiming compares the TTFB, token gap and duration percentiles of
+// two sets of streams. A percentile diverges when it differs by more than
+// tolerance, relative to a's, and by more than slack: gaps of a few
+// milliseconds differ in relative terms on scheduling alone.
+func CompareTiming(a, b []StreamCapture, tolerance float64, slack time.Duration) []TimingComparison {
+	collect := func(captures []StreamCapture, pick func(StreamCapture) []time.Duration) []time.Duration {
+		var all []time.Duration
+		for _, c := range captures {
+			if c.Err == "" {
+				all = append(all, pick(c)...)
+			}
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		return all
+	}
+	series := []struct {
+		name string
+		pick func(StreamCapture) []time.Duration
+	}{
+		{"ttfb", func(c StreamCapture) []time.Duration { return []time.Duration{c.TTFB} }},
+		{"gap", func(c StreamCapture) []time.Duration { return c.Gaps }},
+		{"duration", func(c StreamCapture) []time.Duration { return []time.Duration{c.Duration} }},
+	}
+
+	var out []TimingComparison
+	for _, s := range series {
+		as, bs := collect(a, s.pick), collect(b, s.pick)
+		if len(as) == 0 || len(bs) == 0 {
+			continue
+		}
+		for _, p := range []float64{50, 95} {
+			t := TimingComparison{
+				Metric: fmt.Sprintf("%s_p%.0f", s.name, p),
+				A:      percentile(as, p),
+				B:      percentile(bs, p),
+			}
+			if t.A > 0 {
+				t.Diff = float64(t.B-t.A) / float64(t.A)
+			}
+			delta := t.B - t.A
+			if delta < 0 {
+				delta = -delta
+			}
+			t.Diverged = delta > slack && (t.A == 0 || math.Abs(t.Diff) > tolerance)
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Render writes the report: divergences first, then the timing table.
+func (r ParityReport) Render(w io.Writer) {
+	a, b := r.Names[0], r.Names[1]
+	fmt.Fprintf(w, "parity of %s and %s over %d requests\n\n", a, b, r.Requests)
+	if len(r.Divergences) == 0 {
+		fmt.Fprintln(w, "streams match")
+	}
+	for _, d := range r.Divergences {
+		fmt.Fprintf(w, "request %d%s: %s\n  %s: %s\n  %s: %s\n", d.Request, paramsLabel(d.Params), d.Field, a, d.A, b, d.B)
+	}
+	if len(r.Timing) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%-14s %12s %12s %9s\n", "timing", a, b, "diff")
+	for _, t := range r.Timing {
+		mark := ""
+		if t.Diverged {
+			mark = "  diverges"
+		}
+		fmt.Fprintf(w, "%-14s %12v %12v %+8.1f%%%s\n", t.Metric,
+			t.A.Round(10*time.Microsecond), t.B.Round(10*time.Microsecond), t.Diff*100, mark)
+	}
+}
+
+// paramsLabel names a request's parameters in a report, or is empty for
+// the server defaults.
+func paramsLabel(p ClientParams) string {
+	q := p.Query()
+	if len(q) == 0 {
+		return ""
+	}
+	return " (" + q.Encode() + ")"
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// openAIStream serves tokens as chat completion chunks, ending with
+// [DONE] if done is set.
+func openAIStream(tokens []string, done bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, tok := range tokens {
+			fmt.Fprintf(w, "data: {\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", tok)
+		}
+		fmt.Fprint(w, "data: {\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		if done {
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}
+	})
+}
+
+func TestParity(t *testing.T) {
+	same := httptest.NewServer(openAIStream([]string{"Hello", " world"}, true))
+	defer same.Close()
+	other := httptest.NewServer(openAIStream([]string{"Hello", " there", "!"}, false))
+	defer other.Close()
+
+	capture := func(url string) StreamCapture {
+		return NewSSEClient(url).Capture(context.Background(), ClientParams{})
+	}
+	a, b, c := capture(same.URL), capture(same.URL), capture(other.URL)
+	if a.Tokens != 2 || a.Content != "Hello world" || !a.Done || a.StopReason != "stop" || a.Err != "" || a.Duration <= 0 {
+		t.Fatalf("capture = %+v", a)
+	}
+	if d := CompareCaptures(1, ClientParams{}, a, b, ContentExact); len(d) != 0 {
+		t.Errorf("identical streams diverge: %+v", d)
+	}
+
+	fields := make(map[string]bool)
+	for _, d := range CompareCaptures(1, ClientParams{}, a, c, ContentExact) {
+		fields[d.Field] = true
+	}
+	for _, f := range []string{"tokens", "done", "content"} {
+		if !fields[f] {
+			t.Errorf("no %s divergence, got %v", f, fields)
+		}
+	}
+	for _, d := range CompareCaptures(1, ClientParams{}, a, c, ContentLength) {
+		if d.Field == "content" {
+			t.Errorf("exact content compared in length mode")
+		}
+	}
+}
+
+func TestCompareTiming(t *testing.T) {
+	streams := func(gap time.Duration) []StreamCapture {
+		return []StreamCapture{{
+			TTFB:     10 * time.Millisecond,
+			Gaps:     []time.Duration{gap, gap, gap},
+			Duration: 10*time.Millisecond + 3*gap,
+		}}
+	}
+	timing := CompareTiming(streams(100*time.Millisecond), streams(150*time.Millisecond), 0.25, 5*time.Millisecond)
+	diverged := make(map[string]bool)
+	for _, tc := range timing {
+		diverged[tc.Metric] = tc.Diverged
+	}
+	if diverged["ttfb_p50"] || !diverged["gap_p50"] || !diverged["gap_p95"] {
+		t.Errorf("divergences = %v, want the gaps only", diverged)
+	}
+
+	// Within the slack, however large the relative difference
+	for _, tc := range CompareTiming(streams(time.Millisecond), streams(2*time.Millisecond), 0.25, 5*time.Millisecond) {
+		if tc.Diverged {
+			t.Errorf("%s diverged within the slack: %+v", tc.Metric, tc)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrHostLimit is returned by Pool.Subscribe when the host already has
+// MaxConnsPerHost subscriptions.
+var ErrHostLimit = errors.New("client: per-host subscription limit reached")
+
+// ErrPoolClosed is returned by Pool.Subscribe after Close.
+var ErrPoolClosed = errors.New("client: pool closed")
+
+// PoolConfig controls a Pool.
+type PoolConfig struct {
+	// MaxConnsPerHost caps the subscriptions held open to a single host.
+	// Zero means no cap.
+	MaxConnsPerHost int
+	// ReconnectDelay is the first wait before reconnecting a dropped
+	// subscription. It doubles on every failed attempt up to
+	// MaxReconnectDelay, and starts over once a connection succeeds. A
+	// retry field from the server takes its place.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// EventBuffer is the number of events queued per subscription before
+	// reading from its connection pauses.
+	EventBuffer int
+	// DecodeProto unwraps the base64 envelope of protobuf events, setting
+	// Event.Proto to the message bytes and schema.
+	DecodeProto bool
+	// Logger receives the pool's logs; nil logs to the standard logger.
+	Logger logrus.FieldLogger
+}
+
+// Pool manages many concurrent SSE subscriptions over one shared transport.
+// Subscriptions reconnect on their own (resuming with Last-Event-ID) until
+// the stream completes or they are closed.
+type Pool struct {
+	cfg    PoolConfig
+	client *http.Client
+	logger logrus.FieldLogger
+
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	hosts  map[string]int
+	closed bool
+
+	events     int64
+	reconnects int64
+	errors     int64
+}
+
+// SubscriptionState is where a subscription is in its lifecycle.
+type SubscriptionState int32
+
+const (
+	StateConnecting SubscriptionState = iota
+	StateOpen
+	StateReconnecting
+	StateClosed
+)
+
+func (st SubscriptionState) String() string {
+	switch st {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "closed"
+	}
+}
+
+// Subscription is one long-lived SSE stream held by a Pool. Events are
+// delivered on Events, which is closed once the subscription ends.
+type Subscription struct {
+	URL    string
+	Events <-chan Event
+
+	events      chan Event
+	pool        *Pool
+	host        string
+	cancel      context.CancelFunc
+	done        chan struct{}
+	state       int32
+	lastEventID string
+	retry       time.Duration
+	err         error
+}
+
+// PoolStats is a point-in-time view of a Pool.
+type PoolStats struct {
+	Subscriptions int            `json:"subscriptions"`
+	Open          int            `json:"open"`
+	Reconnecting  int            `json:"reconnecting"`
+	PerHost       map[string]int `json:"per_host"`
+	Events        int64          `json:"events"`
+	Reconnects    int64          `json:"reconnects"`
+	Errors        int64          `json:"errors"`
+}
+
+func NewPool(cfg PoolConfig) *Pool {
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = 500 * time.Millisecond
+	}
+	if cfg.MaxReconnectDelay < cfg.ReconnectDelay {
+		cfg.MaxReconnectDelay = 30 * time.Second
+	}
+	if cfg.EventBuffer < 1 {
+		cfg.EventBuffer = 16
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true,
+	}
+
+	return &Pool{
+		cfg: cfg,
+		// No client timeout: subscriptions are expected to stay open.
+		client: &http.Client{Transport: transport},
+		logger: logger,
+		subs:   make(map[*Subscription]struct{}),
+		hosts:  make(map[string]int),
+	}
+}
+
+// Subscribe opens a subscription to rawURL. It returns immediately; the
+// connection is made in the background and its events arrive on
+// Subscription.Events. Cancelling ctx closes the subscription.
+func (p *Pool) Subscribe(ctx context.Context, rawURL string) (*Subscription, error) {
+	return p.SubscribeFrom(ctx, rawURL, "")
+}
+
+// SubscribeFrom is Subscribe for a stream already read up to lastEventID,
+// which is sent as Last-Event-ID on the first connection too.
+func (p *Pool) SubscribeFrom(ctx context.Context, rawURL, lastEventID string) (*Subscription, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if p.cfg.MaxConnsPerHost > 0 && p.hosts[u.Host] >= p.cfg.MaxConnsPerHost {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrHostLimit, u.Host)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan Event, p.cfg.EventBuffer)
+	sub := &Subscription{
+		URL:    rawURL,
+		Events: events,
+		events: events,
+		pool:   p,
+		host:   u.Host,
+		cancel: cancel,
+		done:   make(chan struct{}),
+
+		lastEventID: lastEventID,
+	}
+	p.subs[sub] = struct{}{}
+	p.hosts[u.Host]++
+	p.mu.Unlock()
+
+	go sub.run(ctx)
+	return sub, nil
+}
+
+// State reports where the subscription is in its lifecycle.
+func (s *Subscription) State() SubscriptionState {
+	return SubscriptionState(atomic.LoadInt32(&s.state))
+}
+
+// Close ends the subscription and waits for its connection to be released.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Err returns why the subscription ended. It is nil for streams that
+// completed or were closed, and only valid once Events is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+func (s *Subscription) setState(st SubscriptionState) {
+	atomic.StoreInt32(&s.state, int32(st))
+}
+
+func (s *Subscription) run(ctx context.Context) {
+	p := s.pool
+	defer func() {
+		s.setState(StateClosed)
+		p.mu.Lock()
+		delete(p.subs, s)
+		if p.hosts[s.host]--; p.hosts[s.host] <= 0 {
+			delete(p.hosts, s.host)
+		}
+		p.mu.Unlock()
+		close(s.events)
+		close(s.done)
+	}()
+
+	delay := p.cfg.ReconnectDelay
+	for {
+		completed, err := s.stream(ctx)
+		if completed || ctx.Err() != nil {
+			return
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			s.err = permanent.err
+			atomic.AddInt64(&p.errors, 1)
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&p.errors, 1)
+		}
+		if s.State() == StateOpen {
+			// The connection was up, so this is a new outage rather than
+			// another failed attempt
+			delay = p.cfg.ReconnectDelay
+			if s.retry > 0 {
+				delay = s.retry
+			}
+		}
+
+		s.setState(StateReconnecting)
+		p.logger.WithFields(logrus.Fields{
+			"url":           s.URL,
+			"last_event_id": s.lastEventID,
+			"delay":         delay,
+			"error":         err,
+		}).Warn("Subscription dropped, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		atomic.AddInt64(&p.reconnects, 1)
+		if delay *= 2; delay > p.cfg.MaxReconnectDelay {
+			delay = p.cfg.MaxReconnectDelay
+		}
+	}
+}
+
+// permanentError marks failures that reconnecting will not fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// stream runs one connection attempt. It reports completed once the server
+// signalled the end of the stream.
+func (s *Subscription) stream(ctx context.Context) (completed bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return false, &permanentError{err}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if s.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", s.lastEventID)
+	}
+
+	resp, err := s.pool.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		// The server asked us to stop reconnecting
+		return true, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return false, &permanentError{&StatusError{StatusCode: resp.StatusCode}}
+	case resp.StatusCode != http.StatusOK:
+		return false, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	s.setState(StateOpen)
+	errDone := errors.New("done")
+	err = readEvents(resp.Body, func(ev Event) error {
+		s.lastEventID, s.retry = ev.LastEventID, ev.Retry
+		if s.pool.cfg.DecodeProto {
+			if pe, err := DecodeProtoEvent(ev); err == nil {
+				ev.Proto = &pe
+			}
+		}
+		select {
+		case s.events <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		atomic.AddInt64(&s.pool.events, 1)
+		if ev.Data == "[DONE]" {
+			return errDone
+		}
+		return nil
+	})
+	if err == errDone {
+		return true, nil
+	}
+	return false, err
+}
+
+// Stats returns aggregate health of the pool's subscriptions.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := PoolStats{
+		Subscriptions: len(p.subs),
+		PerHost:       make(map[string]int, len(p.hosts)),
+		Events:        atomic.LoadInt64(&p.events),
+		Reconnects:    atomic.LoadInt64(&p.reconnects),
+		Errors:        atomic.LoadInt64(&p.errors),
+	}
+	for sub := range p.subs {
+		switch sub.State() {
+		case StateOpen:
+			stats.Open++
+		case StateReconnecting:
+			stats.Reconnecting++
+		}
+	}
+	for host, n := range p.hosts {
+		stats.PerHost[host] = n
+	}
+	return stats
+}
+
+// Close ends every subscription and releases idle connections.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	subs := make([]*Subscription, 0, len(p.subs))
+	for sub := range p.subs {
+		subs = append(subs, sub)
+	}
+	p.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+	p.client.CloseIdleConnections()
+}
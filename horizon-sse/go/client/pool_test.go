@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A subscription whose connections keep succeeding before they drop waits
+// the initial delay every time instead of backing off further and further.
+func TestReconnectDelayResetsAfterOpen(t *testing.T) {
+	var conns int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&conns, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "id: %d\ndata: hello\n\n", n)
+	}))
+	defer ts.Close()
+
+	pool := NewPool(PoolConfig{ReconnectDelay: 20 * time.Millisecond, MaxReconnectDelay: 10 * time.Second})
+	defer pool.Close()
+	sub, err := pool.Subscribe(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// Backing off would take 20+40+...+640ms = 1.26s for seven reconnects
+	deadline := time.After(time.Second)
+	for received := 0; received < 8; {
+		select {
+		case <-sub.Events:
+			received++
+		case <-deadline:
+			t.Fatalf("only %d events in 1s; the reconnect delay kept growing", received)
+		}
+	}
+}
+
+// Failed attempts still back off.
+func TestReconnectDelayBacksOffOnFailures(t *testing.T) {
+	var conns int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&conns, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	pool := NewPool(PoolConfig{ReconnectDelay: 20 * time.Millisecond, MaxReconnectDelay: 10 * time.Second})
+	defer pool.Close()
+	sub, err := pool.Subscribe(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	sub.Close()
+	// 0, 20, 60, 140, 300ms; the next attempt would be at 620ms
+	if n := atomic.LoadInt64(&conns); n < 4 || n > 6 {
+		t.Errorf("%d attempts in 500ms, want about 5", n)
+	}
+}
+
+// A retry field sets the delay, and the Last-Event-ID resumed from.
+func TestReconnectDelayFromRetry(t *testing.T) {
+	lastIDs := make(chan string, 8)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastIDs <- r.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "retry: 300\nid: 7\ndata: hello\n\ndata: no id\n\n")
+	}))
+	defer ts.Close()
+
+	pool := NewPool(PoolConfig{ReconnectDelay: 10 * time.Millisecond, MaxReconnectDelay: 10 * time.Second})
+	defer pool.Close()
+	sub, err := pool.Subscribe(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(450 * time.Millisecond)
+	sub.Close()
+	close(lastIDs)
+	var got []string
+	for id := range lastIDs {
+		got = append(got, id)
+	}
+	if len(got) != 2 || got[0] != "" || got[1] != "7" {
+		t.Errorf("connected with Last-Event-IDs %q, want one reconnect after 300ms resuming from 7", got)
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNotProto is returned by DecodeProtoEvent for events that do not carry
+// a protobuf payload.
+var ErrNotProto = errors.New("client: not a protobuf event")
+
+// protoEncoding is the encoding the server uses for protobuf payloads.
+const protoEncoding = "base64-proto"
+
+// ProtoEvent is a protobuf event received from a broker channel. Payload
+// holds the serialized message; unmarshal it with the generated type that
+// Schema names, e.g. proto.Unmarshal(ev.Payload, &orderspb.Order{}).
+type ProtoEvent struct {
+	ID      string
+	Type    string
+	Schema  string
+	Payload []byte
+}
+
+// DecodeProtoEvent unwraps an event published with a protobuf payload. The
+// server delivers such events as {"schema","encoding":"base64-proto",
+// "payload"}; anything else yields ErrNotProto.
+func DecodeProtoEvent(ev Event) (ProtoEvent, error) {
+	var envelope struct {
+		Schema   string `json:"schema"`
+		Encoding string `json:"encoding"`
+		Payload  string `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(ev.Data), &envelope); err != nil || envelope.Encoding != protoEncoding {
+		return ProtoEvent{}, ErrNotProto
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return ProtoEvent{}, fmt.Errorf("client: invalid protobuf payload: %w", err)
+	}
+	return ProtoEvent{ID: ev.ID, Type: ev.Type, Schema: envelope.Schema, Payload: payload}, nil
+}
@@ -0,0 +1,283 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Scenario describes a load test workload. Per-client request parameters
+// are drawn from the distributions in Clients, so one run mixes short and
+// long prompts, response lengths, dialects, models and stream pacing.
+type Scenario struct {
+	Name string `json:"name"`
+	// Seed makes the drawn parameters reproducible. Zero seeds from the clock.
+	Seed    int64          `json:"seed"`
+	Clients ClientTemplate `json:"clients"`
+}
+
+// ClientTemplate holds the distributions client parameters are drawn from.
+// Unset fields leave the parameter at the server's default.
+type ClientTemplate struct {
+	PromptTokens *Distribution `json:"prompt_tokens,omitempty"`
+	MaxTokens    *Distribution `json:"max_tokens,omitempty"`
+	TokenDelayMs *Distribution `json:"token_delay_ms,omitempty"`
+	// Dialect maps dialect names to relative weights.
+	Dialect map[string]float64 `json:"dialect,omitempty"`
+	// Model maps model names to relative weights, for a deep server with
+	// a model catalog.
+	Model map[string]float64 `json:"model,omitempty"`
+	// EarlyDisconnect makes some clients hang up mid-stream.
+	EarlyDisconnect *EarlyDisconnect `json:"early_disconnect,omitempty"`
+}
+
+// EarlyDisconnect is the early-disconnect persona: a Fraction (0-1) of the
+// clients close their stream after AfterEvents data events, then check
+// that the proxy cancelled the upstream request in time.
+type EarlyDisconnect struct {
+	Fraction    float64       `json:"fraction"`
+	AfterEvents *Distribution `json:"after_events"`
+}
+
+// Distribution is a numeric distribution. Dist is one of fixed (Value),
+// uniform (Min..Max), normal (Mean, Stddev), lognormal (Mean, Stddev of the
+// resulting values) or exponential (Mean). Min and Max, when set, also
+// clamp the other distributions.
+type Distribution struct {
+	Dist   string   `json:"dist"`
+	Value  float64  `json:"value,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Mean   float64  `json:"mean,omitempty"`
+	Stddev float64  `json:"stddev,omitempty"`
+}
+
+// ClientParams are the request parameters of one simulated client. Zero
+// fields are not sent.
+type ClientParams struct {
+	Dialect      string
+	Model        string
+	PromptTokens int
+	MaxTokens    int
+	TokenDelay   time.Duration
+	// DisconnectAfter is the number of data events after which the client
+	// hangs up; zero reads the stream to the end.
+	DisconnectAfter int
+}
+
+// LoadScenario reads and validates a JSON scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc Scenario
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("scenario %s: %w", path, err)
+	}
+	if err := sc.Validate(); err != nil {
+		return nil, fmt.Errorf("scenario %s: %w", path, err)
+	}
+	return &sc, nil
+}
+
+// Validate checks that every distribution and dialect is usable.
+func (sc *Scenario) Validate() error {
+	dists := map[string]*Distribution{
+		"prompt_tokens":  sc.Clients.PromptTokens,
+		"max_tokens":     sc.Clients.MaxTokens,
+		"token_delay_ms": sc.Clients.TokenDelayMs,
+	}
+	for name, d := range dists {
+		if d == nil {
+			continue
+		}
+		if err := d.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for name, weight := range sc.Clients.Dialect {
+		// The proxy can only request these two from the deep server
+		if d := Dialect(name); d != DialectOpenAI && d != DialectAnthropic {
+			return fmt.Errorf("dialect: unsupported %q", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("dialect: negative weight for %q", name)
+		}
+	}
+	for name, weight := range sc.Clients.Model {
+		if weight < 0 {
+			return fmt.Errorf("model: negative weight for %q", name)
+		}
+	}
+	if ed := sc.Clients.EarlyDisconnect; ed != nil {
+		if ed.Fraction < 0 || ed.Fraction > 1 {
+			return fmt.Errorf("early_disconnect: fraction must be between 0 and 1")
+		}
+		if ed.AfterEvents == nil {
+			return fmt.Errorf("early_disconnect: after_events is required")
+		}
+		if err := ed.AfterEvents.Validate(); err != nil {
+			return fmt.Errorf("early_disconnect.after_events: %w", err)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON also takes a plain number, as a fixed distribution of
+// that value.
+func (d *Distribution) UnmarshalJSON(data []byte) error {
+	var value float64
+	if err := json.Unmarshal(data, &value); err == nil && string(data) != "null" {
+		*d = Distribution{Dist: "fixed", Value: value}
+		return nil
+	}
+	type plain Distribution
+	return json.Unmarshal(data, (*plain)(d))
+}
+
+// Validate checks that the distribution's parameters are usable.
+func (d *Distribution) Validate() error {
+	switch d.Dist {
+	case "fixed":
+	case "uniform":
+		if d.Min == nil || d.Max == nil || *d.Max < *d.Min {
+			return fmt.Errorf("uniform needs min <= max")
+		}
+	case "normal", "lognormal":
+		if d.Stddev < 0 || (d.Dist == "lognormal" && d.Mean <= 0) {
+			return fmt.Errorf("%s needs a positive mean and stddev >= 0", d.Dist)
+		}
+	case "exponential":
+		if d.Mean <= 0 {
+			return fmt.Errorf("exponential needs a positive mean")
+		}
+	default:
+		return fmt.Errorf("unknown dist %q", d.Dist)
+	}
+	return nil
+}
+
+// Sample draws one value.
+func (d *Distribution) Sample(rng *rand.Rand) float64 {
+	var v float64
+	switch d.Dist {
+	case "fixed":
+		v = d.Value
+	case "uniform":
+		return *d.Min + rng.Float64()*(*d.Max-*d.Min)
+	case "normal":
+		v = d.Mean + rng.NormFloat64()*d.Stddev
+	case "lognormal":
+		sigma2 := math.Log(1 + (d.Stddev*d.Stddev)/(d.Mean*d.Mean))
+		mu := math.Log(d.Mean) - sigma2/2
+		v = math.Exp(mu + rng.NormFloat64()*math.Sqrt(sigma2))
+	case "exponential":
+		v = rng.ExpFloat64() * d.Mean
+	}
+	if d.Min != nil && v < *d.Min {
+		v = *d.Min
+	}
+	if d.Max != nil && v > *d.Max {
+		v = *d.Max
+	}
+	return v
+}
+
+// NewRand returns the random source for drawing this scenario's clients.
+func (sc *Scenario) NewRand() *rand.Rand {
+	seed := sc.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// Draw picks the parameters of one client.
+func (sc *Scenario) Draw(rng *rand.Rand) ClientParams {
+	var p ClientParams
+	t := sc.Clients
+	if t.PromptTokens != nil {
+		p.PromptTokens = sampleInt(t.PromptTokens, rng)
+	}
+	if t.MaxTokens != nil {
+		p.MaxTokens = sampleInt(t.MaxTokens, rng)
+	}
+	if t.TokenDelayMs != nil {
+		p.TokenDelay = time.Duration(t.TokenDelayMs.Sample(rng) * float64(time.Millisecond))
+	}
+	p.Dialect = pickWeighted(t.Dialect, rng)
+	p.Model = pickWeighted(t.Model, rng)
+	if ed := t.EarlyDisconnect; ed != nil && rng.Float64() < ed.Fraction {
+		p.DisconnectAfter = sampleInt(ed.AfterEvents, rng)
+	}
+	return p
+}
+
+func sampleInt(d *Distribution, rng *rand.Rand) int {
+	v := int(math.Round(d.Sample(rng)))
+	if v < 1 {
+		v = 1
+	}
+	return v
+}
+
+// pickWeighted picks a key of weights with probability proportional to its
+// weight. Keys are sorted first so a seeded draw is reproducible.
+func pickWeighted(weights map[string]float64, rng *rand.Rand) string {
+	keys := make([]string, 0, len(weights))
+	total := 0.0
+	for k, w := range weights {
+		keys = append(keys, k)
+		total += w
+	}
+	if total <= 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	x := rng.Float64() * total
+	for _, k := range keys {
+		if x < weights[k] {
+			return k
+		}
+		x -= weights[k]
+	}
+	return keys[len(keys)-1]
+}
+
+// Query returns the /sse query parameters that request these parameters
+// from the proxy.
+func (p ClientParams) Query() url.Values {
+	q := url.Values{}
+	if p.Dialect != "" {
+		q.Set("dialect", p.Dialect)
+	}
+	if p.Model != "" {
+		q.Set("model", p.Model)
+	}
+	if p.PromptTokens > 0 {
+		q.Set("prompt_tokens", strconv.Itoa(p.PromptTokens))
+	}
+	if p.MaxTokens > 0 {
+		q.Set("max_tokens", strconv.Itoa(p.MaxTokens))
+	}
+	if p.TokenDelay > 0 {
+		q.Set("token_delay_ms", strconv.FormatInt(p.TokenDelay.Milliseconds(), 10))
+	}
+	return q
+}
+
+// ExpectedDuration estimates how long the stream should take, or zero when
+// the parameters leave its length to the server.
+func (p ClientParams) ExpectedDuration() time.Duration {
+	if p.MaxTokens == 0 || p.TokenDelay == 0 {
+		return 0
+	}
+	return time.Duration(p.MaxTokens) * p.TokenDelay
+}
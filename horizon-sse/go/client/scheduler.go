@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ArrivalStats compares the client arrivals a load test asked for with the
+// ones it achieved.
+type ArrivalStats struct {
+	Scheduled int
+	Spawned   int
+	// TargetRate and AchievedRate are in clients per second. AchievedRate is
+	// measured between the first and last actual spawn, leaving out time
+	// spent paused or waiting for a new target.
+	TargetRate   float64
+	AchievedRate float64
+	// Lag is how late a spawn happened relative to its scheduled time.
+	AvgLag time.Duration
+	MaxLag time.Duration
+}
+
+func (a ArrivalStats) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"scheduled":     a.Scheduled,
+		"spawned":       a.Spawned,
+		"target_rate":   a.TargetRate,
+		"achieved_rate": a.AchievedRate,
+		"avg_lag":       a.AvgLag.String(),
+		"max_lag":       a.MaxLag.String(),
+	}
+}
+
+// arrivalScheduler spawns clients evenly over rampUp. Each spawn is timed
+// against its absolute slot (base + i*interval) rather than a sleep after
+// the previous one, so the cost of spawning and of slow clients never
+// stretches the ramp; a scheduler that falls behind catches up immediately.
+//
+// The target can be raised and spawning paused while it runs. Both move the
+// base so that the next client is due when spawning resumes, at the same
+// interval.
+type arrivalScheduler struct {
+	interval time.Duration
+	rampUp   time.Duration
+
+	mu       sync.Mutex
+	target   int
+	spawned  int
+	inflight int
+	paused   bool
+	wake     chan struct{}
+}
+
+func newArrivalScheduler(n int, rampUp time.Duration) *arrivalScheduler {
+	s := &arrivalScheduler{
+		target: n,
+		rampUp: rampUp,
+		wake:   make(chan struct{}, 1),
+	}
+	if n > 1 {
+		s.interval = rampUp / time.Duration(n-1)
+	}
+	return s
+}
+
+func (s *arrivalScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *arrivalScheduler) setPaused(paused bool) {
+	s.mu.Lock()
+	s.paused = paused
+	s.mu.Unlock()
+	s.notify()
+}
+
+// setTarget changes the number of clients to spawn in total. It cannot go
+// below the number already spawned.
+func (s *arrivalScheduler) setTarget(n int) int {
+	s.mu.Lock()
+	if n < s.spawned {
+		n = s.spawned
+	}
+	s.target = n
+	s.mu.Unlock()
+	s.notify()
+	return n
+}
+
+// done marks a spawned client as finished.
+func (s *arrivalScheduler) done() {
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+	s.notify()
+}
+
+type schedulerState struct {
+	target, spawned, inflight int
+	paused                    bool
+}
+
+func (s *arrivalScheduler) state() schedulerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return schedulerState{target: s.target, spawned: s.spawned, inflight: s.inflight, paused: s.paused}
+}
+
+// run calls spawn for every client index in order, at its scheduled time.
+// It returns once the target has been spawned and every client has called
+// done, or when ctx is done.
+func (s *arrivalScheduler) run(ctx context.Context, spawn func(i int)) ArrivalStats {
+	var stats ArrivalStats
+	if s.rampUp > 0 && s.interval > 0 {
+		stats.TargetRate = float64(time.Second) / float64(s.interval)
+	}
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	base := time.Now()
+	var first, last time.Time
+	var totalLag, skipped time.Duration
+	waiting := false
+
+	for {
+		st := s.state()
+		if st.spawned >= st.target && st.inflight == 0 {
+			break
+		}
+		if st.paused || st.spawned >= st.target {
+			// Nothing to spawn until resumed or given a higher target
+			waiting = true
+			select {
+			case <-ctx.Done():
+				return s.finish(stats, first, last, totalLag, skipped)
+			case <-s.wake:
+			}
+			continue
+		}
+
+		now := time.Now()
+		due := base.Add(time.Duration(st.spawned) * s.interval)
+		if waiting {
+			if gap := now.Sub(due); gap > 0 {
+				base = base.Add(gap)
+				due = now
+				if !first.IsZero() {
+					skipped += gap
+				}
+			}
+			waiting = false
+		}
+
+		if wait := due.Sub(now); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return s.finish(stats, first, last, totalLag, skipped)
+			case <-s.wake:
+				// Paused or retargeted while waiting; look again
+				if !timer.Stop() {
+					<-timer.C
+				}
+				continue
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			return s.finish(stats, first, last, totalLag, skipped)
+		}
+
+		now = time.Now()
+		if lag := now.Sub(due); lag > 0 {
+			totalLag += lag
+			if lag > stats.MaxLag {
+				stats.MaxLag = lag
+			}
+		}
+		if first.IsZero() {
+			first = now
+		}
+		last = now
+
+		s.mu.Lock()
+		i := s.spawned
+		s.spawned++
+		s.inflight++
+		s.mu.Unlock()
+		spawn(i)
+	}
+	return s.finish(stats, first, last, totalLag, skipped)
+}
+
+func (s *arrivalScheduler) finish(stats ArrivalStats, first, last time.Time, totalLag, skipped time.Duration) ArrivalStats {
+	st := s.state()
+	stats.Scheduled = st.target
+	stats.Spawned = st.spawned
+	if stats.Spawned > 0 {
+		stats.AvgLag = totalLag / time.Duration(stats.Spawned)
+	}
+	if elapsed := last.Sub(first) - skipped; stats.Spawned > 1 && elapsed > 0 {
+		stats.AchievedRate = float64(stats.Spawned-1) / elapsed.Seconds()
+	}
+	return stats
+}
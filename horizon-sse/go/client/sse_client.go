@@ -1,12 +1,16 @@
 package client
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,11 +21,23 @@ import (
 
 type SSEClient struct {
 	baseURL          string
-	logger           *logrus.Logger
+	logger           logrus.FieldLogger
 	activeClients    int64
 	successfulClients int64
 	failedClients    int64
 	totalMessages    int64
+	timedOutClients  int64
+	abortedClients   int64
+	scenario         *Scenario
+	clientTimeout    time.Duration
+	abortBound       time.Duration
+	anomalies        *AnomalyDetector
+	direct           bool
+	websocket        bool
+	transport        http.RoundTripper // nil for http.DefaultTransport
+
+	runMu sync.Mutex
+	run   *loadRun
 }
 
 type ClientResult struct {
@@ -29,88 +45,243 @@ type ClientResult struct {
 	Success      bool
 	Duration     time.Duration
 	MessageCount int
+	// TTFB is the time until the first data line arrived.
+	TTFB time.Duration
 	Error        error
+	// TimedOut is set when the client ran past its own deadline.
+	TimedOut bool
+	Params   ClientParams
+	// Aborted is set for clients that hung up early on purpose. They
+	// succeed if the upstream stream ended within the abort bound;
+	// AbortLatency is how long after the hang-up that was observed.
+	Aborted      bool
+	AbortLatency time.Duration
+	// DuplicateIDs and OutOfOrderIDs count events whose id was seen
+	// before, or is a number below one seen before.
+	DuplicateIDs  int
+	OutOfOrderIDs int
+	// Protocol is the HTTP version the stream was served over, such as
+	// "HTTP/2.0"; empty if the client got no response.
+	Protocol string
 }
 
-func NewSSEClient(baseURL string) *SSEClient {
-	logger := logrus.New()
-	logger.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-	})
+// idOrder checks the event ids of one stream.
+type idOrder struct {
+	seen       map[string]bool
+	max        int64
+	duplicates int
+	outOfOrder int
+}
+
+func (o *idOrder) observe(id string) {
+	if o.seen == nil {
+		o.seen = make(map[string]bool)
+	}
+	if o.seen[id] {
+		o.duplicates++
+		return
+	}
+	o.seen[id] = true
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		if n < o.max {
+			o.outOfOrder++
+		} else {
+			o.max = n
+		}
+	}
+}
 
+// endsStream reports whether ev is the last event of a stream in any of
+// the formats the client reads: OpenAI's [DONE], Anthropic's message_stop
+// and the final message of the SSE server.
+func endsStream(ev Event) bool {
+	if ev.Data == "[DONE]" || ev.Type == "message_stop" {
+		return true
+	}
+	if !strings.HasPrefix(ev.Data, "{") {
+		return false
+	}
+	var payload struct {
+		Type    string          `json:"type"`
+		Message json.RawMessage `json:"message"`
+	}
+	if json.Unmarshal([]byte(ev.Data), &payload) != nil {
+		return false
+	}
+	return payload.Type == "message_stop" || string(payload.Message) == `"Stream completed"`
+}
+
+// abortPollInterval is how often an aborted client asks the proxy whether
+// its upstream stream has ended.
+const abortPollInterval = 10 * time.Millisecond
+
+// StreamReport is the part of the proxy's /debug/streams/{id} response the
+// early-disconnect check reads.
+type StreamReport struct {
+	ClientAborted bool `json:"client_aborted"`
+	Upstream      *struct {
+		Active  bool   `json:"active"`
+		Outcome string `json:"outcome"`
+	} `json:"upstream"`
+}
+
+// NewSSEClient returns a load test client of the server at baseURL,
+// logging to the standard logger until SetLogger is called.
+func NewSSEClient(baseURL string) *SSEClient {
 	return &SSEClient{
-		baseURL: baseURL,
-		logger:  logger,
+		baseURL:       baseURL,
+		logger:        logrus.StandardLogger(),
+		clientTimeout: 20 * time.Second,
+		abortBound:    2 * time.Second,
 	}
 }
 
-func (c *SSEClient) connectToSSE(ctx context.Context, clientID string) ClientResult {
+// SetLogger makes the client log to logger, such as an application's own
+// or an entry carrying its fields.
+func (c *SSEClient) SetLogger(logger logrus.FieldLogger) {
+	c.logger = logger
+}
+
+// SetAbortBound sets how soon after an early-disconnect client hangs up
+// the upstream stream must have ended for the client to succeed.
+func (c *SSEClient) SetAbortBound(d time.Duration) {
+	c.abortBound = d
+}
+
+// SetAnomalyDetector makes RunLoadTest feed d the clients' progress, so
+// it can warn while the test runs.
+func (c *SSEClient) SetAnomalyDetector(d *AnomalyDetector) {
+	c.anomalies = d
+}
+
+// SetDirect makes clients send their completion requests straight to a
+// deep server at the base URL, as the proxy would on their behalf, instead
+// of streaming through the proxy. Such a run is the baseline the proxy's
+// overhead is measured against.
+func (c *SSEClient) SetDirect(direct bool) {
+	c.direct = direct
+}
+
+// SetTransport sends the clients' requests through t instead of
+// http.DefaultTransport, such as one that speaks only HTTP/1.1 or HTTP/2
+// so the two can be compared; the protocol each stream was served over is
+// in its result.
+func (c *SSEClient) SetTransport(t http.RoundTripper) {
+	c.transport = t
+}
+
+// SetScenario makes RunLoadTest draw each client's request parameters from
+// sc instead of using the server defaults.
+func (c *SSEClient) SetScenario(sc *Scenario) {
+	c.scenario = sc
+}
+
+// SetClientTimeout sets how long each client may take, measured from its own
+// start. Clients whose scenario parameters ask for a longer stream get its
+// expected length plus 10 seconds instead.
+func (c *SSEClient) SetClientTimeout(d time.Duration) {
+	c.clientTimeout = d
+}
+
+func (c *SSEClient) timeoutFor(params ClientParams) time.Duration {
+	timeout := c.clientTimeout
+	if expected := params.ExpectedDuration(); expected > 0 && expected+10*time.Second > timeout {
+		timeout = expected + 10*time.Second
+	}
+	return timeout
+}
+
+// fail records err as the client's outcome. Errors caused by the client's
+// own deadline are also counted as timeouts.
+func (c *SSEClient) fail(ctx context.Context, result *ClientResult, err error) {
+	result.Error = err
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+		result.TimedOut = true
+		atomic.AddInt64(&c.timedOutClients, 1)
+	}
+	atomic.AddInt64(&c.failedClients, 1)
+}
+
+func (c *SSEClient) connectToSSE(ctx context.Context, clientID string, params ClientParams) ClientResult {
 	start := time.Now()
 	result := ClientResult{
 		ClientID: clientID,
 		Success:  false,
+		Params:   params,
 	}
 
 	atomic.AddInt64(&c.activeClients, 1)
 	defer atomic.AddInt64(&c.activeClients, -1)
 
-	url := fmt.Sprintf("%s/sse?client_id=%s", c.baseURL, clientID)
-	
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		result.Error = err
-		atomic.AddInt64(&c.failedClients, 1)
-		return result
+	// Clients that hang up name their stream so they can look it up after
+	var streamID string
+	if params.DisconnectAfter > 0 {
+		streamID = fmt.Sprintf("%s-%d", clientID, start.UnixNano())
 	}
 
-	// Timeout for 10 second streams with buffer for high load
-	client := &http.Client{
-		Timeout: 20 * time.Second,
+	reqCtx, cancelReq := context.WithCancel(ctx)
+	defer cancelReq()
+	req, err := c.newRequest(reqCtx, clientID, streamID, params)
+	if err != nil {
+		c.fail(ctx, &result, err)
+		return result
 	}
 
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		result.Error = err
-		atomic.AddInt64(&c.failedClients, 1)
+		c.fail(ctx, &result, err)
 		return result
 	}
 	defer resp.Body.Close()
+	result.Protocol = resp.Proto
 
 	if resp.StatusCode != http.StatusOK {
-		result.Error = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-		atomic.AddInt64(&c.failedClients, 1)
+		c.fail(ctx, &result, &StatusError{StatusCode: resp.StatusCode})
 		return result
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
+	events, errc := ParseEvents(reqCtx, resp.Body)
 	messageCount := 0
+	var ids idOrder
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "data:") {
-			messageCount++
-			atomic.AddInt64(&c.totalMessages, 1)
-			
-			// Check for completion in either format
-			if strings.Contains(line, "[DONE]") || strings.Contains(line, "Stream completed") {
-				result.Success = true
-				result.Duration = time.Since(start)
-				result.MessageCount = messageCount
-				atomic.AddInt64(&c.successfulClients, 1)
-				
-				c.logger.WithFields(logrus.Fields{
-					"client_id":     clientID,
-					"duration":      result.Duration,
-					"message_count": messageCount,
-				}).Info("Client completed successfully")
-				return result
-			}
+	for ev := range events {
+		if ev.ID != "" {
+			ids.observe(ev.ID)
+			result.DuplicateIDs, result.OutOfOrderIDs = ids.duplicates, ids.outOfOrder
+		}
+		if messageCount == 0 {
+			result.TTFB = time.Since(start)
+			c.anomalies.observeTTFB(result.TTFB)
+		}
+		messageCount++
+		atomic.AddInt64(&c.totalMessages, 1)
+
+		if params.DisconnectAfter > 0 && messageCount >= params.DisconnectAfter {
+			cancelReq()
+			resp.Body.Close()
+			c.verifyAbort(ctx, &result, streamID, time.Now())
+			result.Duration = time.Since(start)
+			result.MessageCount = messageCount
+			return result
+		}
+
+		if endsStream(ev) {
+			result.Success = true
+			result.Duration = time.Since(start)
+			result.MessageCount = messageCount
+			atomic.AddInt64(&c.successfulClients, 1)
+
+			c.logger.WithFields(logrus.Fields{
+				"client_id":     clientID,
+				"duration":      result.Duration,
+				"message_count": messageCount,
+			}).Info("Client completed successfully")
+			return result
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		result.Error = err
-		atomic.AddInt64(&c.failedClients, 1)
+	if err := <-errc; err != nil {
+		c.fail(ctx, &result, err)
 	} else if messageCount > 0 {
 		// Stream ended without explicit [DONE] but we received messages
 		// This happens when the server closes the connection after streaming
@@ -119,8 +290,7 @@ func (c *SSEClient) connectToSSE(ctx context.Context, clientID string) ClientRes
 			"message_count": messageCount,
 			"duration":      time.Since(start),
 		}).Warn("Stream ended without [DONE] marker, treating as incomplete")
-		atomic.AddInt64(&c.failedClients, 1)
-		result.Error = fmt.Errorf("stream ended without completion marker")
+		c.fail(ctx, &result, ErrStreamTruncated)
 	}
 
 	result.Duration = time.Since(start)
@@ -128,51 +298,170 @@ func (c *SSEClient) connectToSSE(ctx context.Context, clientID string) ClientRes
 	return result
 }
 
-func (c *SSEClient) RunLoadTest(numClients int, rampUpTime time.Duration) {
+// newRequest builds a client's request: a GET of the proxy's /sse or, in
+// direct mode, the completion request the proxy would send the deep server
+// for the same parameters.
+func (c *SSEClient) newRequest(ctx context.Context, clientID, streamID string, params ClientParams) (*http.Request, error) {
+	if !c.direct {
+		url := fmt.Sprintf("%s/sse?client_id=%s", c.baseURL, clientID)
+		if q := params.Query(); len(q) > 0 {
+			url += "&" + q.Encode()
+		}
+		if streamID != "" {
+			url += "&stream_id=" + streamID
+		}
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	}
+
+	prompt := "Generate test response"
+	if params.PromptTokens > 0 {
+		prompt = strings.Repeat("test ", params.PromptTokens)
+	}
+	body := map[string]interface{}{
+		"model":    "gpt-4-turbo",
+		"messages": []map[string]string{{"role": "user", "content": prompt}},
+		"stream":   true,
+	}
+	path := "/v1/chat/completions"
+	if params.Dialect == "anthropic" {
+		body["model"] = "claude-3-5-sonnet-20241022"
+		path = "/v1/messages"
+	}
+	if params.MaxTokens > 0 {
+		body["max_tokens"] = params.MaxTokens
+	}
+	url := c.baseURL + path
+	if params.TokenDelay > 0 {
+		url += "?token_delay_ms=" + strconv.FormatInt(params.TokenDelay.Milliseconds(), 10)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if streamID != "" {
+		req.Header.Set("X-Stream-ID", streamID)
+	}
+	return req, nil
+}
+
+// verifyAbort polls the proxy until the upstream side of a stream the
+// client abandoned at hungUp has ended. The client fails if that takes
+// longer than the abort bound.
+func (c *SSEClient) verifyAbort(ctx context.Context, result *ClientResult, streamID string, hungUp time.Time) {
+	result.Aborted = true
+	atomic.AddInt64(&c.abortedClients, 1)
+	deadline := hungUp.Add(c.abortBound)
+
+	for {
+		rep, err := c.fetchStreamReport(ctx, streamID)
+		if err == nil && rep.Upstream != nil && !rep.Upstream.Active {
+			result.AbortLatency = time.Since(hungUp)
+			result.Success = true
+			atomic.AddInt64(&c.successfulClients, 1)
+			c.logger.WithFields(logrus.Fields{
+				"client_id":     result.ClientID,
+				"stream_id":     streamID,
+				"abort_latency": result.AbortLatency,
+			}).Info("Client hung up, upstream stream ended")
+			return
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			switch {
+			case err != nil:
+				err = fmt.Errorf("abort check: %w", err)
+			case rep.Upstream == nil:
+				err = fmt.Errorf("abort check: proxy did not report the upstream side of stream %s", streamID)
+			default:
+				err = fmt.Errorf("%w: stream %s, after %v", ErrAbortNotPropagated, streamID, c.abortBound)
+			}
+			c.fail(ctx, result, err)
+			return
+		}
+		time.Sleep(abortPollInterval)
+	}
+}
+
+func (c *SSEClient) fetchStreamReport(ctx context.Context, streamID string) (StreamReport, error) {
+	var rep StreamReport
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/debug/streams/%s", c.baseURL, streamID), nil)
+	if err != nil {
+		return rep, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return rep, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rep, &StatusError{StatusCode: resp.StatusCode}
+	}
+	if c.direct {
+		// The deep server's report is the upstream side itself
+		return rep, json.NewDecoder(resp.Body).Decode(&rep.Upstream)
+	}
+	return rep, json.NewDecoder(resp.Body).Decode(&rep)
+}
+
+// RunLoadTest spawns numClients clients over rampUpTime, waits for them to
+// finish, saves test-results.json and returns the run's summary. Cancelling
+// ctx aborts the run, as Abort does; the summary of the clients spawned
+// until then is returned with ctx's error. Failing to save the results is
+// returned as an error too.
+func (c *SSEClient) RunLoadTest(ctx context.Context, numClients int, rampUpTime time.Duration) (RunSummary, error) {
 	c.logger.WithFields(logrus.Fields{
 		"num_clients":  numClients,
 		"ramp_up_time": rampUpTime,
 	}).Info("Starting load test")
 
 	var wg sync.WaitGroup
-	results := make(chan ClientResult, numClients)
-	
-	// Calculate timeout based on number of clients and ramp-up time
-	// Need enough time for: ramp-up + 10s stream + buffer
-	// Add extra buffer for high-concurrency scenarios
-	streamTime := 10 * time.Second
-	bufferTime := 10 * time.Second
-	totalTimeout := rampUpTime + streamTime + bufferTime
-	
-	// For very large tests, ensure minimum timeout
-	minTimeout := 60 * time.Second
-	if totalTimeout < minTimeout {
-		totalTimeout = minTimeout
-	}
-	
-	ctx, cancel := context.WithTimeout(context.Background(), totalTimeout)
-	defer cancel()
+	var resultsMu sync.Mutex
+	var allResults []ClientResult
 
-	delayBetweenClients := time.Duration(0)
-	if numClients > 1 {
-		delayBetweenClients = rampUpTime / time.Duration(numClients-1)
+	// Parameters are drawn as clients are spawned, since the target can be
+	// raised while the test runs
+	draw := func() ClientParams { return ClientParams{} }
+	if c.scenario != nil {
+		rng := c.scenario.NewRand()
+		draw = func() ClientParams { return c.scenario.Draw(rng) }
+		c.logger.WithField("scenario", c.scenario.Name).Info("Drawing per-client parameters from scenario")
 	}
 
+	// Every client gets its own context so one client's stream length or
+	// spawn time never shortens another's; each has its own deadline,
+	// counted from when it starts.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	startTime := time.Now()
 
-	for i := 0; i < numClients; i++ {
+	scheduler := newArrivalScheduler(numClients, rampUpTime)
+	run := &loadRun{scheduler: scheduler, cancel: cancel, started: startTime}
+	c.runMu.Lock()
+	c.run = run
+	c.runMu.Unlock()
+
+	go c.anomalies.Run(runCtx)
+
+	arrivals := scheduler.run(runCtx, func(i int) {
 		wg.Add(1)
 		clientID := fmt.Sprintf("client-%d", i+1)
-		
-		go func(id string) {
-			defer wg.Done()
-			result := c.connectToSSE(ctx, id)
-			results <- result
-		}(clientID)
 
-		if i < numClients-1 {
-			time.Sleep(delayBetweenClients)
-		}
+		go func(id string, params ClientParams) {
+			defer wg.Done()
+			defer scheduler.done()
+			clientCtx, clientCancel := context.WithTimeout(runCtx, c.timeoutFor(params))
+			defer clientCancel()
+			result := c.connectToSSE(clientCtx, id, params)
+			c.anomalies.observeResult(result)
+			resultsMu.Lock()
+			allResults = append(allResults, result)
+			resultsMu.Unlock()
+		}(clientID, draw())
 
 		if (i+1)%100 == 0 {
 			c.logger.WithFields(logrus.Fields{
@@ -180,88 +469,245 @@ func (c *SSEClient) RunLoadTest(numClients int, rampUpTime time.Duration) {
 				"active":     atomic.LoadInt64(&c.activeClients),
 				"successful": atomic.LoadInt64(&c.successfulClients),
 				"failed":     atomic.LoadInt64(&c.failedClients),
+				"timed_out":  atomic.LoadInt64(&c.timedOutClients),
 			}).Info("Progress update")
 		}
+	})
+
+	// After an abort the cancelled clients still need to report
+	wg.Wait()
+	run.mu.Lock()
+	run.done = true
+	run.mu.Unlock()
+
+	c.logger.WithFields(logrus.Fields{
+		"spawned":       arrivals.Spawned,
+		"target_rate":   fmt.Sprintf("%.2f/s", arrivals.TargetRate),
+		"achieved_rate": fmt.Sprintf("%.2f/s", arrivals.AchievedRate),
+		"avg_lag":       arrivals.AvgLag,
+		"max_lag":       arrivals.MaxLag,
+	}).Info("Arrivals")
+
+	totalDuration := time.Since(startTime)
+	summary, err := c.printResults(allResults, totalDuration, arrivals)
+	if err == nil {
+		err = ctx.Err()
 	}
+	return summary, err
+}
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+// RunSummary is the outcome of a load test run.
+type RunSummary struct {
+	Clients         int
+	Successful      int
+	Failed          int
+	TimedOut        int
+	TotalMessages   int
+	Duration        time.Duration
+	AvgResponseTime time.Duration
+	// TTFB percentiles over the clients that received any data.
+	TTFBP50  time.Duration
+	TTFBP95  time.Duration
+	TTFBP99  time.Duration
+	Arrivals ArrivalStats
+	// Aborted counts early-disconnect clients, and AbortViolations those
+	// whose upstream stream outlived the abort bound. The percentiles are
+	// over the hang-ups that were propagated.
+	Aborted         int
+	AbortViolations int
+	AbortP50        time.Duration
+	AbortP95        time.Duration
+	// DuplicateIDs and OutOfOrderIDs add up the id faults clients saw.
+	DuplicateIDs  int
+	OutOfOrderIDs int
+	// Protocol is the HTTP version most clients were served over.
+	Protocol string
+}
 
-	var allResults []ClientResult
-	for result := range results {
-		allResults = append(allResults, result)
+func (s RunSummary) SuccessRate() float64 {
+	if s.Clients == 0 {
+		return 0
 	}
+	return float64(s.Successful) / float64(s.Clients) * 100
+}
 
-	totalDuration := time.Since(startTime)
-	c.printResults(allResults, totalDuration)
+func (s RunSummary) MessagesPerSecond() float64 {
+	return float64(s.TotalMessages) / s.Duration.Seconds()
+}
+
+// Metrics flattens the summary into named numbers, durations in
+// milliseconds, for trend tracking.
+func (s RunSummary) Metrics() map[string]float64 {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	m := map[string]float64{
+		"clients":              float64(s.Clients),
+		"success_rate":         s.SuccessRate(),
+		"failed_clients":       float64(s.Failed),
+		"timed_out_clients":    float64(s.TimedOut),
+		"avg_response_time_ms": ms(s.AvgResponseTime),
+		"ttfb_p50_ms":          ms(s.TTFBP50),
+		"ttfb_p95_ms":          ms(s.TTFBP95),
+		"ttfb_p99_ms":          ms(s.TTFBP99),
+		"messages_per_second":  s.MessagesPerSecond(),
+		"achieved_rate":        s.Arrivals.AchievedRate,
+	}
+	if s.Aborted > 0 {
+		m["aborted_clients"] = float64(s.Aborted)
+		m["abort_violations"] = float64(s.AbortViolations)
+		m["abort_propagation_p95_ms"] = ms(s.AbortP95)
+	}
+	if s.DuplicateIDs > 0 || s.OutOfOrderIDs > 0 {
+		m["duplicate_ids"] = float64(s.DuplicateIDs)
+		m["out_of_order_ids"] = float64(s.OutOfOrderIDs)
+	}
+	return m
 }
 
-func (c *SSEClient) printResults(results []ClientResult, totalDuration time.Duration) {
+// percentile returns the p-th percentile (0-100) of sorted durations using
+// the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func (c *SSEClient) printResults(results []ClientResult, totalDuration time.Duration, arrivals ArrivalStats) (RunSummary, error) {
 	successful := 0
 	failed := 0
+	timedOut := 0
 	var totalResponseTime time.Duration
 	totalMessages := 0
 	var errors []map[string]interface{}
+	var ttfbs []time.Duration
+	// Early hang-ups are left out of the response time average
+	completed := 0
+	aborted, abortViolations := 0, 0
+	var abortLatencies []time.Duration
+	duplicateIDs, outOfOrderIDs := 0, 0
+	protocols := make(map[string]int)
 
 	for _, r := range results {
+		if r.Protocol != "" {
+			protocols[r.Protocol]++
+		}
+		duplicateIDs += r.DuplicateIDs
+		outOfOrderIDs += r.OutOfOrderIDs
+		if r.TTFB > 0 {
+			ttfbs = append(ttfbs, r.TTFB)
+		}
+		if r.Aborted {
+			aborted++
+			if r.Success {
+				abortLatencies = append(abortLatencies, r.AbortLatency)
+			} else {
+				abortViolations++
+			}
+		}
 		if r.Success {
 			successful++
-			totalResponseTime += r.Duration
 			totalMessages += r.MessageCount
+			if !r.Aborted {
+				completed++
+				totalResponseTime += r.Duration
+			}
 		} else {
 			failed++
+			if r.TimedOut {
+				timedOut++
+			}
 			if r.Error != nil {
 				errors = append(errors, map[string]interface{}{
 					"client_id": r.ClientID,
 					"error":     r.Error.Error(),
+					"timed_out": r.TimedOut,
 				})
 				c.logger.WithFields(logrus.Fields{
 					"client_id": r.ClientID,
 					"error":     r.Error,
+					"timed_out": r.TimedOut,
 				}).Error("Client failed")
 			}
 		}
 	}
 
 	avgResponseTime := time.Duration(0)
-	if successful > 0 {
-		avgResponseTime = totalResponseTime / time.Duration(successful)
+	if completed > 0 {
+		avgResponseTime = totalResponseTime / time.Duration(completed)
 	}
 
-	successRate := float64(successful) / float64(len(results)) * 100
+	sort.Slice(ttfbs, func(i, j int) bool { return ttfbs[i] < ttfbs[j] })
+	sort.Slice(abortLatencies, func(i, j int) bool { return abortLatencies[i] < abortLatencies[j] })
+	summary := RunSummary{
+		Clients:         len(results),
+		Successful:      successful,
+		Failed:          failed,
+		TimedOut:        timedOut,
+		TotalMessages:   totalMessages,
+		Duration:        totalDuration,
+		AvgResponseTime: avgResponseTime,
+		TTFBP50:         percentile(ttfbs, 50),
+		TTFBP95:         percentile(ttfbs, 95),
+		TTFBP99:         percentile(ttfbs, 99),
+		Arrivals:        arrivals,
+		Aborted:         aborted,
+		AbortViolations: abortViolations,
+		AbortP50:        percentile(abortLatencies, 50),
+		AbortP95:        percentile(abortLatencies, 95),
+		DuplicateIDs:    duplicateIDs,
+		OutOfOrderIDs:   outOfOrderIDs,
+	}
+	for proto, n := range protocols {
+		if n > protocols[summary.Protocol] || n == protocols[summary.Protocol] && proto < summary.Protocol {
+			summary.Protocol = proto
+		}
+	}
+	successRate := summary.SuccessRate()
 	
 	c.logger.WithFields(logrus.Fields{
 		"total_duration":        totalDuration,
 		"total_clients":         len(results),
 		"successful_clients":    successful,
 		"failed_clients":        failed,
+		"timed_out_clients":     timedOut,
 		"success_rate":          fmt.Sprintf("%.2f%%", successRate),
 		"avg_response_time":     avgResponseTime,
+		"ttfb_p95":              summary.TTFBP95,
 		"total_messages":        totalMessages,
 		"messages_per_second":   float64(totalMessages) / totalDuration.Seconds(),
 		"requests_per_second":   float64(len(results)) / totalDuration.Seconds(),
+		"aborted_clients":       aborted,
+		"abort_violations":      abortViolations,
+		"abort_propagation_p95": summary.AbortP95,
+		"duplicate_ids":         duplicateIDs,
+		"out_of_order_ids":      outOfOrderIDs,
+		"protocol":              summary.Protocol,
 	}).Info("Load test completed")
 
 	// Save results to JSON file
-	c.saveResultsToFile(results, totalDuration, successful, failed, totalMessages, avgResponseTime, successRate, errors)
+	return summary, c.saveResultsToFile(results, summary, errors)
 }
 
-func (c *SSEClient) saveResultsToFile(results []ClientResult, totalDuration time.Duration, 
-	successful, failed, totalMessages int, avgResponseTime time.Duration, successRate float64, errors []map[string]interface{}) {
+func (c *SSEClient) saveResultsToFile(results []ClientResult, summary RunSummary, errors []map[string]interface{}) error {
+	totalDuration := summary.Duration
 	
 	// Get final metrics from servers
 	proxyMetrics := make(map[string]interface{})
 	deepMetrics := make(map[string]interface{})
 	
-	if resp, err := http.Get(fmt.Sprintf("%s/metrics", c.baseURL)); err == nil {
+	// Assuming deep server is on port 10081
+	deepURL := strings.Replace(c.baseURL, "10080", "10081", 1)
+	if c.direct {
+		deepURL = c.baseURL
+	} else if resp, err := http.Get(fmt.Sprintf("%s/metrics", c.baseURL)); err == nil {
 		defer resp.Body.Close()
 		json.NewDecoder(resp.Body).Decode(&proxyMetrics)
 	}
 	
-	// Assuming deep server is on port 10081
-	deepURL := strings.Replace(c.baseURL, "10080", "10081", 1)
 	if resp, err := http.Get(fmt.Sprintf("%s/metrics", deepURL)); err == nil {
 		defer resp.Body.Close()
 		json.NewDecoder(resp.Body).Decode(&deepMetrics)
@@ -272,50 +718,129 @@ func (c *SSEClient) saveResultsToFile(results []ClientResult, totalDuration time
 		"test_duration": totalDuration.String(),
 		"summary": map[string]interface{}{
 			"total_clients":        len(results),
-			"successful_clients":   successful,
-			"failed_clients":       failed,
-			"success_rate":         fmt.Sprintf("%.2f%%", successRate),
-			"avg_response_time":    avgResponseTime.String(),
-			"total_messages":       totalMessages,
-			"messages_per_second":  float64(totalMessages) / totalDuration.Seconds(),
+			"successful_clients":   summary.Successful,
+			"failed_clients":       summary.Failed,
+			"timed_out_clients":    summary.TimedOut,
+			"success_rate":         fmt.Sprintf("%.2f%%", summary.SuccessRate()),
+			"avg_response_time":    summary.AvgResponseTime.String(),
+			"ttfb_p50":             summary.TTFBP50.String(),
+			"ttfb_p95":             summary.TTFBP95.String(),
+			"ttfb_p99":             summary.TTFBP99.String(),
+			"total_messages":       summary.TotalMessages,
+			"messages_per_second":  summary.MessagesPerSecond(),
 			"requests_per_second":  float64(len(results)) / totalDuration.Seconds(),
+			"aborted_clients":      summary.Aborted,
+			"abort_violations":     summary.AbortViolations,
+			"abort_propagation_p50": summary.AbortP50.String(),
+			"abort_propagation_p95": summary.AbortP95.String(),
+			"duplicate_ids":        summary.DuplicateIDs,
+			"out_of_order_ids":     summary.OutOfOrderIDs,
 		},
+		"arrivals":      summary.Arrivals.toMap(),
+		"by_dialect":    summarizeBy(results, func(r ClientResult) string { return r.Params.Dialect }),
+		"by_protocol":   summarizeBy(results, protocolOf),
 		"proxy_metrics": proxyMetrics,
 		"deep_metrics":  deepMetrics,
 		"errors":        errors,
 		"test_config": map[string]interface{}{
 			"num_clients": len(results),
 			"server_url":  c.baseURL,
+			"direct":      c.direct,
+			"websocket":   c.websocket,
 		},
 	}
+	if c.anomalies != nil {
+		resultData["anomalies"] = c.anomalies.Alerts()
+	}
+	if c.scenario != nil {
+		resultData["test_config"].(map[string]interface{})["scenario"] = c.scenario
+	}
 
 	// Save to file
 	jsonData, err := json.MarshalIndent(resultData, "", "  ")
 	if err != nil {
-		c.logger.WithError(err).Error("Failed to marshal results to JSON")
-		return
+		return fmt.Errorf("encoding results: %w", err)
 	}
 
 	// Write to current working directory (which will be /work in Docker)
 	filename := "test-results.json"
 	if err := os.WriteFile(filename, jsonData, 0644); err != nil {
-		c.logger.WithError(err).Error("Failed to write results to file")
-		return
+		return fmt.Errorf("saving results: %w", err)
 	}
 
 	c.logger.WithField("file", filename).Info("Test results saved to file")
+	return nil
 }
 
-func (c *SSEClient) MonitorMetrics(interval time.Duration, duration time.Duration) {
+// protocolOf groups results by protocol, those that got no response as
+// "none".
+func protocolOf(r ClientResult) string {
+	if r.Protocol == "" {
+		return "none"
+	}
+	return r.Protocol
+}
+
+// summarizeBy breaks the results down by key, such as the dialect each
+// client requested or the protocol it was served over, so heterogeneous
+// runs show whether one kind of stream fails more than another. Results
+// without a key are grouped as "default".
+func summarizeBy(results []ClientResult, key func(ClientResult) string) map[string]interface{} {
+	type group struct {
+		clients, successful, messages int
+		duration                      time.Duration
+	}
+	groups := make(map[string]*group)
+	for _, r := range results {
+		k := key(r)
+		if k == "" {
+			k = "default"
+		}
+		g, ok := groups[k]
+		if !ok {
+			g = &group{}
+			groups[k] = g
+		}
+		g.clients++
+		if r.Success {
+			g.successful++
+			g.messages += r.MessageCount
+			g.duration += r.Duration
+		}
+	}
+
+	summary := make(map[string]interface{}, len(groups))
+	for k, g := range groups {
+		avg := time.Duration(0)
+		if g.successful > 0 {
+			avg = g.duration / time.Duration(g.successful)
+		}
+		summary[k] = map[string]interface{}{
+			"clients":           g.clients,
+			"successful":        g.successful,
+			"total_messages":    g.messages,
+			"avg_response_time": avg.String(),
+		}
+	}
+	return summary
+}
+
+// MonitorMetrics logs the server's metrics every interval until ctx is
+// done. A server that cannot be reached is logged and asked again at the
+// next tick.
+func (c *SSEClient) MonitorMetrics(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	timeout := time.After(duration)
-
 	for {
 		select {
 		case <-ticker.C:
-			resp, err := http.Get(fmt.Sprintf("%s/metrics", c.baseURL))
+			req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/metrics", c.baseURL), nil)
+			if err != nil {
+				c.logger.WithError(err).Error("Failed to fetch metrics")
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
 			if err != nil {
 				c.logger.WithError(err).Error("Failed to fetch metrics")
 				continue
@@ -327,7 +852,7 @@ func (c *SSEClient) MonitorMetrics(interval time.Duration, duration time.Duratio
 			
 			c.logger.WithField("metrics", string(body[:n])).Info("Server metrics")
 
-		case <-timeout:
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"horizon-sse-go/websocket"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// In direct mode clients send the deep server the request the proxy would
+// have sent it.
+func TestDirectRequests(t *testing.T) {
+	type request struct {
+		path, delay string
+		body        map[string]interface{}
+	}
+	received := make(chan request, 1)
+	deep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- request{r.URL.Path, r.URL.Query().Get("token_delay_ms"), body}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer deep.Close()
+
+	c := NewSSEClient(deep.URL)
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	c.SetLogger(quiet)
+	c.SetDirect(true)
+
+	result := c.connectToSSE(context.Background(), "client-1", ClientParams{
+		Dialect:    "anthropic",
+		MaxTokens:  50,
+		TokenDelay: 5 * time.Millisecond,
+	})
+	if !result.Success || result.MessageCount != 2 || result.Protocol != "HTTP/1.1" {
+		t.Fatalf("result = %+v", result)
+	}
+	got := <-received
+	if got.path != "/v1/messages" || got.delay != "5" {
+		t.Errorf("request to %s?token_delay_ms=%s", got.path, got.delay)
+	}
+	if got.body["stream"] != true || got.body["max_tokens"] != 50.0 || got.body["model"] != "claude-3-5-sonnet-20241022" {
+		t.Errorf("request body %v", got.body)
+	}
+}
+
+// Results are broken down by the protocol they were served over, those
+// that got no response apart.
+func TestSummarizeByProtocol(t *testing.T) {
+	results := []ClientResult{
+		{Success: true, MessageCount: 3, Duration: time.Second, Protocol: "HTTP/2.0"},
+		{Success: true, MessageCount: 5, Duration: 3 * time.Second, Protocol: "HTTP/2.0"},
+		{Success: false, Protocol: "HTTP/1.1"},
+		{Success: false},
+	}
+	got := summarizeBy(results, protocolOf)
+	h2 := got["HTTP/2.0"].(map[string]interface{})
+	if len(got) != 3 || got["none"] == nil || h2["clients"] != 2 || h2["total_messages"] != 8 || h2["avg_response_time"] != "2s" {
+		t.Errorf("summary %v", got)
+	}
+}
+
+// Over WebSocket, clients send the same request to /ws and read the same
+// events.
+func TestWebSocketRequests(t *testing.T) {
+	type request struct {
+		query, body string
+	}
+	received := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" {
+			http.NotFound(w, r)
+			return
+		}
+		websocket.ServeSSE(w, r, func(body []byte) websocket.Route {
+			return websocket.Route{Method: http.MethodPost, Path: "/sse", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- request{r.URL.RawQuery, string(body)}
+				if r.URL.Query().Get("max_tokens") == "1" {
+					http.Error(w, "overloaded", http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+			})}
+		})
+	}))
+	defer srv.Close()
+
+	c := NewSSEClient(srv.URL)
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	c.SetLogger(quiet)
+	c.SetWebSocket(true)
+
+	result := c.connectToSSE(context.Background(), "client-1", ClientParams{MaxTokens: 50})
+	if !result.Success || result.MessageCount != 2 {
+		t.Fatalf("result = %+v", result)
+	}
+	if got := <-received; got.query != "client_id=client-1&max_tokens=50" || got.body != "" {
+		t.Errorf("proxied request %+v", got)
+	}
+
+	result = c.connectToSSE(context.Background(), "client-2", ClientParams{MaxTokens: 1})
+	<-received
+	if result.Success || result.Error == nil || !strings.Contains(result.Error.Error(), "status code: 503") {
+		t.Errorf("refused stream: %+v", result)
+	}
+
+	c.SetDirect(true)
+	result = c.connectToSSE(context.Background(), "client-3", ClientParams{Dialect: "anthropic"})
+	got := <-received
+	if !result.Success || got.query != "dialect=anthropic" || !strings.Contains(got.body, `"model":"claude-3-5-sonnet-20241022"`) {
+		t.Errorf("direct request %+v: %+v", got, result)
+	}
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dialect is the wire format of a model stream.
+type Dialect string
+
+const (
+	// DialectAuto picks the dialect from the first event of the stream.
+	DialectAuto      Dialect = "auto"
+	DialectOpenAI    Dialect = "openai"
+	DialectAnthropic Dialect = "anthropic"
+	// DialectPlain treats every event's data as text. The stream ends at a
+	// "[DONE]" event or when the body ends.
+	DialectPlain Dialect = "plain"
+)
+
+// ParseDialect parses a dialect name; an empty string means DialectAuto.
+func ParseDialect(s string) (Dialect, error) {
+	switch d := Dialect(strings.ToLower(s)); d {
+	case "":
+		return DialectAuto, nil
+	case DialectAuto, DialectOpenAI, DialectAnthropic, DialectPlain:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown dialect %q (want auto, openai, anthropic or plain)", s)
+}
+
+// StreamEventKind says what a StreamEvent carries.
+type StreamEventKind int
+
+const (
+	// KindToken carries the next piece of generated text.
+	KindToken StreamEventKind = iota
+	// KindUsage carries updated token counts.
+	KindUsage
+	// KindDone ends the stream. It carries the stop reason and the final
+	// usage, if the provider reported them.
+	KindDone
+)
+
+func (k StreamEventKind) String() string {
+	switch k {
+	case KindToken:
+		return "token"
+	case KindUsage:
+		return "usage"
+	default:
+		return "done"
+	}
+}
+
+// StreamUsage is a provider-independent token count.
+type StreamUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// StreamEvent is a normalized stream event.
+type StreamEvent struct {
+	Kind       StreamEventKind
+	Text       string
+	Usage      *StreamUsage
+	StopReason string
+	// Raw is the SSE event this was derived from.
+	Raw Event
+}
+
+// StreamReader reads a model stream in any supported dialect as a sequence
+// of Token, Usage and Done events, so callers do not depend on a provider's
+// wire format.
+type StreamReader struct {
+	events  *eventReader
+	dialect Dialect
+	pending []StreamEvent
+	usage   *StreamUsage
+	stop    string
+	done    bool
+}
+
+// NewStreamReader returns a StreamReader for r. With DialectAuto the
+// dialect is detected from the first event.
+func NewStreamReader(r io.Reader, dialect Dialect) *StreamReader {
+	if dialect == "" {
+		dialect = DialectAuto
+	}
+	return &StreamReader{events: newEventReader(r), dialect: dialect}
+}
+
+// Dialect returns the stream's dialect. Until the first event has been read
+// from an auto-detected stream it returns DialectAuto.
+func (sr *StreamReader) Dialect() Dialect {
+	return sr.dialect
+}
+
+// Next returns the next event. After the Done event it returns io.EOF. A
+// stream that ends without its dialect's end marker returns an error
+// matching both ErrStreamTruncated and io.ErrUnexpectedEOF.
+func (sr *StreamReader) Next() (StreamEvent, error) {
+	for len(sr.pending) == 0 {
+		if sr.done {
+			return StreamEvent{}, io.EOF
+		}
+		raw, err := sr.events.next()
+		if err == io.EOF {
+			if sr.dialect == DialectPlain {
+				sr.finish(Event{})
+				continue
+			}
+			return StreamEvent{}, fmt.Errorf("%w: %w", ErrStreamTruncated, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		if sr.dialect == DialectAuto {
+			sr.dialect = detectDialect(raw)
+		}
+		if err := sr.decode(raw); err != nil {
+			return StreamEvent{}, err
+		}
+	}
+
+	ev := sr.pending[0]
+	sr.pending = sr.pending[1:]
+	return ev, nil
+}
+
+// detectDialect guesses the dialect of a stream from its first event.
+func detectDialect(raw Event) Dialect {
+	switch raw.Type {
+	case "message_start", "content_block_start", "content_block_delta", "ping", "error":
+		return DialectAnthropic
+	}
+	if raw.Data == "[DONE]" {
+		return DialectOpenAI
+	}
+	var probe struct {
+		Type    string          `json:"type"`
+		Object  string          `json:"object"`
+		Choices json.RawMessage `json:"choices"`
+	}
+	if json.Unmarshal([]byte(raw.Data), &probe) == nil {
+		switch {
+		case probe.Choices != nil || strings.HasPrefix(probe.Object, "chat.completion"):
+			return DialectOpenAI
+		case strings.HasPrefix(probe.Type, "message_"), strings.HasPrefix(probe.Type, "content_block_"):
+			return DialectAnthropic
+		}
+	}
+	return DialectPlain
+}
+
+func (sr *StreamReader) decode(raw Event) error {
+	switch sr.dialect {
+	case DialectOpenAI:
+		return sr.decodeOpenAI(raw)
+	case DialectAnthropic:
+		return sr.decodeAnthropic(raw)
+	default:
+		if raw.Data == "[DONE]" {
+			sr.finish(raw)
+		} else {
+			sr.emit(StreamEvent{Kind: KindToken, Text: raw.Data, Raw: raw})
+		}
+		return nil
+	}
+}
+
+func (sr *StreamReader) decodeOpenAI(raw Event) error {
+	chunk, err := DecodeChatCompletionChunk(raw.Data)
+	if err == ErrStreamDone {
+		sr.finish(raw)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range chunk.Choices {
+		// Only the first choice is normalized; n>1 streams need the typed API.
+		if ch.Index != 0 {
+			continue
+		}
+		if ch.Delta.Content != "" {
+			sr.emit(StreamEvent{Kind: KindToken, Text: ch.Delta.Content, Raw: raw})
+		}
+		if ch.FinishReason != nil {
+			sr.stop = *ch.FinishReason
+		}
+	}
+	if chunk.Usage != nil {
+		sr.usage = &StreamUsage{
+			InputTokens:  chunk.Usage.PromptTokens,
+			OutputTokens: chunk.Usage.CompletionTokens,
+		}
+		sr.emitUsage(raw)
+	}
+	return nil
+}
+
+func (sr *StreamReader) decodeAnthropic(raw Event) error {
+	ev, err := DecodeAnthropicEvent(raw.Type, raw.Data)
+	if err == ErrStreamDone {
+		sr.finish(raw)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch ev.Type {
+	case "message_start":
+		if ev.Message != nil {
+			usage := ev.Message.Usage
+			sr.usage = &StreamUsage{InputTokens: usage.InputTokens, OutputTokens: usage.OutputTokens}
+			sr.emitUsage(raw)
+		}
+	case "content_block_delta":
+		if ev.Delta != nil && ev.Delta.Text != "" {
+			sr.emit(StreamEvent{Kind: KindToken, Text: ev.Delta.Text, Raw: raw})
+		}
+	case "message_delta":
+		if ev.Delta != nil && ev.Delta.StopReason != nil {
+			sr.stop = *ev.Delta.StopReason
+		}
+		if ev.Usage != nil {
+			if sr.usage == nil {
+				sr.usage = &StreamUsage{}
+			}
+			sr.usage.OutputTokens = ev.Usage.OutputTokens
+			if ev.Usage.InputTokens > 0 {
+				sr.usage.InputTokens = ev.Usage.InputTokens
+			}
+			sr.emitUsage(raw)
+		}
+	case "error":
+		if ev.Error != nil {
+			return ev.Error
+		}
+		return ErrStreamError
+	}
+	return nil
+}
+
+func (sr *StreamReader) emit(ev StreamEvent) {
+	sr.pending = append(sr.pending, ev)
+}
+
+func (sr *StreamReader) emitUsage(raw Event) {
+	usage := *sr.usage
+	sr.emit(StreamEvent{Kind: KindUsage, Usage: &usage, Raw: raw})
+}
+
+func (sr *StreamReader) finish(raw Event) {
+	ev := StreamEvent{Kind: KindDone, StopReason: sr.stop, Raw: raw}
+	if sr.usage != nil {
+		usage := *sr.usage
+		ev.Usage = &usage
+	}
+	sr.emit(ev)
+	sr.done = true
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"errors"
+	"horizon-sse-go/websocket"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SetWebSocket makes clients receive their streams over WebSocket from the
+// server's /ws endpoint instead of as SSE, with the same request, so the
+// two transports can be compared under the same load.
+func (c *SSEClient) SetWebSocket(ws bool) {
+	c.websocket = ws
+}
+
+// do sends a client's request over the configured transport.
+func (c *SSEClient) do(req *http.Request) (*http.Response, error) {
+	if !c.websocket {
+		// The deadline comes from the request's context, which starts
+		// with this client
+		return (&http.Client{Transport: c.transport}).Do(req)
+	}
+	return doWebSocket(req)
+}
+
+// doWebSocket sends req as a WebSocket stream: the connection goes to the
+// server's /ws, with the request's query and headers, and the body is the
+// first message. The events come back, as SSE, in the body of a synthetic
+// 200 response; a stream the server refused fails its read with the status.
+func doWebSocket(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	q := u.Query()
+	if strings.HasSuffix(u.Path, "/v1/messages") {
+		q.Set("dialect", "anthropic")
+	}
+	u.RawQuery = q.Encode()
+	base := strings.TrimSuffix(u.Path, "/sse")
+	if i := strings.Index(base, "/v1/"); i >= 0 {
+		base = base[:i]
+	}
+	u.Path = base + "/ws"
+
+	conn, resp, err := websocket.Dial(req.Context(), u.String(), req.Header)
+	if err != nil {
+		if resp != nil {
+			return resp, nil
+		}
+		return nil, err
+	}
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := conn.WriteText(body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      resp.Proto,
+		ProtoMajor: resp.ProtoMajor,
+		ProtoMinor: resp.ProtoMinor,
+		Header:     resp.Header,
+		Body:       &wsBody{websocket.NewEventReader(conn)},
+		Request:    req,
+	}, nil
+}
+
+// wsBody reports a stream closed for an HTTP status as a StatusError.
+type wsBody struct {
+	*websocket.EventReader
+}
+
+func (b *wsBody) Read(p []byte) (int, error) {
+	n, err := b.EventReader.Read(p)
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code > websocket.CloseStatusBase {
+		err = &StatusError{StatusCode: closeErr.Code - websocket.CloseStatusBase, Reason: closeErr.Reason}
+	}
+	return n, err
+}
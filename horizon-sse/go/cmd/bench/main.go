@@ -0,0 +1,184 @@
+// Command bench runs micro-benchmark scenarios for tuning the streaming
+// servers in-process, without the deep server or proxy binaries.
+//
+//	bench write-buffers [flags]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"horizon-sse-go/server"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var scenarios = map[string]func(args []string) int{
+	"write-buffers": runWriteBuffers,
+}
+
+func main() {
+	if len(os.Args) < 2 || scenarios[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: bench SCENARIO [flags]; scenarios: write-buffers")
+		os.Exit(2)
+	}
+	os.Exit(scenarios[os.Args[1]](os.Args[2:]))
+}
+
+// runWriteBuffers streams token-sized events through an SSE handler under
+// each -http-buffers setting, over HTTP/1.1 and HTTP/2, and reports the
+// socket writes each took. Every write to the socket is a syscall.
+func runWriteBuffers(args []string) int {
+	fs := flag.NewFlagSet("write-buffers", flag.ExitOnError)
+	settings := fs.String("settings", "default;write=16KB;write=64KB;write=64KB,h2-frame=64KB", "Semicolon-separated -http-buffers settings to compare; default is net/http's own")
+	protocols := fs.String("protocols", "h1,h2", "Protocols to run each setting over: h1 (plaintext HTTP/1.1) and h2 (HTTP/2 over TLS)")
+	clients := fs.Int("clients", 50, "Concurrent streams")
+	events := fs.Int("events", 2000, "Events per stream")
+	eventBytes := fs.Int("event-bytes", 64, "Payload bytes per event; LLM tokens make for small events")
+	batch := fs.Int("batch", 256, "Events written between flushes, as a proxy batches events queued while it wrote")
+	fs.Parse(args)
+
+	if *clients < 1 || *events < 1 || *batch < 1 {
+		fmt.Fprintln(os.Stderr, "-clients, -events and -batch must be at least 1")
+		return 2
+	}
+	var runs []server.HTTPBuffers
+	var names []string
+	for _, spec := range strings.Split(*settings, ";") {
+		spec = strings.TrimSpace(spec)
+		b, err := server.ParseHTTPBuffers(strings.TrimPrefix(spec, "default"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		runs = append(runs, b)
+		names = append(names, spec)
+	}
+
+	handler := streamHandler(*events, *eventBytes, *batch)
+	fmt.Printf("%d streams x %d events of %d bytes, flushed every %d events\n\n", *clients, *events, *eventBytes, *batch)
+	fmt.Printf("%-5s %-28s %10s %11s %12s %10s\n", "proto", "settings", "writes", "writes/fl", "bytes/write", "duration")
+	for _, proto := range strings.Split(*protocols, ",") {
+		proto = strings.TrimSpace(proto)
+		if proto != "h1" && proto != "h2" {
+			fmt.Fprintf(os.Stderr, "unknown protocol %q\n", proto)
+			return 2
+		}
+		for i, b := range runs {
+			r, err := benchWrites(handler, b, proto == "h2", *clients)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			flushes := *clients * ((*events + *batch - 1) / *batch)
+			fmt.Printf("%-5s %-28s %10d %11.2f %12.0f %10v\n", proto, names[i], r.writes,
+				float64(r.writes)/float64(flushes), float64(r.bytes)/float64(r.writes), r.duration.Round(time.Millisecond))
+		}
+	}
+	return 0
+}
+
+// streamHandler writes events the way SSEServer does, a few small writes
+// per event, flushing after every batch of them.
+func streamHandler(events, eventBytes, batch int) http.Handler {
+	payload := strings.Repeat("x", eventBytes)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for i := 1; i <= events; i++ {
+			fmt.Fprintf(w, "id: %d\n", i)
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			if i%batch == 0 || i == events {
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+type writeStats struct {
+	writes   int64
+	bytes    int64
+	duration time.Duration
+}
+
+// benchWrites serves handler with buffers and reads one stream per client
+// at once, counting the writes the server made to its sockets.
+func benchWrites(handler http.Handler, buffers server.HTTPBuffers, h2 bool, clients int) (writeStats, error) {
+	var stats writeStats
+	srv := httptest.NewUnstartedServer(buffers.Handler(handler))
+	srv.Listener = &countingListener{Listener: srv.Listener, stats: &stats}
+	buffers.Apply(srv.Config)
+	if h2 {
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	defer srv.Close()
+
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.MaxIdleConnsPerHost = clients
+	buffers.ApplyTransport(transport)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			if h2 && resp.ProtoMajor != 2 {
+				errs <- fmt.Errorf("got %s, want HTTP/2", resp.Proto)
+				return
+			}
+			if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	stats.duration = time.Since(start)
+	// Close waits for the handlers, so the counts are final
+	srv.Close()
+	close(errs)
+	return stats, <-errs
+}
+
+// countingListener counts the writes to the connections it accepts, below
+// TLS when the server speaks it.
+type countingListener struct {
+	net.Listener
+	stats *writeStats
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c, stats: l.stats}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	stats *writeStats
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.stats.writes, 1)
+	atomic.AddInt64(&c.stats.bytes, int64(len(p)))
+	return c.Conn.Write(p)
+}
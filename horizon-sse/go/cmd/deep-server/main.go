@@ -1,13 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"horizon-sse-go/batch"
+	"horizon-sse-go/client"
+	"horizon-sse-go/config"
+	"horizon-sse-go/grpcapi"
+	"horizon-sse-go/retention"
+	"horizon-sse-go/server"
+	"horizon-sse-go/websocket"
+	"io"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,12 +32,609 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// DeepServerConfig holds the settings the deep server is started with.
+type DeepServerConfig struct {
+	// Headers and Trailers are added to every streamed response. Values may
+	// use {stream_id}, which is replaced with the completion ID.
+	Headers  []HeaderField
+	Trailers []HeaderField
+	// UsageTrailers adds trailers summarising the stream (token count and
+	// duration), the way some providers report usage after the body.
+	UsageTrailers bool
+	// WattsPerCore, if set, adds an energy estimate to /usage.
+	WattsPerCore float64
+	// The pause before the first token, standing in for prompt
+	// processing: PromptDelayBase plus PromptDelayPerKB for every KB of
+	// request body and PromptDelayPerToken for every estimated prompt
+	// token, capped at PromptDelayMax if set.
+	PromptDelayBase     time.Duration
+	PromptDelayPerKB    time.Duration
+	PromptDelayPerToken time.Duration
+	PromptDelayMax      time.Duration
+	// DeterministicContent makes the tokens of a response a function of
+	// the request, so repeating a request repeats the response.
+	DeterministicContent bool
+	// EventSizeMin and EventSizeMax, if set, pad the text of every token
+	// event to a random size in that range, in bytes. StreamDuration, if
+	// set, keeps each stream going for that long, cycling through the
+	// response, instead of ending after its tokens.
+	EventSizeMin   int
+	EventSizeMax   int
+	StreamDuration time.Duration
+	// Noise interleaves spec-legal lines that carry no message between
+	// events, to check that parsers downstream skip them.
+	Noise NoiseRates
+	// SequenceIDs numbers the events of each stream with id: 1, 2, ...
+	// DuplicateRate and ReorderRate are the chances that a token event is
+	// sent twice, or held back and sent after the next one; either turns
+	// on the numbering, so clients and the proxy can spot the fault.
+	SequenceIDs   bool
+	DuplicateRate float64
+	ReorderRate   float64
+	// TimeScale runs the simulated timing that many times faster: token
+	// and prompt delays, scripted delays and stream durations shrink alike,
+	// and stream timestamps advance as fast, so a 15-second stream looks
+	// the same to clients but completes in milliseconds.
+	TimeScale float64
+	// IdleLeakAfter is how long a keep-alive connection may sit idle
+	// before /metrics counts it as leaked.
+	IdleLeakAfter time.Duration
+	// Heartbeat, if set, sends a ": ping" comment on a stream that has
+	// been quiet for that long, and flushes the headers of every stream
+	// up front, so a long prompt delay doesn't look like a dead upstream.
+	Heartbeat time.Duration
+	// Models is the catalog of models served, each with its own pacing,
+	// output length, failure rates and dialect. A request for a model not
+	// in it is answered with a 404. Empty serves any model name as
+	// gpt-4-turbo or claude-3-5-sonnet-20241022, by dialect.
+	Models []ModelProfile
+	// EmbeddingDimensions is the length of the vectors /v1/embeddings
+	// returns to requests that don't ask for dimensions; 1536 if zero.
+	// UnaryLatency, plus UnaryLatencyPerKB for every KB of request body,
+	// is how long /v1/embeddings and /v1/moderations take to answer.
+	EmbeddingDimensions int
+	UnaryLatency        time.Duration
+	UnaryLatencyPerKB   time.Duration
+	// BatchRate is how many requests of a batch run per second, under
+	// TimeScale; batch.DefaultRate if zero.
+	BatchRate float64
+	// Scenarios are the responses requests can pick by name or content,
+	// as loaded by loadScenarios.
+	Scenarios []*Scenario
+	// Chaos is the fault injection of streams without an X-Chaos header.
+	Chaos Chaos
+	// Recordings are upstream streams recorded by the proxy, replayed to
+	// requests that name them or that nothing is scripted for.
+	Recordings []*server.Recording
+}
+
+// NoiseRates are the chances, for every event, that the deep server
+// precedes it with a comment line, an extra blank line, or a line with a
+// field name SSE does not define. Comments and unknown fields become part
+// of the event that follows; the blank line ends an empty one.
+type NoiseRates struct {
+	Comments   float64
+	KeepAlives float64
+	Fields     float64
+}
+
+// parseNoiseRates parses a spec such as "comments=0.3,keepalives=0.1".
+func parseNoiseRates(spec string) (NoiseRates, error) {
+	var rates NoiseRates
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return rates, fmt.Errorf("invalid noise rate %q", entry)
+		}
+		switch strings.TrimSpace(name) {
+		case "comments":
+			rates.Comments = rate
+		case "keepalives":
+			rates.KeepAlives = rate
+		case "fields":
+			rates.Fields = rate
+		default:
+			return rates, fmt.Errorf("unknown noise kind %q", name)
+		}
+	}
+	return rates, nil
+}
+
+// parseSizeRange parses "64KB-5MB", or a single size for both bounds.
+func parseSizeRange(v string) (lo, hi int, err error) {
+	first, second, isRange := strings.Cut(v, "-")
+	if lo, err = server.ParseSize(first); err != nil {
+		return 0, 0, err
+	}
+	hi = lo
+	if isRange {
+		if hi, err = server.ParseSize(second); err != nil {
+			return 0, 0, err
+		}
+	}
+	if hi < lo {
+		return 0, 0, fmt.Errorf("size range %q ends below its start", v)
+	}
+	return lo, hi, nil
+}
+
+// Chaos is the chance of each fault the deep server injects into a
+// stream, drawn once per request, and how the fault plays out.
+type Chaos struct {
+	// Disconnect drops the connection after a random token.
+	Disconnect float64
+	// Error fails the request with ErrorStatus before it streams.
+	Error       float64
+	ErrorStatus int
+	// Stall stops the stream after a random token for StallFor, then
+	// goes on.
+	Stall    float64
+	StallFor time.Duration
+	// Malformed cuts the JSON of a random token event short, past the
+	// first.
+	Malformed float64
+	// Trickle writes every event of the stream trickleBytes at a time,
+	// TricklePause apart.
+	Trickle      float64
+	TricklePause time.Duration
+}
+
+// chaosHeader carries the chaos of one request, in the syntax of -chaos,
+// in place of the server's.
+const chaosHeader = "X-Chaos"
+
+// parseChaos parses a spec such as "disconnect=0.05,error=0.02:502,
+// stall=0.1:30s": the chance of each fault, with the status of errors,
+// how long stalls last and the pause of trickles after a colon. They
+// default to 503, 30s and 20ms. "none" injects nothing.
+func parseChaos(spec string) (Chaos, error) {
+	var c Chaos
+	if strings.TrimSpace(spec) == "none" {
+		return c, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		value, arg, hasArg := strings.Cut(value, ":")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return c, fmt.Errorf("invalid chaos rate %q", entry)
+		}
+		duration := func(def time.Duration) (time.Duration, error) {
+			if !hasArg {
+				return def, nil
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(arg))
+			if err != nil || d <= 0 {
+				return 0, fmt.Errorf("invalid duration in %q", entry)
+			}
+			return d, nil
+		}
+		switch name = strings.TrimSpace(name); name {
+		case "disconnect":
+			c.Disconnect = rate
+		case "error":
+			c.Error, c.ErrorStatus = rate, http.StatusServiceUnavailable
+			if hasArg {
+				if c.ErrorStatus, err = strconv.Atoi(strings.TrimSpace(arg)); err != nil || c.ErrorStatus < 500 || c.ErrorStatus > 599 {
+					return c, fmt.Errorf("invalid error status in %q", entry)
+				}
+			}
+		case "stall":
+			c.Stall = rate
+			c.StallFor, err = duration(30 * time.Second)
+		case "malformed":
+			c.Malformed = rate
+		case "trickle":
+			c.Trickle = rate
+			c.TricklePause, err = duration(20 * time.Millisecond)
+		default:
+			return c, fmt.Errorf("unknown chaos kind %q", name)
+		}
+		if err != nil {
+			return c, err
+		}
+		if hasArg && name != "error" && name != "stall" && name != "trickle" {
+			return c, fmt.Errorf("chaos kind %s takes no argument", name)
+		}
+	}
+	return c, nil
+}
+
+// ModelProfile is how one model of the catalog behaves. Fields left zero
+// keep the server-wide behavior.
+type ModelProfile struct {
+	Name string `json:"name"`
+	// Dialect is the API the model is served on, "openai" or "anthropic";
+	// empty serves it on both.
+	Dialect string `json:"dialect,omitempty"`
+	// TokensPerSecond paces the model's tokens. A request's token_delay_ms
+	// still takes precedence.
+	TokensPerSecond float64 `json:"tokens_per_second,omitempty"`
+	// OutputTokensMin and OutputTokensMax bound the length of its
+	// responses, drawn evenly from the range and capped by max_tokens.
+	OutputTokensMin int `json:"output_tokens_min,omitempty"`
+	OutputTokensMax int `json:"output_tokens_max,omitempty"`
+	// ErrorRate is the chance a request fails before streaming, with
+	// ErrorStatus (503 if unset). DisconnectRate is the chance its stream
+	// breaks off at a random token.
+	ErrorRate      float64 `json:"error_rate,omitempty"`
+	ErrorStatus    int     `json:"error_status,omitempty"`
+	DisconnectRate float64 `json:"disconnect_rate,omitempty"`
+}
+
+// defaultModels are served when no catalog is configured, to any model
+// name asked for, as the deep server always has.
+var defaultModels = []ModelProfile{
+	{Name: "gpt-4-turbo", Dialect: "openai"},
+	{Name: "claude-3-5-sonnet-20241022", Dialect: "anthropic"},
+}
+
+// loadModelCatalog reads a JSON array of model profiles from path.
+func loadModelCatalog(path string) ([]ModelProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var models []ModelProfile
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("%s: no models", path)
+	}
+	seen := make(map[string]bool)
+	for _, m := range models {
+		switch {
+		case m.Name == "":
+			return nil, fmt.Errorf("%s: model without a name", path)
+		case seen[m.Name]:
+			return nil, fmt.Errorf("%s: model %q listed twice", path, m.Name)
+		case m.Dialect != "" && m.Dialect != "openai" && m.Dialect != "anthropic":
+			return nil, fmt.Errorf("model %q: unknown dialect %q", m.Name, m.Dialect)
+		case m.TokensPerSecond < 0:
+			return nil, fmt.Errorf("model %q: negative tokens_per_second", m.Name)
+		case m.OutputTokensMin < 0 || m.OutputTokensMax < m.OutputTokensMin:
+			return nil, fmt.Errorf("model %q: invalid output token range %d-%d", m.Name, m.OutputTokensMin, m.OutputTokensMax)
+		case m.ErrorRate < 0 || m.ErrorRate > 1 || m.DisconnectRate < 0 || m.DisconnectRate > 1:
+			return nil, fmt.Errorf("model %q: rates must be between 0 and 1", m.Name)
+		case m.ErrorStatus != 0 && (m.ErrorStatus < 400 || m.ErrorStatus > 599):
+			return nil, fmt.Errorf("model %q: invalid error status %d", m.Name, m.ErrorStatus)
+		}
+		seen[m.Name] = true
+	}
+	return models, nil
+}
+
+// modelCatalog holds the models served and what each has served.
+type modelCatalog struct {
+	models  []*servedModel
+	created int64 // when the catalog was loaded, for /v1/models
+	byName  map[string]*servedModel
+	// strict turns away models not in the catalog; the default catalog
+	// serves any name as its dialect's model.
+	strict bool
+}
+
+type servedModel struct {
+	ModelProfile
+	requests    int64
+	completed   int64
+	errors      int64
+	disconnects int64
+	tokens      int64
+}
+
+// ModelStats is what /metrics reports for each model.
+type ModelStats struct {
+	Requests    int64 `json:"requests"`
+	Completed   int64 `json:"completed"`
+	Errors      int64 `json:"errors"`
+	Disconnects int64 `json:"disconnects"`
+	Tokens      int64 `json:"tokens"`
+}
+
+func newModelCatalog(profiles []ModelProfile) *modelCatalog {
+	c := &modelCatalog{byName: make(map[string]*servedModel), created: time.Now().Unix(), strict: len(profiles) > 0}
+	if !c.strict {
+		profiles = defaultModels
+	}
+	for _, p := range profiles {
+		m := &servedModel{ModelProfile: p}
+		c.models = append(c.models, m)
+		c.byName[p.Name] = m
+	}
+	return c
+}
+
+// lookup returns the model a request of dialect asks for by name. An
+// empty name is the catalog's first model of the dialect.
+func (c *modelCatalog) lookup(name, dialect string) (*servedModel, bool) {
+	if m, ok := c.byName[name]; ok && (m.Dialect == "" || m.Dialect == dialect) {
+		return m, true
+	}
+	if name != "" && c.strict {
+		return nil, false
+	}
+	for _, m := range c.models {
+		if m.Dialect == "" || m.Dialect == dialect {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func (c *modelCatalog) stats() map[string]ModelStats {
+	stats := make(map[string]ModelStats, len(c.models))
+	for _, m := range c.models {
+		stats[m.Name] = ModelStats{
+			Requests:    atomic.LoadInt64(&m.requests),
+			Completed:   atomic.LoadInt64(&m.completed),
+			Errors:      atomic.LoadInt64(&m.errors),
+			Disconnects: atomic.LoadInt64(&m.disconnects),
+			Tokens:      atomic.LoadInt64(&m.tokens),
+		}
+	}
+	return stats
+}
+
+// outputTokens is the max_tokens to generate a response with: a length
+// drawn from the model's range, capped by what the request asked for.
+func (m *servedModel) outputTokens(maxTokens int, rng *rand.Rand) int {
+	if m == nil || m.OutputTokensMax == 0 {
+		return maxTokens
+	}
+	n := m.OutputTokensMin + rng.Intn(m.OutputTokensMax-m.OutputTokensMin+1)
+	if maxTokens > 0 && maxTokens < n {
+		return maxTokens
+	}
+	return max(n, 1)
+}
+
+// tokenDelay is the pause between the model's tokens, or def.
+func (m *servedModel) tokenDelay(def time.Duration) time.Duration {
+	if m == nil || m.TokensPerSecond == 0 {
+		return def
+	}
+	return time.Duration(float64(time.Second) / m.TokensPerSecond)
+}
+
+// HeaderField is a configured response header or trailer.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// headerFlags collects repeated "Name: value" flags.
+type headerFlags []HeaderField
+
+func (h *headerFlags) String() string {
+	parts := make([]string, len(*h))
+	for i, f := range *h {
+		parts[i] = f.Name + ": " + f.Value
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h *headerFlags) IsRepeatable() {}
+
+func (h *headerFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("expected \"Name: value\", got %q", v)
+	}
+	*h = append(*h, HeaderField{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	return nil
+}
+
+const (
+	usageTokensTrailer   = "X-Usage-Completion-Tokens"
+	usageDurationTrailer = "X-Usage-Duration-Ms"
+)
+
+// requestHashHeader carries the hash a deterministic response was seeded
+// with, so clients can tell which responses must be identical.
+const requestHashHeader = "X-Request-Hash"
+
+// noiseFields are the made-up field names of injected unknown fields.
+var noiseFields = []string{"x-trace", "retry-after", "meta", "Data", "ids"}
+
+// bytesPerToken is the rough size of a prompt token, for estimating token
+// counts from request bodies.
+const bytesPerToken = 4
+
+// simulatedTokens is the response every stream sends, one token per event.
+var simulatedTokens = []string{
+	"Hello", " there", "!", " I'm", " a", " simulated", " AI", " response", 
+	" that", " streams", " tokens", " slowly", " over", " time", ".",
+	" This", " mimics", " the", " behavior", " of", " real", " AI", " APIs",
+	" like", " OpenAI", "'s", " GPT", " models", ".", " Each", " token",
+	" represents", " a", " small", " piece", " of", " the", " complete", " response",
+	".", " The", " streaming", " allows", " for", " a", " more", " interactive",
+	" experience", " as", " users", " can", " see", " the", " response", " being",
+	" generated", " in", " real", "-time", " rather", " than", " waiting", " for",
+	" the", " entire", " response", " to", " complete", ".", " This", " test",
+	" server", " simulates", " this", " behavior", " by", " sending", " tokens",
+	" at", " regular", " intervals", " over", " a", " 15", "-second", " period",
+	".", " The", " proxy", " server", " will", " buffer", " and", " forward",
+	" these", " tokens", " to", " connected", " clients", ".",
+	" Additional", " tokens", " are", " added", " to", " extend", " the", " streaming",
+	" duration", " to", " properly", " test", " the", " system", " under", " longer",
+	" streaming", " conditions", ".", " This", " helps", " verify", " that", " the",
+	" proxy", " server", " can", " handle", " extended", " SSE", " connections",
+	" and", " properly", " buffer", " responses", " over", " a", " longer", " period",
+	".", " The", " total", " stream", " time", " is", " now", " approximately",
+	" 15", " seconds", " to", " better", " simulate", " real-world", " AI", " response",
+	" times", " for", " complex", " queries", " or", " longer", " generated", " content",
+}
+
 type DeepServer struct {
 	router           *mux.Router
 	logger           *logrus.Logger
+	config           DeepServerConfig
 	activeStreams    int64
 	totalStreams     int64
 	completedStreams int64
+	cancelledStreams int64
+	streams          *streamLog
+	usage            *server.UsageMeter
+	janitor          *retention.Janitor
+	scripts          *scriptQueue
+	scenarios        *scenarioSet
+	recordings       *recordingSet
+	chaos            *chaosInjector
+	clock            server.Clock
+	conns            *server.ConnStates
+	heartbeats       *server.Heartbeats
+	models           *modelCatalog
+	embeddings       unaryCounters
+	moderations      unaryCounters
+	batches          *batch.Simulator
+	reloader         *config.Reloader // nil unless run by main
+	filler           string // padding text for large events
+}
+
+// streamLogSize bounds the finished streams kept for /debug/streams.
+const streamLogSize = 4096
+
+// streamRecord is what /debug/streams/{id} reports about one stream. The
+// ID is the caller's X-Stream-ID header when it sent one, so a proxy or
+// test can look up the stream it started.
+type streamRecord struct {
+	ID      string `json:"id"`
+	Dialect string `json:"dialect"`
+	Active  bool   `json:"active"`
+	// Outcome is "completed", "failed" if a scenario injected an error,
+	// or, if the client went away first, "cancelled".
+	Outcome   string     `json:"outcome,omitempty"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	// CancelReason is why the caller says it cancelled the stream, if it
+	// reported it (see server.CancelPath).
+	CancelReason string `json:"cancel_reason,omitempty"`
+}
+
+// streamLog keeps the active streams and the most recent finished ones.
+type streamLog struct {
+	mu       sync.Mutex
+	records  map[string]*streamRecord
+	finished []*streamRecord  // oldest first
+	reasons  map[string]int64 // cancellations reported, by reason
+}
+
+func newStreamLog() *streamLog {
+	return &streamLog{records: make(map[string]*streamRecord), reasons: make(map[string]int64)}
+}
+
+func (l *streamLog) start(id, dialect string) *streamRecord {
+	rec := &streamRecord{ID: id, Dialect: dialect, Active: true, StartedAt: time.Now()}
+	l.mu.Lock()
+	l.records[id] = rec
+	l.mu.Unlock()
+	return rec
+}
+
+func (l *streamLog) finish(rec *streamRecord, outcome string) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec.Active = false
+	rec.Outcome = outcome
+	rec.EndedAt = &now
+	l.finished = append(l.finished, rec)
+	if len(l.finished) > streamLogSize {
+		oldest := l.finished[0]
+		l.finished = l.finished[1:]
+		// The ID may have been reused by a newer stream
+		if l.records[oldest.ID] == oldest {
+			delete(l.records, oldest.ID)
+		}
+	}
+}
+
+// cancel records why the stream id was cancelled. Only the first report
+// of a stream counts; it fails if the stream is unknown.
+func (l *streamLog) cancel(id, reason string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec, ok := l.records[id]
+	if !ok {
+		return false
+	}
+	if rec.CancelReason == "" {
+		rec.CancelReason = reason
+		l.reasons[reason]++
+	}
+	return true
+}
+
+func (l *streamLog) cancelReasons() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	reasons := make(map[string]int64, len(l.reasons))
+	for reason, n := range l.reasons {
+		reasons[reason] = n
+	}
+	return reasons
+}
+
+func (l *streamLog) get(id string) (streamRecord, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec, ok := l.records[id]
+	if !ok {
+		return streamRecord{}, false
+	}
+	return *rec, true
+}
+
+// startStream records a new stream under the caller's X-Stream-ID, or
+// streamID without one.
+func (s *DeepServer) startStream(r *http.Request, streamID, dialect string) *streamRecord {
+	if id := r.Header.Get("X-Stream-ID"); id != "" {
+		streamID = id
+	}
+	return s.streams.start(streamID, dialect)
+}
+
+func (s *DeepServer) finishStream(rec *streamRecord, outcome string) {
+	if outcome == "cancelled" {
+		atomic.AddInt64(&s.cancelledStreams, 1)
+	}
+	s.streams.finish(rec, outcome)
+}
+
+// StreamRequest holds the request fields the simulator honours. It is
+// shared by both dialects.
+type StreamRequest struct {
+	Model     string `json:"model"`
+	MaxTokens int    `json:"max_tokens"`
+	// MaxCompletionTokens is OpenAI's newer name for MaxTokens.
+	MaxCompletionTokens int `json:"max_completion_tokens"`
+	// Stream false asks for the whole completion as one JSON response.
+	// Chat completions stream unless it is set so; messages always do.
+	Stream *bool `json:"stream"`
+}
+
+// maxTokens is the length the request caps its response at, by either
+// name.
+func (req StreamRequest) maxTokens() int {
+	return max(req.MaxTokens, req.MaxCompletionTokens)
+}
+
+// modelName is the model a response reports: the one asked for, which the
+// default catalog serves under any name, or else model's.
+func (req StreamRequest) modelName(model *servedModel) string {
+	if req.Model != "" {
+		return req.Model
+	}
+	return model.Name
 }
 
 type StreamResponse struct {
@@ -42,15 +656,74 @@ type Delta struct {
 	Role    string `json:"role,omitempty"`
 }
 
-func NewDeepServer() *DeepServer {
+// AnthropicEvent is one event of an Anthropic Messages stream. Which fields
+// are set depends on Type.
+type AnthropicEvent struct {
+	Type         string            `json:"type"`
+	Message      *AnthropicMessage `json:"message,omitempty"`
+	Index        *int              `json:"index,omitempty"`
+	ContentBlock *ContentBlock     `json:"content_block,omitempty"`
+	Delta        *AnthropicDelta   `json:"delta,omitempty"`
+	Usage        *AnthropicUsage   `json:"usage,omitempty"`
+}
+
+type AnthropicMessage struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        AnthropicUsage `json:"usage"`
+}
+
+type ContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type AnthropicDelta struct {
+	Type       string  `json:"type,omitempty"`
+	Text       string  `json:"text,omitempty"`
+	StopReason *string `json:"stop_reason,omitempty"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func NewDeepServer(cfg DeepServerConfig) *DeepServer {
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
 
 	s := &DeepServer{
-		router: mux.NewRouter(),
-		logger: logger,
+		router:  mux.NewRouter(),
+		logger:  logger,
+		config:  cfg,
+		streams: newStreamLog(),
+		usage:   server.NewUsageMeter(),
+		janitor: retention.NewJanitor(),
+		scripts: &scriptQueue{},
+		clock:   server.NewScaledClock(cfg.TimeScale),
+		conns:   server.NewConnStates(cfg.IdleLeakAfter),
+	}
+	s.heartbeats = server.NewHeartbeats(cfg.Heartbeat)
+	s.batches = batch.New(s.batchRequest, s.clock, logger)
+	s.batches.Rate = cfg.BatchRate
+	s.models = newModelCatalog(cfg.Models)
+	s.scenarios = &scenarioSet{}
+	s.scenarios.replace(cfg.Scenarios)
+	s.recordings = &recordingSet{}
+	s.recordings.replace(cfg.Recordings)
+	s.chaos = &chaosInjector{chaos: cfg.Chaos}
+	s.usage.WattsPerCore = cfg.WattsPerCore
+	if cfg.EventSizeMax > 0 {
+		vocabulary := strings.Join(simulatedTokens, "")
+		s.filler = strings.Repeat(vocabulary, cfg.EventSizeMax/len(vocabulary)+1)
 	}
 
 	s.setupRoutes()
@@ -59,11 +732,1392 @@ func NewDeepServer() *DeepServer {
 
 func (s *DeepServer) setupRoutes() {
 	s.router.HandleFunc("/v1/chat/completions", s.handleStream).Methods("POST")
+	s.router.HandleFunc("/v1/messages", s.handleMessages).Methods("POST")
+	s.router.HandleFunc("/v1/chat/completions", s.handlePreflight).Methods("OPTIONS")
+	s.router.HandleFunc("/v1/messages", s.handlePreflight).Methods("OPTIONS")
+	s.router.HandleFunc("/v1/models", s.handleModels).Methods("GET")
+	s.router.HandleFunc("/v1/embeddings", s.handleEmbeddings).Methods("POST")
+	s.router.HandleFunc("/v1/moderations", s.handleModerations).Methods("POST")
+	s.router.HandleFunc("/v1/embeddings", s.handlePreflight).Methods("OPTIONS")
+	s.router.HandleFunc("/v1/moderations", s.handlePreflight).Methods("OPTIONS")
+	s.batches.Route(s.router)
+	s.router.HandleFunc("/ws", s.handleWebSocket).Methods("GET")
+	s.router.Handle(grpcapi.StreamChatCompletionPath, grpcapi.Handler("/v1/chat/completions", http.HandlerFunc(s.handleStream))).Methods("POST")
 	s.router.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
 	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
+	s.router.HandleFunc("/debug/streams/{id}", s.handleDebugStream).Methods("GET")
+	s.router.HandleFunc("/v1/streams/{id}", s.handleStreamCancel).Methods("DELETE")
+	s.router.HandleFunc("/usage", s.handleUsage).Methods("GET")
+	s.router.HandleFunc("/admin/script", s.handleScriptList).Methods("GET")
+	s.router.HandleFunc("/admin/script", s.handleScriptEnqueue).Methods("POST")
+	s.router.HandleFunc("/admin/script", s.handleScriptClear).Methods("DELETE")
+	s.router.HandleFunc("/admin/retention", s.handleRetention).Methods("GET", "POST")
+}
+
+// handleDebugStream reports whether a stream is still running, so tests can
+// check that a client disconnect upstream of us cancelled it.
+func (s *DeepServer) handleDebugStream(w http.ResponseWriter, r *http.Request) {
+	rec, ok := s.streams.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// handleStreamCancel records why a proxy cancelled a stream, from the
+// X-Cancel-Reason of its DELETE, so wasted generation can be broken down
+// by cause. The stream itself ended with its request.
+func (s *DeepServer) handleStreamCancel(w http.ResponseWriter, r *http.Request) {
+	reason := r.Header.Get(server.CancelReasonHeader)
+	if reason == "" {
+		reason = "unspecified"
+	}
+	if len(reason) > 64 {
+		http.Error(w, "cancel reason too long", http.StatusBadRequest)
+		return
+	}
+	if !s.streams.cancel(mux.Vars(r)["id"], reason) {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUsage reports the CPU time and bytes attributed to each tenant.
+func (s *DeepServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.usage.Snapshot())
+}
+
+// handleRetention reports what the janitor keeps and has removed of each
+// class of stored data; a POST has it make a pass first.
+func (s *DeepServer) handleRetention(w http.ResponseWriter, r *http.Request) {
+	stats := s.janitor.Stats()
+	if r.Method == http.MethodPost {
+		stats = s.janitor.Clean()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// ScriptedResponse replaces what the next matching request gets. Unset
+// fields keep the configured behaviour.
+type ScriptedResponse struct {
+	// Tokens are streamed instead of the simulated response.
+	Tokens       []string `json:"tokens,omitempty"`
+	DelayMs      int      `json:"delay_ms,omitempty"`
+	TokenDelayMs *int     `json:"token_delay_ms,omitempty"`
+	// Status, if set, fails the request with an error body in the
+	// request's dialect carrying Error.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// DisconnectAfter drops the connection after that many tokens.
+	DisconnectAfter int               `json:"disconnect_after,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+
+	play *scenarioPlay // of the scenario the response plays, if any
+}
+
+// ScriptEntry is one queued response and the request headers it waits
+// for. An entry without Match takes the next request of any kind.
+type ScriptEntry struct {
+	Match    map[string]string `json:"match,omitempty"`
+	Response ScriptedResponse  `json:"response"`
+	File     bool              `json:"file,omitempty"` // queued from -script
+}
+
+// scriptQueue holds the responses scripted through /admin/script. A
+// request takes the oldest entry whose headers it matches.
+type scriptQueue struct {
+	mu      sync.Mutex
+	entries []ScriptEntry
+}
+
+func (q *scriptQueue) add(entries []ScriptEntry) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = append(q.entries, entries...)
+	return len(q.entries)
+}
+
+// replaceFile drops the pending entries queued from the -script file and
+// queues its entries as read now, after those posted to /admin/script. It
+// returns how many it dropped.
+func (q *scriptQueue) replaceFile(entries []ScriptEntry) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if !e.File {
+			kept = append(kept, e)
+		}
+	}
+	clear(q.entries[len(kept):])
+	dropped := len(q.entries) - len(kept)
+	for _, e := range entries {
+		e.File = true
+		kept = append(kept, e)
+	}
+	q.entries = kept
+	return dropped
+}
+
+func (q *scriptQueue) take(r *http.Request) *ScriptedResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, e := range q.entries {
+		if e.matches(r) {
+			q.entries = append(q.entries[:i:i], q.entries[i+1:]...)
+			return &e.Response
+		}
+	}
+	return nil
+}
+
+func (e ScriptEntry) matches(r *http.Request) bool {
+	for name, value := range e.Match {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *scriptQueue) pending() []ScriptEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]ScriptEntry{}, q.entries...)
+}
+
+// clear drops the entries with the given match headers, or all of them
+// when match is empty, and returns how many it dropped.
+func (q *scriptQueue) clear(match map[string]string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if len(match) > 0 && !sameMatch(e.Match, match) {
+			kept = append(kept, e)
+		}
+	}
+	clear(q.entries[len(kept):])
+	dropped := len(q.entries) - len(kept)
+	q.entries = kept
+	return dropped
+}
+
+func sameMatch(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalMatch returns match with its header names in canonical form.
+func canonicalMatch(match map[string]string) map[string]string {
+	if len(match) == 0 {
+		return nil
+	}
+	canonical := make(map[string]string, len(match))
+	for name, value := range match {
+		canonical[http.CanonicalHeaderKey(name)] = value
+	}
+	return canonical
+}
+
+// scriptRequest is the body of POST /admin/script: responses for the next
+// requests carrying the match headers, in order.
+type scriptRequest struct {
+	Match     map[string]string  `json:"match"`
+	Responses []ScriptedResponse `json:"responses"`
+}
+
+// entries validates a script and returns its queue entries.
+func (req scriptRequest) entries() ([]ScriptEntry, error) {
+	if len(req.Responses) == 0 {
+		return nil, fmt.Errorf("script has no responses")
+	}
+	match := canonicalMatch(req.Match)
+	entries := make([]ScriptEntry, len(req.Responses))
+	for i, resp := range req.Responses {
+		if resp.Status != 0 && (resp.Status < 400 || resp.Status > 599) {
+			return nil, fmt.Errorf("invalid status %d", resp.Status)
+		}
+		entries[i] = ScriptEntry{Match: match, Response: resp}
+	}
+	return entries, nil
+}
+
+// loadScripts reads a JSON array of scripts, each in the form of a POST
+// to /admin/script, to queue at startup and on every reload.
+func loadScripts(path string) ([]ScriptEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scripts []scriptRequest
+	if err := json.Unmarshal(data, &scripts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var entries []ScriptEntry
+	for i, script := range scripts {
+		e, err := script.entries()
+		if err != nil {
+			return nil, fmt.Errorf("%s: script %d: %w", path, i+1, err)
+		}
+		entries = append(entries, e...)
+	}
+	return entries, nil
+}
+
+func (s *DeepServer) handleScriptEnqueue(w http.ResponseWriter, r *http.Request) {
+	var req scriptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid script: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := req.entries()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pending := s.scripts.add(entries)
+	s.logger.WithFields(logrus.Fields{
+		"match":     req.Match,
+		"responses": len(entries),
+		"pending":   pending,
+	}).Info("Responses scripted")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"queued": len(entries), "pending": pending})
+}
+
+func (s *DeepServer) handleScriptList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"pending": s.scripts.pending()})
+}
+
+// handleScriptClear drops the pending entries, or with a body of match
+// headers only the entries scripted for them.
+func (s *DeepServer) handleScriptClear(w http.ResponseWriter, r *http.Request) {
+	var req scriptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "invalid match: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dropped := s.scripts.clear(canonicalMatch(req.Match))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"dropped": dropped})
+}
+
+// startScript plays the parts of a scripted response that come before the
+// stream: its delay, headers and error status. It returns false if the
+// request ends there.
+func (s *DeepServer) startScript(w http.ResponseWriter, r *http.Request, script *ScriptedResponse, dialect, streamID string) bool {
+	if script == nil {
+		return true
+	}
+	fields := logrus.Fields{
+		"stream_id": streamID,
+		"status":    script.Status,
+		"tokens":    len(script.Tokens),
+	}
+	if script.play != nil {
+		fields["scenario"] = script.play.Name
+		s.logger.WithFields(fields).Info("Playing scenario")
+	} else {
+		s.logger.WithFields(fields).Info("Playing scripted response")
+	}
+	if script.DelayMs > 0 {
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-s.clock.After(time.Duration(script.DelayMs) * time.Millisecond):
+		}
+	}
+	for name, value := range script.Headers {
+		w.Header().Set(name, value)
+	}
+	if script.Status == 0 {
+		return true
+	}
+
+	message := script.Error
+	if message == "" {
+		message = http.StatusText(script.Status)
+	}
+	writeAPIError(w, dialect, script.Status, message)
+	return false
+}
+
+// Scenario is a named response of a -scenarios file: its tokens, the
+// pauses before them, drawn from distributions, and where it fails. A
+// request names the scenario it wants with ?scenario=, or gets the first
+// one whose Match it meets; others get the simulated response. A script
+// queued for a request still comes first.
+type Scenario struct {
+	Name  string        `json:"name"`
+	Match ScenarioMatch `json:"match"`
+	// DelayMs is the pause before the response starts, on top of the
+	// prompt delay. TokenDelayMs is the pause before each token that sets
+	// none of its own; unset, tokens keep the request's or model's pace.
+	DelayMs      *client.Distribution `json:"delay_ms,omitempty"`
+	TokenDelayMs *client.Distribution `json:"token_delay_ms,omitempty"`
+	// Status, if set, fails the request before it streams, with Error, as
+	// a script does. Headers are added to the response.
+	Status  int               `json:"status,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Tokens are the steps of the stream; without any, the simulated
+	// response is streamed at the scenario's pace.
+	Tokens []ScenarioToken `json:"tokens,omitempty"`
+	// Seed, if set, draws the same delays for every request.
+	Seed int64 `json:"seed,omitempty"`
+
+	content *regexp.Regexp
+	plays   int64
+}
+
+// ScenarioMatch is what a request must have for a scenario to answer it
+// without being named: every field set. A scenario with none is only
+// played by name.
+type ScenarioMatch struct {
+	// Model is the model asked for.
+	Model string `json:"model,omitempty"`
+	// Content is a regular expression the request body must match, such
+	// as a phrase of the prompt.
+	Content string `json:"content,omitempty"`
+	// Headers are request headers and their values, as a script matches.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// ScenarioToken is one step of a scenario: a token, or the point where the
+// stream fails. A plain string is a token at the scenario's pace.
+type ScenarioToken struct {
+	Text string `json:"text,omitempty"`
+	// DelayMs is the pause before the step.
+	DelayMs *client.Distribution `json:"delay_ms,omitempty"`
+	// Error ends the stream with an error event carrying it, in the
+	// request's dialect, instead of completing it; Disconnect drops the
+	// connection. Either ends the scenario.
+	Error      string `json:"error,omitempty"`
+	Disconnect bool   `json:"disconnect,omitempty"`
+}
+
+func (t *ScenarioToken) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &t.Text)
+	}
+	type plain ScenarioToken
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+func (t ScenarioToken) fails() bool {
+	return t.Error != "" || t.Disconnect
+}
+
+// loadScenarios reads a JSON or YAML array of scenarios from path.
+func loadScenarios(path string) ([]*Scenario, error) {
+	var scenarios []*Scenario
+	if err := config.Decode(path, &scenarios); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i, sc := range scenarios {
+		if sc == nil || sc.Name == "" {
+			return nil, fmt.Errorf("%s: scenario %d has no name", path, i+1)
+		}
+		if seen[sc.Name] {
+			return nil, fmt.Errorf("%s: scenario %q listed twice", path, sc.Name)
+		}
+		seen[sc.Name] = true
+		if err := sc.validate(); err != nil {
+			return nil, fmt.Errorf("scenario %q: %w", sc.Name, err)
+		}
+	}
+	return scenarios, nil
+}
+
+func (sc *Scenario) validate() error {
+	if sc.Status != 0 && (sc.Status < 400 || sc.Status > 599) {
+		return fmt.Errorf("invalid status %d", sc.Status)
+	}
+	for name, d := range map[string]*client.Distribution{"delay_ms": sc.DelayMs, "token_delay_ms": sc.TokenDelayMs} {
+		if d == nil {
+			continue
+		}
+		if err := d.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for i, t := range sc.Tokens {
+		switch {
+		case t.fails() && t.Text != "":
+			return fmt.Errorf("step %d has both text and an error", i+1)
+		case t.fails() && i < len(sc.Tokens)-1:
+			return fmt.Errorf("step %d fails the stream but is not the last", i+1)
+		case t.Error != "" && t.Disconnect:
+			return fmt.Errorf("step %d both errors and disconnects", i+1)
+		}
+		if t.DelayMs != nil {
+			if err := t.DelayMs.Validate(); err != nil {
+				return fmt.Errorf("step %d: delay_ms: %w", i+1, err)
+			}
+		}
+	}
+	sc.Match.Headers = canonicalMatch(sc.Match.Headers)
+	if sc.Match.Content != "" {
+		var err error
+		if sc.content, err = regexp.Compile(sc.Match.Content); err != nil {
+			return fmt.Errorf("match content: %w", err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether a request for model with body is one the
+// scenario answers unnamed.
+func (sc *Scenario) matches(r *http.Request, body []byte, model string) bool {
+	m := sc.Match
+	if m.Model == "" && sc.content == nil && len(m.Headers) == 0 {
+		return false
+	}
+	if m.Model != "" && m.Model != model {
+		return false
+	}
+	if sc.content != nil && !sc.content.Match(body) {
+		return false
+	}
+	for name, value := range m.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// play draws the response the scenario gives one request.
+func (sc *Scenario) play() *ScriptedResponse {
+	atomic.AddInt64(&sc.plays, 1)
+	seed := sc.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	p := &scenarioPlay{Scenario: sc, rng: rand.New(rand.NewSource(seed))}
+	script := &ScriptedResponse{Status: sc.Status, Error: sc.Error, Headers: sc.Headers, play: p}
+	delay := p.draw(sc.DelayMs)
+	for i, t := range sc.Tokens {
+		if i == 0 {
+			// The pause before the first step is part of the wait for
+			// the response
+			delay += p.draw(t.DelayMs)
+		}
+		if t.fails() {
+			p.fault = &sc.Tokens[i]
+			break
+		}
+		script.Tokens = append(script.Tokens, t.Text)
+	}
+	script.DelayMs = int(delay / time.Millisecond)
+	return script
+}
+
+// scenarioPlay is a scenario being played for one request.
+type scenarioPlay struct {
+	*Scenario
+	rng   *rand.Rand
+	fault *ScenarioToken // the step the stream fails at, if any
+}
+
+// draw returns a delay drawn from d, in milliseconds; zero if d is nil.
+func (p *scenarioPlay) draw(d *client.Distribution) time.Duration {
+	if d == nil {
+		return 0
+	}
+	return max(time.Duration(d.Sample(p.rng)*float64(time.Millisecond)), 0)
+}
+
+// delay is the pause before step i of the scenario, or def if it sets
+// none.
+func (p *scenarioPlay) delay(i int, def time.Duration) time.Duration {
+	switch {
+	case p == nil:
+		return def
+	case i < len(p.Tokens) && p.Tokens[i].DelayMs != nil:
+		return p.draw(p.Tokens[i].DelayMs)
+	case p.TokenDelayMs != nil:
+		return p.draw(p.TokenDelayMs)
+	}
+	return def
+}
+
+// scenarioSet holds the scenarios of -scenarios, replaced on reload.
+type scenarioSet struct {
+	mu        sync.RWMutex
+	scenarios []*Scenario
+}
+
+// replace swaps in scenarios. Those keeping their name keep their count
+// of plays.
+func (set *scenarioSet) replace(scenarios []*Scenario) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for _, sc := range scenarios {
+		for _, old := range set.scenarios {
+			if old.Name == sc.Name {
+				atomic.StoreInt64(&sc.plays, atomic.LoadInt64(&old.plays))
+			}
+		}
+	}
+	set.scenarios = scenarios
+}
+
+// pick returns the scenario r names with ?scenario=, or else the first
+// one it matches, or nil. A name not in the set is an error.
+func (set *scenarioSet) pick(r *http.Request, body []byte, model string) (*Scenario, error) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	name := r.URL.Query().Get("scenario")
+	for _, sc := range set.scenarios {
+		if (name != "" && sc.Name == name) || (name == "" && sc.matches(r, body, model)) {
+			return sc, nil
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("unknown scenario %q", name)
+	}
+	return nil, nil
+}
+
+// stats reports how many requests each scenario has answered.
+func (set *scenarioSet) stats() map[string]int64 {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	plays := make(map[string]int64, len(set.scenarios))
+	for _, sc := range set.scenarios {
+		plays[sc.Name] = atomic.LoadInt64(&sc.plays)
+	}
+	return plays
+}
+
+// takeScript returns the response scripted for a request for model: the
+// next queued for it, or else a play of the scenario it names or
+// matches. It is nil for the simulated response.
+func (s *DeepServer) takeScript(r *http.Request, body []byte, model string) (*ScriptedResponse, error) {
+	if script := s.scripts.take(r); script != nil {
+		return script, nil
+	}
+	sc, err := s.scenarios.pick(r, body, model)
+	if sc == nil || err != nil {
+		return nil, err
+	}
+	return sc.play(), nil
+}
+
+// injectFault ends a stream at the failing step of its scenario, if it
+// has one, with an error event in dialect or by dropping the connection.
+// It returns false if the stream is to complete.
+func (s *DeepServer) injectFault(events *eventWriter, flusher http.Flusher, script *ScriptedResponse, model *servedModel, dialect, streamID string) bool {
+	fault := s.scenarioFault(script, model, streamID)
+	if fault == nil {
+		return false
+	}
+	data, _ := json.Marshal(apiErrorBody(dialect, http.StatusInternalServerError, fault.Error))
+	typ := ""
+	if dialect == "anthropic" {
+		typ = "error"
+	}
+	events.send(typ, string(data), false)
+	flusher.Flush()
+	return true
+}
+
+// scenarioFault returns the failing step of the scenario played, if it has
+// one. A disconnect is played there and then, by dropping the connection.
+func (s *DeepServer) scenarioFault(script *ScriptedResponse, model *servedModel, streamID string) *ScenarioToken {
+	if script == nil || script.play == nil || script.play.fault == nil {
+		return nil
+	}
+	fault := script.play.fault
+	s.logger.WithFields(logrus.Fields{
+		"stream_id":  streamID,
+		"scenario":   script.play.Name,
+		"error":      fault.Error,
+		"disconnect": fault.Disconnect,
+	}).Info("Failing stream as scripted by its scenario")
+	if fault.Disconnect {
+		atomic.AddInt64(&model.disconnects, 1)
+		panic(http.ErrAbortHandler)
+	}
+	return fault
+}
+
+// loadRecordings reads the recordings in dir, or none if dir is empty.
+func loadRecordings(dir string) ([]*server.Recording, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	return server.LoadRecordings(dir)
+}
+
+// recordingSet holds the recordings of -recordings, replaced on reload.
+type recordingSet struct {
+	mu         sync.RWMutex
+	recordings []*replayable
+	next       uint64
+}
+
+// replayable is a recording and how many requests it has answered.
+type replayable struct {
+	*server.Recording
+	plays int64
+}
+
+// replace swaps in recordings. Those keeping their name keep their count
+// of plays.
+func (set *recordingSet) replace(recordings []*server.Recording) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	loaded := make([]*replayable, len(recordings))
+	for i, recording := range recordings {
+		loaded[i] = &replayable{Recording: recording}
+		for _, old := range set.recordings {
+			if old.Name == recording.Name {
+				loaded[i].plays = atomic.LoadInt64(&old.plays)
+			}
+		}
+	}
+	set.recordings = loaded
+}
+
+// named returns the recording r names with X-Recording or ?recording=,
+// or nil if it names none. A name not in the set is an error.
+func (set *recordingSet) named(r *http.Request) (*replayable, error) {
+	name := r.Header.Get("X-Recording")
+	if name == "" {
+		name = r.URL.Query().Get("recording")
+	}
+	if name == "" {
+		return nil, nil
+	}
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	for _, recording := range set.recordings {
+		if recording.Name == name {
+			return recording, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown recording %q", name)
+}
+
+// match returns the next of the recordings made on path, in turn, those
+// of model if there are any, or nil if none was made on path.
+func (set *recordingSet) match(path, model string) *replayable {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	var onPath, ofModel []*replayable
+	for _, recording := range set.recordings {
+		if recording.Header.Path != path {
+			continue
+		}
+		onPath = append(onPath, recording)
+		if model != "" && recording.Header.Model == model {
+			ofModel = append(ofModel, recording)
+		}
+	}
+	if len(ofModel) > 0 {
+		onPath = ofModel
+	}
+	if len(onPath) == 0 {
+		return nil
+	}
+	return onPath[(atomic.AddUint64(&set.next, 1)-1)%uint64(len(onPath))]
+}
+
+// stats reports how many requests each recording has answered.
+func (set *recordingSet) stats() map[string]int64 {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	plays := make(map[string]int64, len(set.recordings))
+	for _, recording := range set.recordings {
+		plays[recording.Name] = atomic.LoadInt64(&recording.plays)
+	}
+	return plays
+}
+
+// takeResponse returns what answers a stream request for model: the
+// recording it names, or else the script takeScript returns, or else the
+// next recording made on its path. Both are nil for the simulated
+// response.
+func (s *DeepServer) takeResponse(r *http.Request, body []byte, model string) (*replayable, *ScriptedResponse, error) {
+	recording, err := s.recordings.named(r)
+	if recording != nil || err != nil {
+		return recording, nil, err
+	}
+	script, err := s.takeScript(r, body, model)
+	if script != nil || err != nil {
+		return nil, script, err
+	}
+	return s.recordings.match(r.URL.Path, model), nil, nil
+}
+
+// replayStream answers a stream request with recording, at the pace it
+// was recorded under the server's clock. A recording of a stream its
+// upstream cut is cut where it was, by dropping the connection.
+func (s *DeepServer) replayStream(w http.ResponseWriter, r *http.Request, flusher http.Flusher, recording *replayable, dialect, streamID string) {
+	atomic.AddInt64(&recording.plays, 1)
+	atomic.AddInt64(&s.activeStreams, 1)
+	atomic.AddInt64(&s.totalStreams, 1)
+	defer atomic.AddInt64(&s.activeStreams, -1)
+	rec := s.startStream(r, streamID, dialect)
+	outcome := "cancelled"
+	defer func() { s.finishStream(rec, outcome) }()
+	w.Header().Set("X-Recording", recording.Name)
+	s.flushHeaders(w, r, flusher)
+	log := s.logger.WithFields(logrus.Fields{"stream_id": streamID, "recording": recording.Name})
+	log.Info("Replaying recorded stream")
+
+	err := recording.Replay(r.Context(), w, flusher, s.clock)
+	switch {
+	case r.Context().Err() != nil:
+		log.Info("Client disconnected")
+	case err != nil:
+		outcome = "failed"
+		log.WithError(err).Info("Cutting replayed stream as its upstream did")
+		panic(http.ErrAbortHandler)
+	default:
+		outcome = "completed"
+		atomic.AddInt64(&s.completedStreams, 1)
+		log.Info("Stream completed")
+	}
+}
+
+// chaosInjector holds the chaos of -chaos, replaced on reload, and counts
+// the faults requests drew.
+type chaosInjector struct {
+	mu    sync.RWMutex
+	chaos Chaos
+
+	errors      int64
+	disconnects int64
+	stalls      int64
+	malformed   int64
+	trickles    int64
+}
+
+func (c *chaosInjector) set(chaos Chaos) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chaos = chaos
+}
+
+func (c *chaosInjector) get() Chaos {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.chaos
+}
+
+func (c *chaosInjector) stats() map[string]int64 {
+	return map[string]int64{
+		"errors":      atomic.LoadInt64(&c.errors),
+		"disconnects": atomic.LoadInt64(&c.disconnects),
+		"stalls":      atomic.LoadInt64(&c.stalls),
+		"malformed":   atomic.LoadInt64(&c.malformed),
+		"trickles":    atomic.LoadInt64(&c.trickles),
+	}
+}
+
+// chaosFaults are the faults a stream drew, at the tokens they hit; zero
+// is none. Every method is a no-op on nil, for streams without chaos.
+type chaosFaults struct {
+	s            *DeepServer
+	streamID     string
+	disconnectAt int
+	stallAt      int
+	stallFor     time.Duration
+	malformedAt  int
+	trickle      time.Duration // the pause between the pieces of events
+}
+
+// startChaos draws the faults of a stream of tokens tokens, as its
+// X-Chaos header or else -chaos says, and fails the request there if it
+// drew an error. It returns false if the request ends there, also when
+// its X-Chaos header doesn't parse.
+func (s *DeepServer) startChaos(w http.ResponseWriter, r *http.Request, dialect, streamID string, tokens int) (*chaosFaults, bool) {
+	chaos := s.chaos.get()
+	if spec := r.Header.Get(chaosHeader); spec != "" {
+		var err error
+		if chaos, err = parseChaos(spec); err != nil {
+			writeAPIError(w, dialect, http.StatusBadRequest, "Invalid "+chaosHeader+": "+err.Error())
+			return nil, false
+		}
+	}
+	if chaos == (Chaos{}) {
+		return nil, true
+	}
+	hit := func(rate float64, count *int64) bool {
+		if rate == 0 || rand.Float64() >= rate {
+			return false
+		}
+		atomic.AddInt64(count, 1)
+		return true
+	}
+	// at picks a token from the first to the last
+	at := func(first int) int {
+		if tokens < first {
+			return 0
+		}
+		return first + rand.Intn(tokens-first+1)
+	}
+	log := s.logger.WithField("stream_id", streamID)
+	if hit(chaos.Error, &s.chaos.errors) {
+		log.WithField("status", chaos.ErrorStatus).Info("Chaos: failing request")
+		writeAPIError(w, dialect, chaos.ErrorStatus, "Injected failure")
+		return nil, false
+	}
+
+	f := &chaosFaults{s: s, streamID: streamID}
+	if hit(chaos.Disconnect, &s.chaos.disconnects) {
+		f.disconnectAt = at(1)
+	}
+	if hit(chaos.Stall, &s.chaos.stalls) {
+		f.stallAt, f.stallFor = at(1), chaos.StallFor
+	}
+	if hit(chaos.Malformed, &s.chaos.malformed) {
+		f.malformedAt = at(2)
+	}
+	if hit(chaos.Trickle, &s.chaos.trickles) {
+		f.trickle = chaos.TricklePause
+	}
+	if *f == (chaosFaults{s: s, streamID: streamID}) {
+		return nil, true
+	}
+	if f.stallFor > 0 || f.trickle > 0 {
+		// The write timeout would end the stream the fault is to slow down
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	}
+	log.WithFields(logrus.Fields{
+		"disconnect_at": f.disconnectAt,
+		"stall_at":      f.stallAt,
+		"stall_ms":      f.stallFor.Milliseconds(),
+		"malformed_at":  f.malformedAt,
+		"trickle_ms":    f.trickle.Milliseconds(),
+	}).Info("Chaos: injecting faults")
+	return f, true
+}
+
+// disconnectAfter is the token after which the stream is to be dropped:
+// after, as scripted or drawn by the model, or else as the chaos drew.
+func (f *chaosFaults) disconnectAfter(after int) int {
+	if after > 0 || f == nil {
+		return after
+	}
+	return f.disconnectAt
+}
+
+// stallAfter is how long the stream stalls after its sent-th token.
+func (f *chaosFaults) stallAfter(sent int) time.Duration {
+	if f == nil || sent != f.stallAt {
+		return 0
+	}
+	f.s.logger.WithFields(logrus.Fields{
+		"stream_id": f.streamID,
+		"stall_ms":  f.stallFor.Milliseconds(),
+	}).Info("Chaos: stalling stream")
+	return f.stallFor
+}
+
+// mangle returns the data of the sent-th token event, cut short if it is
+// the one to be malformed.
+func (f *chaosFaults) mangle(sent int, data []byte) []byte {
+	if f == nil || sent != f.malformedAt {
+		return data
+	}
+	f.s.logger.WithField("stream_id", f.streamID).Info("Chaos: sending a malformed event")
+	return data[:len(data)/2]
+}
+
+// writer is w, trickling if the stream drew a trickle.
+func (f *chaosFaults) writer(w io.Writer, r *http.Request, flusher http.Flusher) io.Writer {
+	if f == nil || f.trickle == 0 {
+		return w
+	}
+	return &trickleWriter{w: w, flusher: flusher, ctx: r.Context(), clock: f.s.clock, pause: f.trickle}
+}
+
+// trickleBytes is the most a trickling stream writes at once.
+const trickleBytes = 8
+
+// trickleWriter writes what it is given a few bytes at a time, flushing
+// each piece, like an upstream whose stream trickles in.
+type trickleWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	ctx     context.Context
+	clock   server.Clock
+	pause   time.Duration
+}
+
+func (t *trickleWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if written > 0 {
+			select {
+			case <-t.ctx.Done():
+				return written, t.ctx.Err()
+			case <-t.clock.After(t.pause):
+			}
+		}
+		n, err := t.w.Write(p[written:min(written+trickleBytes, len(p))])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		t.flusher.Flush()
+	}
+	return written, nil
+}
+
+// writeAPIError fails a request with status and an error body in its
+// dialect.
+func writeAPIError(w http.ResponseWriter, dialect string, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiErrorBody(dialect, status, message))
+}
+
+// apiErrorBody is the body of an error response in dialect.
+func apiErrorBody(dialect string, status int, message string) interface{} {
+	if dialect == "anthropic" {
+		typ := "api_error"
+		switch status {
+		case http.StatusNotFound:
+			typ = "not_found_error"
+		case http.StatusBadRequest:
+			typ = "invalid_request_error"
+		}
+		return map[string]interface{}{
+			"type":  "error",
+			"error": map[string]string{"type": typ, "message": message},
+		}
+	}
+	typ, code := "server_error", interface{}(nil)
+	switch status {
+	case http.StatusNotFound:
+		typ, code = "invalid_request_error", "model_not_found"
+	case http.StatusBadRequest:
+		typ = "invalid_request_error"
+	}
+	return map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": typ, "code": code},
+	}
+}
+
+// startModel picks the model a request asks for from the catalog and
+// fails the request as the model's error rate says. It returns nil if the
+// request ends there.
+func (s *DeepServer) startModel(w http.ResponseWriter, name, dialect, streamID string) *servedModel {
+	model, status, message := s.chooseModel(name, dialect, streamID)
+	if model == nil {
+		writeAPIError(w, dialect, status, message)
+	}
+	return model
+}
+
+// chooseModel is startModel without the response: it returns the model or
+// the status and message to fail the request with.
+func (s *DeepServer) chooseModel(name, dialect, streamID string) (*servedModel, int, string) {
+	model, ok := s.models.lookup(name, dialect)
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Sprintf("The model %q does not exist", name)
+	}
+	atomic.AddInt64(&model.requests, 1)
+	if model.ErrorRate == 0 || rand.Float64() >= model.ErrorRate {
+		return model, 0, ""
+	}
+	atomic.AddInt64(&model.errors, 1)
+	status := model.ErrorStatus
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	s.logger.WithFields(logrus.Fields{
+		"stream_id": streamID,
+		"model":     model.Name,
+		"status":    status,
+	}).Info("Failing request at the model's error rate")
+	return nil, status, fmt.Sprintf("The model %s is overloaded", model.Name)
+}
+
+// handleModels lists the catalog in the shape of OpenAI's /v1/models,
+// with the dialect each model is served on.
+func (s *DeepServer) handleModels(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		OwnedBy string `json:"owned_by"`
+		Dialect string `json:"dialect,omitempty"`
+	}
+	data := make([]entry, len(s.models.models))
+	for i, m := range s.models.models {
+		data[i] = entry{ID: m.Name, Object: "model", Created: s.models.created, OwnedBy: "horizon", Dialect: m.Dialect}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": data})
+}
+
+const (
+	// defaultEmbeddingDimensions is the length of text-embedding-3-small's
+	// vectors; maxEmbeddingDimensions bounds what a request may ask for.
+	defaultEmbeddingDimensions = 1536
+	maxEmbeddingDimensions     = 8192
+	// maxUnaryInputs bounds the inputs of one embeddings or moderations
+	// request, as OpenAI does.
+	maxUnaryInputs = 2048
+)
+
+// moderationCategories are the categories /v1/moderations scores. An input
+// that mentions one is flagged for it.
+var moderationCategories = []string{"harassment", "hate", "self-harm", "sexual", "violence"}
+
+// unaryCounters count what /v1/embeddings or /v1/moderations has answered.
+type unaryCounters struct {
+	requests int64
+	inputs   int64
+	bytes    int64
+}
+
+// UnaryStats is what /metrics reports for each unary endpoint.
+type UnaryStats struct {
+	Requests int64 `json:"requests"`
+	Inputs   int64 `json:"inputs"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (c *unaryCounters) stats() UnaryStats {
+	return UnaryStats{
+		Requests: atomic.LoadInt64(&c.requests),
+		Inputs:   atomic.LoadInt64(&c.inputs),
+		Bytes:    atomic.LoadInt64(&c.bytes),
+	}
+}
+
+// UnaryRequest holds the fields of an embeddings or moderations request
+// the simulator honours. Input is a string or an array; array items other
+// than strings, such as token arrays, count as their JSON text.
+type UnaryRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	Dimensions     int             `json:"dimensions"`
+	EncodingFormat string          `json:"encoding_format"`
+}
+
+// inputs returns the texts of the request.
+func (req UnaryRequest) inputs() ([]string, error) {
+	var one string
+	if err := json.Unmarshal(req.Input, &one); err == nil {
+		return []string{one}, nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(req.Input, &items); err != nil || len(items) == 0 {
+		return nil, fmt.Errorf("input must be a string or a non-empty array")
+	}
+	if len(items) > maxUnaryInputs {
+		return nil, fmt.Errorf("input has %d items, at most %d are allowed", len(items), maxUnaryInputs)
+	}
+	texts := make([]string, len(items))
+	for i, item := range items {
+		if json.Unmarshal(item, &texts[i]) != nil {
+			texts[i] = string(item)
+		}
+	}
+	return texts, nil
+}
+
+// startUnary reads a unary request, takes its model from a strict catalog,
+// and waits out the endpoint's latency. It returns the request and its
+// inputs, or false if it has been answered already or the client has gone.
+func (s *DeepServer) startUnary(w http.ResponseWriter, r *http.Request, defaultModel string) (UnaryRequest, []string, bool) {
+	var req UnaryRequest
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeAPIError(w, "openai", http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return req, nil, false
+	}
+	inputs, err := req.inputs()
+	if err != nil {
+		writeAPIError(w, "openai", http.StatusBadRequest, err.Error())
+		return req, nil, false
+	}
+	if req.Model == "" {
+		req.Model = defaultModel
+	}
+	requestID := r.Header.Get("X-Stream-ID")
+	// The default catalog is of chat models, so only a configured one has
+	// a say over these
+	var model *servedModel
+	if s.models.strict {
+		if model = s.startModel(w, req.Model, "openai", requestID); model == nil {
+			return req, nil, false
+		}
+	}
+	delay := s.config.UnaryLatency + time.Duration(float64(s.config.UnaryLatencyPerKB)*float64(len(body))/1024)
+	s.logger.WithFields(logrus.Fields{
+		"request_id": requestID,
+		"path":       r.URL.Path,
+		"model":      req.Model,
+		"inputs":     len(inputs),
+		"delay_ms":   delay.Milliseconds(),
+	}).Debug("Serving unary request")
+	if delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return req, nil, false
+		case <-s.clock.After(delay):
+		}
+	}
+	if model != nil {
+		atomic.AddInt64(&model.completed, 1)
+	}
+	return req, inputs, true
+}
+
+// writeUnary sends the JSON answer to a unary request of inputs inputs.
+func (s *DeepServer) writeUnary(w http.ResponseWriter, counters *unaryCounters, inputs int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeAPIError(w, "openai", http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	n, _ := w.Write(data)
+	atomic.AddInt64(&counters.requests, 1)
+	atomic.AddInt64(&counters.inputs, int64(inputs))
+	atomic.AddInt64(&counters.bytes, int64(n))
+}
+
+// inputRand returns a PRNG seeded by model and input, so the same text
+// always gets the same embedding or scores, as from a real model.
+func inputRand(model, input string) *rand.Rand {
+	sum := sha256.Sum256([]byte(model + "\x00" + input))
+	return rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:]))))
+}
+
+// handleEmbeddings answers /v1/embeddings in OpenAI's shape with a unit
+// vector for every input, as floats or, with encoding_format "base64",
+// little-endian float32s.
+func (s *DeepServer) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	req, inputs, ok := s.startUnary(w, r, "text-embedding-3-small")
+	if !ok {
+		return
+	}
+	resp, err := s.embed(req, inputs)
+	if err != nil {
+		writeAPIError(w, "openai", http.StatusBadRequest, err.Error())
+		return
+	}
+	s.writeUnary(w, &s.embeddings, len(inputs), resp)
+}
+
+// embed computes the answer to an embeddings request, or why it is
+// invalid.
+func (s *DeepServer) embed(req UnaryRequest, inputs []string) (interface{}, error) {
+	dims := req.Dimensions
+	if dims == 0 {
+		dims = s.config.EmbeddingDimensions
+	}
+	if dims == 0 {
+		dims = defaultEmbeddingDimensions
+	}
+	if dims < 0 || dims > maxEmbeddingDimensions {
+		return nil, fmt.Errorf("dimensions must be between 1 and %d", maxEmbeddingDimensions)
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		return nil, fmt.Errorf("unknown encoding_format %q", req.EncodingFormat)
+	}
+
+	type embedding struct {
+		Object    string      `json:"object"`
+		Index     int         `json:"index"`
+		Embedding interface{} `json:"embedding"`
+	}
+	data := make([]embedding, len(inputs))
+	tokens := 0
+	for i, input := range inputs {
+		rng := inputRand(req.Model, input)
+		vector := make([]float32, dims)
+		var norm float64
+		for j := range vector {
+			v := rng.NormFloat64()
+			vector[j] = float32(v)
+			norm += v * v
+		}
+		norm = math.Sqrt(norm)
+		for j := range vector {
+			vector[j] = float32(float64(vector[j]) / norm)
+		}
+		data[i] = embedding{Object: "embedding", Index: i, Embedding: vector}
+		if req.EncodingFormat == "base64" {
+			raw := make([]byte, 4*dims)
+			for j, v := range vector {
+				binary.LittleEndian.PutUint32(raw[4*j:], math.Float32bits(v))
+			}
+			data[i].Embedding = base64.StdEncoding.EncodeToString(raw)
+		}
+		tokens += max(len(input)/bytesPerToken, 1)
+	}
+	return map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  req.Model,
+		"usage":  map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	}, nil
+}
+
+// handleModerations answers /v1/moderations in OpenAI's shape. Scores are
+// low but for the categories an input mentions by name, which it is
+// flagged for.
+func (s *DeepServer) handleModerations(w http.ResponseWriter, r *http.Request) {
+	req, inputs, ok := s.startUnary(w, r, "omni-moderation-latest")
+	if !ok {
+		return
+	}
+	s.writeUnary(w, &s.moderations, len(inputs), moderate(req, inputs))
+}
+
+// moderate computes the answer to a moderations request.
+func moderate(req UnaryRequest, inputs []string) interface{} {
+	type result struct {
+		Flagged        bool               `json:"flagged"`
+		Categories     map[string]bool    `json:"categories"`
+		CategoryScores map[string]float64 `json:"category_scores"`
+	}
+	results := make([]result, len(inputs))
+	for i, input := range inputs {
+		rng := inputRand(req.Model, input)
+		lower := strings.ToLower(input)
+		res := result{Categories: make(map[string]bool), CategoryScores: make(map[string]float64)}
+		for _, category := range moderationCategories {
+			score := rng.Float64() * 0.05
+			if strings.Contains(lower, category) {
+				score = 0.9 + rng.Float64()*0.1
+			}
+			res.CategoryScores[category] = score
+			res.Categories[category] = score > 0.5
+			res.Flagged = res.Flagged || score > 0.5
+		}
+		results[i] = res
+	}
+	return map[string]interface{}{
+		"id":      fmt.Sprintf("modr-%d", time.Now().UnixNano()),
+		"model":   req.Model,
+		"results": results,
+	}
+}
+
+// batchRequest answers one request of a batch: the status and body it
+// would have got on its own, without the wait.
+func (s *DeepServer) batchRequest(endpoint string, body json.RawMessage) (int, interface{}) {
+	if endpoint == "/v1/chat/completions" {
+		var req StreamRequest
+		json.Unmarshal(body, &req)
+		model, status, message := s.chooseModel(req.Model, "openai", "")
+		if model == nil {
+			return status, apiErrorBody("openai", status, message)
+		}
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		tokens := streamTokens(model.outputTokens(req.maxTokens(), rng))
+		atomic.AddInt64(&model.completed, 1)
+		atomic.AddInt64(&model.tokens, int64(len(tokens)))
+		return http.StatusOK, s.chatCompletion(batch.NewID("chatcmpl-"), req.modelName(model), strings.Join(tokens, ""), len(tokens), len(body))
+	}
+
+	var req UnaryRequest
+	json.Unmarshal(body, &req)
+	inputs, err := req.inputs()
+	if err != nil {
+		return http.StatusBadRequest, apiErrorBody("openai", http.StatusBadRequest, err.Error())
+	}
+	if req.Model == "" {
+		req.Model = "text-embedding-3-small"
+		if endpoint == "/v1/moderations" {
+			req.Model = "omni-moderation-latest"
+		}
+	}
+	if s.models.strict {
+		model, status, message := s.chooseModel(req.Model, "openai", "")
+		if model == nil {
+			return status, apiErrorBody("openai", status, message)
+		}
+		atomic.AddInt64(&model.completed, 1)
+	}
+	if endpoint == "/v1/moderations" {
+		return http.StatusOK, moderate(req, inputs)
+	}
+	resp, err := s.embed(req, inputs)
+	if err != nil {
+		return http.StatusBadRequest, apiErrorBody("openai", http.StatusBadRequest, err.Error())
+	}
+	return http.StatusOK, resp
+}
+
+// tokenDelay is the token delay of a scripted response, or def.
+func (script *ScriptedResponse) tokenDelay(def time.Duration) time.Duration {
+	if script == nil || script.TokenDelayMs == nil {
+		return def
+	}
+	return time.Duration(*script.TokenDelayMs) * time.Millisecond
+}
+
+// disconnectAfter is the number of tokens after which a stream is to be
+// dropped: as scripted, or at a random token as often as the model's
+// disconnect rate says. Zero means never.
+func disconnectAfter(script *ScriptedResponse, model *servedModel, tokens *tokenStream) int {
+	if script != nil && script.DisconnectAfter > 0 {
+		return script.DisconnectAfter
+	}
+	if model != nil && model.DisconnectRate > 0 && tokens.rng.Float64() < model.DisconnectRate {
+		return 1 + tokens.rng.Intn(len(tokens.tokens))
+	}
+	return 0
+}
+
+// cutOff drops the connection once sent tokens have gone out, if after
+// says to, like an upstream that dies mid-stream.
+func (s *DeepServer) cutOff(model *servedModel, after int, streamID string, sent int) {
+	if after <= 0 || sent < after {
+		return
+	}
+	atomic.AddInt64(&model.disconnects, 1)
+	s.logger.WithFields(logrus.Fields{
+		"stream_id": streamID,
+		"model":     model.Name,
+	}).Info("Dropping connection mid-stream")
+	panic(http.ErrAbortHandler)
 }
 
 func (s *DeepServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	var req StreamRequest
+	json.Unmarshal(body, &req)
+	if req.Stream != nil && !*req.Stream {
+		s.handleCompletion(w, r, body, req)
+		return
+	}
+
+	w, stopHeartbeat := s.heartbeats.Wrap(w)
+	defer stopHeartbeat()
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
@@ -76,53 +2130,68 @@ func (s *DeepServer) handleStream(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("X-Accel-Buffering", "no")
 
-	streamID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	streamID := fmt.Sprintf("chatcmpl-%d", s.clock.Now().UnixNano())
+	start := s.clock.Now()
+	s.addConfiguredHeaders(w, streamID)
+	recording, script, err := s.takeResponse(r, body, req.Model)
+	if err != nil {
+		writeAPIError(w, "openai", http.StatusBadRequest, err.Error())
+		return
+	}
+	if recording != nil {
+		s.replayStream(w, r, flusher, recording, "openai", streamID)
+		return
+	}
+	if !s.startScript(w, r, script, "openai", streamID) {
+		return
+	}
+	model := s.startModel(w, req.Model, "openai", streamID)
+	if model == nil {
+		return
+	}
+	tokens := s.responseTokens(w, r, body, req.maxTokens(), model)
+	if script != nil && (len(script.Tokens) > 0 || script.play != nil && script.play.fault != nil) {
+		tokens = s.newTokenStream(script.Tokens, tokens.rng)
+	}
+	if script != nil {
+		tokens.play = script.play
+	}
+	faults, ok := s.startChaos(w, r, "openai", streamID, len(tokens.tokens))
+	if !ok {
+		return
+	}
+	cutAfter := faults.disconnectAfter(disconnectAfter(script, model, tokens))
+	defer func() { atomic.AddInt64(&model.tokens, int64(tokens.sent)) }()
 	atomic.AddInt64(&s.activeStreams, 1)
 	atomic.AddInt64(&s.totalStreams, 1)
 	defer atomic.AddInt64(&s.activeStreams, -1)
+	rec := s.startStream(r, streamID, "openai")
+	outcome := "cancelled"
+	defer func() { s.finishStream(rec, outcome) }()
+	usage := s.usage.Start(server.TenantOf(r))
+	defer usage.Finish()
+	w = usage.Wrap(w)
+	s.flushHeaders(w, r, flusher)
+	if !s.processPrompt(r, streamID, len(body)) {
+		return
+	}
+	events := s.newEventWriter(faults.writer(w, r, flusher))
 
 	s.logger.WithFields(logrus.Fields{
 		"stream_id":     streamID,
 		"active_streams": atomic.LoadInt64(&s.activeStreams),
 	}).Info("Stream started")
 
-	// Simulate token generation over 15 seconds with variable delays
-	tokens := []string{
-		"Hello", " there", "!", " I'm", " a", " simulated", " AI", " response", 
-		" that", " streams", " tokens", " slowly", " over", " time", ".",
-		" This", " mimics", " the", " behavior", " of", " real", " AI", " APIs",
-		" like", " OpenAI", "'s", " GPT", " models", ".", " Each", " token",
-		" represents", " a", " small", " piece", " of", " the", " complete", " response",
-		".", " The", " streaming", " allows", " for", " a", " more", " interactive",
-		" experience", " as", " users", " can", " see", " the", " response", " being",
-		" generated", " in", " real", "-time", " rather", " than", " waiting", " for",
-		" the", " entire", " response", " to", " complete", ".", " This", " test",
-		" server", " simulates", " this", " behavior", " by", " sending", " tokens",
-		" at", " regular", " intervals", " over", " a", " 15", "-second", " period",
-		".", " The", " proxy", " server", " will", " buffer", " and", " forward",
-		" these", " tokens", " to", " connected", " clients", ".",
-		" Additional", " tokens", " are", " added", " to", " extend", " the", " streaming",
-		" duration", " to", " properly", " test", " the", " system", " under", " longer",
-		" streaming", " conditions", ".", " This", " helps", " verify", " that", " the",
-		" proxy", " server", " can", " handle", " extended", " SSE", " connections",
-		" and", " properly", " buffer", " responses", " over", " a", " longer", " period",
-		".", " The", " total", " stream", " time", " is", " now", " approximately",
-		" 15", " seconds", " to", " better", " simulate", " real-world", " AI", " response",
-		" times", " for", " complex", " queries", " or", " longer", " generated", " content",
-	}
-
-	// Stream over 15 seconds for hardcore testing
+	// The full response streams over 15 seconds for hardcore testing
 	// This tests the system under extended streaming conditions
-	streamDuration := 15 * time.Second
-	baseDelay := streamDuration / time.Duration(len(tokens))
-	tokenDelay := baseDelay
-	
-	for i, token := range tokens {
+	tokenDelay := script.tokenDelay(streamTokenDelay(r, model))
+
+	for token, ok := tokens.next(); ok; token, ok = tokens.next() {
 		response := StreamResponse{
 			ID:      streamID,
 			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   "gpt-4-turbo",
+			Created: s.clock.Now().Unix(),
+			Model:   req.modelName(model),
 			Choices: []Choice{
 				{
 					Index: 0,
@@ -134,30 +2203,36 @@ func (s *DeepServer) handleStream(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 
-		if i == 0 {
+		if tokens.sent == 1 {
 			response.Choices[0].Delta.Role = "assistant"
 		}
 
 		data, _ := json.Marshal(response)
-		fmt.Fprintf(w, "data: %s\n\n", string(data))
+		// The first chunk carries the role, so it stays first and single
+		events.send("", string(faults.mangle(tokens.sent, data)), tokens.sent > 1)
 		flusher.Flush()
+		s.cutOff(model, cutAfter, streamID, tokens.sent)
 
 		select {
 		case <-r.Context().Done():
 			s.logger.WithField("stream_id", streamID).Info("Client disconnected")
 			return
-		case <-time.After(tokenDelay):
+		case <-s.clock.After(tokens.delay(tokenDelay) + faults.stallAfter(tokens.sent)):
 			// Continue to next token
 		}
 	}
+	if s.injectFault(events, flusher, script, model, "openai", streamID) {
+		outcome = "failed"
+		return
+	}
 
 	// Send finish message
 	finishReason := "stop"
 	finalResponse := StreamResponse{
 		ID:      streamID,
 		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   "gpt-4-turbo",
+		Created: s.clock.Now().Unix(),
+		Model:   req.modelName(model),
 		Choices: []Choice{
 			{
 				Index:        0,
@@ -168,25 +2243,571 @@ func (s *DeepServer) handleStream(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data, _ := json.Marshal(finalResponse)
-	fmt.Fprintf(w, "data: %s\n\n", string(data))
-	fmt.Fprintf(w, "data: [DONE]\n\n")
+	events.send("", string(data), false)
+	events.send("", "[DONE]", false)
 	flusher.Flush()
 
+	s.setConfiguredTrailers(w, streamID, tokens.sent, start)
+
+	outcome = "completed"
+	atomic.AddInt64(&s.completedStreams, 1)
+	atomic.AddInt64(&model.completed, 1)
+	s.logger.WithField("stream_id", streamID).Info("Stream completed")
+}
+
+// handleCompletion answers a chat completion asked for with "stream":
+// false: the simulated response of handleStream, generated at the same
+// pace and failing the same ways, as one chat.completion object once it
+// is complete. A scenario's error step fails it with a 500.
+func (s *DeepServer) handleCompletion(w http.ResponseWriter, r *http.Request, body []byte, req StreamRequest) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	streamID := fmt.Sprintf("chatcmpl-%d", s.clock.Now().UnixNano())
+	start := s.clock.Now()
+	s.addConfiguredHeaders(w, streamID)
+	script, err := s.takeScript(r, body, req.Model)
+	if err != nil {
+		writeAPIError(w, "openai", http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.startScript(w, r, script, "openai", streamID) {
+		return
+	}
+	model := s.startModel(w, req.Model, "openai", streamID)
+	if model == nil {
+		return
+	}
+	tokens := s.responseTokens(w, r, body, req.maxTokens(), model)
+	if script != nil && (len(script.Tokens) > 0 || script.play != nil && script.play.fault != nil) {
+		tokens = s.newTokenStream(script.Tokens, tokens.rng)
+	}
+	if script != nil {
+		tokens.play = script.play
+	}
+	faults, ok := s.startChaos(w, r, "openai", streamID, len(tokens.tokens))
+	if !ok {
+		return
+	}
+	cutAfter := faults.disconnectAfter(disconnectAfter(script, model, tokens))
+	defer func() { atomic.AddInt64(&model.tokens, int64(tokens.sent)) }()
+	atomic.AddInt64(&s.activeStreams, 1)
+	atomic.AddInt64(&s.totalStreams, 1)
+	defer atomic.AddInt64(&s.activeStreams, -1)
+	rec := s.startStream(r, streamID, "openai")
+	outcome := "cancelled"
+	defer func() { s.finishStream(rec, outcome) }()
+	usage := s.usage.Start(server.TenantOf(r))
+	defer usage.Finish()
+	w = usage.Wrap(w)
+	if !s.processPrompt(r, streamID, len(body)) {
+		return
+	}
+
+	var content strings.Builder
+	tokenDelay := script.tokenDelay(streamTokenDelay(r, model))
+	for token, ok := tokens.next(); ok; token, ok = tokens.next() {
+		content.WriteString(token)
+		s.cutOff(model, cutAfter, streamID, tokens.sent)
+		select {
+		case <-r.Context().Done():
+			s.logger.WithField("stream_id", streamID).Info("Client disconnected")
+			return
+		case <-s.clock.After(tokens.delay(tokenDelay) + faults.stallAfter(tokens.sent)):
+		}
+	}
+	if fault := s.scenarioFault(script, model, streamID); fault != nil {
+		outcome = "failed"
+		writeAPIError(w, "openai", http.StatusInternalServerError, fault.Error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.chatCompletion(streamID, req.modelName(model), content.String(), tokens.sent, len(body)))
+	s.setConfiguredTrailers(w, streamID, tokens.sent, start)
+
+	outcome = "completed"
+	atomic.AddInt64(&s.completedStreams, 1)
+	atomic.AddInt64(&model.completed, 1)
+	s.logger.WithFields(logrus.Fields{
+		"stream_id": streamID,
+		"tokens":    tokens.sent,
+	}).Info("Completion sent")
+}
+
+// chatCompletion is the non-streamed response of a chat completion: its
+// content, made of tokens tokens, with the usage of a prompt of
+// promptBytes.
+func (s *DeepServer) chatCompletion(id, model, content string, tokens, promptBytes int) client.ChatCompletion {
+	promptTokens := max(promptBytes/bytesPerToken, 1)
+	return client.ChatCompletion{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: s.clock.Now().Unix(),
+		Model:   model,
+		Choices: []client.CompletionChoice{{
+			Message:      client.ChatMessage{Role: "assistant", Content: content},
+			FinishReason: "stop",
+		}},
+		Usage: &client.Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: tokens,
+			TotalTokens:      promptTokens + tokens,
+		},
+	}
+}
+
+// maxResponseTokens caps the max_tokens a request can ask for, which sizes
+// the token slice of its response. -stream-duration serves longer streams.
+const maxResponseTokens = 100000
+
+// streamTokens returns the tokens of a response limited to maxTokens. Zero
+// means the full simulated response; longer requests cycle through it.
+func streamTokens(maxTokens int) []string {
+	if maxTokens <= 0 {
+		return simulatedTokens
+	}
+	tokens := make([]string, min(maxTokens, maxResponseTokens))
+	for i := range tokens {
+		tokens[i] = simulatedTokens[i%len(simulatedTokens)]
+	}
+	return tokens
+}
+
+// responseTokens returns the tokens to stream for a request, as many as
+// the model's output length says. In deterministic mode they are drawn
+// from the simulated vocabulary with a PRNG seeded by the hash of the
+// request path and body, which is also reported in the X-Request-Hash
+// header.
+func (s *DeepServer) responseTokens(w http.ResponseWriter, r *http.Request, body []byte, maxTokens int, model *servedModel) *tokenStream {
+	if !s.config.DeterministicContent {
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return s.newTokenStream(streamTokens(model.outputTokens(maxTokens, rng)), rng)
+	}
+	h := sha256.New()
+	io.WriteString(h, r.URL.Path)
+	h.Write([]byte{0})
+	h.Write(body)
+	sum := h.Sum(nil)
+	w.Header().Set(requestHashHeader, hex.EncodeToString(sum[:8]))
+
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum))))
+	n := min(model.outputTokens(maxTokens, rng), maxResponseTokens)
+	if n <= 0 {
+		n = len(simulatedTokens)
+	}
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = simulatedTokens[rng.Intn(len(simulatedTokens))]
+	}
+	return s.newTokenStream(tokens, rng)
+}
+
+// tokenStream hands out the text of a response one token event at a time.
+type tokenStream struct {
+	s      *DeepServer
+	tokens []string
+	rng    *rand.Rand // event sizes, seeded like the tokens
+	start  time.Time  // of the first token
+	sent   int
+	play   *scenarioPlay // pacing the tokens, if a scenario is played
+}
+
+func (s *DeepServer) newTokenStream(tokens []string, rng *rand.Rand) *tokenStream {
+	return &tokenStream{s: s, tokens: tokens, rng: rng}
+}
+
+// next returns the text of the next token event, or false once the
+// response is complete: after its tokens, or in long-stream mode once the
+// stream duration has passed.
+func (t *tokenStream) next() (string, bool) {
+	cfg := t.s.config
+	if t.sent == 0 {
+		t.start = t.s.clock.Now()
+	}
+	if cfg.StreamDuration > 0 {
+		if t.sent > 0 && t.s.clock.Since(t.start) >= cfg.StreamDuration {
+			return "", false
+		}
+	} else if t.sent >= len(t.tokens) {
+		return "", false
+	}
+	if len(t.tokens) == 0 {
+		return "", false
+	}
+	token := t.tokens[t.sent%len(t.tokens)]
+	t.sent++
+
+	if cfg.EventSizeMax > 0 {
+		size := cfg.EventSizeMin + t.rng.Intn(cfg.EventSizeMax-cfg.EventSizeMin+1)
+		if pad := size - len(token); pad > 0 {
+			token += t.s.filler[:pad]
+		}
+	}
+	return token, true
+}
+
+// delay is the pause after the token just sent: as the scenario played
+// says, or def.
+func (t *tokenStream) delay(def time.Duration) time.Duration {
+	return t.play.delay(t.sent, def)
+}
+
+// streamTokenDelay is the pause between tokens. It defaults to the model's
+// pace, or to spreading the full response over 15 seconds; load
+// generators can set token_delay_ms to pace individual streams.
+func streamTokenDelay(r *http.Request, model *servedModel) time.Duration {
+	if ms, err := strconv.Atoi(r.URL.Query().Get("token_delay_ms")); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return model.tokenDelay(15 * time.Second / time.Duration(len(simulatedTokens)))
+}
+
+// eventWriter writes the events of one stream, adding the configured
+// ids, noise and sequencing faults.
+type eventWriter struct {
+	s    *DeepServer
+	w    io.Writer
+	ids  bool
+	seq  int
+	held string // an event delayed until after the next one
+}
+
+func (s *DeepServer) newEventWriter(w io.Writer) *eventWriter {
+	c := s.config
+	return &eventWriter{s: s, w: w, ids: c.SequenceIDs || c.DuplicateRate > 0 || c.ReorderRate > 0}
+}
+
+// send writes an event of type typ (empty for the default) with data.
+// Faults are only injected where faulty is set, so a stream still starts
+// and ends in order.
+func (e *eventWriter) send(typ, data string, faulty bool) {
+	var b strings.Builder
+	e.seq++
+	if e.ids {
+		fmt.Fprintf(&b, "id: %d\n", e.seq)
+	}
+	if typ != "" {
+		fmt.Fprintf(&b, "event: %s\n", typ)
+	}
+	fmt.Fprintf(&b, "data: %s\n\n", data)
+	event := b.String()
+
+	c := e.s.config
+	if faulty && e.held == "" && c.ReorderRate > 0 && rand.Float64() < c.ReorderRate {
+		e.held = event
+		return
+	}
+	e.write(event)
+	if e.held != "" {
+		e.write(e.held)
+		e.held = ""
+	}
+	if faulty && c.DuplicateRate > 0 && rand.Float64() < c.DuplicateRate {
+		e.write(event)
+	}
+}
+
+func (e *eventWriter) write(event string) {
+	e.s.writeNoise(e.w)
+	io.WriteString(e.w, event)
+}
+
+// writeNoise writes the noise configured to precede an event.
+func (s *DeepServer) writeNoise(w io.Writer) {
+	n := s.config.Noise
+	if n.KeepAlives > 0 && rand.Float64() < n.KeepAlives {
+		io.WriteString(w, "\n")
+	}
+	if n.Comments > 0 && rand.Float64() < n.Comments {
+		fmt.Fprintf(w, ": noise %d\n", rand.Intn(1000))
+	}
+	if n.Fields > 0 && rand.Float64() < n.Fields {
+		fmt.Fprintf(w, "%s: %d\n", noiseFields[rand.Intn(len(noiseFields))], rand.Intn(1000))
+	}
+}
+
+// promptDelay is how long the simulated model takes to read a prompt of
+// size bytes before it starts streaming.
+func (s *DeepServer) promptDelay(size int) time.Duration {
+	c := s.config
+	d := c.PromptDelayBase +
+		time.Duration(float64(c.PromptDelayPerKB)*float64(size)/1024) +
+		c.PromptDelayPerToken*time.Duration(size/bytesPerToken)
+	if c.PromptDelayMax > 0 && d > c.PromptDelayMax {
+		d = c.PromptDelayMax
+	}
+	return d
+}
+
+// flushHeaders sends the 200 and the headers right away if the client asks
+// with ?flush_headers=true, instead of with the first event. fetch()
+// resolves once the headers arrive, so a client streaming with fetch can
+// tell a stream waiting on its prompt from one that failed to connect.
+// With heartbeats on they always go out, so the wait can carry them.
+func (s *DeepServer) flushHeaders(w http.ResponseWriter, r *http.Request, flusher http.Flusher) {
+	if flush, _ := strconv.ParseBool(r.URL.Query().Get("flush_headers")); flush || s.config.Heartbeat > 0 {
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+}
+
+// handlePreflight answers the CORS preflight a browser sends before a
+// fetch() that POSTs JSON, so pages can stream without EventSource.
+func (s *DeepServer) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWebSocket streams a completion over WebSocket: the first message
+// is the request body, for /v1/messages with ?dialect=anthropic and for
+// /v1/chat/completions otherwise, and each event comes as a message.
+func (s *DeepServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	route := websocket.Route{Method: http.MethodPost, Path: "/v1/chat/completions", Handler: http.HandlerFunc(s.handleStream)}
+	if r.URL.Query().Get("dialect") == "anthropic" {
+		route = websocket.Route{Method: http.MethodPost, Path: "/v1/messages", Handler: http.HandlerFunc(s.handleMessages)}
+	}
+	if err := websocket.ServeSSE(w, r, func([]byte) websocket.Route { return route }); err != nil {
+		s.logger.WithError(err).Debug("WebSocket stream not started")
+	}
+}
+
+// processPrompt waits out the prompt delay before the first byte of the
+// response. It returns false if the client went away meanwhile.
+func (s *DeepServer) processPrompt(r *http.Request, streamID string, size int) bool {
+	delay := s.promptDelay(size)
+	if delay <= 0 {
+		return true
+	}
+	s.logger.WithFields(logrus.Fields{
+		"stream_id":    streamID,
+		"prompt_bytes": size,
+		"delay_ms":     delay.Milliseconds(),
+	}).Debug("Processing prompt")
+
+	select {
+	case <-r.Context().Done():
+		s.logger.WithField("stream_id", streamID).Info("Client disconnected during prompt processing")
+		return false
+	case <-s.clock.After(delay):
+		return true
+	}
+}
+
+// addConfiguredHeaders adds the configured headers and declares the
+// trailers that setConfiguredTrailers will fill in.
+func (s *DeepServer) addConfiguredHeaders(w http.ResponseWriter, streamID string) {
+	for _, h := range s.config.Headers {
+		w.Header().Add(h.Name, strings.ReplaceAll(h.Value, "{stream_id}", streamID))
+	}
+	for _, t := range s.config.Trailers {
+		w.Header().Add("Trailer", t.Name)
+	}
+	if s.config.UsageTrailers {
+		w.Header().Add("Trailer", usageTokensTrailer)
+		w.Header().Add("Trailer", usageDurationTrailer)
+	}
+}
+
+func (s *DeepServer) setConfiguredTrailers(w http.ResponseWriter, streamID string, tokens int, start time.Time) {
+	for _, t := range s.config.Trailers {
+		w.Header().Set(t.Name, strings.ReplaceAll(t.Value, "{stream_id}", streamID))
+	}
+	if s.config.UsageTrailers {
+		w.Header().Set(usageTokensTrailer, strconv.Itoa(tokens))
+		w.Header().Set(usageDurationTrailer, strconv.FormatInt(s.clock.Since(start).Milliseconds(), 10))
+	}
+}
+
+// handleMessages streams the same simulated response as handleStream in the
+// Anthropic Messages dialect: typed events from message_start to
+// message_stop instead of chunks ending in [DONE].
+func (s *DeepServer) handleMessages(w http.ResponseWriter, r *http.Request) {
+	w, stopHeartbeat := s.heartbeats.Wrap(w)
+	defer stopHeartbeat()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	var req StreamRequest
+	json.Unmarshal(body, &req)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	streamID := fmt.Sprintf("msg_%d", s.clock.Now().UnixNano())
+	start := s.clock.Now()
+	s.addConfiguredHeaders(w, streamID)
+	recording, script, err := s.takeResponse(r, body, req.Model)
+	if err != nil {
+		writeAPIError(w, "anthropic", http.StatusBadRequest, err.Error())
+		return
+	}
+	if recording != nil {
+		s.replayStream(w, r, flusher, recording, "anthropic", streamID)
+		return
+	}
+	if !s.startScript(w, r, script, "anthropic", streamID) {
+		return
+	}
+	model := s.startModel(w, req.Model, "anthropic", streamID)
+	if model == nil {
+		return
+	}
+	tokens := s.responseTokens(w, r, body, req.MaxTokens, model)
+	if script != nil && (len(script.Tokens) > 0 || script.play != nil && script.play.fault != nil) {
+		tokens = s.newTokenStream(script.Tokens, tokens.rng)
+	}
+	if script != nil {
+		tokens.play = script.play
+	}
+	faults, ok := s.startChaos(w, r, "anthropic", streamID, len(tokens.tokens))
+	if !ok {
+		return
+	}
+	cutAfter := faults.disconnectAfter(disconnectAfter(script, model, tokens))
+	defer func() { atomic.AddInt64(&model.tokens, int64(tokens.sent)) }()
+	atomic.AddInt64(&s.activeStreams, 1)
+	atomic.AddInt64(&s.totalStreams, 1)
+	defer atomic.AddInt64(&s.activeStreams, -1)
+	rec := s.startStream(r, streamID, "anthropic")
+	outcome := "cancelled"
+	defer func() { s.finishStream(rec, outcome) }()
+	usage := s.usage.Start(server.TenantOf(r))
+	defer usage.Finish()
+	w = usage.Wrap(w)
+	s.flushHeaders(w, r, flusher)
+	if !s.processPrompt(r, streamID, len(body)) {
+		return
+	}
+	events := s.newEventWriter(faults.writer(w, r, flusher))
+
+	s.logger.WithFields(logrus.Fields{
+		"stream_id":      streamID,
+		"dialect":        "anthropic",
+		"active_streams": atomic.LoadInt64(&s.activeStreams),
+	}).Info("Stream started")
+
+	send := func(ev AnthropicEvent) {
+		data, _ := json.Marshal(ev)
+		if ev.Type == "content_block_delta" {
+			data = faults.mangle(tokens.sent, data)
+		}
+		events.send(ev.Type, string(data), ev.Type == "content_block_delta")
+		flusher.Flush()
+	}
+
+	index := 0
+	send(AnthropicEvent{
+		Type: "message_start",
+		Message: &AnthropicMessage{
+			ID:      streamID,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   req.modelName(model),
+			Content: []ContentBlock{},
+			Usage: AnthropicUsage{InputTokens: len(body) / bytesPerToken, OutputTokens: 1},
+		},
+	})
+	send(AnthropicEvent{Type: "content_block_start", Index: &index, ContentBlock: &ContentBlock{Type: "text"}})
+	send(AnthropicEvent{Type: "ping"})
+
+	tokenDelay := script.tokenDelay(streamTokenDelay(r, model))
+	for token, ok := tokens.next(); ok; token, ok = tokens.next() {
+		send(AnthropicEvent{
+			Type:  "content_block_delta",
+			Index: &index,
+			Delta: &AnthropicDelta{Type: "text_delta", Text: token},
+		})
+		s.cutOff(model, cutAfter, streamID, tokens.sent)
+
+		select {
+		case <-r.Context().Done():
+			s.logger.WithField("stream_id", streamID).Info("Client disconnected")
+			return
+		case <-s.clock.After(tokens.delay(tokenDelay) + faults.stallAfter(tokens.sent)):
+		}
+	}
+	if s.injectFault(events, flusher, script, model, "anthropic", streamID) {
+		outcome = "failed"
+		return
+	}
+
+	stopReason := "end_turn"
+	send(AnthropicEvent{Type: "content_block_stop", Index: &index})
+	send(AnthropicEvent{
+		Type:  "message_delta",
+		Delta: &AnthropicDelta{StopReason: &stopReason},
+		Usage: &AnthropicUsage{OutputTokens: tokens.sent},
+	})
+	send(AnthropicEvent{Type: "message_stop"})
+
+	s.setConfiguredTrailers(w, streamID, tokens.sent, start)
+
+	outcome = "completed"
 	atomic.AddInt64(&s.completedStreams, 1)
+	atomic.AddInt64(&model.completed, 1)
 	s.logger.WithField("stream_id", streamID).Info("Stream completed")
 }
 
 func (s *DeepServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	conns, _ := json.Marshal(s.conns.Stats())
+	janitor, _ := json.Marshal(s.janitor.Stats())
+	heartbeats, _ := json.Marshal(s.heartbeats.Stats())
+	models, _ := json.Marshal(s.models.stats())
+	scenarios, _ := json.Marshal(s.scenarios.stats())
+	recordings, _ := json.Marshal(s.recordings.stats())
+	chaos, _ := json.Marshal(s.chaos.stats())
+	batches, _ := json.Marshal(s.batches.Stats())
+	cancelReasons, _ := json.Marshal(s.streams.cancelReasons())
+	reload, _ := json.Marshal(s.reloader.Stats())
+	unary, _ := json.Marshal(map[string]UnaryStats{
+		"embeddings":  s.embeddings.stats(),
+		"moderations": s.moderations.stats(),
+	})
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, `{
 		"active_streams": %d,
 		"total_streams": %d,
 		"completed_streams": %d,
+		"cancelled_streams": %d,
+		"cancel_reasons": %s,
+		"connections": %s,
+		"heartbeats": %s,
+		"models": %s,
+		"scenarios": %s,
+		"recordings": %s,
+		"chaos": %s,
+		"unary": %s,
+		"batches": %s,
+		"retention": %s,
+		"config": %s,
 		"timestamp": "%s"
 	}`,
 		atomic.LoadInt64(&s.activeStreams),
 		atomic.LoadInt64(&s.totalStreams),
 		atomic.LoadInt64(&s.completedStreams),
+		atomic.LoadInt64(&s.cancelledStreams),
+		cancelReasons,
+		conns,
+		heartbeats,
+		models,
+		scenarios,
+		recordings,
+		chaos,
+		unary,
+		batches,
+		janitor,
+		reload,
 		time.Now().Format(time.RFC3339),
 	)
 }
@@ -204,14 +2825,247 @@ func main() {
 		}
 	}
 	port := flag.Int("port", defaultPort, "Server port")
+	var headers, trailers headerFlags
+	flag.Var(&headers, "header", "Response header \"Name: value\" to add to streams (repeatable, {stream_id} is expanded)")
+	flag.Var(&trailers, "trailer", "Trailer \"Name: value\" to send after the stream (repeatable, {stream_id} is expanded)")
+	usageTrailers := flag.Bool("usage-trailers", false, "Send token count and duration as trailers after each stream")
+	usageSample := flag.Duration("usage-sample", time.Second, "Interval between samples attributing CPU time to streams for /usage")
+	wattsPerCore := flag.Float64("watts-per-core", 0, "Power draw of one busy core, to estimate energy on /usage (0 leaves it out)")
+	promptDelayBase := flag.Duration("prompt-delay-base", 0, "Fixed delay before the first token of every stream")
+	promptDelayPerKB := flag.Duration("prompt-delay-per-kb", 0, "Delay before the first token per KB of request body")
+	promptDelayPerToken := flag.Duration("prompt-delay-per-token", 0, "Delay before the first token per estimated prompt token (4 bytes each)")
+	deterministic := flag.Bool("deterministic", false, "Derive each response's tokens from a hash of the request, so identical requests get identical content")
+	noise := flag.String("noise", "", "Chances per event of preceding it with noise lines, e.g. comments=0.3,keepalives=0.2,fields=0.1")
+	sequenceIDs := flag.Bool("sequence-ids", false, "Number the events of each stream with id: 1, 2, ...")
+	duplicateRate := flag.Float64("duplicate-rate", 0, "Chance that a token event is sent twice (turns on -sequence-ids)")
+	reorderRate := flag.Float64("reorder-rate", 0, "Chance that a token event is sent after the next one (turns on -sequence-ids)")
+	eventSize := flag.String("event-size", "", "Pad every token event to a random size in this range, e.g. 64KB-5MB (empty leaves events as they are)")
+	streamDuration := flag.Duration("stream-duration", 0, "Keep every stream going this long, cycling through the response (0 ends it after its tokens)")
+	promptDelayMax := flag.Duration("prompt-delay-max", 0, "Upper bound of the delay before the first token (0 means none)")
+	idleLeakAfter := flag.Duration("idle-leak-after", server.DefaultIdleLeakAfter, "Idle time after which /metrics counts a keep-alive connection as leaked")
+	httpBuffers := flag.String("http-buffers", "", "Response buffer sizes, e.g. write=32KB,h2-frame=64KB (see the proxy's -http-buffers)")
+	httpVersion := flag.String("http-version", string(server.HTTPAuto), "HTTP versions served: auto (HTTP/1.1, and HTTP/2 over TLS or as h2c), h1 or h2 (see the proxy's -http-version)")
+	tcpSpec := flag.String("tcp", "", "Socket options of accepted connections, e.g. nodelay=false,sndbuf=64KB,keepalive=30s (see the proxy's -tcp)")
+	pprofAddr := flag.String("pprof", "", "Address to serve net/http/pprof on (e.g. localhost:6061); disabled if empty")
+	timeScale := flag.Float64("time-scale", 1, "Run simulated time this many times faster than the wall clock, e.g. 1000 to finish 15-second streams in 15ms")
+	grpcPort := flag.Int("grpc-port", 0, "Also serve the API, with the gRPC ChatService, over HTTP/2 with TLS on this port (0 disables)")
+	grpcCert := flag.String("grpc-cert", "", "Certificate file of the -grpc-port listener (a self-signed one for localhost if empty)")
+	grpcKey := flag.String("grpc-key", "", "Key file of -grpc-cert")
+	retentionSpec := flag.String("retention", "", "Retention of stored data as CLASS[@DIR]=AGE[:SIZE] entries, e.g. usage=7d,logs@/var/log/horizon=30d:5GB (see the proxy's -retention)")
+	retentionInterval := flag.Duration("retention-interval", time.Minute, "Interval between the janitor's passes over -retention")
+	heartbeat := flag.Duration("heartbeat", 0, "Send a \": ping\" comment on streams idle for this long, flushing headers up front (0 disables)")
+	modelsFile := flag.String("models", "", "JSON file of the model catalog, each model with its own pacing, output length, error rates and dialect (empty serves any model)")
+	embeddingDims := flag.Int("embedding-dims", defaultEmbeddingDimensions, "Length of the vectors /v1/embeddings returns to requests that don't ask for dimensions")
+	unaryLatency := flag.Duration("unary-latency", 0, "Time /v1/embeddings and /v1/moderations take to answer")
+	unaryLatencyPerKB := flag.Duration("unary-latency-per-kb", 0, "Time /v1/embeddings and /v1/moderations take per KB of request body, on top of -unary-latency")
+	batchRate := flag.Float64("batch-rate", batch.DefaultRate, "Requests of a batch run per second (under -time-scale)")
+	scriptFile := flag.String("script", "", "JSON file of scripts to queue at startup, an array of /admin/script request bodies")
+	scenariosFile := flag.String("scenarios", "", "JSON or YAML file of named responses, with their token sequences, delay distributions and failures, picked by ?scenario= or by request content")
+	recordingsDir := flag.String("recordings", "", "Directory of streams recorded by the proxy's -record, replayed with their timing to requests naming one with X-Recording or ?recording=, and in turn to those on their path that nothing is scripted for")
+	chaosSpec := flag.String("chaos", "", "Chances per stream of injected faults, e.g. disconnect=0.05,error=0.02:502,stall=0.1:30s,malformed=0.01,trickle=0.05:20ms (requests can set their own with X-Chaos)")
+	preflightMode := flag.String("preflight", config.PreflightFail, "Check the settings and ports before serving and print the results: fail (stop on a failed check), warn or off")
+	configFile := flag.String("config", "", "YAML or TOML file setting the flags not given, under deep-server (default $HORIZON_CONFIG)")
 	flag.Parse()
 
-	server := NewDeepServer()
+	effective, err := config.Apply(flag.CommandLine, "deep-server", *configFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -config")
+	}
+	var eventSizeMin, eventSizeMax int
+	if *eventSize != "" {
+		var err error
+		if eventSizeMin, eventSizeMax, err = parseSizeRange(*eventSize); err != nil {
+			logrus.WithError(err).Fatal("Invalid -event-size")
+		}
+	}
+
+	noiseRates, err := parseNoiseRates(*noise)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -noise")
+	}
+	tcpOptions, err := server.ParseTCPOptions(*tcpSpec)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -tcp")
+	}
+	buffers, err := server.ParseHTTPBuffers(*httpBuffers)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -http-buffers")
+	}
+	version, err := server.ParseHTTPVersion(*httpVersion)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -http-version")
+	}
+	if *pprofAddr != "" {
+		if err := server.ServePprof(*pprofAddr); err != nil {
+			logrus.WithError(err).Fatal("Invalid -pprof")
+		}
+	}
+	if *duplicateRate < 0 || *duplicateRate > 1 {
+		logrus.Fatalf("Invalid -duplicate-rate %v, must be between 0 and 1", *duplicateRate)
+	}
+	if *reorderRate < 0 || *reorderRate > 1 {
+		logrus.Fatalf("Invalid -reorder-rate %v, must be between 0 and 1", *reorderRate)
+	}
+	retentionRules, err := retention.ParseRules(*retentionSpec)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -retention")
+	}
+	if *embeddingDims < 1 || *embeddingDims > maxEmbeddingDimensions {
+		logrus.Fatalf("Invalid -embedding-dims %d, must be between 1 and %d", *embeddingDims, maxEmbeddingDimensions)
+	}
+	if *batchRate <= 0 {
+		logrus.Fatalf("Invalid -batch-rate %v, must be positive", *batchRate)
+	}
+	var models []ModelProfile
+	if *modelsFile != "" {
+		if models, err = loadModelCatalog(*modelsFile); err != nil {
+			logrus.WithError(err).Fatal("Invalid -models")
+		}
+	}
+	var scripts []ScriptEntry
+	if *scriptFile != "" {
+		if scripts, err = loadScripts(*scriptFile); err != nil {
+			logrus.WithError(err).Fatal("Invalid -script")
+		}
+	}
+	var scenarios []*Scenario
+	if *scenariosFile != "" {
+		if scenarios, err = loadScenarios(*scenariosFile); err != nil {
+			logrus.WithError(err).Fatal("Invalid -scenarios")
+		}
+	}
+	recordings, err := loadRecordings(*recordingsDir)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -recordings")
+	}
+	chaos, err := parseChaos(*chaosSpec)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -chaos")
+	}
+	if err := config.CheckPreflightMode(*preflightMode); err != nil {
+		logrus.WithError(err).Fatal("Invalid -preflight")
+	}
+	if *preflightMode != config.PreflightOff {
+		checks := &config.Preflight{}
+		if addr := fmt.Sprintf(":%d", *port); tcpOptions.ReusePort {
+			checks.OK("port", addr+" shared with SO_REUSEPORT")
+		} else {
+			checks.Port("port", addr)
+		}
+		if *grpcPort > 0 {
+			checks.Port("grpc port", fmt.Sprintf(":%d", *grpcPort))
+			checks.Pair("grpc tls", "grpc-cert", *grpcCert, "grpc-key", *grpcKey)
+		} else if *grpcCert != "" || *grpcKey != "" {
+			checks.Warn("grpc tls", "-grpc-cert and -grpc-key have no effect without -grpc-port")
+		}
+		if *promptDelayMax > 0 && *promptDelayMax < *promptDelayBase {
+			checks.Warn("prompt delay", "-prompt-delay-max is below -prompt-delay-base, so every first token waits -prompt-delay-max")
+		}
+		if *timeScale < 1 {
+			checks.Warn("time scale", "-time-scale below 1 runs at the wall clock's speed; simulated time only runs faster")
+		}
+		checks.Print(os.Stderr)
+		if err := checks.Err(); err != nil {
+			if *preflightMode == config.PreflightFail {
+				logrus.WithError(err).Fatal("Startup checks failed; see the table above, or start with -preflight warn to serve anyway")
+			}
+			logrus.WithError(err).Warn("Startup checks failed; serving anyway")
+		}
+	}
+	var server *DeepServer
+	// A reload queues the scripts of -script again, in place of those of
+	// the file still pending, and reads -scenarios, -recordings and -chaos
+	// again
+	reloader, err := config.NewReloader(flag.CommandLine, effective, []string{"script", "scenarios", "recordings", "chaos"}, func() error {
+		var scripts []ScriptEntry
+		var scenarios []*Scenario
+		chaos, err := parseChaos(*chaosSpec)
+		if err != nil {
+			return fmt.Errorf("-chaos: %w", err)
+		}
+		if *scriptFile != "" {
+			if scripts, err = loadScripts(*scriptFile); err != nil {
+				return err
+			}
+		}
+		if *scenariosFile != "" {
+			if scenarios, err = loadScenarios(*scenariosFile); err != nil {
+				return err
+			}
+		}
+		recordings, err := loadRecordings(*recordingsDir)
+		if err != nil {
+			return fmt.Errorf("-recordings: %w", err)
+		}
+		server.scenarios.replace(scenarios)
+		server.recordings.replace(recordings)
+		server.chaos.set(chaos)
+		dropped := server.scripts.replaceFile(scripts)
+		server.logger.WithFields(logrus.Fields{"file": *scriptFile, "responses": len(scripts), "dropped": dropped}).Info("Responses scripted")
+		server.logger.WithFields(logrus.Fields{"file": *scenariosFile, "scenarios": len(scenarios)}).Info("Scenarios loaded")
+		server.logger.WithFields(logrus.Fields{"dir": *recordingsDir, "recordings": len(recordings)}).Info("Recordings loaded")
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -config")
+	}
+
+	server = NewDeepServer(DeepServerConfig{
+		Headers:       headers,
+		Trailers:      trailers,
+		UsageTrailers: *usageTrailers,
+		WattsPerCore:  *wattsPerCore,
+
+		PromptDelayBase:     *promptDelayBase,
+		PromptDelayPerKB:    *promptDelayPerKB,
+		PromptDelayPerToken: *promptDelayPerToken,
+		PromptDelayMax:      *promptDelayMax,
+
+		DeterministicContent: *deterministic,
+		EventSizeMin:         eventSizeMin,
+		EventSizeMax:         eventSizeMax,
+		StreamDuration:       *streamDuration,
+		Noise:                noiseRates,
+		SequenceIDs:          *sequenceIDs,
+		DuplicateRate:        *duplicateRate,
+		ReorderRate:          *reorderRate,
+		TimeScale:            *timeScale,
+		IdleLeakAfter:        *idleLeakAfter,
+		Heartbeat:            *heartbeat,
+		Models:               models,
+		EmbeddingDimensions:  *embeddingDims,
+		UnaryLatency:         *unaryLatency,
+		UnaryLatencyPerKB:    *unaryLatencyPerKB,
+		BatchRate:            *batchRate,
+		Scenarios:            scenarios,
+		Recordings:           recordings,
+		Chaos:                chaos,
+	})
+	server.reloader = reloader
+	server.scripts.replaceFile(scripts)
+	go server.usage.Run(context.Background(), *usageSample)
+	if err := server.janitor.AddRules(retentionRules, map[string]retention.Store{"usage": server.usage}); err != nil {
+		logrus.WithError(err).Fatal("Invalid -retention")
+	}
+	if len(retentionRules) > 0 {
+		go server.janitor.Run(context.Background(), *retentionInterval)
+	}
 	
 	server.logger.WithFields(logrus.Fields{
 		"port": *port,
 		"service": "deep-server",
 	}).Info("Starting Deep Server (OpenAI simulator)")
+	reloader.Log(server.logger)
+	reloader.ReloadOnSignal()
+	if len(scripts) > 0 {
+		server.logger.WithFields(logrus.Fields{"file": *scriptFile, "responses": len(scripts)}).Info("Responses scripted")
+	}
+	if len(scenarios) > 0 {
+		server.logger.WithFields(logrus.Fields{"file": *scenariosFile, "scenarios": len(scenarios)}).Info("Scenarios loaded")
+	}
+	if len(recordings) > 0 {
+		server.logger.WithFields(logrus.Fields{"dir": *recordingsDir, "recordings": len(recordings)}).Info("Recordings loaded")
+	}
 
 	// Add random delays to simulate real API behavior
 	rand.Seed(time.Now().UnixNano())
@@ -220,11 +3074,52 @@ func main() {
 	addr := fmt.Sprintf(":%d", *port)
 	httpServer := &http.Server{
 		Addr:           addr,
-		Handler:        server.router,
+		Handler:        buffers.Handler(reloader.Wrap(server.router)),
 		ReadTimeout:    30 * time.Second,
 		WriteTimeout:   30 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		ConnState:      server.conns.Track,
 	}
+	if *streamDuration > 0 {
+		// The write timeout covers the whole response, which would cut
+		// long streams short
+		httpServer.WriteTimeout = 0
+	}
+	buffers.Apply(httpServer)
+	version.Apply(httpServer)
 	
-	server.logger.Fatal(httpServer.ListenAndServe())
+	tcpOptions = tcpOptions.ForPlatform(server.logger)
+	ln, err := tcpOptions.Listen("tcp", addr)
+	if err != nil {
+		server.logger.WithError(err).Fatal("Failed to listen")
+	}
+	server.logger.WithFields(tcpOptions.Fields()).WithFields(buffers.Fields()).WithField("http_version", version).Info("Listener socket options")
+	if *grpcPort > 0 {
+		go server.serveGRPC(httpServer, buffers, tcpOptions, *grpcPort, *grpcCert, *grpcKey)
+	}
+	server.logger.Fatal(httpServer.Serve(ln))
+}
+
+// serveGRPC serves the API, like httpServer, over HTTP/2 with TLS on port,
+// for gRPC clients of the ChatService: Go serves HTTP/2 only over TLS.
+func (s *DeepServer) serveGRPC(httpServer *http.Server, buffers server.HTTPBuffers, tcpOptions server.TCPOptions, port int, certFile, keyFile string) {
+	tlsConfig, err := grpcapi.ServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		s.logger.WithError(err).Fatal("Invalid -grpc-cert")
+	}
+	grpcServer := &http.Server{
+		Handler:        httpServer.Handler,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    httpServer.ReadTimeout,
+		WriteTimeout:   httpServer.WriteTimeout,
+		MaxHeaderBytes: httpServer.MaxHeaderBytes,
+		ConnState:      httpServer.ConnState,
+	}
+	buffers.Apply(grpcServer)
+	ln, err := tcpOptions.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		s.logger.WithError(err).Fatal("Failed to listen for gRPC")
+	}
+	s.logger.WithField("grpc_port", port).Info("Serving gRPC ChatService")
+	s.logger.Fatal(grpcServer.ServeTLS(ln, "", ""))
 }
\ No newline at end of file
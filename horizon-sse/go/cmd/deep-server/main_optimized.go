@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"horizon-sse-go/config"
+	"horizon-sse-go/server"
 	"net/http"
 	"os"
 	"runtime"
@@ -228,8 +230,19 @@ func main() {
 		}
 	}
 	port := flag.Int("port", defaultPort, "Server port")
+	httpVersion := flag.String("http-version", string(server.HTTPAuto), "HTTP versions served: auto (HTTP/1.1, and HTTP/2 over TLS or as h2c), h1 or h2")
+	configFile := flag.String("config", "", "YAML or TOML file setting the flags not given, under deep-server (default $HORIZON_CONFIG)")
 	flag.Parse()
 
+	effective, err := config.Apply(flag.CommandLine, "deep-server", *configFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -config")
+	}
+
+	version, err := server.ParseHTTPVersion(*httpVersion)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -http-version")
+	}
 	server := NewDeepServer()
 	
 	server.logger.WithFields(logrus.Fields{
@@ -237,17 +250,19 @@ func main() {
 		"service": "deep-server",
 		"tokens":  len(server.tokens),
 	}).Info("Starting Deep Server (Optimized)")
+	effective.Log(server.logger)
 
 	// Create optimized HTTP server
 	addr := fmt.Sprintf(":%d", *port)
 	httpServer := &http.Server{
 		Addr:           addr,
-		Handler:        server.router,
+		Handler:        effective.Wrap(server.router),
 		ReadTimeout:    5 * time.Second,
 		WriteTimeout:   30 * time.Second,
 		IdleTimeout:    120 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 	
+	version.Apply(httpServer)
 	server.logger.Fatal(httpServer.ListenAndServe())
 }
\ No newline at end of file
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"math"
+	"horizon-sse-go/config"
+	"horizon-sse-go/cpuwork"
+	"horizon-sse-go/server"
 	"net/http"
 	"os"
 	"runtime"
@@ -33,6 +34,7 @@ type DeepServer struct {
 	completedStreams int64
 	tokens           []string
 	tokenResponses   [][]byte // Pre-serialized responses
+	work             *cpuwork.Worker
 }
 
 type StreamResponse struct {
@@ -55,55 +57,7 @@ type Delta struct {
 	Role    string `json:"role,omitempty"`
 }
 
-// CPU-intensive function to calculate prime numbers
-func calculatePrimes(limit int) []int {
-	if limit < 2 {
-		return []int{}
-	}
-	
-	sieve := make([]bool, limit+1)
-	for i := 2; i <= limit; i++ {
-		sieve[i] = true
-	}
-	
-	for i := 2; i*i <= limit; i++ {
-		if sieve[i] {
-			for j := i * i; j <= limit; j += i {
-				sieve[j] = false
-			}
-		}
-	}
-	
-	primes := []int{}
-	for i := 2; i <= limit; i++ {
-		if sieve[i] {
-			primes = append(primes, i)
-		}
-	}
-	return primes
-}
-
-// CPU-intensive work: calculate checksum and do prime calculation
-func performCPUWork(data string) string {
-	// Calculate SHA256 hash multiple times for CPU load
-	hash := sha256.Sum256([]byte(data))
-	for i := 0; i < 100; i++ {
-		hash = sha256.Sum256(hash[:])
-	}
-	
-	// Calculate some primes to add CPU load
-	_ = calculatePrimes(1000)
-	
-	// Do some floating point math
-	result := 0.0
-	for i := 1; i <= 100; i++ {
-		result += math.Sqrt(float64(i)) * math.Sin(float64(i))
-	}
-	
-	return fmt.Sprintf("%x", hash)
-}
-
-func NewDeepServer() *DeepServer {
+func NewDeepServer(work *cpuwork.Worker) *DeepServer {
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
@@ -132,13 +86,14 @@ func NewDeepServer() *DeepServer {
 		router: mux.NewRouter(),
 		logger: logger,
 		tokens: tokens,
+		work:   work,
 	}
 
 	// Pre-serialize token responses to avoid repeated JSON marshaling
 	s.tokenResponses = make([][]byte, len(tokens))
 	for i, token := range tokens {
 		// Perform CPU work for each token
-		checksum := performCPUWork(token + strconv.Itoa(i))
+		checksum := s.work.Checksum(token + strconv.Itoa(i))
 		
 		response := StreamResponse{
 			ID:       "chatcmpl-static",
@@ -215,7 +170,7 @@ func (s *DeepServer) handleStream(w http.ResponseWriter, r *http.Request) {
 		case <-ticker.C:
 			// Perform CPU-intensive work for each token
 			token := s.tokens[tokenIndex]
-			checksum := performCPUWork(streamID + token + strconv.Itoa(tokenIndex))
+			checksum := s.work.Checksum(streamID + token + strconv.Itoa(tokenIndex))
 			
 			// Create response with checksum
 			response := StreamResponse{
@@ -259,7 +214,7 @@ func (s *DeepServer) handleStream(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send finish message with final CPU work
-	finalChecksum := performCPUWork(streamID + "DONE")
+	finalChecksum := s.work.Checksum(streamID + "DONE")
 	finishReason := "stop"
 	finalResponse := StreamResponse{
 		ID:       streamID,
@@ -311,27 +266,50 @@ func main() {
 		}
 	}
 	port := flag.Int("port", defaultPort, "Server port")
+	cpuHash := flag.String("cpu-hash", cpuwork.SHA256, "Hash chained per token: sha256, sha512 or blake3")
+	cpuIterations := flag.Int("cpu-iterations", cpuwork.DefaultIterations, "Times each token is hashed again")
+	cpuPrimes := flag.Int("cpu-primes", cpuwork.DefaultPrimes, "Limit of the prime sieve run per token")
+	fips := flag.Bool("fips", false, "Refuse hashes that are not FIPS-approved")
+	httpVersion := flag.String("http-version", string(server.HTTPAuto), "HTTP versions served: auto (HTTP/1.1, and HTTP/2 over TLS or as h2c), h1 or h2")
+	configFile := flag.String("config", "", "YAML or TOML file setting the flags not given, under deep-server (default $HORIZON_CONFIG)")
 	flag.Parse()
 
-	server := NewDeepServer()
+	effective, err := config.Apply(flag.CommandLine, "deep-server", *configFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -config")
+	}
+
+	work, err := cpuwork.New(cpuwork.Config{Hash: *cpuHash, Iterations: *cpuIterations, Primes: *cpuPrimes, FIPS: *fips})
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid CPU work")
+	}
+	version, err := server.ParseHTTPVersion(*httpVersion)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -http-version")
+	}
+	server := NewDeepServer(work)
 	
 	server.logger.WithFields(logrus.Fields{
 		"port":    *port,
 		"service": "deep-server",
 		"tokens":  len(server.tokens),
 		"cpus":    runtime.NumCPU(),
+		"hash":    work.Hash(),
+		"fips":    *fips,
 	}).Info("Starting Deep Server (CPU-Intensive)")
+	effective.Log(server.logger)
 
 	// Create optimized HTTP server
 	addr := fmt.Sprintf(":%d", *port)
 	httpServer := &http.Server{
 		Addr:           addr,
-		Handler:        server.router,
+		Handler:        effective.Wrap(server.router),
 		ReadTimeout:    5 * time.Second,
 		WriteTimeout:   30 * time.Second,
 		IdleTimeout:    120 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 	
+	version.Apply(httpServer)
 	server.logger.Fatal(httpServer.ListenAndServe())
 }
\ No newline at end of file
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"horizon-sse-go/batch"
+	"horizon-sse-go/client"
+	"horizon-sse-go/grpcapi"
+	"horizon-sse-go/server"
+	"horizon-sse-go/websocket"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamTokensCapped(t *testing.T) {
+	if n := len(streamTokens(0)); n != len(simulatedTokens) {
+		t.Errorf("default response has %d tokens, want %d", n, len(simulatedTokens))
+	}
+	if n := len(streamTokens(10)); n != 10 {
+		t.Errorf("max_tokens 10 gave %d tokens", n)
+	}
+	if n := len(streamTokens(2000000000)); n != maxResponseTokens {
+		t.Errorf("max_tokens 2e9 gave %d tokens, want the cap %d", n, maxResponseTokens)
+	}
+}
+
+func TestDeterministicTokensCapped(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{DeterministicContent: true})
+	body := []byte(`{"max_tokens":2000000000}`)
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(string(body)))
+	tokens := s.responseTokens(httptest.NewRecorder(), r, body, 2000000000, nil)
+	if n := len(tokens.tokens); n != maxResponseTokens {
+		t.Errorf("max_tokens 2e9 gave %d tokens, want the cap %d", n, maxResponseTokens)
+	}
+}
+
+func TestScriptClear(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{})
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no body", "", 200},
+		{"match", `{"match":{"X-Test":"a"}}`, 200},
+		{"malformed", `{"match":`, 400},
+		{"wrong type", `{"match":["a"]}`, 400},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/script", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+func TestLoadScripts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "scripts.json")
+	os.WriteFile(path, []byte(`[
+		{"match": {"x-test": "a"}, "responses": [{"status": 429}, {"tokens": ["hi"]}]},
+		{"responses": [{"delay_ms": 5}]}
+	]`), 0o644)
+	entries, err := loadScripts(path)
+	if err != nil || len(entries) != 3 || entries[0].Match["X-Test"] != "a" || entries[2].Match != nil {
+		t.Errorf("got %+v, %v", entries, err)
+	}
+
+	// A reload replaces the entries of the file, not those posted
+	q := &scriptQueue{}
+	q.replaceFile(entries)
+	q.add([]ScriptEntry{{Response: ScriptedResponse{Status: 503}}})
+	if dropped := q.replaceFile(entries[2:]); dropped != 3 {
+		t.Errorf("reload dropped %d entries, want 3", dropped)
+	}
+	if pending := q.pending(); len(pending) != 2 || pending[0].File || pending[0].Response.Status != 503 || !pending[1].File {
+		t.Errorf("after reload: %+v", pending)
+	}
+
+	os.WriteFile(path, []byte(`[{"responses": [{"tokens": ["hi"]}]}, {"responses": [{"status": 200}]}]`), 0o644)
+	if _, err := loadScripts(path); err == nil || !strings.Contains(err.Error(), "script 2: invalid status 200") {
+		t.Errorf("invalid status: got %v", err)
+	}
+}
+
+// Scenarios answer the requests that name or match them with their own
+// tokens, pauses and failures.
+func TestScenarios(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "scenarios.yaml")
+	os.WriteFile(path, []byte(`
+- name: refusal
+  match: {content: "(?i)password"}
+  token_delay_ms: {dist: uniform, min: 1, max: 2}
+  tokens:
+  - " I"
+  - text: " can't"
+    delay_ms: 5
+- name: flaky
+  tokens: ["a", {error: overloaded, delay_ms: 1}]
+- name: busy
+  match:
+    headers: {x-tenant: t1}
+  status: 429
+`), 0o644)
+	scenarios, err := loadScenarios(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewDeepServer(DeepServerConfig{TimeScale: 1000, Scenarios: scenarios})
+	post := func(path, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if len(header) == 2 {
+			r.Header.Set(header[0], header[1])
+		}
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("/v1/chat/completions", `{"messages":[{"role":"user","content":"my Password is"}]}`)
+	if body := w.Body.String(); strings.Count(body, `"content"`) != 2 || !strings.Contains(body, `" can't"`) || !strings.Contains(body, "[DONE]") {
+		t.Errorf("refusal: %s", body)
+	}
+	if body := post("/v1/chat/completions?scenario=flaky", `{}`).Body.String(); !strings.Contains(body, `data: {"error":{"code":null,"message":"overloaded"`) || strings.Contains(body, "[DONE]") {
+		t.Errorf("flaky: %s", body)
+	}
+	if body := post("/v1/messages?scenario=flaky", `{}`).Body.String(); !strings.Contains(body, "event: error\ndata: {\"error\":{\"message\":\"overloaded\"") || strings.Contains(body, "message_stop") {
+		t.Errorf("flaky on messages: %s", body)
+	}
+	if w := post("/v1/messages", `{}`, "X-Tenant", "t1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("busy: %d", w.Code)
+	}
+	if w := post("/v1/chat/completions?scenario=nope", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown scenario: %d", w.Code)
+	}
+	if w := post("/v1/chat/completions", `{"max_tokens":3}`); strings.Count(w.Body.String(), `"content"`) != 3 {
+		t.Errorf("unmatched request: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics struct {
+		Scenarios map[string]int64 `json:"scenarios"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil || metrics.Scenarios["refusal"] != 1 || metrics.Scenarios["flaky"] != 2 || metrics.Scenarios["busy"] != 1 {
+		t.Errorf("metrics %s, %v", w.Body, err)
+	}
+
+	for data, want := range map[string]string{
+		`[{"name": "a", "tokens": [{"disconnect": true}, "b"]}]`: "step 1 fails the stream but is not the last",
+		`[{"name": "a", "match": {"content": "("}}]`:             "match content",
+		`[{"name": "a"}, {"name": "a"}]`:                         `scenario "a" listed twice`,
+		`[{"name": "a", "token_delay_ms": {"dist": "poisson"}}]`: "token_delay_ms: unknown dist",
+	} {
+		path := filepath.Join(dir, "bad.json")
+		os.WriteFile(path, []byte(data), 0o644)
+		if _, err := loadScenarios(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", data, err, want)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	for spec, want := range map[string]Chaos{
+		"disconnect=0.05, error=0.02:502": {Disconnect: 0.05, Error: 0.02, ErrorStatus: 502},
+		"error=1,stall=0.5,trickle=1:5ms": {Error: 1, ErrorStatus: 503, Stall: 0.5, StallFor: 30 * time.Second, Trickle: 1, TricklePause: 5 * time.Millisecond},
+		"none":                            {},
+	} {
+		if c, err := parseChaos(spec); err != nil || c != want {
+			t.Errorf("%s: %+v, %v", spec, c, err)
+		}
+	}
+	for _, spec := range []string{"stall=2", "error=1:404", "malformed=1:5ms", "stall=1:soon", "flood=0.1"} {
+		if _, err := parseChaos(spec); err == nil {
+			t.Errorf("%s parsed", spec)
+		}
+	}
+
+	s := NewDeepServer(DeepServerConfig{TimeScale: 1000, Chaos: Chaos{Error: 1, ErrorStatus: 500}})
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+	post := func(path, chaos string) (*http.Response, string, error) {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(`{"max_tokens":4}`))
+		req.Header.Set(chaosHeader, chaos)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	if resp, _, err := post("/v1/chat/completions", ""); err != nil || resp.StatusCode != 500 {
+		t.Errorf("-chaos error: %v %v", resp, err)
+	}
+	if resp, _, err := post("/v1/messages", "error=1:529"); err != nil || resp.StatusCode != 529 {
+		t.Errorf("X-Chaos error: %v %v", resp, err)
+	}
+	if resp, body, err := post("/v1/chat/completions", "stall=whenever"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid X-Chaos: %v %s %v", resp, body, err)
+	}
+	if _, body, err := post("/v1/chat/completions", "disconnect=1"); err == nil || strings.Contains(body, "[DONE]") {
+		t.Errorf("disconnect: %s, %v", body, err)
+	}
+	_, body, err := post("/v1/chat/completions", "malformed=1,stall=1:1s,trickle=1:1ms")
+	var broken int
+	for _, line := range strings.Split(body, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok && data != "[DONE]" && !json.Valid([]byte(data)) {
+			broken++
+		}
+	}
+	if err != nil || broken != 1 || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("%d malformed events: %s, %v", broken, body, err)
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics struct {
+		Chaos map[string]int64 `json:"chaos"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &metrics)
+	want := map[string]int64{"errors": 2, "disconnects": 1, "stalls": 1, "malformed": 1, "trickles": 1}
+	for kind, n := range want {
+		if metrics.Chaos[kind] != n {
+			t.Errorf("metrics %s", w.Body)
+			break
+		}
+	}
+}
+
+// Sequencing faults never hit the first chunk, which carries the role.
+func TestFirstTokenNotFaulted(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{DuplicateRate: 1, ReorderRate: 1})
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions?token_delay_ms=0", strings.NewReader(`{"max_tokens":5}`)))
+	events := strings.Split(w.Body.String(), "\n\n")
+	if !strings.HasPrefix(events[0], "id: 1\n") || !strings.Contains(events[0], `"role":"assistant"`) {
+		t.Errorf("first event is %q, want id 1 with the role", events[0])
+	}
+	if n := strings.Count(w.Body.String(), "id: 1\n"); n != 1 {
+		t.Errorf("event 1 sent %d times", n)
+	}
+	if !strings.Contains(w.Body.String(), "id: 2\n") || strings.Count(w.Body.String(), "id: 3\n") != 2 {
+		t.Errorf("later tokens were not faulted:\n%s", w.Body.String())
+	}
+}
+
+// A fetch() client gets the headers at once with ?flush_headers=true, and
+// the events as they are sent rather than at the end.
+func TestFetchStreaming(t *testing.T) {
+	const promptDelay = 500 * time.Millisecond
+	s := NewDeepServer(DeepServerConfig{PromptDelayBase: promptDelay})
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+
+	for _, path := range []string{"/v1/chat/completions", "/v1/messages"} {
+		for _, flush := range []bool{true, false} {
+			url := srv.URL + path + "?token_delay_ms=100"
+			if flush {
+				url += "&flush_headers=true"
+			}
+			start := time.Now()
+			resp, err := http.Post(url, "application/json", strings.NewReader(`{"max_tokens":5,"messages":[{"role":"user","content":"hi"}]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			headersAt := time.Since(start)
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+				t.Errorf("%s: status %d, content type %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			if flush && headersAt >= promptDelay/2 {
+				t.Errorf("%s: headers took %v with flush_headers", path, headersAt)
+			}
+			if !flush && headersAt < promptDelay {
+				t.Errorf("%s: headers after %v, before the prompt delay", path, headersAt)
+			}
+
+			br := bufio.NewReader(resp.Body)
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatalf("%s: %v before the first event", path, err)
+				}
+				if strings.HasPrefix(line, "data:") {
+					break
+				}
+			}
+			firstAt := time.Since(start)
+			rest, _ := io.ReadAll(br)
+			resp.Body.Close()
+			if done := time.Since(start); done-firstAt < 300*time.Millisecond {
+				t.Errorf("%s: first event at %v, end at %v: not streamed", path, firstAt, done)
+			}
+			if end := strings.TrimSpace(string(rest)); !strings.HasSuffix(end, "[DONE]") && !strings.Contains(end, "message_stop") {
+				t.Errorf("%s: stream ended with %q", path, end[max(0, len(end)-80):])
+			}
+		}
+	}
+}
+
+// With heartbeats on, a stream waiting on its prompt gets its headers at
+// once and pings until the first token.
+func TestHeartbeat(t *testing.T) {
+	const promptDelay = 200 * time.Millisecond
+	s := NewDeepServer(DeepServerConfig{PromptDelayBase: promptDelay, Heartbeat: 30 * time.Millisecond})
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Post(srv.URL+"/v1/chat/completions?token_delay_ms=0", "application/json", strings.NewReader(`{"max_tokens":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headersAt := time.Since(start); headersAt >= promptDelay/2 {
+		t.Errorf("headers took %v", headersAt)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(body), ": ping\n\n") || !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+		t.Errorf("got %q", body)
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics struct {
+		Heartbeats struct {
+			Sent int64 `json:"sent"`
+		} `json:"heartbeats"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil || metrics.Heartbeats.Sent == 0 {
+		t.Errorf("metrics %s, %v", w.Body, err)
+	}
+}
+
+func TestStreamCancelReason(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{})
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+	r := httptest.NewRequest("POST", "/v1/chat/completions?token_delay_ms=0", strings.NewReader(`{"max_tokens":2}`))
+	r.Header.Set("X-Stream-ID", "s1")
+	serve(r)
+
+	for _, reason := range []string{server.CancelClientGone, server.CancelSlowClient} {
+		r = httptest.NewRequest("DELETE", server.CancelPath("s1"), nil)
+		r.Header.Set(server.CancelReasonHeader, reason)
+		if w := serve(r); w.Code != http.StatusNoContent {
+			t.Fatalf("cancel: %d", w.Code)
+		}
+	}
+	if w := serve(httptest.NewRequest("DELETE", server.CancelPath("unknown"), nil)); w.Code != http.StatusNotFound {
+		t.Errorf("unknown stream: %d", w.Code)
+	}
+
+	// The first reason reported sticks
+	var rec streamRecord
+	json.Unmarshal(serve(httptest.NewRequest("GET", "/debug/streams/s1", nil)).Body.Bytes(), &rec)
+	if rec.CancelReason != server.CancelClientGone {
+		t.Errorf("record %+v", rec)
+	}
+	var metrics struct {
+		CancelReasons map[string]int64 `json:"cancel_reasons"`
+	}
+	w := serve(httptest.NewRequest("GET", "/metrics", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil || metrics.CancelReasons[server.CancelClientGone] != 1 || len(metrics.CancelReasons) != 1 {
+		t.Errorf("metrics %s, %v", w.Body, err)
+	}
+}
+
+// Each model of the catalog answers with its own length and failures, on
+// its own dialect, and is counted on its own.
+func TestModelCatalog(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{Models: []ModelProfile{
+		{Name: "small", Dialect: "openai", TokensPerSecond: 1000, OutputTokensMin: 3, OutputTokensMax: 3},
+		{Name: "flaky", ErrorRate: 1, ErrorStatus: 529},
+	}})
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+
+	w := post("/v1/chat/completions", `{"model":"small","max_tokens":50}`)
+	if n := strings.Count(w.Body.String(), `"content"`); w.Code != 200 || n != 3 || !strings.Contains(w.Body.String(), `"model":"small"`) {
+		t.Errorf("small: %d with %d tokens: %s", w.Code, n, w.Body)
+	}
+	if w := post("/v1/messages", `{"model":"small"}`); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "not_found_error") {
+		t.Errorf("small on the other dialect: %d %s", w.Code, w.Body)
+	}
+	if w := post("/v1/chat/completions", `{"model":"gpt-4-turbo"}`); w.Code != http.StatusNotFound {
+		t.Errorf("model outside the catalog: %d", w.Code)
+	}
+	if w := post("/v1/messages", `{"model":"flaky"}`); w.Code != 529 {
+		t.Errorf("flaky: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models", nil))
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 2 || list.Data[0].ID != "small" {
+		t.Errorf("models %s, %v", w.Body, err)
+	}
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics struct {
+		Models map[string]ModelStats `json:"models"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ModelStats{
+		"small": {Requests: 1, Completed: 1, Tokens: 3},
+		"flaky": {Requests: 1, Errors: 1},
+	}
+	for name, st := range want {
+		if metrics.Models[name] != st {
+			t.Errorf("%s: %+v, want %+v", name, metrics.Models[name], st)
+		}
+	}
+}
+
+func TestRequestParams(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{})
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions?token_delay_ms=0", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"model":"gpt-4o","stream":false,"max_tokens":7}`)
+	var completion client.ChatCompletion
+	if err := json.Unmarshal(w.Body.Bytes(), &completion); err != nil || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("non-streamed: %d %s: %v", w.Code, w.Body, err)
+	}
+	if completion.Object != "chat.completion" || completion.Model != "gpt-4o" || len(completion.Choices) != 1 ||
+		completion.Choices[0].Message.Content != strings.Join(simulatedTokens[:7], "") ||
+		completion.Usage == nil || completion.Usage.CompletionTokens != 7 {
+		t.Errorf("non-streamed: %s", w.Body)
+	}
+
+	w = post(`{"model":"gpt-4o-mini","stream":true,"max_completion_tokens":4}`)
+	if n := strings.Count(w.Body.String(), `"content"`); n != 4 || !strings.Contains(w.Body.String(), `"model":"gpt-4o-mini"`) {
+		t.Errorf("streamed with %d tokens: %s", n, w.Body)
+	}
+	if w := post(`{"max_tokens":2}`); !strings.Contains(w.Body.String(), `"model":"gpt-4-turbo"`) || !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("without a model: %s", w.Body)
+	}
+}
+
+func TestUnaryEndpoints(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{EmbeddingDimensions: 8})
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+
+	var embeddings struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Model string `json:"model"`
+	}
+	w := post("/v1/embeddings", `{"input":["a cat","a dog","a cat"]}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &embeddings); err != nil || w.Code != 200 || len(embeddings.Data) != 3 {
+		t.Fatalf("embeddings: %d %s", w.Code, w.Body)
+	}
+	if embeddings.Model != "text-embedding-3-small" || len(embeddings.Data[0].Embedding) != 8 {
+		t.Errorf("embeddings: %s", w.Body)
+	}
+	var norm float64
+	for _, v := range embeddings.Data[0].Embedding {
+		norm += v * v
+	}
+	if norm < 0.99 || norm > 1.01 {
+		t.Errorf("squared norm %v", norm)
+	}
+	if a, b := embeddings.Data[0].Embedding, embeddings.Data[2].Embedding; a[0] != b[0] || a[0] == embeddings.Data[1].Embedding[0] {
+		t.Errorf("same input, different vectors, or different input, same vector")
+	}
+	w = post("/v1/embeddings", `{"input":"x","dimensions":4,"encoding_format":"base64"}`)
+	if !strings.Contains(w.Body.String(), `"embedding":"`) {
+		t.Errorf("base64: %s", w.Body)
+	}
+	for _, body := range []string{`{"input":[]}`, `{"input":"x","dimensions":100000}`, `{}`} {
+		if w := post("/v1/embeddings", body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_request_error") {
+			t.Errorf("%s: %d %s", body, w.Code, w.Body)
+		}
+	}
+
+	w = post("/v1/moderations", `{"input":["have a nice day","threats of violence"]}`)
+	var moderations struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &moderations); err != nil || len(moderations.Results) != 2 {
+		t.Fatalf("moderations: %d %s", w.Code, w.Body)
+	}
+	if moderations.Results[0].Flagged || !moderations.Results[1].Categories["violence"] {
+		t.Errorf("moderations: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics struct {
+		Unary map[string]UnaryStats `json:"unary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if st := metrics.Unary["embeddings"]; st.Requests != 2 || st.Inputs != 4 || st.Bytes == 0 {
+		t.Errorf("embeddings stats %+v", st)
+	}
+
+	// A configured catalog decides which models are served here too
+	s = NewDeepServer(DeepServerConfig{Models: []ModelProfile{{Name: "embed-small", Dialect: "openai"}}})
+	if w := post("/v1/embeddings", `{"model":"embed-small","input":"x"}`); w.Code != 200 {
+		t.Errorf("catalog model: %d %s", w.Code, w.Body)
+	}
+	if w := post("/v1/embeddings", `{"input":"x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("default model outside the catalog: %d", w.Code)
+	}
+}
+
+// uploadBatchFile uploads lines as a batch input file and returns its ID.
+func uploadBatchFile(t *testing.T, s *DeepServer, lines ...string) string {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", "batch")
+	part, _ := form.CreateFormFile("file", "input.jsonl")
+	io.WriteString(part, strings.Join(lines, "\n")+"\n")
+	form.Close()
+	r := httptest.NewRequest("POST", "/v1/files", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	var file batch.FileObject
+	if err := json.Unmarshal(w.Body.Bytes(), &file); err != nil || w.Code != 200 || file.Purpose != "batch" {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	return file.ID
+}
+
+// waitBatch polls a batch until it has finished.
+func waitBatch(t *testing.T, s *DeepServer, id string) batch.Batch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/batches/"+id, nil))
+		var b batch.Batch
+		if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil {
+			t.Fatalf("batch: %d %s", w.Code, w.Body)
+		}
+		switch b.Status {
+		case "completed", "failed", "cancelled":
+			return b
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batch still %s", b.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{TimeScale: 1000, Models: []ModelProfile{
+		{Name: "small", Dialect: "openai", OutputTokensMin: 3, OutputTokensMax: 3},
+	}})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	file := uploadBatchFile(t, s,
+		`{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"small","messages":[]}}`,
+		`{"custom_id":"b","method":"POST","url":"/v1/chat/completions","body":{"model":"large","messages":[]}}`,
+	)
+	w := do("POST", "/v1/batches", `{"input_file_id":"`+file+`","endpoint":"/v1/chat/completions","completion_window":"24h"}`)
+	var created batch.Batch
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != 200 {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	b := waitBatch(t, s, created.ID)
+	if b.Status != "completed" || b.RequestCounts != (batch.Counts{Total: 2, Completed: 1, Failed: 1}) || b.OutputFileID == nil || b.ErrorFileID == nil {
+		t.Fatalf("batch %+v", b)
+	}
+	w = do("GET", "/v1/files/"+*b.OutputFileID+"/content", "")
+	var result struct {
+		CustomID string `json:"custom_id"`
+		Response struct {
+			StatusCode int `json:"status_code"`
+			Body       struct {
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			} `json:"body"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.CustomID != "a" || result.Response.Body.Choices[0].Message.Content != "Hello there!" {
+		t.Errorf("output: %s", w.Body)
+	}
+	if w := do("GET", "/v1/files/"+*b.ErrorFileID+"/content", ""); !strings.Contains(w.Body.String(), `"status_code":404`) {
+		t.Errorf("errors: %s", w.Body)
+	}
+
+	if st := s.batches.Stats(); st.Completed != 1 || st.Requests != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{})
+	r := httptest.NewRequest("OPTIONS", "/v1/chat/completions", nil)
+	r.Header.Set("Origin", "http://localhost:3000")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "content-type,authorization")
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Headers") != "content-type,authorization" ||
+		!strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "POST") {
+		t.Errorf("preflight: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{})
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+
+	for _, dialect := range []string{"openai", "anthropic"} {
+		conn, _, err := websocket.Dial(context.Background(), srv.URL+"/ws?token_delay_ms=1&dialect="+dialect, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteText([]byte(`{"max_tokens":5,"messages":[{"role":"user","content":"hi"}]}`)); err != nil {
+			t.Fatal(err)
+		}
+		r := websocket.NewEventReader(conn)
+		body, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+		end := strings.TrimSpace(string(body))
+		if dialect == "openai" && !strings.HasSuffix(end, "data: [DONE]") ||
+			dialect == "anthropic" && !strings.Contains(end, "event: message_stop") {
+			t.Errorf("%s: stream ended with %q", dialect, end[max(0, len(end)-80):])
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	s := NewDeepServer(DeepServerConfig{})
+	srv := httptest.NewUnstartedServer(s.router)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The call is read back as the SSE stream it bridges
+	client := &http.Client{Transport: &grpcapi.SSETransport{Base: srv.Client().Transport}}
+	resp, err := client.Post(srv.URL+"/v1/chat/completions?token_delay_ms=1", "application/json",
+		strings.NewReader(`{"max_tokens":5,"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(body), `"content":`); n != 5 || !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+		t.Errorf("%d content chunks in:\n%s", n, body)
+	}
+}
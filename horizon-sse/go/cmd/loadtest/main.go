@@ -1,44 +1,456 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"horizon-sse-go/artifact"
 	"horizon-sse-go/client"
+	"horizon-sse-go/config"
+	"horizon-sse-go/history"
+	"horizon-sse-go/objstore"
+	"horizon-sse-go/server"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		os.Exit(runHistory(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		os.Exit(runTrace(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "overhead" {
+		os.Exit(runOverhead(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "protocols" {
+		os.Exit(runProtocols(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "parity" {
+		os.Exit(runParity(os.Args[2:]))
+	}
+
 	serverURL := flag.String("url", "http://localhost:10080", "Server URL")
 	numClients := flag.Int("clients", 1000, "Number of concurrent clients")
 	rampUp := flag.Duration("rampup", 10*time.Second, "Ramp-up time for spawning clients")
 	monitorInterval := flag.Duration("monitor", 2*time.Second, "Metrics monitoring interval")
+	scenarioFile := flag.String("scenario", "", "Scenario file with per-client parameter distributions (JSON)")
+	controlAddr := flag.String("control", "", "Address for the control interface (e.g. :9090); disabled if empty")
+	clientTimeout := flag.Duration("client-timeout", 20*time.Second, "Deadline for each client, counted from its own start")
+	abortBound := flag.Duration("abort-bound", 2*time.Second, "How soon an early-disconnect client's upstream stream must end after it hangs up")
+	historyDir := flag.String("history", "", "Directory of the run registry to append this run's summary to; disabled if empty")
+	direct := flag.Bool("direct", false, "Send completion requests straight to the deep server at -url, bypassing the proxy, as a baseline for the proxy's overhead")
+	transport := flag.String("transport", "sse", "How clients receive their streams: sse, or ws for WebSocket frames from the server's /ws")
+	httpVersion := flag.String("http-version", string(server.HTTPAuto), "HTTP versions clients speak: auto (HTTP/2 over TLS, HTTP/1.1 otherwise), h1, or h2 (h2c on http URLs)")
+	anomalyWindow := flag.Duration("anomaly-window", client.DefaultAnomalyConfig.Window, "Window the anomaly detector measures failure rate, disconnect rate and TTFB over; 0 disables it")
+	anomalyThreshold := flag.Float64("anomaly-threshold", client.DefaultAnomalyConfig.Threshold, "How many times its recent baseline a rate must reach to be reported as an anomaly")
+	anomalyWebhook := flag.String("anomaly-webhook", "", "URL to POST each anomaly to as JSON; disabled if empty")
+	upload := flag.String("upload", "", "Upload test-results.json, and the scenario, to s3://BUCKET/PREFIX or gs://BUCKET/PREFIX, with credentials from the environment ({host} in the prefix is the host name); disabled if empty")
+	configFile := flag.String("config", "", "YAML or TOML file setting the flags not given, under loadtest (default $HORIZON_CONFIG)")
 	flag.Parse()
 
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
+	effective, err := config.Apply(flag.CommandLine, "loadtest", *configFile)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -config")
+	}
+	effective.Log(logger)
+	var bucket *objstore.Bucket
+	if *upload != "" {
+		var err error
+		if bucket, err = objstore.Open(*upload); err != nil {
+			logger.WithError(err).Fatal("Invalid -upload")
+		}
+	}
+	if *transport != "sse" && *transport != "ws" {
+		logger.WithField("transport", *transport).Fatal("Unknown -transport (want sse or ws)")
+	}
+	version, err := server.ParseHTTPVersion(*httpVersion)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -http-version")
+	}
 
 	logger.WithFields(logrus.Fields{
 		"server_url":       *serverURL,
 		"num_clients":      *numClients,
 		"ramp_up_time":     *rampUp,
 		"monitor_interval": *monitorInterval,
+		"transport":        *transport,
+		"http_version":     version,
 	}).Info("Starting load test")
 
 	sseClient := client.NewSSEClient(*serverURL)
+	sseClient.SetLogger(logger)
+	sseClient.SetClientTimeout(*clientTimeout)
+	sseClient.SetAbortBound(*abortBound)
+	sseClient.SetDirect(*direct)
+	sseClient.SetWebSocket(*transport == "ws")
+	if version != server.HTTPAuto {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		version.ApplyTransport(t)
+		sseClient.SetTransport(t)
+	}
+
+	if *anomalyWindow > 0 {
+		sseClient.SetAnomalyDetector(client.NewAnomalyDetector(client.AnomalyConfig{
+			Window:    *anomalyWindow,
+			Threshold: *anomalyThreshold,
+			Webhook:   *anomalyWebhook,
+		}, logger))
+	}
+
+	var scenario *client.Scenario
+	if *scenarioFile != "" {
+		sc, err := client.LoadScenario(*scenarioFile)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load scenario")
+		}
+		scenario = sc
+		sseClient.SetScenario(scenario)
+	}
+
+	// An interrupt aborts the run, which still reports the clients spawned
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	go sseClient.MonitorMetrics(*monitorInterval, 20*time.Second+*rampUp)
+	monitorCtx, stopMonitor := context.WithTimeout(ctx, 20*time.Second+*rampUp)
+	defer stopMonitor()
+	go sseClient.MonitorMetrics(monitorCtx, *monitorInterval)
 
 	fmt.Println("\n" + strings.Repeat("=", 80))
 	fmt.Printf("LOAD TEST: %d concurrent SSE clients over %v\n", *numClients, *rampUp)
 	fmt.Printf("Server: %s\n", *serverURL)
-	fmt.Printf("Each client will receive ~100 messages over 10 seconds\n")
+	if *direct {
+		fmt.Printf("Direct: requests go straight to the deep server, bypassing the proxy\n")
+	}
+	if *transport == "ws" {
+		fmt.Printf("Transport: WebSocket\n")
+	}
+	if version != server.HTTPAuto {
+		fmt.Printf("HTTP version: %s\n", version)
+	}
+	if scenario != nil {
+		fmt.Printf("Scenario: %s (randomized per-client parameters)\n", scenario.Name)
+	} else {
+		fmt.Printf("Each client will receive ~100 messages over 10 seconds\n")
+	}
 	fmt.Println(strings.Repeat("=", 80) + "\n")
 
-	sseClient.RunLoadTest(*numClients, *rampUp)
+	if *controlAddr != "" {
+		go func() {
+			logger.WithField("addr", *controlAddr).Info("Control interface listening")
+			if err := http.ListenAndServe(*controlAddr, effective.Wrap(sseClient.ControlHandler())); err != nil {
+				logger.WithError(err).Error("Control interface stopped")
+			}
+		}()
+	}
+
+	started := time.Now()
+	summary, err := sseClient.RunLoadTest(ctx, *numClients, *rampUp)
+	if ctx.Err() != nil {
+		// A partial run is no baseline for later ones
+		logger.Warn("Load test interrupted, not recorded")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Fatal("Load test failed")
+	}
+
+	if bucket != nil {
+		uploadResults(bucket, "loadtest-"+started.Format("20060102-150405"), *scenarioFile, logger)
+	}
+
+	if *historyDir != "" {
+		if hash, err := recordRun(*historyDir, summary, scenario, *numClients, *rampUp, *direct, *transport); err != nil {
+			logger.WithError(err).Error("Failed to record run in history")
+		} else {
+			logger.WithField("dir", *historyDir).Info("Run recorded in history")
+			// Once the registry has a run of the other kind, report
+			// what the proxy costs
+			runs, err := history.Store{Dir: *historyDir}.Load()
+			if err == nil {
+				if overhead, err := history.NewOverhead(runs, hash); err == nil {
+					fmt.Println()
+					overhead.Render(os.Stdout)
+				}
+				// and, once it has a run over another HTTP version,
+				// what the protocol changes
+				if protocols, err := history.NewProtocolComparison(runs, hash); err == nil {
+					fmt.Println()
+					protocols.Render(os.Stdout)
+				}
+			}
+		}
+	}
+
+	if *controlAddr != "" {
+		// Give /events subscribers a chance to see the final phase
+		time.Sleep(time.Second)
+	}
+}
+
+// uploadResults uploads test-results.json, and the scenario file if the
+// run had one, as name/ and their base names.
+func uploadResults(bucket *objstore.Bucket, name, scenarioFile string, logger *logrus.Logger) {
+	files := []string{"test-results.json"}
+	if scenarioFile != "" {
+		files = append(files, scenarioFile)
+	}
+	for _, file := range files {
+		key := name + "/" + filepath.Base(file)
+		if err := bucket.Upload(context.Background(), key, file); err != nil {
+			logger.WithError(err).Error("Failed to upload results")
+			return
+		}
+	}
+	logger.WithField("location", bucket.Location(name)).Info("Results uploaded")
+}
+
+// recordRun appends the run to the registry and returns its scenario hash.
+// The hash covers the client count, ramp-up and scenario, so only runs of
+// the same shape are compared; direct runs share it with proxied ones to be
+// paired with them, as do runs over other HTTP versions. WebSocket runs
+// have a shape of their own, leaving the hashes of SSE runs as they were.
+func recordRun(dir string, summary client.RunSummary, scenario *client.Scenario, clients int, rampUp time.Duration, direct bool, transport string) (string, error) {
+	if transport == "sse" {
+		transport = ""
+	}
+	shape := struct {
+		Clients   int              `json:"clients"`
+		RampUp    string           `json:"rampup"`
+		Scenario  *client.Scenario `json:"scenario,omitempty"`
+		Transport string           `json:"transport,omitempty"`
+	}{clients, rampUp.String(), scenario, transport}
+	hash, err := history.ScenarioHash(shape)
+	if err != nil {
+		return "", err
+	}
+
+	rec := history.Record{
+		Time:     time.Now(),
+		Build:    history.CurrentBuild(),
+		Scenario: hash,
+		Metrics:  summary.Metrics(),
+	}
+	if scenario != nil {
+		rec.ScenarioName = scenario.Name
+	}
+	if direct {
+		rec.Mode = history.ModeDirect
+	}
+	rec.Protocol = summary.Protocol
+	return hash, history.Store{Dir: dir}.Append(rec)
+}
+
+// runHistory implements "loadtest history": it renders a metric's trend
+// over recent runs and can fail when the latest run drifted too far.
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	dir := fs.String("dir", "loadtest-history", "Run registry directory")
+	metric := fs.String("metric", "ttfb_p95_ms", "Metric to show")
+	last := fs.Int("last", 30, "Number of most recent runs to show")
+	scenario := fs.String("scenario", "", "Scenario hash to show (default: that of the latest run)")
+	failDrift := fs.Float64("fail-drift", 0, "Exit 1 if the latest run is worse than the baseline by more than this percentage (0 disables)")
+	fs.Parse(args)
+
+	runs, err := history.Store{Dir: *dir}.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	trend, err := history.NewTrend(runs, *metric, *scenario, *last)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *dir, err)
+		return 2
+	}
+	trend.Render(os.Stdout)
+
+	if *failDrift > 0 && trend.Regressed(*failDrift) {
+		fmt.Printf("\n%s regressed by more than %.1f%%\n", *metric, *failDrift)
+		return 1
+	}
+	return 0
+}
+
+// runOverhead implements "loadtest overhead": it compares the latest runs
+// of a scenario through the proxy and direct to the deep server.
+func runOverhead(args []string) int {
+	fs := flag.NewFlagSet("overhead", flag.ExitOnError)
+	dir := fs.String("dir", "loadtest-history", "Run registry directory")
+	scenario := fs.String("scenario", "", "Scenario hash to compare (default: that of the latest run)")
+	fs.Parse(args)
+
+	runs, err := history.Store{Dir: *dir}.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	overhead, err := history.NewOverhead(runs, *scenario)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *dir, err)
+		return 2
+	}
+	overhead.Render(os.Stdout)
+	return 0
+}
+
+// runProtocols implements "loadtest protocols": it compares the latest
+// runs of a scenario over each HTTP version.
+func runProtocols(args []string) int {
+	fs := flag.NewFlagSet("protocols", flag.ExitOnError)
+	dir := fs.String("dir", "loadtest-history", "Run registry directory")
+	scenario := fs.String("scenario", "", "Scenario hash to compare (default: that of the latest run)")
+	fs.Parse(args)
+
+	runs, err := history.Store{Dir: *dir}.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	protocols, err := history.NewProtocolComparison(runs, *scenario)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *dir, err)
+		return 2
+	}
+	protocols.Render(os.Stdout)
+	return 0
+}
+
+// runParity implements "loadtest parity": it sends the same requests to
+// the Go and Node.js implementations and reports where their streams
+// differ, exiting 1 if they do.
+func runParity(args []string) int {
+	fs := flag.NewFlagSet("parity", flag.ExitOnError)
+	goURL := fs.String("go", "http://localhost:10080", "Go endpoint")
+	nodeURL := fs.String("node", "http://localhost:10090", "Node.js endpoint")
+	direct := fs.Bool("direct", false, "Compare deep servers with completion requests instead of proxies with /sse")
+	requests := fs.Int("requests", 10, "Requests sent to each endpoint")
+	concurrency := fs.Int("concurrency", 5, "Requests in flight at once per endpoint")
+	scenarioFile := fs.String("scenario", "", "Scenario file to draw each request's parameters from (default: the servers' defaults)")
+	contentCheck := fs.String("content", "exact", "How to compare the streamed text: exact, length or off")
+	tolerance := fs.Float64("timing-tolerance", 0.25, "Relative difference in a timing percentile reported as a divergence")
+	slack := fs.Duration("timing-slack", 5*time.Millisecond, "Timing differences below this are never divergences")
+	fs.Parse(args)
+
+	content, err := client.ParseContentCheck(*contentCheck)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *requests < 1 || *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-requests and -concurrency must be at least 1")
+		return 2
+	}
+	params := make([]client.ClientParams, *requests)
+	if *scenarioFile != "" {
+		sc, err := client.LoadScenario(*scenarioFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		rng := sc.NewRand()
+		for i := range params {
+			params[i] = sc.Draw(rng)
+			// Both sides must read their streams to the end
+			params[i].DisconnectAfter = 0
+		}
+	}
+
+	targets := [2]*client.SSEClient{client.NewSSEClient(*goURL), client.NewSSEClient(*nodeURL)}
+	for _, c := range targets {
+		c.SetDirect(*direct)
+	}
+	// Each request goes to both sides at once, so they stream under the
+	// same load
+	captures := [2][]client.StreamCapture{make([]client.StreamCapture, *requests), make([]client.StreamCapture, *requests)}
+	sem := make(chan struct{}, 2**concurrency)
+	var wg sync.WaitGroup
+	for i := range params {
+		for side, c := range targets {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i, side int, c *client.SSEClient) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				captures[side][i] = c.Capture(ctx, params[i])
+			}(i, side, c)
+		}
+	}
+	wg.Wait()
+
+	report := client.ParityReport{Names: [2]string{"go", "node"}, Requests: *requests}
+	for i := range params {
+		report.Divergences = append(report.Divergences, client.CompareCaptures(i+1, params[i], captures[0][i], captures[1][i], content)...)
+	}
+	report.Timing = client.CompareTiming(captures[0], captures[1], *tolerance, *slack)
+	report.Render(os.Stdout)
+	if report.Diverged() {
+		return 1
+	}
+	return 0
+}
+
+// runTrace implements "loadtest trace": it reads a stream from a proxy
+// running with -trace-events, live from a URL or captured in a file,
+// compressed or not, and reports where its events spent their time.
+func runTrace(args []string) int {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	url := fs.String("url", "", "Stream to capture live, e.g. http://localhost:10080/sse (also reports delivery to this client)")
+	fs.Parse(args)
+
+	var traces []server.EventTrace
+	var err error
+	switch {
+	case *url != "":
+		var resp *http.Response
+		if resp, err = http.Get(*url); err != nil {
+			break
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s: %s", *url, resp.Status)
+			break
+		}
+		traces, err = server.ReadTrace(resp.Body, time.Now)
+	case fs.NArg() == 1 && fs.Arg(0) == "-":
+		traces, err = server.ReadTrace(os.Stdin, nil)
+	case fs.NArg() == 1:
+		var f io.ReadCloser
+		if f, err = artifact.Open(fs.Arg(0)); err != nil {
+			break
+		}
+		defer f.Close()
+		traces, err = server.ReadTrace(f, nil)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: loadtest trace -url URL | loadtest trace FILE (- for stdin)")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	report := server.TraceReport(traces)
+	if len(report) == 0 {
+		fmt.Fprintln(os.Stderr, "no traced events; is the proxy running with -trace-events?")
+		return 1
+	}
+	server.RenderTraceReport(os.Stdout, report)
+	return 0
 }
 
 var strings = struct {
@@ -0,0 +1,479 @@
+// Command orchestrator runs a complete benchmark locally: it builds and
+// starts the deep server and proxy, waits for both to be ready, runs the
+// load test against the proxy, and collects logs, metrics and profiles of
+// all three into one results directory, which it can upload to object
+// storage.
+//
+//	orchestrator -clients 500 -scenario scenarios/mixed.json -out results/mixed
+//	orchestrator -upload s3://bench-results/{host}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"horizon-sse-go/artifact"
+	settings "horizon-sse-go/config"
+	"horizon-sse-go/history"
+	"horizon-sse-go/objstore"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// binaries are built from these sources, relative to the module root.
+var binaries = map[string]string{
+	"deep-server":  "cmd/deep-server/main.go",
+	"proxy-server": "cmd/proxy-server/main.go",
+	"loadtest":     "./cmd/loadtest",
+}
+
+// Manifest describes a run; it is written to manifest.json in the results
+// directory.
+type Manifest struct {
+	Build        history.Build     `json:"build"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Clients      int               `json:"clients"`
+	RampUp       string            `json:"rampup"`
+	Scenario     string            `json:"scenario,omitempty"`
+	Commands     map[string]string `json:"commands"`
+	LoadtestExit int               `json:"loadtest_exit"`
+	Artifacts    []string          `json:"artifacts"`
+	// Upload is where the results directory is uploaded to, if anywhere.
+	Upload string   `json:"upload,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type config struct {
+	out          string
+	bin          string
+	deepPort     int
+	proxyPort    int
+	deepPprof    int
+	proxyPprof   int
+	clients      int
+	rampUp       time.Duration
+	scenario     string
+	deepArgs     []string
+	proxyArgs    []string
+	loadtestArgs []string
+	readyTimeout time.Duration
+	sample       time.Duration
+	cpuProfile   time.Duration
+	compress     bool
+	upload       string
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.out, "out", "", "Results directory (default: results/<timestamp>)")
+	flag.StringVar(&cfg.bin, "bin", "", "Directory with prebuilt deep-server, proxy-server and loadtest binaries (default: build them into the results directory)")
+	flag.IntVar(&cfg.deepPort, "deep-port", 10081, "Deep server port")
+	flag.IntVar(&cfg.proxyPort, "proxy-port", 10080, "Proxy port")
+	flag.IntVar(&cfg.deepPprof, "deep-pprof-port", 6061, "Port the deep server serves pprof on")
+	flag.IntVar(&cfg.proxyPprof, "proxy-pprof-port", 6062, "Port the proxy serves pprof on")
+	flag.IntVar(&cfg.clients, "clients", 1000, "Number of load test clients")
+	flag.DurationVar(&cfg.rampUp, "rampup", 10*time.Second, "Load test ramp-up time")
+	flag.StringVar(&cfg.scenario, "scenario", "", "Load test scenario file (JSON)")
+	deepArgs := flag.String("deep-args", "", "Extra deep server flags, space-separated")
+	proxyArgs := flag.String("proxy-args", "", "Extra proxy flags, space-separated")
+	loadtestArgs := flag.String("loadtest-args", "", "Extra load test flags, space-separated")
+	flag.DurationVar(&cfg.readyTimeout, "ready-timeout", 30*time.Second, "How long to wait for each server's /health")
+	flag.DurationVar(&cfg.sample, "sample", 2*time.Second, "Interval between /metrics samples of both servers (0 takes only the final ones)")
+	flag.DurationVar(&cfg.cpuProfile, "cpu-profile", 20*time.Second, "Length of the CPU profile taken of each server once the load test starts, which waits for it (0 disables)")
+	flag.BoolVar(&cfg.compress, "compress", true, "Compress the logs, metrics samples and load test results with zstd, as <name>"+artifact.Ext)
+	flag.StringVar(&cfg.upload, "upload", "", "Upload the results directory to s3://BUCKET/PREFIX or gs://BUCKET/PREFIX, with credentials from the environment ({host} in the prefix is the host name); disabled if empty")
+	configFile := flag.String("config", "", "YAML or TOML file setting the flags not given, under orchestrator; the servers and load test it starts read their sections too (default $HORIZON_CONFIG)")
+	flag.Parse()
+
+	effective, err := settings.Apply(flag.CommandLine, "orchestrator", *configFile)
+	if err == nil && effective.File != "" {
+		// The processes run in the results directory
+		var path string
+		if path, err = filepath.Abs(effective.File); err == nil {
+			err = os.Setenv(settings.FileEnv, path)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "orchestrator: invalid -config:", err)
+		os.Exit(2)
+	}
+	cfg.deepArgs = strings.Fields(*deepArgs)
+	cfg.proxyArgs = strings.Fields(*proxyArgs)
+	cfg.loadtestArgs = strings.Fields(*loadtestArgs)
+	if cfg.out == "" {
+		cfg.out = filepath.Join("results", time.Now().Format("20060102-150405"))
+	}
+
+	code, err := run(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "orchestrator:", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+// run performs the benchmark and returns the load test's exit code. Errors
+// collecting artifacts are recorded in the manifest rather than failing
+// the run.
+func run(cfg config) (int, error) {
+	if err := os.MkdirAll(cfg.out, 0755); err != nil {
+		return 2, err
+	}
+	out, err := filepath.Abs(cfg.out)
+	if err != nil {
+		return 2, err
+	}
+	scenario := cfg.scenario
+	if scenario != "" {
+		if scenario, err = filepath.Abs(scenario); err != nil {
+			return 2, err
+		}
+	}
+
+	// Bad credentials fail the run before it starts, not after
+	var bucket *objstore.Bucket
+	if cfg.upload != "" {
+		if bucket, err = objstore.Open(cfg.upload); err != nil {
+			return 2, err
+		}
+	}
+
+	bin := cfg.bin
+	if bin == "" {
+		bin = filepath.Join(out, "bin")
+		if err := build(bin); err != nil {
+			return 2, err
+		}
+	}
+
+	m := &Manifest{
+		Build:    history.CurrentBuild(),
+		Started:  time.Now(),
+		Clients:  cfg.clients,
+		RampUp:   cfg.rampUp.String(),
+		Scenario: cfg.scenario,
+		Commands: make(map[string]string),
+	}
+	var errMu sync.Mutex
+	note := func(err error) {
+		errMu.Lock()
+		m.Errors = append(m.Errors, err.Error())
+		errMu.Unlock()
+	}
+
+	deepURL := fmt.Sprintf("http://localhost:%d", cfg.deepPort)
+	proxyURL := fmt.Sprintf("http://localhost:%d", cfg.proxyPort)
+	deepPprof := fmt.Sprintf("localhost:%d", cfg.deepPprof)
+	proxyPprof := fmt.Sprintf("localhost:%d", cfg.proxyPprof)
+
+	// Ctrl-C stops the run but still collects what there is
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	deep, err := start(m, out, cfg.compress, filepath.Join(bin, "deep-server"), append([]string{
+		"-port", fmt.Sprint(cfg.deepPort), "-pprof", deepPprof,
+	}, cfg.deepArgs...)...)
+	if err != nil {
+		return 2, err
+	}
+	defer deep.stop()
+	if err := waitReady(ctx, deepURL, cfg.readyTimeout); err != nil {
+		return 2, fmt.Errorf("deep-server: %w (see %s)", err, deep.logName)
+	}
+
+	proxy, err := start(m, out, cfg.compress, filepath.Join(bin, "proxy-server"), append([]string{
+		"-port", fmt.Sprint(cfg.proxyPort), "-deep-server", deepURL, "-pprof", proxyPprof,
+	}, cfg.proxyArgs...)...)
+	if err != nil {
+		return 2, err
+	}
+	defer proxy.stop()
+	if err := waitReady(ctx, proxyURL, cfg.readyTimeout); err != nil {
+		return 2, fmt.Errorf("proxy-server: %w (see %s)", err, proxy.logName)
+	}
+
+	targets := map[string]string{"deep": deepURL, "proxy": proxyURL}
+	sampleCtx, stopSampling := context.WithCancel(ctx)
+	defer stopSampling()
+	var wg sync.WaitGroup
+	if cfg.sample > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sampleMetrics(sampleCtx, filepath.Join(out, "metrics.jsonl"), cfg.compress, targets, cfg.sample); err != nil {
+				note(err)
+			}
+		}()
+	}
+	if cfg.cpuProfile > 0 {
+		for name, addr := range map[string]string{"deep": deepPprof, "proxy": proxyPprof} {
+			wg.Add(1)
+			go func(name, addr string) {
+				defer wg.Done()
+				url := fmt.Sprintf("http://%s/debug/pprof/profile?seconds=%d", addr, int(cfg.cpuProfile.Seconds()))
+				if err := fetch(ctx, url, filepath.Join(out, name+"-cpu.pprof")); err != nil {
+					note(err)
+				}
+			}(name, addr)
+		}
+	}
+
+	args := []string{"-url", proxyURL, "-clients", fmt.Sprint(cfg.clients), "-rampup", cfg.rampUp.String()}
+	if scenario != "" {
+		args = append(args, "-scenario", scenario)
+	}
+	lt, err := start(m, out, cfg.compress, filepath.Join(bin, "loadtest"), append(args, cfg.loadtestArgs...)...)
+	if err != nil {
+		return 2, err
+	}
+	go func() {
+		<-ctx.Done()
+		lt.cmd.Process.Signal(os.Interrupt)
+	}()
+	lt.cmd.Wait()
+	lt.log.Close()
+	m.LoadtestExit = lt.cmd.ProcessState.ExitCode()
+	if cfg.compress {
+		if err := artifact.CompressFile(filepath.Join(out, "test-results.json")); err != nil {
+			note(err)
+		}
+	}
+
+	stopSampling()
+	wg.Wait()
+	for name, url := range targets {
+		for _, path := range []string{"metrics", "usage"} {
+			if err := fetch(context.Background(), url+"/"+path, filepath.Join(out, fmt.Sprintf("%s-%s.json", name, path))); err != nil {
+				note(err)
+			}
+		}
+	}
+	for name, addr := range map[string]string{"deep": deepPprof, "proxy": proxyPprof} {
+		for _, profile := range []string{"heap", "goroutine", "allocs"} {
+			url := fmt.Sprintf("http://%s/debug/pprof/%s", addr, profile)
+			if err := fetch(context.Background(), url, filepath.Join(out, fmt.Sprintf("%s-%s.pprof", name, profile))); err != nil {
+				note(err)
+			}
+		}
+	}
+	deep.stop()
+	proxy.stop()
+
+	m.Finished = time.Now()
+	if bucket != nil {
+		m.Upload = bucket.Location(filepath.Base(out))
+	}
+	if err := writeManifest(out, m); err != nil {
+		return m.LoadtestExit, err
+	}
+	fmt.Printf("Results in %s\n", out)
+	if bucket != nil {
+		names, err := bucket.UploadDir(context.Background(), filepath.Base(out), out, func(name string) bool { return name == "bin" })
+		if err != nil {
+			return m.LoadtestExit, err
+		}
+		fmt.Printf("Uploaded %d artifacts to %s\n", len(names), m.Upload)
+	}
+	return m.LoadtestExit, nil
+}
+
+// build compiles the binaries into dir, from the module in the working
+// directory.
+func build(dir string) error {
+	for name, src := range binaries {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(dir, name), src)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("building %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+type process struct {
+	cmd     *exec.Cmd
+	log     io.WriteCloser
+	logName string
+	once    sync.Once
+}
+
+// start runs a binary in the results directory with its output going to
+// <name>.log there, compressed if compress is set; the load test's also
+// goes to stdout.
+func start(m *Manifest, dir string, compress bool, path string, args ...string) (*process, error) {
+	name := filepath.Base(path)
+	logName := name + ".log"
+	if compress {
+		logName += artifact.Ext
+	}
+	log, err := artifact.Create(filepath.Join(dir, name+".log"), compress)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = log, log
+	if name == "loadtest" {
+		cmd.Stdout = io.MultiWriter(log, os.Stdout)
+		cmd.Stderr = cmd.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		log.Close()
+		return nil, fmt.Errorf("starting %s: %w", name, err)
+	}
+	m.Commands[name] = strings.Join(append([]string{path}, args...), " ")
+	return &process{cmd: cmd, log: log, logName: logName}, nil
+}
+
+// stop asks the process to shut down and kills it if it has not within
+// ten seconds.
+func (p *process) stop() {
+	p.once.Do(func() {
+		p.cmd.Process.Signal(syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() {
+			p.cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			p.cmd.Process.Kill()
+			<-done
+		}
+		p.log.Close()
+	})
+}
+
+// waitReady polls url's /health until it answers 200.
+func waitReady(ctx context.Context, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		req, _ := http.NewRequestWithContext(ctx, "GET", url+"/health", nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %v", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch saves the body of a GET of url to path.
+func fetch(ctx context.Context, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: status %d", url, resp.StatusCode)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("fetching %s: %w", url, err)
+	}
+	return f.Close()
+}
+
+// sampleMetrics appends a line {"time","service","metrics"} to path for
+// each target every interval until ctx is done.
+func sampleMetrics(ctx context.Context, path string, compress bool, targets map[string]string, interval time.Duration) error {
+	f, err := artifact.Create(path, compress)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			for name, url := range targets {
+				metrics, err := getJSON(ctx, url+"/metrics")
+				if err != nil {
+					if errors.Is(err, context.Canceled) {
+						return nil
+					}
+					continue
+				}
+				enc.Encode(struct {
+					Time    time.Time       `json:"time"`
+					Service string          `json:"service"`
+					Metrics json.RawMessage `json:"metrics"`
+				}{now, name, metrics})
+			}
+		}
+	}
+}
+
+func getJSON(ctx context.Context, url string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("%s: not JSON", url)
+	}
+	return body, nil
+}
+
+// writeManifest lists the files in dir, other than the binaries, and
+// writes m to manifest.json.
+func writeManifest(dir string, m *Manifest) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			m.Artifacts = append(m.Artifacts, e.Name())
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "manifest.json"), data, 0644)
+}
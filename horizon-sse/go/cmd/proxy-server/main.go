@@ -1,250 +1,98 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
+	"horizon-sse-go/artifact"
+	"horizon-sse-go/audit"
+	"horizon-sse-go/config"
+	"horizon-sse-go/grpcapi"
+	"horizon-sse-go/handoff"
+	"horizon-sse-go/objstore"
+	"horizon-sse-go/proxy"
+	"horizon-sse-go/retention"
+	"horizon-sse-go/server"
+	"horizon-sse-go/streamio"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"sync"
-	"sync/atomic"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
-type ProxyServer struct {
-	router            *mux.Router
-	logger            *logrus.Logger
-	deepServerURL     string
-	activeConnections int64
-	totalConnections  int64
-	proxiedMessages   int64
-	failedConnections int64
-	bufferPool        sync.Pool
-}
-
-func NewProxyServer(deepServerURL string) *ProxyServer {
-	logger := logrus.New()
-	logger.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-	})
-
-	s := &ProxyServer{
-		router:        mux.NewRouter(),
-		logger:        logger,
-		deepServerURL: deepServerURL,
-		bufferPool: sync.Pool{
-			New: func() interface{} {
-				return new(bytes.Buffer)
-			},
-		},
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
 	}
-
-	s.setupRoutes()
-	return s
+	return out
 }
 
-func (s *ProxyServer) setupRoutes() {
-	s.router.HandleFunc("/sse", s.handleSSEProxy).Methods("GET")
-	s.router.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
-	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
-}
+// upstreamFlags is the repeatable -upstream flag.
+type upstreamFlags []proxy.Upstream
 
-func (s *ProxyServer) handleSSEProxy(w http.ResponseWriter, r *http.Request) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		atomic.AddInt64(&s.failedConnections, 1)
-		return
-	}
-
-	clientID := r.URL.Query().Get("client_id")
-	if clientID == "" {
-		clientID = fmt.Sprintf("proxy-client-%d", time.Now().UnixNano())
-	}
-
-	atomic.AddInt64(&s.activeConnections, 1)
-	atomic.AddInt64(&s.totalConnections, 1)
-	defer atomic.AddInt64(&s.activeConnections, -1)
-
-	s.logger.WithFields(logrus.Fields{
-		"client_id":          clientID,
-		"active_connections": atomic.LoadInt64(&s.activeConnections),
-	}).Info("Client connected to proxy")
-
-	// Set SSE headers
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("X-Accel-Buffering", "no")
-
-	// Create request to deep server
-	reqBody := map[string]interface{}{
-		"model": "gpt-4-turbo",
-		"messages": []map[string]string{
-			{"role": "user", "content": "Generate test response"},
-		},
-		"stream": true,
-	}
-
-	jsonBody, _ := json.Marshal(reqBody)
-	deepReq, err := http.NewRequestWithContext(r.Context(), "POST", 
-		fmt.Sprintf("%s/v1/chat/completions", s.deepServerURL), 
-		bytes.NewReader(jsonBody))
-	
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to create deep server request")
-		http.Error(w, "Failed to connect to deep server", http.StatusInternalServerError)
-		atomic.AddInt64(&s.failedConnections, 1)
-		return
-	}
-
-	deepReq.Header.Set("Content-Type", "application/json")
-
-	// Make request to deep server with timeout for 10 second streams
-	client := &http.Client{
-		Timeout: 20 * time.Second,
+func (f *upstreamFlags) String() string {
+	specs := make([]string, len(*f))
+	for i, u := range *f {
+		specs[i] = fmt.Sprintf("%s=%s,weight=%d", u.Name, u.URL, u.Weight)
 	}
+	return strings.Join(specs, "; ")
+}
 
-	resp, err := client.Do(deepReq)
+func (f *upstreamFlags) Set(spec string) error {
+	u, err := proxy.ParseUpstream(spec)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to connect to deep server")
-		http.Error(w, "Failed to connect to deep server", http.StatusBadGateway)
-		atomic.AddInt64(&s.failedConnections, 1)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		s.logger.WithField("status", resp.StatusCode).Error("Deep server returned error")
-		http.Error(w, "Deep server error", http.StatusBadGateway)
-		atomic.AddInt64(&s.failedConnections, 1)
-		return
+		return err
 	}
+	*f = append(*f, u)
+	return nil
+}
 
-	// Buffer and forward the stream
-	scanner := bufio.NewScanner(resp.Body)
-	buffer := s.bufferPool.Get().(*bytes.Buffer)
-	defer func() {
-		buffer.Reset()
-		s.bufferPool.Put(buffer)
-	}()
-
-	messageCount := 0
-	lastFlush := time.Now()
-	flushInterval := 50 * time.Millisecond // Batch messages for efficiency
+func (f *upstreamFlags) IsRepeatable() {}
+func (f *upstreamFlags) Reset()        { *f = nil }
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		
-		// Write to buffer
-		buffer.WriteString(line)
-		buffer.WriteString("\n")
+// routeFlags is the repeatable -route flag.
+type routeFlags []proxy.Route
 
-		// Check for complete SSE message
-		if line == "" || time.Since(lastFlush) > flushInterval {
-			// Flush buffered data to client
-			if buffer.Len() > 0 {
-				_, err := w.Write(buffer.Bytes())
-				if err != nil {
-					s.logger.WithFields(logrus.Fields{
-						"client_id": clientID,
-						"error":     err,
-					}).Error("Failed to write to client")
-					atomic.AddInt64(&s.failedConnections, 1)
-					return
-				}
-				flusher.Flush()
-				
-				if line != "" && line != "data: [DONE]" {
-					messageCount++
-					atomic.AddInt64(&s.proxiedMessages, 1)
-				}
-				
-				buffer.Reset()
-				lastFlush = time.Now()
-			}
+func (f *routeFlags) String() string {
+	specs := make([]string, len(*f))
+	for i, r := range *f {
+		match := "model:" + r.Model
+		if r.Path != "" {
+			match = "path:" + r.Path
 		}
-
-		// Check if stream is complete
-		if line == "data: [DONE]" {
-			// Write the [DONE] message to buffer first
-			buffer.WriteString(line)
-			buffer.WriteString("\n")
-			break
-		}
-	}
-
-	// Final flush
-	if buffer.Len() > 0 {
-		w.Write(buffer.Bytes())
-		flusher.Flush()
-	}
-
-	if err := scanner.Err(); err != nil {
-		s.logger.WithError(err).Error("Error reading from deep server")
-		atomic.AddInt64(&s.failedConnections, 1)
-		return
+		specs[i] = match + "=" + strings.Join(r.Upstreams, ",")
 	}
-
-	s.logger.WithFields(logrus.Fields{
-		"client_id":      clientID,
-		"message_count":  messageCount,
-	}).Info("Proxy stream completed")
+	return strings.Join(specs, "; ")
 }
 
-func (s *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	// Get deep server metrics
-	deepMetrics := make(map[string]interface{})
-	resp, err := http.Get(fmt.Sprintf("%s/metrics", s.deepServerURL))
-	if err == nil {
-		defer resp.Body.Close()
-		json.NewDecoder(resp.Body).Decode(&deepMetrics)
+func (f *routeFlags) Set(spec string) error {
+	r, err := proxy.ParseRoute(spec)
+	if err != nil {
+		return err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{
-		"proxy": {
-			"active_connections": %d,
-			"total_connections": %d,
-			"proxied_messages": %d,
-			"failed_connections": %d
-		},
-		"deep_server": %s,
-		"timestamp": "%s"
-	}`,
-		atomic.LoadInt64(&s.activeConnections),
-		atomic.LoadInt64(&s.totalConnections),
-		atomic.LoadInt64(&s.proxiedMessages),
-		atomic.LoadInt64(&s.failedConnections),
-		func() string {
-			if len(deepMetrics) > 0 {
-				data, _ := json.Marshal(deepMetrics)
-				return string(data)
-			}
-			return "{}"
-		}(),
-		time.Now().Format(time.RFC3339),
-	)
+	*f = append(*f, r)
+	return nil
 }
 
-func (s *ProxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	// Check deep server health
-	deepHealthy := false
-	resp, err := http.Get(fmt.Sprintf("%s/health", s.deepServerURL))
-	if err == nil {
-		defer resp.Body.Close()
-		deepHealthy = resp.StatusCode == http.StatusOK
-	}
+func (f *routeFlags) IsRepeatable() {}
+func (f *routeFlags) Reset()        { *f = nil }
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"status": "healthy", "service": "proxy-server", "deep_server_healthy": %v}`, deepHealthy)
+// reloadableFlags set what a running proxy takes again on SIGHUP or POST
+// /admin/reload: its routing table and rate limits.
+var reloadableFlags = []string{
+	"deep-server", "upstream", "route", "balance",
+	"conn-rate", "conn-burst", "conn-rate-per-ip", "conn-burst-per-ip",
+	"batch-rate-limit", "batch-burst",
 }
 
 func main() {
@@ -262,25 +110,540 @@ func main() {
 	
 	port := flag.Int("port", defaultPort, "Proxy server port")
 	deepServerURL := flag.String("deep-server", defaultDeepURL, "Deep server URL")
+	pumpBuffer := flag.Int("pump-buffer", 64, "Upstream events buffered per client before the upstream reader stalls")
+	slowClient := flag.String("slow-client", string(streamio.OverflowBlock), "What a stream does once its client falls -pump-buffer events behind: block, drop-oldest, drop-newest or disconnect")
+	writeDeadline := flag.Duration("write-deadline", 30*time.Second, "Longest a single write or flush to a client may take before it is disconnected (0 disables)")
+	maxLineBytes := flag.Int("max-line-bytes", proxy.DefaultMaxLineBytes, "Longest upstream line accepted; longer ones end the stream with an error")
+	maxRequestBytes := flag.Int64("max-request-bytes", proxy.DefaultMaxRequestBytes, "Largest chat request a client may POST to /sse, or body of an embeddings or moderations call, to have forwarded upstream")
+	batchRateLimit := flag.Float64("batch-rate-limit", 0, "Batch API calls (/v1/files, /v1/batches) each tenant may make a second; beyond it they get 429 (0 disables)")
+	batchBurst := flag.Int("batch-burst", 0, "Batch API calls a tenant may make at once under -batch-rate-limit (0 for a second's worth)")
+	batchMaxUpload := flag.Int64("batch-max-upload", proxy.DefaultBatchMaxUploadBytes, "Largest file a client may upload to /v1/files for a batch")
+	apiKeys := flag.String("api-keys", "", "Comma-separated [NAME=]KEY API keys streams and API calls must carry as a bearer token or X-API-Key (empty disables)")
+	apiKeysFile := flag.String("api-keys-file", "", "File of [NAME=]KEY lines, read again when it changes, instead of -api-keys")
+	jwksURL := flag.String("jwt-jwks-url", "", "JWKS URL of the keys JWT bearer tokens are signed with; streams and API calls must carry a valid token (empty disables)")
+	jwksRefresh := flag.Duration("jwt-jwks-refresh", proxy.DefaultJWKSRefresh, "How often the JWKS is fetched again")
+	jwtIssuer := flag.String("jwt-issuer", "", "Issuer (iss) tokens must have (empty accepts any)")
+	jwtAudience := flag.String("jwt-audience", "", "Audience (aud) tokens must include (empty accepts any)")
+	jwtTenantClaim := flag.String("jwt-tenant-claim", "tenant", "Claim naming the tenant of a token")
+	jwtUserClaim := flag.String("jwt-user-claim", "sub", "Claim naming the user of a token, forwarded upstream as X-User-Id")
+	jwtMaxStreams := flag.Int("jwt-max-streams", 0, "Streams and API calls each tenant may have open at once (0 for no limit)")
+	jwtMessagesPerMinute := flag.Int64("jwt-messages-per-minute", 0, "Messages each tenant may be streamed a minute before its new requests get 429 (0 for no limit)")
+	logPayloads := flag.Bool("log-payloads", false, "Log the JSON body of each stream request and API call, with prompts redacted by -payload-redaction")
+	payloadRedaction := flag.String("payload-redaction", string(audit.ModeHash), "How logged prompts are redacted: hash, truncate[:N], drop or full")
+	payloadFields := flag.String("payload-redaction-fields", strings.Join(audit.DefaultFields, ","), "Comma-separated prompt fields of a payload to redact, as dotted paths")
+	var upstreams upstreamFlags
+	flag.Var(&upstreams, "upstream", "Named backend NAME=URL[,weight=N] to route streams to instead of -deep-server (repeatable)")
+	var routes routeFlags
+	flag.Var(&routes, "route", "Send streams matching model:PATTERN or path:PATTERN to some upstreams, e.g. model:claude-*=a,b (repeatable, first match wins)")
+	node := flag.String("node", "", "Name of this proxy in its cluster; enables affinity cookies so reconnects return to the node holding their replay buffer")
+	peers := flag.String("peers", "", "Other proxy nodes of the cluster as NAME=URL pairs, e.g. p1=http://10.0.0.1:10080,p2=http://10.0.0.2:10080")
+	affinityMode := flag.String("affinity", proxy.AffinityForward, "How requests with another node's cookie reach it: forward (proxy them) or redirect (307)")
+	balance := flag.String("balance", proxy.BalanceRoundRobin, "How streams are spread over the upstreams of a route: round-robin, least-active or weighted")
+	healthInterval := flag.Duration("health-interval", 0, "How often each upstream's health is checked; failing ones leave the rotation (0 disables)")
+	healthTimeout := flag.Duration("health-timeout", proxy.DefaultHealthCheck.Timeout, "Timeout of an upstream health check")
+	healthPath := flag.String("health-path", proxy.DefaultHealthCheck.Path, "Path polled on each upstream for its health")
+	unhealthyAfter := flag.Int("unhealthy-after", proxy.DefaultHealthCheck.UnhealthyThreshold, "Failed health checks in a row that take an upstream out of rotation")
+	healthyAfter := flag.Int("healthy-after", proxy.DefaultHealthCheck.HealthyThreshold, "Passed health checks in a row that put an upstream back in rotation")
+	earlyFlush := flag.String("early-flush", proxy.EarlyFlushOff, "Open /sse streams before the upstream answers, with a notice: off, comment or event (a \"meta\" event)")
+	bodyMemory := flag.Int64("body-memory", proxy.DefaultBodyMemory, "Bytes of a POSTed request kept in memory while its stream runs; larger ones spill to a temp file")
+	bodySpoolDir := flag.String("body-spool-dir", "", "Directory for request bodies spilled to disk (default the system temp directory)")
+	upstreamRetries := flag.Int("upstream-retries", 0, "Times a stream's upstream request is sent again when it fails to connect or gets a 502, 503 or 504")
+	retryBackoff := flag.Duration("retry-backoff", proxy.DefaultRetryBackoff, "Wait before the first upstream retry, doubled for each one after")
+	upstreamProtocol := flag.String("upstream-protocol", proxy.UpstreamSSE, "How streams are requested from the upstreams: sse, or grpc to call their gRPC ChatService (https URLs) and serve it as SSE")
+	upstreamInsecureTLS := flag.Bool("upstream-insecure-tls", false, "Skip verifying the certificates of https upstreams, such as a deep server's self-signed -grpc-port one")
+	grpcPort := flag.Int("grpc-port", 0, "Also serve /sse to gRPC ChatService clients, over HTTP/2 with TLS on this port (0 disables)")
+	grpcCert := flag.String("grpc-cert", "", "Certificate file of the -grpc-port listener (a self-signed one for localhost if empty)")
+	grpcKey := flag.String("grpc-key", "", "Key file of -grpc-cert")
+	coalesceWindow := flag.Duration("coalesce-window", 0, "Share one upstream request among identical /sse requests arriving within this long of the first (0 disables)")
+	eventIDs := flag.String("event-ids", "passthrough", "Event ID strategy (monotonic, snowflake, passthrough), optionally per route: passthrough,/sse=monotonic")
+	nodeID := flag.Int64("node-id", 0, "Node ID embedded in snowflake event IDs")
+	metricsInterval := flag.Duration("metrics-interval", 2*time.Second, "Interval between /metrics/stream snapshots")
+	forwardHeaders := flag.String("forward-headers", "strip", "Upstream response headers to pass on: strip, forward, or a list like x-request-id,x-ratelimit-*")
+	forwardTrailers := flag.String("forward-trailers", "strip", "Upstream trailers to pass on: strip, forward, or a list like x-usage-*")
+	migrateTo := flag.String("migrate-to", "", "Comma-separated addresses clients are advised to reconnect to when this proxy drains")
+	migrateDiscovery := flag.String("migrate-discovery", "", "URL returning a JSON array of reconnect addresses, queried when draining")
+	rechunk := flag.String("rechunk", "none", "Regroup streamed text (none, markdown), optionally per route: none,/sse=markdown")
+	sequencing := flag.String("sequencing", "off", "Check that upstream event ids count up by one: off, flag (count violations) or repair (also reorder and drop duplicates)")
+	sequencingWindow := flag.Int("sequencing-window", 8, "Events held back in repair mode waiting for a missing id before giving up on it")
+	rechunkMaxHold := flag.Int("rechunk-max-hold", 2048, "Bytes of text held back waiting for a markdown-safe boundary before it is sent anyway")
+	upstreamErrors := flag.String("upstream-errors", "gateway", "How upstream error statuses reach clients (gateway, generic, passthrough, sse), optionally per route: generic,/sse=sse")
+	var redactions []string
+	flag.Func("redact", "Extra regexp scrubbed from upstream error bodies in passthrough mode (repeatable)", func(expr string) error {
+		redactions = append(redactions, expr)
+		return nil
+	})
+	upstreamTypes := flag.String("upstream-content-types", "text/event-stream", "Comma-separated media types accepted from the deep server; other responses fail with 502")
+	patchSnapshotEvery := flag.Int("patch-snapshot-every", 50, "Patches between full snapshots for ?format=patch clients (0 sends snapshots only at the start and end)")
+	migrateJitter := flag.Duration("migrate-jitter", 5*time.Second, "Upper bound of the random reconnect delay advised to each client")
+	maxConnections := flag.Int("max-connections", 0, "Client streams served at once; more get a 503 (0 means unlimited)")
+	connectionQueue := flag.Int("connection-queue", 0, "Streams past -max-connections that wait for a slot instead of getting a 503 at once")
+	connectionQueueTimeout := flag.Duration("connection-queue-timeout", proxy.DefaultConnectionQueueTimeout, "Longest a queued stream waits before it gets a 503")
+	connRate := flag.Float64("conn-rate", 0, "New streams accepted a second; more get a 429 with a retry hint (0 disables)")
+	connBurst := flag.Int("conn-burst", 0, "New streams accepted at once under -conn-rate (0 for a second's worth)")
+	connRatePerIP := flag.Float64("conn-rate-per-ip", 0, "New streams accepted a second from each client address (0 disables)")
+	connBurstPerIP := flag.Int("conn-burst-per-ip", 0, "New streams accepted at once from an address under -conn-rate-per-ip (0 for a second's worth)")
+	maxUpstreamInFlight := flag.Int("max-upstream-inflight", 0, "Requests open to the deep server at once; more get a 503 (0 means unlimited)")
+	memoryBudget := flag.Int64("memory-budget-mb", 0, "Memory the proxy should stay within, reported on /capacity (0 means unlimited)")
+	targetStreams := flag.Float64("target-streams", 0, "Active streams per instance /autoscale scales toward (0 leaves it out)")
+	targetQueueDepth := flag.Float64("target-queue-depth", 0, "Queued upstream events per instance /autoscale scales toward (0 leaves it out)")
+	targetShedRate := flag.Float64("target-shed-rate", 0, "Refused streams per second per instance /autoscale scales toward (0 leaves it out)")
+	usageSample := flag.Duration("usage-sample", time.Second, "Interval between samples attributing CPU time to streams for /usage")
+	wattsPerCore := flag.Float64("watts-per-core", 0, "Power draw of one busy core, to estimate energy on /usage (0 leaves it out)")
+	replaySize := flag.Int("replay-size", 0, "Events kept per client with a client_id, to resume with Last-Event-ID (0 disables)")
+	replayTTL := flag.Duration("replay-ttl", server.DefaultReplayTTL, "How long a client's events are kept after its last one")
+	replayMemory := flag.Int64("replay-memory", 0, "Bytes of a client's replay buffer kept in memory; older events spill to disk (0 keeps them all in memory)")
+	replaySpillDir := flag.String("replay-spill-dir", "", "Directory for replay buffers spilled to disk (default the system temp directory)")
+	retentionSpec := flag.String("retention", "", "Retention of stored data as CLASS[@DIR]=AGE[:SIZE] entries, e.g. sessions=10m,usage=7d,recordings@/var/lib/horizon/results=30d:20GB; classes other than sessions and usage need a directory")
+	retentionInterval := flag.Duration("retention-interval", time.Minute, "Interval between the janitor's passes over -retention")
+	idleLeakAfter := flag.Duration("idle-leak-after", server.DefaultIdleLeakAfter, "Idle time after which /metrics counts a keep-alive connection as leaked")
+	httpBuffers := flag.String("http-buffers", "", "Response buffer sizes: write=SIZE collects each response's writes until a flush, h2-frame=SIZE sets the HTTP/2 frame size")
+	httpVersion := flag.String("http-version", string(server.HTTPAuto), "HTTP versions served: auto (HTTP/1.1, and HTTP/2 over TLS or as h2c with prior knowledge), h1 to force HTTP/1.1, or h2")
+	tcpSpec := flag.String("tcp", "", "Socket options of accepted connections, e.g. nodelay=false,sndbuf=64KB,rcvbuf=64KB,keepalive=30s,keepalive-interval=10s,keepalive-count=3,reuseport=true")
+	unixSocket := flag.String("unix-socket", "", "Also serve on a unix socket at this path, e.g. for a sidecar on the same host")
+	slowFlush := flag.Duration("slow-flush", server.DefaultSlowFlush, "Flush duration past which a flush to a client is logged and counted as slow")
+	heartbeat := flag.Duration("heartbeat", 0, "Send a \": ping\" comment to /sse clients idle for this long (0 disables)")
+	traceEvents := flag.Bool("trace-events", false, "Stamp each event on /sse with its pipeline timings in SSE comments, for `loadtest trace`")
+	reportCancellations := flag.Bool("report-cancellations", false, "Tell the deep server why the proxy cancelled a stream, with a DELETE of /v1/streams/{id}")
+	pprofAddr := flag.String("pprof", "", "Address to serve net/http/pprof on (e.g. localhost:6061); disabled if empty")
+	drainTimeout := flag.Duration("drain-timeout", 60*time.Second, "How long to let active streams finish on shutdown or handoff")
+	logFormat := flag.String("log-format", "text", "Format of the logs: text, or json for ingestion by ELK or Loki")
+	accessLogPath := flag.String("access-log", "", "File to write a line per request to, apart from the logs, e.g. /var/log/horizon/access.log (- for stdout, empty disables)")
+	accessLogFormat := flag.String("access-log-format", proxy.AccessLogCombined, "Format of -access-log: common, combined or json")
+	accessLogMaxSize := flag.String("access-log-max-size", "100MB", "Size past which -access-log is rotated (0 never)")
+	accessLogMaxAge := flag.Duration("access-log-max-age", 24*time.Hour, "Age past which -access-log is rotated (0 never)")
+	latencySpec := flag.String("latency", "", "Artificial delay on each /sse event before it is written to the client: fixed:50ms, uniform:20ms-80ms or pareto:10ms,shape=1.5[,max=2s] (empty disables)")
+	recordDir := flag.String("record", "", "Directory to record upstream /sse streams to, with their event timing, for a deep server's -recordings to replay (empty disables)")
+	recordRate := flag.Float64("record-rate", 1, "Fraction of /sse streams -record records")
+	recordCompress := flag.Bool("record-compress", true, "Compress recordings with zstd, as <stream id>.sse.jsonl"+artifact.Ext)
+	recordUpload := flag.String("record-upload", "", "Bucket to upload each recording to once its stream ends, s3://bucket/prefix or gs://bucket/prefix (credentials from the environment)")
+	preflightMode := flag.String("preflight", config.PreflightFail, "Check the settings, ports and upstream DNS before serving and print the results: fail (stop on a failed check), warn or off")
+	configFile := flag.String("config", "", "YAML or TOML file setting the flags not given, under proxy (default $HORIZON_CONFIG)")
 	flag.Parse()
 
-	server := NewProxyServer(*deepServerURL)
+	effective, err := config.Apply(flag.CommandLine, "proxy", *configFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -config")
+	}
+
+	formatter, err := server.ParseLogFormat(*logFormat)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -log-format")
+	}
+	logrus.SetFormatter(formatter)
+	var accessLog io.Writer
+	switch *accessLogPath {
+	case "":
+	case "-":
+		accessLog = os.Stdout
+	default:
+		maxSize, err := server.ParseSize(*accessLogMaxSize)
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid -access-log-max-size")
+		}
+		if accessLog, err = server.OpenRotatingFile(*accessLogPath, int64(maxSize), *accessLogMaxAge); err != nil {
+			logrus.WithError(err).Fatal("Invalid -access-log")
+		}
+	}
+	latency, err := proxy.ParseLatency(*latencySpec)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -latency")
+	}
+	var recordBucket *objstore.Bucket
+	if *recordUpload != "" {
+		if recordBucket, err = objstore.Open(*recordUpload); err != nil {
+			logrus.WithError(err).Fatal("Invalid -record-upload")
+		}
+	}
+	idRoutes, err := server.ParseEventIDRoutes(*eventIDs, server.EventIDPassthrough)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -event-ids")
+	}
+	tcpOptions, err := server.ParseTCPOptions(*tcpSpec)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -tcp")
+	}
+	buffers, err := server.ParseHTTPBuffers(*httpBuffers)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -http-buffers")
+	}
+	version, err := server.ParseHTTPVersion(*httpVersion)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -http-version")
+	}
+	if *pprofAddr != "" {
+		if err := server.ServePprof(*pprofAddr); err != nil {
+			logrus.WithError(err).Fatal("Invalid -pprof")
+		}
+	}
+	if err := server.SetSnowflakeNodeID(*nodeID); err != nil {
+		logrus.WithError(err).Fatal("Invalid -node-id")
+	}
+	peerURLs, err := proxy.ParsePeers(*peers)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -peers")
+	}
+	if err := config.CheckPreflightMode(*preflightMode); err != nil {
+		logrus.WithError(err).Fatal("Invalid -preflight")
+	}
+	if *preflightMode != config.PreflightOff {
+		checks := &config.Preflight{}
+		// Listeners handed off by the previous process hold their ports
+		listen := func(name string, port int) {
+			switch addr := fmt.Sprintf(":%d", port); {
+			case handoff.Inheriting():
+				checks.OK(name, addr+" taken over from the previous process")
+			case tcpOptions.ReusePort:
+				checks.OK(name, addr+" shared with SO_REUSEPORT")
+			default:
+				checks.Port(name, addr)
+			}
+		}
+		listen("port", *port)
+		if *grpcPort > 0 {
+			listen("grpc port", *grpcPort)
+			checks.Pair("grpc tls", "grpc-cert", *grpcCert, "grpc-key", *grpcKey)
+		} else if *grpcCert != "" || *grpcKey != "" {
+			checks.Warn("grpc tls", "-grpc-cert and -grpc-key have no effect without -grpc-port")
+		}
+		if len(upstreams) == 0 {
+			checks.Resolve("deep server", *deepServerURL)
+		}
+		for _, u := range upstreams {
+			checks.Resolve("upstream "+u.Name, u.URL)
+		}
+		for name, peerURL := range peerURLs {
+			if name != *node {
+				checks.Resolve("peer "+name, peerURL)
+			}
+		}
+		if *jwksURL != "" {
+			checks.Resolve("jwks", *jwksURL)
+		}
+		switch {
+		case *replaySize == 0 && (*replayMemory > 0 || *replaySpillDir != ""):
+			checks.Fail("replay", "-replay-memory or -replay-spill-dir is set but -replay-size is 0, so nothing is kept; set -replay-size")
+		case *replaySize == 0 && *node != "":
+			checks.Warn("replay", "-node sends reconnects back to this node for their replay buffer, but -replay-size is 0")
+		case *replayMemory > 0:
+			checks.Dir("replay spill dir", *replaySpillDir)
+		case *replaySize > 0:
+			checks.OK("replay", fmt.Sprintf("%d events per client, in memory", *replaySize))
+		}
+		if *bodySpoolDir != "" {
+			checks.Dir("body spool dir", *bodySpoolDir)
+		}
+		if *recordDir != "" {
+			checks.Dir("record dir", *recordDir)
+		} else if *recordUpload != "" {
+			checks.Warn("record upload", "-record-upload has no effect without -record")
+		}
+		if *connectionQueue > 0 && *maxConnections == 0 {
+			checks.Warn("connection queue", "-connection-queue has no effect without -max-connections")
+		}
+		if (*connBurst > 0 && *connRate == 0) || (*connBurstPerIP > 0 && *connRatePerIP == 0) {
+			checks.Warn("connection rate", "-conn-burst and -conn-burst-per-ip have no effect without -conn-rate and -conn-rate-per-ip")
+		}
+		if *healthInterval > 0 && *healthTimeout >= *healthInterval {
+			checks.Warn("health checks", "-health-timeout is not shorter than -health-interval, so checks may overlap")
+		}
+		checks.Print(os.Stderr)
+		if err := checks.Err(); err != nil {
+			if *preflightMode == config.PreflightFail {
+				logrus.WithError(err).Fatal("Startup checks failed; see the table above, or start with -preflight warn to serve anyway")
+			}
+			logrus.WithError(err).Warn("Startup checks failed; serving anyway")
+		}
+	}
+	keys, err := loadAPIKeys(*apiKeys, *apiKeysFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -api-keys")
+	}
+	var jwt *proxy.JWTAuth
+	if *jwksURL != "" {
+		jwt, err = proxy.NewJWTAuth(proxy.JWTConfig{
+			JWKSURL:           *jwksURL,
+			Refresh:           *jwksRefresh,
+			Issuer:            *jwtIssuer,
+			Audience:          *jwtAudience,
+			TenantClaim:       *jwtTenantClaim,
+			UserClaim:         *jwtUserClaim,
+			MaxStreams:        *jwtMaxStreams,
+			MessagesPerMinute: *jwtMessagesPerMinute,
+		})
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid -jwt-jwks-url")
+		}
+	}
+	redaction, err := audit.ParsePolicy(*payloadRedaction, *payloadFields)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -payload-redaction")
+	}
+	balancer, err := proxy.NewBalancer(*balance)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -balance")
+	}
+	rechunkRoutes, err := server.ParseRechunkRoutes(*rechunk)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -rechunk")
+	}
+	errorRoutes, err := server.ParseUpstreamErrorRoutes(*upstreamErrors)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -upstream-errors")
+	}
+	redactor, err := server.NewRedactor(redactions...)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -redact")
+	}
+	retentionRules, err := retention.ParseRules(*retentionSpec)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -retention")
+	}
+	var p *proxy.Proxy
+	reloader, err := config.NewReloader(flag.CommandLine, effective, reloadableFlags, func() error {
+		balancer, err := proxy.NewBalancer(*balance)
+		if err != nil {
+			return err
+		}
+		return p.Reload(proxy.Reloadable{
+			DeepServerURL:        *deepServerURL,
+			Upstreams:            upstreams,
+			Routes:               routes,
+			Balancer:             balancer,
+			ConnectionRate:       *connRate,
+			ConnectionBurst:      *connBurst,
+			ConnectionRatePerIP:  *connRatePerIP,
+			ConnectionBurstPerIP: *connBurstPerIP,
+			BatchRateLimit:       *batchRateLimit,
+			BatchBurst:           *batchBurst,
+		})
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -config")
+	}
+
+	logger := logrus.New()
+	logger.SetFormatter(formatter)
+	p, err = proxy.New(proxy.Options{
+		Logger:              logger,
+		DeepServerURL:       *deepServerURL,
+		PumpBufferSize:      *pumpBuffer,
+		SlowClientPolicy:    streamio.Overflow(*slowClient),
+		WriteDeadline:       *writeDeadline,
+		MaxLineBytes:        *maxLineBytes,
+		MaxRequestBytes:     *maxRequestBytes,
+		BatchRateLimit:      *batchRateLimit,
+		BatchBurst:          *batchBurst,
+		BatchMaxUploadBytes: *batchMaxUpload,
+		APIKeys:             keys,
+		JWT:                 jwt,
+		LogPayloads:         *logPayloads,
+		PayloadRedaction:    redaction,
+		CoalesceWindow:      *coalesceWindow,
+		Upstreams:           upstreams,
+		Routes:              routes,
+		Balancer:            balancer,
+		HealthCheck: proxy.HealthCheck{
+			Interval:           *healthInterval,
+			Timeout:            *healthTimeout,
+			Path:               *healthPath,
+			UnhealthyThreshold: *unhealthyAfter,
+			HealthyThreshold:   *healthyAfter,
+		},
+		Node:                   *node,
+		Peers:                  peerURLs,
+		Affinity:               *affinityMode,
+		EarlyFlush:             *earlyFlush,
+		BodyMemory:             *bodyMemory,
+		BodySpoolDir:           *bodySpoolDir,
+		UpstreamRetries:        *upstreamRetries,
+		RetryBackoff:           *retryBackoff,
+		UpstreamProtocol:       *upstreamProtocol,
+		UpstreamInsecureTLS:    *upstreamInsecureTLS,
+		EventIDs:               idRoutes,
+		MetricsInterval:        *metricsInterval,
+		ForwardHeaders:         proxy.ParseHeaderPolicy(*forwardHeaders),
+		ForwardTrailers:        proxy.ParseHeaderPolicy(*forwardTrailers),
+		PatchSnapshotEvery:     *patchSnapshotEvery,
+		UpstreamTypes:          splitList(*upstreamTypes),
+		UpstreamErrors:         errorRoutes,
+		Redactor:               redactor,
+		MaxConnections:         *maxConnections,
+		ConnectionQueue:        *connectionQueue,
+		ConnectionQueueTimeout: *connectionQueueTimeout,
+		ConnectionRate:         *connRate,
+		ConnectionBurst:        *connBurst,
+		ConnectionRatePerIP:    *connRatePerIP,
+		ConnectionBurstPerIP:   *connBurstPerIP,
+		MaxUpstreamInFlight:    *maxUpstreamInFlight,
+		MemoryBudget:           *memoryBudget << 20,
+		Autoscale: server.AutoscaleTargets{
+			ActiveStreams: *targetStreams,
+			QueueDepth:    *targetQueueDepth,
+			ShedRate:      *targetShedRate,
+		},
+		WattsPerCore:        *wattsPerCore,
+		Rechunk:             rechunkRoutes,
+		RechunkMaxHold:      *rechunkMaxHold,
+		Sequencing:          *sequencing,
+		SequencingWindow:    *sequencingWindow,
+		MigrateTo:           splitList(*migrateTo),
+		MigrateDiscoveryURL: *migrateDiscovery,
+		MigrateJitter:       *migrateJitter,
+		TraceEvents:         *traceEvents,
+		ReportCancellations: *reportCancellations,
+		SlowFlush:           *slowFlush,
+		Heartbeat:           *heartbeat,
+		UsageSample:         *usageSample,
+		IdleLeakAfter:       *idleLeakAfter,
+		ReplaySize:          *replaySize,
+		ReplayTTL:           *replayTTL,
+		ReplayMemory:        *replayMemory,
+		ReplaySpillDir:      *replaySpillDir,
+		Retention:           retentionRules,
+		RetentionInterval:   *retentionInterval,
+		Config:              reloader,
+		AccessLog:           accessLog,
+		AccessLogFormat:     *accessLogFormat,
+		Latency:             latency,
+		RecordDir:           *recordDir,
+		RecordRate:          *recordRate,
+		RecordCompress:      *recordCompress,
+		RecordBucket:        recordBucket,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid proxy settings")
+	}
 	
-	server.logger.WithFields(logrus.Fields{
+	logger.WithFields(logrus.Fields{
 		"port":           *port,
 		"deep_server":    *deepServerURL,
+		"upstreams":      len(upstreams),
+		"pump_buffer":    *pumpBuffer,
 		"service":        "proxy-server",
 	}).Info("Starting SSE Proxy Server")
+	reloader.Log(logger)
+	reloader.ReloadOnSignal()
 
 	// Create optimized HTTP server
 	addr := fmt.Sprintf(":%d", *port)
 	httpServer := &http.Server{
 		Addr:           addr,
-		Handler:        server.router,
+		Handler:        buffers.Handler(reloader.Wrap(p)),
 		ReadTimeout:    30 * time.Second,
+		// Streaming routes lift it for their own responses
 		WriteTimeout:   30 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		ConnState:      p.ConnState,
 	}
+	buffers.Apply(httpServer)
+	version.Apply(httpServer)
 	
-	server.logger.Fatal(httpServer.ListenAndServe())
-}
\ No newline at end of file
+	upgrader, err := handoff.New()
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to pick up inherited listeners")
+	}
+	tcpOptions = tcpOptions.ForPlatform(logger.WithField("fd_handoff", handoff.Supported))
+	upgrader.ListenConfig = tcpOptions.ListenConfig()
+	ln, err := upgrader.Listen("tcp", addr)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to listen")
+	}
+	ln = tcpOptions.Wrap(ln)
+	logger.WithFields(tcpOptions.Fields()).WithFields(buffers.Fields()).Info("Listener socket options")
+	if *unixSocket != "" {
+		uln, err := upgrader.Listen("unix", *unixSocket)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to listen on unix socket")
+		}
+		logger.WithField("unix_socket", *unixSocket).Info("Serving on unix socket")
+		go func() {
+			if err := httpServer.Serve(uln); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).Fatal("Unix socket server failed")
+			}
+		}()
+	}
+
+	go p.Run(context.Background())
+	go func() {
+		if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.WithError(err).Fatal("Server failed")
+		}
+	}()
+	if *grpcPort > 0 {
+		serveGRPC(logger, upgrader, tcpOptions, buffers, httpServer, *grpcPort, *grpcCert, *grpcKey)
+	}
+	if upgrader.HasParent() {
+		logger.Info("Took over listener from previous process")
+	}
+	if err := upgrader.Ready(); err != nil {
+		logger.WithError(err).Warn("Failed to notify previous process")
+	}
+
+	// SIGUSR2 starts a new binary on the same listener and drains this one;
+	// SIGINT/SIGTERM just drain, and SIGHUP reloads the config. Without
+	// handoff, as on Windows, there is no SIGUSR2.
+	sigChan := make(chan os.Signal, 1)
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	if handoff.Supported {
+		signals = append(signals, handoff.UpgradeSignal)
+	}
+	signal.Notify(sigChan, signals...)
+	for sig := range sigChan {
+		if sig != handoff.UpgradeSignal {
+			break
+		}
+		logger.Info("Handing listener off to new process")
+		if err := upgrader.Upgrade(); err != nil {
+			logger.WithError(err).Error("Upgrade failed, continuing to serve")
+			continue
+		}
+		logger.Info("New process is serving")
+		break
+	}
+
+	p.Drain(httpServer, *drainTimeout)
+}
+
+// serveGRPC serves the proxy, like httpServer, over HTTP/2 with TLS on
+// port, for gRPC clients of the ChatService. The listener is handed off on
+// upgrade like the main one.
+func serveGRPC(logger *logrus.Logger, upgrader *handoff.Upgrader, tcpOptions server.TCPOptions, buffers server.HTTPBuffers, httpServer *http.Server, port int, certFile, keyFile string) {
+	tlsConfig, err := grpcapi.ServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -grpc-cert")
+	}
+	grpcServer := &http.Server{
+		Handler:        httpServer.Handler,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    httpServer.ReadTimeout,
+		WriteTimeout:   httpServer.WriteTimeout,
+		MaxHeaderBytes: httpServer.MaxHeaderBytes,
+		ConnState:      httpServer.ConnState,
+	}
+	buffers.Apply(grpcServer)
+	ln, err := upgrader.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to listen for gRPC")
+	}
+	ln = tcpOptions.Wrap(ln)
+	logger.WithField("grpc_port", port).Info("Serving gRPC ChatService")
+	go func() {
+		if err := grpcServer.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			logger.WithError(err).Fatal("gRPC server failed")
+		}
+	}()
+}
+
+// loadAPIKeys returns the keys of -api-keys or -api-keys-file, or nil if
+// neither is set.
+func loadAPIKeys(list, file string) (*proxy.APIKeys, error) {
+	switch {
+	case list != "" && file != "":
+		return nil, fmt.Errorf("set -api-keys or -api-keys-file, not both")
+	case file != "":
+		return proxy.LoadAPIKeys(file)
+	case list != "":
+		return proxy.ParseAPIKeys(list)
+	}
+	return nil, nil
+}
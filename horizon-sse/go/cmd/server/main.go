@@ -1,26 +1,68 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"horizon-sse-go/config"
 	"horizon-sse-go/server"
+	"horizon-sse-go/streamio"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// specList collects the values of a flag that may be repeated.
+type specList []string
+
+func (l *specList) String() string     { return strings.Join(*l, " ") }
+func (l *specList) Set(v string) error { *l = append(*l, v); return nil }
+func (l *specList) IsRepeatable()      {}
+
 func main() {
+	var bridges, webhooks specList
+	flag.Var(&webhooks, "webhook", "POST the events of a channel to a URL, as channel=url. Repeatable")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("HORIZON_WEBHOOK_SECRET"), "HMAC secret signing webhook requests (default $HORIZON_WEBHOOK_SECRET)")
+	webhookBatch := flag.Int("webhook-batch", 1, "Maximum events per webhook request")
+	webhookBatchWait := flag.Duration("webhook-batch-wait", 100*time.Millisecond, "Maximum wait for a webhook batch to fill")
+	flag.Var(&bridges, "bridge", "Mirror a remote SSE stream into a local channel, as channel=url; {type} in the channel is replaced by the event type. Repeatable")
 	port := flag.Int("port", 10080, "Server port")
+	eventIDs := flag.String("event-ids", "passthrough", "Event ID strategy (monotonic, snowflake, passthrough), optionally per route: passthrough,/sse=snowflake")
+	nodeID := flag.Int64("node-id", 0, "Node ID embedded in snowflake event IDs")
+	metricsInterval := flag.Duration("metrics-interval", 2*time.Second, "Interval between /metrics/stream snapshots")
+	maxChannels := flag.Int("max-tracked-channels", 100, "Channels reported individually in /metrics; the rest are aggregated as _other")
+	channelPolicies := flag.String("channel-policy", "drop-newest", "Slow subscriber policy (drop-newest, drop-oldest, compact, disconnect) with optional buffer, per channel: drop-newest,prices.*=compact:1,audit=disconnect:1024")
+	stateChannels := flag.String("state-channels", "", "Channels that keep the latest event per key and send it to new subscribers, e.g. dashboard,status.*")
+	timeScale := flag.Float64("time-scale", 1, "Run /sse stream and metrics push timing this many times faster than the wall clock")
+	replaySize := flag.Int("replay-size", 0, "Events kept per /sse client with a client_id, to resume with Last-Event-ID (0 disables)")
+	replayTTL := flag.Duration("replay-ttl", server.DefaultReplayTTL, "How long a client's events are kept after its last one")
+	replayMemory := flag.Int64("replay-memory", 0, "Bytes of a client's replay buffer kept in memory; older events spill to disk (0 keeps them all in memory)")
+	replaySpillDir := flag.String("replay-spill-dir", "", "Directory for replay buffers spilled to disk (default the system temp directory)")
+	idleLeakAfter := flag.Duration("idle-leak-after", server.DefaultIdleLeakAfter, "Idle time after which /metrics counts a keep-alive connection as leaked")
+	httpBuffers := flag.String("http-buffers", "", "Response buffer sizes, e.g. write=32KB,h2-frame=64KB (see README)")
+	httpVersion := flag.String("http-version", string(server.HTTPAuto), "HTTP versions served: auto (HTTP/1.1, and HTTP/2 over TLS or as h2c), h1 or h2 (see README)")
+	tcpSpec := flag.String("tcp", "", "Socket options of accepted connections, e.g. nodelay=false,sndbuf=64KB,rcvbuf=64KB,keepalive=30s,keepalive-interval=10s,keepalive-count=3")
+	heartbeat := flag.Duration("heartbeat", 0, "Send a heartbeat comment to /sse and /metrics/stream clients idle for this long (0 disables)")
+	streamBuffer := flag.Int("stream-buffer", server.DefaultStreamBuffer, "Events buffered per /sse client before -stream-overflow applies")
+	streamOverflow := flag.String("stream-overflow", string(streamio.OverflowBlock), "What a /sse stream does once its client falls -stream-buffer events behind: block, drop-oldest, drop-newest or disconnect")
+	slowFlush := flag.Duration("slow-flush", server.DefaultSlowFlush, "Flush duration past which a flush to an /sse client is logged and counted as slow")
+	schemaDir := flag.String("schemas", "", "Directory of JSON Schemas (<channel>.json) that events published to each channel must match")
+	configFile := flag.String("config", "", "YAML or TOML file setting the flags not given, under server (default $HORIZON_CONFIG)")
 	flag.Parse()
 
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
+	effective, err := config.Apply(flag.CommandLine, "server", *configFile)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -config")
+	}
 
 	logger.WithFields(logrus.Fields{
 		"port":       *port,
@@ -28,10 +70,84 @@ func main() {
 		"cpu_cores":  runtime.NumCPU(),
 		"go_version": runtime.Version(),
 	}).Info("Starting SSE server")
+	effective.Log(logger)
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	idRoutes, err := server.ParseEventIDRoutes(*eventIDs, server.EventIDPassthrough)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -event-ids")
+	}
+	if err := server.SetSnowflakeNodeID(*nodeID); err != nil {
+		logger.WithError(err).Fatal("Invalid -node-id")
+	}
+	policies, err := server.ParseChannelPolicies(*channelPolicies)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -channel-policy")
+	}
+	tcpOptions, err := server.ParseTCPOptions(*tcpSpec)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -tcp")
+	}
+	buffers, err := server.ParseHTTPBuffers(*httpBuffers)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -http-buffers")
+	}
+	version, err := server.ParseHTTPVersion(*httpVersion)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -http-version")
+	}
+	overflow, err := streamio.ParseOverflow(*streamOverflow)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid -stream-overflow")
+	}
+
+	// Interrupts end the streams and the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	sseServer := server.NewSSEServer()
+	sseServer.SetLogger(logger)
+	sseServer.Handle(config.Path, effective)
+	sseServer.SetEventIDRoutes(idRoutes)
+	sseServer.SetMetricsInterval(*metricsInterval)
+	sseServer.SetClock(server.NewScaledClock(*timeScale))
+	sseServer.SetSlowFlush(*slowFlush)
+	sseServer.SetHeartbeat(*heartbeat)
+	sseServer.SetStreamBuffer(*streamBuffer, overflow)
+	sseServer.SetIdleLeakAfter(*idleLeakAfter)
+	sseServer.SetReplay(*replaySize, *replayTTL)
+	sseServer.SetReplaySpill(*replayMemory, *replaySpillDir)
+	sseServer.SetTCPOptions(tcpOptions.ForPlatform(logger))
+	sseServer.SetHTTPBuffers(buffers)
+	sseServer.SetHTTPVersion(version)
+	sseServer.SetMaxTrackedChannels(*maxChannels)
+	sseServer.SetChannelPolicies(policies)
+	sseServer.SetStateChannels(server.ParseStateChannels(*stateChannels))
+	for _, spec := range bridges {
+		cfg, err := server.ParseBridgeConfig(spec)
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid -bridge")
+		}
+		sseServer.AddBridge(ctx, cfg)
+	}
+	for _, spec := range webhooks {
+		cfg, err := server.ParseWebhookConfig(spec)
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid -webhook")
+		}
+		cfg.Secret = *webhookSecret
+		cfg.BatchSize = *webhookBatch
+		cfg.BatchWait = *webhookBatchWait
+		sseServer.AddWebhook(ctx, cfg)
+	}
+	if *schemaDir != "" {
+		n, err := sseServer.LoadSchemas(*schemaDir)
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid -schemas")
+		}
+		logger.WithField("schemas", n).Info("Loaded event schemas")
+	}
 
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
@@ -50,15 +166,14 @@ func main() {
 		}
 	}()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
 	go func() {
-		<-sigChan
+		<-ctx.Done()
 		logger.Info("Shutting down server...")
-		os.Exit(0)
 	}()
 
 	addr := fmt.Sprintf(":%d", *port)
-	logger.Fatal(sseServer.Start(addr))
+	if err := sseServer.Start(ctx, addr); err != nil {
+		logger.WithError(err).Fatal("Server failed")
+	}
+	logger.Info("Server stopped")
 }
\ No newline at end of file
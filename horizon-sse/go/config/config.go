@@ -0,0 +1,348 @@
+// Package config sets the flags of a binary from one YAML or TOML file
+// and the environment, so a deployment keeps its ports, upstream URLs,
+// timeouts, buffer sizes, scripts and limits in one place instead of on
+// long command lines.
+//
+// The keys of a file are flag names. A top-level map named after a
+// binary's section holds its settings; other top-level keys apply to
+// every binary with a flag of that name:
+//
+//	http-version: h2
+//	proxy:
+//	  port: 10080
+//	  deep-server: http://localhost:10081
+//	  tcp:
+//	    nodelay: false
+//	    sndbuf: 64KB
+//
+// A list is joined with commas and a map under a flag becomes its
+// key=value pairs, the form the flags take on the command line. A
+// variable HORIZON_<SECTION>_<FLAG>, such as HORIZON_PROXY_PORT, overrides
+// the file, and flags given on the command line override both. A
+// Reloader applies them again while the binary runs, to the flags it can
+// take without a restart.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sections are the top-level keys of a file that hold the settings of one
+// binary.
+var Sections = []string{"proxy", "deep-server", "server", "loadtest", "orchestrator"}
+
+// FileEnv names the config file when -config is not given.
+const FileEnv = "HORIZON_CONFIG"
+
+// EnvPrefix starts the variables that override settings.
+const EnvPrefix = "HORIZON_"
+
+// Path is where GET requests for the effective config are served.
+const Path = "/admin/config"
+
+// Where a setting came from.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// Setting is the value a flag ended up with. Key is the file key or the
+// variable that set it.
+type Setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	Key    string `json:"key,omitempty"`
+
+	parts []string // the items of a list or pairs of a map in a file
+}
+
+// Repeatable is implemented by the values of flags given once per item,
+// such as -header. A file sets each item of a list, or pair of a map,
+// under one of them on its own rather than joined with commas.
+type Repeatable interface {
+	flag.Value
+	IsRepeatable()
+}
+
+// Effective is the config a binary runs with: every flag, with secrets
+// redacted, and the keys of its section that no flag takes. It serves
+// itself as JSON.
+type Effective struct {
+	Section  string    `json:"section"`
+	File     string    `json:"file,omitempty"`
+	Settings []Setting `json:"settings"`
+	Unknown  []string  `json:"unknown,omitempty"`
+
+	resolved map[string]Setting // the file and environment values applied, by flag
+}
+
+// Apply sets the flags of fs, once parsed, that were not given on the
+// command line: from the file at path, or at $HORIZON_CONFIG if path is
+// empty, then from the environment. section is the binary's section of
+// the file.
+func Apply(fs *flag.FlagSet, section, path string) (*Effective, error) {
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	resolved, unknown, err := resolve(fs, section, path, given)
+	if err != nil {
+		return nil, err
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if s, ok := resolved[f.Name]; ok && err == nil {
+			err = set(fs, path, s)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return effective(fs, section, path, given, resolved, unknown), nil
+}
+
+// resolve returns the values the file at path and the environment have
+// for the flags of fs not given, by flag, without setting them, and the
+// keys of section no flag takes. A variable overrides the file.
+func resolve(fs *flag.FlagSet, section, path string, given map[string]bool) (map[string]Setting, []string, error) {
+	resolved := make(map[string]Setting)
+	var unknown []string
+	if path != "" {
+		entries, err := load(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		values, keys, err := flagValues(fs, section, entries)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		unknown = keys
+		for _, v := range values {
+			if given[v.Name] {
+				continue
+			}
+			if _, ok := fs.Lookup(v.Name).Value.(Repeatable); !ok {
+				v.parts = []string{v.Value}
+			}
+			v.Source = SourceFile
+			resolved[v.Name] = v
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		name := EnvName(section, f.Name)
+		if value, ok := os.LookupEnv(name); ok && !given[f.Name] {
+			resolved[f.Name] = Setting{Name: f.Name, Value: value, Source: SourceEnv, Key: name, parts: []string{value}}
+		}
+	})
+	return resolved, unknown, nil
+}
+
+// set gives a flag of fs the value s resolved to, item by item for a
+// repeatable flag.
+func set(fs *flag.FlagSet, path string, s Setting) error {
+	for _, part := range s.parts {
+		if err := fs.Set(s.Name, part); err != nil {
+			if s.Source == SourceFile {
+				return fmt.Errorf("%s: %s: %w", path, s.Key, err)
+			}
+			return fmt.Errorf("%s: %w", s.Key, err)
+		}
+	}
+	return nil
+}
+
+// effective reports the flags of fs as they are set, each with where its
+// value came from.
+func effective(fs *flag.FlagSet, section, path string, given map[string]bool, resolved map[string]Setting, unknown []string) *Effective {
+	eff := &Effective{Section: section, File: path, Unknown: unknown, resolved: resolved}
+	fs.VisitAll(func(f *flag.Flag) {
+		s := Setting{Name: f.Name, Value: f.Value.String(), Source: SourceDefault}
+		if given[f.Name] {
+			s.Source = SourceFlag
+		} else if r, ok := resolved[f.Name]; ok {
+			s.Source, s.Key = r.Source, r.Key
+		}
+		if secret(f.Name) && s.Value != "" {
+			s.Value = "[redacted]"
+		}
+		eff.Settings = append(eff.Settings, s)
+	})
+	return eff
+}
+
+// EnvName is the variable overriding flag in section, such as
+// HORIZON_DEEP_SERVER_PORT.
+func EnvName(section, flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(section+"_"+flag))
+}
+
+// load parses a config file, as TOML if it ends in .toml and YAML if it
+// ends in .yaml or .yml.
+func load(path string) ([]entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		entries, err = parseYAML(data)
+	case ".toml":
+		entries, err = parseTOML(data)
+	default:
+		return nil, fmt.Errorf("%s: config files must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]int, len(entries))
+	for _, e := range entries {
+		if line, ok := seen[e.name()]; ok {
+			return nil, fmt.Errorf("%s: line %d: %s already set on line %d", path, e.line, e.name(), line)
+		}
+		seen[e.name()] = e.line
+	}
+	return entries, nil
+}
+
+// flagValues resolves the entries of a file to the values of the flags of
+// fs, those of section over the shared ones. Keys of the section that are
+// not flags of fs are returned as unknown, as they may be meant for
+// another build of the binary; shared keys are for any binary and left
+// out silently.
+func flagValues(fs *flag.FlagSet, section string, entries []entry) ([]Setting, []string, error) {
+	isSection := make(map[string]bool, len(Sections))
+	for _, s := range Sections {
+		isSection[s] = true
+	}
+	var shared, ours []entry
+	for _, e := range entries {
+		switch {
+		case !isSection[e.key[0]]:
+			shared = append(shared, e)
+		case e.key[0] != section:
+		case len(e.key) == 1:
+			return nil, nil, fmt.Errorf("line %d: section %s is not a map", e.line, section)
+		default:
+			ours = append(ours, e)
+		}
+	}
+	values, _, err := groupFlags(fs, shared, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	overrides, unknown, err := groupFlags(fs, ours, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, o := range overrides {
+		replaced := false
+		for i := range values {
+			if values[i].Name == o.Name {
+				values[i], replaced = o, true
+			}
+		}
+		if !replaced {
+			values = append(values, o)
+		}
+	}
+	return values, unknown, nil
+}
+
+// groupFlags turns entries, whose keys start at index skip, into flag
+// values: a key of its own is the flag's value and the entries of a map
+// under it are joined as key=value pairs. It returns the keys of flags fs
+// does not have apart.
+func groupFlags(fs *flag.FlagSet, entries []entry, skip int) ([]Setting, []string, error) {
+	var values []Setting
+	var unknown []string
+	index := make(map[string]int)
+	plain := make(map[string]bool) // flags set by a key of their own
+	for _, e := range entries {
+		key := e.key[skip:]
+		if len(key) > 2 {
+			return nil, nil, fmt.Errorf("line %d: %s nests too deep", e.line, e.name())
+		}
+		if fs.Lookup(key[0]) == nil {
+			unknown = append(unknown, e.name())
+			continue
+		}
+		parts := []string{e.value}
+		switch {
+		case len(key) == 2:
+			parts = []string{key[1] + "=" + e.value}
+		case e.items != nil:
+			parts = e.items
+		}
+		i, ok := index[key[0]]
+		if !ok {
+			index[key[0]] = len(values)
+			plain[key[0]] = len(key) == 1
+			values = append(values, Setting{Name: key[0], Key: strings.Join(e.key[:skip+1], ".")})
+			i = len(values) - 1
+		} else if len(key) == 1 || plain[key[0]] {
+			return nil, nil, fmt.Errorf("line %d: %s is both a value and a map", e.line, e.name())
+		}
+		values[i].parts = append(values[i].parts, parts...)
+	}
+	for i := range values {
+		values[i].Value = strings.Join(values[i].parts, ",")
+	}
+	return values, unknown, nil
+}
+
+// secret reports whether the value of a flag is a credential, which the
+// effective config does not show.
+func secret(name string) bool {
+	word := name[strings.LastIndex(name, "-")+1:]
+	return word == "secret" || word == "keys" || word == "password" || word == "token"
+}
+
+// Log records the file applied, if any, and warns of the keys of the
+// section no flag took.
+func (e *Effective) Log(log logrus.FieldLogger) {
+	if e.File == "" {
+		return
+	}
+	counts := make(map[string]int)
+	for _, s := range e.Settings {
+		counts[s.Source]++
+	}
+	log.WithFields(logrus.Fields{
+		"file":      e.File,
+		"section":   e.Section,
+		"from_file": counts[SourceFile],
+		"from_env":  counts[SourceEnv],
+	}).Info("Config applied")
+	if len(e.Unknown) > 0 {
+		log.WithField("keys", e.Unknown).Warn("Config keys no flag takes")
+	}
+}
+
+// ServeHTTP writes the effective config as JSON.
+func (e *Effective) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// Wrap serves the effective config on Path in front of next.
+func (e *Effective) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == Path && r.Method == http.MethodGet {
+			e.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,446 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const yamlConfig = `# shared by every binary
+http-version: h2
+proxy:
+  port: 10090            # overrides the flag default
+  deep-server: "http://localhost:10081/#x"
+  peers:
+  - http://a:10080
+  - 'http://b:10080'
+  tcp:
+    nodelay: false
+    sndbuf: 64KB
+  api-keys: [k1, "k2"]
+  header:
+  - "X-A: 1, 2"
+  - "X-B: 3"
+  not-a-flag: 1
+deep-server:
+  port: 10091
+`
+
+const tomlConfig = `http-version = "h2"
+
+[proxy]
+port = 10090 # overrides the flag default
+deep-server = "http://localhost:10081/#x"
+peers = [
+  "http://a:10080",
+  'http://b:10080',
+]
+tcp = { nodelay = false, sndbuf = "64KB" }
+api-keys = ["k1", "k2"]
+header = ["X-A: 1, 2", "X-B: 3"]
+not-a-flag = 1
+
+[deep-server]
+port = 10091
+`
+
+func TestParse(t *testing.T) {
+	want := map[string]string{
+		"http-version":      "h2",
+		"proxy.port":        "10090",
+		"proxy.deep-server": "http://localhost:10081/#x",
+		"proxy.peers":       "http://a:10080,http://b:10080",
+		"proxy.tcp.nodelay": "false",
+		"proxy.tcp.sndbuf":  "64KB",
+		"proxy.api-keys":    "k1,k2",
+		"proxy.header":      "X-A: 1, 2,X-B: 3",
+		"proxy.not-a-flag":  "1",
+		"deep-server.port":  "10091",
+	}
+	for name, parse := range map[string]func([]byte) ([]entry, error){
+		"yaml": parseYAML,
+		"toml": parseTOML,
+	} {
+		data := yamlConfig
+		if name == "toml" {
+			data = tomlConfig
+		}
+		entries, err := parse([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := make(map[string]string)
+		for _, e := range entries {
+			got[e.name()] = e.value
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		yaml bool
+		data string
+		err  string
+	}{
+		{true, "proxy:\n  port: 1\n    tcp: x\n", "line 3: inconsistent indentation"},
+		{true, "- a\n", "line 1: list item outside a list"},
+		{true, "proxy:\n\tport: 1\n", "line 2: indented with a tab"},
+		{true, "proxy\n", "line 1: expected key: value"},
+		{true, "port: \"10\n", "line 1: invalid string"},
+		{true, "proxy:\n  peers:\n  - url: x\n", "line 3: proxy.peers holds a list or map, not a value"},
+		{false, "[[proxy]]\n", "line 1: arrays of tables"},
+		{false, "port 10\n", "line 1: expected key = value"},
+		{false, "peers = [\"a\",\n", "line 1: unterminated list"},
+	} {
+		parse := parseTOML
+		if tc.yaml {
+			parse = parseYAML
+		}
+		if _, err := parse([]byte(tc.data)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: got %v, want %q", tc.data, err, tc.err)
+		}
+	}
+}
+
+// headers is a repeatable flag value.
+type headers []string
+
+func (h *headers) String() string     { return strings.Join(*h, "; ") }
+func (h *headers) Set(v string) error { *h = append(*h, v); return nil }
+func (h *headers) IsRepeatable()      {}
+func (h *headers) Reset()             { *h = nil }
+
+func proxyFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	fs.Int("port", 10080, "")
+	fs.String("deep-server", "", "")
+	fs.String("peers", "", "")
+	fs.String("tcp", "", "")
+	fs.String("api-keys", "", "")
+	fs.String("http-version", "auto", "")
+	fs.Duration("drain-timeout", 30*time.Second, "")
+	fs.Int("max-connections", 0, "")
+	fs.Var(new(headers), "header", "")
+	return fs
+}
+
+func TestApply(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"horizon.yaml", "horizon.toml"} {
+		path := filepath.Join(dir, file)
+		data := yamlConfig
+		if strings.HasSuffix(file, ".toml") {
+			data = tomlConfig
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		fs := proxyFlags()
+		if err := fs.Parse([]string{"-max-connections", "5"}); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("HORIZON_PROXY_DRAIN_TIMEOUT", "5s")
+		t.Setenv("HORIZON_PROXY_MAX_CONNECTIONS", "7")
+		eff, err := Apply(fs, "proxy", path)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+
+		got := make(map[string]Setting)
+		for _, s := range eff.Settings {
+			got[s.Name] = s
+		}
+		for _, want := range []Setting{
+			{Name: "port", Value: "10090", Source: SourceFile, Key: "proxy.port"},
+			{Name: "peers", Value: "http://a:10080,http://b:10080", Source: SourceFile, Key: "proxy.peers"},
+			{Name: "tcp", Value: "nodelay=false,sndbuf=64KB", Source: SourceFile, Key: "proxy.tcp"},
+			{Name: "api-keys", Value: "[redacted]", Source: SourceFile, Key: "proxy.api-keys"},
+			{Name: "header", Value: "X-A: 1, 2; X-B: 3", Source: SourceFile, Key: "proxy.header"},
+			{Name: "http-version", Value: "h2", Source: SourceFile, Key: "http-version"},
+			{Name: "drain-timeout", Value: "5s", Source: SourceEnv, Key: "HORIZON_PROXY_DRAIN_TIMEOUT"},
+			{Name: "max-connections", Value: "5", Source: SourceFlag},
+		} {
+			if !reflect.DeepEqual(got[want.Name], want) {
+				t.Errorf("%s: got %+v, want %+v", file, got[want.Name], want)
+			}
+		}
+		if v := fs.Lookup("api-keys").Value.String(); v != "k1,k2" {
+			t.Errorf("%s: api-keys set to %q", file, v)
+		}
+		if !reflect.DeepEqual(eff.Unknown, []string{"proxy.not-a-flag"}) {
+			t.Errorf("%s: unknown %v", file, eff.Unknown)
+		}
+
+		rec := httptest.NewRecorder()
+		eff.Wrap(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", Path, nil))
+		var served Effective
+		want := *eff
+		want.resolved = nil
+		if err := json.NewDecoder(rec.Body).Decode(&served); err != nil || !reflect.DeepEqual(served, want) {
+			t.Errorf("%s: served %+v (%v), want %+v", file, served, err, want)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, tc := range []struct {
+		path string
+		err  string
+	}{
+		{write("bad-value.yaml", "proxy:\n  port: ten\n"), "proxy.port: parse error"},
+		{write("twice.yaml", "proxy:\n  port: 1\nproxy:\n  port: 2\n"), "line 4: proxy.port already set on line 2"},
+		{write("deep.yaml", "proxy:\n  tcp:\n    a:\n      b: 1\n"), "proxy.tcp.a.b nests too deep"},
+		{write("mixed.toml", "[proxy]\ntcp = \"x\"\ntcp.nodelay = false\n"), "proxy.tcp.nodelay is both a value and a map"},
+		{write("horizon.json", "{}"), "must be .yaml, .yml or .toml"},
+	} {
+		if _, err := Apply(proxyFlags(), "proxy", tc.path); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got %v, want %q", filepath.Base(tc.path), err, tc.err)
+		}
+	}
+
+	t.Setenv("HORIZON_PROXY_PORT", "ten")
+	if _, err := Apply(proxyFlags(), "proxy", ""); err == nil || !strings.Contains(err.Error(), "HORIZON_PROXY_PORT") {
+		t.Errorf("invalid variable: got %v", err)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "horizon.yaml")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("proxy:\n  port: 10090\n  peers: http://a:10080\n  deep-server: http://x\n  header: [\"X-A: 1\"]\n  drain-timeout: 5s\n")
+	fs := proxyFlags()
+	if err := fs.Parse([]string{"-drain-timeout", "9s"}); err != nil {
+		t.Fatal(err)
+	}
+	eff, err := Apply(fs, "proxy", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReloader(fs, eff, []string{"no-such-flag"}, nil); err == nil {
+		t.Error("reloader of an unknown flag")
+	}
+	applied := 0
+	var applyErr error
+	r, err := NewReloader(fs, eff, []string{"peers", "header", "deep-server", "drain-timeout"}, func() error {
+		applied++
+		return applyErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	r.Log(quiet)
+	handler := r.Wrap(http.NotFoundHandler())
+	reload := func() (int, ReloadStats) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", ReloadPath, nil))
+		var stats ReloadStats
+		if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, stats
+	}
+	value := func(name string) string { return fs.Lookup(name).Value.String() }
+	source := func(name string) string {
+		for _, s := range r.Effective().Settings {
+			if s.Name == name {
+				return s.Source
+			}
+		}
+		return ""
+	}
+	first := r.Stats()
+
+	write("proxy:\n  port: 10091\n  peers: http://b:10080\n  header: [\"X-B: 2\", \"X-C: 3\"]\n  drain-timeout: 1s\n")
+	code, stats := reload()
+	if code != http.StatusOK || stats.Version != 2 || stats.Trigger != TriggerAdmin || applied != 1 {
+		t.Fatalf("reload: %d %+v, applied %d times", code, stats, applied)
+	}
+	if stats.Checksum == first.Checksum || !reflect.DeepEqual(stats.PendingRestart, []string{"port"}) {
+		t.Errorf("checksum %s after %s, pending %v", stats.Checksum, first.Checksum, stats.PendingRestart)
+	}
+	for name, want := range map[string]string{
+		"port":          "10090",
+		"peers":         "http://b:10080",
+		"header":        "X-B: 2; X-C: 3",
+		"deep-server":   "",
+		"drain-timeout": "9s",
+	} {
+		if got := value(name); got != want {
+			t.Errorf("-%s is %q, want %q", name, got, want)
+		}
+	}
+	if source("peers") != SourceFile || source("deep-server") != SourceDefault || source("drain-timeout") != SourceFlag {
+		t.Errorf("sources %+v", r.Effective().Settings)
+	}
+
+	applyErr = fmt.Errorf("route to unknown upstream")
+	write("proxy:\n  peers: http://c:10080\n")
+	if code, stats := reload(); code != http.StatusUnprocessableEntity || stats.Version != 2 || stats.Failed != 1 || stats.LastError != "route to unknown upstream" {
+		t.Errorf("refused reload: %d %+v", code, stats)
+	}
+	for _, s := range r.Effective().Settings {
+		if s.Name == "peers" && s.Value != "http://b:10080" {
+			t.Errorf("effective config took a refused reload: %+v", s)
+		}
+	}
+	write("proxy:\n  port: [\n")
+	if _, err := r.Reload(TriggerSignal); err == nil || r.Stats().Failed != 2 {
+		t.Errorf("invalid file: %v, %+v", err, r.Stats())
+	}
+}
+
+func TestDecode(t *testing.T) {
+	type token struct {
+		Text    string  `json:"text"`
+		DelayMs float64 `json:"delay_ms"`
+	}
+	type scenario struct {
+		Name   string            `json:"name"`
+		Match  map[string]string `json:"match"`
+		Tokens []json.RawMessage `json:"tokens"`
+		Steps  []token           `json:"steps"`
+		Off    bool              `json:"off"`
+	}
+	want := []scenario{
+		{Name: "refusal", Match: map[string]string{"content": "(?i)password"}, Tokens: []json.RawMessage{[]byte(`" I"`), []byte(`{"delay_ms":500,"text":" can't"}`)}},
+		{Name: "steps", Steps: []token{{Text: "a", DelayMs: 1.5}, {Text: "42"}}, Off: true},
+	}
+	yaml := `# scenarios
+- name: refusal
+  match:
+    content: "(?i)password"
+  tokens:
+  - " I"
+  - {text: " can't", delay_ms: 500}
+-
+  name: steps
+  steps:
+    - text: a
+      delay_ms: 1.5
+    - text: "42"
+  off: true
+`
+	data, _ := json.Marshal(want)
+	dir := t.TempDir()
+	for name, content := range map[string]string{"s.yaml": yaml, "s.json": string(data)} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var got []scenario
+		if err := Decode(path, &got); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	// Config files are read the same way
+	path := filepath.Join(dir, "horizon.yaml")
+	os.WriteFile(path, []byte(yamlConfig), 0o644)
+	var config struct {
+		Proxy struct {
+			Peers []string               `json:"peers"`
+			TCP   map[string]interface{} `json:"tcp"`
+		} `json:"proxy"`
+	}
+	if err := Decode(path, &config); err != nil || len(config.Proxy.Peers) != 2 || config.Proxy.TCP["nodelay"] != false {
+		t.Errorf("config file: %+v %v", config, err)
+	}
+
+	for _, tc := range []struct{ data, err string }{
+		{"- a\nb: 1\n", "line 2: inconsistent indentation"},
+		{"a: 1\n- b\n", "line 2: list item inside a map"},
+		{"a: 1\na: 2\n", "line 2: a already set on line 1"},
+		{"a: [1, {b: 2}\n", "line 1: unterminated list"},
+		{"- text: 42\n", "cannot unmarshal number"},
+	} {
+		path := filepath.Join(dir, "bad.yml")
+		if err := os.WriteFile(path, []byte(tc.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var got []token
+		if err := Decode(path, &got); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: got %v, want %q", tc.data, err, tc.err)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0o644)
+
+	p := &Preflight{}
+	p.Port("free port", "127.0.0.1:0")
+	p.Port("held port", held.Addr().String())
+	p.Pair("tls", "cert", "", "key", "key.pem")
+	p.Pair("unset tls", "cert", "", "key", "")
+	p.Resolve("ip", "http://127.0.0.1:10081")
+	p.Resolve("not a url", "localhost:10081")
+	p.Dir("dir", dir)
+	p.Dir("missing dir", filepath.Join(dir, "missing"))
+	p.Dir("file", file)
+	p.Warn("queue", "no effect")
+	p.Check("parsed", nil, "fine")
+
+	var results []string
+	for _, c := range p.Checks() {
+		results = append(results, c.Name+"="+c.Result)
+	}
+	want := "free port=ok held port=FAIL tls=FAIL ip=ok not a url=FAIL dir=ok missing dir=FAIL file=FAIL queue=warn parsed=ok"
+	if got := strings.Join(results, " "); got != want {
+		t.Errorf("checks %s, want %s", got, want)
+	}
+	if err := p.Err(); err == nil || !strings.Contains(err.Error(), "held port: "+held.Addr().String()+" is in use") ||
+		!strings.Contains(err.Error(), "-key is set without -cert") || strings.Contains(err.Error(), "queue") {
+		t.Errorf("Err() = %v", err)
+	}
+	var table strings.Builder
+	p.Print(&table)
+	if lines := strings.Split(strings.TrimSpace(table.String()), "\n"); len(lines) != 11 || !strings.HasPrefix(lines[0], "CHECK") {
+		t.Errorf("table:\n%s", table.String())
+	}
+	if (&Preflight{}).Err() != nil {
+		t.Error("no checks failed, but Err is set")
+	}
+	if CheckPreflightMode("strict") == nil {
+		t.Error("unknown preflight mode accepted")
+	}
+}
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Decode reads the JSON or YAML file at path into v as encoding/json
+// would, by its extension: .yaml and .yml are read as YAML, anything else
+// as JSON. It is for files of structured settings, such as lists of
+// objects, that don't map to flags.
+//
+// The YAML read is that of config files, read by readYAML: plain scalars
+// that read as numbers, true, false or null are those, so a token such as
+// 42 or true that is meant as text needs quotes.
+func Decode(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		root, err := readYAML(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		tree, err := root.value()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(tree); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// yamlNode is a value read from YAML: a scalar, a list of items or a map
+// of fields, in the order written. A nil node is an empty value, such as
+// a key with nothing under it.
+type yamlNode struct {
+	kind   yamlKind
+	line   int
+	text   string // of a scalar, unquoted
+	quoted bool
+	items  []*yamlNode
+	fields []yamlField
+}
+
+type yamlKind int
+
+const (
+	yamlScalar yamlKind = iota
+	yamlList
+	yamlMap
+)
+
+// yamlField is a key of a map and its value. Keys set twice are kept, so
+// that readers can say where each was set.
+type yamlField struct {
+	key   string
+	line  int
+	value *yamlNode
+}
+
+// value turns n into the maps, slices and scalars encoding/json takes.
+func (n *yamlNode) value() (interface{}, error) {
+	if n == nil {
+		return nil, nil
+	}
+	switch n.kind {
+	case yamlList:
+		items := make([]interface{}, 0, len(n.items))
+		for _, item := range n.items {
+			v, err := item.value()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	case yamlMap:
+		m := make(map[string]interface{}, len(n.fields))
+		seen := make(map[string]int, len(n.fields))
+		for _, f := range n.fields {
+			if first, ok := seen[f.key]; ok {
+				return nil, fmt.Errorf("line %d: %s already set on line %d", f.line, f.key, first)
+			}
+			seen[f.key] = f.line
+			v, err := f.value.value()
+			if err != nil {
+				return nil, err
+			}
+			m[f.key] = v
+		}
+		return m, nil
+	}
+	if n.quoted {
+		return n.text, nil
+	}
+	switch n.text {
+	case "", "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(n.text, 10, 64); err == nil {
+		return i, nil
+	}
+	if c := n.text[0]; c == '-' || c == '.' || (c >= '0' && c <= '9') {
+		if f, err := strconv.ParseFloat(n.text, 64); err == nil && !strings.ContainsAny(n.text, "xXpP_nN") {
+			return f, nil
+		}
+	}
+	return n.text, nil
+}
+
+// yamlLine is a line of YAML with content, its comment cut.
+type yamlLine struct {
+	indent int
+	text   string
+	line   int
+}
+
+func (l yamlLine) item() bool {
+	return l.text == "-" || strings.HasPrefix(l.text, "- ")
+}
+
+// readYAML reads the block mappings and lists, flow lists and maps, which
+// may nest, and plain, single- and double-quoted scalars of YAML. Anchors,
+// tags, multi-line scalars and documents are not supported. An empty
+// document is a nil node.
+func readYAML(data []byte) (*yamlNode, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimSpace(stripComment(raw))
+		if text == "" || text == "---" {
+			continue
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+		if raw[indent] == '\t' {
+			return nil, fmt.Errorf("line %d: indented with a tab", i+1)
+		}
+		lines = append(lines, yamlLine{indent: indent, text: text, line: i + 1})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	d := &yamlDecoder{lines: lines}
+	n, err := d.block(lines[0].indent)
+	if err == nil && d.next < len(lines) {
+		err = fmt.Errorf("line %d: inconsistent indentation", lines[d.next].line)
+	}
+	return n, err
+}
+
+type yamlDecoder struct {
+	lines []yamlLine
+	next  int
+}
+
+// block reads the list or map whose lines are indented by indent.
+func (d *yamlDecoder) block(indent int) (*yamlNode, error) {
+	if d.lines[d.next].item() {
+		return d.list(indent)
+	}
+	return d.mapping(indent)
+}
+
+func (d *yamlDecoder) list(indent int) (*yamlNode, error) {
+	list := &yamlNode{kind: yamlList, line: d.lines[d.next].line}
+	for d.next < len(d.lines) && d.lines[d.next].indent == indent && d.lines[d.next].item() {
+		l := d.lines[d.next]
+		rest := strings.TrimPrefix(strings.TrimPrefix(l.text, "-"), " ")
+		content := strings.TrimLeft(rest, " ")
+		if content == "" {
+			d.next++
+			n, err := d.child(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, n)
+			continue
+		}
+		if _, _, ok := cutYAMLKey(content); ok && !strings.ContainsAny(content[:1], `"'[{`) {
+			// A map starting on the item's line: its keys line up with
+			// the first one
+			d.lines[d.next] = yamlLine{indent: indent + len(l.text) - len(content), text: content, line: l.line}
+			n, err := d.mapping(d.lines[d.next].indent)
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, n)
+			continue
+		}
+		n, err := flowNode(content, l.line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.line, err)
+		}
+		list.items = append(list.items, n)
+		d.next++
+	}
+	return list, nil
+}
+
+func (d *yamlDecoder) mapping(indent int) (*yamlNode, error) {
+	m := &yamlNode{kind: yamlMap, line: d.lines[d.next].line}
+	for d.next < len(d.lines) && d.lines[d.next].indent == indent {
+		l := d.lines[d.next]
+		if l.item() {
+			return nil, fmt.Errorf("line %d: list item inside a map", l.line)
+		}
+		key, value, ok := cutYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", l.line)
+		}
+		key, err := scalar(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.line, err)
+		}
+		d.next++
+		var n *yamlNode
+		if value == "" {
+			n, err = d.child(indent, true)
+		} else if n, err = flowNode(value, l.line); err != nil {
+			err = fmt.Errorf("line %d: %w", l.line, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.fields = append(m.fields, yamlField{key: key, line: l.line, value: n})
+	}
+	return m, nil
+}
+
+// child reads the block under a key or list item at indent, if any. The
+// list of a key may start at the key's own indent.
+func (d *yamlDecoder) child(indent int, key bool) (*yamlNode, error) {
+	if d.next == len(d.lines) {
+		return nil, nil
+	}
+	l := d.lines[d.next]
+	if l.indent > indent || (key && l.indent == indent && l.item()) {
+		return d.block(l.indent)
+	}
+	return nil, nil
+}
+
+// flowNode parses a value on the line of its key or item: a scalar, or a
+// list or map in brackets or braces, which may nest.
+func flowNode(value string, line int) (*yamlNode, error) {
+	switch {
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") || !balanced(value) {
+			return nil, fmt.Errorf("unterminated list")
+		}
+		list := &yamlNode{kind: yamlList, line: line, items: []*yamlNode{}}
+		for _, part := range splitFlow(value[1 : len(value)-1]) {
+			item, err := flowNode(part, line)
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+		}
+		return list, nil
+	case strings.HasPrefix(value, "{"):
+		if !strings.HasSuffix(value, "}") {
+			return nil, fmt.Errorf("unterminated map")
+		}
+		m := &yamlNode{kind: yamlMap, line: line}
+		for _, part := range splitFlow(value[1 : len(value)-1]) {
+			key, v, ok := cutYAMLKey(part)
+			if !ok {
+				return nil, fmt.Errorf("expected key: value in %q", part)
+			}
+			key, err := scalar(key)
+			if err != nil {
+				return nil, err
+			}
+			n, err := flowNode(v, line)
+			if err != nil {
+				return nil, err
+			}
+			m.fields = append(m.fields, yamlField{key: key, line: line, value: n})
+		}
+		return m, nil
+	}
+	text, err := scalar(value)
+	if err != nil {
+		return nil, err
+	}
+	quoted := strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'")
+	return &yamlNode{kind: yamlScalar, line: line, text: text, quoted: quoted}, nil
+}
@@ -0,0 +1,289 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// entry is one value of a config file, under the path of keys leading to
+// it. A list is joined with commas, keeping its items, and a map becomes
+// one entry per key.
+type entry struct {
+	key   []string
+	value string
+	items []string
+	line  int
+}
+
+func (e entry) name() string {
+	return strings.Join(e.key, ".")
+}
+
+// parseYAML reads a YAML config file, as readYAML does, into entries. The
+// document is a map; lists under it hold scalars.
+func parseYAML(data []byte) ([]entry, error) {
+	root, err := readYAML(data)
+	switch {
+	case err != nil:
+		return nil, err
+	case root == nil:
+		return nil, nil
+	case root.kind == yamlList:
+		return nil, fmt.Errorf("line %d: list item outside a list", root.line)
+	}
+	return yamlEntries(nil, root.line, root)
+}
+
+// yamlEntries flattens n, the value of the key path set on line, into
+// entries.
+func yamlEntries(path []string, line int, n *yamlNode) ([]entry, error) {
+	switch {
+	case n == nil:
+		return []entry{{key: path, line: line}}, nil
+	case n.kind == yamlScalar:
+		return []entry{{key: path, value: n.text, line: line}}, nil
+	case n.kind == yamlList:
+		items := []string{}
+		for _, item := range n.items {
+			switch {
+			case item == nil:
+				items = append(items, "")
+			case item.kind != yamlScalar:
+				return nil, fmt.Errorf("line %d: %s holds a list or map, not a value", item.line, strings.Join(path, "."))
+			default:
+				items = append(items, item.text)
+			}
+		}
+		return []entry{{key: path, value: strings.Join(items, ","), items: items, line: line}}, nil
+	}
+	var entries []entry
+	for _, f := range n.fields {
+		values, err := yamlEntries(append(append([]string{}, path...), f.key), f.line, f.value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, values...)
+	}
+	return entries, nil
+}
+
+// cutYAMLKey splits "key: value" at the first colon followed by a space
+// or ending the line, so URLs in values stay whole.
+func cutYAMLKey(text string) (key, value string, ok bool) {
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			key = strings.TrimSpace(text[:i])
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// parseTOML reads tables, dotted keys, strings, arrays (which may span
+// lines) and inline tables. Arrays of tables and multi-line strings are
+// not supported; numbers, booleans and dates are kept as written.
+func parseTOML(data []byte) ([]entry, error) {
+	var entries []entry
+	var table []string
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := i + 1
+		text := strings.TrimSpace(stripComment(strings.TrimRight(lines[i], "\r")))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[[") {
+			return nil, fmt.Errorf("line %d: arrays of tables are not supported", line)
+		}
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", line)
+			}
+			var err error
+			if table, err = dottedKey(text[1 : len(text)-1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key, err := dottedKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		value = strings.TrimSpace(value)
+		// An array continues until its brackets balance
+		for strings.HasPrefix(value, "[") && !balanced(value) && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripComment(strings.TrimRight(lines[i], "\r")))
+		}
+		values, err := flowValue(append(append([]string{}, table...), key...), value, line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, values...)
+	}
+	return entries, nil
+}
+
+func dottedKey(s string) ([]string, error) {
+	var key []string
+	for _, part := range strings.Split(s, ".") {
+		part = strings.TrimSpace(part)
+		if unquoted, err := scalar(part); err == nil && part != "" && (part[0] == '"' || part[0] == '\'') {
+			part = unquoted
+		}
+		if part == "" {
+			return nil, fmt.Errorf("empty key in %q", s)
+		}
+		key = append(key, part)
+	}
+	return key, nil
+}
+
+// flowValue parses a TOML value: a scalar, an array, joined with commas,
+// or an inline table.
+func flowValue(path []string, value string, line int) ([]entry, error) {
+	switch {
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") || !balanced(value) {
+			return nil, fmt.Errorf("line %d: unterminated list", line)
+		}
+		items := []string{}
+		for _, part := range splitFlow(value[1 : len(value)-1]) {
+			item, err := scalar(part)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			items = append(items, item)
+		}
+		return []entry{{key: path, value: strings.Join(items, ","), items: items, line: line}}, nil
+	case strings.HasPrefix(value, "{"):
+		if !strings.HasSuffix(value, "}") {
+			return nil, fmt.Errorf("line %d: unterminated map", line)
+		}
+		var entries []entry
+		for _, part := range splitFlow(value[1 : len(value)-1]) {
+			i := strings.IndexByte(part, '=')
+			if i <= 0 {
+				return nil, fmt.Errorf("line %d: expected key = value in %q", line, part)
+			}
+			v, err := scalar(strings.TrimSpace(part[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			key := append(append([]string{}, path...), strings.TrimSpace(part[:i]))
+			entries = append(entries, entry{key: key, value: v, line: line})
+		}
+		return entries, nil
+	}
+	v, err := scalar(value)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", line, err)
+	}
+	return []entry{{key: path, value: v, line: line}}, nil
+}
+
+// scalar unquotes a double- or single-quoted string; anything else is
+// taken as written.
+func scalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+// splitFlow splits the inside of a flow list or map at the commas outside
+// quotes, brackets and braces, dropping empty parts.
+func splitFlow(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, s[start:])
+	kept := parts[:0]
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// balanced reports whether the brackets of s outside quotes are closed.
+func balanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth == 0
+}
+
+// stripComment cuts a line at a # that starts a comment: outside quotes,
+// at the start of the line or after whitespace.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
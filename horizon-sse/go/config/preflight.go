@@ -0,0 +1,203 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// The modes of a binary's -preflight flag.
+const (
+	// PreflightFail prints the checks and stops the binary if one failed.
+	PreflightFail = "fail"
+	// PreflightWarn prints them and serves anyway.
+	PreflightWarn = "warn"
+	// PreflightOff skips them.
+	PreflightOff = "off"
+)
+
+// The results of a check.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "FAIL"
+)
+
+// DefaultResolveTimeout bounds each DNS lookup of a preflight.
+const DefaultResolveTimeout = 5 * time.Second
+
+// Preflight collects the checks a binary makes on its settings and
+// surroundings before it serves: that they are coherent, that its ports
+// are free and that its upstreams resolve. Every check runs, so a
+// misconfigured binary stops at startup with all of its problems listed,
+// each with what to do about it, rather than on the first one or
+// mid-traffic.
+type Preflight struct {
+	// ResolveTimeout bounds each DNS lookup; DefaultResolveTimeout if zero.
+	ResolveTimeout time.Duration
+	// Resolver looks up upstream hosts; net.DefaultResolver if nil.
+	Resolver *net.Resolver
+
+	checks []Check
+}
+
+// Check is the outcome of one check. Detail says what was found, and for
+// those not ok what to do about it.
+type Check struct {
+	Name   string
+	Result string
+	Detail string
+}
+
+// CheckPreflightMode checks a -preflight setting.
+func CheckPreflightMode(mode string) error {
+	switch mode {
+	case PreflightFail, PreflightWarn, PreflightOff:
+		return nil
+	}
+	return fmt.Errorf("unknown preflight mode %q (want fail, warn or off)", mode)
+}
+
+// OK records a check that passed.
+func (p *Preflight) OK(name, detail string) {
+	p.checks = append(p.checks, Check{Name: name, Result: CheckOK, Detail: detail})
+}
+
+// Warn records a setting that works but likely not as meant, such as one
+// without effect.
+func (p *Preflight) Warn(name, detail string) {
+	p.checks = append(p.checks, Check{Name: name, Result: CheckWarn, Detail: detail})
+}
+
+// Fail records a check that failed.
+func (p *Preflight) Fail(name, detail string) {
+	p.checks = append(p.checks, Check{Name: name, Result: CheckFail, Detail: detail})
+}
+
+// Check records err as a failure of name, or detail as its pass.
+func (p *Preflight) Check(name string, err error, detail string) {
+	if err != nil {
+		p.Fail(name, err.Error())
+		return
+	}
+	p.OK(name, detail)
+}
+
+// Pair checks that the flags a and b, with the values given, are set
+// together or not at all, as a TLS certificate and its key are.
+func (p *Preflight) Pair(name, a, aValue, b, bValue string) {
+	switch {
+	case aValue != "" && bValue == "":
+		p.Fail(name, fmt.Sprintf("-%s is set without -%s; set both or neither", a, b))
+	case aValue == "" && bValue != "":
+		p.Fail(name, fmt.Sprintf("-%s is set without -%s; set both or neither", b, a))
+	case aValue != "":
+		p.OK(name, fmt.Sprintf("-%s and -%s set", a, b))
+	}
+}
+
+// Port checks that the TCP address addr, such as ":10080", can be
+// listened on, by opening and closing a listener on it.
+func (p *Preflight) Port(name, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		detail := err.Error()
+		if errors.Is(err, syscall.EADDRINUSE) {
+			detail = fmt.Sprintf("%s is in use; stop what holds it or pick another port", addr)
+		}
+		p.Fail(name, detail)
+		return
+	}
+	ln.Close()
+	p.OK(name, addr+" free")
+}
+
+// Resolve checks that the host of the URL rawURL resolves. IP addresses
+// pass as they are.
+func (p *Preflight) Resolve(name, rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		p.Fail(name, fmt.Sprintf("%q is not a URL with a host", rawURL))
+		return
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		p.OK(name, host)
+		return
+	}
+	timeout := p.ResolveTimeout
+	if timeout == 0 {
+		timeout = DefaultResolveTimeout
+	}
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		p.Fail(name, fmt.Sprintf("%s does not resolve (%v); check the URL and the DNS of this host", host, err))
+		return
+	}
+	p.OK(name, host+" → "+strings.Join(addrs, ", "))
+}
+
+// Dir checks that dir is a directory files can be created in. An empty dir
+// is the system's temp directory.
+func (p *Preflight) Dir(name, dir string) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		p.Fail(name, fmt.Sprintf("%v; create it or pick another directory", err))
+		return
+	}
+	if !info.IsDir() {
+		p.Fail(name, dir+" is not a directory")
+		return
+	}
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		p.Fail(name, fmt.Sprintf("%s is not writable: %v", dir, err))
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	p.OK(name, dir+" writable")
+}
+
+// Checks returns the checks recorded, in order.
+func (p *Preflight) Checks() []Check {
+	return p.checks
+}
+
+// Err joins the details of the checks that failed, or is nil.
+func (p *Preflight) Err() error {
+	var errs []error
+	for _, c := range p.checks {
+		if c.Result == CheckFail {
+			errs = append(errs, fmt.Errorf("%s: %s", c.Name, c.Detail))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Print writes the checks as a table.
+func (p *Preflight) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, c := range p.checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Name, c.Result, c.Detail)
+	}
+	tw.Flush()
+}
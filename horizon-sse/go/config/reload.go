@@ -0,0 +1,255 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReloadPath is where POST requests reload the config.
+const ReloadPath = "/admin/reload"
+
+// What set off a reload.
+const (
+	TriggerStartup = "startup"
+	TriggerSignal  = "signal"
+	TriggerAdmin   = "admin"
+)
+
+// Resetter is implemented by the values of repeatable flags that can be
+// reloaded: Reset drops the items set so far, before the file sets them
+// again.
+type Resetter interface {
+	Reset()
+}
+
+// Reloader applies the file and environment again while a binary runs, on
+// SIGHUP or a POST to ReloadPath, to the flags the binary can take without
+// a restart. Flags given on the command line keep their value, and a
+// reloadable flag the file and environment no longer set goes back to its
+// default. Changes to the other flags are reported as pending a restart.
+type Reloader struct {
+	fs         *flag.FlagSet
+	reloadable []string
+	apply      func() error
+
+	mu        sync.Mutex
+	log       logrus.FieldLogger
+	effective *Effective
+	stats     ReloadStats
+}
+
+// ReloadStats is the version of the config a binary runs with: Version
+// counts the configs loaded, 1 being the one it started with, and
+// Checksum identifies the values of its flags, so instances running the
+// same config can be told apart from those that are not. Failed counts
+// the reloads refused, LastError says why the last one was.
+type ReloadStats struct {
+	Version        int64     `json:"version"`
+	Checksum       string    `json:"checksum"`
+	LoadedAt       time.Time `json:"loaded_at"`
+	Trigger        string    `json:"trigger"`
+	Failed         int64     `json:"failed"`
+	LastError      string    `json:"last_error,omitempty"`
+	Reloadable     []string  `json:"reloadable"`
+	PendingRestart []string  `json:"pending_restart,omitempty"`
+}
+
+// NewReloader returns a reloader of the flags of fs named reloadable, set
+// as eff, which Apply returned for fs, says. apply takes their new values
+// into the running binary; if it fails, the binary is meant to keep
+// running with what it had.
+func NewReloader(fs *flag.FlagSet, eff *Effective, reloadable []string, apply func() error) (*Reloader, error) {
+	for _, name := range reloadable {
+		f := fs.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("no flag -%s to reload", name)
+		}
+		if _, ok := f.Value.(Repeatable); ok {
+			if _, ok := f.Value.(Resetter); !ok {
+				return nil, fmt.Errorf("repeatable flag -%s cannot be reset for a reload", name)
+			}
+		}
+	}
+	r := &Reloader{
+		fs:         fs,
+		reloadable: slices.Clone(reloadable),
+		apply:      apply,
+		log:        logrus.StandardLogger(),
+		effective:  eff,
+	}
+	slices.Sort(r.reloadable)
+	r.stats = ReloadStats{
+		Version:    1,
+		Checksum:   checksum(fs),
+		LoadedAt:   time.Now(),
+		Trigger:    TriggerStartup,
+		Reloadable: r.reloadable,
+	}
+	return r, nil
+}
+
+// Log records the config applied, as Effective.Log does, and has the
+// reloads that follow logged to log.
+func (r *Reloader) Log(log logrus.FieldLogger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log = log
+	r.effective.Log(log)
+}
+
+// Effective returns the config the binary runs with now.
+func (r *Reloader) Effective() *Effective {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.effective
+}
+
+// Stats returns the version of the config, or nil for a nil reloader, as
+// binaries that cannot reload have.
+func (r *Reloader) Stats() *ReloadStats {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	return &stats
+}
+
+// Reload applies the file and environment again, telling what set it off.
+func (r *Reloader) Reload(trigger string) (ReloadStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fields := logrus.Fields{"trigger": trigger, "file": r.effective.File}
+	pending, err := r.reload()
+	if err != nil {
+		r.stats.Failed++
+		r.stats.LastError = err.Error()
+		r.log.WithFields(fields).WithError(err).Error("Config reload failed, keeping the running config")
+		return r.stats, err
+	}
+	r.stats.Version++
+	r.stats.Checksum = checksum(r.fs)
+	r.stats.LoadedAt = time.Now()
+	r.stats.Trigger = trigger
+	r.stats.LastError = ""
+	r.stats.PendingRestart = pending
+	fields["version"], fields["checksum"] = r.stats.Version, r.stats.Checksum
+	r.log.WithFields(fields).Info("Config reloaded")
+	if len(pending) > 0 {
+		r.log.WithField("flags", pending).Warn("Config changes that need a restart")
+	}
+	return r.stats, nil
+}
+
+// reload sets the reloadable flags again and applies them, returning the
+// other flags whose settings changed.
+func (r *Reloader) reload() ([]string, error) {
+	old := r.effective
+	given := make(map[string]bool)
+	for _, s := range old.Settings {
+		if s.Source == SourceFlag {
+			given[s.Name] = true
+		}
+	}
+	resolved, unknown, err := resolve(r.fs, old.Section, old.File, given)
+	if err != nil {
+		return nil, err
+	}
+
+	// The flags that are not reloaded keep what they were set to
+	running := make(map[string]Setting, len(resolved))
+	var pending []string
+	r.fs.VisitAll(func(f *flag.Flag) {
+		now, set := resolved[f.Name]
+		if slices.Contains(r.reloadable, f.Name) {
+			if set {
+				running[f.Name] = now
+			}
+			return
+		}
+		was, wasSet := old.resolved[f.Name]
+		if wasSet {
+			running[f.Name] = was
+		}
+		if set != wasSet || set && !slices.Equal(now.parts, was.parts) {
+			pending = append(pending, f.Name)
+		}
+	})
+
+	for _, name := range r.reloadable {
+		if given[name] {
+			continue
+		}
+		f := r.fs.Lookup(name)
+		if v, ok := f.Value.(Resetter); ok {
+			v.Reset()
+		} else if err := r.fs.Set(name, f.DefValue); err != nil {
+			return nil, fmt.Errorf("resetting -%s: %w", name, err)
+		}
+		if s, ok := running[name]; ok {
+			if err := set(r.fs, old.File, s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := r.apply(); err != nil {
+		return nil, err
+	}
+	r.effective = effective(r.fs, old.Section, old.File, given, running, unknown)
+	return pending, nil
+}
+
+// ReloadOnSignal reloads whenever the process gets SIGHUP, in the
+// background. Windows has no SIGHUP, so there only ReloadPath reloads.
+func (r *Reloader) ReloadOnSignal() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			r.Reload(TriggerSignal)
+		}
+	}()
+}
+
+// Wrap serves the effective config on Path and reloads it on a POST to
+// ReloadPath, answering with its version, in front of next. A reload
+// refused is answered 422.
+func (r *Reloader) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == Path && req.Method == http.MethodGet:
+			r.Effective().ServeHTTP(w, req)
+		case req.URL.Path == ReloadPath && req.Method == http.MethodPost:
+			stats, err := r.Reload(TriggerAdmin)
+			w.Header().Set("Content-Type", "application/json")
+			if err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+			}
+			json.NewEncoder(w).Encode(stats)
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// checksum hashes the values of the flags of fs.
+func checksum(fs *flag.FlagSet) string {
+	h := sha256.New()
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value.String())
+	})
+	return hex.EncodeToString(h.Sum(nil)[:6])
+}
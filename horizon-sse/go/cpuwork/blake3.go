@@ -0,0 +1,192 @@
+package cpuwork
+
+import "encoding/binary"
+
+// BLAKE3, after its reference implementation: the input is cut into 1 KiB
+// chunks of 64-byte blocks, each chunk is compressed to a chaining value
+// and those are merged pairwise up a binary tree. Only the unkeyed 32-byte
+// hash is needed here.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func rotr(x uint32, n uint) uint32 {
+	return x>>n | x<<(32-n)
+}
+
+func g(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = rotr(s[d]^s[a], 16)
+	s[c] += s[d]
+	s[b] = rotr(s[b]^s[c], 12)
+	s[a] += s[b] + my
+	s[d] = rotr(s[d]^s[a], 8)
+	s[c] += s[d]
+	s[b] = rotr(s[b]^s[c], 7)
+}
+
+func blake3Compress(cv [8]uint32, block [16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := block
+	for round := 0; round < 7; round++ {
+		g(&s, 0, 4, 8, 12, m[0], m[1])
+		g(&s, 1, 5, 9, 13, m[2], m[3])
+		g(&s, 2, 6, 10, 14, m[4], m[5])
+		g(&s, 3, 7, 11, 15, m[6], m[7])
+		g(&s, 0, 5, 10, 15, m[8], m[9])
+		g(&s, 1, 6, 11, 12, m[10], m[11])
+		g(&s, 2, 7, 8, 13, m[12], m[13])
+		g(&s, 3, 4, 9, 14, m[14], m[15])
+		var permuted [16]uint32
+		for i, j := range blake3Permutation {
+			permuted[i] = m[j]
+		}
+		m = permuted
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func first8(s [16]uint32) (cv [8]uint32) {
+	copy(cv[:], s[:8])
+	return cv
+}
+
+func blockWords(block []byte) (words [16]uint32) {
+	var padded [blake3BlockLen]byte
+	copy(padded[:], block)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(padded[4*i:])
+	}
+	return words
+}
+
+// blake3Output is a compression not yet done, so it can be done either for
+// a chaining value or as the root.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o blake3Output) chainingValue() [8]uint32 {
+	return first8(blake3Compress(o.cv, o.block, o.counter, o.blockLen, o.flags))
+}
+
+func (o blake3Output) root() [32]byte {
+	var out [32]byte
+	for i, w := range first8(blake3Compress(o.cv, o.block, 0, o.blockLen, o.flags|flagRoot)) {
+		binary.LittleEndian.PutUint32(out[4*i:], w)
+	}
+	return out
+}
+
+func parentOutput(left, right [8]uint32) blake3Output {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return blake3Output{cv: blake3IV, block: block, blockLen: blake3BlockLen, flags: flagParent}
+}
+
+type chunkState struct {
+	cv         [8]uint32
+	counter    uint64
+	block      [blake3BlockLen]byte
+	blockLen   int
+	compressed int
+}
+
+func newChunkState(counter uint64) *chunkState {
+	return &chunkState{cv: blake3IV, counter: counter}
+}
+
+func (c *chunkState) len() int {
+	return blake3BlockLen*c.compressed + c.blockLen
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.compressed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(input []byte) {
+	for len(input) > 0 {
+		// A full block is compressed only once more input follows, since
+		// the last block of the chunk is compressed differently
+		if c.blockLen == blake3BlockLen {
+			c.cv = first8(blake3Compress(c.cv, blockWords(c.block[:]), c.counter, blake3BlockLen, c.startFlag()))
+			c.compressed++
+			c.block = [blake3BlockLen]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], input)
+		c.blockLen += n
+		input = input[n:]
+	}
+}
+
+func (c *chunkState) output() blake3Output {
+	return blake3Output{
+		cv:       c.cv,
+		block:    blockWords(c.block[:c.blockLen]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | flagChunkEnd,
+	}
+}
+
+// blake3Sum returns the 32-byte BLAKE3 hash of data.
+func blake3Sum(data []byte) [32]byte {
+	chunk := newChunkState(0)
+	var stack [][8]uint32
+	for len(data) > 0 {
+		if chunk.len() == blake3ChunkLen {
+			cv := chunk.output().chainingValue()
+			total := chunk.counter + 1
+			// Merge every subtree this chunk completes
+			for total&1 == 0 {
+				cv = parentOutput(stack[len(stack)-1], cv).chainingValue()
+				stack = stack[:len(stack)-1]
+				total >>= 1
+			}
+			stack = append(stack, cv)
+			chunk = newChunkState(chunk.counter + 1)
+		}
+		n := blake3ChunkLen - chunk.len()
+		if n > len(data) {
+			n = len(data)
+		}
+		chunk.update(data[:n])
+		data = data[n:]
+	}
+	out := chunk.output()
+	for i := len(stack) - 1; i >= 0; i-- {
+		out = parentOutput(stack[i], out.chainingValue())
+	}
+	return out.root()
+}
@@ -0,0 +1,137 @@
+// Package cpuwork is the synthetic CPU load the CPU-intensive deep server
+// spends on each token it streams, standing in for the compute of a real
+// model: a chain of hashes over the token, a prime sieve and some floating
+// point math. The hash and the length of the chain are configurable, and a
+// FIPS configuration refuses the hashes that are not FIPS-approved, for
+// deployment targets that allow only validated crypto modules.
+package cpuwork
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Hashes the work can chain.
+const (
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+	// BLAKE3 is not FIPS-approved.
+	BLAKE3 = "blake3"
+)
+
+const (
+	// DefaultIterations is how many times a token is hashed again.
+	DefaultIterations = 100
+	// DefaultPrimes is the limit of the prime sieve.
+	DefaultPrimes = 1000
+)
+
+// Config is how much work is done per token, and with which hash.
+type Config struct {
+	// Hash is SHA256, SHA512 or BLAKE3; SHA256 if empty.
+	Hash string
+	// Iterations is how many times the hash is applied again to its own
+	// sum, DefaultIterations if 0.
+	Iterations int
+	// Primes is the limit of the prime sieve, DefaultPrimes if 0.
+	Primes int
+	// FIPS refuses a hash that is not FIPS-approved.
+	FIPS bool
+}
+
+// Approved reports whether hash is FIPS-approved (FIPS 180-4).
+func Approved(hash string) bool {
+	switch strings.ToLower(hash) {
+	case "", SHA256, SHA512:
+		return true
+	}
+	return false
+}
+
+// Worker does the work of a Config.
+type Worker struct {
+	hash       string
+	sum        func([]byte) []byte
+	iterations int
+	primes     int
+}
+
+// New returns a worker for cfg.
+func New(cfg Config) (*Worker, error) {
+	w := &Worker{hash: strings.ToLower(cfg.Hash), iterations: cfg.Iterations, primes: cfg.Primes}
+	switch w.hash {
+	case "", SHA256:
+		w.hash = SHA256
+		w.sum = func(b []byte) []byte { s := sha256.Sum256(b); return s[:] }
+	case SHA512:
+		w.sum = func(b []byte) []byte { s := sha512.Sum512(b); return s[:] }
+	case BLAKE3:
+		w.sum = func(b []byte) []byte { s := blake3Sum(b); return s[:] }
+	default:
+		return nil, fmt.Errorf("unknown hash %q, want %s, %s or %s", cfg.Hash, SHA256, SHA512, BLAKE3)
+	}
+	if cfg.FIPS && !Approved(w.hash) {
+		return nil, fmt.Errorf("hash %s is not FIPS-approved", w.hash)
+	}
+	if w.iterations < 0 || w.primes < 0 {
+		return nil, fmt.Errorf("negative iterations or prime limit")
+	}
+	if w.iterations == 0 {
+		w.iterations = DefaultIterations
+	}
+	if w.primes == 0 {
+		w.primes = DefaultPrimes
+	}
+	return w, nil
+}
+
+// Hash is the name of the hash w chains.
+func (w *Worker) Hash() string {
+	return w.hash
+}
+
+// Checksum does the work for data and returns the hex of the last hash.
+func (w *Worker) Checksum(data string) string {
+	sum := w.sum([]byte(data))
+	for i := 0; i < w.iterations; i++ {
+		sum = w.sum(sum)
+	}
+
+	_ = Primes(w.primes)
+
+	result := 0.0
+	for i := 1; i <= 100; i++ {
+		result += math.Sqrt(float64(i)) * math.Sin(float64(i))
+	}
+
+	return hex.EncodeToString(sum)
+}
+
+// Primes returns the primes up to limit, by the sieve of Eratosthenes.
+func Primes(limit int) []int {
+	if limit < 2 {
+		return []int{}
+	}
+	sieve := make([]bool, limit+1)
+	for i := 2; i <= limit; i++ {
+		sieve[i] = true
+	}
+	for i := 2; i*i <= limit; i++ {
+		if sieve[i] {
+			for j := i * i; j <= limit; j += i {
+				sieve[j] = false
+			}
+		}
+	}
+	primes := []int{}
+	for i := 2; i <= limit; i++ {
+		if sieve[i] {
+			primes = append(primes, i)
+		}
+	}
+	return primes
+}
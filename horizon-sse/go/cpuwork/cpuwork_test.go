@@ -0,0 +1,81 @@
+package cpuwork
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"testing"
+)
+
+func TestBLAKE3(t *testing.T) {
+	// The official test vectors hash the repeating bytes 0..250
+	pattern := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		input []byte
+		want  string
+	}{
+		{nil, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{[]byte("abc"), "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{pattern(1), "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{pattern(1024), "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{pattern(1025), "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{pattern(2048), "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{pattern(3072), "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+	} {
+		sum := blake3Sum(tc.input)
+		if got := hex.EncodeToString(sum[:]); got != tc.want {
+			t.Errorf("BLAKE3 of %d bytes: %s, want %s", len(tc.input), got, tc.want)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	sum := sha512.Sum512([]byte("token"))
+	for i := 0; i < 3; i++ {
+		sum = sha512.Sum512(sum[:])
+	}
+	w, err := New(Config{Hash: "SHA512", Iterations: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Checksum("token"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha512 checksum %s", got)
+	}
+
+	w, _ = New(Config{})
+	sum256 := sha256.Sum256([]byte("token"))
+	for i := 0; i < DefaultIterations; i++ {
+		sum256 = sha256.Sum256(sum256[:])
+	}
+	if got := w.Checksum("token"); w.Hash() != SHA256 || got != hex.EncodeToString(sum256[:]) {
+		t.Errorf("default checksum %s %s", w.Hash(), got)
+	}
+	if w, err := New(Config{Hash: BLAKE3, Iterations: 1}); err != nil || len(w.Checksum("token")) != 64 {
+		t.Errorf("blake3: %v", err)
+	}
+}
+
+func TestFIPS(t *testing.T) {
+	if _, err := New(Config{Hash: BLAKE3, FIPS: true}); err == nil {
+		t.Error("blake3 accepted under FIPS")
+	}
+	for _, hash := range []string{"", SHA256, SHA512} {
+		if _, err := New(Config{Hash: hash, FIPS: true}); err != nil {
+			t.Errorf("%q refused under FIPS: %v", hash, err)
+		}
+	}
+	for _, cfg := range []Config{{Hash: "md5"}, {Iterations: -1}} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+	if got := len(Primes(100)); got != 25 {
+		t.Errorf("%d primes up to 100", got)
+	}
+}
@@ -4,7 +4,8 @@ go 1.21
 
 require (
 	github.com/gorilla/mux v1.8.1
+	github.com/klauspost/compress v1.17.11
 	github.com/sirupsen/logrus v1.9.3
 )
 
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
\ No newline at end of file
+require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
@@ -0,0 +1,220 @@
+// Package grpcapi serves the streamed chat completion API over gRPC, for
+// teams that use gRPC internally, by bridging it to the SSE handlers the
+// deep server and proxy already have. The messages are those of
+// chat.proto, encoded by hand since they are few; their JSON tags are the
+// OpenAI field names, so a chunk converts to and from the JSON of an SSE
+// event directly.
+package grpcapi
+
+// StreamChatCompletionPath is the HTTP/2 path of the ChatService's
+// StreamChatCompletion method.
+const StreamChatCompletionPath = "/horizon.v1.ChatService/StreamChatCompletion"
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ChatCompletionRequest struct {
+	Model     string        `json:"model,omitempty"`
+	Messages  []ChatMessage `json:"messages"`
+	MaxTokens int32         `json:"max_tokens,omitempty"`
+	// TokenDelayMs travels in the query over SSE, not the JSON body.
+	TokenDelayMs int32 `json:"-"`
+}
+
+type Delta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type Choice struct {
+	Index int32 `json:"index"`
+	Delta Delta `json:"delta"`
+	// FinishReason is nil until the last chunk; it is sent as an empty
+	// string over gRPC.
+	FinishReason *string `json:"finish_reason"`
+}
+
+type ChatCompletionChunk struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Choices []Choice `json:"choices"`
+}
+
+func (m *ChatMessage) Marshal() []byte {
+	b := appendString(nil, 1, m.Role)
+	return appendString(b, 2, m.Content)
+}
+
+func (m *ChatMessage) Unmarshal(b []byte) error {
+	*m = ChatMessage{}
+	return decodeFields(b, func(d *decoder, field, wire int) error {
+		switch field {
+		case 1:
+			return d.string(wire, &m.Role)
+		case 2:
+			return d.string(wire, &m.Content)
+		}
+		return d.skip(wire)
+	})
+}
+
+func (m *ChatCompletionRequest) Marshal() []byte {
+	b := appendString(nil, 1, m.Model)
+	for i := range m.Messages {
+		b = appendMessage(b, 2, m.Messages[i].Marshal())
+	}
+	b = appendInt(b, 3, int64(m.MaxTokens))
+	return appendInt(b, 4, int64(m.TokenDelayMs))
+}
+
+func (m *ChatCompletionRequest) Unmarshal(b []byte) error {
+	*m = ChatCompletionRequest{}
+	return decodeFields(b, func(d *decoder, field, wire int) error {
+		switch field {
+		case 1:
+			return d.string(wire, &m.Model)
+		case 2:
+			var msg ChatMessage
+			if err := d.message(wire, &msg); err != nil {
+				return err
+			}
+			m.Messages = append(m.Messages, msg)
+			return nil
+		case 3:
+			return d.int32(wire, &m.MaxTokens)
+		case 4:
+			return d.int32(wire, &m.TokenDelayMs)
+		}
+		return d.skip(wire)
+	})
+}
+
+func (m *Delta) Marshal() []byte {
+	b := appendString(nil, 1, m.Role)
+	return appendString(b, 2, m.Content)
+}
+
+func (m *Delta) Unmarshal(b []byte) error {
+	*m = Delta{}
+	return decodeFields(b, func(d *decoder, field, wire int) error {
+		switch field {
+		case 1:
+			return d.string(wire, &m.Role)
+		case 2:
+			return d.string(wire, &m.Content)
+		}
+		return d.skip(wire)
+	})
+}
+
+func (m *Choice) Marshal() []byte {
+	b := appendInt(nil, 1, int64(m.Index))
+	b = appendMessage(b, 2, m.Delta.Marshal())
+	if m.FinishReason != nil {
+		b = appendString(b, 3, *m.FinishReason)
+	}
+	return b
+}
+
+func (m *Choice) Unmarshal(b []byte) error {
+	*m = Choice{}
+	return decodeFields(b, func(d *decoder, field, wire int) error {
+		switch field {
+		case 1:
+			return d.int32(wire, &m.Index)
+		case 2:
+			return d.message(wire, &m.Delta)
+		case 3:
+			var reason string
+			if err := d.string(wire, &reason); err != nil {
+				return err
+			}
+			if reason != "" {
+				m.FinishReason = &reason
+			}
+			return nil
+		}
+		return d.skip(wire)
+	})
+}
+
+func (m *ChatCompletionChunk) Marshal() []byte {
+	b := appendString(nil, 1, m.ID)
+	b = appendString(b, 2, m.Object)
+	b = appendInt(b, 3, m.Created)
+	b = appendString(b, 4, m.Model)
+	for i := range m.Choices {
+		b = appendMessage(b, 5, m.Choices[i].Marshal())
+	}
+	return b
+}
+
+func (m *ChatCompletionChunk) Unmarshal(b []byte) error {
+	*m = ChatCompletionChunk{}
+	return decodeFields(b, func(d *decoder, field, wire int) error {
+		switch field {
+		case 1:
+			return d.string(wire, &m.ID)
+		case 2:
+			return d.string(wire, &m.Object)
+		case 3:
+			v, _, ok, err := d.value(wire, wireVarint)
+			if ok {
+				m.Created = int64(v)
+			}
+			return err
+		case 4:
+			return d.string(wire, &m.Model)
+		case 5:
+			var choice Choice
+			if err := d.message(wire, &choice); err != nil {
+				return err
+			}
+			m.Choices = append(m.Choices, choice)
+			return nil
+		}
+		return d.skip(wire)
+	})
+}
+
+// decodeFields calls field for each field of the encoded message b.
+func decodeFields(b []byte, field func(d *decoder, field, wire int) error) error {
+	d := &decoder{b: b}
+	for {
+		n, wire, ok, err := d.next()
+		if err != nil || !ok {
+			return err
+		}
+		if err := field(d, n, wire); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *decoder) string(wire int, s *string) error {
+	_, b, ok, err := d.value(wire, wireBytes)
+	if ok {
+		*s = string(b)
+	}
+	return err
+}
+
+func (d *decoder) int32(wire int, v *int32) error {
+	u, _, ok, err := d.value(wire, wireVarint)
+	if ok {
+		*v = int32(u)
+	}
+	return err
+}
+
+func (d *decoder) message(wire int, m interface{ Unmarshal([]byte) error }) error {
+	_, b, ok, err := d.value(wire, wireBytes)
+	if !ok {
+		return err
+	}
+	return m.Unmarshal(b)
+}
@@ -0,0 +1,135 @@
+package grpcapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	stop := "stop"
+	chunks := []ChatCompletionChunk{
+		{ID: "c1", Object: "chat.completion.chunk", Created: 1700000000, Model: "gpt-4", Choices: []Choice{{Delta: Delta{Role: "assistant", Content: "héllo"}}}},
+		{ID: "c1", Choices: []Choice{{Index: 1, FinishReason: &stop}}},
+	}
+	for _, want := range chunks {
+		var got ChatCompletionChunk
+		// A field from a newer schema is skipped
+		msg := appendString(want.Marshal(), 99, "unknown")
+		if err := got.Unmarshal(msg); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	req := ChatCompletionRequest{Model: "m", Messages: []ChatMessage{{Role: "user", Content: "hi"}}, MaxTokens: 5, TokenDelayMs: 10}
+	var got ChatCompletionRequest
+	if err := got.Unmarshal(req.Marshal()); err != nil || !reflect.DeepEqual(got, req) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	if err := got.Unmarshal(req.Marshal()[:4]); err == nil {
+		t.Error("truncated message decoded")
+	}
+}
+
+// serve serves h as the method and returns a client of it that speaks SSE.
+func serve(t *testing.T, h http.HandlerFunc) (*http.Client, string) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(Handler("/stream", h))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return &http.Client{Transport: &SSETransport{Base: srv.Client().Transport}}, srv.URL
+}
+
+func TestHandler(t *testing.T) {
+	client, url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/stream" || r.URL.Query().Get("token_delay_ms") != "20" || r.Header.Get("X-Stream-ID") != "s1" ||
+			string(body) != `{"model":"m","messages":[{"role":"user","content":"one\ntwo"}],"max_tokens":3,"stream":true}` {
+			t.Errorf("handler got %s with X-Stream-ID %q and %s", r.URL, r.Header.Get("X-Stream-ID"), body)
+		}
+		fmt.Fprint(w, ": connected\n\nevent: meta\ndata: {}\n\n")
+		fmt.Fprint(w, `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":null}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`+"\n\ndata: [DONE]\n\n")
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, url+"/v1/chat/completions?token_delay_ms=20",
+		strings.NewReader(`{"model":"m","messages":[{"role":"user","content":[{"type":"text","text":"one"},{"type":"text","text":"two"}]}],"max_tokens":3,"stream":true}`))
+	req.Header.Set("X-Stream-ID", "s1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, %v", resp.StatusCode, err)
+	}
+	want := `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":null}]}` + "\n\n" +
+		`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}` + "\n\n" +
+		"data: [DONE]\n\n"
+	if string(got) != want {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestHandlerErrorStatus(t *testing.T) {
+	client, url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded: 100%", http.StatusServiceUnavailable)
+	})
+
+	resp, err := client.Post(url+"/v1/chat/completions", "application/json", strings.NewReader(`{"messages":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "overloaded: 100%" {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestHandlerErrorEvent(t *testing.T) {
+	client, url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `data: {"id":"c1","choices":[]}`+"\n\n")
+		event, _ := json.Marshal(map[string]interface{}{"status": 429, "message": "slow down"})
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", event)
+	})
+
+	resp, err := client.Post(url+"/v1/chat/completions", "application/json", strings.NewReader(`{"messages":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	var status *Status
+	if !errors.As(err, &status) || status.Code != ResourceExhausted || status.Message != "slow down" {
+		t.Errorf("got %v", err)
+	}
+	if !strings.HasPrefix(string(got), `data: {"id":"c1"`) {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestHandlerRefusesHTTP1(t *testing.T) {
+	srv := httptest.NewServer(Handler("/stream", http.NotFoundHandler()))
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+StreamChatCompletionPath, "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
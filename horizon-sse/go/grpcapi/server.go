@@ -0,0 +1,297 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler serves StreamChatCompletion with h, an SSE handler of streamed
+// chat completions at path such as the deep server's /v1/chat/completions.
+// The gRPC request becomes the JSON request h is POSTed, with the call's
+// metadata as its headers and token_delay_ms in its query, and each chunk
+// h streams a message of the response. The call ends with status OK where
+// h sends [DONE]; an error status h answers with, or an error event it
+// sends, becomes the gRPC status of the same meaning. Other events, such
+// as the proxy's comments and meta events, have no place in the stream
+// and are dropped. h's request is cancelled when the call is.
+func Handler(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "expected a gRPC request", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		rw := &responseWriter{w: w, flusher: w.(http.Flusher)}
+		msg, err := readMessage(r.Body)
+		if err != nil {
+			rw.fail(&Status{Code: InvalidArgument, Message: "reading request: " + err.Error()})
+			return
+		}
+		var req ChatCompletionRequest
+		if err := req.Unmarshal(msg); err != nil {
+			rw.fail(&Status{Code: InvalidArgument, Message: err.Error()})
+			return
+		}
+		if req.Messages == nil {
+			req.Messages = []ChatMessage{}
+		}
+		body, err := json.Marshal(struct {
+			*ChatCompletionRequest
+			Stream bool `json:"stream"`
+		}{&req, true})
+		if err != nil {
+			rw.fail(&Status{Code: Internal, Message: err.Error()})
+			return
+		}
+
+		ctx := r.Context()
+		if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		inner := r.Clone(ctx)
+		inner.URL.Path = path
+		inner.URL.RawQuery = ""
+		if req.TokenDelayMs > 0 {
+			inner.URL.RawQuery = "token_delay_ms=" + strconv.Itoa(int(req.TokenDelayMs))
+		}
+		inner.RequestURI = inner.URL.RequestURI()
+		for _, name := range []string{"Te", "Grpc-Timeout", "Grpc-Encoding", "Grpc-Accept-Encoding"} {
+			inner.Header.Del(name)
+		}
+		inner.Header.Set("Content-Type", "application/json")
+		inner.Header.Set("Accept", "text/event-stream")
+		inner.Body = io.NopCloser(bytes.NewReader(body))
+		inner.ContentLength = int64(len(body))
+		inner.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+
+		// A handler aborting its response resets the call, as it would
+		// the HTTP/2 stream of an SSE response
+		h.ServeHTTP(rw, inner)
+		if ctx.Err() == context.DeadlineExceeded && rw.err == nil {
+			rw.failure = &Status{Code: DeadlineExceeded, Message: "deadline exceeded"}
+		}
+		rw.finish()
+	})
+}
+
+// parseTimeout reads a Grpc-Timeout, such as 500m or 10S.
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[value[len(value)-1]]
+	return time.Duration(n) * unit, ok
+}
+
+// responseWriter turns what an SSE handler writes into gRPC messages, one
+// per chunk.
+type responseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	header  http.Header
+	status  int
+	started bool         // the response headers are out
+	pending []byte       // SSE text short of a whole event
+	errBody bytes.Buffer // the body of an error response
+	failure *Status      // from an error event
+	err     error
+}
+
+// maxErrorBody caps the error response kept as a status message.
+const maxErrorBody = 4 << 10
+
+func (w *responseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.status != http.StatusOK {
+		if w.errBody.Len() < maxErrorBody {
+			w.errBody.Write(p)
+		}
+		return len(p), nil
+	}
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.Index(w.pending, []byte("\n\n"))
+		if i < 0 {
+			break
+		}
+		block := string(w.pending[:i])
+		w.pending = w.pending[i+2:]
+		if err := w.send(block); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush does nothing: each chunk is sent as soon as it is whole.
+func (w *responseWriter) Flush() {}
+
+// Unwrap lets http.ResponseController reach the call's connection, to
+// lift its write deadline for a long stream.
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.w }
+
+// send sends the chunk of one SSE event block as a message.
+func (w *responseWriter) send(block string) error {
+	var event string
+	var data []string
+	for _, line := range strings.Split(block, "\n") {
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	payload := strings.Join(data, "\n")
+	switch {
+	case event == "error":
+		w.failure = errorEventStatus(payload)
+		return nil
+	case event != "" && event != "message", data == nil, payload == "[DONE]":
+		return nil
+	}
+	var chunk ChatCompletionChunk
+	if json.Unmarshal([]byte(payload), &chunk) != nil {
+		return nil
+	}
+	w.start()
+	if err := writeMessage(w.w, chunk.Marshal()); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+// errorEventStatus reads an error event, in the proxy's shape, with the
+// upstream status and a message, or OpenAI's and Anthropic's, with the
+// message under "error".
+func errorEventStatus(data string) *Status {
+	var event struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Error   struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(data), &event) != nil {
+		return &Status{Code: Internal, Message: data}
+	}
+	status := &Status{Code: Internal, Message: event.Message}
+	if event.Status != 0 {
+		status.Code = codeForHTTP(event.Status)
+	}
+	if status.Message == "" {
+		status.Message = event.Error.Message
+	}
+	return status
+}
+
+// start sends the response headers, once.
+func (w *responseWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.copyHeader()
+	w.w.WriteHeader(http.StatusOK)
+}
+
+// copyHeader sets the call's headers: the handler's own, such as
+// X-Stream-ID, but not those describing its SSE response.
+func (w *responseWriter) copyHeader() {
+	for name, values := range w.header {
+		switch name {
+		case "Content-Type", "Content-Length", "Cache-Control", "Connection", "Keep-Alive", "Transfer-Encoding", "Trailer":
+		default:
+			if !strings.HasPrefix(name, http.TrailerPrefix) {
+				w.w.Header()[name] = values
+			}
+		}
+	}
+	w.w.Header().Set("Content-Type", "application/grpc")
+}
+
+// fail ends a call that has not started with status: the response is
+// trailers only.
+func (w *responseWriter) fail(status *Status) {
+	w.failure = status
+	w.finish()
+}
+
+// finish ends the call with the handler's outcome: status OK, unless it
+// answered with an error status or sent an error event.
+func (w *responseWriter) finish() {
+	if w.err != nil {
+		return
+	}
+	if w.status == http.StatusOK && len(bytes.TrimSpace(w.pending)) > 0 {
+		if err := w.send(string(w.pending)); err != nil {
+			return
+		}
+	}
+	status := w.failure
+	if w.status != 0 && w.status != http.StatusOK {
+		status = &Status{Code: codeForHTTP(w.status), Message: strings.TrimSpace(w.errBody.String())}
+	}
+	code, message := OK, ""
+	if status != nil {
+		code, message = status.Code, status.Message
+	}
+
+	// Before any message the status goes in the headers, as gRPC's
+	// trailers-only response; after, in trailers
+	prefix := ""
+	if w.started {
+		prefix = http.TrailerPrefix
+	} else {
+		w.copyHeader()
+	}
+	w.w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(int(code)))
+	if message != "" {
+		w.w.Header().Set(prefix+"Grpc-Message", encodeMessage(message))
+	}
+	if !w.started {
+		w.w.WriteHeader(http.StatusOK)
+	}
+}
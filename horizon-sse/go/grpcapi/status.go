@@ -0,0 +1,142 @@
+package grpcapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Code is a gRPC status code.
+type Code int
+
+const (
+	OK                Code = 0
+	Canceled          Code = 1
+	Unknown           Code = 2
+	InvalidArgument   Code = 3
+	DeadlineExceeded  Code = 4
+	NotFound          Code = 5
+	PermissionDenied  Code = 7
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+	Unauthenticated   Code = 16
+)
+
+// Status is a stream's gRPC status other than OK, as an error.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", s.Code, s.Message)
+}
+
+// codeForHTTP maps the status an SSE handler answered with to the gRPC
+// code of the same meaning, as grpc-gateway does the other way.
+func codeForHTTP(status int) Code {
+	switch status {
+	case http.StatusOK:
+		return OK
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return InvalidArgument
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusTooManyRequests:
+		return ResourceExhausted
+	case 499:
+		return Canceled
+	case http.StatusNotImplemented:
+		return Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return Unavailable
+	case http.StatusGatewayTimeout:
+		return DeadlineExceeded
+	}
+	if status >= 500 {
+		return Internal
+	}
+	return Unknown
+}
+
+// httpForCode maps a gRPC code back to an HTTP status, so a gRPC upstream
+// fails the way an SSE one would.
+func httpForCode(code Code) int {
+	switch code {
+	case OK:
+		return http.StatusOK
+	case InvalidArgument:
+		return http.StatusBadRequest
+	case Unauthenticated:
+		return http.StatusUnauthorized
+	case PermissionDenied:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case ResourceExhausted:
+		return http.StatusTooManyRequests
+	case Canceled:
+		return 499
+	case Unimplemented:
+		return http.StatusNotImplemented
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	case DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// parseStatus reads the Grpc-Status and Grpc-Message of h, headers or
+// trailers; ok is false if they have none.
+func parseStatus(h http.Header) (status *Status, ok bool) {
+	value := h.Get("Grpc-Status")
+	if value == "" {
+		return nil, false
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return &Status{Code: Unknown, Message: "invalid grpc-status " + strconv.Quote(value)}, true
+	}
+	if code == int(OK) {
+		return nil, true
+	}
+	return &Status{Code: Code(code), Message: decodeMessage(h.Get("Grpc-Message"))}, true
+}
+
+// encodeMessage percent-encodes a Grpc-Message as the gRPC spec asks:
+// everything but printable ASCII, and the percent sign itself.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func decodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if c, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,212 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NewRequest builds the StreamChatCompletion call of msg to the server at
+// baseURL, which must be https: gRPC runs over HTTP/2, which Go's client
+// only speaks over TLS.
+func NewRequest(ctx context.Context, baseURL string, msg *ChatCompletionRequest) (*http.Request, error) {
+	var body bytes.Buffer
+	writeMessage(&body, msg.Marshal())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+StreamChatCompletionPath, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	return req, nil
+}
+
+// NewTransport returns a transport for gRPC calls. insecure skips
+// verifying the server's certificate, such as the self-signed one a deep
+// server makes for itself.
+func NewTransport(insecure bool) *http.Transport {
+	return &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecure},
+	}
+}
+
+// SSETransport sends the JSON requests of chat completion streams as
+// StreamChatCompletion calls to the same host, and answers them as the
+// SSE endpoint would, so code written for SSE upstreams can stream from a
+// gRPC one: each message becomes a data event of its chunk's JSON, and
+// status OK a data: [DONE]. A call failing before its first message is
+// answered with the HTTP status of its gRPC one and the message as the
+// body; one failing later fails the body's read with a *Status.
+type SSETransport struct {
+	// Base sends the calls; it must speak HTTP/2, as NewTransport's does.
+	Base http.RoundTripper
+}
+
+func (t *SSETransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	msg, err := chatRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	u := *req.URL
+	u.Path, u.RawQuery = "", ""
+	call, err := NewRequest(req.Context(), u.String(), msg)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Type", "Content-Length", "Accept", "Accept-Encoding":
+		default:
+			call.Header[name] = values
+		}
+	}
+	resp, err := t.Base.RoundTrip(call)
+	if err != nil {
+		return nil, err
+	}
+	return sseResponse(resp, req), nil
+}
+
+// chatRequest reads the JSON body of req, and token_delay_ms from its
+// query, as the message of a call. Content given as an array of parts is
+// sent as their text.
+func chatRequest(req *http.Request) (*ChatCompletionRequest, error) {
+	msg := &ChatCompletionRequest{}
+	if ms, err := strconv.Atoi(req.URL.Query().Get("token_delay_ms")); err == nil {
+		msg.TokenDelayMs = int32(ms)
+	}
+	if req.Body == nil {
+		return msg, nil
+	}
+	defer req.Body.Close()
+	var body struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+		MaxTokens int32 `json:"max_tokens"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("grpcapi: reading chat request: %w", err)
+	}
+	msg.Model, msg.MaxTokens = body.Model, body.MaxTokens
+	for _, m := range body.Messages {
+		var content string
+		if json.Unmarshal(m.Content, &content) != nil {
+			var parts []struct {
+				Text string `json:"text"`
+			}
+			json.Unmarshal(m.Content, &parts)
+			var texts []string
+			for _, part := range parts {
+				texts = append(texts, part.Text)
+			}
+			content = strings.Join(texts, "\n")
+		}
+		msg.Messages = append(msg.Messages, ChatMessage{Role: m.Role, Content: content})
+	}
+	return msg, nil
+}
+
+// sseResponse answers req, an SSE request, with resp, the response to its
+// call.
+func sseResponse(resp *http.Response, req *http.Request) *http.Response {
+	sse := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        http.Header{"Content-Type": {"text/event-stream"}},
+		ContentLength: -1,
+		Request:       req,
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Not answered by gRPC, such as a 404 from a server without the
+		// method
+		resp.Request = req
+		return resp
+	}
+	if status, ok := parseStatus(resp.Header); ok {
+		resp.Body.Close()
+		if status == nil {
+			sse.Body = io.NopCloser(strings.NewReader("data: [DONE]\n\n"))
+			return sse
+		}
+		sse.StatusCode = httpForCode(status.Code)
+		sse.Status = fmt.Sprintf("%d %s", sse.StatusCode, http.StatusText(sse.StatusCode))
+		sse.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		sse.Body = io.NopCloser(strings.NewReader(status.Message))
+		return sse
+	}
+	// The server's own headers, and trailers once the body is read, are
+	// the stream's, as they would be over SSE
+	for name, values := range resp.Header {
+		if name != "Content-Type" && !strings.HasPrefix(name, "Grpc-") {
+			sse.Header[name] = values
+		}
+	}
+	sse.Trailer = resp.Trailer
+	sse.Body = &sseBody{resp: resp}
+	return sse
+}
+
+// sseBody reads the messages of a call as SSE text.
+type sseBody struct {
+	resp *http.Response
+	buf  bytes.Buffer
+	err  error
+}
+
+func (b *sseBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		msg, err := readMessage(b.resp.Body)
+		if err == io.EOF {
+			// The trailers are in once the body is read
+			status, ok := parseStatus(b.resp.Trailer)
+			switch {
+			case !ok:
+				b.err = errors.New("grpcapi: call ended without a status")
+			case status != nil:
+				b.err = status
+			default:
+				b.buf.WriteString("data: [DONE]\n\n")
+				b.err = io.EOF
+			}
+			continue
+		}
+		if err != nil {
+			b.err = err
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if err := chunk.Unmarshal(msg); err != nil {
+			b.err = err
+			continue
+		}
+		data, err := json.Marshal(&chunk)
+		if err != nil {
+			b.err = err
+			continue
+		}
+		fmt.Fprintf(&b.buf, "data: %s\n\n", data)
+	}
+	return b.buf.Read(p)
+}
+
+func (b *sseBody) Close() error {
+	return b.resp.Body.Close()
+}
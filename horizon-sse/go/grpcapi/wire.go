@@ -0,0 +1,163 @@
+package grpcapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The protobuf wire types the messages use.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendTag(b []byte, field, wire int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+// appendString appends a string field, left out when empty as proto3 does.
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendInt appends an int32 or int64 field, left out when zero.
+func appendInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, uint64(v))
+}
+
+// appendMessage appends an embedded message field, even an empty one.
+func appendMessage(b []byte, field int, msg []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+var errTruncated = errors.New("grpcapi: truncated protobuf message")
+
+// decoder walks the fields of an encoded message.
+type decoder struct {
+	b []byte
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// next reads the tag of the next field; ok is false at the end.
+func (d *decoder) next() (field, wire int, ok bool, err error) {
+	if len(d.b) == 0 {
+		return 0, 0, false, nil
+	}
+	tag, err := d.varint()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return int(tag >> 3), int(tag & 7), true, nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.b)) {
+		return nil, errTruncated
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// skip passes over the value of a field the message does not know, as
+// protobuf requires for compatibility with newer schemas.
+func (d *decoder) skip(wire int) error {
+	switch wire {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	case 1, 5: // fixed64, fixed32
+		size := 8
+		if wire == 5 {
+			size = 4
+		}
+		if len(d.b) < size {
+			return errTruncated
+		}
+		d.b = d.b[size:]
+		return nil
+	}
+	return fmt.Errorf("grpcapi: unsupported wire type %d", wire)
+}
+
+// value reads a field of the wire type want, skipping it and returning
+// ok false when it has another.
+func (d *decoder) value(wire, want int) (v uint64, b []byte, ok bool, err error) {
+	if wire != want {
+		return 0, nil, false, d.skip(wire)
+	}
+	if wire == wireVarint {
+		v, err = d.varint()
+	} else {
+		b, err = d.bytes()
+	}
+	return v, b, err == nil, err
+}
+
+// MaxMessageBytes caps the gRPC messages read, as gRPC's default receive
+// limit does.
+const MaxMessageBytes = 4 << 20
+
+// writeMessage writes msg as one uncompressed gRPC length-prefixed message.
+func writeMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// readMessage reads one gRPC length-prefixed message. It returns io.EOF at
+// a clean end of the stream and io.ErrUnexpectedEOF inside a message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("grpcapi: compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > MaxMessageBytes {
+		return nil, fmt.Errorf("grpcapi: message of %d bytes exceeds %d", n, MaxMessageBytes)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
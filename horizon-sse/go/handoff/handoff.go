@@ -0,0 +1,232 @@
+// Package handoff lets a new copy of a server binary take over the
+// listening sockets of the running one, so a deploy can swap binaries while
+// the old process finishes its long-lived streams.
+//
+// The running process starts the new binary with its listeners passed as
+// extra file descriptors and waits until the child reports that it is
+// serving. It can then stop accepting and drain. Passing descriptors needs
+// a Unix; on Windows listeners open as usual and Upgrade fails.
+package handoff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	envListeners = "HORIZON_HANDOFF_LISTENERS"
+	envReadyFD   = "HORIZON_HANDOFF_READY_FD"
+
+	// First descriptor number used for ExtraFiles in the child.
+	firstExtraFD = 3
+)
+
+// Upgrader keeps track of the listeners that will be passed on and of the
+// ones inherited from a parent.
+type Upgrader struct {
+	// ReadyTimeout bounds how long Upgrade waits for the child to call Ready.
+	ReadyTimeout time.Duration
+	// ListenConfig opens the listeners not inherited from a parent. Socket
+	// options it sets stay with the listener through handoffs.
+	ListenConfig net.ListenConfig
+
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners []*os.File
+	ready     *os.File
+	upgrading bool
+}
+
+// New returns an Upgrader, picking up any listeners passed by a parent.
+func New() (*Upgrader, error) {
+	u := &Upgrader{
+		ReadyTimeout: 30 * time.Second,
+		inherited:    make(map[string]*os.File),
+	}
+
+	n, _ := strconv.Atoi(os.Getenv(envListeners))
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(firstExtraFD+i), "inherited-listener")
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("handoff: inherited fd %d: %w", firstExtraFD+i, err)
+		}
+		u.inherited[ln.Addr().String()] = f
+		ln.Close()
+	}
+	if fd, err := strconv.Atoi(os.Getenv(envReadyFD)); err == nil {
+		u.ready = os.NewFile(uintptr(fd), "handoff-ready")
+	}
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReadyFD)
+
+	return u, nil
+}
+
+// Inheriting reports whether this process was started by Upgrade with
+// listeners to take over, whose ports are then rightly in use. It only
+// tells before New, which consumes them.
+func Inheriting() bool {
+	return os.Getenv(envListeners) != ""
+}
+
+// HasParent reports whether this process was started by Upgrade.
+func (u *Upgrader) HasParent() bool {
+	return u.ready != nil
+}
+
+// Listen returns the listener for addr inherited from the parent, or opens a
+// new one. Only listeners obtained here are handed to the next binary. A
+// unix socket left behind by a process that is gone is replaced; the
+// ListenConfig's socket options only apply to TCP.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for key, f := range u.inherited {
+		if sameAddr(key, addr) {
+			delete(u.inherited, key)
+			ln, err := net.FileListener(f)
+			if err != nil {
+				return nil, err
+			}
+			u.listeners = append(u.listeners, f)
+			return ln, nil
+		}
+	}
+
+	lc := u.ListenConfig
+	if network == "unix" {
+		lc = net.ListenConfig{}
+		if c, err := net.Dial("unix", addr); err == nil {
+			c.Close()
+		} else {
+			os.Remove(addr)
+		}
+	}
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := listenerFile(ln)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if f != nil {
+		u.listeners = append(u.listeners, f)
+	}
+	return ln, nil
+}
+
+// Ready tells the parent, if any, that this process is serving. The parent
+// stops accepting once it receives this.
+func (u *Upgrader) Ready() error {
+	if u.ready == nil {
+		return nil
+	}
+	defer func() {
+		u.ready.Close()
+		u.ready = nil
+	}()
+	_, err := u.ready.Write([]byte{1})
+	return err
+}
+
+// Upgrade starts a new copy of the running binary with the same arguments
+// and hands it the listeners. It returns once the child has called Ready,
+// after which the caller should stop accepting and drain.
+func (u *Upgrader) Upgrade() error {
+	if !Supported {
+		return errors.New("handoff: not supported on this platform")
+	}
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return errors.New("handoff: upgrade already in progress")
+	}
+	u.upgrading = true
+	files := append([]*os.File(nil), u.listeners...)
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("handoff: locate binary: %w", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strconv.Itoa(len(files)),
+		envReadyFD+"="+strconv.Itoa(firstExtraFD+len(files)),
+	)
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		return fmt.Errorf("handoff: start %s: %w", exe, err)
+	}
+	readyW.Close()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	readyc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		readyc <- err
+	}()
+
+	timer := time.NewTimer(u.ReadyTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-readyc:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("handoff: child %d did not become ready: %w", cmd.Process.Pid, err)
+		}
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("handoff: child exited before ready: %v", err)
+	case <-timer.C:
+		cmd.Process.Kill()
+		return fmt.Errorf("handoff: child %d not ready after %v", cmd.Process.Pid, u.ReadyTimeout)
+	}
+}
+
+// sameAddr compares a listener address with a configured one such as ":10080".
+func sameAddr(have, want string) bool {
+	if have == want {
+		return true
+	}
+	hHost, hPort, err1 := net.SplitHostPort(have)
+	wHost, wPort, err2 := net.SplitHostPort(want)
+	if err1 != nil || err2 != nil || hPort != wPort {
+		return false
+	}
+	if wHost == "" {
+		return true
+	}
+	return hHost == wHost
+}
@@ -0,0 +1,140 @@
+package handoff
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Upgrade runs the test binary again; that copy is the child of the
+// handoff, told what to do by the environment.
+func TestMain(m *testing.M) {
+	if Inheriting() {
+		os.Exit(child())
+	}
+	os.Exit(m.Run())
+}
+
+// child takes over the listener on $HANDOFF_TEST_ADDR, reports ready and
+// answers one connection, or with $HANDOFF_TEST_FAIL set exits at once.
+func child() int {
+	u, err := New()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if os.Getenv("HANDOFF_TEST_FAIL") != "" {
+		return 1
+	}
+	addr := os.Getenv("HANDOFF_TEST_ADDR")
+	if _, ok := u.inherited[addr]; !ok || !u.HasParent() || Inheriting() {
+		fmt.Fprintf(os.Stderr, "child: %s not inherited\n", addr)
+		return 1
+	}
+	ln, err := u.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := u.Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		return 1
+	}
+	fmt.Fprintf(conn, "child %d\n", os.Getpid())
+	conn.Close()
+	return 0
+}
+
+// The new binary serves on the listener of the old one, which then stops
+// accepting without refusing anyone.
+func TestUpgrade(t *testing.T) {
+	if !Supported {
+		t.Skip("no handoff on this platform")
+	}
+	u, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.HasParent() {
+		t.Fatal("test process has a parent")
+	}
+	ln, err := u.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HANDOFF_TEST_ADDR", ln.Addr().String())
+
+	u.ReadyTimeout = 10 * time.Second
+	if err := u.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "child ") || line == fmt.Sprintf("child %d\n", os.Getpid()) {
+		t.Errorf("got %q, %v", line, err)
+	}
+}
+
+// A child that exits before reporting ready fails the upgrade, and the
+// old binary keeps its listener.
+func TestUpgradeChildExits(t *testing.T) {
+	if !Supported {
+		t.Skip("no handoff on this platform")
+	}
+	u, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := u.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("HANDOFF_TEST_FAIL", "1")
+
+	if err := u.Upgrade(); err == nil || !strings.Contains(err.Error(), "ready") {
+		t.Errorf("got %v", err)
+	}
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("old listener gone: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSameAddr(t *testing.T) {
+	for _, tc := range []struct {
+		have, want string
+		same       bool
+	}{
+		{"127.0.0.1:10080", "127.0.0.1:10080", true},
+		{"[::]:10080", ":10080", true},
+		{"127.0.0.1:10080", "localhost:10080", false},
+		{"127.0.0.1:10080", ":10081", false},
+		{"/tmp/proxy.sock", "/tmp/proxy.sock", true},
+	} {
+		if got := sameAddr(tc.have, tc.want); got != tc.same {
+			t.Errorf("sameAddr(%q, %q) = %v", tc.have, tc.want, got)
+		}
+	}
+}
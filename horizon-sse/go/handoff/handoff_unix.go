@@ -0,0 +1,29 @@
+//go:build !windows
+
+package handoff
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Supported reports whether listeners can be handed to a new binary.
+const Supported = true
+
+// UpgradeSignal is the signal that asks a server to hand off to a new binary.
+var UpgradeSignal os.Signal = syscall.SIGUSR2
+
+// listenerFile returns the descriptor of a TCP or unix listener to pass on,
+// or nil for other listeners.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	switch ln := ln.(type) {
+	case *net.TCPListener:
+		return ln.File()
+	case *net.UnixListener:
+		// The next process serves on the socket file once this one closes
+		ln.SetUnlinkOnClose(false)
+		return ln.File()
+	}
+	return nil, nil
+}
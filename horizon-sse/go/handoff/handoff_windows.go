@@ -0,0 +1,18 @@
+package handoff
+
+import (
+	"net"
+	"os"
+)
+
+// Supported reports whether listeners can be handed to a new binary.
+// Windows cannot pass them to a child as descriptors.
+const Supported = false
+
+// UpgradeSignal is nil: there is no signal to ask for a handoff.
+var UpgradeSignal os.Signal
+
+// listenerFile returns nil: no listener is passed on.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	return nil, nil
+}
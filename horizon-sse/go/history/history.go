@@ -0,0 +1,438 @@
+// Package history keeps a registry of load test runs so performance can be
+// compared across builds. Each run is one JSON line in runs.jsonl inside
+// the registry directory, holding the build it ran against, a hash of the
+// test shape and the run's summary metrics.
+package history
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+const fileName = "runs.jsonl"
+
+// Build identifies the binary a run was made with.
+type Build struct {
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	// CommitTime is the VCS time of Revision.
+	CommitTime string `json:"commit_time,omitempty"`
+}
+
+// CurrentBuild reads the build information embedded by the Go toolchain.
+// Binaries built outside a VCS checkout (or with go run) have no revision.
+func CurrentBuild() Build {
+	b := Build{GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.time":
+			b.CommitTime = s.Value
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+// Record is one run in the registry.
+type Record struct {
+	Time  time.Time `json:"time"`
+	Build Build     `json:"build"`
+	// Scenario is a hash of the test shape; only runs with the same hash
+	// are comparable.
+	Scenario     string `json:"scenario"`
+	ScenarioName string `json:"scenario_name,omitempty"`
+	// Mode is ModeDirect for baseline runs against the deep server and
+	// empty for runs through the proxy.
+	Mode string `json:"mode,omitempty"`
+	// Protocol is the HTTP version most of the run's clients were served
+	// over, such as "HTTP/2.0".
+	Protocol string             `json:"protocol,omitempty"`
+	Metrics  map[string]float64 `json:"metrics"`
+}
+
+// ModeDirect marks runs that bypassed the proxy.
+const ModeDirect = "direct"
+
+// ScenarioHash returns a short stable hash of v's JSON encoding.
+func ScenarioHash(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12], nil
+}
+
+// Store is a registry directory.
+type Store struct {
+	Dir string
+}
+
+// Append adds rec to the registry, creating the directory if needed.
+func (s Store) Append(rec Record) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.Dir, fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load returns every run in the registry, oldest first. Lines that cannot be
+// parsed (e.g. a run interrupted mid-write) are skipped.
+func (s Store) Load() ([]Record, error) {
+	f, err := os.Open(filepath.Join(s.Dir, fileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		runs = append(runs, rec)
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Time.Before(runs[j].Time) })
+	return runs, scanner.Err()
+}
+
+// Trend is a metric over recent runs of one scenario, through the proxy or
+// direct and over one protocol, never mixing them.
+type Trend struct {
+	Metric   string
+	Scenario string
+	Mode     string
+	Protocol string
+	Runs     []Record
+	Values   []float64
+	// Baseline is the median of every run but the latest; Drift is the
+	// latest value relative to it, in percent.
+	Baseline float64
+	Drift    float64
+}
+
+// NewTrend selects the last n runs that reported metric. An empty scenario
+// picks the scenario of the most recent run; the trend follows the mode and
+// protocol of the scenario's most recent run.
+func NewTrend(runs []Record, metric, scenario string, n int) (*Trend, error) {
+	mode, protocol := "", ""
+	for i := len(runs) - 1; i >= 0; i-- {
+		if _, ok := runs[i].Metrics[metric]; ok && (scenario == "" || runs[i].Scenario == scenario) {
+			scenario, mode, protocol = runs[i].Scenario, runs[i].Mode, runs[i].Protocol
+			break
+		}
+	}
+
+	t := &Trend{Metric: metric, Scenario: scenario, Mode: mode, Protocol: protocol}
+	for _, r := range runs {
+		v, ok := r.Metrics[metric]
+		if !ok || r.Scenario != scenario || r.Mode != mode || r.Protocol != protocol {
+			continue
+		}
+		t.Runs = append(t.Runs, r)
+		t.Values = append(t.Values, v)
+	}
+	if len(t.Runs) == 0 {
+		return nil, fmt.Errorf("no runs with metric %q", metric)
+	}
+	if n > 0 && len(t.Runs) > n {
+		t.Runs = t.Runs[len(t.Runs)-n:]
+		t.Values = t.Values[len(t.Values)-n:]
+	}
+
+	if len(t.Values) > 1 {
+		t.Baseline = median(t.Values[:len(t.Values)-1])
+		if t.Baseline != 0 {
+			t.Drift = (t.Values[len(t.Values)-1] - t.Baseline) / t.Baseline * 100
+		}
+	}
+	return t, nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// HigherIsBetter reports whether an increase in metric is an improvement,
+// as for rates and throughput, rather than a regression, as for latencies.
+func HigherIsBetter(metric string) bool {
+	return strings.HasSuffix(metric, "_rate") || strings.HasSuffix(metric, "_per_second")
+}
+
+// Regressed reports whether the latest run is worse than the baseline by
+// more than threshold percent.
+func (t *Trend) Regressed(threshold float64) bool {
+	if len(t.Values) < 2 {
+		return false
+	}
+	if HigherIsBetter(t.Metric) {
+		return -t.Drift > threshold
+	}
+	return t.Drift > threshold
+}
+
+// Render writes the trend as a table with a bar per run.
+func (t *Trend) Render(w io.Writer) {
+	const width = 40
+	max := 0.0
+	for _, v := range t.Values {
+		max = math.Max(max, v)
+	}
+
+	scenario := t.Scenario
+	if t.Mode != "" {
+		scenario += " (" + t.Mode + ")"
+	}
+	if t.Protocol != "" {
+		scenario += " over " + t.Protocol
+	}
+	fmt.Fprintf(w, "%s, scenario %s, last %d runs\n\n", t.Metric, scenario, len(t.Runs))
+	for i, r := range t.Runs {
+		rev := r.Build.Revision
+		if len(rev) > 8 {
+			rev = rev[:8]
+		}
+		if rev == "" {
+			rev = "-"
+		} else if r.Build.Modified {
+			rev += "+"
+		}
+		bar := 0
+		if max > 0 {
+			bar = int(math.Round(t.Values[i] / max * width))
+		}
+		fmt.Fprintf(w, "%s  %-9s %12.2f  %s\n",
+			r.Time.Local().Format("2006-01-02 15:04"), rev, t.Values[i], strings.Repeat("#", bar))
+	}
+
+	if len(t.Values) > 1 {
+		fmt.Fprintf(w, "\nbaseline (median of previous runs): %.2f\n", t.Baseline)
+		fmt.Fprintf(w, "latest: %.2f (%+.1f%%)\n", t.Values[len(t.Values)-1], t.Drift)
+	}
+}
+
+// overheadMetrics are the metrics an Overhead compares.
+var overheadMetrics = []string{
+	"ttfb_p50_ms",
+	"ttfb_p95_ms",
+	"ttfb_p99_ms",
+	"avg_response_time_ms",
+	"messages_per_second",
+	"success_rate",
+}
+
+// Overhead is the cost of the proxy: the latest run of a scenario through
+// it against the latest direct run of the same scenario.
+type Overhead struct {
+	Scenario string
+	Proxied  Record
+	Direct   Record
+	Metrics  []OverheadMetric
+}
+
+// OverheadMetric is one metric of both runs. Delta is the proxied value
+// less the direct one; Percent is Delta relative to the direct value.
+type OverheadMetric struct {
+	Metric  string
+	Proxied float64
+	Direct  float64
+	Delta   float64
+	Percent float64
+}
+
+// NewOverhead pairs the latest proxied and direct runs of scenario, over
+// the protocol of its most recent run. An empty scenario picks the
+// scenario of the most recent run. It fails unless the scenario has runs
+// of both kinds.
+func NewOverhead(runs []Record, scenario string) (*Overhead, error) {
+	if scenario == "" && len(runs) > 0 {
+		scenario = runs[len(runs)-1].Scenario
+	}
+	protocol := ""
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Scenario == scenario {
+			protocol = runs[i].Protocol
+			break
+		}
+	}
+	var proxied, direct *Record
+	for i := len(runs) - 1; i >= 0 && (proxied == nil || direct == nil); i-- {
+		r := &runs[i]
+		if r.Scenario != scenario || r.Protocol != protocol {
+			continue
+		}
+		if r.Mode == ModeDirect && direct == nil {
+			direct = r
+		} else if r.Mode == "" && proxied == nil {
+			proxied = r
+		}
+	}
+	if proxied == nil || direct == nil {
+		return nil, fmt.Errorf("scenario %q needs both a proxied and a direct run", scenario)
+	}
+
+	o := &Overhead{Scenario: scenario, Proxied: *proxied, Direct: *direct}
+	for _, metric := range overheadMetrics {
+		p, ok1 := proxied.Metrics[metric]
+		d, ok2 := direct.Metrics[metric]
+		if !ok1 || !ok2 {
+			continue
+		}
+		m := OverheadMetric{Metric: metric, Proxied: p, Direct: d, Delta: p - d}
+		if d != 0 {
+			m.Percent = m.Delta / d * 100
+		}
+		o.Metrics = append(o.Metrics, m)
+	}
+	return o, nil
+}
+
+// Render writes the comparison as a table.
+func (o *Overhead) Render(w io.Writer) {
+	fmt.Fprintf(w, "proxy overhead, scenario %s\n", o.Scenario)
+	fmt.Fprintf(w, "proxied run %s, direct run %s\n\n",
+		o.Proxied.Time.Local().Format("2006-01-02 15:04"), o.Direct.Time.Local().Format("2006-01-02 15:04"))
+	fmt.Fprintf(w, "%-22s %12s %12s %12s\n", "metric", "direct", "proxied", "delta")
+	for _, m := range o.Metrics {
+		fmt.Fprintf(w, "%-22s %12.2f %12.2f %+12.2f %+8.1f%%\n", m.Metric, m.Direct, m.Proxied, m.Delta, m.Percent)
+	}
+}
+
+// ProtocolComparison sets the latest runs of a scenario over each HTTP
+// version side by side, through the proxy or direct as its most recent
+// run went. Runs are ordered by protocol, and the percentages of each
+// metric are relative to the first.
+type ProtocolComparison struct {
+	Scenario string
+	Mode     string
+	Runs     []Record
+	Metrics  []ProtocolMetric
+}
+
+// ProtocolMetric is one metric of each run of a ProtocolComparison.
+type ProtocolMetric struct {
+	Metric  string
+	Values  []float64
+	Percent []float64
+}
+
+// NewProtocolComparison picks the latest run of scenario over each
+// protocol. An empty scenario picks the scenario of the most recent run.
+// It fails unless the scenario has runs over two protocols or more.
+func NewProtocolComparison(runs []Record, scenario string) (*ProtocolComparison, error) {
+	if scenario == "" && len(runs) > 0 {
+		scenario = runs[len(runs)-1].Scenario
+	}
+	mode, found := "", false
+	latest := make(map[string]Record)
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		if r.Scenario != scenario {
+			continue
+		}
+		if !found {
+			mode, found = r.Mode, true
+		}
+		if _, ok := latest[r.Protocol]; r.Mode == mode && r.Protocol != "" && !ok {
+			latest[r.Protocol] = r
+		}
+	}
+	if len(latest) < 2 {
+		return nil, fmt.Errorf("scenario %q needs runs over two protocols", scenario)
+	}
+
+	c := &ProtocolComparison{Scenario: scenario, Mode: mode}
+	for _, r := range latest {
+		c.Runs = append(c.Runs, r)
+	}
+	sort.Slice(c.Runs, func(i, j int) bool { return c.Runs[i].Protocol < c.Runs[j].Protocol })
+	for _, metric := range overheadMetrics {
+		m := ProtocolMetric{Metric: metric}
+		for _, r := range c.Runs {
+			v, ok := r.Metrics[metric]
+			if !ok {
+				break
+			}
+			m.Values = append(m.Values, v)
+			percent := 0.0
+			if base := m.Values[0]; base != 0 {
+				percent = (v - base) / base * 100
+			}
+			m.Percent = append(m.Percent, percent)
+		}
+		if len(m.Values) == len(c.Runs) {
+			c.Metrics = append(c.Metrics, m)
+		}
+	}
+	return c, nil
+}
+
+// Render writes the comparison as a table, a column per protocol, each
+// after the first with its change from it.
+func (c *ProtocolComparison) Render(w io.Writer) {
+	scenario := c.Scenario
+	if c.Mode != "" {
+		scenario += " (" + c.Mode + ")"
+	}
+	fmt.Fprintf(w, "protocols, scenario %s\n", scenario)
+	for _, r := range c.Runs {
+		fmt.Fprintf(w, "%s run %s\n", r.Protocol, r.Time.Local().Format("2006-01-02 15:04"))
+	}
+	fmt.Fprintf(w, "\n%-22s %12s", "metric", c.Runs[0].Protocol)
+	for _, r := range c.Runs[1:] {
+		fmt.Fprintf(w, " %12s %8s", r.Protocol, "change")
+	}
+	fmt.Fprintln(w)
+	for _, m := range c.Metrics {
+		fmt.Fprintf(w, "%-22s %12.2f", m.Metric, m.Values[0])
+		for i := 1; i < len(m.Values); i++ {
+			fmt.Fprintf(w, " %12.2f %+7.1f%%", m.Values[i], m.Percent[i])
+		}
+		fmt.Fprintln(w)
+	}
+}
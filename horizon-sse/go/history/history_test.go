@@ -0,0 +1,86 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverhead(t *testing.T) {
+	at := func(min int) time.Time { return time.Date(2026, 1, 1, 0, min, 0, 0, time.UTC) }
+	runs := []Record{
+		{Time: at(0), Scenario: "a", Metrics: map[string]float64{"ttfb_p95_ms": 40, "success_rate": 100}},
+		{Time: at(1), Scenario: "a", Mode: ModeDirect, Metrics: map[string]float64{"ttfb_p95_ms": 10, "success_rate": 100}},
+		{Time: at(2), Scenario: "a", Metrics: map[string]float64{"ttfb_p95_ms": 15, "success_rate": 99}},
+		{Time: at(3), Scenario: "b", Metrics: map[string]float64{"ttfb_p95_ms": 20}},
+	}
+
+	if _, err := NewOverhead(runs, ""); err == nil {
+		t.Error("scenario b has no direct run, but NewOverhead succeeded")
+	}
+	o, err := NewOverhead(runs, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.Proxied.Time.Equal(at(2)) || !o.Direct.Time.Equal(at(1)) {
+		t.Errorf("paired runs at %v and %v, want the latest of each", o.Proxied.Time, o.Direct.Time)
+	}
+	want := []OverheadMetric{
+		{Metric: "ttfb_p95_ms", Proxied: 15, Direct: 10, Delta: 5, Percent: 50},
+		{Metric: "success_rate", Proxied: 99, Direct: 100, Delta: -1, Percent: -1},
+	}
+	if len(o.Metrics) != len(want) {
+		t.Fatalf("metrics = %+v", o.Metrics)
+	}
+	for i := range want {
+		if o.Metrics[i] != want[i] {
+			t.Errorf("metric %d = %+v, want %+v", i, o.Metrics[i], want[i])
+		}
+	}
+
+	// Trends keep to the mode of the latest run
+	trend, err := NewTrend(runs, "ttfb_p95_ms", "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trend.Values) != 2 || trend.Values[0] != 40 || trend.Values[1] != 15 {
+		t.Errorf("trend values = %v, want the proxied runs only", trend.Values)
+	}
+}
+
+func TestProtocolComparison(t *testing.T) {
+	at := func(min int) time.Time { return time.Date(2026, 1, 1, 0, min, 0, 0, time.UTC) }
+	runs := []Record{
+		{Time: at(0), Scenario: "a", Protocol: "HTTP/2.0", Metrics: map[string]float64{"messages_per_second": 900}},
+		{Time: at(1), Scenario: "a", Protocol: "HTTP/1.1", Metrics: map[string]float64{"messages_per_second": 1000, "ttfb_p95_ms": 20}},
+		{Time: at(2), Scenario: "a", Protocol: "HTTP/2.0", Metrics: map[string]float64{"messages_per_second": 1200, "ttfb_p95_ms": 10}},
+		{Time: at(3), Scenario: "a", Mode: ModeDirect, Protocol: "HTTP/1.1", Metrics: map[string]float64{"messages_per_second": 5000}},
+		{Time: at(4), Scenario: "b", Protocol: "HTTP/1.1", Metrics: map[string]float64{"messages_per_second": 1}},
+	}
+
+	if _, err := NewProtocolComparison(runs, ""); err == nil {
+		t.Error("scenario b has one protocol, but NewProtocolComparison succeeded")
+	}
+	// The latest run of a is direct, and has no other protocol to compare
+	if _, err := NewProtocolComparison(runs, "a"); err == nil {
+		t.Error("direct runs of a compared over one protocol")
+	}
+	c, err := NewProtocolComparison(runs[:3], "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Runs) != 2 || c.Runs[0].Protocol != "HTTP/1.1" || !c.Runs[1].Time.Equal(at(2)) {
+		t.Fatalf("runs %+v", c.Runs)
+	}
+	if len(c.Metrics) != 2 || c.Metrics[0].Metric != "ttfb_p95_ms" || c.Metrics[0].Percent[1] != -50 || c.Metrics[1].Percent[1] != 20 {
+		t.Errorf("metrics %+v", c.Metrics)
+	}
+
+	// Overhead and trends keep to one protocol
+	runs = append(runs[:3], Record{Time: at(3), Scenario: "a", Mode: ModeDirect, Protocol: "HTTP/1.1", Metrics: map[string]float64{"ttfb_p95_ms": 5}})
+	if o, err := NewOverhead(runs, "a"); err != nil || !o.Proxied.Time.Equal(at(1)) {
+		t.Errorf("overhead paired %+v, %v", o, err)
+	}
+	if trend, err := NewTrend(runs, "messages_per_second", "a", 0); err != nil || len(trend.Values) != 2 || trend.Protocol != "HTTP/2.0" {
+		t.Errorf("trend %+v, %v", trend, err)
+	}
+}
@@ -0,0 +1,60 @@
+package mocksrv
+
+import (
+	"bytes"
+	"horizon-sse-go/client"
+	"horizon-sse-go/server"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stream of 16 tokens a second apart takes 15 seconds of fake time and
+// finishes as soon as the test has stepped through them.
+func TestFakeClockRunsLongStream(t *testing.T) {
+	clock := server.NewFakeClock(time.Unix(1000, 0))
+	srv := NewOpenAI(t, Options{Clock: clock, TokenDelay: time.Second})
+	tokens := strings.SplitAfter(strings.Repeat("tok ", 16), " ")[:16]
+	srv.Enqueue(Response{Tokens: tokens})
+
+	type result struct {
+		completion *client.ChatCompletion
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Post(srv.BaseURL()+"/chat/completions", "application/json", bytes.NewBufferString(`{"stream":true}`))
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		c, err := client.DecodeChatCompletionStream(resp.Body, nil)
+		done <- result{c, err}
+	}()
+
+	start := clock.Now()
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case r := <-done:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if got, want := r.completion.Choices[0].Message.Content, strings.Join(tokens, ""); got != want {
+				t.Errorf("content = %q, want %q", got, want)
+			}
+			if elapsed := clock.Since(start); elapsed != 15*time.Second {
+				t.Errorf("stream took %v of fake time, want 15s", elapsed)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("stream did not finish; fake time advanced %v", clock.Since(start))
+		case <-time.After(time.Millisecond):
+			if clock.Waiters() > 0 {
+				clock.Advance(time.Second)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+// Package mocksrv runs an in-process imitation of the OpenAI chat
+// completions API for unit tests. Point an OpenAI SDK at the BaseURL of a
+// server from NewOpenAI and program what each request gets back: the text
+// and how it is chunked, the latency, an error status, or a stream that
+// breaks off halfway.
+//
+//	srv := mocksrv.NewOpenAI(t, mocksrv.Options{})
+//	srv.Enqueue(mocksrv.Response{Content: "Hello there"})
+//	client := openai.NewClient(option.WithBaseURL(srv.BaseURL()), option.WithAPIKey("test"))
+//
+// It does not share the deep server's response generation. The deep server
+// is a load target: it makes up its text (or derives it from a hash of the
+// request), paces it over 15 seconds and injects noise and sequencing
+// faults, and answers the Anthropic dialect too. The mock only sends what
+// the test programmed, in the chunking the test chose, without ids, noise
+// or faults, and unlike the deep server it sends a usage chunk when
+// stream_options asks for one. Use the deep server's /admin/script to
+// script a response end to end through the proxy.
+package mocksrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"horizon-sse-go/client"
+	"horizon-sse-go/server"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// DefaultModel is reported when neither the request nor the options name
+// a model.
+const DefaultModel = "gpt-4o-mini"
+
+// bytesPerToken approximates prompt tokens from the request size, as the
+// deep server does.
+const bytesPerToken = 4
+
+// Response is what one request gets back. The zero value answers with
+// Options.Response.
+type Response struct {
+	// Content is the assistant message. It is streamed a word at a time
+	// unless Tokens gives the chunks explicitly.
+	Content string
+	Tokens  []string
+	// FinishReason defaults to "stop".
+	FinishReason string
+	// ToolCalls are sent after the content, each in one chunk.
+	ToolCalls []client.ToolCall
+
+	// Latency is waited before the response starts, TokenDelay between
+	// streamed chunks. They override the options when set.
+	Latency    time.Duration
+	TokenDelay time.Duration
+
+	// Status, if not 200, fails the request with an OpenAI error body
+	// carrying Error (or the status text) as its message.
+	Status int
+	Error  string
+	// Header is added to the response, e.g. Retry-After on a 429.
+	Header http.Header
+
+	// DisconnectAfter, if positive, drops the connection after that many
+	// content chunks instead of finishing the stream.
+	DisconnectAfter int
+}
+
+// Options configure a server.
+type Options struct {
+	Model string
+	// Response answers requests when nothing is queued and Handler is nil.
+	Response Response
+	// Handler, if set, decides the response to requests not served from
+	// the queue.
+	Handler func(Request) Response
+	// Latency and TokenDelay apply to every response that does not set
+	// its own.
+	Latency    time.Duration
+	TokenDelay time.Duration
+	// Clock paces the delays and stamps responses; server.SystemClock if
+	// nil. A server.FakeClock lets a test step through a slow stream.
+	Clock server.Clock
+}
+
+// Request is a chat completion request the server received.
+type Request struct {
+	Header    http.Header
+	Body      []byte
+	Model     string
+	Stream    bool
+	MaxTokens int
+	Messages  []Message
+}
+
+// Message is a message of a request. Content is empty for messages whose
+// content is a list of parts; their raw JSON is in Request.Body.
+type Message struct {
+	Role    string
+	Content string
+}
+
+// Server is a running mock. It is closed when the test that created it
+// ends.
+type Server struct {
+	*httptest.Server
+
+	opts     Options
+	nextID   int64
+	mu       sync.Mutex
+	queue    []Response
+	requests []Request
+}
+
+// NewOpenAI starts a mock for the duration of t.
+func NewOpenAI(t testing.TB, opts Options) *Server {
+	t.Helper()
+	if opts.Model == "" {
+		opts.Model = DefaultModel
+	}
+	if opts.Clock == nil {
+		opts.Clock = server.SystemClock
+	}
+	s := &Server{opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("/v1/models", s.handleModels)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// BaseURL is the URL SDKs take as their base, ending in /v1.
+func (s *Server) BaseURL() string {
+	return s.URL + "/v1"
+}
+
+// Enqueue queues responses for the next requests, in order.
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, responses...)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// respond records req and picks its response.
+func (s *Server) respond(req Request) Response {
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	if len(s.queue) > 0 {
+		resp := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		return resp
+	}
+	s.mu.Unlock()
+	if s.opts.Handler != nil {
+		return s.opts.Handler(req)
+	}
+	return s.opts.Response
+}
+
+type chatRequest struct {
+	Model               string `json:"model"`
+	Stream              bool   `json:"stream"`
+	MaxTokens           int    `json:"max_tokens"`
+	MaxCompletionTokens int    `json:"max_completion_tokens"`
+	StreamOptions       *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var cr chatRequest
+	if err := json.Unmarshal(body, &cr); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	req := Request{
+		Header:    r.Header.Clone(),
+		Body:      body,
+		Model:     cr.Model,
+		Stream:    cr.Stream,
+		MaxTokens: max(cr.MaxTokens, cr.MaxCompletionTokens),
+	}
+	for _, m := range cr.Messages {
+		msg := Message{Role: m.Role}
+		json.Unmarshal(m.Content, &msg.Content)
+		req.Messages = append(req.Messages, msg)
+	}
+	resp := s.respond(req)
+
+	latency, tokenDelay := resp.Latency, resp.TokenDelay
+	if latency == 0 {
+		latency = s.opts.Latency
+	}
+	if tokenDelay == 0 {
+		tokenDelay = s.opts.TokenDelay
+	}
+	if !s.sleep(r, latency) {
+		return
+	}
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	if resp.Status != 0 && resp.Status != http.StatusOK {
+		writeError(w, resp.Status, resp.Error)
+		return
+	}
+
+	model := cr.Model
+	if model == "" {
+		model = s.opts.Model
+	}
+	tokens := resp.Tokens
+	if len(tokens) == 0 && resp.Content != "" {
+		tokens = strings.SplitAfter(resp.Content, " ")
+	}
+	finish := resp.FinishReason
+	if finish == "" {
+		finish = "stop"
+		if len(resp.ToolCalls) > 0 {
+			finish = "tool_calls"
+		}
+	}
+	usage := &client.Usage{PromptTokens: len(body) / bytesPerToken, CompletionTokens: len(tokens) + len(resp.ToolCalls)}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	id := fmt.Sprintf("chatcmpl-mock-%d", atomic.AddInt64(&s.nextID, 1))
+	created := s.opts.Clock.Now().Unix()
+
+	if !cr.Stream {
+		if resp.DisconnectAfter > 0 {
+			panic(http.ErrAbortHandler)
+		}
+		message := client.ChatMessage{Role: "assistant", Content: strings.Join(tokens, ""), ToolCalls: resp.ToolCalls}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.ChatCompletion{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   model,
+			Choices: []client.CompletionChoice{{Message: message, FinishReason: finish}},
+			Usage:   usage,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher := w.(http.Flusher)
+	send := func(data string) {
+		io.WriteString(w, server.Event{Data: data}.Format())
+		flusher.Flush()
+	}
+	chunk := func(delta client.ChunkDelta, finishReason *string) {
+		data, _ := json.Marshal(client.ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []client.ChunkChoice{{Delta: delta, FinishReason: finishReason}},
+		})
+		send(string(data))
+	}
+
+	chunk(client.ChunkDelta{Role: "assistant"}, nil)
+	for i, token := range tokens {
+		if resp.DisconnectAfter > 0 && i == resp.DisconnectAfter {
+			panic(http.ErrAbortHandler)
+		}
+		if i > 0 && !s.sleep(r, tokenDelay) {
+			return
+		}
+		chunk(client.ChunkDelta{Content: token}, nil)
+	}
+	for i, call := range resp.ToolCalls {
+		chunk(client.ChunkDelta{ToolCalls: []client.ToolCallDelta{{
+			Index:    i,
+			ID:       call.ID,
+			Type:     "function",
+			Function: client.FunctionCallDelta{Name: call.Function.Name, Arguments: call.Function.Arguments},
+		}}}, nil)
+	}
+	if resp.DisconnectAfter > 0 {
+		panic(http.ErrAbortHandler)
+	}
+	chunk(client.ChunkDelta{}, &finish)
+	if cr.StreamOptions != nil && cr.StreamOptions.IncludeUsage {
+		data, _ := json.Marshal(client.ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []client.ChunkChoice{},
+			Usage:   usage,
+		})
+		send(string(data))
+	}
+	send("[DONE]")
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data": []map[string]interface{}{
+			{"id": s.opts.Model, "object": "model", "created": 0, "owned_by": "mocksrv"},
+		},
+	})
+}
+
+// writeError answers with the error body OpenAI SDKs decode into their
+// API error type.
+func writeError(w http.ResponseWriter, status int, message string) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	errType, code := "invalid_request_error", ""
+	switch {
+	case status == http.StatusUnauthorized:
+		errType, code = "authentication_error", "invalid_api_key"
+	case status == http.StatusTooManyRequests:
+		errType, code = "rate_limit_error", "rate_limit_exceeded"
+	case status >= 500:
+		errType = "server_error"
+	}
+	body := map[string]interface{}{"message": message, "type": errType, "param": nil, "code": nil}
+	if code != "" {
+		body["code"] = code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": body})
+}
+
+// sleep waits d unless the client goes away first.
+func (s *Server) sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-s.opts.Clock.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
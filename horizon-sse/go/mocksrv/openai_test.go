@@ -0,0 +1,90 @@
+package mocksrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"horizon-sse-go/client"
+	"net/http"
+	"testing"
+)
+
+func post(t *testing.T, srv *Server, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(srv.BaseURL()+"/chat/completions", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestStream(t *testing.T) {
+	srv := NewOpenAI(t, Options{})
+	srv.Enqueue(Response{Content: "Hello there, world"})
+
+	var chunks int
+	resp := post(t, srv, `{"model":"gpt-test","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	completion, err := client.DecodeChatCompletionStream(resp.Body, func(*client.ChatCompletionChunk) error {
+		chunks++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The role, three words, the finish reason and the usage
+	if chunks != 6 {
+		t.Errorf("got %d chunks, want 6", chunks)
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Content != "Hello there, world" || choice.Message.Role != "assistant" || choice.FinishReason != "stop" {
+		t.Errorf("choice = %+v", choice)
+	}
+	if completion.Model != "gpt-test" || completion.Usage == nil || completion.Usage.CompletionTokens != 3 {
+		t.Errorf("model %q, usage %+v", completion.Model, completion.Usage)
+	}
+
+	reqs := srv.Requests()
+	if len(reqs) != 1 || !reqs[0].Stream || reqs[0].Messages[0].Content != "hi" {
+		t.Errorf("requests = %+v", reqs)
+	}
+}
+
+func TestError(t *testing.T) {
+	srv := NewOpenAI(t, Options{})
+	srv.Enqueue(Response{Status: http.StatusTooManyRequests, Error: "slow down", Header: http.Header{"Retry-After": {"2"}}})
+
+	resp := post(t, srv, `{"stream":true}`)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Message != "slow down" || body.Error.Type != "rate_limit_error" || body.Error.Code != "rate_limit_exceeded" {
+		t.Errorf("error body = %+v", body.Error)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	srv := NewOpenAI(t, Options{})
+	srv.Enqueue(Response{Tokens: []string{"a", "b", "c", "d"}, DisconnectAfter: 2})
+
+	resp := post(t, srv, `{"stream":true}`)
+	completion, err := client.DecodeChatCompletionStream(resp.Body, nil)
+	if err == nil {
+		t.Fatal("stream that broke off decoded without an error")
+	}
+	if got := completion.Choices[0].Message.Content; got != "ab" {
+		t.Errorf("content before the disconnect = %q, want %q", got, "ab")
+	}
+	if reason := completion.Choices[0].FinishReason; reason != "" {
+		t.Errorf("finish reason %q on a broken stream", reason)
+	}
+}
@@ -0,0 +1,161 @@
+// Package objstore uploads benchmark artifacts, such as recorded streams
+// and load test results, to object storage, so runs on many machines end
+// up in one place. Buckets are named by URL, s3://bucket/prefix for S3 and
+// S3-compatible stores and gs://bucket/prefix for Google Cloud Storage,
+// and credentials come from the environment, as the providers' own tools
+// take them.
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Bucket is a place in object storage to upload to.
+type Bucket struct {
+	// Prefix is prepended, with a slash, to the keys of uploads.
+	Prefix string
+	// Client sends the uploads; nil is http.DefaultClient.
+	Client *http.Client
+
+	root string // scheme://bucket
+	put  func(ctx context.Context, c *http.Client, key string, body io.ReadSeeker, size int64) error
+}
+
+// Open returns the bucket at rawURL, with credentials from the
+// environment. A {host} in the prefix is replaced with the machine's host
+// name, so workers sharing a URL don't overwrite each other's artifacts.
+func Open(rawURL string) (*Bucket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("objstore: %q names no bucket", rawURL)
+	}
+	b := &Bucket{Prefix: strings.Trim(u.Path, "/"), root: u.Scheme + "://" + u.Host}
+	if strings.Contains(b.Prefix, "{host}") {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		b.Prefix = strings.ReplaceAll(b.Prefix, "{host}", host)
+	}
+	switch u.Scheme {
+	case "s3":
+		s, err := s3FromEnv(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		b.put = s.put
+	case "gs":
+		g, err := gcsFromEnv(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		b.put = g.put
+	default:
+		return nil, fmt.Errorf("objstore: unknown scheme %q, want s3 or gs", u.Scheme)
+	}
+	return b, nil
+}
+
+// Key is where name is uploaded to: name under the bucket's prefix.
+func (b *Bucket) Key(name string) string {
+	return path.Join(b.Prefix, name)
+}
+
+// Location is the URL name is uploaded to.
+func (b *Bucket) Location(name string) string {
+	return b.root + "/" + b.Key(name)
+}
+
+// Upload uploads the file at file as name.
+func (b *Bucket) Upload(ctx context.Context, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if err := b.put(ctx, client, b.Key(name), f, fi.Size()); err != nil {
+		return fmt.Errorf("objstore: uploading %s to %s: %w", file, b.Location(name), err)
+	}
+	return nil
+}
+
+// UploadDir uploads the files under dir as prefix/ and their path in dir,
+// but for those skip returns true for, given their path in dir. It goes on
+// past failed uploads and returns the names uploaded and the first error.
+func (b *Bucket) UploadDir(ctx context.Context, prefix, dir string, skip func(name string) bool) ([]string, error) {
+	var uploaded []string
+	var first error
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if skip != nil && rel != "." && skip(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		name := path.Join(prefix, rel)
+		if err := b.Upload(ctx, name, p); err != nil {
+			if first == nil {
+				first = err
+			}
+			return ctx.Err()
+		}
+		uploaded = append(uploaded, name)
+		return nil
+	})
+	if first == nil {
+		first = err
+	}
+	return uploaded, first
+}
+
+// checkResponse turns a failed upload's response into an error.
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// firstEnv returns the first of the variables names that is set.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
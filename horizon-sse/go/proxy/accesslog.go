@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The formats of the access log.
+const (
+	// AccessLogCommon is Apache's common log format, with the duration in
+	// milliseconds and the reason a stream ended ("-" for other requests)
+	// appended.
+	AccessLogCommon = "common"
+	// AccessLogCombined adds the referer and user agent to
+	// AccessLogCommon, before the appended fields, as Apache's combined
+	// log format does. It is the default.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes each line as an accessEntry object.
+	AccessLogJSON = "json"
+)
+
+// accessTimeFormat is the time of a request in the common log format.
+const accessTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes a line per request to a writer of its own, apart from
+// the application's log, once the request is over.
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// accessEntry is the line of one request. The stream fields are those of
+// its stream summary, for requests on a streaming route.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	Remote     string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Transport  string    `json:"transport,omitempty"`
+	ClientID   string    `json:"client_id,omitempty"`
+	StreamID   string    `json:"stream_id,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// accessStream links the access log line of a request to the summary of
+// the stream it served, which logStreams fills in.
+type accessStream struct {
+	summary *streamSummary
+}
+
+type accessStreamKey struct{}
+
+// linkAccessLog hands summary to the access log line of r, if one is kept.
+func linkAccessLog(r *http.Request, summary *streamSummary) {
+	if link, ok := r.Context().Value(accessStreamKey{}).(*accessStream); ok {
+		link.summary = summary
+	}
+}
+
+// serve serves r with next and logs it once it is over, also if next
+// panics, as it does to drop a connection.
+func (l *accessLog) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	aw := &accessWriter{ResponseWriter: w}
+	link := &accessStream{}
+	defer func() {
+		e := accessEntry{
+			Time:       start,
+			Remote:     clientAddr(r),
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     aw.status,
+			Bytes:      aw.bytes,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		}
+		if e.Status == 0 {
+			// Nothing written, or a WebSocket that took over the connection
+			e.Status = http.StatusOK
+			if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				e.Status = http.StatusSwitchingProtocols
+			}
+		}
+		if m := link.summary; m != nil {
+			m.mu.Lock()
+			e.Transport, e.ClientID, e.StreamID = m.transport, m.clientID, m.streamID
+			e.Upstream, e.Reason = m.upstream, m.reason
+			m.mu.Unlock()
+		}
+		l.write(e)
+	}()
+	next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessStreamKey{}, link)))
+}
+
+func (l *accessLog) write(e accessEntry) {
+	var line []byte
+	if l.format == AccessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s - - [%s] %s %d %d", e.Remote, e.Time.Format(accessTimeFormat),
+			strconv.Quote(e.Method+" "+e.URI+" "+e.Proto), e.Status, e.Bytes)
+		if l.format != AccessLogCommon {
+			fmt.Fprintf(&b, " %s %s", strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)))
+		}
+		fmt.Fprintf(&b, " %.1f %s\n", e.DurationMs, orDash(e.Reason))
+		line = []byte(b.String())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// orDash is v, or "-" for a field the common log format leaves empty.
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// accessWriter records the status and size of a response for its access
+// log line.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer.
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
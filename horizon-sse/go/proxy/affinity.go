@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AffinityCookie names the proxy node that served a browser's last
+// stream, and so holds its replay buffer.
+const AffinityCookie = "horizon_node"
+
+// forwardedHeader marks a request a peer forwarded for affinity; it is
+// served where it lands, so two nodes never bounce a request between them.
+// It is only believed from a peer's address.
+const forwardedHeader = "X-Horizon-Forwarded-By"
+
+// How a request carrying another node's cookie is sent to that node.
+const (
+	AffinityForward  = "forward"
+	AffinityRedirect = "redirect"
+)
+
+// peerHealthTTL is how long a peer's health check is trusted.
+const peerHealthTTL = 5 * time.Second
+
+// ParsePeers parses a -peers setting: comma-separated NAME=URL pairs
+// naming the other proxy nodes of a cluster.
+func ParsePeers(spec string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, item := range splitNames(spec) {
+		name, rawURL, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("peer %q: want NAME=URL", item)
+		}
+		if u, err := url.Parse(rawURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("peer %q: invalid URL %q", item, rawURL)
+		}
+		peers[name] = strings.TrimSuffix(rawURL, "/")
+	}
+	return peers, nil
+}
+
+// affinity keeps a browser's reconnects on the node that served it, so an
+// EventSource retrying with Last-Event-ID finds its replay buffer. Streams
+// are answered with a cookie naming this node; a request carrying a
+// peer's cookie is forwarded or redirected there, or served here, with a
+// new cookie, if the peer is gone. A nil affinity does nothing.
+type affinity struct {
+	node   string
+	mode   string
+	logger *logrus.Logger
+	client *http.Client
+
+	mu      sync.Mutex
+	peers   map[string]*peer
+	issued  int64
+	routed  int64
+	served  int64
+	fallen  int64
+	unknown int64
+}
+
+type peer struct {
+	name     string
+	url      *url.URL
+	proxy    *httputil.ReverseProxy
+	checked  time.Time
+	healthy  bool
+	resolved time.Time
+	addrs    []net.IP // of its host, as last resolved
+}
+
+// AffinityStats counts cookies issued and where requests carrying one
+// went: to the peer it names, served here as named, or here because the
+// peer was down or unknown.
+type AffinityStats struct {
+	Node      string          `json:"node"`
+	Mode      string          `json:"mode"`
+	Issued    int64           `json:"cookies_issued"`
+	Routed    int64           `json:"routed_to_peer"`
+	Local     int64           `json:"served_locally"`
+	Fallbacks int64           `json:"fallbacks"`
+	Unknown   int64           `json:"unknown_nodes"`
+	Peers     map[string]bool `json:"peers_healthy"`
+}
+
+func newAffinity(node, mode string, peers map[string]string, logger *logrus.Logger) (*affinity, error) {
+	if node == "" {
+		if len(peers) > 0 {
+			return nil, fmt.Errorf("peers given without a node name")
+		}
+		return nil, nil
+	}
+	switch mode {
+	case "":
+		mode = AffinityForward
+	case AffinityForward, AffinityRedirect:
+	default:
+		return nil, fmt.Errorf("unknown affinity mode %q (want %s or %s)", mode, AffinityForward, AffinityRedirect)
+	}
+	a := &affinity{
+		node:   node,
+		mode:   mode,
+		logger: logger,
+		client: &http.Client{Timeout: time.Second},
+		peers:  make(map[string]*peer, len(peers)),
+	}
+	for name, rawURL := range peers {
+		if name == node {
+			continue
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: %w", name, err)
+		}
+		rp := httputil.NewSingleHostReverseProxy(u)
+		// Streams are relayed as they come
+		rp.FlushInterval = -1
+		a.peers[name] = &peer{name: name, url: u, proxy: rp}
+	}
+	return a, nil
+}
+
+// wrap routes requests to next by their affinity cookie.
+func (a *affinity) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.forwarded(r)
+		if p := a.route(r); p != nil {
+			atomic.AddInt64(&a.routed, 1)
+			if a.mode == AffinityRedirect {
+				target := *p.url
+				target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+				target.RawQuery = r.URL.RawQuery
+				http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+				return
+			}
+			clearWriteDeadline(w)
+			r.Header.Set(forwardedHeader, a.node)
+			p.proxy.ServeHTTP(w, r)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     AffinityCookie,
+			Value:    a.node,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.Header().Set("X-Horizon-Node", a.node)
+		next(w, r)
+	}
+}
+
+// forwarded reports whether r was forwarded by a peer: it carries
+// forwardedHeader and comes from the address of a peer. Anyone can send
+// the header, so it is deleted from requests that don't, lest they skip
+// their address's connection limit or their routing.
+func (a *affinity) forwarded(r *http.Request) bool {
+	if r.Header.Get(forwardedHeader) == "" {
+		return false
+	}
+	if a != nil && a.fromPeer(net.ParseIP(clientAddr(r))) {
+		return true
+	}
+	r.Header.Del(forwardedHeader)
+	return false
+}
+
+// fromPeer reports whether ip is an address of a peer. Peer host names are
+// resolved again at most once per peerHealthTTL.
+func (a *affinity) fromPeer(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, p := range a.peers {
+		for _, addr := range a.peerAddrs(p) {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *affinity) peerAddrs(p *peer) []net.IP {
+	a.mu.Lock()
+	if time.Since(p.resolved) < peerHealthTTL {
+		defer a.mu.Unlock()
+		return p.addrs
+	}
+	a.mu.Unlock()
+
+	var addrs []net.IP
+	if ip := net.ParseIP(p.url.Hostname()); ip != nil {
+		addrs = []net.IP{ip}
+	} else if hosts, err := net.LookupHost(p.url.Hostname()); err == nil {
+		for _, host := range hosts {
+			addrs = append(addrs, net.ParseIP(host))
+		}
+	}
+	a.mu.Lock()
+	p.resolved, p.addrs = time.Now(), addrs
+	a.mu.Unlock()
+	return addrs
+}
+
+// route returns the peer r should go to, or nil to serve it here.
+func (a *affinity) route(r *http.Request) *peer {
+	cookie, err := r.Cookie(AffinityCookie)
+	switch {
+	case err != nil:
+		atomic.AddInt64(&a.issued, 1)
+		return nil
+	case cookie.Value == a.node || r.Header.Get(forwardedHeader) != "":
+		atomic.AddInt64(&a.served, 1)
+		return nil
+	}
+	p, ok := a.peers[cookie.Value]
+	if !ok {
+		atomic.AddInt64(&a.unknown, 1)
+		atomic.AddInt64(&a.issued, 1)
+		return nil
+	}
+	if !a.healthy(p) {
+		atomic.AddInt64(&a.fallen, 1)
+		atomic.AddInt64(&a.issued, 1)
+		a.logger.WithFields(logrus.Fields{
+			"peer": p.name,
+			"node": a.node,
+		}).Warn("Affinity peer is down, serving its client here")
+		return nil
+	}
+	return p
+}
+
+// healthy checks the peer's /health, at most once per peerHealthTTL.
+func (a *affinity) healthy(p *peer) bool {
+	a.mu.Lock()
+	if time.Since(p.checked) < peerHealthTTL {
+		defer a.mu.Unlock()
+		return p.healthy
+	}
+	a.mu.Unlock()
+
+	ok := false
+	if resp, err := a.client.Get(p.url.String() + "/health"); err == nil {
+		resp.Body.Close()
+		ok = resp.StatusCode == http.StatusOK
+	}
+	a.mu.Lock()
+	p.checked, p.healthy = time.Now(), ok
+	a.mu.Unlock()
+	return ok
+}
+
+func (a *affinity) Stats() *AffinityStats {
+	if a == nil {
+		return nil
+	}
+	stats := &AffinityStats{
+		Node:      a.node,
+		Mode:      a.mode,
+		Issued:    atomic.LoadInt64(&a.issued),
+		Routed:    atomic.LoadInt64(&a.routed),
+		Local:     atomic.LoadInt64(&a.served),
+		Fallbacks: atomic.LoadInt64(&a.fallen),
+		Unknown:   atomic.LoadInt64(&a.unknown),
+		Peers:     make(map[string]bool, len(a.peers)),
+	}
+	a.mu.Lock()
+	for name, p := range a.peers {
+		stats.Peers[name] = p.healthy
+	}
+	a.mu.Unlock()
+	return stats
+}
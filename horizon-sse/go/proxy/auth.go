@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"horizon-sse-go/server"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// apiKeysRecheck is how often a key file is checked for changes.
+const apiKeysRecheck = 5 * time.Second
+
+// APIKeys authenticates clients by API key, sent as a bearer token or in
+// X-API-Key, and counts the connections and messages of each key. Keys are
+// reported by their name, or as server.TenantOf names their tenant if they
+// have none, so /metrics never shows a key.
+type APIKeys struct {
+	path string // of the key file, empty for a static list
+
+	mu       sync.RWMutex
+	labels   map[string]string // by SHA-256 of the key
+	counters map[string]*keyCounters
+	modTime  time.Time
+	checked  time.Time
+	rejected int64
+}
+
+type keyCounters struct {
+	label                         string
+	connections, active, messages int64
+}
+
+// APIKeyStats counts the requests a key was accepted for, those still
+// open, and the events streamed to them.
+type APIKeyStats struct {
+	Connections int64 `json:"connections"`
+	Active      int64 `json:"active"`
+	Messages    int64 `json:"messages"`
+}
+
+// AuthStats counts the requests of each key and those refused for lacking
+// a valid one.
+type AuthStats struct {
+	Keys     map[string]APIKeyStats `json:"keys"`
+	Rejected int64                  `json:"rejected"`
+}
+
+// ParseAPIKeys parses a static key list: comma-separated [NAME=]KEY.
+func ParseAPIKeys(spec string) (*APIKeys, error) {
+	k := &APIKeys{counters: make(map[string]*keyCounters)}
+	labels, err := parseKeyLines(strings.Split(spec, ","))
+	if err != nil {
+		return nil, err
+	}
+	k.setLabels(labels)
+	return k, nil
+}
+
+// LoadAPIKeys reads the keys from a file of [NAME=]KEY lines, where blank
+// lines and those starting with # are skipped. The file is read again
+// when it changes, so keys can be added and revoked while the proxy runs;
+// if it can no longer be read, the keys last read stay in force.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	k := &APIKeys{path: path, counters: make(map[string]*keyCounters)}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+	k.checked = time.Now()
+	return k, nil
+}
+
+func (k *APIKeys) load(modTime time.Time) error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	labels, err := parseKeyLines(lines)
+	if err != nil {
+		return fmt.Errorf("%s: %w", k.path, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.setLabels(labels)
+	k.modTime = modTime
+	return nil
+}
+
+// keyNamePattern is what the NAME of a NAME=KEY entry looks like.
+var keyNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// splitKeyEntry splits a [NAME=]KEY entry. Keys such as base64 ones end in
+// = padding, so an entry is only named if what precedes its first = is a
+// name and what follows is more than padding; otherwise it is all key.
+func splitKeyEntry(entry string) (name, key string, named bool) {
+	name, key, named = strings.Cut(entry, "=")
+	name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+	if !named || !keyNamePattern.MatchString(name) || strings.Trim(key, "=") == "" {
+		return "", entry, false
+	}
+	return name, key, true
+}
+
+// parseKeyLines maps the hash of each [NAME=]KEY entry to its label.
+func parseKeyLines(entries []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, "=") {
+			return nil, fmt.Errorf("invalid API key entry %q, want [NAME=]KEY", entry)
+		}
+		name, key, named := splitKeyEntry(entry)
+		sum := sha256.Sum256([]byte(key))
+		if !named {
+			name = "key:" + hex.EncodeToString(sum[:6])
+		}
+		labels[hex.EncodeToString(sum[:])] = name
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("no API keys")
+	}
+	return labels, nil
+}
+
+// setLabels replaces the keys; counters of keys still present carry over.
+// Callers hold mu, or own k.
+func (k *APIKeys) setLabels(labels map[string]string) {
+	k.labels = labels
+	counters := make(map[string]*keyCounters, len(labels))
+	for _, label := range labels {
+		if c := k.counters[label]; c != nil {
+			counters[label] = c
+		} else {
+			counters[label] = &keyCounters{label: label}
+		}
+	}
+	k.counters = counters
+}
+
+// reload reads the key file again if it changed, at most every
+// apiKeysRecheck.
+func (k *APIKeys) reload(now time.Time) {
+	if k.path == "" {
+		return
+	}
+	k.mu.Lock()
+	if now.Sub(k.checked) < apiKeysRecheck {
+		k.mu.Unlock()
+		return
+	}
+	k.checked = now
+	modTime := k.modTime
+	k.mu.Unlock()
+	if info, err := os.Stat(k.path); err == nil && !info.ModTime().Equal(modTime) {
+		k.load(info.ModTime())
+	}
+}
+
+// lookup returns the counters of the key r was sent with, or nil if it has
+// no valid one.
+func (k *APIKeys) lookup(r *http.Request) *keyCounters {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if key = strings.TrimSpace(key); key == "" {
+		return nil
+	}
+	k.reload(time.Now())
+	sum := sha256.Sum256([]byte(key))
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	label, ok := k.labels[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil
+	}
+	return k.counters[label]
+}
+
+type apiKeyContextKey struct{}
+
+// Wrap lets through the requests with a valid key, counted against it, and
+// answers the others 401.
+func (k *APIKeys) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := k.lookup(r)
+		if c == nil {
+			atomic.AddInt64(&k.rejected, 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxy"`)
+			http.Error(w, "Missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt64(&c.connections, 1)
+		atomic.AddInt64(&c.active, 1)
+		defer atomic.AddInt64(&c.active, -1)
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, c)))
+	}
+}
+
+// CountMessages counts n messages streamed to the key that r was let
+// through with, or the tenant of its token, if any.
+func CountMessages(r *http.Request, n int) {
+	if n <= 0 {
+		return
+	}
+	if c, ok := r.Context().Value(apiKeyContextKey{}).(*keyCounters); ok {
+		atomic.AddInt64(&c.messages, int64(n))
+	}
+	if t, ok := r.Context().Value(jwtContextKey{}).(*tenantLimits); ok {
+		t.count(time.Now(), int64(n))
+	}
+}
+
+// authIdentity names who r was authenticated as: the API key and the
+// tenant and user of the token it was let through with. It is empty
+// without authentication.
+func authIdentity(r *http.Request) string {
+	var id []string
+	if c, ok := r.Context().Value(apiKeyContextKey{}).(*keyCounters); ok {
+		id = append(id, "key="+c.label)
+	}
+	if _, ok := r.Context().Value(jwtContextKey{}).(*tenantLimits); ok {
+		id = append(id, "tenant="+r.Header.Get(server.TenantHeader), "user="+jwtUser(r))
+	}
+	return strings.Join(id, ",")
+}
+
+// requestOwner names who r comes from, for the streams it opens and
+// those it may then control: its authIdentity, or without authentication
+// the client_id it names. It is empty for an anonymous request.
+func requestOwner(r *http.Request) string {
+	if id := authIdentity(r); id != "" {
+		return id
+	}
+	if clientID := r.URL.Query().Get("client_id"); clientID != "" {
+		return "client=" + clientID
+	}
+	return ""
+}
+
+// replayKey is what the replay log of clientID's streams is kept under:
+// client_id is chosen by clients and no secret, so with authentication
+// it is only looked up among the logs of the same identity.
+func replayKey(r *http.Request, clientID string) string {
+	if id := authIdentity(r); id != "" {
+		return id + "|" + clientID
+	}
+	return clientID
+}
+
+// Stats snapshots the counters of each key.
+func (k *APIKeys) Stats() AuthStats {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	st := AuthStats{Keys: make(map[string]APIKeyStats, len(k.counters)), Rejected: atomic.LoadInt64(&k.rejected)}
+	for label, c := range k.counters {
+		st.Keys[label] = APIKeyStats{
+			Connections: atomic.LoadInt64(&c.connections),
+			Active:      atomic.LoadInt64(&c.active),
+			Messages:    atomic.LoadInt64(&c.messages),
+		}
+	}
+	return st
+}
+
+// authStats reports the API key counters, or nil without authentication.
+func (s *Proxy) authStats() *AuthStats {
+	if s.apiKeys == nil {
+		return nil
+	}
+	st := s.apiKeys.Stats()
+	return &st
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"horizon-sse-go/server"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// batchRoutes are the endpoints of the batch API: the files batches read
+// their requests from and write their results to, and the batches.
+var batchRoutes = []struct{ method, path string }{
+	{"POST", "/v1/files"},
+	{"GET", "/v1/files/{id}"},
+	{"DELETE", "/v1/files/{id}"},
+	{"GET", "/v1/files/{id}/content"},
+	{"POST", "/v1/batches"},
+	{"GET", "/v1/batches"},
+	{"GET", "/v1/batches/{id}"},
+	{"POST", "/v1/batches/{id}/cancel"},
+}
+
+const (
+	// DefaultBatchMaxUploadBytes is the upstream's own limit on batch
+	// input files.
+	DefaultBatchMaxUploadBytes = 200 << 20
+	// maxBatchOwners bounds the files and batches whose upstream is
+	// remembered; the oldest are forgotten first.
+	maxBatchOwners = 1 << 16
+	// maxIdleBuckets is how many tenants' or addresses' rate limits are
+	// kept before those at their full burst are dropped.
+	maxIdleBuckets = 4096
+)
+
+// BatchStats counts the batch API calls by method and route, and those
+// refused for the tenant's rate limit or pinned to the upstream holding
+// what they name.
+type BatchStats struct {
+	Calls       map[string]UnaryStats `json:"calls"`
+	RateLimited int64                 `json:"rate_limited"`
+	Pinned      int64                 `json:"pinned"`
+}
+
+// batchOwners remembers which upstream created each file and batch, since
+// only that one can answer for it.
+type batchOwners struct {
+	mu     sync.Mutex
+	owners map[string]*Backend
+	order  []string // oldest first
+}
+
+func newBatchOwners() *batchOwners {
+	return &batchOwners{owners: make(map[string]*Backend)}
+}
+
+func (o *batchOwners) owner(id string) *Backend {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.owners[id]
+}
+
+func (o *batchOwners) set(id string, b *Backend) {
+	if id == "" {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.owners[id]; !ok {
+		o.order = append(o.order, id)
+	}
+	o.owners[id] = b
+	for len(o.order) > maxBatchOwners {
+		delete(o.owners, o.order[0])
+		o.order = o.order[1:]
+	}
+}
+
+// record remembers b as the owner of the files and batches a JSON answer
+// describes, alone or in a list.
+func (o *batchOwners) record(b *Backend, answer []byte) {
+	type object struct {
+		ID           string `json:"id"`
+		InputFileID  string `json:"input_file_id"`
+		OutputFileID string `json:"output_file_id"`
+		ErrorFileID  string `json:"error_file_id"`
+	}
+	var v struct {
+		object
+		Data []object `json:"data"`
+	}
+	if json.Unmarshal(answer, &v) != nil {
+		return
+	}
+	for _, obj := range append(v.Data, v.object) {
+		o.set(obj.ID, b)
+		o.set(obj.InputFileID, b)
+		o.set(obj.OutputFileID, b)
+		o.set(obj.ErrorFileID, b)
+	}
+}
+
+// tenantBuckets is a token bucket per tenant, or other key: each may make
+// rate calls a second, and up to burst at once.
+type tenantBuckets struct {
+	rate, burst float64
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTenantBuckets(rate float64, burst int) *tenantBuckets {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tenantBuckets{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// reuseBuckets returns buckets for rate and burst, nil for a zero rate:
+// old if it has those already, so a reload leaving a limit as it was does
+// not hand everyone a fresh burst.
+func reuseBuckets(old *tenantBuckets, rate float64, burst int) *tenantBuckets {
+	if rate <= 0 {
+		return nil
+	}
+	b := newTenantBuckets(rate, burst)
+	if old != nil && old.rate == b.rate && old.burst == b.burst {
+		return old
+	}
+	return b
+}
+
+// take takes a token of tenant's bucket, or reports how long until one is
+// there.
+func (t *tenantBuckets) take(tenant string, now time.Time) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[tenant]
+	if b == nil {
+		if len(t.buckets) >= maxIdleBuckets {
+			t.dropIdle(now)
+		}
+		b = &tokenBucket{tokens: t.burst, last: now}
+		t.buckets[tenant] = b
+	}
+	b.tokens = math.Min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// dropIdle forgets the tenants whose buckets have refilled, as a new bucket
+// would be.
+func (t *tenantBuckets) dropIdle(now time.Time) {
+	for tenant, b := range t.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*t.rate >= t.burst {
+			delete(t.buckets, tenant)
+		}
+	}
+}
+
+// batchHandler forwards the calls to one batch API route, counted under
+// method and path. Calls naming a file or batch go to the upstream that
+// created it; an upload is bounded by the batch upload limit rather than
+// the request size limit, and file contents are streamed as they come.
+func (s *Proxy) batchHandler(method, path string) http.HandlerFunc {
+	stats := &unaryCounters{}
+	s.batchCalls[method+" "+path] = stats
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		s.limitsMu.Lock()
+		limits := s.batchLimits
+		s.limitsMu.Unlock()
+		if limits != nil {
+			if ok, wait := limits.take(server.TenantOf(r), start); !ok {
+				atomic.AddInt64(&s.batchRateLimited, 1)
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Batch API rate limit exceeded", http.StatusTooManyRequests)
+				stats.count(start, 0, false)
+				return
+			}
+		}
+
+		call := newUnaryCall(r, r.URL.Path)
+		named := mux.Vars(r)["id"]
+		switch {
+		case path == "/v1/files":
+			call.contentType = r.Header.Get("Content-Type")
+			if _, err := s.readCallBody(r, &call, s.batchMaxUploadBytes); err != nil {
+				s.refuseCall(w, err)
+				stats.count(start, 0, false)
+				return
+			}
+			defer call.body.Close()
+		case method == "POST" && path == "/v1/batches":
+			fields, err := s.readCallBody(r, &call, s.maxRequestBytes)
+			if err != nil {
+				s.refuseCall(w, err)
+				stats.count(start, 0, false)
+				return
+			}
+			defer call.body.Close()
+			call.contentType = "application/json"
+			json.Unmarshal(fields["input_file_id"], &named)
+		}
+
+		var pinned *Backend
+		if named != "" {
+			if pinned = s.batchOwners.owner(named); pinned != nil {
+				atomic.AddInt64(&s.batchPinned, 1)
+			}
+		}
+		var keep func(*Backend, []byte)
+		if !strings.HasSuffix(path, "/content") {
+			keep = s.batchOwners.record
+		}
+		n, ok := s.forwardCall(w, r, call, pinned, keep)
+		stats.count(start, n, ok)
+	}
+}
+
+// batchStats snapshots the batch API counters.
+func (s *Proxy) batchStats() BatchStats {
+	st := BatchStats{
+		Calls:       make(map[string]UnaryStats, len(s.batchCalls)),
+		RateLimited: atomic.LoadInt64(&s.batchRateLimited),
+		Pinned:      atomic.LoadInt64(&s.batchPinned),
+	}
+	for route, c := range s.batchCalls {
+		st.Calls[route] = c.stats()
+	}
+	return st
+}
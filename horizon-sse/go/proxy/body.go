@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"horizon-sse-go/audit"
+	"horizon-sse-go/server"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requestBody is a request body kept whole so the upstream request can be
+// sent again: in memory up to the spool's threshold, in a temp file past
+// it. It is read with ReadAt, so any number of attempts can read it at
+// once, and must be closed to remove the file.
+type requestBody struct {
+	spool *bodySpool
+	mem   []byte
+	file  *os.File
+	size  int64
+}
+
+func (b *requestBody) ReadAt(p []byte, off int64) (int, error) {
+	if b.file != nil {
+		return b.file.ReadAt(p, off)
+	}
+	return bytes.NewReader(b.mem).ReadAt(p, off)
+}
+
+// reader reads the body from the start.
+func (b *requestBody) reader() io.Reader {
+	return io.NewSectionReader(b, 0, b.size)
+}
+
+func (b *requestBody) Close() error {
+	if b == nil {
+		return nil
+	}
+	atomic.AddInt64(&b.spool.active, -1)
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// bodySpool buffers the bodies clients POST, keeping up to memLimit bytes
+// of each in memory and spilling larger ones to temp files in dir.
+type bodySpool struct {
+	memLimit int64
+	dir      string
+
+	buffered     int64
+	spilled      int64
+	spilledBytes int64
+	active       int64
+}
+
+// BodySpoolStats counts the bodies buffered, those of them that spilled to
+// disk and their size, and the bodies held by streams still running.
+type BodySpoolStats struct {
+	Buffered     int64 `json:"buffered"`
+	Spilled      int64 `json:"spilled"`
+	SpilledBytes int64 `json:"spilled_bytes"`
+	Active       int64 `json:"active"`
+}
+
+func newBodySpool(memLimit int64, dir string) *bodySpool {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &bodySpool{memLimit: memLimit, dir: dir}
+}
+
+// read buffers r, of at most limit bytes; a longer body fails with an
+// *http.MaxBytesError.
+func (sp *bodySpool) read(r io.Reader, limit int64) (*requestBody, error) {
+	r = http.MaxBytesReader(nil, io.NopCloser(r), limit)
+	mem, err := io.ReadAll(io.LimitReader(r, sp.memLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	b := &requestBody{spool: sp, mem: mem, size: int64(len(mem))}
+	if b.size > sp.memLimit {
+		if b.file, err = os.CreateTemp(sp.dir, "horizon-body-*"); err != nil {
+			return nil, err
+		}
+		// The file takes over from the first bytes read into memory
+		n, err := io.Copy(b.file, io.MultiReader(bytes.NewReader(mem), r))
+		b.mem, b.size = nil, n
+		if err != nil {
+			b.file.Close()
+			os.Remove(b.file.Name())
+			return nil, err
+		}
+		atomic.AddInt64(&sp.spilled, 1)
+		atomic.AddInt64(&sp.spilledBytes, n)
+	}
+	atomic.AddInt64(&sp.buffered, 1)
+	atomic.AddInt64(&sp.active, 1)
+	return b, nil
+}
+
+// hold keeps data, a body the proxy made, as if read.
+func (sp *bodySpool) hold(data []byte) *requestBody {
+	atomic.AddInt64(&sp.active, 1)
+	return &requestBody{spool: sp, mem: data, size: int64(len(data))}
+}
+
+func (sp *bodySpool) Stats() BodySpoolStats {
+	return BodySpoolStats{
+		Buffered:     atomic.LoadInt64(&sp.buffered),
+		Spilled:      atomic.LoadInt64(&sp.spilled),
+		SpilledBytes: atomic.LoadInt64(&sp.spilledBytes),
+		Active:       atomic.LoadInt64(&sp.active),
+	}
+}
+
+// maxLoggedPayload bounds the part of a request body that is logged; a
+// longer one is redacted whole, as what is left of it is not JSON.
+const maxLoggedPayload = 64 << 10
+
+// logPayload logs the JSON body a client sent for id, with LogPayloads.
+// The logger's audit hook redacts its prompts.
+func (s *Proxy) logPayload(r *http.Request, id string, body *requestBody) {
+	if !s.logPayloads || body == nil {
+		return
+	}
+	payload, _ := io.ReadAll(io.LimitReader(body.reader(), maxLoggedPayload))
+	s.logger.WithFields(logrus.Fields{
+		"request_id":       id,
+		"path":             r.URL.Path,
+		"tenant":           server.TenantOf(r),
+		"bytes":            body.size,
+		audit.PayloadField: payload,
+	}).Info("Request payload")
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"horizon-sse-go/server"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cancelReportTimeout bounds a cancellation report to the upstream.
+const cancelReportTimeout = 2 * time.Second
+
+// cancelReports counts the upstream streams the proxy cancelled, by
+// reason, and the reports of them the upstream did not take.
+type cancelReports struct {
+	mu       sync.Mutex
+	byReason map[string]int64
+	failed   int64
+}
+
+// CancelReportStats is the upstream streams cancelled, by reason, and how
+// many of the reports sent for them failed.
+type CancelReportStats struct {
+	Reasons map[string]int64 `json:"reasons"`
+	Failed  int64            `json:"failed"`
+}
+
+// clientGoneReason is why the upstream stream of a client that went away
+// is cancelled: the client left, unless the proxy closed it on shutdown.
+func (s *Proxy) clientGoneReason() string {
+	if atomic.LoadInt32(&s.closing) != 0 {
+		return server.CancelShutdown
+	}
+	return server.CancelClientGone
+}
+
+// reportCancel tells the upstream of stream, in the background, why its
+// request was cancelled, with a DELETE of server.CancelPath carrying the
+// reason in server.CancelReasonHeader.
+func (s *Proxy) reportCancel(stream *activeStream, reason string) {
+	c := s.cancelReports
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.byReason[reason]++
+	c.mu.Unlock()
+
+	upstreamURL := s.upstreams.primary()
+	s.streamsMu.Lock()
+	if stream.backend != nil {
+		upstreamURL = stream.backend.URL
+	}
+	s.streamsMu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cancelReportTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, upstreamURL+server.CancelPath(stream.id), nil)
+		if err != nil {
+			atomic.AddInt64(&c.failed, 1)
+			return
+		}
+		req.Header.Set(server.CancelReasonHeader, reason)
+		resp, err := (&http.Client{Transport: s.unaryTransport}).Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+		}
+		atomic.AddInt64(&c.failed, 1)
+		fields := logrus.Fields{"stream_id": stream.id, "reason": reason}
+		if err == nil {
+			fields["status"] = resp.StatusCode
+		}
+		s.logger.WithFields(fields).WithError(err).Debug("Upstream did not take cancellation report")
+	}()
+}
+
+// cancelReportStats snapshots the cancellation counters, or nil if
+// cancellations are not reported.
+func (s *Proxy) cancelReportStats() *CancelReportStats {
+	c := s.cancelReports
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reasons := make(map[string]int64, len(c.byReason))
+	for reason, n := range c.byReason {
+		reasons[reason] = n
+	}
+	return &CancelReportStats{Reasons: reasons, Failed: atomic.LoadInt64(&c.failed)}
+}
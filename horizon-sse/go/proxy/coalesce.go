@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"horizon-sse-go/server"
+)
+
+// errCoalescedShed is what the members of a group get when the request
+// that opened it was refused for lack of upstream capacity.
+var errCoalescedShed = errors.New("upstream at capacity")
+
+// coalescer shares one upstream request among identical requests arriving
+// within a window of the first: the upstream response is recorded as it
+// arrives and every member reads it from the start, at its own pace. A nil
+// coalescer shares nothing.
+type coalescer struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	groups    map[string]*coalesceGroup
+	opened    int64
+	coalesced int64
+	largest   int
+}
+
+// coalesceGroup is the upstream response a set of identical requests
+// shares. It is cancelled once the last member has gone.
+type coalesceGroup struct {
+	c       *coalescer
+	key     string
+	created time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	ready chan struct{} // closed once resp or err is set
+	resp  *http.Response
+	err   error
+
+	mu      sync.Mutex
+	data    []byte
+	eof     bool
+	readErr error
+	trailer http.Header
+	notify  chan struct{} // closed and replaced whenever data grows
+	members int
+	clients int
+	closed  bool
+}
+
+// CoalesceStats are the groups opened, the requests served from another
+// request's upstream response, and the groups still open.
+type CoalesceStats struct {
+	Window       string               `json:"window"`
+	Groups       int64                `json:"groups"`
+	Coalesced    int64                `json:"coalesced_requests"`
+	LargestGroup int                  `json:"largest_group"`
+	Active       []CoalesceGroupStats `json:"active"`
+}
+
+// CoalesceGroupStats describes an open group.
+type CoalesceGroupStats struct {
+	Key     string `json:"key"`
+	Members int    `json:"members"`
+	Clients int    `json:"clients"`
+	Bytes   int    `json:"bytes"`
+	AgeMs   int64  `json:"age_ms"`
+	Done    bool   `json:"done"`
+}
+
+// newCoalescer coalesces requests within window of each other; zero
+// disables coalescing.
+func newCoalescer(window time.Duration) *coalescer {
+	if window <= 0 {
+		return nil
+	}
+	return &coalescer{window: window, groups: make(map[string]*coalesceGroup)}
+}
+
+// coalesceKey identifies what the upstream would answer req with: the
+// same path, body, tenant and credentials. The backend is left out, since
+// any the request could be routed to would do, and so is X-Stream-ID,
+// which differs per stream.
+func coalesceKey(req *http.Request) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, req.Method+" "+req.URL.RequestURI()+"\n")
+	names := append([]string{server.TenantHeader}, credentialHeaders...)
+	for _, name := range names {
+		for _, v := range req.Header.Values(name) {
+			io.WriteString(h, name+": "+v+"\n")
+		}
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// join adds a member to the open group for key, or opens one. It reports
+// whether the group already existed: the member that opens a group has to
+// start it. Every member must read its response, or leave if it does not.
+func (c *coalescer) join(key string) (*coalesceGroup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[key]
+	if ok && !g.closed && time.Since(g.created) < c.window {
+		g.mu.Lock()
+		g.members++
+		g.clients++
+		if g.clients > c.largest {
+			c.largest = g.clients
+		}
+		g.mu.Unlock()
+		c.coalesced++
+		return g, true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g = &coalesceGroup{
+		c:       c,
+		key:     key,
+		created: time.Now(),
+		ctx:     ctx,
+		cancel:  cancel,
+		ready:   make(chan struct{}),
+		notify:  make(chan struct{}),
+		members: 1,
+		clients: 1,
+	}
+	c.groups[key] = g
+	c.opened++
+	c.largest = max(c.largest, 1)
+	return g, false
+}
+
+// start sends req upstream for the group with send and records the
+// response as it arrives. The request outlives the member that started it.
+func (g *coalesceGroup) start(send func(*http.Request) (*http.Response, error), req *http.Request) {
+	resp, err := send(req.WithContext(g.ctx))
+	g.finish(resp, err)
+	if err != nil {
+		return
+	}
+	go g.record(resp)
+}
+
+// finish settles the upstream response the members get.
+func (g *coalesceGroup) finish(resp *http.Response, err error) {
+	g.resp, g.err = resp, err
+	close(g.ready)
+}
+
+// record copies the upstream body into the group until it ends.
+func (g *coalesceGroup) record(resp *http.Response) {
+	defer resp.Body.Close()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		g.mu.Lock()
+		g.data = append(g.data, buf[:n]...)
+		if err != nil {
+			g.eof = true
+			if err != io.EOF {
+				g.readErr = err
+			}
+			// Trailers are only there once the body has been read to EOF
+			g.trailer = resp.Trailer.Clone()
+		}
+		close(g.notify)
+		g.notify = make(chan struct{})
+		g.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// response waits for the upstream response and returns a member's copy of
+// it, whose body reads the recorded stream from the start. Reads end with
+// ctx; closing the body leaves the group.
+func (g *coalesceGroup) response(ctx context.Context) (*http.Response, error) {
+	select {
+	case <-g.ready:
+	case <-ctx.Done():
+		g.leave()
+		return nil, ctx.Err()
+	}
+	if g.err != nil {
+		g.leave()
+		return nil, g.err
+	}
+	resp := new(http.Response)
+	*resp = *g.resp
+	resp.Header = g.resp.Header.Clone()
+	resp.Trailer = make(http.Header, len(g.resp.Trailer))
+	for name := range g.resp.Trailer {
+		resp.Trailer[name] = nil
+	}
+	resp.Body = &coalescedBody{g: g, ctx: ctx, resp: resp, closed: make(chan struct{})}
+	return resp, nil
+}
+
+// leave drops a member, cancelling the upstream request with the last.
+func (g *coalesceGroup) leave() {
+	c := g.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g.mu.Lock()
+	g.members--
+	last := g.members == 0
+	g.mu.Unlock()
+	if !last {
+		return
+	}
+	g.closed = true
+	g.cancel()
+	if c.groups[g.key] == g {
+		delete(c.groups, g.key)
+	}
+}
+
+// coalescedBody is a member's reader of the group's recorded stream.
+type coalescedBody struct {
+	g      *coalesceGroup
+	ctx    context.Context
+	resp   *http.Response
+	off    int
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (b *coalescedBody) Read(p []byte) (int, error) {
+	g := b.g
+	for {
+		g.mu.Lock()
+		if b.off < len(g.data) {
+			n := copy(p, g.data[b.off:])
+			b.off += n
+			g.mu.Unlock()
+			return n, nil
+		}
+		if g.eof {
+			for name := range b.resp.Trailer {
+				b.resp.Trailer[name] = g.trailer[name]
+			}
+			err := g.readErr
+			g.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		wait := g.notify
+		g.mu.Unlock()
+		select {
+		case <-wait:
+		case <-b.closed:
+			return 0, errors.New("read on closed body")
+		case <-b.ctx.Done():
+			return 0, b.ctx.Err()
+		}
+	}
+}
+
+func (b *coalescedBody) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+		b.g.leave()
+	})
+	return nil
+}
+
+// Stats reports the groups so far and those still open.
+func (c *coalescer) Stats() *CoalesceStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := &CoalesceStats{
+		Window:       c.window.String(),
+		Groups:       c.opened,
+		Coalesced:    c.coalesced,
+		LargestGroup: c.largest,
+		Active:       []CoalesceGroupStats{},
+	}
+	now := time.Now()
+	for _, g := range c.groups {
+		g.mu.Lock()
+		stats.Active = append(stats.Active, CoalesceGroupStats{
+			Key:     g.key[:12],
+			Members: g.members,
+			Clients: g.clients,
+			Bytes:   len(g.data),
+			AgeMs:   now.Sub(g.created).Milliseconds(),
+			Done:    g.eof,
+		})
+		g.mu.Unlock()
+	}
+	sort.Slice(stats.Active, func(i, j int) bool { return stats.Active[i].AgeMs > stats.Active[j].AgeMs })
+	return stats
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connLimiter smooths bursts of new streams with a token bucket for all of
+// them and one for each client address.
+type connLimiter struct {
+	mu                 sync.Mutex     // guards the buckets, which a reload replaces
+	global, perIP      *tenantBuckets // nil if not limited
+	limited, limitedIP int64
+}
+
+// ConnectionLimitStats counts the streams refused for the global rate
+// limit and for their address's, and the addresses being limited.
+type ConnectionLimitStats struct {
+	RateLimited   int64 `json:"rate_limited"`
+	RateLimitedIP int64 `json:"rate_limited_per_ip"`
+	Addresses     int   `json:"addresses"`
+}
+
+// set limits new streams to rate a second, in bursts of burst, and those
+// of each address to ipRate and ipBurst; a zero rate lifts its limit.
+func (l *connLimiter) set(rate float64, burst int, ipRate float64, ipBurst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = reuseBuckets(l.global, rate, burst)
+	l.perIP = reuseBuckets(l.perIP, ipRate, ipBurst)
+}
+
+// buckets returns the buckets new streams take from, nil for a limit not
+// set.
+func (l *connLimiter) buckets() (global, perIP *tenantBuckets) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.global, l.perIP
+}
+
+// clientAddr is the address a request came from, without its port.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitConnections refuses new streams beyond the connection rate limits
+// with a 429. A stream forwarded by a peer for session affinity, from the
+// peer's address, was limited by its client's address there, and here
+// only counts against the global limit.
+func (s *Proxy) limitConnections(next http.HandlerFunc) http.HandlerFunc {
+	l := &s.connLimits
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		global, perIP := l.buckets()
+		forwarded := s.affinity.forwarded(r)
+		if perIP != nil && !forwarded {
+			if ok, wait := perIP.take(clientAddr(r), now); !ok {
+				atomic.AddInt64(&l.limitedIP, 1)
+				refuseConnection(w, wait, perIP)
+				return
+			}
+		}
+		if global != nil {
+			if ok, wait := global.take("", now); !ok {
+				atomic.AddInt64(&l.limited, 1)
+				refuseConnection(w, wait, global)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// refuseConnection answers 429 with when to come back, as Retry-After and
+// as an SSE retry: hint, so EventSource clients that read the body back
+// off too. The delay is spread over the time the bucket takes to refill,
+// so the clients of a burst return at the rate they can be let in.
+func refuseConnection(w http.ResponseWriter, wait time.Duration, b *tenantBuckets) {
+	refill := time.Duration(b.burst / b.rate * float64(time.Second))
+	retry := wait + time.Duration(rand.Int63n(int64(refill)+1))
+	if retry < time.Millisecond {
+		retry = time.Millisecond
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retry.Seconds()))))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, ": connection rate limit exceeded\nretry: %d\n\n", retry.Milliseconds())
+}
+
+// connectionLimitStats snapshots the connection rate limit counters, or
+// nil without a limit.
+func (s *Proxy) connectionLimitStats() *ConnectionLimitStats {
+	l := &s.connLimits
+	global, perIP := l.buckets()
+	if global == nil && perIP == nil {
+		return nil
+	}
+	st := &ConnectionLimitStats{
+		RateLimited:   atomic.LoadInt64(&l.limited),
+		RateLimitedIP: atomic.LoadInt64(&l.limitedIP),
+	}
+	if perIP != nil {
+		perIP.mu.Lock()
+		st.Addresses = len(perIP.buckets)
+		perIP.mu.Unlock()
+	}
+	return st
+}
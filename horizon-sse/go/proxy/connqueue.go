@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"horizon-sse-go/server"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultConnectionQueueTimeout is how long a queued stream waits for a
+// connection slot if ConnectionQueueTimeout is not set.
+const DefaultConnectionQueueTimeout = 30 * time.Second
+
+var connectionQueueBuckets = []time.Duration{
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// connQueue admits streams up to the connection limit. Beyond it, up to
+// size streams wait in arrival order; each stream that ends hands its slot
+// to the first waiting, so a new arrival cannot overtake the queue.
+type connQueue struct {
+	active  *int64 // the proxy's active connections
+	limit   int    // 0 for no limit
+	size    int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	waiting *list.List // of *queuedConn, first come first
+
+	queued, timedOut, abandoned, full int64
+	wait                              *server.LatencyRecorder
+}
+
+type queuedConn struct {
+	ready    chan struct{}
+	admitted bool // set, under mu, when handed a slot
+}
+
+// ConnectionQueueStats describes the streams waiting for a connection
+// slot: how many wait now, how many did in all, and how those that left
+// the queue without one did.
+type ConnectionQueueStats struct {
+	Depth     int              `json:"depth"`
+	Size      int              `json:"size"`
+	Queued    int64            `json:"queued"`
+	TimedOut  int64            `json:"timed_out"`
+	Abandoned int64            `json:"abandoned"`
+	Full      int64            `json:"full"`
+	Wait      server.Histogram `json:"wait"`
+}
+
+func newConnQueue(active *int64, limit, size int, timeout time.Duration) *connQueue {
+	if timeout <= 0 {
+		timeout = DefaultConnectionQueueTimeout
+	}
+	return &connQueue{
+		active:  active,
+		limit:   limit,
+		size:    size,
+		timeout: timeout,
+		waiting: list.New(),
+		wait:    server.NewLatencyRecorder(connectionQueueBuckets...),
+	}
+}
+
+// acquire takes a connection slot, waiting in the queue for one if the
+// limit is reached. It fails if the queue is full, the wait times out or
+// ctx ends.
+func (q *connQueue) acquire(ctx context.Context) bool {
+	if q.limit <= 0 {
+		atomic.AddInt64(q.active, 1)
+		return true
+	}
+	q.mu.Lock()
+	if q.waiting.Len() == 0 && atomic.LoadInt64(q.active) < int64(q.limit) {
+		atomic.AddInt64(q.active, 1)
+		q.mu.Unlock()
+		return true
+	}
+	if q.waiting.Len() >= q.size {
+		q.mu.Unlock()
+		if q.size > 0 {
+			atomic.AddInt64(&q.full, 1)
+		}
+		return false
+	}
+	c := &queuedConn{ready: make(chan struct{})}
+	elem := q.waiting.PushBack(c)
+	q.mu.Unlock()
+	atomic.AddInt64(&q.queued, 1)
+
+	start := time.Now()
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	timedOut := false
+	select {
+	case <-c.ready:
+		q.wait.Observe(time.Since(start))
+		return true
+	case <-timer.C:
+		timedOut = true
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if c.admitted {
+		// Handed a slot as it gave up: it takes it
+		q.wait.Observe(time.Since(start))
+		return true
+	}
+	q.waiting.Remove(elem)
+	if timedOut {
+		atomic.AddInt64(&q.timedOut, 1)
+	} else {
+		atomic.AddInt64(&q.abandoned, 1)
+	}
+	return false
+}
+
+// release gives up a slot, to the first stream waiting if there is one.
+func (q *connQueue) release() {
+	if q.limit <= 0 {
+		atomic.AddInt64(q.active, -1)
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if front := q.waiting.Front(); front != nil {
+		c := q.waiting.Remove(front).(*queuedConn)
+		c.admitted = true
+		close(c.ready)
+		return
+	}
+	atomic.AddInt64(q.active, -1)
+}
+
+// stats snapshots the queue, or nil if streams are not queued.
+func (q *connQueue) stats() *ConnectionQueueStats {
+	if q.size <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	depth := q.waiting.Len()
+	q.mu.Unlock()
+	return &ConnectionQueueStats{
+		Depth:     depth,
+		Size:      q.size,
+		Queued:    atomic.LoadInt64(&q.queued),
+		TimedOut:  atomic.LoadInt64(&q.timedOut),
+		Abandoned: atomic.LoadInt64(&q.abandoned),
+		Full:      atomic.LoadInt64(&q.full),
+		Wait:      q.wait.Snapshot(),
+	}
+}
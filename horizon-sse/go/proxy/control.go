@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"horizon-sse-go/websocket"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Commands a client can send its stream.
+const (
+	// CommandPause holds the stream's events at the proxy until resumed;
+	// the upstream keeps sending into the stream's buffer meanwhile.
+	CommandPause = "pause"
+	// CommandResume delivers the events held and those that follow.
+	CommandResume = "resume"
+	// CommandCancel ends the stream and its upstream request.
+	CommandCancel = "cancel"
+	// CommandFilter delivers only events of the given types from then on.
+	CommandFilter = "filter"
+)
+
+// maxCommandBytes bounds the body of a stream command.
+const maxCommandBytes = 64 << 10
+
+// StreamCommand controls a running /sse stream. It is the body of POST
+// /streams/{id}/control, or, over WebSocket, any message the client sends
+// after the request. Events, for a filter, are the event types delivered
+// ("message" for events without one); a filter without any delivers all
+// of them again.
+type StreamCommand struct {
+	Command string   `json:"command"`
+	Events  []string `json:"events,omitempty"`
+}
+
+// StreamControlState answers a command with the state of the stream it
+// left. Error says why the command was refused.
+type StreamControlState struct {
+	StreamID  string   `json:"stream_id,omitempty"`
+	Command   string   `json:"command"`
+	Paused    bool     `json:"paused"`
+	Cancelled bool     `json:"cancelled"`
+	Events    []string `json:"events,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// streamControl is what commands set on a stream. Its forwarding loop
+// picks a command up as soon as it comes, by waiting on changed.
+type streamControl struct {
+	mu        sync.Mutex
+	streamID  string // set once the stream is tracked
+	paused    bool
+	cancelled bool
+	events    map[string]bool // the delivered event types, nil for all
+	changed   chan struct{}   // closed, and replaced, by each command
+}
+
+func newStreamControl() *streamControl {
+	return &streamControl{changed: make(chan struct{})}
+}
+
+type streamControlKey struct{}
+
+// withStreamControl has the stream served for r take its commands from
+// c, which a transport that carries them, like WebSocket, feeds.
+func withStreamControl(r *http.Request, c *streamControl) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), streamControlKey{}, c))
+}
+
+// streamControlFor returns the control of the stream served for r.
+func streamControlFor(r *http.Request) *streamControl {
+	if c, ok := r.Context().Value(streamControlKey{}).(*streamControl); ok {
+		return c
+	}
+	return newStreamControl()
+}
+
+func (c *streamControl) apply(cmd StreamCommand) (StreamControlState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch cmd.Command {
+	case CommandPause:
+		c.paused = true
+	case CommandResume:
+		c.paused = false
+	case CommandCancel:
+		c.cancelled = true
+	case CommandFilter:
+		c.events = nil
+		if len(cmd.Events) > 0 {
+			c.events = make(map[string]bool, len(cmd.Events))
+			for _, typ := range cmd.Events {
+				c.events[typ] = true
+			}
+		}
+	default:
+		return c.stateLocked(cmd.Command), fmt.Errorf("unknown command %q", cmd.Command)
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return c.stateLocked(cmd.Command), nil
+}
+
+func (c *streamControl) stateLocked(command string) StreamControlState {
+	state := StreamControlState{StreamID: c.streamID, Command: command, Paused: c.paused, Cancelled: c.cancelled}
+	for typ := range c.events {
+		state.Events = append(state.Events, typ)
+	}
+	sort.Strings(state.Events)
+	return state
+}
+
+// state returns whether the stream is paused or cancelled now, and a
+// channel closed by the next command.
+func (c *streamControl) state() (changed <-chan struct{}, paused, cancelled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changed, c.paused, c.cancelled
+}
+
+// allows reports whether ev passes the stream's filter. Events without
+// data are not dispatched to clients anyway, so they always pass.
+func (c *streamControl) allows(ev sseEvent) bool {
+	c.mu.Lock()
+	events := c.events
+	c.mu.Unlock()
+	if events == nil || !ev.hasData() {
+		return true
+	}
+	typ := ev.hubEvent().Type
+	if typ == "" {
+		typ = "message"
+	}
+	return events[typ]
+}
+
+// commandCounts counts the commands streams took, by transport and
+// command.
+type commandCounts struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+}
+
+func (c *commandCounts) record(transport, command string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]map[string]int64)
+	}
+	if c.counts[transport] == nil {
+		c.counts[transport] = make(map[string]int64)
+	}
+	c.counts[transport][command]++
+}
+
+func (c *commandCounts) snapshot() map[string]map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]map[string]int64, len(c.counts))
+	for transport, commands := range c.counts {
+		out[transport] = make(map[string]int64, len(commands))
+		for command, n := range commands {
+			out[transport][command] = n
+		}
+	}
+	return out
+}
+
+// streamCommand applies a command that came over transport to a stream.
+func (s *Proxy) streamCommand(c *streamControl, transport string, cmd StreamCommand) (StreamControlState, error) {
+	state, err := c.apply(cmd)
+	if err != nil {
+		return state, err
+	}
+	s.streamCommands.record(transport, cmd.Command)
+	s.logger.WithFields(logrus.Fields{
+		"stream_id": state.StreamID,
+		"command":   cmd.Command,
+		"transport": transport,
+		"events":    state.Events,
+	}).Info("Stream command")
+	return state, nil
+}
+
+// handleStreamControl applies the command in the body to a stream the
+// proxy is serving, and answers with the stream's state. Only the owner of
+// the stream, as requestOwner names it, may command it; to others it is
+// unknown, so stream IDs can't be probed.
+func (s *Proxy) handleStreamControl(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var cmd StreamCommand
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxCommandBytes)).Decode(&cmd); err != nil {
+		http.Error(w, "invalid command: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.streamsMu.Lock()
+	stream := s.streamsByID[id]
+	s.streamsMu.Unlock()
+	if stream == nil || stream.owner != requestOwner(r) {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+
+	state, err := s.streamCommand(stream.control, "http", cmd)
+	status := http.StatusOK
+	if err != nil {
+		state.Error = err.Error()
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(state)
+}
+
+// webSocketCommands applies the messages a WebSocket client sends after
+// its request as commands to its stream, answering each with a "control"
+// event of the stream's state.
+func (s *Proxy) webSocketCommands(c *streamControl) func(message []byte) *websocket.Message {
+	return func(message []byte) *websocket.Message {
+		var cmd StreamCommand
+		state, err := StreamControlState{}, json.Unmarshal(message, &cmd)
+		if err == nil {
+			state, err = s.streamCommand(c, "websocket", cmd)
+		} else {
+			err = fmt.Errorf("invalid command: %w", err)
+		}
+		if err != nil {
+			state.Error = err.Error()
+		}
+		data, _ := json.Marshal(state)
+		return &websocket.Message{Event: "control", Data: string(data)}
+	}
+}
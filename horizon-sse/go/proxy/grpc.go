@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"fmt"
+	"horizon-sse-go/grpcapi"
+	"net/http"
+	"sync/atomic"
+)
+
+// The protocols the proxy can stream from its upstreams with.
+const (
+	// UpstreamSSE POSTs the JSON API and reads its SSE response.
+	UpstreamSSE = "sse"
+	// UpstreamGRPC calls the gRPC ChatService at the same URLs, which must
+	// be https, and turns its messages back into SSE, so streams are
+	// served, recorded and retried as from an SSE upstream.
+	UpstreamGRPC = "grpc"
+)
+
+// upstreamTransports returns the transports of upstream streams and of
+// the rest, health checks and unary calls, for protocol; nil ones are
+// http.DefaultTransport.
+func upstreamTransports(protocol string, insecureTLS bool) (stream, probe http.RoundTripper, err error) {
+	switch protocol {
+	case "", UpstreamSSE:
+		if !insecureTLS {
+			return nil, nil, nil
+		}
+		base := grpcapi.NewTransport(true)
+		return base, base, nil
+	case UpstreamGRPC:
+		base := grpcapi.NewTransport(insecureTLS)
+		return &grpcapi.SSETransport{Base: base}, base, nil
+	}
+	return nil, nil, fmt.Errorf("unknown upstream protocol %q", protocol)
+}
+
+// handleGRPC serves /sse to gRPC clients of the ChatService: the call's
+// message is the body of a POST /sse and its metadata the headers.
+func (s *Proxy) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.grpcStreams, 1)
+	grpcapi.Handler("/sse", http.HandlerFunc(s.handleSSEProxy)).ServeHTTP(w, r)
+}
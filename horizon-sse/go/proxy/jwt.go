@@ -0,0 +1,551 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes of RS256, PS256 and ES256
+	_ "crypto/sha512" // and of their 384 and 512 variants
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"horizon-sse-go/server"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultJWKSRefresh is how often the signing keys are fetched again.
+	DefaultJWKSRefresh = 5 * time.Minute
+	// jwksMinRefetch bounds how often a token signed with an unknown key
+	// makes the keys be fetched again, for keys rotated in early.
+	jwksMinRefetch = 30 * time.Second
+	// jwtLeeway is the clock skew allowed on exp and nbf.
+	jwtLeeway = time.Minute
+	// maxJWKSBytes bounds a key set.
+	maxJWKSBytes = 1 << 20
+)
+
+// UserHeader carries the user a token was issued to upstream.
+const UserHeader = "X-User-Id"
+
+// JWTConfig is how tokens are validated and the limits put on the tenant
+// each names.
+type JWTConfig struct {
+	// JWKSURL serves the JSON Web Key Set tokens are signed with. RSA
+	// (RS256, PS256 and their 384 and 512 variants) and ECDSA keys (ES256,
+	// ES384, ES512) are used; others are skipped.
+	JWKSURL string
+	// Refresh is how often the key set is fetched again,
+	// DefaultJWKSRefresh if zero. A token signed with a key the set lacks
+	// fetches it sooner.
+	Refresh time.Duration
+	// Issuer and Audience, if set, must be the token's iss and one of its
+	// aud.
+	Issuer, Audience string
+	// TenantClaim names the tenant, "tenant" if empty, and UserClaim the
+	// user, "sub" if empty. A token without a tenant is refused.
+	TenantClaim, UserClaim string
+	// MaxStreams, if set, is how many streams and API calls each tenant
+	// may have open at once.
+	MaxStreams int
+	// MessagesPerMinute, if set, is how many messages a tenant may be
+	// streamed in a minute; past it, the tenant's new streams and calls
+	// are refused until the minute has passed.
+	MessagesPerMinute int64
+	// Client fetches the key set; a client with a 10s timeout if nil.
+	Client *http.Client
+}
+
+// JWTAuth authenticates clients by the JWT they send as a bearer token,
+// and limits the streams and messages of the tenant it names. The tenant
+// replaces any X-Tenant-ID the client sent, so usage, rate limits and the
+// upstream all see the tenant the token was issued for.
+type JWTAuth struct {
+	cfg        JWTConfig
+	minRefetch time.Duration
+
+	fetchMu  sync.Mutex // held while fetching
+	mu       sync.RWMutex
+	keys     []jwk
+	fetched  time.Time
+	fetches  int64
+	fetchErr int64
+
+	tenantsMu sync.Mutex
+	tenants   map[string]*tenantLimits
+	rejected  int64
+}
+
+type jwk struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// tenantLimits counts a tenant's open requests and, by second, the
+// messages it was streamed in the last minute.
+type tenantLimits struct {
+	connections, active, messages, throttled int64
+
+	mu     sync.Mutex
+	slots  [60]int64
+	second int64 // of the newest slot
+}
+
+// JWTTenantStats counts the requests a tenant was let through for, those
+// still open, the messages streamed to it in all and in the last minute,
+// and the requests refused for its limits.
+type JWTTenantStats struct {
+	Connections        int64 `json:"connections"`
+	Active             int64 `json:"active"`
+	Messages           int64 `json:"messages"`
+	MessagesLastMinute int64 `json:"messages_last_minute"`
+	Throttled          int64 `json:"throttled"`
+}
+
+// JWTStats counts the requests of each tenant, those refused for lacking
+// a valid token, and the key set fetches.
+type JWTStats struct {
+	Tenants     map[string]JWTTenantStats `json:"tenants"`
+	Rejected    int64                     `json:"rejected"`
+	Keys        int                       `json:"keys"`
+	Fetches     int64                     `json:"jwks_fetches"`
+	FetchErrors int64                     `json:"jwks_fetch_errors"`
+}
+
+// NewJWTAuth returns a validator for cfg, once its key set is fetched.
+func NewJWTAuth(cfg JWTConfig) (*JWTAuth, error) {
+	if cfg.JWKSURL == "" {
+		return nil, errors.New("no JWKS URL")
+	}
+	if cfg.MaxStreams < 0 || cfg.MessagesPerMinute < 0 {
+		return nil, fmt.Errorf("negative stream limit %d or messages per minute %d", cfg.MaxStreams, cfg.MessagesPerMinute)
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = DefaultJWKSRefresh
+	}
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "tenant"
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	j := &JWTAuth{cfg: cfg, minRefetch: jwksMinRefetch, tenants: make(map[string]*tenantLimits)}
+	if err := j.fetch(time.Now()); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// fetch replaces the keys with the key set served now.
+func (j *JWTAuth) fetch(now time.Time) error {
+	atomic.AddInt64(&j.fetches, 1)
+	keys, err := j.fetchKeys()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetched = now
+	if err != nil {
+		atomic.AddInt64(&j.fetchErr, 1)
+		return fmt.Errorf("JWKS %s: %w", j.cfg.JWKSURL, err)
+	}
+	j.keys = keys
+	return nil
+}
+
+func (j *JWTAuth) fetchKeys() ([]jwk, error) {
+	resp, err := j.cfg.Client.Get(j.cfg.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&set); err != nil {
+		return nil, err
+	}
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := decodeBigInt(k.N)
+			e, errE := decodeBigInt(k.E)
+			if errN != nil || errE != nil || !e.IsInt64() || e.Int64() > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+			x, errX := decodeBigInt(k.X)
+			y, errY := decodeBigInt(k.Y)
+			if curve == nil || errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+			if _, err := pub.ECDH(); err != nil {
+				return nil, fmt.Errorf("invalid EC key %q: %w", k.Kid, err)
+			}
+			key = pub
+		default:
+			continue
+		}
+		keys = append(keys, jwk{kid: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keysFor returns the keys a token signed with kid may be checked with,
+// fetching the key set again if it is due, or if kid is not in it and it
+// was not fetched just now. Failed fetches leave the keys as they were.
+func (j *JWTAuth) keysFor(kid string, now time.Time) []jwk {
+	find := func() ([]jwk, time.Time) {
+		j.mu.RLock()
+		defer j.mu.RUnlock()
+		var found []jwk
+		for _, k := range j.keys {
+			if kid == "" || k.kid == kid {
+				found = append(found, k)
+			}
+		}
+		return found, j.fetched
+	}
+	found, fetched := find()
+	age := now.Sub(fetched)
+	if age < j.cfg.Refresh && (len(found) > 0 || age < j.minRefetch) {
+		return found
+	}
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+	// Another request may have fetched them while this one waited
+	if _, again := find(); again.Equal(fetched) {
+		j.fetch(now)
+	}
+	found, _ = find()
+	return found
+}
+
+// verify checks the signature and times of token, and the issuer and
+// audience if configured, and returns its claims.
+func (j *JWTAuth) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range j.keysFor(header.Kid, now) {
+		if err := verifySignature(header.Alg, k.key, signed, sig); err == nil {
+			verified = true
+			break
+		} else if errors.Is(err, errUnsupportedAlg) {
+			return nil, err
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if j.cfg.Issuer != "" && claims["iss"] != j.cfg.Issuer {
+		return nil, fmt.Errorf("issuer %v, want %s", claims["iss"], j.cfg.Issuer)
+	}
+	if j.cfg.Audience != "" && !hasAudience(claims["aud"], j.cfg.Audience) {
+		return nil, fmt.Errorf("audience %v lacks %s", claims["aud"], j.cfg.Audience)
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errUnsupportedAlg = errors.New("unsupported signing algorithm")
+
+// verifySignature checks sig of signed under alg with key; a key of the
+// wrong type or curve for alg fails.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return errUnsupportedAlg
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errUnsupportedAlg
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("not an RSA key")
+		}
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		}
+		return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		curves := map[string]elliptic.Curve{"256": elliptic.P256(), "384": elliptic.P384(), "512": elliptic.P521()}
+		if !ok || pub.Curve != curves[alg[2:]] {
+			return errors.New("not an EC key on the algorithm's curve")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	}
+	return errUnsupportedAlg
+}
+
+// claimString returns a string or number claim as text.
+func claimString(claims map[string]interface{}, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// tenant returns the limits of tenant. Tenants only come from signed
+// tokens, so they are kept for as long as the proxy runs.
+func (j *JWTAuth) tenant(name string) *tenantLimits {
+	j.tenantsMu.Lock()
+	defer j.tenantsMu.Unlock()
+	t := j.tenants[name]
+	if t == nil {
+		t = &tenantLimits{}
+		j.tenants[name] = t
+	}
+	return t
+}
+
+// advance moves the window to the second of now. Callers hold mu.
+func (t *tenantLimits) advance(now time.Time) {
+	sec := now.Unix()
+	if sec <= t.second {
+		return
+	}
+	if sec-t.second >= int64(len(t.slots)) {
+		t.slots = [60]int64{}
+	} else {
+		for s := t.second + 1; s <= sec; s++ {
+			t.slots[s%60] = 0
+		}
+	}
+	t.second = sec
+}
+
+func (t *tenantLimits) count(now time.Time, n int64) {
+	atomic.AddInt64(&t.messages, n)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(now)
+	t.slots[t.second%60] += n
+}
+
+// lastMinute returns the messages of the last minute and, if limit is
+// reached, how long until enough of them are older than a minute.
+func (t *tenantLimits) lastMinute(now time.Time, limit int64) (int64, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(now)
+	var sum int64
+	for _, n := range t.slots {
+		sum += n
+	}
+	if limit <= 0 || sum < limit {
+		return sum, 0
+	}
+	left := sum
+	for i := int64(0); i < 60; i++ {
+		left -= t.slots[(t.second+1+i)%60]
+		if left < limit {
+			return sum, time.Duration(i+1) * time.Second
+		}
+	}
+	return sum, time.Minute
+}
+
+type (
+	jwtContextKey     struct{}
+	jwtUserContextKey struct{}
+)
+
+// jwtUser returns the user of the token r was let through with, if any.
+func jwtUser(r *http.Request) string {
+	user, _ := r.Context().Value(jwtUserContextKey{}).(string)
+	return user
+}
+
+// Wrap lets through the requests with a valid token whose tenant is within
+// its limits. Requests without one are answered 401, those of a tenant at
+// its limits 429.
+func (j *JWTAuth) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		claims, err := j.verify(strings.TrimSpace(token), now)
+		var tenant string
+		if err == nil {
+			if tenant = claimString(claims, j.cfg.TenantClaim); tenant == "" {
+				err = fmt.Errorf("token has no %s claim", j.cfg.TenantClaim)
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&j.rejected, 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxy", error="invalid_token"`)
+			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		t := j.tenant(tenant)
+		if _, wait := t.lastMinute(now, j.cfg.MessagesPerMinute); wait > 0 {
+			atomic.AddInt64(&t.throttled, 1)
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Tenant message rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if active := atomic.AddInt64(&t.active, 1); j.cfg.MaxStreams > 0 && active > int64(j.cfg.MaxStreams) {
+			atomic.AddInt64(&t.active, -1)
+			atomic.AddInt64(&t.throttled, 1)
+			http.Error(w, "Tenant stream limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		defer atomic.AddInt64(&t.active, -1)
+		atomic.AddInt64(&t.connections, 1)
+
+		r.Header.Set(server.TenantHeader, tenant)
+		ctx := context.WithValue(r.Context(), jwtContextKey{}, t)
+		ctx = context.WithValue(ctx, jwtUserContextKey{}, claimString(claims, j.cfg.UserClaim))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// Stats snapshots the counters of each tenant.
+func (j *JWTAuth) Stats() JWTStats {
+	now := time.Now()
+	j.mu.RLock()
+	st := JWTStats{Keys: len(j.keys)}
+	j.mu.RUnlock()
+	st.Rejected = atomic.LoadInt64(&j.rejected)
+	st.Fetches = atomic.LoadInt64(&j.fetches)
+	st.FetchErrors = atomic.LoadInt64(&j.fetchErr)
+	j.tenantsMu.Lock()
+	defer j.tenantsMu.Unlock()
+	st.Tenants = make(map[string]JWTTenantStats, len(j.tenants))
+	for name, t := range j.tenants {
+		lastMinute, _ := t.lastMinute(now, 0)
+		st.Tenants[name] = JWTTenantStats{
+			Connections:        atomic.LoadInt64(&t.connections),
+			Active:             atomic.LoadInt64(&t.active),
+			Messages:           atomic.LoadInt64(&t.messages),
+			MessagesLastMinute: lastMinute,
+			Throttled:          atomic.LoadInt64(&t.throttled),
+		}
+	}
+	return st
+}
+
+// jwtStats reports the JWT counters, or nil without JWT authentication.
+func (s *Proxy) jwtStats() *JWTStats {
+	if s.jwt == nil {
+		return nil
+	}
+	st := s.jwt.Stats()
+	return &st
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The distributions of injected latency.
+const (
+	LatencyFixed   = "fixed"
+	LatencyUniform = "uniform"
+	LatencyPareto  = "pareto"
+)
+
+// latencyQueue bounds the events held for their latency on a stream. Past
+// it the pump stops reading the upstream, as a full TCP window would.
+const latencyQueue = 1024
+
+// Latency is an artificial delay put on each event of a /sse stream
+// between its receipt from the upstream and its write to the client, to
+// simulate a WAN without external tooling. Dist is LatencyFixed (Min),
+// LatencyUniform (Min to Max) or LatencyPareto, a long-tailed jitter whose
+// least delay is Min and whose tail is the longer the smaller Shape; Max,
+// if set, caps it. Each event's delay runs from its receipt, and events
+// keep their order, so one never overtakes another held longer.
+type Latency struct {
+	Dist  string
+	Min   time.Duration
+	Max   time.Duration
+	Shape float64
+}
+
+// ParseLatency parses a -latency setting: "fixed:50ms" (or just "50ms"),
+// "uniform:20ms-80ms" or "pareto:10ms,shape=1.5[,max=2s]". Empty or "off"
+// injects none.
+func ParseLatency(spec string) (Latency, error) {
+	var l Latency
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "off" {
+		return l, nil
+	}
+	dist, args, ok := strings.Cut(spec, ":")
+	if !ok {
+		dist, args = LatencyFixed, spec
+	}
+	fields := strings.Split(args, ",")
+	var err error
+	switch l.Dist = strings.TrimSpace(dist); l.Dist {
+	case LatencyFixed:
+		l.Min, err = time.ParseDuration(strings.TrimSpace(fields[0]))
+	case LatencyUniform:
+		min, max, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return l, fmt.Errorf("latency %q: want uniform:MIN-MAX", spec)
+		}
+		if l.Min, err = time.ParseDuration(strings.TrimSpace(min)); err == nil {
+			l.Max, err = time.ParseDuration(strings.TrimSpace(max))
+		}
+	case LatencyPareto:
+		l.Min, err = time.ParseDuration(strings.TrimSpace(fields[0]))
+		for _, field := range fields[1:] {
+			if err != nil {
+				break
+			}
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "shape":
+				l.Shape, err = strconv.ParseFloat(value, 64)
+			case "max":
+				l.Max, err = time.ParseDuration(value)
+			default:
+				return l, fmt.Errorf("latency %q: unknown option %q", spec, key)
+			}
+		}
+		fields = fields[:1]
+	default:
+		return l, fmt.Errorf("latency %q: unknown distribution %q", spec, l.Dist)
+	}
+	if err == nil && len(fields) > 1 {
+		err = fmt.Errorf("unexpected %q", fields[1])
+	}
+	if err == nil {
+		err = l.validate()
+	}
+	if err != nil {
+		return l, fmt.Errorf("latency %q: %w", spec, err)
+	}
+	return l, nil
+}
+
+func (l Latency) validate() error {
+	switch l.Dist {
+	case "":
+	case LatencyFixed:
+		if l.Min < 0 {
+			return fmt.Errorf("negative delay")
+		}
+	case LatencyUniform:
+		if l.Min < 0 || l.Max < l.Min {
+			return fmt.Errorf("uniform needs 0 <= min <= max")
+		}
+	case LatencyPareto:
+		if l.Min <= 0 || l.Shape <= 0 {
+			return fmt.Errorf("pareto needs a positive min and shape")
+		}
+		if l.Max != 0 && l.Max < l.Min {
+			return fmt.Errorf("pareto max below its min")
+		}
+	default:
+		return fmt.Errorf("unknown distribution %q", l.Dist)
+	}
+	return nil
+}
+
+// sample draws the delay of one event.
+func (l Latency) sample() time.Duration {
+	switch l.Dist {
+	case LatencyFixed:
+		return l.Min
+	case LatencyUniform:
+		return l.Min + time.Duration(rand.Int63n(int64(l.Max-l.Min)+1))
+	case LatencyPareto:
+		// Inverse transform: 1-Float64 is in (0, 1], so d is at least Min
+		d := float64(l.Min) / math.Pow(1-rand.Float64(), 1/l.Shape)
+		if l.Max != 0 && d > float64(l.Max) {
+			return l.Max
+		}
+		if d > math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return time.Duration(d)
+	}
+	return 0
+}
+
+// delayLine holds the events of one stream for their latency on their
+// way from the pump's reader to its buffer, in a goroutine of its own so
+// the reader keeps receiving while they wait.
+type delayLine struct {
+	latency Latency
+	ctx     context.Context
+	queue   chan sseEvent
+	failed  chan struct{}
+	done    chan struct{}
+	err     error // why put failed, once failed is closed
+}
+
+func newDelayLine(ctx context.Context, latency Latency, put func(sseEvent) error) *delayLine {
+	d := &delayLine{
+		latency: latency,
+		ctx:     ctx,
+		queue:   make(chan sseEvent, latencyQueue),
+		failed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(d.done)
+		for ev := range d.queue {
+			if wait := time.Until(ev.readAt.Add(d.latency.sample())); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					d.err = ctx.Err()
+					close(d.failed)
+					return
+				}
+			}
+			if err := put(ev); err != nil {
+				d.err = err
+				close(d.failed)
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// put queues ev, received at ev.readAt. It fails once the buffer refused
+// an event, so the reader stops as it would without the delay.
+func (d *delayLine) put(ev sseEvent) error {
+	select {
+	case d.queue <- ev:
+		return nil
+	case <-d.failed:
+		return d.err
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+// close waits for the events queued to be put, or for put to fail.
+func (d *delayLine) close() {
+	close(d.queue)
+	<-d.done
+}
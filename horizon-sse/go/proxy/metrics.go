@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"horizon-sse-go/server"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func (s *Proxy) metricsSnapshot() map[string]interface{} {
+	// Get deep server metrics
+	deepMetrics := make(map[string]interface{})
+	resp, err := http.Get(fmt.Sprintf("%s/metrics", s.upstreams.primary()))
+	if err == nil {
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&deepMetrics)
+	}
+
+	buffers := s.streamBuffers.Stats()
+	return map[string]interface{}{
+		"proxy": map[string]interface{}{
+			"active_connections": atomic.LoadInt64(&s.activeConnections),
+			"total_connections":  atomic.LoadInt64(&s.totalConnections),
+			"proxied_messages":   atomic.LoadInt64(&s.proxiedMessages),
+			"failed_connections": atomic.LoadInt64(&s.failedConnections),
+			"pump_buffer_size":   s.pumpBufferSize,
+			"pump_stalls":        buffers.Stalls,
+			"pump_stall_ms":      int64(buffers.StallMs),
+			"stream_buffers":     buffers,
+			"write_errors":       s.writeErrors.Snapshot(),
+			"slow_clients":       s.slowClientStats(),
+			"migration_hints":    atomic.LoadInt64(&s.migrationHints),
+			"joined_clients":     atomic.LoadInt64(&s.joinedClients),
+			"client_aborts":      atomic.LoadInt64(&s.clientAborts),
+			"bad_content_types":  atomic.LoadInt64(&s.contentTypeErrors),
+			"upstream_errors":    s.upstreamStatusSnapshot(),
+			"error_events":       atomic.LoadInt64(&s.streamErrorEvents),
+			"upstream_inflight":  atomic.LoadInt64(&s.upstreamInFlight),
+			"shed_connections":   atomic.LoadInt64(&s.shedConnections),
+			"connection_limits":  s.connectionLimitStats(),
+			"connection_queue":   s.connQueue.stats(),
+			"queue_depth":        s.queueDepth(),
+			"transcoded_streams": s.transcodedSnapshot(),
+			"abort_propagation":  s.abortPropagation.Snapshot(),
+			"upstream_cancels":   s.cancelReportStats(),
+			"flushes":            s.flushes.Stats(),
+			"heartbeats":         s.heartbeats.Stats(),
+			"connections":        s.conns.Stats(),
+			"replay":             s.replay.Stats(),
+			"coalescing":         s.coalescer.Stats(),
+			"upstreams":          s.upstreams.Stats(),
+			"affinity":           s.affinity.Stats(),
+			"early_flushes":      atomic.LoadInt64(&s.earlyFlushes),
+			"websocket_streams":  atomic.LoadInt64(&s.websocketStreams),
+			"stream_commands":    s.streamCommands.snapshot(),
+			"grpc_streams":       atomic.LoadInt64(&s.grpcStreams),
+			"unary":              s.unaryStats(),
+			"batch":              s.batchStats(),
+			"auth":               s.authStats(),
+			"jwt":                s.jwtStats(),
+			"request_bodies":     s.bodies.Stats(),
+			"upstream_retries":   s.retryStats(),
+			"retention":          s.janitor.Stats(),
+			"recordings":         s.recorder.Stats(),
+			"oversized_bodies": map[string]int64{
+				"refused":          atomic.LoadInt64(&s.oversizedBodies),
+				"continue_refused": atomic.LoadInt64(&s.continueRefused),
+			},
+			"sequencing": map[string]int64{
+				"duplicates":   atomic.LoadInt64(&s.seqDuplicates),
+				"out_of_order": atomic.LoadInt64(&s.seqOutOfOrder),
+				"gaps":         atomic.LoadInt64(&s.seqGaps),
+				"repaired":     atomic.LoadInt64(&s.seqRepaired),
+			},
+		},
+		"deep_server": deepMetrics,
+		"hub":         s.hub.Stats(),
+		"config":      s.config.Stats(),
+		"timestamp":   time.Now().Format(time.RFC3339),
+	}
+}
+
+func (s *Proxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.metricsSnapshot())
+}
+
+// handleMetricsStream pushes a metrics snapshot every metricsInterval so
+// dashboards can subscribe instead of polling /metrics.
+func (s *Proxy) handleMetricsStream(w http.ResponseWriter, r *http.Request) {
+	clearWriteDeadline(w)
+	s.hub.ServeSSE(w, r, metricsTopic)
+}
+
+// publishMetrics feeds the metrics topic while anyone is subscribed.
+func (s *Proxy) publishMetrics(ctx context.Context) {
+	ticker := time.NewTicker(s.metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if s.hub.Subscribers(metricsTopic) == 0 {
+			continue
+		}
+		data, err := json.Marshal(s.metricsSnapshot())
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to marshal metrics snapshot")
+			continue
+		}
+		s.hub.Publish(metricsTopic, server.Event{Type: "metrics", Data: string(data)})
+	}
+}
+
+func (s *Proxy) handleHealth(w http.ResponseWriter, r *http.Request) {
+	// Check deep server health
+	deepHealthy := false
+	backends := s.upstreams.list()
+	upstreams := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		resp, err := http.Get(fmt.Sprintf("%s/health", b.URL))
+		if err == nil {
+			resp.Body.Close()
+			upstreams[b.Name] = resp.StatusCode == http.StatusOK
+		}
+		deepHealthy = deepHealthy || upstreams[b.Name]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(upstreams) == 1 {
+		fmt.Fprintf(w, `{"status": "healthy", "service": "proxy-server", "deep_server_healthy": %v}`, deepHealthy)
+		return
+	}
+	// With several upstreams the proxy can serve streams while any is up
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":              "healthy",
+		"service":             "proxy-server",
+		"deep_server_healthy": deepHealthy,
+		"upstreams":           upstreams,
+	})
+}
+
+// admit takes one of limit slots counted by counter, or reports that all
+// are taken. A limit of 0 admits everything.
+func admit(counter *int64, limit int) bool {
+	if n := atomic.AddInt64(counter, 1); limit > 0 && n > int64(limit) {
+		atomic.AddInt64(counter, -1)
+		return false
+	}
+	return true
+}
+
+// shed refuses a stream because the proxy is at its limit for resource.
+func (s *Proxy) shed(w http.ResponseWriter, resource string) {
+	s.noteShed(resource)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Proxy at capacity", http.StatusServiceUnavailable)
+}
+
+// noteShed counts and logs a stream refused for lack of resource.
+func (s *Proxy) noteShed(resource string) {
+	atomic.AddInt64(&s.shedConnections, 1)
+	s.shedRate.Add(1)
+	s.logger.WithField("resource", resource).Warn("Proxy at capacity, refusing stream")
+}
+
+// capacityReport measures the proxy against its configured limits.
+func (s *Proxy) capacityReport() *server.CapacityReport {
+	streams := atomic.LoadInt64(&s.activeConnections)
+	rep := server.NewCapacityReport(streams)
+	rep.Add("connections", streams, int64(s.maxConnections), 1)
+	rep.Add("upstream_inflight", atomic.LoadInt64(&s.upstreamInFlight), int64(s.maxUpstreamInFlight), 1)
+
+	// Per-stream memory is estimated from the growth since startup, so it
+	// is only known while streams are open
+	memory := server.ProcessMemory()
+	var memoryPerStream float64
+	if streams > 0 && memory > s.baseMemory {
+		memoryPerStream = float64(memory-s.baseMemory) / float64(streams)
+	}
+	rep.Add("memory_bytes", memory, s.memoryBudget, memoryPerStream)
+
+	// Each stream holds the client socket and the upstream one
+	if open, limit := server.OpenFiles(); open >= 0 {
+		rep.Add("file_descriptors", open, limit, 2)
+	}
+	return rep.Finish()
+}
+
+// handleCapacity reports utilization and headroom against the configured
+// limits, for autoscalers and capacity dashboards.
+func (s *Proxy) handleCapacity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Upstream string `json:"upstream"`
+		*server.CapacityReport
+		Shed      int64  `json:"shed_connections"`
+		Timestamp string `json:"timestamp"`
+	}{s.upstreams.primary(), s.capacityReport(), atomic.LoadInt64(&s.shedConnections), time.Now().Format(time.RFC3339)})
+}
+
+// queueDepth returns the upstream events waiting in all pumps for their
+// clients to take them.
+func (s *Proxy) queueDepth() int64 {
+	return s.streamBuffers.Stats().Queued
+}
+
+// handleAutoscale reports the saturation metrics autoscalers scale on, as
+// JSON for the KEDA metrics-api scaler or, with ?format=prometheus, in the
+// Prometheus text format for external metrics adapters.
+func (s *Proxy) handleAutoscale(w http.ResponseWriter, r *http.Request) {
+	saturation := server.NewAutoscaleSignal(
+		atomic.LoadInt64(&s.activeConnections),
+		s.queueDepth(),
+		s.shedRate.Rate(),
+		s.autoscale,
+	)
+	if r.URL.Query().Get("format") == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		saturation.WritePrometheus(w, "horizon_proxy_")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saturation)
+}
+
+// handleUsage reports the CPU time and bytes attributed to each tenant,
+// for chargeback.
+func (s *Proxy) handleUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.usage.Snapshot())
+}
+
+// handleRetention reports what the janitor keeps and has removed of each
+// class of stored data; a POST has it make a pass first.
+func (s *Proxy) handleRetention(w http.ResponseWriter, r *http.Request) {
+	stats := s.janitor.Stats()
+	if r.Method == http.MethodPost {
+		stats = s.janitor.Clean()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
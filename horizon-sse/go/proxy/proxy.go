@@ -0,0 +1,800 @@
+// Package proxy is the SSE proxy that sits between clients and the deep
+// server: it relays upstream streams with new event IDs and optional
+// transforms, lets clients join running streams and reports its metrics
+// and capacity. A Proxy is an http.Handler, so it can be mounted behind
+// any router and middleware; cmd/proxy-server runs it standalone.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"horizon-sse-go/audit"
+	"horizon-sse-go/config"
+	"horizon-sse-go/grpcapi"
+	"horizon-sse-go/objstore"
+	"horizon-sse-go/retention"
+	"horizon-sse-go/server"
+	"horizon-sse-go/streamio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Options holds the settings the proxy is started with.
+type Options struct {
+	DeepServerURL string
+	// Logger receives the proxy's logs; nil logs to stderr as text.
+	Logger *logrus.Logger
+	// PumpBufferSize is the number of upstream events that may be queued
+	// for a client before the slow-client policy applies.
+	PumpBufferSize int
+	// SlowClientPolicy is what a /sse stream does once its client falls
+	// PumpBufferSize events behind: streamio.OverflowBlock (the default)
+	// makes the upstream reader wait, the others drop events or the
+	// client.
+	SlowClientPolicy streamio.Overflow
+	// WriteDeadline, if set, bounds every write and flush to a /sse
+	// client; a client that takes longer is disconnected.
+	WriteDeadline time.Duration
+	// MaxLineBytes is the longest upstream line the proxy accepts; a
+	// longer one ends the stream with an error.
+	MaxLineBytes int
+	// EventIDs picks the id: strategy for events forwarded on each route.
+	EventIDs server.EventIDRoutes
+	// MetricsInterval is how often /metrics/stream pushes a snapshot.
+	MetricsInterval time.Duration
+	// MigrateTo lists addresses clients are advised to reconnect to when
+	// this instance drains. MigrateDiscoveryURL, if set, is queried at drain
+	// time for a JSON array of addresses instead.
+	MigrateTo           []string
+	MigrateDiscoveryURL string
+	// MigrateJitter spreads the advised reconnect delays.
+	MigrateJitter time.Duration
+	// ForwardHeaders and ForwardTrailers decide which upstream response
+	// headers and trailers are passed on to the client.
+	ForwardHeaders  HeaderPolicy
+	ForwardTrailers HeaderPolicy
+	// Rechunk picks the rechunk mode for the text forwarded on each route;
+	// RechunkMaxHold bounds the bytes held back waiting for a boundary.
+	Rechunk        server.RechunkRoutes
+	RechunkMaxHold int
+	// Sequencing checks that the numeric ids of upstream events count up
+	// by one: "flag" counts violations, "repair" also puts events back in
+	// order, holding up to SequencingWindow events while it waits for a
+	// missing one, and drops duplicates. Empty or "off" disables it.
+	Sequencing       string
+	SequencingWindow int
+	// UpstreamTypes lists the media types accepted from the upstream.
+	// Anything else, typically an HTML error page from a load balancer,
+	// fails the request instead of being relayed as SSE.
+	UpstreamTypes []string
+	// PatchSnapshotEvery is the number of patches between full snapshots
+	// for clients that ask for ?format=patch.
+	PatchSnapshotEvery int
+	// UpstreamErrors picks how upstream error statuses reach the client on
+	// each route. Redactor scrubs upstream bodies that are passed on; nil
+	// uses the default patterns.
+	UpstreamErrors server.UpstreamErrorRoutes
+	Redactor       *server.Redactor
+	// MaxConnections and MaxUpstreamInFlight cap the client streams and
+	// the requests open to the upstream; past them new streams get a 503.
+	// MemoryBudget is the memory the proxy is meant to stay within, in
+	// bytes. Zero means unlimited; /capacity reports usage against all
+	// three.
+	MaxConnections      int
+	MaxUpstreamInFlight int
+	MemoryBudget        int64
+	// ConnectionQueue, if set, is how many streams past MaxConnections
+	// wait, first come first served, for one to end rather than get a 503
+	// at once. A stream waits at most ConnectionQueueTimeout
+	// (DefaultConnectionQueueTimeout if zero) before it gets one anyway.
+	ConnectionQueue        int
+	ConnectionQueueTimeout time.Duration
+	// ConnectionRate, if set, is how many new streams (/sse, /ws and gRPC)
+	// the proxy accepts a second, in bursts of up to ConnectionBurst (a
+	// second's worth if zero), and ConnectionRatePerIP and
+	// ConnectionBurstPerIP the same for each client address. Streams
+	// beyond either are answered 429, told when to retry.
+	ConnectionRate       float64
+	ConnectionBurst      int
+	ConnectionRatePerIP  float64
+	ConnectionBurstPerIP int
+	// Autoscale holds the per-instance targets /autoscale reports and
+	// computes its scale ratio from.
+	Autoscale server.AutoscaleTargets
+	// WattsPerCore, if set, adds an energy estimate to /usage.
+	WattsPerCore float64
+	// TraceEvents stamps every event forwarded on /sse with when it passed
+	// each stage of the pipeline, in SSE comments that `loadtest trace`
+	// turns into a per-stage latency report.
+	TraceEvents bool
+	// ReportCancellations tells the upstream why the proxy cancelled a
+	// stream before it ended (server.CancelClientGone and the rest), with a
+	// DELETE of server.CancelPath, so the deep server can account the
+	// generation wasted on it.
+	ReportCancellations bool
+	// SlowFlush is the flush duration past which a flush to a client is
+	// logged and counted as slow; server.DefaultSlowFlush if zero.
+	SlowFlush time.Duration
+	// Heartbeat, if set, sends a ": ping" comment to a /sse client whose
+	// stream has been quiet for that long, once its headers are out: from
+	// the start with early flush, else once the upstream answers.
+	Heartbeat time.Duration
+	// ReplaySize is the number of events kept for each client that passes
+	// a client_id, so it can reconnect with Last-Event-ID and be sent
+	// what it missed, for ReplayTTL after its last event
+	// (server.DefaultReplayTTL if zero). Zero disables replay.
+	ReplaySize int
+	ReplayTTL  time.Duration
+	// ReplayMemory, if set, is how many bytes of a client's events are
+	// kept in memory; older ones spill to files in ReplaySpillDir (the
+	// system's temp directory if empty), so streams running for hours stay
+	// resumable. Zero keeps them all in memory.
+	ReplayMemory   int64
+	ReplaySpillDir string
+	// IdleLeakAfter is how long a keep-alive connection may sit idle
+	// before /metrics counts it as leaked; server.DefaultIdleLeakAfter if
+	// zero. Only connections reported to ConnState are seen.
+	IdleLeakAfter time.Duration
+	// UsageSample is how often Run attributes CPU time to streams for
+	// /usage; a second if zero.
+	UsageSample time.Duration
+	// MaxRequestBytes bounds the chat request a client may POST to /sse,
+	// or the body of a unary call, to have it forwarded upstream;
+	// DefaultMaxRequestBytes if zero.
+	MaxRequestBytes int64
+	// BodyMemory is how much of a POSTed request is kept in memory while
+	// its stream runs, DefaultBodyMemory if zero; larger ones spill to a
+	// temp file in BodySpoolDir, the system's temp directory if empty.
+	BodyMemory   int64
+	BodySpoolDir string
+	// UpstreamRetries is how many times the upstream request of a stream
+	// is sent again, to a backend picked afresh, when it fails to connect
+	// or is answered 502, 503 or 504. Retries wait RetryBackoff
+	// (DefaultRetryBackoff if zero), doubled for each one after. Zero
+	// never retries.
+	UpstreamRetries int
+	RetryBackoff    time.Duration
+	// UpstreamProtocol is how streams are requested from the upstreams:
+	// UpstreamSSE, the default, or UpstreamGRPC. UpstreamInsecureTLS skips
+	// verifying the certificates of https upstreams, such as the
+	// self-signed one of a deep server's -grpc-port.
+	UpstreamProtocol    string
+	UpstreamInsecureTLS bool
+	// CoalesceWindow, if set, lets /sse requests identical to one made up
+	// to that long before share its upstream request: the upstream stream
+	// is recorded and fanned out to each of them from the start. Zero
+	// sends every request upstream.
+	CoalesceWindow time.Duration
+	// Upstreams, if set, replaces DeepServerURL with several named
+	// backends. Each stream goes to one of those of the first of Routes it
+	// matches, or of all of them, picked by Balancer (round-robin if nil).
+	Upstreams []Upstream
+	Routes    []Route
+	Balancer  Balancer
+	// HealthCheck, if its Interval is set, polls each upstream and takes
+	// those failing out of rotation until they recover.
+	HealthCheck HealthCheck
+	// Node names this proxy among Peers, the other nodes of its cluster by
+	// name and URL. When set, /sse responses carry an AffinityCookie
+	// naming the node, and a request with a peer's cookie is sent to that
+	// peer, so reconnects find their replay buffer: proxied if Affinity is
+	// AffinityForward (the default), or redirected if AffinityRedirect. A
+	// peer that is down is fallen back from by serving the request here.
+	Node     string
+	Peers    map[string]string
+	Affinity string
+	// EarlyFlush, unless EarlyFlushOff (the default), opens every /sse
+	// stream as soon as the request is validated, before the upstream
+	// answers, with a notice of the given kind. Clients can then tell a
+	// stream waiting for the model from a failed connection. Upstream
+	// failures are then reported in error events and upstream headers are
+	// not forwarded. A client can ask for it with ?flush_headers=true.
+	EarlyFlush string
+	// Retention has a janitor keep stored data within the policies of its
+	// rules, every RetentionInterval (a minute if zero) and on a POST to
+	// /admin/retention. Besides directories, the classes are "sessions",
+	// the replay buffers, and "usage", the usage of idle tenants.
+	Retention         []retention.Rule
+	RetentionInterval time.Duration
+	// BatchRateLimit, if set, is how many batch API calls, to /v1/files
+	// and /v1/batches, each tenant may make a second, in bursts of up to
+	// BatchBurst (a second's worth if zero); calls beyond are answered 429.
+	// BatchMaxUploadBytes bounds the files uploaded for batches, in place
+	// of MaxRequestBytes; DefaultBatchMaxUploadBytes if zero.
+	BatchRateLimit      float64
+	BatchBurst          int
+	BatchMaxUploadBytes int64
+	// APIKeys, if set, must let through every stream and API call: /sse,
+	// /ws, gRPC streams, unary calls and the batch API. Requests without
+	// one of its keys are answered 401; /metrics counts each key's.
+	APIKeys *APIKeys
+	// JWT, if set, must let through the same routes by the bearer token,
+	// in place of APIKeys, and limits the tenant each token names.
+	JWT *JWTAuth
+	// LogPayloads logs the JSON body of each stream request and API call,
+	// for audits. A hook added to Logger redacts its prompts, and those of
+	// any payload or prompt field logged, with PayloadRedaction; the zero
+	// policy hashes them.
+	LogPayloads      bool
+	PayloadRedaction audit.Policy
+	// AccessLog, if set, gets a line for every request once it is over,
+	// with its status, bytes and duration, and for streams the reason they
+	// ended, in AccessLogFormat (AccessLogCombined if empty). It is kept
+	// apart from Logger for log pipelines to ingest as they do web server
+	// logs; server.RotatingFile rotates it.
+	AccessLog       io.Writer
+	AccessLogFormat string
+	// Latency, if its Dist is set, holds each event of a /sse stream for
+	// an artificial delay drawn from it before it is written to the
+	// client, to test clients against WAN conditions.
+	Latency Latency
+	// RecordDir, if set, records the upstream stream of /sse requests to a
+	// file in it, with when each event arrived, for a deep server's
+	// -recordings to replay: a RecordRate fraction of them, or all if
+	// zero. RecordCompress compresses them with zstd, and RecordBucket, if
+	// set, has each uploaded once its stream ends.
+	RecordDir      string
+	RecordRate     float64
+	RecordCompress bool
+	RecordBucket   *objstore.Bucket
+	// Config, if set, reloads the settings the proxy was started with, and
+	// /metrics reports the version of them it runs with.
+	Config *config.Reloader
+}
+
+// The notices a stream opened early starts with.
+const (
+	EarlyFlushOff     = "off"
+	EarlyFlushComment = "comment"
+	EarlyFlushEvent   = "event"
+)
+
+// HeaderPolicy selects upstream headers by name. Patterns are matched
+// case-insensitively and may end in "*" to match a prefix.
+type HeaderPolicy struct {
+	All      bool
+	Patterns []string
+}
+
+// ParseHeaderPolicy accepts "strip" (forward nothing), "forward" (forward
+// everything) or a comma-separated list of header names and prefixes.
+func ParseHeaderPolicy(spec string) HeaderPolicy {
+	switch strings.ToLower(strings.TrimSpace(spec)) {
+	case "", "strip":
+		return HeaderPolicy{}
+	case "forward":
+		return HeaderPolicy{All: true}
+	}
+	var p HeaderPolicy
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			p.Patterns = append(p.Patterns, strings.ToLower(name))
+		}
+	}
+	return p
+}
+
+// proxyOwnedHeaders are set by the proxy itself or are hop-by-hop, so they
+// are never copied from the upstream response.
+var proxyOwnedHeaders = map[string]bool{
+	"Access-Control-Allow-Origin": true,
+	"Cache-Control":               true,
+	"Connection":                  true,
+	"Content-Length":              true,
+	"Content-Type":                true,
+	"Date":                        true,
+	"Keep-Alive":                  true,
+	"Trailer":                     true,
+	"Transfer-Encoding":           true,
+	"X-Accel-Buffering":           true,
+}
+
+func (p HeaderPolicy) allows(name string) bool {
+	if proxyOwnedHeaders[http.CanonicalHeaderKey(name)] {
+		return false
+	}
+	if p.All {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, pattern := range p.Patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsTopic is the hub topic /metrics/stream subscribers listen on.
+const metricsTopic = "metrics"
+
+const (
+	// streamTopicPrefix prefixes the hub topic each proxied stream is
+	// mirrored on while clients have joined it.
+	streamTopicPrefix = "stream."
+	// streamEndEvent tells joined clients that a stream has finished.
+	streamEndEvent = "stream-end"
+	// maxJoinedStreams bounds the streams one client can join at once.
+	maxJoinedStreams = 64
+	// finishedStreamsKept bounds the finished streams /debug/streams
+	// remembers.
+	finishedStreamsKept = 4096
+	// shedRateWindow is the window /autoscale averages the shed rate over.
+	shedRateWindow = time.Minute
+	// DefaultMaxLineBytes leaves room for multi-megabyte events.
+	DefaultMaxLineBytes = 8 << 20
+	// DefaultMaxRequestBytes leaves room for long conversations.
+	DefaultMaxRequestBytes = 1 << 20
+	// DefaultBodyMemory keeps typical requests out of the temp directory.
+	DefaultBodyMemory = 64 << 10
+)
+
+// abortPropagationBuckets bound the abort_propagation histogram: the time
+// from a client going away to the upstream request being torn down.
+var abortPropagationBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Proxy relays SSE streams from the deep server to clients.
+type Proxy struct {
+	router              *mux.Router
+	logger              *logrus.Logger
+	pumpBufferSize      int
+	maxLineBytes        int
+	maxRequestBytes     int64
+	eventIDs            server.EventIDRoutes
+	activeConnections   int64
+	totalConnections    int64
+	proxiedMessages     int64
+	failedConnections   int64
+	streamBuffers       *streamio.Metrics
+	slowClientPolicy    streamio.Overflow
+	writeDeadline       time.Duration
+	slowClientTimeouts  int64
+	slowClientOverruns  int64
+	writeErrors         server.WriteErrorCounters
+	hub                 *server.Hub
+	metricsInterval     time.Duration
+	forwardHeaders      HeaderPolicy
+	forwardTrailers     HeaderPolicy
+	patchSnapshotEvery  int
+	upstreamTypes       []string
+	contentTypeErrors   int64
+	upstreamErrors      server.UpstreamErrorRoutes
+	redactor            *server.Redactor
+	statusMu            sync.Mutex
+	upstreamStatuses    map[string]int64 // error responses per upstream status
+	streamErrorEvents   int64
+	maxConnections      int
+	maxUpstreamInFlight int
+	memoryBudget        int64
+	baseMemory          int64 // process memory before any stream
+	upstreamInFlight    int64
+	shedConnections     int64
+	shedRate            *server.RateWindow
+	autoscale           server.AutoscaleTargets
+	usage               *server.UsageMeter
+	usageSample         time.Duration
+	transcodedMu        sync.Mutex
+	transcoded          map[string]int64 // streams per source charset
+	rechunk             server.RechunkRoutes
+	rechunkMaxHold      int
+	sequencing          string
+	sequencingWindow    int
+	seqDuplicates       int64
+	seqOutOfOrder       int64
+	seqGaps             int64
+	seqRepaired         int64
+	migrateTo           []string
+	migrateDiscoveryURL string
+	migrateJitter       time.Duration
+	migrationHints      int64
+	joinedClients       int64
+	clientAborts        int64
+	abortPropagation    *server.LatencyRecorder
+	streamsMu           sync.Mutex
+	streams             map[*activeStream]struct{}
+	streamsByID         map[string]*activeStream
+	finishedStreams     []*activeStream // oldest first
+	finishedByID        map[string]*activeStream
+	bufferPool          sync.Pool
+	traceEvents         bool
+	flushes             *server.FlushMonitor
+	heartbeats          *server.Heartbeats
+	conns               *server.ConnStates
+	replay              *server.ReplayStore
+	coalescer           *coalescer
+	upstreams           *upstreamSet
+	affinity            *affinity
+	earlyFlush          string
+	earlyFlushes        int64
+	oversizedBodies     int64
+	continueRefused     int64
+	websocketStreams    int64
+	streamCommands      commandCounts
+	bodies              *bodySpool
+	upstreamRetries     int
+	retryBackoff        time.Duration
+	retries             int64
+	retriesRecovered    int64
+	retriesExhausted    int64
+	upstreamProtocol    string
+	upstreamTransport   http.RoundTripper
+	unaryTransport      http.RoundTripper // the upstream's own API, whatever streams use
+	grpcStreams         int64
+	unary               map[string]*unaryCounters // by path, fixed at New
+	batchCalls          map[string]*unaryCounters // by method and route, fixed at New
+	limitsMu            sync.Mutex                // guards batchLimits, which a reload replaces
+	batchLimits         *tenantBuckets            // nil without a rate limit
+	connLimits          connLimiter
+	connQueue           *connQueue
+	cancelReports       *cancelReports // nil if cancellations are not reported
+	closing             int32          // set once Drain gives up waiting
+	batchOwners         *batchOwners
+	batchMaxUploadBytes int64
+	batchRateLimited    int64
+	batchPinned         int64
+	apiKeys             *APIKeys // nil if unauthenticated
+	jwt                 *JWTAuth // nil without JWT authentication
+	logPayloads         bool
+	janitor             *retention.Janitor
+	retentionInterval   time.Duration
+	config              *config.Reloader // nil if settings are not reloaded
+	testPage            testPageReports
+	accessLog           *accessLog // nil without an access log
+	latency             Latency
+	recorder            *recorder // nil if streams are not recorded
+}
+
+// New returns a proxy for cfg, or an error if cfg is inconsistent.
+func New(cfg Options) (*Proxy, error) {
+	switch cfg.Sequencing {
+	case "", "off", "flag", "repair":
+	default:
+		return nil, fmt.Errorf("unknown sequencing mode %q", cfg.Sequencing)
+	}
+	if cfg.Sequencing == "repair" && (cfg.SequencingWindow < 1 || cfg.SequencingWindow >= maxTrackedIDs) {
+		return nil, fmt.Errorf("sequencing window must be between 1 and %d", maxTrackedIDs-1)
+	}
+	switch cfg.AccessLogFormat {
+	case "":
+		cfg.AccessLogFormat = AccessLogCombined
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.AccessLogFormat)
+	}
+	if err := cfg.Latency.validate(); err != nil {
+		return nil, fmt.Errorf("latency: %w", err)
+	}
+	if cfg.RecordRate < 0 || cfg.RecordRate > 1 {
+		return nil, fmt.Errorf("record rate %v must be between 0 and 1", cfg.RecordRate)
+	}
+	if cfg.RecordDir != "" && cfg.RecordRate == 0 {
+		cfg.RecordRate = 1
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = logrus.New()
+		logger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+	}
+
+	if cfg.PumpBufferSize < 1 {
+		cfg.PumpBufferSize = 1
+	}
+	if cfg.MaxLineBytes <= 0 {
+		cfg.MaxLineBytes = DefaultMaxLineBytes
+	}
+	if cfg.MetricsInterval <= 0 {
+		cfg.MetricsInterval = 2 * time.Second
+	}
+	if len(cfg.UpstreamTypes) == 0 {
+		cfg.UpstreamTypes = []string{"text/event-stream"}
+	}
+	if cfg.UsageSample <= 0 {
+		cfg.UsageSample = time.Second
+	}
+	if cfg.MaxRequestBytes <= 0 {
+		cfg.MaxRequestBytes = DefaultMaxRequestBytes
+	}
+	if cfg.BodyMemory <= 0 {
+		cfg.BodyMemory = DefaultBodyMemory
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	if cfg.RetentionInterval <= 0 {
+		cfg.RetentionInterval = time.Minute
+	}
+	if cfg.BatchMaxUploadBytes <= 0 {
+		cfg.BatchMaxUploadBytes = DefaultBatchMaxUploadBytes
+	}
+	if cfg.BatchRateLimit < 0 || cfg.BatchBurst < 0 {
+		return nil, fmt.Errorf("negative batch rate limit %v or burst %d", cfg.BatchRateLimit, cfg.BatchBurst)
+	}
+	if cfg.ConnectionRate < 0 || cfg.ConnectionBurst < 0 || cfg.ConnectionRatePerIP < 0 || cfg.ConnectionBurstPerIP < 0 {
+		return nil, fmt.Errorf("negative connection rate limit or burst")
+	}
+	if cfg.ConnectionQueue < 0 || cfg.ConnectionQueueTimeout < 0 {
+		return nil, fmt.Errorf("negative connection queue %d or timeout %v", cfg.ConnectionQueue, cfg.ConnectionQueueTimeout)
+	}
+	if cfg.APIKeys != nil && cfg.JWT != nil {
+		return nil, fmt.Errorf("API keys and JWT authentication are exclusive")
+	}
+	if cfg.UpstreamRetries < 0 {
+		return nil, fmt.Errorf("negative upstream retries %d", cfg.UpstreamRetries)
+	}
+	if cfg.Redactor == nil {
+		cfg.Redactor, _ = server.NewRedactor()
+	}
+	if len(cfg.Upstreams) == 0 {
+		cfg.Upstreams = []Upstream{{Name: "default", URL: cfg.DeepServerURL, Weight: 1}}
+	}
+	if cfg.SlowClientPolicy == "" {
+		cfg.SlowClientPolicy = streamio.OverflowBlock
+	}
+	if _, err := streamio.ParseOverflow(string(cfg.SlowClientPolicy)); err != nil {
+		return nil, fmt.Errorf("unknown slow-client policy %q", cfg.SlowClientPolicy)
+	}
+	if cfg.WriteDeadline < 0 {
+		return nil, fmt.Errorf("negative write deadline %v", cfg.WriteDeadline)
+	}
+	switch cfg.EarlyFlush {
+	case "":
+		cfg.EarlyFlush = EarlyFlushOff
+	case EarlyFlushOff, EarlyFlushComment, EarlyFlushEvent:
+	default:
+		return nil, fmt.Errorf("unknown early flush mode %q", cfg.EarlyFlush)
+	}
+	if cfg.Balancer == nil {
+		cfg.Balancer, _ = NewBalancer(BalanceRoundRobin)
+	}
+	if cfg.LogPayloads {
+		logger.AddHook(audit.NewHook(cfg.PayloadRedaction))
+	}
+	upstreams, err := newUpstreamSet(cfg.Upstreams, cfg.Routes, cfg.Balancer, cfg.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamProtocol == "" {
+		cfg.UpstreamProtocol = UpstreamSSE
+	}
+	upstreamTransport, probeTransport, err := upstreamTransports(cfg.UpstreamProtocol, cfg.UpstreamInsecureTLS)
+	if err != nil {
+		return nil, err
+	}
+	upstreams.transport = probeTransport
+	affinity, err := newAffinity(cfg.Node, cfg.Affinity, cfg.Peers, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := server.NewUsageMeter()
+	usage.WattsPerCore = cfg.WattsPerCore
+	replay := server.NewReplayStore(cfg.ReplaySize, cfg.ReplayTTL)
+	replay.SpillMemory = cfg.ReplayMemory
+	replay.SpillDir = cfg.ReplaySpillDir
+	janitor := retention.NewJanitor()
+	if err := janitor.AddRules(cfg.Retention, map[string]retention.Store{"sessions": replay, "usage": usage}); err != nil {
+		return nil, err
+	}
+
+	s := &Proxy{
+		router:              mux.NewRouter(),
+		logger:              logger,
+		pumpBufferSize:      cfg.PumpBufferSize,
+		streamBuffers:       streamio.NewMetrics(),
+		slowClientPolicy:    cfg.SlowClientPolicy,
+		writeDeadline:       cfg.WriteDeadline,
+		maxLineBytes:        cfg.MaxLineBytes,
+		maxRequestBytes:     cfg.MaxRequestBytes,
+		eventIDs:            cfg.EventIDs,
+		hub:                 server.NewHub(),
+		metricsInterval:     cfg.MetricsInterval,
+		forwardHeaders:      cfg.ForwardHeaders,
+		forwardTrailers:     cfg.ForwardTrailers,
+		patchSnapshotEvery:  cfg.PatchSnapshotEvery,
+		upstreamTypes:       cfg.UpstreamTypes,
+		upstreamErrors:      cfg.UpstreamErrors,
+		redactor:            cfg.Redactor,
+		upstreamStatuses:    make(map[string]int64),
+		maxConnections:      cfg.MaxConnections,
+		maxUpstreamInFlight: cfg.MaxUpstreamInFlight,
+		memoryBudget:        cfg.MemoryBudget,
+		baseMemory:          server.ProcessMemory(),
+		shedRate:            server.NewRateWindow(shedRateWindow),
+		autoscale:           cfg.Autoscale,
+		usage:               usage,
+		transcoded:          make(map[string]int64),
+		rechunk:             cfg.Rechunk,
+		rechunkMaxHold:      cfg.RechunkMaxHold,
+		sequencing:          cfg.Sequencing,
+		sequencingWindow:    cfg.SequencingWindow,
+		migrateTo:           cfg.MigrateTo,
+		migrateJitter:       cfg.MigrateJitter,
+		migrateDiscoveryURL: cfg.MigrateDiscoveryURL,
+		streams:             make(map[*activeStream]struct{}),
+		streamsByID:         make(map[string]*activeStream),
+		finishedByID:        make(map[string]*activeStream),
+		abortPropagation:    server.NewLatencyRecorder(abortPropagationBuckets...),
+		usageSample:         cfg.UsageSample,
+		traceEvents:         cfg.TraceEvents,
+		latency:             cfg.Latency,
+		flushes:             server.NewFlushMonitor(cfg.SlowFlush),
+		heartbeats:          server.NewHeartbeats(cfg.Heartbeat),
+		conns:               server.NewConnStates(cfg.IdleLeakAfter),
+		replay:              replay,
+		coalescer:           newCoalescer(cfg.CoalesceWindow),
+		upstreams:           upstreams,
+		affinity:            affinity,
+		earlyFlush:          cfg.EarlyFlush,
+		bodies:              newBodySpool(cfg.BodyMemory, cfg.BodySpoolDir),
+		upstreamRetries:     cfg.UpstreamRetries,
+		retryBackoff:        cfg.RetryBackoff,
+		upstreamProtocol:    cfg.UpstreamProtocol,
+		upstreamTransport:   upstreamTransport,
+		unaryTransport:      probeTransport,
+		janitor:             janitor,
+		retentionInterval:   cfg.RetentionInterval,
+		unary:               make(map[string]*unaryCounters, len(unaryPaths)),
+		batchCalls:          make(map[string]*unaryCounters, len(batchRoutes)),
+		batchOwners:         newBatchOwners(),
+		batchMaxUploadBytes: cfg.BatchMaxUploadBytes,
+		apiKeys:             cfg.APIKeys,
+		jwt:                 cfg.JWT,
+		logPayloads:         cfg.LogPayloads,
+		config:              cfg.Config,
+		bufferPool: sync.Pool{
+			New: func() interface{} {
+				return new(bytes.Buffer)
+			},
+		},
+	}
+
+	if cfg.RecordDir != "" {
+		s.recorder = &recorder{dir: cfg.RecordDir, rate: cfg.RecordRate, compress: cfg.RecordCompress, bucket: cfg.RecordBucket, logger: logger}
+	}
+	if cfg.AccessLog != nil {
+		s.accessLog = &accessLog{w: cfg.AccessLog, format: cfg.AccessLogFormat}
+	}
+	if cfg.ReportCancellations {
+		s.cancelReports = &cancelReports{byReason: make(map[string]int64)}
+	}
+	s.connQueue = newConnQueue(&s.activeConnections, cfg.MaxConnections, cfg.ConnectionQueue, cfg.ConnectionQueueTimeout)
+	for _, path := range unaryPaths {
+		s.unary[path] = &unaryCounters{}
+	}
+	s.batchLimits = reuseBuckets(nil, cfg.BatchRateLimit, cfg.BatchBurst)
+	s.connLimits.set(cfg.ConnectionRate, cfg.ConnectionBurst, cfg.ConnectionRatePerIP, cfg.ConnectionBurstPerIP)
+	s.setupRoutes()
+	return s, nil
+}
+
+func (s *Proxy) setupRoutes() {
+	s.router.HandleFunc("/sse", s.logStreams("sse", s.limitConnections(s.clientRoute(s.handleSSEProxy)))).Methods("GET", "POST")
+	s.router.HandleFunc("/ws", s.logStreams("websocket", s.limitConnections(s.clientRoute(s.handleWebSocket)))).Methods("GET")
+	s.router.HandleFunc(grpcapi.StreamChatCompletionPath, s.logStreams("grpc", s.limitConnections(s.clientRoute(s.handleGRPC)))).Methods("POST")
+	for _, path := range unaryPaths {
+		s.router.HandleFunc(path, s.clientRoute(s.handleUnary)).Methods("POST")
+	}
+	for _, route := range batchRoutes {
+		s.router.HandleFunc(route.path, s.clientRoute(s.batchHandler(route.method, route.path))).Methods(route.method)
+	}
+	s.router.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+	s.router.HandleFunc("/metrics/stream", s.handleMetricsStream).Methods("GET")
+	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
+	s.router.HandleFunc("/capacity", s.handleCapacity).Methods("GET")
+	s.router.HandleFunc("/autoscale", s.handleAutoscale).Methods("GET")
+	s.router.HandleFunc("/usage", s.handleUsage).Methods("GET")
+	s.router.HandleFunc("/debug/streams/{id}", s.handleDebugStream).Methods("GET")
+	s.router.HandleFunc("/streams/{id}/control", s.clientRoute(s.handleStreamControl)).Methods("POST")
+	s.router.HandleFunc("/admin/retention", s.handleRetention).Methods("GET", "POST")
+	s.router.HandleFunc("/testpage", s.handleTestPage).Methods("GET")
+	s.router.HandleFunc("/testpage/results", s.handleTestPageResults).Methods("GET", "POST")
+}
+
+// clientRoute wraps the handler of a route clients stream or call the
+// upstream through: the API key or token is checked first, then session
+// affinity may send the request to a peer.
+func (s *Proxy) clientRoute(next http.HandlerFunc) http.HandlerFunc {
+	next = s.affinity.wrap(next)
+	if s.apiKeys != nil {
+		next = s.apiKeys.Wrap(next)
+	}
+	if s.jwt != nil {
+		next = s.jwt.Wrap(next)
+	}
+	return next
+}
+
+// ServeHTTP serves the proxy's routes: /sse, /ws, /metrics, /metrics/stream,
+// /health, /capacity, /autoscale, /usage, /debug/streams/{id},
+// /streams/{id}/control, /admin/retention and /testpage.
+func (s *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.accessLog != nil {
+		s.accessLog.serve(s.router, w, r)
+		return
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+// ConnState tracks the state of the connections of the server the proxy
+// is served by, for /metrics. Set it as the server's ConnState hook.
+func (s *Proxy) ConnState(c net.Conn, state http.ConnState) {
+	s.conns.Track(c, state)
+}
+
+// Logger is the logger the proxy writes to.
+func (s *Proxy) Logger() *logrus.Logger {
+	return s.logger
+}
+
+// Run does the proxy's background work, feeding /metrics/stream, sampling
+// CPU usage for /usage and checking upstream health, until ctx is done.
+func (s *Proxy) Run(ctx context.Context) {
+	go s.usage.Run(ctx, s.usageSample)
+	if len(s.janitor.Stats().Classes) > 0 {
+		go s.janitor.Run(ctx, s.retentionInterval)
+	}
+	go s.upstreams.runHealthChecks(ctx, s.logger)
+	s.publishMetrics(ctx)
+}
+
+// Drain stops httpServer accepting connections, advises the clients of
+// active streams where to reconnect and waits up to timeout for the
+// streams to finish before closing whatever is left. Replay buffers
+// spilled to disk are removed last.
+func (s *Proxy) Drain(httpServer *http.Server, timeout time.Duration) {
+	s.logger.WithFields(logrus.Fields{
+		"active_connections": atomic.LoadInt64(&s.activeConnections),
+		"drain_timeout":      timeout,
+	}).Info("Draining")
+
+	s.sendMigrationHints()
+
+	// Spilled replay buffers are gone with the process
+	defer s.replay.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"active_connections": atomic.LoadInt64(&s.activeConnections),
+			"error":              err,
+		}).Warn("Drain timed out, closing remaining connections")
+		atomic.StoreInt32(&s.closing, 1)
+		httpServer.Close()
+		return
+	}
+	s.logger.Info("Drained")
+}
+
+// clearWriteDeadline lifts the server's WriteTimeout for a streaming
+// response, which would otherwise cut it off however lively it is.
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
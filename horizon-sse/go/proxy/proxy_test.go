@@ -0,0 +1,2658 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"horizon-sse-go/audit"
+	"horizon-sse-go/grpcapi"
+	"horizon-sse-go/retention"
+	"horizon-sse-go/server"
+	"horizon-sse-go/streamio"
+	"horizon-sse-go/websocket"
+	"io"
+	"math"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// seqEvents builds upstream events from ids; "-" is an event without one.
+func seqEvents(ids ...string) []sseEvent {
+	events := make([]sseEvent, len(ids))
+	for i, id := range ids {
+		if id == "-" {
+			events[i] = sseEvent{lines: []string{"data: plain"}}
+		} else {
+			events[i] = sseEvent{lines: []string{"id: " + id, "data: " + id}}
+		}
+	}
+	return events
+}
+
+func TestSequenceStream(t *testing.T) {
+	type counts struct{ duplicates, outOfOrder, gaps, repaired int64 }
+	tests := []struct {
+		name   string
+		repair bool
+		in     string
+		out    string
+		counts counts
+	}{
+		{"in order", false, "1 2 3 4", "1 2 3 4", counts{}},
+		{"in order repaired", true, "1 2 3 4", "1 2 3 4", counts{}},
+		{"reorder flagged", false, "1 3 2 4", "1 3 2 4", counts{outOfOrder: 1}},
+		{"reorder repaired", true, "1 3 2 4", "1 2 3 4", counts{outOfOrder: 1, repaired: 1}},
+		{"duplicate flagged", false, "1 2 2 3", "1 2 2 3", counts{duplicates: 1}},
+		{"duplicate dropped", true, "1 2 2 3", "1 2 3", counts{duplicates: 1}},
+		{"held duplicate dropped", true, "1 3 3 2", "1 2 3", counts{duplicates: 1, outOfOrder: 1, repaired: 1}},
+		// The first event held back upstream must not be taken for a
+		// duplicate of the baseline
+		{"first late flagged", false, "2 1 3", "2 1 3", counts{outOfOrder: 1}},
+		{"first late repaired", true, "2 1 3", "2 1 3", counts{outOfOrder: 1}},
+		{"gap flagged", false, "1 2 4 5 6 7", "1 2 4 5 6 7", counts{gaps: 1}},
+		{"window overflow releases", true, "1 2 4 5 6 7", "1 2 4 5 6 7", counts{gaps: 1}},
+		{"late after gap", true, "1 3 4 5 6 2", "1 3 4 5 6 2", counts{gaps: 1, outOfOrder: 1}},
+		{"held until end of body", true, "1 3 4", "1 3 4", counts{}},
+		{"event without id releases", true, "1 3 - 2", "1 3 - 2", counts{outOfOrder: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Proxy{sequencingWindow: 3}
+			seq := s.newSequenceStream(tt.repair)
+			var got []sseEvent
+			for _, ev := range seqEvents(strings.Fields(tt.in)...) {
+				got = append(got, seq.transform(ev)...)
+			}
+			got = append(got, seq.flush()...)
+
+			var ids []string
+			for _, ev := range got {
+				id := ev.id()
+				if id == "" {
+					id = "-"
+				}
+				ids = append(ids, id)
+			}
+			if out := strings.Join(ids, " "); out != tt.out {
+				t.Errorf("out = %q, want %q", out, tt.out)
+			}
+			c := counts{s.seqDuplicates, s.seqOutOfOrder, s.seqGaps, s.seqRepaired}
+			if !reflect.DeepEqual(c, tt.counts) {
+				t.Errorf("counts = %+v, want %+v", c, tt.counts)
+			}
+		})
+	}
+}
+
+// Transforms later in the chain see what a flushed transform held.
+func TestFlushTransformsRunsLaterTransforms(t *testing.T) {
+	s := &Proxy{sequencingWindow: 3}
+	transforms := []eventTransform{s.newSequenceStream(true)}
+	for _, ev := range seqEvents("1", "3") {
+		runTransforms([]sseEvent{ev}, transforms, false)
+	}
+	out := runTransforms(nil, transforms, true)
+	if len(out) != 1 || out[0].id() != "3" {
+		t.Fatalf("flush returned %v, want the held event 3", out)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		params upstreamParams
+		want   time.Duration
+	}{
+		{"unpaced", upstreamParams{}, 20 * time.Second},
+		// The length of the stream does not matter, only its pace
+		{"short paced", upstreamParams{hasDelay: true, tokenDelay: time.Millisecond, maxTokens: 100000}, 20 * time.Second},
+		{"slow paced", upstreamParams{hasDelay: true, tokenDelay: 30 * time.Second}, 40 * time.Second},
+		{"overflowing", upstreamParams{hasDelay: true, tokenDelay: math.MaxInt64}, maxUpstreamTimeout},
+	}
+	for _, tt := range tests {
+		if got := tt.params.timeout(); got != tt.want {
+			t.Errorf("%s: timeout = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A stream that keeps sending outlives the idle timeout; one that stalls
+// is cut off.
+func TestIdleTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pause, _ := time.ParseDuration(r.URL.Query().Get("pause"))
+		for i := 0; i < 6; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(pause):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	get := func(pause string) (context.Context, error) {
+		ctx, wrap, cancel := withIdleTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", upstream.URL+"?pause="+pause, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return ctx, err
+		}
+		body := wrap(resp.Body)
+		defer body.Close()
+		_, err = io.Copy(io.Discard, body)
+		return ctx, err
+	}
+
+	if _, err := get("40ms"); err != nil {
+		t.Errorf("steady stream failed after the idle timeout: %v", err)
+	}
+	ctx, err := get("300ms")
+	if err == nil {
+		t.Fatal("stalled stream was not cut off")
+	}
+	if cause := context.Cause(ctx); cause == nil || !strings.Contains(cause.Error(), "idle") {
+		t.Errorf("cause = %v, want the idle timeout", cause)
+	}
+}
+
+// noisyStream writes a stream of tokens with the noise the deep server's
+// -noise flag adds before events: keep-alive blank lines, comments and
+// unknown fields, alone and together.
+func noisyStream(w io.Writer, tokens int) {
+	noise := []string{"", "\n", ": noise 17\n", "meta: 7\n", "\n: noise 3\nx-trace: 9\nData: 1\n"}
+	for i := 0; i < tokens; i++ {
+		fmt.Fprintf(w, "%sdata: {\"token\":%d}\n\n", noise[i%len(noise)], i)
+	}
+	fmt.Fprintf(w, "%sdata: {\"finish_reason\":\"stop\"}\n\n", noise[4])
+	fmt.Fprintf(w, "%sdata: [DONE]\n\n", noise[2])
+}
+
+// Noise lines ride along with the event they precede and never count as
+// messages of their own.
+func TestPumpNoisyStream(t *testing.T) {
+	const tokens = 40
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		noisyStream(w, tokens)
+	}))
+	defer upstream.Close()
+
+	idRoutes, err := server.ParseEventIDRoutes("passthrough", server.EventIDPassthrough)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{DeepServerURL: upstream.URL, EventIDs: idRoutes, PumpBufferSize: 4, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	pump := s.startPump(context.Background(), resp.Body, nil)
+	var buf bytes.Buffer
+	ids := s.eventIDs.For("/sse").NewGenerator()
+	messages := 0
+	for {
+		ev, err := pump.events.Get(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages += s.forwardEvent(&buf, ev, ids, nil, nil)
+	}
+	// The tokens and the finish chunk; [DONE] is not a message
+	if messages != tokens+1 {
+		t.Errorf("counted %d messages, want %d", messages, tokens+1)
+	}
+	if n := strings.Count(buf.String(), "data: "); n != tokens+2 {
+		t.Errorf("forwarded %d data lines, want %d", n, tokens+2)
+	}
+}
+
+// Past a full buffer, drop-oldest keeps the newest events and disconnect
+// gives up on the client.
+func TestSlowClientPolicies(t *testing.T) {
+	var upstream strings.Builder
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&upstream, "data: %d\n\n", i)
+	}
+	// The pump reads the whole upstream before the client takes anything
+	pumpAll := func(policy streamio.Overflow) (*Proxy, *upstreamPump) {
+		s, err := New(Options{PumpBufferSize: 2, SlowClientPolicy: policy, Logger: quietLogger()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pump := s.startPump(context.Background(), strings.NewReader(upstream.String()), nil)
+		<-pump.done
+		return s, pump
+	}
+
+	s, pump := pumpAll(streamio.OverflowDropOldest)
+	var kept []string
+	for {
+		ev, err := pump.events.Get(context.Background())
+		if err != nil {
+			break
+		}
+		kept = append(kept, ev.lines[0])
+	}
+	if !reflect.DeepEqual(kept, []string{"data: 3", "data: 4"}) || pump.events.Dropped() != 3 || s.slowClientStats().DroppedEvents != 3 {
+		t.Errorf("kept %q, dropped %d", kept, pump.events.Dropped())
+	}
+
+	_, pump = pumpAll(streamio.OverflowDisconnect)
+	if _, err := pump.events.Get(context.Background()); err != streamio.ErrOverflow {
+		t.Errorf("overrun client not given up on: %v", err)
+	}
+
+	if _, err := New(Options{SlowClientPolicy: "wait"}); err == nil {
+		t.Error("unknown slow-client policy accepted")
+	}
+}
+
+// A client that stops reading is cut off at the write deadline, and the
+// upstream request with it.
+func TestWriteDeadline(t *testing.T) {
+	upstreamDone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+		w.Header().Set("Content-Type", "text/event-stream")
+		event := "data: " + strings.Repeat("x", 16<<10) + "\n\n"
+		for start := time.Now(); time.Since(start) < 10*time.Second; {
+			if _, err := io.WriteString(w, event); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+	p, err := New(Options{DeepServerURL: upstream.URL, WriteDeadline: 100 * time.Millisecond, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /sse HTTP/1.1\r\nHost: test\r\n\r\n")
+	select {
+	case <-upstreamDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream still streaming to a stuck client")
+	}
+	if st := p.slowClientStats(); st.TimedOut != 1 || st.Terminated != 1 || st.WriteDeadlineMs != 100 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	return logger
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{Sequencing: "fix"},
+		{Sequencing: "repair", SequencingWindow: 0},
+		{Sequencing: "repair", SequencingWindow: maxTrackedIDs},
+	} {
+		if _, err := New(opts); err == nil {
+			t.Errorf("New(%+v) succeeded", opts)
+		}
+	}
+}
+
+// TestServeHTTP mounts the proxy under a prefix of another mux, as an
+// embedding application would, and streams through it.
+func TestServeHTTP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/proxy/", http.StripPrefix("/proxy", p))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/proxy/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), `"content":"hi"`) || !strings.Contains(string(body), "[DONE]") {
+		t.Errorf("stream not relayed:\n%s", body)
+	}
+}
+
+func TestForwardsClientRequest(t *testing.T) {
+	type upstreamReq struct {
+		body map[string]interface{}
+		auth string
+	}
+	received := make(chan upstreamReq, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- upstreamReq{body, r.Header.Get("Authorization")}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, MaxRequestBytes: 256, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	post := func(body string) (int, string) {
+		req, _ := http.NewRequest("POST", srv.URL+"/sse", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-test")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+
+	status, out := post(`{"model":"gpt-4o-mini","temperature":0.2,"messages":[{"role":"user","content":"hello"}]}`)
+	if status != http.StatusOK || !strings.Contains(out, "[DONE]") {
+		t.Fatalf("status %d:\n%s", status, out)
+	}
+	got := <-received
+	if got.body["model"] != "gpt-4o-mini" || got.body["temperature"] != 0.2 || got.body["stream"] != true {
+		t.Errorf("upstream got %v", got.body)
+	}
+	if msgs, _ := got.body["messages"].([]interface{}); len(msgs) != 1 {
+		t.Errorf("upstream got messages %v", got.body["messages"])
+	}
+	if got.auth != "Bearer sk-test" {
+		t.Errorf("upstream got Authorization %q", got.auth)
+	}
+
+	for body, want := range map[string]int{
+		`{"model":"gpt-4o-mini"}`: http.StatusBadRequest,
+		`[1,2]`:                   http.StatusBadRequest,
+		`{"messages":[{"role":"user","content":"` + strings.Repeat("x", 300) + `"}]}`: http.StatusRequestEntityTooLarge,
+	} {
+		if status, out := post(body); status != want {
+			t.Errorf("%.40s: status %d, want %d: %s", body, status, want, out)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 5; i++ {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"t%d\"}}]}\n\n", i)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	// All but the last event spill to disk, so resumes read them back
+	spillDir := t.TempDir()
+	p, err := New(Options{
+		DeepServerURL:  upstream.URL,
+		EventIDs:       server.EventIDRoutes{Default: server.EventIDMonotonic},
+		ReplaySize:     16,
+		ReplayMemory:   1,
+		ReplaySpillDir: spillDir,
+		Logger:         quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	get := func(lastID string) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+"/sse?client_id=c1", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if _, body := get(""); strings.Count(body, "id: ") != 6 {
+		t.Fatalf("first stream:\n%s", body)
+	}
+	status, body := get("3")
+	if status != http.StatusOK || !strings.HasPrefix(body, "id: 4\n") || strings.Count(body, "id: ") != 3 || !strings.Contains(body, "[DONE]") {
+		t.Errorf("resume from 3: %d\n%s", status, body)
+	}
+	if strings.Contains(body, "event: error") {
+		t.Errorf("finished stream resumed with an error:\n%s", body)
+	}
+	if status, body := get("6"); status != http.StatusNoContent {
+		t.Errorf("resume from the last event: %d\n%s", status, body)
+	}
+	// An unknown ID starts a new stream
+	if _, body := get("99"); !strings.HasPrefix(body, "id: 1\n") {
+		t.Errorf("resume from an unknown ID:\n%s", body)
+	}
+
+	p.replay.Close()
+	if files, _ := os.ReadDir(spillDir); len(files) != 0 {
+		t.Errorf("%d replay files left after Close", len(files))
+	}
+}
+
+func TestResumeScopedToKey(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"secret\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	keys, _ := ParseAPIKeys("alice=sk-alice,bob=sk-bob")
+	p, err := New(Options{
+		DeepServerURL: upstream.URL,
+		EventIDs:      server.EventIDRoutes{Default: server.EventIDMonotonic},
+		ReplaySize:    16,
+		APIKeys:       keys,
+		Logger:        quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	get := func(key, lastID string) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+"/sse?client_id=c1", nil)
+		req.Header.Set("X-API-Key", key)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	get("sk-alice", "")
+	// Another key naming the same client starts a stream of its own
+	if status, body := get("sk-bob", "1"); status != http.StatusOK || !strings.HasPrefix(body, "id: 1\n") {
+		t.Errorf("resume with another key: %d\n%s", status, body)
+	}
+	if status, body := get("sk-alice", "1"); status != http.StatusOK || !strings.HasPrefix(body, "id: 2\n") {
+		t.Errorf("resume with the same key: %d\n%s", status, body)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"t\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	runs := t.TempDir()
+	os.WriteFile(filepath.Join(runs, "run-1.log"), make([]byte, 300), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(runs, "run-1.log"), old, old)
+	rules, err := retention.ParseRules("sessions=0:1B,usage=1ns,recordings@" + runs + "=30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(Options{
+		DeepServerURL: upstream.URL,
+		ReplaySize:    16,
+		Retention:     rules,
+		Logger:        quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sse?client_id=c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if p.replay.Stats().Clients != 1 || len(p.usage.Snapshot().Tenants) != 1 {
+		t.Fatal("stream left no session or usage")
+	}
+
+	resp, err = http.Post(srv.URL+"/admin/retention", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats retention.Stats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	for class, removed := range map[string]int64{"sessions": 1, "usage": 1, "recordings": 1} {
+		if got := stats.Classes[class]; got.RemovedItems != removed || got.Items != 0 {
+			t.Errorf("%s: %+v", class, got)
+		}
+	}
+	if stats.Classes["recordings"].ReclaimedBytes != 300 {
+		t.Errorf("recordings: %+v", stats.Classes["recordings"])
+	}
+	if p.replay.Stats().Clients != 0 || len(p.usage.Snapshot().Tenants) != 0 {
+		t.Error("session or usage kept")
+	}
+	if _, err := os.Stat(filepath.Join(runs, "run-1.log")); !os.IsNotExist(err) {
+		t.Errorf("recording kept: %v", err)
+	}
+
+	if _, err := New(Options{Retention: []retention.Rule{{Class: "audit"}}}); err == nil {
+		t.Error("audit without a directory accepted")
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var requests int64
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"t%d\"}}]}\n\n", i)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, CoalesceWindow: time.Minute, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	queries := []string{"max_tokens=3", "max_tokens=3", "max_tokens=3", "max_tokens=4"}
+	bodies := make(chan string, len(queries))
+	for _, q := range queries {
+		go func(q string) {
+			resp, err := http.Get(srv.URL + "/sse?" + q)
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			bodies <- string(body)
+		}(q)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.coalescer.Stats().Coalesced < 2 || atomic.LoadInt64(&requests) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests not coalesced: %+v", p.coalescer.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+
+	for range queries {
+		if body := <-bodies; strings.Count(body, "data: ") != 4 || !strings.Contains(body, "t3") {
+			t.Errorf("client got:\n%s", body)
+		}
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+	stats := p.coalescer.Stats()
+	if stats.Groups != 2 || stats.Coalesced != 2 || stats.LargestGroup != 3 || len(stats.Active) != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestCoalescedUpstreamCancelledWithLastMember(t *testing.T) {
+	c := newCoalescer(time.Minute)
+	g, joined := c.join("k")
+	if joined {
+		t.Fatal("first request joined a group")
+	}
+	if _, joined := c.join("k"); !joined {
+		t.Fatal("identical request did not join")
+	}
+	g.leave()
+	if g.ctx.Err() != nil {
+		t.Fatal("upstream cancelled with a member left")
+	}
+	g.leave()
+	if g.ctx.Err() == nil {
+		t.Fatal("upstream not cancelled after the last member left")
+	}
+	if g2, joined := c.join("k"); joined || g2 == g {
+		t.Error("joined a closed group")
+	}
+}
+
+func TestBalancers(t *testing.T) {
+	a := &Backend{Upstream: Upstream{Name: "a", Weight: 3}}
+	b := &Backend{Upstream: Upstream{Name: "b", Weight: 1}}
+	pick := func(name string, n int) string {
+		balancer, err := NewBalancer(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got strings.Builder
+		for i := 0; i < n; i++ {
+			got.WriteString(balancer.Pick([]*Backend{a, b}).Name)
+		}
+		return got.String()
+	}
+	if got := pick(BalanceRoundRobin, 4); got != "abab" {
+		t.Errorf("round-robin picked %s", got)
+	}
+	if got := pick(BalanceWeighted, 8); got != "aabaaaba" {
+		t.Errorf("weighted picked %s", got)
+	}
+	a.active = 2
+	if got := pick(BalanceLeastActive, 3); got != "bbb" {
+		t.Errorf("least-active picked %s", got)
+	}
+	if _, err := NewBalancer("random"); err == nil {
+		t.Error("unknown balancer accepted")
+	}
+}
+
+func TestRouting(t *testing.T) {
+	backend := func(name string, hits *int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(hits, 1)
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\ndata: [DONE]\n\n", name)
+		}))
+	}
+	var hitsA, hitsB, hitsC int64
+	a, b, c := backend("a", &hitsA), backend("b", &hitsB), backend("c", &hitsC)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	var upstreams []Upstream
+	for _, spec := range []string{"a=" + a.URL, "b=" + b.URL + ",weight=2", "c=" + c.URL} {
+		u, err := ParseUpstream(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	var routes []Route
+	for _, spec := range []string{"path:/v1/messages=c", "model:claude-*=c", "model:gpt-*=a,b"} {
+		r, err := ParseRoute(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, r)
+	}
+	if _, err := New(Options{Upstreams: upstreams, Routes: []Route{{Model: "x", Upstreams: []string{"d"}}}}); err == nil {
+		t.Error("route to an unknown upstream accepted")
+	}
+	p, err := New(Options{Upstreams: upstreams, Routes: routes, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	post := func(query, model string) string {
+		body := `{"model":"` + model + `","messages":[{"role":"user","content":"hi"}]}`
+		resp, err := http.Post(srv.URL+"/sse"+query, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return string(out)
+	}
+	for i := 0; i < 4; i++ {
+		post("", "gpt-4o-mini")
+	}
+	post("", "claude-3-haiku")
+	post("?dialect=anthropic", "other")
+	if hitsA != 2 || hitsB != 2 || hitsC != 2 {
+		t.Errorf("hits a=%d b=%d c=%d, want 2 each", hitsA, hitsB, hitsC)
+	}
+	stats := p.upstreams.Stats().Backends
+	if stats[1].Name != "b" || stats[1].Requests != 2 || stats[1].Weight != 2 || stats[1].Active != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// A retry avoids the backends already tried while the route has others
+	byName := p.upstreams.byName
+	for i := 0; i < 3; i++ {
+		if got := p.upstreams.pick("gpt-4o", "/v1/chat/completions", byName["a"]); got.Name != "b" {
+			t.Errorf("avoiding a picked %s", got.Name)
+		}
+	}
+	if got := p.upstreams.pick("claude-3-haiku", "/v1/messages", byName["c"]); got.Name != "c" {
+		t.Errorf("avoiding the only backend picked %s", got.Name)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	// Each node's URL is only known once it listens
+	handlers := make(map[string]http.Handler)
+	urls := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[name].ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		urls[name] = srv.URL
+	}
+	nodes := make(map[string]*Proxy)
+	for name, mode := range map[string]string{"a": AffinityForward, "b": AffinityForward, "c": AffinityRedirect} {
+		p, err := New(Options{
+			DeepServerURL: upstream.URL,
+			Node:          name,
+			Peers:         map[string]string{"a": urls["a"], "b": urls["b"], "d": gone.URL},
+			Affinity:      mode,
+			Logger:        quietLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[name], handlers[name] = p, p
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(node, cookie string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", urls[node]+"/sse?client_id=c1", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: AffinityCookie, Value: cookie})
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	cookie := func(resp *http.Response) string {
+		for _, c := range resp.Cookies() {
+			if c.Name == AffinityCookie {
+				return c.Value
+			}
+		}
+		return ""
+	}
+
+	resp, body := get("a", "")
+	if cookie(resp) != "a" || !strings.Contains(body, "[DONE]") {
+		t.Errorf("first connect: cookie %q\n%s", cookie(resp), body)
+	}
+	resp, body = get("a", "b")
+	if resp.Header.Get("X-Horizon-Node") != "b" || cookie(resp) != "b" || !strings.Contains(body, "[DONE]") {
+		t.Errorf("forward to b: served by %q, cookie %q\n%s", resp.Header.Get("X-Horizon-Node"), cookie(resp), body)
+	}
+	resp, _ = get("c", "b")
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusTemporaryRedirect || loc != urls["b"]+"/sse?client_id=c1" {
+		t.Errorf("redirect to b: %d %q", resp.StatusCode, loc)
+	}
+	// A node that is gone, or that nobody knows, is fallen back from
+	for _, dead := range []string{"d", "e"} {
+		resp, body = get("a", dead)
+		if resp.Header.Get("X-Horizon-Node") != "a" || cookie(resp) != "a" || !strings.Contains(body, "[DONE]") {
+			t.Errorf("cookie for %s: served by %q, cookie %q\n%s", dead, resp.Header.Get("X-Horizon-Node"), cookie(resp), body)
+		}
+	}
+
+	stats := nodes["a"].affinity.Stats()
+	if stats.Routed != 1 || stats.Fallbacks != 1 || stats.Unknown != 1 || stats.Issued != 3 || !stats.Peers["b"] || stats.Peers["d"] {
+		t.Errorf("node a stats %+v", stats)
+	}
+	if _, err := New(Options{Peers: map[string]string{"a": urls["a"]}}); err == nil {
+		t.Error("peers without a node name accepted")
+	}
+}
+
+func TestHealthCheckFailover(t *testing.T) {
+	var bDown int32
+	var hitsA, hitsB int64
+	backend := func(hits *int64, down *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				if atomic.LoadInt32(down) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			atomic.AddInt64(hits, 1)
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}))
+	}
+	var aDown int32
+	a, b := backend(&hitsA, &aDown), backend(&hitsB, &bDown)
+	defer a.Close()
+	defer b.Close()
+
+	p, err := New(Options{
+		Upstreams:   []Upstream{{Name: "a", URL: a.URL, Weight: 1}, {Name: "b", URL: b.URL, Weight: 1}},
+		HealthCheck: HealthCheck{Interval: 10 * time.Millisecond, UnhealthyThreshold: 2, HealthyThreshold: 2},
+		Logger:      quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.upstreams.runHealthChecks(ctx, p.logger)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	waitFor := func(what string, cond func(BackendStats) bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond(p.upstreams.Stats().Backends[1]) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %+v", what, p.upstreams.Stats())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	get := func() {
+		resp, err := http.Get(srv.URL + "/sse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	atomic.StoreInt32(&bDown, 1)
+	waitFor("b not taken out of rotation", func(s BackendStats) bool { return !s.Healthy })
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if hitsA != 4 || hitsB != 0 {
+		t.Errorf("with b down: a got %d streams, b %d", hitsA, hitsB)
+	}
+
+	atomic.StoreInt32(&bDown, 0)
+	waitFor("b not back in rotation", func(s BackendStats) bool { return s.Healthy })
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if hitsB != 2 {
+		t.Errorf("with b back: b got %d streams, want 2", hitsB)
+	}
+	stats := p.upstreams.Stats()
+	if stats.Failovers != 4 || stats.Backends[1].MarkedDown != 1 || stats.Backends[1].MarkedUp != 1 || stats.Backends[1].LastError != "status 503" {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestEarlyFlush(t *testing.T) {
+	const upstreamDelay = 300 * time.Millisecond
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(upstreamDelay)
+		if r.URL.Query().Get("token_delay_ms") == "1" {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Trailer", "X-Usage")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+		w.Header().Set("X-Usage", "5")
+	}))
+	defer upstream.Close()
+
+	open := func(mode, query string) (*http.Response, time.Duration) {
+		p, err := New(Options{DeepServerURL: upstream.URL, EarlyFlush: mode, ForwardTrailers: HeaderPolicy{All: true}, Logger: quietLogger()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(p)
+		t.Cleanup(srv.Close)
+		start := time.Now()
+		resp, err := http.Get(srv.URL + "/sse" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, time.Since(start)
+	}
+	read := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	resp, took := open(EarlyFlushComment, "")
+	if took >= upstreamDelay/2 || resp.StatusCode != http.StatusOK {
+		t.Errorf("comment mode: status %d after %v", resp.StatusCode, took)
+	}
+	if body := read(resp); !strings.HasPrefix(body, ": connected") || !strings.Contains(body, "[DONE]") || resp.Trailer.Get("X-Usage") != "5" {
+		t.Errorf("comment mode: trailer %q\n%s", resp.Trailer.Get("X-Usage"), body)
+	}
+
+	resp, _ = open(EarlyFlushEvent, "")
+	if body := read(resp); !strings.HasPrefix(body, "event: meta\ndata: {") || !strings.Contains(body, `"state":"waiting_for_upstream"`) {
+		t.Errorf("event mode:\n%s", body)
+	}
+
+	// Asked for by the client, and an upstream error after the 200
+	resp, took = open("", "?flush_headers=true&token_delay_ms=1")
+	if took >= upstreamDelay/2 || resp.StatusCode != http.StatusOK {
+		t.Errorf("?flush_headers: status %d after %v", resp.StatusCode, took)
+	}
+	if body := read(resp); !strings.Contains(body, "event: error\ndata: {\"status\":502") {
+		t.Errorf("upstream error after an early flush:\n%s", body)
+	}
+
+	resp, took = open("", "")
+	if read(resp); took < upstreamDelay {
+		t.Errorf("headers after %v without early flush", took)
+	}
+	if _, err := New(Options{EarlyFlush: "always"}); err == nil {
+		t.Error("unknown early flush mode accepted")
+	}
+}
+
+// An early-flushed stream waiting on a slow upstream pings its client.
+func TestHeartbeat(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	p, err := New(Options{DeepServerURL: upstream.URL, EarlyFlush: EarlyFlushComment, Heartbeat: 20 * time.Millisecond, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	events := strings.SplitAfter(string(body), "\n\n")
+	if len(events) < 3 || !strings.HasPrefix(events[0], ": connected") || events[1] != server.HeartbeatComment || !strings.Contains(string(body), "[DONE]") {
+		t.Errorf("got %q", body)
+	}
+	if st := p.heartbeats.Stats(); st.Sent == 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+// sentinelReader notes whether its contents were ever read.
+type sentinelReader struct {
+	io.Reader
+	read int32
+}
+
+func (r *sentinelReader) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&r.read, 1)
+	return r.Reader.Read(p)
+}
+
+func TestExpectContinueRefused(t *testing.T) {
+	p, err := New(Options{DeepServerURL: "http://127.0.0.1:1", MaxRequestBytes: 1024, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	body := &sentinelReader{Reader: strings.NewReader(strings.Repeat("x", 4096))}
+	req, _ := http.NewRequest("POST", srv.URL+"/sse", body)
+	req.ContentLength = 4096
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&body.read) != 0 {
+		t.Error("body sent without 100 Continue")
+	}
+	if n := atomic.LoadInt64(&p.continueRefused); n != 1 {
+		t.Errorf("continue_refused = %d", n)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	bodies := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	stream := func(query, body string) (string, error) {
+		conn, _, err := websocket.Dial(context.Background(), srv.URL+"/ws"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteText([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		r := websocket.NewEventReader(conn)
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		return string(got), err
+	}
+
+	// An empty first message streams what GET /sse would
+	got, err := stream("?max_tokens=7", "")
+	if err != nil || !strings.Contains(got, `"content":"hi"`) || !strings.HasSuffix(got, "data: [DONE]\n\n") {
+		t.Errorf("GET stream: %v\n%s", err, got)
+	}
+	if body := <-bodies; !strings.Contains(body, `"max_tokens":7`) {
+		t.Errorf("upstream body for GET stream %s", body)
+	}
+
+	// Otherwise it is the body of a POST
+	if _, err := stream("", `{"model":"gpt-4o","messages":[{"role":"user","content":"ws"}]}`); err != nil {
+		t.Errorf("POST stream: %v", err)
+	}
+	if body := <-bodies; !strings.Contains(body, `"content":"ws"`) {
+		t.Errorf("upstream body for POST stream %s", body)
+	}
+
+	_, err = stream("?max_tokens=lots", "")
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseStatusBase+http.StatusBadRequest {
+		t.Errorf("invalid stream ended with %v", err)
+	}
+	if n := atomic.LoadInt64(&p.websocketStreams); n != 3 {
+		t.Errorf("websocket_streams = %d", n)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	requests := make(chan string, 1)
+	sse := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r.URL.RawQuery + " " + string(body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id":"c1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":null}]}`+"\n\ndata: [DONE]\n\n")
+	})
+	upstream := httptest.NewUnstartedServer(grpcapi.Handler("/v1/chat/completions", sse))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// The proxy streams from the gRPC upstream and serves gRPC clients
+	p, err := New(Options{
+		DeepServerURL:       upstream.URL,
+		UpstreamProtocol:    UpstreamGRPC,
+		UpstreamInsecureTLS: true,
+		Logger:              quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(p)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &grpcapi.SSETransport{Base: srv.Client().Transport}}
+	resp, err := client.Post(srv.URL+"/v1/chat/completions?token_delay_ms=5", "application/json",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"grpc"}],"max_tokens":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(got), `"content":"hi"`) || !strings.HasSuffix(string(got), "data: [DONE]\n\n") {
+		t.Fatalf("status %d, %v:\n%s", resp.StatusCode, err, got)
+	}
+	if req := <-requests; !strings.HasPrefix(req, "token_delay_ms=5 ") || !strings.Contains(req, `"content":"grpc"`) || !strings.Contains(req, `"max_tokens":3`) {
+		t.Errorf("upstream request %s", req)
+	}
+	if n := atomic.LoadInt64(&p.grpcStreams); n != 1 {
+		t.Errorf("grpc_streams = %d", n)
+	}
+
+	// gRPC upstreams speak only the OpenAI dialect
+	resp, err = srv.Client().Get(srv.URL + "/sse?dialect=anthropic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("anthropic dialect: status %d", resp.StatusCode)
+	}
+
+	if _, err := New(Options{DeepServerURL: upstream.URL, UpstreamProtocol: "carrier-pigeon"}); err == nil {
+		t.Error("unknown upstream protocol accepted")
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var attempts int64
+	bodies := make(chan string, 8)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		n := atomic.AddInt64(&attempts, 1)
+		if r.URL.Query().Get("token_delay_ms") == "1" || n <= 2 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	spoolDir := t.TempDir()
+	p, err := New(Options{
+		DeepServerURL:   upstream.URL,
+		BodyMemory:      64,
+		BodySpoolDir:    spoolDir,
+		UpstreamRetries: 2,
+		RetryBackoff:    time.Millisecond,
+		Logger:          quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// Larger than BodyMemory, so it is read back from disk for each try
+	request := `{"model":"gpt-4o","messages":[{"role":"user","content":"` + strings.Repeat("x", 200) + `"}]}`
+	resp, err := http.Post(srv.URL+"/sse", "application/json", strings.NewReader(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(out), "[DONE]") {
+		t.Fatalf("status %d:\n%s", resp.StatusCode, out)
+	}
+	first := <-bodies
+	for i := 0; i < 2; i++ {
+		if retried := <-bodies; retried != first {
+			t.Errorf("retry %d sent %.80q, first try %.80q", i+1, retried, first)
+		}
+	}
+	if !strings.Contains(first, strings.Repeat("x", 200)) || !strings.HasSuffix(first, `,"stream":true}`) {
+		t.Errorf("upstream body %s", first)
+	}
+
+	// Out of retries, the client gets the last answer, as a gateway error
+	resp, err = http.Get(srv.URL + "/sse?token_delay_ms=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("exhausted retries: status %d", resp.StatusCode)
+	}
+
+	if got, want := p.retryStats(), (RetryStats{Retries: 4, Recovered: 1, Exhausted: 1}); got != want {
+		t.Errorf("retry stats %+v, want %+v", got, want)
+	}
+	if got := p.bodies.Stats(); got.Spilled != 1 || got.Active != 0 {
+		t.Errorf("body stats %+v", got)
+	}
+	if files, _ := os.ReadDir(spoolDir); len(files) != 0 {
+		t.Errorf("spooled bodies left behind: %v", files)
+	}
+}
+
+func TestUnary(t *testing.T) {
+	var attempts int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/v1/moderations" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"input is required"}}`)
+			return
+		}
+		if atomic.AddInt64(&attempts, 1) == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"path":%q,"auth":%q,"body":%s}`, r.URL.Path, r.Header.Get("Authorization"), body)
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{
+		DeepServerURL:   upstream.URL,
+		MaxRequestBytes: 256,
+		UpstreamRetries: 1,
+		RetryBackoff:    time.Millisecond,
+		UpstreamErrors:  server.UpstreamErrorRoutes{Routes: map[string]server.UpstreamErrorMode{"/v1/moderations": server.ErrorsPassthrough}},
+		Logger:          quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	post := func(path, body string) (int, string) {
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-test")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+
+	// Sent again after the 503, as it came
+	request := `{"model":"text-embedding-3-small","input":["a","b"]}`
+	status, out := post("/v1/embeddings", request)
+	want := `{"path":"/v1/embeddings","auth":"Bearer sk-test","body":` + request + `}`
+	if status != http.StatusOK || out != want {
+		t.Errorf("embeddings: %d %s", status, out)
+	}
+	if status, out := post("/v1/moderations", `{}`); status != http.StatusBadRequest || !strings.Contains(out, "input is required") {
+		t.Errorf("moderations error: %d %s", status, out)
+	}
+	for body, want := range map[string]int{
+		`["a"]`: http.StatusBadRequest,
+		`null`:  http.StatusBadRequest,
+		`{"input":"` + strings.Repeat("x", 300) + `"}`: http.StatusRequestEntityTooLarge,
+	} {
+		if status, out := post("/v1/embeddings", body); status != want {
+			t.Errorf("%.40s: status %d, want %d: %s", body, status, want, out)
+		}
+	}
+
+	stats := p.unaryStats()
+	if st := stats["/v1/embeddings"]; st.Requests != 4 || st.Failed != 3 || st.Bytes != int64(len(want)) {
+		t.Errorf("embeddings stats %+v", st)
+	}
+	if st := stats["/v1/moderations"]; st.Requests != 1 || st.Failed != 1 {
+		t.Errorf("moderations stats %+v", st)
+	}
+	if got := p.retryStats(); got.Retries != 1 || got.Recovered != 1 {
+		t.Errorf("retry stats %+v", got)
+	}
+}
+
+func TestBatchAPI(t *testing.T) {
+	// Each upstream names its files and batches after itself
+	newUpstream := func(name string) *httptest.Server {
+		var n int64
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == "POST" && r.URL.Path == "/v1/files":
+				file, _, err := r.FormFile("file")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				data, _ := io.ReadAll(file)
+				fmt.Fprintf(w, `{"id":"file-%s-%d","bytes":%d}`, name, atomic.AddInt64(&n, 1), len(data))
+			case r.Method == "POST" && r.URL.Path == "/v1/batches":
+				var req struct {
+					InputFileID string `json:"input_file_id"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				if !strings.HasPrefix(req.InputFileID, "file-"+name) {
+					http.Error(w, `{"error":{"message":"no such file"}}`, http.StatusNotFound)
+					return
+				}
+				fmt.Fprintf(w, `{"id":"batch-%s","input_file_id":%q,"output_file_id":"out-%s"}`, name, req.InputFileID, name)
+			case strings.HasPrefix(r.URL.Path, "/v1/files/out-"+name):
+				fmt.Fprintf(w, `{"custom_id":"a","upstream":%q}`+"\n", name)
+			case strings.HasPrefix(r.URL.Path, "/v1/batches/batch-"+name), strings.HasPrefix(r.URL.Path, "/v1/files/file-"+name):
+				fmt.Fprintf(w, `{"id":%q}`, path.Base(r.URL.Path))
+			default:
+				http.Error(w, `{"error":{"message":"not found"}}`, http.StatusNotFound)
+			}
+		}))
+	}
+	a, b := newUpstream("a"), newUpstream("b")
+	defer a.Close()
+	defer b.Close()
+
+	p, err := New(Options{
+		Upstreams:           []Upstream{{Name: "a", URL: a.URL, Weight: 1}, {Name: "b", URL: b.URL, Weight: 1}},
+		BatchRateLimit:      1,
+		BatchBurst:          8,
+		BatchMaxUploadBytes: 1024,
+		Logger:              quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	call := func(method, path, contentType string, body io.Reader) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+	upload := func(content string) (int, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("purpose", "batch")
+		fw, _ := mw.CreateFormFile("file", "input.jsonl")
+		io.WriteString(fw, content)
+		mw.Close()
+		return call("POST", "/v1/files", mw.FormDataContentType(), &buf)
+	}
+
+	// Files land round-robin, but whatever names one goes where it is
+	var files []string
+	for i := 0; i < 2; i++ {
+		status, out := upload(`{"custom_id":"a"}`)
+		var f struct {
+			ID string `json:"id"`
+		}
+		if status != http.StatusOK || json.Unmarshal([]byte(out), &f) != nil {
+			t.Fatalf("upload: %d %s", status, out)
+		}
+		files = append(files, f.ID)
+	}
+	for _, id := range files {
+		if status, out := call("POST", "/v1/batches", "", strings.NewReader(`{"input_file_id":"`+id+`"}`)); status != http.StatusOK {
+			t.Errorf("batch of %s: %d %s", id, status, out)
+		}
+	}
+	for _, target := range []string{"/v1/batches/batch-a", "/v1/batches/batch-b", "/v1/files/out-b/content"} {
+		if status, out := call("GET", target, "", nil); status != http.StatusOK {
+			t.Errorf("%s: %d %s", target, status, out)
+		}
+	}
+	if status, _ := upload(strings.Repeat("x", 2048)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("large upload: status %d", status)
+	}
+
+	// The burst of 8 is spent
+	if status, _ := call("GET", "/v1/batches/batch-a", "", nil); status != http.StatusTooManyRequests {
+		t.Errorf("over the rate limit: status %d", status)
+	}
+
+	st := p.batchStats()
+	if st.Pinned != 5 || st.RateLimited != 1 {
+		t.Errorf("batch stats %+v", st)
+	}
+	if c := st.Calls["POST /v1/files"]; c.Requests != 3 || c.Failed != 1 {
+		t.Errorf("upload stats %+v", c)
+	}
+	if c := st.Calls["GET /v1/batches/{id}"]; c.Requests != 3 || c.Failed != 1 {
+		t.Errorf("retrieve stats %+v", c)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: a\n\ndata: b\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# team keys\nalice=sk-alice\nsk-anon\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(Options{DeepServerURL: upstream.URL, APIKeys: keys, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	get := func(path string, header, value string) int {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	for _, tc := range []struct {
+		header, value string
+		want          int
+	}{
+		{"Authorization", "Bearer sk-alice", http.StatusOK},
+		{"X-API-Key", "sk-anon", http.StatusOK},
+		{"Authorization", "Bearer sk-mallory", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		if got := get("/sse", tc.header, tc.value); got != tc.want {
+			t.Errorf("%s %q: status %d, want %d", tc.header, tc.value, got, tc.want)
+		}
+	}
+	if got := get("/health", "", ""); got != http.StatusOK {
+		t.Errorf("/health: status %d", got)
+	}
+
+	st := keys.Stats()
+	alice := st.Keys["alice"]
+	if alice.Connections != 1 || alice.Active != 0 || alice.Messages != 2 || st.Rejected != 2 {
+		t.Errorf("stats %+v", st)
+	}
+	if len(st.Keys) != 2 {
+		t.Errorf("keys %v", st.Keys)
+	}
+
+	// A key removed from the file is refused once the change is seen
+	if err := os.WriteFile(path, []byte("alice=sk-alice\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	keys.reload(later)
+	if got := get("/sse", "X-API-Key", "sk-anon"); got != http.StatusUnauthorized {
+		t.Errorf("revoked key: status %d", got)
+	}
+	if got := keys.Stats(); got.Keys["alice"].Connections != 1 || len(got.Keys) != 1 {
+		t.Errorf("stats after reload %+v", got)
+	}
+
+	for _, spec := range []string{"", "=sk", "==", " , "} {
+		if _, err := ParseAPIKeys(spec); err == nil {
+			t.Errorf("ParseAPIKeys(%q) accepted", spec)
+		}
+	}
+
+	// Base64 keys end in = padding, which must not split them into a name
+	// and a key of padding
+	padded, err := ParseAPIKeys("c2VjcmV0a2V5MQ==,c2VjcmV0a2V5Mg=,ci=c2VjcmV0a2V5Mw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{
+		"c2VjcmV0a2V5MQ==": true,
+		"c2VjcmV0a2V5Mg=":  true,
+		"c2VjcmV0a2V5Mw==": true,
+		"=":                false,
+		"==":               false,
+		"c2VjcmV0a2V5MQ":   false,
+		"ci":               false,
+	} {
+		r := httptest.NewRequest("GET", "/sse", nil)
+		r.Header.Set("X-API-Key", key)
+		if got := padded.lookup(r) != nil; got != want {
+			t.Errorf("key %q accepted %v, want %v", key, got, want)
+		}
+	}
+	if _, ok := padded.Stats().Keys["ci"]; !ok {
+		t.Errorf("named padded key missing from %v", padded.Stats().Keys)
+	}
+}
+
+// TestApprovedCrypto keeps the code that authenticates clients and
+// upstreams, signs and stores secrets on FIPS-approved primitives.
+func TestApprovedCrypto(t *testing.T) {
+	approved := map[string]bool{
+		"crypto/sha256": true, "crypto/sha512": true, "crypto/hmac": true,
+		"crypto/rand": true, "crypto/subtle": true, "crypto/tls": true,
+		"crypto/ecdsa": true, "crypto/elliptic": true, "crypto/rsa": true,
+		"crypto/x509": true, "crypto/x509/pkix": true,
+	}
+	for _, file := range []string{
+		"auth.go",
+		"jwt.go",
+		"../server/usage.go",
+		"../server/idempotency.go",
+		"../server/webhooks.go",
+		"../objstore/s3.go",
+		"../grpcapi/tls.go",
+	} {
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ImportsOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, imp := range f.Imports {
+			pkg, _ := strconv.Unquote(imp.Path.Value)
+			if (strings.HasPrefix(pkg, "crypto/") || strings.Contains(pkg, "/crypto")) && !approved[pkg] {
+				t.Errorf("%s imports %s, which is not FIPS-approved", file, pkg)
+			}
+		}
+	}
+}
+
+func TestJWT(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	b64 := base64.RawURLEncoding.EncodeToString
+	ecJWK := fmt.Sprintf(`{"kty":"EC","kid":"ec1","crv":"P-256","x":"%s","y":"%s"}`,
+		b64(ecKey.X.FillBytes(make([]byte, 32))), b64(ecKey.Y.FillBytes(make([]byte, 32))))
+	rsaJWK := fmt.Sprintf(`{"kty":"RSA","kid":"rsa1","n":"%s","e":"AQAB"}`, b64(rsaKey.N.Bytes()))
+	var jwks atomic.Value
+	jwks.Store(`{"keys":[` + ecJWK + `,{"kty":"oct","kid":"hs","k":"c2VjcmV0"}]}`)
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, jwks.Load().(string))
+	}))
+	defer jwksServer.Close()
+
+	sign := func(alg, kid string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+		body, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(body)
+		sum := sha256.Sum256([]byte(signed))
+		var sig []byte
+		switch alg {
+		case "ES256":
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		case "RS256":
+			sig, _ = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		case "PS256":
+			sig, _ = rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, sum[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return signed + "." + b64(sig)
+	}
+	claims := func(tenant string, change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": "idp", "aud": []string{"proxy"}, "sub": "u-" + tenant, "tenant": tenant, "exp": time.Now().Add(time.Minute).Unix()}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	var seen atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen.Store(r.Header.Get(server.TenantHeader) + " " + r.Header.Get(UserHeader))
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: a\n\ndata: b\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	auth, err := NewJWTAuth(JWTConfig{JWKSURL: jwksServer.URL, Issuer: "idp", Audience: "proxy", MaxStreams: 1, MessagesPerMinute: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(Options{DeepServerURL: upstream.URL, JWT: auth, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/sse", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(server.TenantHeader, "spoofed")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp
+	}
+
+	valid := sign("ES256", "ec1", claims("team-a", nil))
+	other := strings.Split(sign("ES256", "ec1", claims("team-z", nil)), ".")
+	parts := strings.Split(valid, ".")
+	for name, token := range map[string]string{
+		"expired":     sign("ES256", "ec1", claims("team-a", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"issuer":      sign("ES256", "ec1", claims("team-a", func(c map[string]interface{}) { c["iss"] = "elsewhere" })),
+		"audience":    sign("ES256", "ec1", claims("team-a", func(c map[string]interface{}) { c["aud"] = "other" })),
+		"no tenant":   sign("ES256", "ec1", claims("team-a", func(c map[string]interface{}) { delete(c, "tenant") })),
+		"tampered":    parts[0] + "." + other[1] + "." + parts[2],
+		"alg none":    b64([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".",
+		"unknown kid": sign("RS256", "rsa1", claims("team-b", nil)),
+		"missing":     "",
+	} {
+		if resp := get(token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: status %d", name, resp.StatusCode)
+		}
+	}
+
+	if resp := get(valid); resp.StatusCode != http.StatusOK || seen.Load() != "team-a u-team-a" {
+		t.Errorf("valid token: status %d, upstream saw %v", resp.StatusCode, seen.Load())
+	}
+	// Its two messages use up team-a's minute
+	if resp := get(valid); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("over messages per minute: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// A key added to the set is fetched when a token is signed with it
+	jwks.Store(`{"keys":[` + ecJWK + `,` + rsaJWK + `]}`)
+	auth.minRefetch = 0
+	for alg, tenant := range map[string]string{"RS256": "team-b", "PS256": "team-d"} {
+		if resp := get(sign(alg, "rsa1", claims(tenant, nil))); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", alg, resp.StatusCode)
+		}
+	}
+
+	// A tenant at its stream limit is refused more
+	started, release := make(chan struct{}), make(chan struct{})
+	held := auth.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	req := httptest.NewRequest("GET", "/sse", nil)
+	req.Header.Set("Authorization", "Bearer "+sign("ES256", "ec1", claims("team-c", nil)))
+	go held(httptest.NewRecorder(), req)
+	<-started
+	rec := httptest.NewRecorder()
+	held(rec, req)
+	close(release)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("over stream limit: status %d", rec.Code)
+	}
+
+	st := auth.Stats()
+	a := st.Tenants["team-a"]
+	if a.Connections != 1 || a.Messages != 2 || a.MessagesLastMinute != 2 || a.Throttled != 1 {
+		t.Errorf("team-a stats %+v", a)
+	}
+	if st.Rejected != 8 || st.Keys != 2 || st.Tenants["team-c"].Throttled != 1 || st.Tenants["team-b"].Connections != 1 {
+		t.Errorf("stats %+v", st)
+	}
+
+	keys, _ := ParseAPIKeys("sk")
+	if _, err := New(Options{DeepServerURL: upstream.URL, APIKeys: keys, JWT: auth}); err == nil {
+		t.Error("API keys and JWT accepted together")
+	}
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, ConnectionRatePerIP: 0.5, ConnectionBurstPerIP: 2, ConnectionRate: 0.5, ConnectionBurst: 3, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/sse", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Each address gets its burst, until the global one runs out
+	for i, tc := range []struct {
+		remote string
+		want   int
+	}{
+		{"10.0.0.1:1000", http.StatusOK},
+		{"10.0.0.1:1001", http.StatusOK},
+		{"10.0.0.1:1002", http.StatusTooManyRequests},
+		{"10.0.0.2:1000", http.StatusOK},
+		{"10.0.0.3:1000", http.StatusTooManyRequests},
+	} {
+		rec := status(tc.remote)
+		if rec.Code != tc.want {
+			t.Fatalf("%d from %s: status %d, want %d", i, tc.remote, rec.Code, tc.want)
+		}
+		if tc.want != http.StatusTooManyRequests {
+			continue
+		}
+		// A token takes two seconds, plus up to the bucket's refill time
+		retry, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+		body := rec.Body.String()
+		if retry < 1 || retry > 8 || rec.Header().Get("Content-Type") != "text/event-stream" || !strings.Contains(body, "\nretry: ") {
+			t.Errorf("%d: Retry-After %d, body %q", i, retry, body)
+		}
+	}
+
+	st := p.connectionLimitStats()
+	if st.RateLimitedIP != 1 || st.RateLimited != 1 || st.Addresses != 3 {
+		t.Errorf("stats %+v", st)
+	}
+	if _, err := New(Options{DeepServerURL: upstream.URL, ConnectionRate: -1}); err == nil {
+		t.Error("negative connection rate accepted")
+	}
+
+	// Only a peer's address can have its streams counted where they began
+	p, err = New(Options{DeepServerURL: upstream.URL, ConnectionRatePerIP: 0.5, ConnectionBurstPerIP: 1, Node: "a", Peers: map[string]string{"b": "http://10.0.0.9:10080"}, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := func(remote string) int {
+		req := httptest.NewRequest("GET", "/sse", nil)
+		req.RemoteAddr = remote
+		req.Header.Set(forwardedHeader, "b")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i, tc := range []struct {
+		remote string
+		want   int
+	}{
+		{"10.0.0.1:1000", http.StatusOK},
+		{"10.0.0.1:1001", http.StatusTooManyRequests},
+		{"10.0.0.9:1000", http.StatusOK},
+		{"10.0.0.9:1001", http.StatusOK},
+	} {
+		if got := forwarded(tc.remote); got != tc.want {
+			t.Errorf("%d: forwarded from %s: status %d, want %d", i, tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	release := make(chan struct{})
+	backend := func(name string, hits *int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt64(hits, 1)
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", name)
+			if name == "a" && n == 1 {
+				w.(http.Flusher).Flush()
+				<-release
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}))
+	}
+	var hitsA, hitsB int64
+	a, b := backend("a", &hitsA), backend("b", &hitsB)
+	defer a.Close()
+	defer b.Close()
+
+	p, err := New(Options{Upstreams: []Upstream{{Name: "a", URL: a.URL, Weight: 1}}, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	post := func(model string) (int, string) {
+		body := `{"model":"` + model + `","messages":[{"role":"user","content":"hi"}]}`
+		resp, err := http.Post(srv.URL+"/sse", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+
+	// The first stream, held open by a, keeps going while routing moves
+	// away from it
+	held, err := http.Get(srv.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Body.Close()
+	first := p.upstreams.lookup("a")
+	err = p.Reload(Reloadable{
+		Upstreams:       []Upstream{{Name: "a", URL: a.URL, Weight: 3}, {Name: "b", URL: b.URL, Weight: 1}},
+		Routes:          []Route{{Model: "gpt-*", Upstreams: []string{"b"}}},
+		ConnectionRate:  0.5,
+		ConnectionBurst: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept := p.upstreams.lookup("a"); kept != first || kept.Weight != 3 || kept.Active() != 1 {
+		t.Errorf("backend a not kept across the reload: %+v", kept)
+	}
+	if code, body := post("gpt-4o"); code != http.StatusOK || !strings.Contains(body, `"b"`) {
+		t.Errorf("routed stream: %d %q", code, body)
+	}
+	post("gpt-4o")
+	if code, _ := post("gpt-4o"); code != http.StatusTooManyRequests {
+		t.Errorf("past the reloaded rate limit: status %d", code)
+	}
+	close(release)
+	if out, _ := io.ReadAll(held.Body); !strings.Contains(string(out), `"a"`) || !strings.Contains(string(out), "[DONE]") {
+		t.Errorf("held stream: %q", out)
+	}
+
+	// An inconsistent config changes nothing
+	if err := p.Reload(Reloadable{DeepServerURL: a.URL, Routes: []Route{{Model: "x", Upstreams: []string{"c"}}}}); err == nil {
+		t.Error("route to an unknown upstream accepted")
+	}
+	if err := p.Reload(Reloadable{DeepServerURL: a.URL, ConnectionRate: -1}); err == nil {
+		t.Error("negative connection rate accepted")
+	}
+	if p.upstreams.lookup("b") == nil || p.connectionLimitStats() == nil {
+		t.Error("refused reload changed the proxy")
+	}
+
+	// Back to a lone deep server, without limits
+	if err := p.Reload(Reloadable{DeepServerURL: b.URL}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if code, body := post("gpt-4o"); code != http.StatusOK || !strings.Contains(body, `"b"`) {
+			t.Errorf("after reload %d: %d %q", i, code, body)
+		}
+	}
+	if p.connectionLimitStats() != nil || p.upstreams.primary() != b.URL {
+		t.Errorf("limits %+v, primary %s", p.connectionLimitStats(), p.upstreams.primary())
+	}
+}
+
+func TestConnectionQueue(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		<-release
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, MaxConnections: 1, ConnectionQueue: 1, ConnectionQueueTimeout: 100 * time.Millisecond, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := func(ctx context.Context) <-chan int {
+		done := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest("GET", "/sse", nil).WithContext(ctx))
+			done <- rec.Code
+		}()
+		return done
+	}
+	waitDepth := func(depth int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for p.connQueue.stats().Depth != depth {
+			if time.Now().After(deadline) {
+				t.Fatalf("queue depth %d, want %d", p.connQueue.stats().Depth, depth)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// One streams and one waits for it; a third finds the queue full
+	first := stream(context.Background())
+	for atomic.LoadInt64(&p.activeConnections) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	second := stream(context.Background())
+	waitDepth(1)
+	if code := <-stream(context.Background()); code != http.StatusServiceUnavailable {
+		t.Errorf("past a full queue: %d", code)
+	}
+	// The first ending hands its slot to the second
+	release <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("first: %d", code)
+	}
+	waitDepth(0)
+	if n := atomic.LoadInt64(&p.activeConnections); n != 1 {
+		t.Errorf("%d active after the hand-off", n)
+	}
+
+	// A stream that waits too long gets a 503, one that leaves nothing
+	if code := <-stream(context.Background()); code != http.StatusServiceUnavailable {
+		t.Errorf("timed out: %d", code)
+	}
+	leaving, leave := context.WithCancel(context.Background())
+	gone := stream(leaving)
+	waitDepth(1)
+	leave()
+	<-gone
+	release <- struct{}{}
+	if code := <-second; code != http.StatusOK {
+		t.Errorf("second: %d", code)
+	}
+
+	st := p.connQueue.stats()
+	if st.Depth != 0 || st.Queued != 3 || st.TimedOut != 1 || st.Abandoned != 1 || st.Full != 1 || st.Wait.Count != 1 {
+		t.Errorf("stats %+v", st)
+	}
+	if n := atomic.LoadInt64(&p.activeConnections); n != 0 {
+		t.Errorf("%d active at the end", n)
+	}
+	if _, err := New(Options{DeepServerURL: upstream.URL, ConnectionQueue: -1}); err == nil {
+		t.Error("negative connection queue accepted")
+	}
+}
+
+func TestReportCancellations(t *testing.T) {
+	reports := make(chan string, 4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			reports <- r.URL.Path + " " + r.Header.Get(server.CancelReasonHeader)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: 1\n\n")
+		if r.Header.Get("X-Stream-ID") == "done" {
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, ReportCancellations: true, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// A stream that ends by itself is not reported
+	resp, err := http.Get(srv.URL + "/sse?stream_id=done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// One the client leaves is, under its stream ID
+	resp, err = http.Get(srv.URL + "/sse?stream_id=left")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufio.NewReader(resp.Body).ReadString('\n')
+	resp.Body.Close()
+	select {
+	case got := <-reports:
+		if got != "/v1/streams/left "+server.CancelClientGone {
+			t.Errorf("reported %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no cancellation reported")
+	}
+	select {
+	case got := <-reports:
+		t.Errorf("also reported %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if st := p.cancelReportStats(); st.Reasons[server.CancelClientGone] != 1 || len(st.Reasons) != 1 || st.Failed != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestStreamCommands(t *testing.T) {
+	events := make(chan string)
+	ended := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(ended)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case ev := <-events:
+				fmt.Fprint(w, ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), srv.URL+"/ws?stream_id=s1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteText(nil)
+	next := func() websocket.Message {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg websocket.Message
+		json.Unmarshal(message, &msg)
+		return msg
+	}
+	command := func(cmd string) StreamControlState {
+		t.Helper()
+		conn.WriteText([]byte(cmd))
+		msg := next()
+		var state StreamControlState
+		if msg.Event != "control" || json.Unmarshal([]byte(msg.Data), &state) != nil {
+			t.Fatalf("got %+v for %s", msg, cmd)
+		}
+		return state
+	}
+	post := func(id, cmd string) (int, StreamControlState) {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/streams/"+id+"/control", "application/json", strings.NewReader(cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var state StreamControlState
+		json.NewDecoder(resp.Body).Decode(&state)
+		return resp.StatusCode, state
+	}
+
+	events <- "event: delta\ndata: 1\n\n"
+	if msg := next(); msg.Event != "delta" || msg.Data != "1" {
+		t.Fatalf("first event %+v", msg)
+	}
+
+	// A filter over WebSocket drops the events of other types
+	if state := command(`{"command":"filter","events":["done"]}`); state.StreamID != "s1" || !reflect.DeepEqual(state.Events, []string{"done"}) {
+		t.Errorf("filter: %+v", state)
+	}
+	events <- "event: delta\ndata: 2\n\n"
+	events <- "event: done\ndata: 3\n\n"
+	if msg := next(); msg.Event != "done" || msg.Data != "3" {
+		t.Errorf("filtered stream sent %+v", msg)
+	}
+
+	// Paused over HTTP, the stream holds its events until resumed
+	if status, state := post("s1", `{"command":"pause"}`); status != http.StatusOK || !state.Paused {
+		t.Errorf("pause: %d %+v", status, state)
+	}
+	events <- "event: done\ndata: 4\n\n"
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if message, err := conn.ReadMessage(); err == nil {
+		t.Errorf("paused stream sent %s", message)
+	}
+	conn.WriteText([]byte(`{"command":"resume"}`))
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		msg := next()
+		got[msg.Event] = msg.Data
+	}
+	if got["done"] != "4" || !strings.Contains(got["control"], `"paused":false`) {
+		t.Errorf("after resume: %v", got)
+	}
+
+	if state := command(`{"command":"rewind"}`); state.Error != `unknown command "rewind"` {
+		t.Errorf("unknown command over WebSocket: %+v", state)
+	}
+	if status, _ := post("s1", `{"command":`); status != http.StatusBadRequest {
+		t.Errorf("malformed command: %d", status)
+	}
+	if status, _ := post("nope", `{"command":"pause"}`); status != http.StatusNotFound {
+		t.Errorf("command to an unknown stream: %d", status)
+	}
+
+	// Cancelling ends the stream, and its upstream request
+	if state := command(`{"command":"cancel"}`); !state.Cancelled {
+		t.Errorf("cancel: %+v", state)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var closeErr *websocket.CloseError
+	if _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormal {
+		t.Errorf("cancelled stream ended with %v", err)
+	}
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Error("upstream request outlived the cancelled stream")
+	}
+
+	want := map[string]map[string]int64{
+		"http":      {CommandPause: 1},
+		"websocket": {CommandFilter: 1, CommandResume: 1, CommandCancel: 1},
+	}
+	if got := p.streamCommands.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stream_commands %v", got)
+	}
+}
+
+func TestStreamCommandOwner(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: a\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	keys, _ := ParseAPIKeys("alice=sk-alice,bob=sk-bob")
+	p, err := New(Options{DeepServerURL: upstream.URL, APIKeys: keys, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/sse?stream_id=s1", nil)
+	req.Header.Set("X-API-Key", "sk-alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bufio.NewReader(resp.Body).ReadString('\n')
+
+	post := func(key string) int {
+		req, _ := http.NewRequest("POST", srv.URL+"/streams/s1/control", strings.NewReader(`{"command":"pause"}`))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Another key's stream is as good as unknown to it
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "sk-bob": http.StatusNotFound, "sk-alice": http.StatusOK} {
+		if got := post(key); got != want {
+			t.Errorf("command with key %q: status %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestLogPayloads(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	var logged bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logged)
+	p, err := New(Options{
+		DeepServerURL:    upstream.URL,
+		LogPayloads:      true,
+		PayloadRedaction: audit.Policy{Mode: audit.ModeDrop},
+		Logger:           logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/sse", "application/json", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"the launch codes"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	out := logged.String()
+	if !strings.Contains(out, "Request payload") || !strings.Contains(out, `\"content\":\"[redacted]\"`) || strings.Contains(out, "launch codes") {
+		t.Errorf("logged %s", out)
+	}
+}
+
+func TestRequestBodyFields(t *testing.T) {
+	bodies := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	p, err := New(Options{DeepServerURL: upstream.URL, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		query, body, want string
+	}{
+		// The client's request goes as it came, with the missing fields added
+		{"", `{"model":"m","stream":true,"messages":[]}`, `{"model":"m","stream":true,"messages":[]}`},
+		{"?max_tokens=5", ` {"messages":[]} `, ` {"messages":[],"model":"gpt-4-turbo","stream":true,"max_tokens":5}`},
+		// A field set otherwise is replaced rather than sent twice
+		{"", `{"stream":false,"messages":[]}`, `{"messages":[],"model":"gpt-4-turbo","stream":true}`},
+	} {
+		resp, err := http.Post(srv.URL+"/sse"+tc.query, "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if got := <-bodies; got != tc.want {
+			t.Errorf("%s: upstream got %s, want %s", tc.body, got, tc.want)
+		}
+	}
+}
+
+// summaryHook passes on the stream summaries a logger writes.
+type summaryHook chan *logrus.Entry
+
+func (h summaryHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h summaryHook) Fire(e *logrus.Entry) error {
+	if e.Message == "Stream summary" {
+		h <- e
+	}
+	return nil
+}
+
+func TestStreamSummary(t *testing.T) {
+	var requests int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) > 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: {\"choices\":[{\"delta\":{\"content\":\"b\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	summaries := make(summaryHook, 4)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(summaries)
+	p, err := New(Options{DeepServerURL: upstream.URL, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	stream := func() (int64, logrus.Fields) {
+		resp, err := http.Get(srv.URL + "/sse?client_id=c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		select {
+		case e := <-summaries:
+			return n, e.Data
+		case <-time.After(5 * time.Second):
+			t.Fatal("no stream summary logged")
+			return 0, nil
+		}
+	}
+
+	n, fields := stream()
+	if fields["reason"] != streamCompleted || fields["client_id"] != "c1" || fields["transport"] != "sse" || fields["upstream"] != "default" {
+		t.Errorf("completed stream: %v", fields)
+	}
+	if fields["bytes"] != n || fields["messages"] != int64(2) {
+		t.Errorf("counted %v bytes and %v messages, client read %d bytes", fields["bytes"], fields["messages"], n)
+	}
+	if ms, _ := fields["first_byte_ms"].(float64); ms <= 0 || ms > fields["duration_ms"].(float64) {
+		t.Errorf("first byte at %v ms of %v", fields["first_byte_ms"], fields["duration_ms"])
+	}
+
+	if _, fields := stream(); fields["reason"] != streamUpstreamStatus || fields["upstream_status"] != http.StatusServiceUnavailable {
+		t.Errorf("failed stream: %v", fields)
+	}
+}
+
+// accessLines collects the lines of an access log.
+type accessLines chan string
+
+func (l accessLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func TestAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	if _, err := New(Options{DeepServerURL: upstream.URL, AccessLog: io.Discard, AccessLogFormat: "apache"}); err == nil {
+		t.Error("unknown access log format accepted")
+	}
+
+	for _, format := range []string{AccessLogJSON, AccessLogCombined, AccessLogCommon} {
+		lines := make(accessLines, 4)
+		p, err := New(Options{DeepServerURL: upstream.URL, Logger: quietLogger(), AccessLog: lines, AccessLogFormat: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(p)
+		get := func(path string) (int64, string) {
+			resp, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, _ := io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			select {
+			case line := <-lines:
+				return n, line
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: no access log line for %s", format, path)
+				return 0, ""
+			}
+		}
+
+		n, line := get("/sse?client_id=c1")
+		_, health := get("/health")
+		srv.Close()
+		if format != AccessLogJSON {
+			want := fmt.Sprintf(`^127\.0\.0\.1 - - \[[^]]+\] "GET /sse\?client_id=c1 HTTP/1\.1" 200 %d( "-" "Go-http-client/1\.1")? [0-9.]+ completed\n$`, n)
+			if !regexp.MustCompile(want).MatchString(line) || strings.Contains(line, "Go-http-client") != (format == AccessLogCombined) {
+				t.Errorf("%s stream: %q", format, line)
+			}
+			if !strings.Contains(health, `"GET /health HTTP/1.1" 200 `) || !strings.HasSuffix(health, " -\n") {
+				t.Errorf("%s health check: %q", format, health)
+			}
+			continue
+		}
+		var e accessEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if e.Status != 200 || e.Bytes != n || e.URI != "/sse?client_id=c1" || e.Transport != "sse" || e.ClientID != "c1" || e.Reason != streamCompleted || e.DurationMs <= 0 {
+			t.Errorf("json stream: %s", line)
+		}
+		if err := json.Unmarshal([]byte(health), &e); err != nil || e.Status != 200 || strings.Contains(health, "reason") {
+			t.Errorf("json health check: %s", health)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	for spec, want := range map[string]Latency{
+		"":                             {},
+		"50ms":                         {Dist: LatencyFixed, Min: 50 * time.Millisecond},
+		"uniform:20ms-80ms":            {Dist: LatencyUniform, Min: 20 * time.Millisecond, Max: 80 * time.Millisecond},
+		"pareto:10ms,shape=1.5,max=2s": {Dist: LatencyPareto, Min: 10 * time.Millisecond, Shape: 1.5, Max: 2 * time.Second},
+	} {
+		if l, err := ParseLatency(spec); err != nil || l != want {
+			t.Errorf("ParseLatency(%q) = %+v, %v", spec, l, err)
+		}
+	}
+	for _, spec := range []string{"normal:5ms", "uniform:80ms-20ms", "uniform:20ms", "pareto:10ms", "pareto:10ms,shape=1,max=5ms", "fixed:5ms,1ms"} {
+		if _, err := ParseLatency(spec); err == nil {
+			t.Errorf("ParseLatency(%q) accepted", spec)
+		}
+	}
+	pareto := Latency{Dist: LatencyPareto, Min: 10 * time.Millisecond, Shape: 0.5, Max: time.Second}
+	for i := 0; i < 1000; i++ {
+		if d := pareto.sample(); d < pareto.Min || d > pareto.Max {
+			t.Fatalf("pareto sample %v out of [%v, %v]", d, pareto.Min, pareto.Max)
+		}
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range []string{`{"choices":[{"delta":{"content":"a"}}]}`, `{"choices":[{"delta":{"content":"b"}}]}`, "[DONE]"} {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+	p, err := New(Options{DeepServerURL: upstream.URL, Logger: quietLogger(), Latency: Latency{Dist: LatencyFixed, Min: 150 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var arrived []time.Duration
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data: ") {
+			arrived = append(arrived, time.Since(start))
+		}
+	}
+	// Each event is held 150ms from its receipt, so the delays overlap
+	// rather than add up
+	if len(arrived) != 3 || arrived[0] < 150*time.Millisecond || arrived[2] < 250*time.Millisecond || arrived[2] > 400*time.Millisecond {
+		t.Errorf("events arrived at %v", arrived)
+	}
+}
+
+func TestRecording(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range []string{`{"choices":[{"delta":{"content":"a"}}]}`, `{"choices":[{"delta":{"content":"b"}}]}`, "[DONE]"} {
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	p, err := New(Options{DeepServerURL: upstream.URL, Logger: quietLogger(), RecordDir: dir, RecordCompress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sse?model=gpt-4o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	// The pump closes the recording once the stream is forwarded
+	for deadline := time.Now().Add(2 * time.Second); p.recorder.Stats().Recorded == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	recordings, err := server.LoadRecordings(dir)
+	if err != nil || len(recordings) != 1 {
+		t.Fatalf("recordings %v, %v", recordings, err)
+	}
+	rec := recordings[0]
+	if rec.Header.Path != "/v1/chat/completions" || rec.Header.Model != "gpt-4o" || rec.End != server.RecordingEOF || len(rec.Events) != 3 {
+		t.Fatalf("recording %+v", rec)
+	}
+	if rec.Events[0].AtMs < 50 || rec.Events[2].AtMs < 150 || rec.Events[2].Lines[0] != "data: [DONE]" {
+		t.Errorf("events %+v", rec.Events)
+	}
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	if err := rec.Replay(context.Background(), w, w, server.SystemClock); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("replayed in %v, recorded over %vms", elapsed, rec.Events[2].AtMs)
+	}
+	if !strings.HasSuffix(w.Body.String(), "\n\ndata: [DONE]\n\n") || strings.Count(w.Body.String(), "data: ") != 3 {
+		t.Errorf("replayed %q", w.Body.String())
+	}
+	rec.End = "unexpected EOF"
+	if err := rec.Replay(context.Background(), httptest.NewRecorder(), w, server.SystemClock); err == nil {
+		t.Error("replay of a cut stream succeeded")
+	}
+}
+
+func TestTestPage(t *testing.T) {
+	p, err := New(Options{DeepServerURL: "http://127.0.0.1:1", Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/testpage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(page), "new EventSource(") {
+		t.Errorf("page %s: %.200s", resp.Header.Get("Content-Type"), page)
+	}
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"user_agent":"Firefox","transport":"eventsource","streams":[{"events":12,"done":true},{"events":3,"error":"connection refused"}]}`, http.StatusNoContent},
+		{`{"streams":`, http.StatusBadRequest},
+	} {
+		resp, err := http.Post(srv.URL+"/testpage/results", "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: status %d, want %d", tc.body, resp.StatusCode, tc.code)
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/testpage/results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var listed struct {
+		Reports []TestPageReport `json:"reports"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Reports) != 1 || listed.Reports[0].UserAgent != "Firefox" || len(listed.Reports[0].Streams) != 2 || listed.Reports[0].Received.IsZero() {
+		t.Errorf("reports %+v", listed.Reports)
+	}
+}
+
+// A joined stream ends for the client when the stream finishes, even if
+// the client's buffer is full.
+func TestJoinedStreamEnds(t *testing.T) {
+	p, err := New(Options{DeepServerURL: "http://127.0.0.1:1", PumpBufferSize: 1, Logger: quietLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := p.trackStream("", "", "s1", &streamControl{})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sse?streams=s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("join: %s", resp.Status)
+	}
+	for i := 0; i < 10; i++ {
+		p.hub.Publish(streamTopicPrefix+"s1", server.Event{Data: fmt.Sprint(i)})
+	}
+	p.untrackStream(stream)
+
+	done := make(chan string)
+	go func() {
+		body, _ := io.ReadAll(resp.Body)
+		done <- string(body)
+	}()
+	select {
+	case body := <-done:
+		if !strings.HasSuffix(body, "event: stream-end\ndata: {\"stream\":\"s1\"}\n\n") {
+			t.Errorf("body %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("joined client still open after the stream ended")
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"horizon-sse-go/objstore"
+	"horizon-sse-go/server"
+	"math/rand"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recordUploadTimeout bounds the upload of one recording.
+const recordUploadTimeout = 5 * time.Minute
+
+// recorder records the upstream streams of /sse requests to files, for a
+// deep server to replay. A nil recorder records nothing.
+type recorder struct {
+	dir      string
+	rate     float64
+	compress bool
+	bucket   *objstore.Bucket // nil to keep recordings local only
+	logger   *logrus.Logger
+
+	recorded     int64
+	failed       int64
+	uploaded     int64
+	uploadFailed int64
+}
+
+// RecordingStats counts the recordings made, those that could not be
+// written, and their uploads.
+type RecordingStats struct {
+	Dir          string  `json:"dir"`
+	Rate         float64 `json:"rate"`
+	Recorded     int64   `json:"recorded"`
+	Failed       int64   `json:"failed"`
+	Uploaded     int64   `json:"uploaded"`
+	UploadFailed int64   `json:"upload_failed"`
+}
+
+// start begins the recording of a stream, if it is picked, or returns nil.
+func (r *recorder) start(h server.RecordingHeader) *server.Recorder {
+	if r == nil || r.rate < 1 && rand.Float64() >= r.rate {
+		return nil
+	}
+	rec, err := server.CreateRecording(r.dir, h, r.compress)
+	if err != nil {
+		atomic.AddInt64(&r.failed, 1)
+		r.logger.WithError(err).WithField("stream_id", h.StreamID).Error("Failed to start recording")
+		return nil
+	}
+	return rec
+}
+
+// finish ends rec, with how its stream ended, and uploads it if a bucket
+// is set.
+func (r *recorder) finish(rec *server.Recorder, ended error) {
+	if rec == nil {
+		return
+	}
+	if err := rec.Close(ended); err != nil {
+		atomic.AddInt64(&r.failed, 1)
+		r.logger.WithError(err).WithField("recording", rec.Path()).Error("Failed to write recording")
+		return
+	}
+	atomic.AddInt64(&r.recorded, 1)
+	if r.bucket == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), recordUploadTimeout)
+		defer cancel()
+		name := filepath.Base(rec.Path())
+		if err := r.bucket.Upload(ctx, name, rec.Path()); err != nil {
+			atomic.AddInt64(&r.uploadFailed, 1)
+			r.logger.WithError(err).Warn("Failed to upload recording")
+			return
+		}
+		atomic.AddInt64(&r.uploaded, 1)
+	}()
+}
+
+// Stats reports the recordings so far.
+func (r *recorder) Stats() *RecordingStats {
+	if r == nil {
+		return nil
+	}
+	return &RecordingStats{
+		Dir:          r.dir,
+		Rate:         r.rate,
+		Recorded:     atomic.LoadInt64(&r.recorded),
+		Failed:       atomic.LoadInt64(&r.failed),
+		Uploaded:     atomic.LoadInt64(&r.uploaded),
+		UploadFailed: atomic.LoadInt64(&r.uploadFailed),
+	}
+}
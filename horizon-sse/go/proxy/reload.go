@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reloadable holds the settings a running proxy can take again, as the
+// fields of Options of the same names: its routing table and rate limits.
+type Reloadable struct {
+	DeepServerURL        string
+	Upstreams            []Upstream
+	Routes               []Route
+	Balancer             Balancer
+	ConnectionRate       float64
+	ConnectionBurst      int
+	ConnectionRatePerIP  float64
+	ConnectionBurstPerIP int
+	BatchRateLimit       float64
+	BatchBurst           int
+}
+
+// Reload replaces the proxy's routing table and rate limits with those of
+// cfg, without touching the streams open: they finish on the backend they
+// were sent to. Backends kept, by name and URL, keep their health and
+// counters, and limits left as they were keep their buckets. If cfg is
+// inconsistent, nothing changes.
+func (s *Proxy) Reload(cfg Reloadable) error {
+	if cfg.BatchRateLimit < 0 || cfg.BatchBurst < 0 {
+		return fmt.Errorf("negative batch rate limit %v or burst %d", cfg.BatchRateLimit, cfg.BatchBurst)
+	}
+	if cfg.ConnectionRate < 0 || cfg.ConnectionBurst < 0 || cfg.ConnectionRatePerIP < 0 || cfg.ConnectionBurstPerIP < 0 {
+		return fmt.Errorf("negative connection rate limit or burst")
+	}
+	if len(cfg.Upstreams) == 0 {
+		cfg.Upstreams = []Upstream{{Name: "default", URL: cfg.DeepServerURL, Weight: 1}}
+	}
+	if cfg.Balancer == nil {
+		cfg.Balancer, _ = NewBalancer(BalanceRoundRobin)
+	}
+	if err := s.upstreams.replace(cfg.Upstreams, cfg.Routes, cfg.Balancer); err != nil {
+		return err
+	}
+	s.connLimits.set(cfg.ConnectionRate, cfg.ConnectionBurst, cfg.ConnectionRatePerIP, cfg.ConnectionBurstPerIP)
+	s.limitsMu.Lock()
+	s.batchLimits = reuseBuckets(s.batchLimits, cfg.BatchRateLimit, cfg.BatchBurst)
+	s.limitsMu.Unlock()
+
+	s.logger.WithFields(logrus.Fields{
+		"upstreams":      len(cfg.Upstreams),
+		"routes":         len(cfg.Routes),
+		"conn_rate":      cfg.ConnectionRate,
+		"conn_rate_ip":   cfg.ConnectionRatePerIP,
+		"batch_rate":     cfg.BatchRateLimit,
+		"active_streams": atomic.LoadInt64(&s.activeConnections),
+	}).Info("Routing and rate limits reloaded")
+	return nil
+}
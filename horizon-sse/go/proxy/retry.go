@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRetryBackoff is the wait before the first retry of an upstream
+// request; it doubles with each one after.
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// retryableStatuses are the upstream answers worth trying again: the
+// backend, or one in front of it, was unavailable rather than the request
+// wrong.
+var retryableStatuses = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// RetryStats counts the upstream requests sent again, the streams that got
+// an answer from a retry, and those whose last retry failed too.
+type RetryStats struct {
+	Retries   int64 `json:"retries"`
+	Recovered int64 `json:"recovered"`
+	Exhausted int64 `json:"exhausted"`
+}
+
+// upstreamRequest is what an upstream request is built from, so that
+// sendUpstream can build it again for another backend.
+type upstreamRequest interface {
+	model() string
+	path() string
+	newRequest(ctx context.Context, baseURL string) (*http.Request, error)
+}
+
+// sendUpstream sends req, the upstream request of a stream or of a unary
+// call, and sends it again while it fails to connect or is answered with a
+// retryable status, up to upstreamRetries times. Each retry goes to a
+// backend picked afresh, one not tried yet if there is one; moved is told
+// when that is another one than the last. Nothing has been sent to the
+// client yet, and the client's body is buffered, so a retry is the same
+// request.
+func (s *Proxy) sendUpstream(client *http.Client, req *http.Request, params upstreamRequest, backend *Backend, moved func(*Backend)) (*http.Response, error) {
+	backoff := s.retryBackoff
+	tried := []*Backend{backend}
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		failed := err != nil || retryableStatuses[resp.StatusCode]
+		if !failed || attempt == s.upstreamRetries || req.Context().Err() != nil {
+			if attempt > 0 && failed {
+				atomic.AddInt64(&s.retriesExhausted, 1)
+			} else if attempt > 0 {
+				atomic.AddInt64(&s.retriesRecovered, 1)
+			}
+			return resp, err
+		}
+
+		fields := logrus.Fields{
+			"stream_id": req.Header.Get("X-Stream-ID"),
+			"upstream":  backend.Name,
+			"attempt":   attempt + 1,
+			"backoff":   backoff,
+		}
+		if err != nil {
+			fields["error"] = err
+		} else {
+			fields["status"] = resp.StatusCode
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+			resp.Body.Close()
+		}
+		s.logger.WithFields(fields).Warn("Upstream request failed, retrying")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		if next := s.upstreams.pick(params.model(), params.path(), tried...); next != backend {
+			backend = next
+			moved(backend)
+			tried = append(tried, backend)
+		}
+		retry, err := params.newRequest(req.Context(), backend.URL)
+		if err != nil {
+			return nil, err
+		}
+		retry.Header = req.Header.Clone()
+		req = retry
+		atomic.AddInt64(&s.retries, 1)
+	}
+}
+
+func (s *Proxy) retryStats() RetryStats {
+	return RetryStats{
+		Retries:   atomic.LoadInt64(&s.retries),
+		Recovered: atomic.LoadInt64(&s.retriesRecovered),
+		Exhausted: atomic.LoadInt64(&s.retriesExhausted),
+	}
+}
@@ -0,0 +1,493 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Upstream is a deep server, or any OpenAI-compatible backend, the proxy
+// can send streams to. Weight only matters to the weighted balancer.
+type Upstream struct {
+	Name   string
+	URL    string
+	Weight int
+}
+
+// ParseUpstream parses an -upstream setting: NAME=URL, optionally followed
+// by ",weight=N".
+func ParseUpstream(spec string) (Upstream, error) {
+	u := Upstream{Weight: 1}
+	fields := strings.Split(spec, ",")
+	name, rawURL, ok := strings.Cut(strings.TrimSpace(fields[0]), "=")
+	if !ok || name == "" {
+		return u, fmt.Errorf("upstream %q: want NAME=URL", spec)
+	}
+	if parsed, err := url.Parse(rawURL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return u, fmt.Errorf("upstream %q: invalid URL %q", spec, rawURL)
+	}
+	u.Name, u.URL = name, strings.TrimSuffix(rawURL, "/")
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		if key != "weight" {
+			return u, fmt.Errorf("upstream %q: unknown option %q", spec, key)
+		}
+		w, err := strconv.Atoi(value)
+		if err != nil || w < 0 {
+			return u, fmt.Errorf("upstream %q: invalid weight %q", spec, value)
+		}
+		u.Weight = w
+	}
+	return u, nil
+}
+
+// Route sends the streams matching it to some of the upstreams. Model and
+// Path match the model requested and the upstream path
+// (/v1/chat/completions, /v1/messages, /v1/embeddings or
+// /v1/moderations); either may end in "*" to match a prefix, and an empty
+// one matches anything.
+type Route struct {
+	Model     string
+	Path      string
+	Upstreams []string
+}
+
+// ParseRoute parses a -route setting: MATCH=NAME[,NAME...], where MATCH is
+// model:PATTERN or path:PATTERN.
+func ParseRoute(spec string) (Route, error) {
+	var r Route
+	match, names, ok := strings.Cut(spec, "=")
+	if !ok {
+		return r, fmt.Errorf("route %q: want MATCH=UPSTREAM[,UPSTREAM...]", spec)
+	}
+	kind, pattern, _ := strings.Cut(strings.TrimSpace(match), ":")
+	switch kind {
+	case "model":
+		r.Model = pattern
+	case "path":
+		r.Path = pattern
+	default:
+		return r, fmt.Errorf("route %q: match on model: or path:", spec)
+	}
+	r.Upstreams = splitNames(names)
+	if len(r.Upstreams) == 0 {
+		return r, fmt.Errorf("route %q: no upstreams", spec)
+	}
+	return r, nil
+}
+
+func splitNames(v string) []string {
+	var out []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func (r Route) matches(model, path string) bool {
+	return matchPattern(r.Model, model) && matchPattern(r.Path, path)
+}
+
+func matchPattern(pattern, v string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(v, prefix)
+	}
+	return pattern == "" || pattern == v
+}
+
+// Backend is an upstream as the proxy runs it, with the streams open to
+// it. Balancers pick among backends.
+type Backend struct {
+	Upstream
+	active   int64
+	requests int64
+
+	// Set by health checks, under upstreamSet.healthMu
+	down       bool
+	failures   int // consecutive failed checks
+	successes  int // consecutive passed checks while down
+	markedUp   int64
+	markedDown int64
+	lastError  string
+}
+
+// Active is the number of streams open to the backend.
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Balancer picks the backend a stream goes to among the candidates its
+// route allows, of which there is at least one.
+type Balancer interface {
+	Pick(candidates []*Backend) *Backend
+}
+
+// The balancers NewBalancer knows.
+const (
+	BalanceRoundRobin  = "round-robin"
+	BalanceLeastActive = "least-active"
+	BalanceWeighted    = "weighted"
+)
+
+// NewBalancer returns the balancer called name.
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", BalanceRoundRobin:
+		return &roundRobin{}, nil
+	case BalanceLeastActive:
+		return &leastActive{}, nil
+	case BalanceWeighted:
+		return &weighted{current: make(map[*Backend]int)}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q (want %s, %s or %s)", name, BalanceRoundRobin, BalanceLeastActive, BalanceWeighted)
+}
+
+type roundRobin struct{ next uint64 }
+
+func (b *roundRobin) Pick(candidates []*Backend) *Backend {
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// leastActive picks the backend with the fewest open streams, taking
+// turns among those tied.
+type leastActive struct{ next uint64 }
+
+func (b *leastActive) Pick(candidates []*Backend) *Backend {
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(len(candidates)))
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		if c := candidates[(start+i)%len(candidates)]; c.Active() < best.Active() {
+			best = c
+		}
+	}
+	return best
+}
+
+// weighted is smooth weighted round-robin: each backend gets its share of
+// streams in proportion to its weight, interleaved rather than in runs.
+// Backends of weight zero only get streams when no other can.
+type weighted struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (b *weighted) Pick(candidates []*Backend) *Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *Backend
+	total := 0
+	for _, c := range candidates {
+		total += c.Weight
+		b.current[c] += c.Weight
+		if best == nil || b.current[c] > b.current[best] {
+			best = c
+		}
+	}
+	if total == 0 {
+		return candidates[0]
+	}
+	b.current[best] -= total
+	return best
+}
+
+// HealthCheck configures the active health checks of upstreams: each is
+// polled at Path every Interval, taken out of rotation after
+// UnhealthyThreshold failed checks in a row and put back after
+// HealthyThreshold passed ones. A zero Interval disables checks.
+type HealthCheck struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	Path               string
+	UnhealthyThreshold int
+	HealthyThreshold   int
+}
+
+// DefaultHealthCheck fills in the fields of a HealthCheck left zero,
+// except Interval.
+var DefaultHealthCheck = HealthCheck{
+	Timeout:            2 * time.Second,
+	Path:               "/health",
+	UnhealthyThreshold: 3,
+	HealthyThreshold:   2,
+}
+
+// upstreamSet routes streams to backends.
+type upstreamSet struct {
+	mu       sync.RWMutex // guards the routing table, which a reload replaces
+	backends []*Backend
+	byName   map[string]*Backend
+	routes   []Route
+	balancer Balancer
+
+	check HealthCheck
+	// transport carries the health checks; http.DefaultTransport if nil
+	transport http.RoundTripper
+
+	healthMu  sync.Mutex
+	failovers int64 // streams sent elsewhere because of a backend down
+}
+
+// BackendStats is a backend as /metrics reports it.
+type BackendStats struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Weight     int    `json:"weight"`
+	Healthy    bool   `json:"healthy"`
+	Active     int64  `json:"active_streams"`
+	Requests   int64  `json:"requests"`
+	MarkedDown int64  `json:"marked_down"`
+	MarkedUp   int64  `json:"marked_up"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// UpstreamStats are the backends and the streams that failed over from a
+// backend out of rotation.
+type UpstreamStats struct {
+	Backends  []BackendStats `json:"backends"`
+	Failovers int64          `json:"failovers"`
+}
+
+func newUpstreamSet(upstreams []Upstream, routes []Route, balancer Balancer, check HealthCheck) (*upstreamSet, error) {
+	def := DefaultHealthCheck
+	if check.Timeout <= 0 {
+		check.Timeout = def.Timeout
+	}
+	if check.Path == "" {
+		check.Path = def.Path
+	}
+	if check.UnhealthyThreshold <= 0 {
+		check.UnhealthyThreshold = def.UnhealthyThreshold
+	}
+	if check.HealthyThreshold <= 0 {
+		check.HealthyThreshold = def.HealthyThreshold
+	}
+	set := &upstreamSet{check: check}
+	if err := set.replace(upstreams, routes, balancer); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// replace swaps in a new routing table. A backend of the same name and URL
+// as one already running is kept, with its open streams and health, and
+// takes its new weight; streams open to a backend dropped finish there.
+func (s *upstreamSet) replace(upstreams []Upstream, routes []Route, balancer Balancer) error {
+	if len(upstreams) == 0 {
+		return fmt.Errorf("no upstreams")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backends := make([]*Backend, 0, len(upstreams))
+	byName := make(map[string]*Backend, len(upstreams))
+	for _, u := range upstreams {
+		if _, dup := byName[u.Name]; dup {
+			return fmt.Errorf("upstream %q defined twice", u.Name)
+		}
+		b := &Backend{Upstream: u}
+		if old := s.byName[u.Name]; old != nil && old.URL == u.URL {
+			b = old
+		}
+		backends = append(backends, b)
+		byName[u.Name] = b
+	}
+	for _, r := range routes {
+		for _, name := range r.Upstreams {
+			if _, ok := byName[name]; !ok {
+				return fmt.Errorf("route to unknown upstream %q", name)
+			}
+		}
+	}
+	for _, u := range upstreams {
+		byName[u.Name].Weight = u.Weight
+	}
+	s.backends, s.byName, s.routes, s.balancer = backends, byName, routes, balancer
+	return nil
+}
+
+// list returns the backends.
+func (s *upstreamSet) list() []*Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backends
+}
+
+// lookup returns the backend called name, or nil.
+func (s *upstreamSet) lookup(name string) *Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byName[name]
+}
+
+// primary is the URL of the first backend, the deep server when there is
+// only the one.
+func (s *upstreamSet) primary() string {
+	return s.list()[0].URL
+}
+
+// pick chooses the backend for a stream of model to path: among those of
+// the first route that matches, or all of them. Backends out of rotation
+// are skipped, unless all of the route's are: then trying one beats
+// refusing the stream. So are those in avoid, which a retry has already
+// tried, while there are others.
+func (s *upstreamSet) pick(model, path string, avoid ...*Backend) *Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	candidates := s.backends
+	for _, r := range s.routes {
+		if r.matches(model, path) {
+			candidates = make([]*Backend, len(r.Upstreams))
+			for i, name := range r.Upstreams {
+				candidates[i] = s.byName[name]
+			}
+			break
+		}
+	}
+	if healthy := s.healthy(candidates); len(healthy) > 0 && len(healthy) < len(candidates) {
+		atomic.AddInt64(&s.failovers, 1)
+		candidates = healthy
+	}
+	if len(avoid) > 0 {
+		untried := make([]*Backend, 0, len(candidates))
+		for _, b := range candidates {
+			if !slices.Contains(avoid, b) {
+				untried = append(untried, b)
+			}
+		}
+		if len(untried) > 0 {
+			candidates = untried
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	return s.balancer.Pick(candidates)
+}
+
+// healthy returns the candidates in rotation.
+func (s *upstreamSet) healthy(candidates []*Backend) []*Backend {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	out := make([]*Backend, 0, len(candidates))
+	for _, b := range candidates {
+		if !b.down {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// runHealthChecks polls every backend until ctx is done, if checks are
+// enabled.
+func (s *upstreamSet) runHealthChecks(ctx context.Context, logger *logrus.Logger) {
+	if s.check.Interval <= 0 {
+		return
+	}
+	client := &http.Client{Timeout: s.check.Timeout, Transport: s.transport}
+	ticker := time.NewTicker(s.check.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range s.list() {
+			wg.Add(1)
+			go func(b *Backend) {
+				defer wg.Done()
+				s.observeHealth(b, s.probe(ctx, client, b), logger)
+			}(b)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks one backend, returning why it failed, if it did.
+func (s *upstreamSet) probe(ctx context.Context, client *http.Client, b *Backend) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.URL+s.check.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// observeHealth counts a check of b and moves it in or out of rotation
+// once enough checks in a row agree.
+func (s *upstreamSet) observeHealth(b *Backend, err error, logger *logrus.Logger) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	fields := logrus.Fields{"upstream": b.Name, "url": b.URL}
+	if err != nil {
+		b.lastError = err.Error()
+		b.successes = 0
+		if b.failures++; !b.down && b.failures >= s.check.UnhealthyThreshold {
+			b.down = true
+			b.markedDown++
+			logger.WithFields(fields).WithError(err).Warn("Upstream failed its health checks, taking it out of rotation")
+		}
+		return
+	}
+	b.failures = 0
+	if !b.down {
+		return
+	}
+	if b.successes++; b.successes >= s.check.HealthyThreshold {
+		b.down = false
+		b.successes = 0
+		b.markedUp++
+		logger.WithFields(fields).Info("Upstream passed its health checks, putting it back in rotation")
+	}
+}
+
+// open counts a stream to b until the returned func is called.
+func (b *Backend) open() func() {
+	atomic.AddInt64(&b.requests, 1)
+	atomic.AddInt64(&b.active, 1)
+	return func() { atomic.AddInt64(&b.active, -1) }
+}
+
+func (s *upstreamSet) Stats() UpstreamStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	stats := UpstreamStats{
+		Backends:  make([]BackendStats, len(s.backends)),
+		Failovers: atomic.LoadInt64(&s.failovers),
+	}
+	for i, b := range s.backends {
+		stats.Backends[i] = BackendStats{
+			Name:       b.Name,
+			URL:        b.URL,
+			Weight:     b.Weight,
+			Healthy:    !b.down,
+			Active:     b.Active(),
+			Requests:   atomic.LoadInt64(&b.requests),
+			MarkedDown: b.markedDown,
+			MarkedUp:   b.markedUp,
+			LastError:  b.lastError,
+		}
+	}
+	return stats
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"horizon-sse-go/streamio"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SlowClientStats is how the proxy deals with slow clients, how many it
+// has cut off, by running into the write deadline or by falling a full
+// pump buffer behind under streamio.OverflowDisconnect, and how many events
+// the drop policies have dropped.
+type SlowClientStats struct {
+	Policy          streamio.Overflow `json:"policy"`
+	WriteDeadlineMs float64           `json:"write_deadline_ms"`
+	Terminated      int64             `json:"terminated"`
+	TimedOut        int64             `json:"timed_out"`
+	Overrun         int64             `json:"overrun"`
+	DroppedEvents   int64             `json:"dropped_events"`
+}
+
+func (s *Proxy) slowClientStats() SlowClientStats {
+	timedOut := atomic.LoadInt64(&s.slowClientTimeouts)
+	overrun := atomic.LoadInt64(&s.slowClientOverruns)
+	buffers := s.streamBuffers.Stats()
+	return SlowClientStats{
+		Policy:          s.slowClientPolicy,
+		WriteDeadlineMs: float64(s.writeDeadline) / float64(time.Millisecond),
+		Terminated:      timedOut + overrun,
+		TimedOut:        timedOut,
+		Overrun:         overrun,
+		DroppedEvents:   buffers.Dropped,
+	}
+}
+
+// dropSlowClient ends a stream whose client is too slow to be served: it
+// ran into the write deadline, or, if overrun, fell behind past the pump
+// buffer. An overrun client's connection is dropped, so it sees the
+// stream break off rather than end.
+func (s *Proxy) dropSlowClient(clientID, streamID string, overrun bool) {
+	reason := "write_deadline"
+	if overrun {
+		reason = "overrun"
+		atomic.AddInt64(&s.slowClientOverruns, 1)
+	} else {
+		atomic.AddInt64(&s.slowClientTimeouts, 1)
+	}
+	atomic.AddInt64(&s.failedConnections, 1)
+	s.logger.WithFields(logrus.Fields{
+		"client_id": clientID,
+		"stream_id": streamID,
+		"reason":    reason,
+	}).Warn("Disconnecting slow client")
+	if overrun {
+		panic(http.ErrAbortHandler)
+	}
+}
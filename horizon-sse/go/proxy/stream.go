@@ -0,0 +1,1068 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"horizon-sse-go/server"
+	"horizon-sse-go/streamio"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func (s *Proxy) handleSSEProxy(w http.ResponseWriter, r *http.Request) {
+	deadline := server.NewDeadlineWriter(w, s.writeDeadline)
+	w, stopHeartbeat := s.heartbeats.Wrap(deadline)
+	defer stopHeartbeat()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+	clearWriteDeadline(w)
+	summary := streamSummaryFor(r)
+
+	if streams := r.URL.Query().Get("streams"); streams != "" {
+		summary.note("joined_streams", splitList(streams))
+		s.handleJoinedStreams(w, r, flusher, splitList(streams))
+		if r.Context().Err() == nil {
+			summary.end(streamCompleted, nil)
+		}
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	// Only a client that names itself can come back for its stream
+	resumable := clientID != ""
+	if clientID == "" {
+		clientID = fmt.Sprintf("proxy-client-%d", time.Now().UnixNano())
+	}
+	streamID := r.URL.Query().Get("stream_id")
+	if streamID == "" {
+		streamID = fmt.Sprintf("stream-%d", time.Now().UnixNano())
+	}
+	summary.identify(clientID, streamID)
+
+	params, err := parseUpstreamParams(r.URL.Query())
+	if err == nil && s.upstreamProtocol == UpstreamGRPC && params.dialect != "openai" {
+		err = fmt.Errorf("dialect %q is not served by gRPC upstreams", params.dialect)
+	}
+	if err == nil && r.Method == http.MethodPost {
+		// Refused on its declared length, a body is never sent by a client
+		// waiting for 100 Continue, which is only sent once it is read
+		if r.ContentLength > s.maxRequestBytes {
+			s.noteOversizedBody(r)
+			err = fmt.Errorf("request body larger than %d bytes: %w", s.maxRequestBytes, &http.MaxBytesError{Limit: s.maxRequestBytes})
+		} else {
+			err = params.readBody(r, s.maxRequestBytes, s.bodies)
+		}
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+	defer params.closeBody()
+	s.logPayload(r, streamID, params.body)
+
+	// Ordering is checked on the events as the upstream sent them, and
+	// rechunking comes before patches so they carry the regrouped text
+	var transforms []eventTransform
+	if s.sequencing == "flag" || s.sequencing == "repair" {
+		transforms = append(transforms, s.newSequenceStream(s.sequencing == "repair"))
+	}
+	if s.rechunk.For("/sse") == server.RechunkMarkdown {
+		transforms = append(transforms, newRechunkStream(s.rechunkMaxHold))
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "raw":
+	case "patch":
+		transforms = append(transforms, newPatchStream(s.patchSnapshotEvery))
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+
+	stream, ok := s.trackStream(clientID, requestOwner(r), streamID, streamControlFor(r))
+	if !ok {
+		http.Error(w, fmt.Sprintf("stream %q is already active", streamID), http.StatusConflict)
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+	defer s.untrackStream(stream)
+
+	if !s.connQueue.acquire(r.Context()) {
+		if r.Context().Err() == nil {
+			s.shed(w, "connections")
+			summary.end(streamShed, nil)
+		}
+		return
+	}
+	atomic.AddInt64(&s.totalConnections, 1)
+	defer s.connQueue.release()
+
+	tenant := server.TenantOf(r)
+	usage := s.usage.Start(tenant)
+	defer usage.Finish()
+
+	summary.note("model", params.model())
+
+	// Set SSE headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("X-Stream-ID", streamID)
+
+	var replay *server.ReplayLog
+	if resumable {
+		if lastID := r.Header.Get("Last-Event-ID"); lastID != "" && s.resume(w, r, flusher, clientID, lastID) {
+			summary.end(streamResumed, nil)
+			return
+		}
+		replay = s.replay.Open(replayKey(r, clientID))
+	}
+
+	// Past this point the request is valid, so the client can be told it
+	// is connected before the upstream answers. Failures are then reported
+	// in error events, since the 200 is out.
+	early := s.earlyFlush != EarlyFlushOff || r.URL.Query().Get("flush_headers") == "true"
+	if early {
+		s.writeConnected(w, flusher, streamID)
+	}
+
+	// Create request to deep server. It may stream for as long as the
+	// upstream keeps sending, but not stall for longer than the timeout.
+	upstreamCtx, idleBody, cancelUpstream := withIdleTimeout(r.Context(), params.timeout())
+	defer cancelUpstream()
+	backend := s.upstreams.pick(params.model(), params.path())
+	summary.sentTo(backend.Name)
+	deepReq, err := params.newRequest(upstreamCtx, backend.URL)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to create deep server request")
+		summary.end(streamConnectFailed, err)
+		s.failStream(w, flusher, early, http.StatusInternalServerError, "Failed to connect to deep server")
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+
+	// Lets the upstream, and /debug/streams, correlate its side of the
+	// stream with ours
+	deepReq.Header.Set("X-Stream-ID", streamID)
+	deepReq.Header.Set(server.TenantHeader, tenant)
+	if user := jwtUser(r); user != "" {
+		deepReq.Header.Set(UserHeader, user)
+	}
+
+	client := &http.Client{Transport: s.upstreamTransport}
+	closeBackend := func() {}
+	defer func() { closeBackend() }()
+	// Retries may move the stream to another backend
+	moved := func(b *Backend) {
+		closeBackend()
+		closeBackend = b.open()
+		summary.sentTo(b.Name)
+		s.streamsMu.Lock()
+		stream.backend = b
+		s.streamsMu.Unlock()
+	}
+	send := func(req *http.Request) (*http.Response, error) {
+		return s.sendUpstream(client, req, params, backend, moved)
+	}
+
+	// An identical request already streaming within the coalescing window
+	// is shared instead of sending another upstream
+	var group *coalesceGroup
+	joined := false
+	if s.coalescer != nil {
+		if key, err := coalesceKey(deepReq); err == nil {
+			group, joined = s.coalescer.join(key)
+		}
+	}
+	if !joined {
+		if !admit(&s.upstreamInFlight, s.maxUpstreamInFlight) {
+			if group != nil {
+				group.finish(nil, errCoalescedShed)
+				group.leave()
+			}
+			s.shedStream(w, flusher, early, "upstream_inflight")
+			summary.end(streamShed, nil)
+			return
+		}
+		defer atomic.AddInt64(&s.upstreamInFlight, -1)
+		moved(backend)
+	}
+
+	var resp *http.Response
+	sentAt := time.Now()
+	if group == nil {
+		resp, err = send(deepReq)
+	} else {
+		if !joined {
+			group.start(send, deepReq)
+		} else {
+			summary.note("coalesced", true)
+			s.logger.WithFields(logrus.Fields{
+				"stream_id": streamID,
+				"group":     group.key[:12],
+			}).Info("Coalescing stream with an identical upstream request")
+		}
+		resp, err = group.response(upstreamCtx)
+	}
+	if errors.Is(err, errCoalescedShed) {
+		s.shedStream(w, flusher, early, "upstream_inflight")
+		summary.end(streamShed, nil)
+		return
+	}
+	if err != nil {
+		if r.Context().Err() == nil {
+			summary.end(streamConnectFailed, err)
+		}
+		s.logger.WithError(err).Error("Failed to connect to deep server")
+		s.failStream(w, flusher, early, http.StatusBadGateway, "Failed to connect to deep server")
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+	resp.Body = idleBody(resp.Body)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		summary.note("upstream_status", resp.StatusCode)
+		summary.end(streamUpstreamStatus, nil)
+		s.writeUpstreamError(w, flusher, "/sse", streamID, resp, early)
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+
+	charset, err := s.checkUpstreamContentType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"stream_id":    streamID,
+			"content_type": resp.Header.Get("Content-Type"),
+			"body_prefix":  bodyPrefix(resp.Body),
+		}).WithError(err).Error("Deep server did not return an event stream")
+		summary.end(streamUpstreamError, err)
+		s.failStream(w, flusher, early, http.StatusBadGateway, "Bad gateway: "+err.Error())
+		atomic.AddInt64(&s.contentTypeErrors, 1)
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+
+	for name, values := range resp.Header {
+		if s.forwardHeaders.allows(name) {
+			w.Header()[name] = values
+		}
+	}
+	var trailers []string
+	for name := range resp.Trailer {
+		if s.forwardTrailers.allows(name) {
+			trailers = append(trailers, name)
+			w.Header().Add("Trailer", name)
+		}
+	}
+	// Headers sent early could not announce the trailers, so they go out
+	// unannounced
+	trailerPrefix := ""
+	if early {
+		trailerPrefix = http.TrailerPrefix
+	}
+
+	// Clients always get UTF-8, whatever the upstream sends
+	body, _ := server.NewUTF8Reader(resp.Body, charset)
+	if !server.IsUTF8Charset(charset) {
+		s.recordTranscoded(charset)
+		s.logger.WithFields(logrus.Fields{
+			"stream_id": streamID,
+			"charset":   charset,
+		}).Info("Transcoding upstream stream to UTF-8")
+	}
+
+	// Requests sharing a coalesced upstream request leave its recording
+	// to the one that sent it
+	var recording *server.Recorder
+	if !joined {
+		s.streamsMu.Lock()
+		upstream := stream.backend.Name
+		s.streamsMu.Unlock()
+		recording = s.recorder.start(server.RecordingHeader{
+			StreamID: streamID,
+			Path:     params.path(),
+			Model:    params.model(),
+			Upstream: upstream,
+			Started:  sentAt,
+		})
+	}
+
+	// Forward the stream event by event while the pump keeps reading
+	pump := s.startPump(r.Context(), body, recording)
+	defer pump.events.Close()
+
+	// If the client goes away, time how long it takes to tear down the
+	// upstream request. The request shares the client's context, so the
+	// transport cancels it; a failed write counts as the client leaving too.
+	var clientGone int64
+	markGone := func() { atomic.CompareAndSwapInt64(&clientGone, 0, time.Now().UnixNano()) }
+	stopWatching := context.AfterFunc(r.Context(), markGone)
+	defer func() {
+		stopWatching()
+		if r.Context().Err() == nil && atomic.LoadInt64(&clientGone) == 0 {
+			return
+		}
+		resp.Body.Close()
+		pump.stop()
+		markGone()
+		s.recordAbort(stream, time.Unix(0, atomic.LoadInt64(&clientGone)), time.Now())
+	}()
+	buffer := s.bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		buffer.Reset()
+		s.bufferPool.Put(buffer)
+	}()
+
+	messageCount := 0
+	ids := s.eventIDs.For("/sse").NewGenerator()
+	var traceFlush string // the trace of the last flush, sent with the next batch
+	var flushes server.StreamFlushes
+	flush := func() {
+		d, slow := s.flushes.Flush(flusher)
+		if flushes.Record(d, slow) {
+			s.logger.WithFields(logrus.Fields{
+				"client_id": clientID,
+				"stream_id": streamID,
+				"flush_ms":  d.Milliseconds(),
+			}).Warn("Slow flush to client")
+		}
+	}
+	var readErr error // how the pump ended: io.EOF, an upstream error or an overrun
+	// Why the proxy, rather than the upstream, ended the stream, if it did.
+	// A coalesced request may still serve others, so it is left alone.
+	cancelReason := ""
+	defer func() {
+		summary.note("pump_stalls", pump.events.Stalls())
+		summary.note("dropped_events", pump.events.Dropped())
+		summary.note("slow_flushes", flushes.Slow)
+		summary.note("slowest_flush_ms", flushes.Slowest.Milliseconds())
+		switch {
+		case cancelReason != "":
+			summary.end(cancelReason, nil)
+		case r.Context().Err() != nil || atomic.LoadInt64(&clientGone) != 0:
+			summary.end(s.clientGoneReason(), nil)
+		}
+	}()
+	defer func() {
+		if group != nil || readErr == io.EOF {
+			return
+		}
+		if cancelReason == "" && (r.Context().Err() != nil || atomic.LoadInt64(&clientGone) != 0) {
+			cancelReason = s.clientGoneReason()
+		}
+		if cancelReason != "" {
+			s.reportCancel(stream, cancelReason)
+		}
+	}()
+forward:
+	for readErr == nil {
+		buffer.Reset()
+		buffer.WriteString(traceFlush)
+		commanded, paused, cancelled := stream.control.state()
+		if cancelled {
+			cancelReason = server.CancelClientCommand
+			return
+		}
+		// A paused stream leaves its events in the pump's buffer, so only
+		// the client leaving or a command ends its wait
+		ready, gone := pump.events.Ready(), (<-chan struct{})(nil)
+		if paused {
+			ready, gone = nil, r.Context().Done()
+		}
+		select {
+		case <-ready:
+			// Coalesce events that are already queued into the same flush
+			taken := 0
+			for {
+				ev, ok, err := pump.events.TryGet()
+				if !ok {
+					readErr = err
+					break
+				}
+				if !stream.control.allows(ev) {
+					continue
+				}
+				n := s.forwardEvent(buffer, ev, ids, replay, transforms)
+				messageCount += n
+				CountMessages(r, n)
+				summary.delivered(n)
+				s.mirrorEvent(stream, ev)
+				taken++
+			}
+			if taken == 0 {
+				continue forward
+			}
+		case notice := <-stream.notices:
+			buffer.WriteString(notice.Format())
+		case <-commanded:
+			continue forward
+		case <-gone:
+			return
+		}
+
+		writeAt := time.Now()
+		n, err := w.Write(buffer.Bytes())
+		usage.AddBytes(n)
+		summary.wrote(n)
+		if err != nil {
+			markGone()
+			if deadline.TimedOut() {
+				cancelReason = server.CancelSlowClient
+				s.dropSlowClient(clientID, streamID, false)
+				return
+			}
+			s.logger.WithFields(logrus.Fields{
+				"client_id":         clientID,
+				"error":             err,
+				"write_error_class": s.writeErrors.Record(err),
+			}).Error("Failed to write to client")
+			atomic.AddInt64(&s.failedConnections, 1)
+			return
+		}
+		flush()
+		if deadline.TimedOut() {
+			markGone()
+			cancelReason = server.CancelSlowClient
+			s.dropSlowClient(clientID, streamID, false)
+			return
+		}
+		if s.traceEvents {
+			traceFlush = server.FormatFlushTrace(writeAt, time.Now())
+		}
+	}
+
+	if readErr == streamio.ErrOverflow {
+		markGone()
+		cancelReason = server.CancelSlowClient
+		s.dropSlowClient(clientID, streamID, true)
+	}
+
+	// The upstream may end without a final event, with events still held
+	buffer.Reset()
+	buffer.WriteString(traceFlush)
+	held := s.flushTransforms(buffer, ids, replay, transforms)
+	messageCount += held
+	CountMessages(r, held)
+	summary.delivered(held)
+	if buffer.Len() > 0 && r.Context().Err() == nil {
+		writeAt := time.Now()
+		n, _ := w.Write(buffer.Bytes())
+		usage.AddBytes(n)
+		summary.wrote(n)
+		flush()
+		if s.traceEvents && buffer.Len() > len(traceFlush) {
+			n, _ := io.WriteString(w, server.FormatFlushTrace(writeAt, time.Now()))
+			usage.AddBytes(n)
+			summary.wrote(n)
+			flusher.Flush()
+		}
+	}
+
+	if readErr != io.EOF {
+		if cause := context.Cause(upstreamCtx); cause != context.Canceled && cause != nil {
+			readErr = cause
+			cancelReason = server.CancelUpstreamIdle
+		}
+		if cancelReason != "" || r.Context().Err() != nil || atomic.LoadInt64(&clientGone) != 0 {
+			summary.end(cancelReason, readErr)
+		} else {
+			summary.end(streamUpstreamError, readErr)
+		}
+		atomic.AddInt64(&s.failedConnections, 1)
+		if r.Context().Err() == nil {
+			// The 200 is out already, so the only way left to tell the
+			// client the stream broke off is an event
+			s.writeErrorEvent(w, flusher, server.UpstreamError{Message: "Upstream stream interrupted"})
+		}
+		return
+	}
+
+	if len(trailers) > 0 {
+		// Trailers only arrive once the upstream body has been read to EOF
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		for _, name := range trailers {
+			w.Header()[trailerPrefix+name] = resp.Trailer[name]
+		}
+	}
+	replay.Finish()
+	summary.end(streamCompleted, nil)
+}
+
+// resume answers a client reconnecting with Last-Event-ID to a stream the
+// proxy still holds. Its upstream request ended with the client's
+// connection, so the client is sent the events it missed and, if the
+// stream had not finished, told that it broke off. A stream answered in
+// full gets a 204, which tells EventSource clients to stop reconnecting.
+// It returns false if the stream is not buffered, for a new one instead.
+func (s *Proxy) resume(w http.ResponseWriter, r *http.Request, flusher http.Flusher, clientID, lastID string) bool {
+	replay, missed, ok := s.replay.Resume(replayKey(r, clientID), lastID)
+	if !ok {
+		return false
+	}
+	if len(missed) == 0 && replay.Done() {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	for _, ev := range missed {
+		io.WriteString(w, ev.Text)
+	}
+	flusher.Flush()
+	if !replay.Done() {
+		s.writeErrorEvent(w, flusher, server.UpstreamError{Message: "Upstream stream interrupted"})
+		// Reconnecting again has nothing more to offer
+		replay.Finish()
+	}
+	s.logger.WithFields(logrus.Fields{
+		"client_id":     clientID,
+		"last_event_id": lastID,
+		"replayed":      len(missed),
+	}).Info("Client resumed stream")
+	return true
+}
+
+// checkUpstreamContentType accepts the configured media types in UTF-8 or
+// a charset the proxy can transcode, and returns the charset.
+func (s *Proxy) checkUpstreamContentType(contentType string) (string, error) {
+	if contentType == "" {
+		return "", fmt.Errorf("upstream response has no Content-Type")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("upstream response has an invalid Content-Type %q", contentType)
+	}
+	allowed := false
+	for _, t := range s.upstreamTypes {
+		if strings.EqualFold(t, mediaType) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("upstream returned %s instead of an event stream", mediaType)
+	}
+	charset := strings.ToLower(params["charset"])
+	if _, err := server.NewUTF8Reader(nil, charset); err != nil {
+		return "", fmt.Errorf("upstream charset %q is not supported", charset)
+	}
+	return charset, nil
+}
+
+func (s *Proxy) recordTranscoded(charset string) {
+	s.transcodedMu.Lock()
+	s.transcoded[charset]++
+	s.transcodedMu.Unlock()
+}
+
+func (s *Proxy) transcodedSnapshot() map[string]int64 {
+	s.transcodedMu.Lock()
+	defer s.transcodedMu.Unlock()
+	snapshot := make(map[string]int64, len(s.transcoded))
+	for charset, n := range s.transcoded {
+		snapshot[charset] = n
+	}
+	return snapshot
+}
+
+// maxErrorBody bounds the upstream error body read for passthrough.
+const maxErrorBody = 4096
+
+// writeConnected opens a stream before the upstream answers: the 200, the
+// headers and a notice that the stream is waiting for the model, as a
+// comment or, in EarlyFlushEvent mode, a "meta" event.
+func (s *Proxy) writeConnected(w http.ResponseWriter, flusher http.Flusher, streamID string) {
+	atomic.AddInt64(&s.earlyFlushes, 1)
+	w.WriteHeader(http.StatusOK)
+	if s.earlyFlush == EarlyFlushEvent {
+		data, _ := json.Marshal(map[string]string{"stream_id": streamID, "state": "waiting_for_upstream"})
+		io.WriteString(w, server.Event{Type: "meta", Data: string(data)}.Format())
+	} else {
+		io.WriteString(w, ": connected, waiting for upstream\n\n")
+	}
+	flusher.Flush()
+}
+
+// failStream refuses a stream with status, or, if its headers were sent
+// early, ends it with an error event carrying the status.
+func (s *Proxy) failStream(w http.ResponseWriter, flusher http.Flusher, early bool, status int, message string) {
+	if early {
+		s.writeErrorEvent(w, flusher, server.UpstreamError{Status: status, Message: message})
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// shedStream is shed for a stream whose headers may have been sent early.
+func (s *Proxy) shedStream(w http.ResponseWriter, flusher http.Flusher, early bool, resource string) {
+	if !early {
+		s.shed(w, resource)
+		return
+	}
+	s.noteShed(resource)
+	s.failStream(w, flusher, early, http.StatusServiceUnavailable, "Proxy at capacity")
+}
+
+// noteOversizedBody counts a POST refused on its Content-Length, and those
+// of them whose client waited for 100 Continue and so never sent the body.
+func (s *Proxy) noteOversizedBody(r *http.Request) {
+	atomic.AddInt64(&s.oversizedBodies, 1)
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		atomic.AddInt64(&s.continueRefused, 1)
+	}
+}
+
+// writeUpstreamError answers a client whose upstream request failed with an
+// error status, as the route's error mode says; flusher is nil for unary
+// calls. The full body is only logged; clients see it in passthrough mode,
+// and then redacted.
+func (s *Proxy) writeUpstreamError(w http.ResponseWriter, flusher http.Flusher, route, streamID string, resp *http.Response, early bool) {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	mode := s.upstreamErrors.For(route)
+	if mode == server.ErrorsSSE && flusher == nil {
+		// A unary call has no stream to carry the event
+		mode = server.ErrorsPassthrough
+	}
+	s.logger.WithFields(logrus.Fields{
+		"stream_id":   streamID,
+		"status":      resp.StatusCode,
+		"error_mode":  mode,
+		"body_prefix": string(body[:min(len(body), 512)]),
+	}).Error("Deep server returned error")
+
+	s.statusMu.Lock()
+	s.upstreamStatuses[strconv.Itoa(resp.StatusCode)]++
+	s.statusMu.Unlock()
+
+	if early {
+		// The 200 is out, so every mode becomes an error event, as much
+		// of the status as the mode would have passed on
+		upstreamErr := server.UpstreamError{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		switch mode {
+		case server.ErrorsGeneric:
+			status := server.ClientStatus(resp.StatusCode)
+			upstreamErr = server.UpstreamError{Status: status, Message: http.StatusText(status)}
+		case server.ErrorsPassthrough, server.ErrorsSSE:
+		default:
+			upstreamErr = server.UpstreamError{Status: http.StatusBadGateway, Message: "Deep server error"}
+		}
+		s.writeErrorEvent(w, flusher, upstreamErr)
+		return
+	}
+
+	// Backoff hints are useful to clients and reveal nothing
+	if retry := resp.Header.Get("Retry-After"); retry != "" && mode != server.ErrorsGateway {
+		w.Header().Set("Retry-After", retry)
+	}
+
+	switch mode {
+	case server.ErrorsGeneric:
+		status := server.ClientStatus(resp.StatusCode)
+		http.Error(w, http.StatusText(status), status)
+	case server.ErrorsPassthrough:
+		contentType := resp.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(resp.StatusCode)
+		w.Write([]byte(s.redactor.Redact(string(body))))
+	case server.ErrorsSSE:
+		s.writeErrorEvent(w, flusher, server.UpstreamError{
+			Status:  resp.StatusCode,
+			Message: http.StatusText(resp.StatusCode),
+		})
+	default:
+		http.Error(w, "Deep server error", http.StatusBadGateway)
+	}
+}
+
+// writeErrorEvent sends an error event on a stream, which opens it with a
+// 200 if nothing has been written yet.
+func (s *Proxy) writeErrorEvent(w http.ResponseWriter, flusher http.Flusher, upstreamErr server.UpstreamError) {
+	if _, err := io.WriteString(w, upstreamErr.Event().Format()); err != nil {
+		return
+	}
+	flusher.Flush()
+	atomic.AddInt64(&s.streamErrorEvents, 1)
+}
+
+func (s *Proxy) upstreamStatusSnapshot() map[string]int64 {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	snapshot := make(map[string]int64, len(s.upstreamStatuses))
+	for status, n := range s.upstreamStatuses {
+		snapshot[status] = n
+	}
+	return snapshot
+}
+
+// bodyPrefix reads the start of an unexpected upstream body for logging.
+func bodyPrefix(body io.Reader) string {
+	prefix, _ := io.ReadAll(io.LimitReader(body, 512))
+	return string(prefix)
+}
+
+// activeStream is the handle the proxy keeps on each client stream so it
+// can inject events, such as migration hints, that did not come from the
+// upstream. Other clients can join the stream by its id.
+type activeStream struct {
+	id        string
+	clientID  string
+	owner     string // of the request, as requestOwner names it
+	notices   chan server.Event
+	control   *streamControl
+	startedAt time.Time
+	backend   *Backend // set under streamsMu unless coalesced
+
+	// Set under streamsMu once the stream is over. clientGoneAt and
+	// upstreamClosedAt are only set if the client left early.
+	endedAt          time.Time
+	clientGoneAt     time.Time
+	upstreamClosedAt time.Time
+}
+
+// trackStream registers a stream under id, taking commands through
+// control from owner. It fails if a stream with that id is still running.
+func (s *Proxy) trackStream(clientID, owner, id string, control *streamControl) (*activeStream, bool) {
+	stream := &activeStream{id: id, clientID: clientID, owner: owner, notices: make(chan server.Event, 1), control: control, startedAt: time.Now()}
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if _, ok := s.streamsByID[id]; ok {
+		return nil, false
+	}
+	control.mu.Lock()
+	control.streamID = id
+	control.mu.Unlock()
+	s.streams[stream] = struct{}{}
+	s.streamsByID[id] = stream
+	return stream, true
+}
+
+func (s *Proxy) untrackStream(stream *activeStream) {
+	s.streamsMu.Lock()
+	delete(s.streams, stream)
+	delete(s.streamsByID, stream.id)
+	stream.endedAt = time.Now()
+	s.finishedByID[stream.id] = stream
+	s.finishedStreams = append(s.finishedStreams, stream)
+	if len(s.finishedStreams) > finishedStreamsKept {
+		oldest := s.finishedStreams[0]
+		s.finishedStreams = s.finishedStreams[1:]
+		if s.finishedByID[oldest.id] == oldest {
+			delete(s.finishedByID, oldest.id)
+		}
+	}
+	s.streamsMu.Unlock()
+
+	// Closed after the stream is gone, so a client that joins now is
+	// either refused or sees the end
+	s.hub.CloseTopic(streamTopicPrefix + stream.id)
+}
+
+// recordAbort notes that the client of stream left at gone and that the
+// upstream request was gone by closed.
+func (s *Proxy) recordAbort(stream *activeStream, gone, closed time.Time) {
+	s.streamsMu.Lock()
+	stream.clientGoneAt = gone
+	stream.upstreamClosedAt = closed
+	s.streamsMu.Unlock()
+
+	atomic.AddInt64(&s.clientAborts, 1)
+	s.abortPropagation.Observe(closed.Sub(gone))
+	s.logger.WithFields(logrus.Fields{
+		"client_id":      stream.clientID,
+		"stream_id":      stream.id,
+		"propagation_ms": float64(closed.Sub(gone)) / float64(time.Millisecond),
+	}).Info("Client aborted, upstream request cancelled")
+}
+
+// streamReport is the body of /debug/streams/{id}. Upstream is the deep
+// server's view of the same stream; UpstreamPropagationMs compares its end
+// with the moment the client left, which is only meaningful when both
+// processes share a clock.
+type streamReport struct {
+	ID                    string          `json:"id"`
+	ClientID              string          `json:"client_id"`
+	Active                bool            `json:"active"`
+	Backend               string          `json:"backend,omitempty"`
+	StartedAt             time.Time       `json:"started_at"`
+	EndedAt               *time.Time      `json:"ended_at,omitempty"`
+	ClientAborted         bool            `json:"client_aborted"`
+	ClientGoneAt          *time.Time      `json:"client_gone_at,omitempty"`
+	UpstreamClosedAt      *time.Time      `json:"upstream_closed_at,omitempty"`
+	PropagationMs         float64         `json:"propagation_ms,omitempty"`
+	Upstream              *upstreamReport `json:"upstream,omitempty"`
+	UpstreamPropagationMs float64         `json:"upstream_propagation_ms,omitempty"`
+}
+
+// upstreamReport holds the fields of the deep server's /debug/streams/{id}
+// the proxy relies on.
+type upstreamReport struct {
+	Active       bool       `json:"active"`
+	Outcome      string     `json:"outcome,omitempty"`
+	EndedAt      *time.Time `json:"ended_at,omitempty"`
+	CancelReason string     `json:"cancel_reason,omitempty"`
+}
+
+func (s *Proxy) streamReport(id string) (streamReport, bool) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	stream, active := s.streamsByID[id]
+	if !active {
+		var ok bool
+		if stream, ok = s.finishedByID[id]; !ok {
+			return streamReport{}, false
+		}
+	}
+
+	rep := streamReport{ID: id, ClientID: stream.clientID, Active: active, StartedAt: stream.startedAt}
+	if stream.backend != nil {
+		rep.Backend = stream.backend.Name
+	}
+	timePtr := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	rep.EndedAt = timePtr(stream.endedAt)
+	rep.ClientGoneAt = timePtr(stream.clientGoneAt)
+	rep.UpstreamClosedAt = timePtr(stream.upstreamClosedAt)
+	if rep.ClientAborted = rep.ClientGoneAt != nil; rep.ClientAborted {
+		rep.PropagationMs = float64(stream.upstreamClosedAt.Sub(stream.clientGoneAt)) / float64(time.Millisecond)
+	}
+	return rep, true
+}
+
+// handleDebugStream reports how a stream ended on both sides of the proxy,
+// so tests can check that a client disconnect reached the upstream.
+func (s *Proxy) handleDebugStream(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rep, ok := s.streamReport(id)
+	if !ok {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	upstreamURL := s.upstreams.primary()
+	if b := s.upstreams.lookup(rep.Backend); b != nil {
+		upstreamURL = b.URL
+	}
+	if resp, err := client.Get(upstreamURL + "/debug/streams/" + url.PathEscape(id)); err == nil {
+		var up upstreamReport
+		if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&up) == nil {
+			rep.Upstream = &up
+			if rep.ClientGoneAt != nil && up.EndedAt != nil {
+				rep.UpstreamPropagationMs = float64(up.EndedAt.Sub(*rep.ClientGoneAt)) / float64(time.Millisecond)
+			}
+		}
+		resp.Body.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+func (s *Proxy) streamActive(id string) bool {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	_, ok := s.streamsByID[id]
+	return ok
+}
+
+// joinedEvent is the data of an event delivered to a client that joined
+// several streams: the upstream data, tagged with the stream it came from.
+type joinedEvent struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// mirrorEvent republishes an upstream event for the clients that joined
+// stream. Streams nobody joined cost nothing beyond the subscriber check.
+func (s *Proxy) mirrorEvent(stream *activeStream, ev sseEvent) {
+	topic := streamTopicPrefix + stream.id
+	if !ev.hasData() || s.hub.Subscribers(topic) == 0 {
+		return
+	}
+	hubEv := ev.hubEvent()
+	data, err := json.Marshal(joinedEvent{Stream: stream.id, Data: hubEv.Data})
+	if err != nil {
+		return
+	}
+	hubEv.Data = string(data)
+	s.hub.Publish(topic, hubEv)
+}
+
+// handleJoinedStreams follows several running streams over one connection,
+// for dashboards that watch many generations at once. Events keep their
+// type and carry the stream id in their data; each stream ends with a
+// stream-end event, sent once its subscription closes so that a full
+// buffer cannot lose it, and the connection closes once all of them have.
+func (s *Proxy) handleJoinedStreams(w http.ResponseWriter, r *http.Request, flusher http.Flusher, ids []string) {
+	if len(ids) > maxJoinedStreams {
+		http.Error(w, fmt.Sprintf("at most %d streams can be joined", maxJoinedStreams), http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe before checking the streams exist, so none can end unseen
+	// in between
+	merged := make(chan server.Event, s.pumpBufferSize)
+	var missing []string
+	for _, id := range ids {
+		sub := s.hub.Subscribe(streamTopicPrefix+id, s.pumpBufferSize)
+		defer sub.Close()
+		if !s.streamActive(id) {
+			missing = append(missing, id)
+			continue
+		}
+		go func(id string) {
+			for ev := range sub.C {
+				select {
+				case merged <- ev:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			end := map[string]string{"stream": id}
+			if err := sub.Err(); err != nil {
+				end["error"] = err.Error()
+			}
+			data, _ := json.Marshal(end)
+			select {
+			case merged <- server.Event{Type: streamEndEvent, Data: string(data)}:
+			case <-r.Context().Done():
+			}
+		}(id)
+	}
+	if len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("unknown streams: %s", strings.Join(missing, ",")), http.StatusNotFound)
+		return
+	}
+
+	atomic.AddInt64(&s.joinedClients, 1)
+	defer atomic.AddInt64(&s.joinedClients, -1)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	s.logger.WithField("streams", ids).Info("Client joined streams")
+
+	var flushes server.StreamFlushes
+	remaining := len(ids)
+	for remaining > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-merged:
+			if ev.Type == streamEndEvent {
+				remaining--
+			}
+			if _, err := fmt.Fprint(w, ev.Format()); err != nil {
+				s.writeErrors.Record(err)
+				return
+			}
+			if d, slow := s.flushes.Flush(flusher); flushes.Record(d, slow) {
+				s.logger.WithFields(logrus.Fields{
+					"streams":  ids,
+					"flush_ms": d.Milliseconds(),
+				}).Warn("Slow flush to client")
+			}
+		}
+	}
+}
+
+// sendMigrationHints tells every active client to reconnect elsewhere. Each
+// client gets its own random delay within migrateJitter so they do not all
+// come back at once.
+func (s *Proxy) sendMigrationHints() {
+	targets := s.migrationTargets()
+
+	s.streamsMu.Lock()
+	streams := make([]*activeStream, 0, len(s.streams))
+	for stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.streamsMu.Unlock()
+
+	for i, stream := range streams {
+		delay := time.Duration(0)
+		if s.migrateJitter > 0 {
+			delay = time.Duration(rand.Int63n(int64(s.migrateJitter)))
+		}
+		hint := map[string]interface{}{
+			"reason":   "shutdown",
+			"delay_ms": delay.Milliseconds(),
+		}
+		if len(targets) > 0 {
+			hint["reconnect_url"] = targets[i%len(targets)]
+		}
+		data, _ := json.Marshal(hint)
+
+		select {
+		case stream.notices <- server.Event{Type: "migrate", Data: string(data), Retry: delay}:
+			atomic.AddInt64(&s.migrationHints, 1)
+		default:
+			// A hint is already pending for this client
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"clients": len(streams),
+		"targets": targets,
+	}).Info("Sent migration hints")
+}
+
+// migrationTargets returns the alternate addresses to send clients to: the
+// configured list, or whatever the discovery URL currently returns.
+func (s *Proxy) migrationTargets() []string {
+	if s.migrateDiscoveryURL == "" {
+		return s.migrateTo
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(s.migrateDiscoveryURL)
+	if err != nil {
+		s.logger.WithError(err).Warn("Migration discovery failed, using static targets")
+		return s.migrateTo
+	}
+	defer resp.Body.Close()
+
+	var targets []string
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil || len(targets) == 0 {
+		s.logger.WithError(err).Warn("Migration discovery returned no targets, using static targets")
+		return s.migrateTo
+	}
+	return targets
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"horizon-sse-go/server"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Why a stream ended, in its summary, besides the reasons the proxy
+// cancels upstream streams for, such as server.CancelClientGone.
+const (
+	// streamCompleted: the upstream finished the stream.
+	streamCompleted = "completed"
+	// streamRejected: the request was refused before a stream started,
+	// as invalid, unauthorized or over a rate limit.
+	streamRejected = "rejected"
+	// streamShed: the proxy was at capacity.
+	streamShed = "shed"
+	// streamResumed: a reconnecting client was answered from its replay
+	// buffer.
+	streamResumed = "resumed"
+	// streamConnectFailed: the upstream could not be reached.
+	streamConnectFailed = "connect_failed"
+	// streamUpstreamStatus: the upstream answered with an error status.
+	streamUpstreamStatus = "upstream_status"
+	// streamUpstreamError: the upstream answered with something other than
+	// an event stream, or its stream broke off.
+	streamUpstreamError = "upstream_error"
+)
+
+// streamSummary is what the log record of a stream reports once it is
+// over. The handlers serving the stream fill it in; every method is a
+// no-op on nil, for requests served without one.
+type streamSummary struct {
+	transport string
+	start     time.Time
+
+	mu        sync.Mutex
+	clientID  string
+	streamID  string
+	upstream  string
+	bytes     int64
+	messages  int64
+	firstByte time.Duration
+	reason    string
+	err       error
+	fields    logrus.Fields
+}
+
+type streamSummaryKey struct{}
+
+// streamSummaryFor returns the summary of the stream served for r, or nil.
+func streamSummaryFor(r *http.Request) *streamSummary {
+	summary, _ := r.Context().Value(streamSummaryKey{}).(*streamSummary)
+	return summary
+}
+
+// identify names the client and stream.
+func (m *streamSummary) identify(clientID, streamID string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clientID, m.streamID = clientID, streamID
+}
+
+// sentTo records the backend the stream went to, the last one if retries
+// moved it.
+func (m *streamSummary) sentTo(backend string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstream = backend
+}
+
+// wrote counts n bytes written to the client; the first time the time to
+// first byte is taken.
+func (m *streamSummary) wrote(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.bytes == 0 {
+		m.firstByte = time.Since(m.start)
+	}
+	m.bytes += int64(n)
+}
+
+// delivered counts n messages sent to the client.
+func (m *streamSummary) delivered(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages += int64(n)
+}
+
+// end records why the stream ended and the error that ended it, if any.
+// The first reason given is kept.
+func (m *streamSummary) end(reason string, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reason == "" {
+		m.reason, m.err = reason, err
+	}
+}
+
+// note adds a field to the record.
+func (m *streamSummary) note(key string, value interface{}) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fields == nil {
+		m.fields = logrus.Fields{}
+	}
+	m.fields[key] = value
+}
+
+// logStreams wraps the handler of a streaming route so that each of its
+// requests is logged once, when it is over, with what its stream carried
+// and why it ended, instead of along the way.
+func (s *Proxy) logStreams(transport string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summary := &streamSummary{transport: transport, start: time.Now()}
+		linkAccessLog(r, summary)
+		next(w, r.WithContext(context.WithValue(r.Context(), streamSummaryKey{}, summary)))
+
+		summary.mu.Lock()
+		defer summary.mu.Unlock()
+		if summary.reason == "" {
+			summary.reason = streamRejected
+			if r.Context().Err() != nil {
+				summary.reason = server.CancelClientGone
+			}
+		}
+		entry := s.logger.WithFields(summary.fields).WithFields(logrus.Fields{
+			"client_id":     summary.clientID,
+			"stream_id":     summary.streamID,
+			"transport":     transport,
+			"upstream":      summary.upstream,
+			"duration_ms":   float64(time.Since(summary.start)) / float64(time.Millisecond),
+			"bytes":         summary.bytes,
+			"messages":      summary.messages,
+			"first_byte_ms": float64(summary.firstByte) / float64(time.Millisecond),
+			"reason":        summary.reason,
+		})
+		if summary.err != nil {
+			entry.WithError(summary.err).Warn("Stream summary")
+			return
+		}
+		entry.Info("Stream summary")
+	}
+}
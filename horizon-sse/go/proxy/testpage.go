@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testPageHTML is served on /testpage: a harness that opens streams on /sse
+// from a real browser, with EventSource or fetch, and posts what arrived
+// to /testpage/results.
+//
+//go:embed testpage.html
+var testPageHTML []byte
+
+// testPageReportsKept bounds the reports /testpage/results lists.
+const testPageReportsKept = 100
+
+// TestPageReport is what the test page posts once its streams are over.
+type TestPageReport struct {
+	UserAgent string           `json:"user_agent"`
+	Transport string           `json:"transport"` // eventsource or fetch
+	Query     string           `json:"query"`
+	Streams   []TestPageStream `json:"streams"`
+	// Received is set by the proxy.
+	Received time.Time `json:"received"`
+}
+
+// TestPageStream is what one stream of the test page received.
+type TestPageStream struct {
+	Events       int     `json:"events"`
+	Bytes        int64   `json:"bytes"`
+	FirstEventMs float64 `json:"first_event_ms"`
+	DurationMs   float64 `json:"duration_ms"`
+	MaxGapMs     float64 `json:"max_gap_ms"`
+	// Bursts counts events that arrived together with the one before, as
+	// from a buffer flushed at once.
+	Bursts      int    `json:"bursts"`
+	Reconnects  int    `json:"reconnects"`
+	Done        bool   `json:"done"`
+	Error       string `json:"error,omitempty"`
+	LastEventID string `json:"last_event_id,omitempty"`
+}
+
+// testPageReports keeps the latest reports, oldest first.
+type testPageReports struct {
+	mu      sync.Mutex
+	reports []TestPageReport
+}
+
+func (t *testPageReports) add(report TestPageReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reports = append(t.reports, report)
+	if len(t.reports) > testPageReportsKept {
+		t.reports = append(t.reports[:0:0], t.reports[len(t.reports)-testPageReportsKept:]...)
+	}
+}
+
+func (t *testPageReports) list() []TestPageReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TestPageReport{}, t.reports...)
+}
+
+func (s *Proxy) handleTestPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(testPageHTML)
+}
+
+// handleTestPageResults keeps and logs a report of the test page, or with
+// GET lists those kept.
+func (s *Proxy) handleTestPageResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"reports": s.testPage.list()})
+		return
+	}
+
+	var report TestPageReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&report); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.Received = time.Now()
+	s.testPage.add(report)
+
+	fields := logrus.Fields{
+		"user_agent": report.UserAgent,
+		"transport":  report.Transport,
+		"query":      report.Query,
+		"streams":    len(report.Streams),
+	}
+	var done, failed, events, reconnects, bursts int
+	for _, st := range report.Streams {
+		if st.Done {
+			done++
+		}
+		if st.Error != "" {
+			failed++
+		}
+		events += st.Events
+		reconnects += st.Reconnects
+		bursts += st.Bursts
+	}
+	fields["done"], fields["failed"], fields["events"] = done, failed, events
+	fields["reconnects"], fields["bursts"] = reconnects, bursts
+	s.logger.WithFields(fields).Info("Test page report")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,441 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"horizon-sse-go/server"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bufferEvent assigns ev its outgoing ID, appends it to buf, records it
+// for replay and reports whether it counts as a proxied message.
+func (s *Proxy) bufferEvent(buf *bytes.Buffer, ev sseEvent, ids server.EventIDGenerator, replay *server.ReplayLog) int {
+	if ev.hasData() {
+		ev = ev.withID(ids.Next(ev.id()))
+	}
+	start := buf.Len()
+	ev.writeTo(buf)
+	if ev.hasData() {
+		replay.Record(ev.id(), string(buf.Bytes()[start:]))
+	}
+	if ev.hasData() && !ev.isDone() {
+		atomic.AddInt64(&s.proxiedMessages, 1)
+		return 1
+	}
+	return 0
+}
+
+// eventTransform rewrites the upstream events of one stream. It may hold
+// events back, split them or replace them, and keeps whatever state it
+// needs between calls.
+type eventTransform interface {
+	transform(ev sseEvent) []sseEvent
+}
+
+// eventFlusher is implemented by transforms that may still hold events
+// when the upstream body ends.
+type eventFlusher interface {
+	flush() []sseEvent
+}
+
+// forwardEvent runs ev through transforms in order, buffers what comes out
+// for the client and returns the number of proxied messages.
+func (s *Proxy) forwardEvent(buf *bytes.Buffer, ev sseEvent, ids server.EventIDGenerator, replay *server.ReplayLog, transforms []eventTransform) int {
+	out := runTransforms([]sseEvent{ev}, transforms, false)
+	for i := range out {
+		// Events a transform made up, like patches, trace back to the
+		// event that produced them
+		if out[i].readAt.IsZero() {
+			out[i].readAt = ev.readAt
+		}
+	}
+	return s.bufferEvents(buf, out, ids, replay)
+}
+
+// flushTransforms buffers the events transforms still hold once the
+// upstream has ended, and returns the number of proxied messages.
+func (s *Proxy) flushTransforms(buf *bytes.Buffer, ids server.EventIDGenerator, replay *server.ReplayLog, transforms []eventTransform) int {
+	return s.bufferEvents(buf, runTransforms(nil, transforms, true), ids, replay)
+}
+
+// runTransforms passes events through transforms in order. With flush,
+// each transform also hands over what it holds, which the later ones then
+// see as events.
+func runTransforms(events []sseEvent, transforms []eventTransform, flush bool) []sseEvent {
+	for _, t := range transforms {
+		var next []sseEvent
+		for _, e := range events {
+			next = append(next, t.transform(e)...)
+		}
+		if f, ok := t.(eventFlusher); ok && flush {
+			next = append(next, f.flush()...)
+		}
+		events = next
+	}
+	return events
+}
+
+func (s *Proxy) bufferEvents(buf *bytes.Buffer, events []sseEvent, ids server.EventIDGenerator, replay *server.ReplayLog) int {
+	var transformed time.Time
+	if s.traceEvents {
+		transformed = time.Now()
+	}
+	n := 0
+	for _, out := range events {
+		if s.traceEvents && !out.readAt.IsZero() && out.hasData() {
+			buf.WriteString(server.FormatEventTrace(out.readAt, transformed))
+		}
+		n += s.bufferEvent(buf, out, ids, replay)
+	}
+	return n
+}
+
+// sequenceStream checks that the numeric ids of one upstream stream count
+// up by one, and in repair mode restores that order. Events without a
+// numeric id pass through untouched; they, the final event of the stream
+// and the end of the upstream body release anything held first.
+//
+// An id seen before is a duplicate. One below the highest id so far that
+// has not been seen is out of order; it is forwarded, in order if repair
+// mode still can, late otherwise. An id still missing once
+// sequencingWindow higher ids have arrived is a gap, and counts as out of
+// order as well should it turn up after all.
+type sequenceStream struct {
+	s      *Proxy
+	repair bool
+	first  int64 // first id of the stream, 0 before it
+	next   int64 // id to send next in repair mode
+	max    int64 // highest id seen
+	// seen[id%len(seen)] == id for the ids received among the last
+	// len(seen) below max
+	seen []int64
+	held map[int64]sseEvent
+}
+
+// maxTrackedIDs bounds how far back a stream remembers the ids it has
+// seen. Older ids are assumed not to have been seen.
+const maxTrackedIDs = 1024
+
+func (s *Proxy) newSequenceStream(repair bool) *sequenceStream {
+	return &sequenceStream{s: s, repair: repair, seen: make([]int64, maxTrackedIDs), held: make(map[int64]sseEvent)}
+}
+
+func (t *sequenceStream) hasSeen(id int64) bool {
+	return id > t.max-int64(len(t.seen)) && t.seen[id%int64(len(t.seen))] == id
+}
+
+func (t *sequenceStream) transform(ev sseEvent) []sseEvent {
+	id, err := strconv.ParseInt(ev.id(), 10, 64)
+	if err != nil || id <= 0 {
+		return append(t.release(), ev)
+	}
+	if t.first == 0 {
+		t.first, t.next, t.max = id, id, id-1
+	}
+
+	switch {
+	case id > t.max:
+		window := int64(t.s.sequencingWindow)
+		// Ids that have just dropped out of the window without arriving
+		for m := max(t.max-window, id-window-int64(len(t.seen)), t.first); m < id-window; m++ {
+			if !t.hasSeen(m) {
+				atomic.AddInt64(&t.s.seqGaps, 1)
+			}
+		}
+		t.max = id
+	case t.hasSeen(id):
+		atomic.AddInt64(&t.s.seqDuplicates, 1)
+		if t.repair {
+			return nil
+		}
+		return []sseEvent{ev}
+	default:
+		atomic.AddInt64(&t.s.seqOutOfOrder, 1)
+	}
+	t.seen[id%int64(len(t.seen))] = id
+
+	if !t.repair || id < t.next {
+		// Too late to put back in place
+		return []sseEvent{ev}
+	}
+	if id != t.next {
+		t.held[id] = ev
+		if ev.isDone() || ev.hubEvent().Type == "message_stop" || len(t.held) > t.s.sequencingWindow {
+			// The missing events are not coming in time
+			return t.release()
+		}
+		return nil
+	}
+	t.next++
+	out := []sseEvent{ev}
+	for {
+		held, ok := t.held[t.next]
+		if !ok {
+			break
+		}
+		delete(t.held, t.next)
+		atomic.AddInt64(&t.s.seqRepaired, 1)
+		out = append(out, held)
+		t.next++
+	}
+	return out
+}
+
+func (t *sequenceStream) flush() []sseEvent {
+	return t.release()
+}
+
+// release returns the held events in id order and continues after them.
+func (t *sequenceStream) release() []sseEvent {
+	if len(t.held) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(t.held))
+	for id := range t.held {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	out := make([]sseEvent, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, t.held[id])
+		delete(t.held, id)
+	}
+	t.next = ids[len(ids)-1] + 1
+	return out
+}
+
+// rechunkStream regroups the text of upstream chunks, in either dialect,
+// on markdown-safe boundaries. A chunk whose text is held back is dropped
+// unless it carries something else, such as the role; held text goes out
+// in a copy of the last text chunk before any other event.
+type rechunkStream struct {
+	chunker *server.MarkdownChunker
+	// last is the most recent text chunk, decoded, and lastType its event
+	// type, used to build the chunk that flushes held text.
+	last     map[string]interface{}
+	lastType string
+}
+
+func newRechunkStream(maxHold int) *rechunkStream {
+	return &rechunkStream{chunker: server.NewMarkdownChunker(maxHold)}
+}
+
+func (t *rechunkStream) transform(ev sseEvent) []sseEvent {
+	hubEv := ev.hubEvent()
+	var chunk map[string]interface{}
+	if err := json.Unmarshal([]byte(hubEv.Data), &chunk); err != nil {
+		return append(t.flush(), ev)
+	}
+	delta, key := chunkText(chunk)
+	if delta == nil {
+		if hubEv.Type == "ping" {
+			return []sseEvent{ev}
+		}
+		return append(t.flush(), ev)
+	}
+
+	t.last, t.lastType = chunk, hubEv.Type
+	out := t.chunker.Write(delta[key].(string))
+	if out == "" {
+		for field := range delta {
+			if field != key && field != "type" {
+				delta[key] = ""
+				return []sseEvent{ev.withData(chunk)}
+			}
+		}
+		return nil
+	}
+	delta[key] = out
+	return []sseEvent{ev.withData(chunk)}
+}
+
+// flush returns a chunk with the text still held, if any.
+func (t *rechunkStream) flush() []sseEvent {
+	text := t.chunker.Flush()
+	if text == "" || t.last == nil {
+		return nil
+	}
+	delta, key := chunkText(t.last)
+	delta[key] = text
+	var ev sseEvent
+	if t.lastType != "" {
+		ev.lines = append(ev.lines, "event: "+t.lastType)
+	}
+	return []sseEvent{ev.withData(t.last)}
+}
+
+// chunkText finds the text of a decoded chunk: delta.content of the first
+// choice for OpenAI, delta.text of a content_block_delta for Anthropic. It
+// returns the map holding the text and its key, or nil if there is none.
+func chunkText(chunk map[string]interface{}) (map[string]interface{}, string) {
+	if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
+		choice, _ := choices[0].(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		if _, ok := delta["content"].(string); ok {
+			return delta, "content"
+		}
+		return nil, ""
+	}
+	if chunk["type"] == "content_block_delta" {
+		delta, _ := chunk["delta"].(map[string]interface{})
+		if _, ok := delta["text"].(string); ok {
+			return delta, "text"
+		}
+	}
+	return nil, ""
+}
+
+// patchDocument is the completion a patch-mode client maintains. Content
+// is a list of chunks to concatenate, so each token is a cheap append
+// rather than a rewrite of the whole text.
+type patchDocument struct {
+	ID           string   `json:"id"`
+	Model        string   `json:"model"`
+	Role         string   `json:"role"`
+	Content      []string `json:"content"`
+	FinishReason *string  `json:"finish_reason"`
+}
+
+// patchOp is one RFC 6902 JSON Patch operation.
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// patchStream turns the chunks of one upstream completion, in either
+// dialect, into "patch" events against a patchDocument. The first event,
+// every snapshotEvery-th after it and the last are "snapshot" events that
+// carry the whole document instead, so clients can start from any of them.
+type patchStream struct {
+	doc           patchDocument
+	snapshotEvery int
+	started       bool
+	sinceSnapshot int
+}
+
+func newPatchStream(snapshotEvery int) *patchStream {
+	return &patchStream{doc: patchDocument{Content: []string{}}, snapshotEvery: snapshotEvery}
+}
+
+// completionChunk holds the fields of OpenAI chunks and Anthropic events
+// that make up a patchDocument.
+type completionChunk struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Message *struct {
+		ID    string `json:"id"`
+		Model string `json:"model"`
+		Role  string `json:"role"`
+	} `json:"message"`
+	Delta *struct {
+		Text       string  `json:"text"`
+		StopReason *string `json:"stop_reason"`
+	} `json:"delta"`
+}
+
+// transform returns the events to send in place of ev. Events that are not
+// completion chunks, such as errors, pass through unchanged; the stream's
+// terminating event follows the final snapshot.
+func (p *patchStream) transform(ev sseEvent) []sseEvent {
+	hubEv := ev.hubEvent()
+	if ev.isDone() || hubEv.Type == "message_stop" {
+		if p.started && p.sinceSnapshot == 0 {
+			// Nothing changed since the last snapshot
+			return []sseEvent{ev}
+		}
+		return []sseEvent{p.snapshot(), ev}
+	}
+
+	var chunk completionChunk
+	if err := json.Unmarshal([]byte(hubEv.Data), &chunk); err != nil || (chunk.Type == "" && chunk.Choices == nil) {
+		return []sseEvent{ev}
+	}
+	ops := p.apply(chunk)
+	if len(ops) == 0 {
+		return nil
+	}
+	if !p.started {
+		p.started = true
+		return []sseEvent{p.snapshot()}
+	}
+	if p.sinceSnapshot++; p.snapshotEvery > 0 && p.sinceSnapshot >= p.snapshotEvery {
+		return []sseEvent{p.snapshot()}
+	}
+
+	data, _ := json.Marshal(ops)
+	return []sseEvent{{lines: []string{"event: patch", "data: " + string(data)}}}
+}
+
+// apply updates the document with chunk and returns the operations that
+// describe the change.
+func (p *patchStream) apply(chunk completionChunk) []patchOp {
+	var ops []patchOp
+	set := func(path string, field *string, value string) {
+		if value != "" && value != *field {
+			*field = value
+			ops = append(ops, patchOp{Op: "replace", Path: path, Value: value})
+		}
+	}
+	appendContent := func(text string) {
+		if text != "" {
+			p.doc.Content = append(p.doc.Content, text)
+			ops = append(ops, patchOp{Op: "add", Path: "/content/-", Value: text})
+		}
+	}
+	finish := func(reason *string) {
+		if reason != nil && (p.doc.FinishReason == nil || *p.doc.FinishReason != *reason) {
+			p.doc.FinishReason = reason
+			ops = append(ops, patchOp{Op: "replace", Path: "/finish_reason", Value: *reason})
+		}
+	}
+
+	if chunk.Message != nil {
+		set("/id", &p.doc.ID, chunk.Message.ID)
+		set("/model", &p.doc.Model, chunk.Message.Model)
+		set("/role", &p.doc.Role, chunk.Message.Role)
+	}
+	if chunk.Delta != nil {
+		appendContent(chunk.Delta.Text)
+		finish(chunk.Delta.StopReason)
+	}
+	if chunk.Choices != nil {
+		set("/id", &p.doc.ID, chunk.ID)
+		set("/model", &p.doc.Model, chunk.Model)
+	}
+	for _, choice := range chunk.Choices {
+		// The document follows the first choice only
+		if choice.Index != 0 {
+			continue
+		}
+		set("/role", &p.doc.Role, choice.Delta.Role)
+		appendContent(choice.Delta.Content)
+		finish(choice.FinishReason)
+	}
+	return ops
+}
+
+// snapshot returns the whole document, with its content joined into one
+// chunk so later "/content/-" appends still apply.
+func (p *patchStream) snapshot() sseEvent {
+	p.started = true
+	p.sinceSnapshot = 0
+	if len(p.doc.Content) > 1 {
+		p.doc.Content = []string{strings.Join(p.doc.Content, "")}
+	}
+	data, _ := json.Marshal(p.doc)
+	return sseEvent{lines: []string{"event: snapshot", "data: " + string(data)}}
+}
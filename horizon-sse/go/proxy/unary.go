@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"horizon-sse-go/server"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// unaryPaths are the endpoints answered with one JSON body, forwarded to
+// the upstreams as they are.
+var unaryPaths = []string{"/v1/embeddings", "/v1/moderations"}
+
+// unaryTimeout bounds a unary call upstream, from sending it to the end of
+// its answer.
+const unaryTimeout = 60 * time.Second
+
+// maxKeptAnswer bounds the answers forwardCall buffers for inspection.
+const maxKeptAnswer = 16 << 20
+
+// UnaryStats counts the calls to one unary endpoint: those answered, those
+// that failed in the proxy or upstream, the bytes of the answers and the
+// mean time to them.
+type UnaryStats struct {
+	Requests int64   `json:"requests"`
+	Failed   int64   `json:"failed"`
+	Bytes    int64   `json:"bytes"`
+	MeanMs   float64 `json:"mean_ms"`
+}
+
+type unaryCounters struct {
+	requests, failed, bytes, nanos int64
+}
+
+// count records a call that started at start, wrote n bytes of answer and
+// went through if ok.
+func (c *unaryCounters) count(start time.Time, n int64, ok bool) {
+	atomic.AddInt64(&c.requests, 1)
+	atomic.AddInt64(&c.nanos, int64(time.Since(start)))
+	atomic.AddInt64(&c.bytes, n)
+	if !ok {
+		atomic.AddInt64(&c.failed, 1)
+	}
+}
+
+func (c *unaryCounters) stats() UnaryStats {
+	st := UnaryStats{
+		Requests: atomic.LoadInt64(&c.requests),
+		Failed:   atomic.LoadInt64(&c.failed),
+		Bytes:    atomic.LoadInt64(&c.bytes),
+	}
+	if st.Requests > 0 {
+		st.MeanMs = float64(atomic.LoadInt64(&c.nanos)) / float64(st.Requests) / float64(time.Millisecond)
+	}
+	return st
+}
+
+// unaryCall is a client's request to a unary endpoint, sent upstream as it
+// came but for the headers the proxy adds.
+type unaryCall struct {
+	method string
+	// route is the endpoint as routes and error modes name it, target the
+	// path and query sent upstream
+	route       string
+	target      string
+	contentType string
+	modelName   string
+	body        *requestBody // nil for none
+	credentials http.Header
+}
+
+func (c unaryCall) model() string { return c.modelName }
+func (c unaryCall) path() string  { return c.route }
+
+func (c unaryCall) newRequest(ctx context.Context, baseURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, c.method, baseURL+c.target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.body != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(c.body.reader()), nil
+		}
+		req.Body, _ = req.GetBody()
+		req.ContentLength = c.body.size
+	}
+	if c.contentType != "" {
+		req.Header.Set("Content-Type", c.contentType)
+	}
+	for name, values := range c.credentials {
+		req.Header[name] = values
+	}
+	return req, nil
+}
+
+// newUnaryCall starts the call r makes, with the client's credentials.
+func newUnaryCall(r *http.Request, route string) unaryCall {
+	call := unaryCall{
+		method:      r.Method,
+		route:       route,
+		target:      r.URL.RequestURI(),
+		credentials: make(http.Header),
+	}
+	for _, name := range credentialHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			call.credentials[name] = v
+		}
+	}
+	return call
+}
+
+// handleUnary forwards a call to a unary endpoint. It goes through what
+// streams go through, but for the stream itself: the request size limit,
+// routing by model and path, the upstream in-flight limit, retries, the
+// route's error mode and the tenant's usage.
+func (s *Proxy) handleUnary(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	call := newUnaryCall(r, r.URL.Path)
+	fields, err := s.readCallBody(r, &call, s.maxRequestBytes)
+	if err != nil {
+		s.refuseCall(w, err)
+		s.unary[call.route].count(start, 0, false)
+		return
+	}
+	defer call.body.Close()
+	call.contentType = "application/json"
+	json.Unmarshal(fields["model"], &call.modelName)
+	n, ok := s.forwardCall(w, r, call, nil, nil)
+	s.unary[call.route].count(start, n, ok)
+}
+
+// readCallBody buffers the body of a call, of at most limit bytes, into
+// call. Unless its content is multipart it must be a JSON object, whose
+// fields are returned.
+func (s *Proxy) readCallBody(r *http.Request, call *unaryCall, limit int64) (map[string]json.RawMessage, error) {
+	if r.ContentLength > limit {
+		s.noteOversizedBody(r)
+		return nil, fmt.Errorf("request body larger than %d bytes: %w", limit, &http.MaxBytesError{Limit: limit})
+	}
+	body, err := s.bodies.read(r.Body, limit)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, fmt.Errorf("request body larger than %d bytes: %w", limit, err)
+		}
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	if call.contentType != "" {
+		call.body = body
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(body.reader()).Decode(&fields); err != nil || fields == nil {
+		body.Close()
+		return nil, errors.New("invalid request body: expected a JSON object")
+	}
+	call.body = body
+	return fields, nil
+}
+
+// refuseCall answers a call whose body was refused by readCallBody.
+func (s *Proxy) refuseCall(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// forwardCall sends call upstream, to pinned if it is set and otherwise to
+// a backend routed to, retrying on another, and relays the answer. If keep
+// is set, a successful answer is buffered and handed to it with the
+// backend that gave it before it is relayed. It returns the bytes relayed
+// and whether the call went through.
+func (s *Proxy) forwardCall(w http.ResponseWriter, r *http.Request, call unaryCall, pinned *Backend, keep func(*Backend, []byte)) (int64, bool) {
+	start := time.Now()
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = fmt.Sprintf("call-%d", time.Now().UnixNano())
+	}
+	if call.contentType == "application/json" {
+		s.logPayload(r, requestID, call.body)
+	}
+	if !admit(&s.upstreamInFlight, s.maxUpstreamInFlight) {
+		s.shed(w, "upstream_inflight")
+		return 0, false
+	}
+	defer atomic.AddInt64(&s.upstreamInFlight, -1)
+
+	tenant := server.TenantOf(r)
+	usage := s.usage.Start(tenant)
+	defer usage.Finish()
+
+	ctx, cancel := context.WithTimeout(r.Context(), unaryTimeout)
+	defer cancel()
+	backend := pinned
+	if backend == nil {
+		backend = s.upstreams.pick(call.model(), call.path())
+	}
+	req, err := call.newRequest(ctx, backend.URL)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to create deep server request")
+		http.Error(w, "Failed to connect to deep server", http.StatusInternalServerError)
+		return 0, false
+	}
+	req.Header.Set("X-Stream-ID", requestID)
+	req.Header.Set(server.TenantHeader, tenant)
+	if user := jwtUser(r); user != "" {
+		req.Header.Set(UserHeader, user)
+	}
+
+	closeBackend := backend.open()
+	defer func() { closeBackend() }()
+	moved := func(b *Backend) {
+		closeBackend()
+		closeBackend = b.open()
+		backend = b
+	}
+	client := &http.Client{Transport: s.unaryTransport}
+	var resp *http.Response
+	if pinned != nil {
+		// Only the pinned backend has what the call is about
+		resp, err = client.Do(req)
+	} else {
+		resp, err = s.sendUpstream(client, req, call, backend, moved)
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to connect to deep server")
+		http.Error(w, "Failed to connect to deep server", http.StatusBadGateway)
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		s.writeUpstreamError(w, nil, call.path(), requestID, resp, false)
+		return 0, false
+	}
+	body := resp.Body
+	if keep != nil {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxKeptAnswer))
+		if err != nil {
+			http.Error(w, "Failed to read deep server answer", http.StatusBadGateway)
+			return 0, false
+		}
+		keep(backend, data)
+		body = io.NopCloser(io.MultiReader(bytes.NewReader(data), resp.Body))
+	}
+	for name, values := range resp.Header {
+		if s.forwardHeaders.allows(name) {
+			w.Header()[name] = values
+		}
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("X-Request-ID", requestID)
+	n, err := io.Copy(w, body)
+	usage.AddBytes(int(n))
+	if err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"request_id": requestID,
+			"path":       call.path(),
+			"error":      err,
+		}).Warn("Unary response cut short")
+		return n, false
+	}
+	s.logger.WithFields(logrus.Fields{
+		"request_id":  requestID,
+		"path":        call.path(),
+		"model":       call.model(),
+		"upstream":    backend.Name,
+		"bytes":       n,
+		"duration_ms": time.Since(start).Milliseconds(),
+	}).Debug("Unary call completed")
+	return n, true
+}
+
+// unaryStats snapshots the counters of each unary endpoint.
+func (s *Proxy) unaryStats() map[string]UnaryStats {
+	out := make(map[string]UnaryStats, len(s.unary))
+	for path, st := range s.unary {
+		out[path] = st.stats()
+	}
+	return out
+}
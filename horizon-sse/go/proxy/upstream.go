@@ -0,0 +1,477 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"horizon-sse-go/server"
+	"horizon-sse-go/streamio"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamParams shapes the request sent to the deep server. Load tests set
+// them per client with /sse query parameters (dialect, model,
+// prompt_tokens, max_tokens, token_delay_ms) to mix workloads; without them every client
+// gets the same request. A client that POSTs its own chat request to /sse
+// has that forwarded instead.
+type upstreamParams struct {
+	dialect      string
+	promptTokens int
+	maxTokens    int
+	tokenDelay   time.Duration
+	hasDelay     bool
+	queryModel   string
+	// body is the client's request and credentials the headers it
+	// authenticated with, both passed on as they came. The fields the
+	// proxy sets are appended to the JSON object, as bodyFields in place
+	// of its closing brace at bodyEnd, unless the client set them
+	// otherwise, in which case body is a rewritten copy.
+	body        *requestBody
+	bodyEnd     int64
+	bodyFields  []byte
+	bodyModel   string
+	credentials http.Header
+}
+
+// credentialHeaders are the client headers forwarded with its own
+// request, so the proxy can front a backend that wants an API key.
+var credentialHeaders = []string{
+	"Authorization",
+	"X-Api-Key",
+	"Anthropic-Version",
+	"Anthropic-Beta",
+	"Openai-Organization",
+	"Openai-Project",
+}
+
+func parseUpstreamParams(q url.Values) (upstreamParams, error) {
+	p := upstreamParams{dialect: "openai"}
+	switch d := q.Get("dialect"); d {
+	case "", "openai":
+	case "anthropic":
+		p.dialect = d
+	default:
+		return p, fmt.Errorf("unknown dialect %q", d)
+	}
+	p.queryModel = q.Get("model")
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"prompt_tokens", &p.promptTokens},
+		{"max_tokens", &p.maxTokens},
+	}
+	for _, f := range ints {
+		if v := q.Get(f.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return p, fmt.Errorf("invalid %s %q", f.name, v)
+			}
+			*f.dst = n
+		}
+	}
+	if v := q.Get("token_delay_ms"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return p, fmt.Errorf("invalid token_delay_ms %q", v)
+		}
+		p.tokenDelay = time.Duration(ms) * time.Millisecond
+		p.hasDelay = true
+	}
+	return p, nil
+}
+
+// readBody takes the chat request a client POSTed, of at most limit bytes:
+// a JSON object with messages, in the dialect's format. It is buffered in
+// spool, so the upstream request can be sent again, until closeBody. The
+// model, if missing, and streaming are filled in when it is sent.
+func (p *upstreamParams) readBody(r *http.Request, limit int64, spool *bodySpool) error {
+	body, err := spool.read(r.Body, limit)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return fmt.Errorf("request body larger than %d bytes: %w", limit, err)
+		}
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	if err := p.setBody(body); err != nil {
+		body.Close()
+		return err
+	}
+	p.credentials = make(http.Header)
+	for _, name := range credentialHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			p.credentials[name] = v
+		}
+	}
+	return nil
+}
+
+// setBody checks the client's request in body and works out the fields
+// to add to it.
+func (p *upstreamParams) setBody(body *requestBody) error {
+	var head struct {
+		Model     json.RawMessage `json:"model"`
+		Messages  json.RawMessage `json:"messages"`
+		Stream    json.RawMessage `json:"stream"`
+		MaxTokens json.RawMessage `json:"max_tokens"`
+	}
+	dec := json.NewDecoder(body.reader())
+	if err := dec.Decode(&head); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	end := dec.InputOffset()
+	last := make([]byte, 1)
+	if _, err := body.ReadAt(last, end-1); err != nil || last[0] != '}' {
+		return errors.New("invalid request body: expected a JSON object")
+	}
+	if !bytes.HasPrefix(head.Messages, []byte("[")) {
+		return errors.New("invalid request body: messages must be an array")
+	}
+	json.Unmarshal(head.Model, &p.bodyModel)
+
+	var fields bytes.Buffer
+	rewrite := false
+	set := func(name string, have json.RawMessage, want string) {
+		switch {
+		case have == nil:
+			fmt.Fprintf(&fields, ",%q:%s", name, want)
+		case string(have) != want:
+			rewrite = true
+		}
+	}
+	if p.bodyModel == "" {
+		model, _ := json.Marshal(p.model())
+		set("model", head.Model, string(model))
+	}
+	// The proxy only relays streams
+	set("stream", head.Stream, "true")
+	if p.maxTokens > 0 {
+		set("max_tokens", head.MaxTokens, strconv.Itoa(p.maxTokens))
+	}
+	if !rewrite {
+		fields.WriteString("}")
+		p.body, p.bodyEnd, p.bodyFields = body, end-1, fields.Bytes()
+		return nil
+	}
+
+	// The client set a field the proxy overrides; rather than send it
+	// twice, the request is rewritten
+	var all map[string]interface{}
+	if err := json.NewDecoder(body.reader()).Decode(&all); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	all["model"] = p.model()
+	all["stream"] = true
+	if p.maxTokens > 0 {
+		all["max_tokens"] = p.maxTokens
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	body.Close()
+	p.body = body.spool.hold(data)
+	p.bodyEnd, p.bodyFields = int64(len(data)), nil
+	return nil
+}
+
+// closeBody releases the client's request once the stream is over.
+func (p upstreamParams) closeBody() {
+	p.body.Close()
+}
+
+// model is the model the request asks for, in its body or with ?model=.
+func (p upstreamParams) model() string {
+	if p.bodyModel != "" {
+		return p.bodyModel
+	}
+	if p.queryModel != "" {
+		return p.queryModel
+	}
+	if p.dialect == "anthropic" {
+		return "claude-3-5-sonnet-20241022"
+	}
+	return "gpt-4-turbo"
+}
+
+// path is the upstream endpoint for the stream's dialect.
+func (p upstreamParams) path() string {
+	if p.dialect == "anthropic" {
+		return "/v1/messages"
+	}
+	return "/v1/chat/completions"
+}
+
+// newRequest builds the upstream request. Its body can be had again with
+// GetBody, so it can be retried.
+func (p upstreamParams) newRequest(ctx context.Context, baseURL string) (*http.Request, error) {
+	target := baseURL + p.path()
+	if p.hasDelay {
+		target += "?token_delay_ms=" + strconv.FormatInt(p.tokenDelay.Milliseconds(), 10)
+	}
+
+	var req *http.Request
+	var err error
+	if p.body != nil {
+		req, err = http.NewRequestWithContext(ctx, "POST", target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(io.MultiReader(io.NewSectionReader(p.body, 0, p.bodyEnd), bytes.NewReader(p.bodyFields))), nil
+		}
+		req.Body, _ = req.GetBody()
+		req.ContentLength = p.bodyEnd + int64(len(p.bodyFields))
+	} else {
+		prompt := "Generate test response"
+		if p.promptTokens > 0 {
+			prompt = strings.Repeat("test ", p.promptTokens)
+		}
+		reqBody := map[string]interface{}{
+			"messages": []map[string]string{{"role": "user", "content": prompt}},
+			"model":    p.model(),
+			"stream":   true,
+		}
+		if p.maxTokens > 0 {
+			reqBody["max_tokens"] = p.maxTokens
+		}
+		jsonBody, _ := json.Marshal(reqBody)
+		req, err = http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range p.credentials {
+		req.Header[name] = values
+	}
+	return req, nil
+}
+
+// maxUpstreamTimeout bounds the idle timeout of paced streams, however
+// slow they ask to be.
+const maxUpstreamTimeout = 24 * time.Hour
+
+// timeout is how long the upstream may go quiet, waiting for the response
+// headers or between reads of the body, before the request is abandoned.
+// Streams can run for as long as they keep sending; paced ones get their
+// token delay plus headroom between reads.
+func (p upstreamParams) timeout() time.Duration {
+	timeout := 20 * time.Second
+	if !p.hasDelay || p.tokenDelay <= 0 {
+		return timeout
+	}
+	if p.tokenDelay > maxUpstreamTimeout-10*time.Second {
+		return maxUpstreamTimeout
+	}
+	return max(timeout, p.tokenDelay+10*time.Second)
+}
+
+// idleTimeoutBody cancels its request when a read has not returned for
+// longer than timeout. The timer is armed before the request is sent, so
+// it covers the wait for the response headers too.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// withIdleTimeout returns a context for the upstream request that is
+// cancelled once the upstream has been idle for timeout, and a function
+// that wraps the response body to keep it alive while it reads.
+func withIdleTimeout(ctx context.Context, timeout time.Duration) (context.Context, func(io.ReadCloser) io.ReadCloser, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() {
+		cancel(fmt.Errorf("upstream idle for %v", timeout))
+	})
+	wrap := func(body io.ReadCloser) io.ReadCloser {
+		return &idleTimeoutBody{ReadCloser: body, timer: timer, timeout: timeout}
+	}
+	return ctx, wrap, func() {
+		timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+// sseEvent is one SSE event read from the upstream, kept as its raw lines
+// without the terminating blank line. readAt is when the pump read it.
+type sseEvent struct {
+	lines  []string
+	readAt time.Time
+}
+
+func (e sseEvent) isDone() bool {
+	for _, line := range e.lines {
+		if line == "data: [DONE]" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e sseEvent) hasData() bool {
+	for _, line := range e.lines {
+		if strings.HasPrefix(line, "data:") {
+			return true
+		}
+	}
+	return false
+}
+
+// id returns the value of the event's id: field, if it has one.
+func (e sseEvent) id() string {
+	for _, line := range e.lines {
+		if strings.HasPrefix(line, "id:") {
+			return strings.TrimPrefix(strings.TrimPrefix(line, "id:"), " ")
+		}
+	}
+	return ""
+}
+
+// withID returns a copy of the event with its id: field replaced. An empty
+// id leaves the event without one.
+func (e sseEvent) withID(id string) sseEvent {
+	lines := make([]string, 0, len(e.lines)+1)
+	if id != "" {
+		lines = append(lines, "id: "+id)
+	}
+	for _, line := range e.lines {
+		if !strings.HasPrefix(line, "id:") {
+			lines = append(lines, line)
+		}
+	}
+	return sseEvent{lines: lines, readAt: e.readAt}
+}
+
+// withData returns a copy of the event with its data replaced by the JSON
+// encoding of v.
+func (e sseEvent) withData(v interface{}) sseEvent {
+	data, _ := json.Marshal(v)
+	lines := make([]string, 0, len(e.lines)+1)
+	for _, line := range e.lines {
+		if !strings.HasPrefix(line, "data:") {
+			lines = append(lines, line)
+		}
+	}
+	return sseEvent{lines: append(lines, "data: "+string(data)), readAt: e.readAt}
+}
+
+// hubEvent converts the event for publishing on the hub.
+func (e sseEvent) hubEvent() server.Event {
+	var ev server.Event
+	var data []string
+	for _, line := range e.lines {
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Type = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	ev.Data = strings.Join(data, "\n")
+	return ev
+}
+
+func (e sseEvent) writeTo(buf *bytes.Buffer) {
+	for _, line := range e.lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+}
+
+// upstreamPump reads the upstream body in its own goroutine and hands
+// complete events to the client writer through a bounded buffer, so a slow
+// client fills the buffer instead of delaying reads from the upstream. What
+// happens once it is full is the proxy's slow-client policy. With a
+// Latency, events go through a delayLine on their way into the buffer, and
+// with a recording they are recorded as they are read. The buffer ends
+// with the error reading the upstream, if any.
+type upstreamPump struct {
+	events *streamio.Buffer[sseEvent]
+	done   chan struct{}
+}
+
+func (s *Proxy) startPump(ctx context.Context, body io.Reader, recording *server.Recorder) *upstreamPump {
+	p := &upstreamPump{
+		events: streamio.NewBuffer[sseEvent](s.pumpBufferSize, s.slowClientPolicy, s.streamBuffers),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		var err error
+		var cut error // why the pump stopped before the upstream ended
+		put := func(ev sseEvent) error { return p.events.Put(ctx, ev) }
+		var delay *delayLine
+		if s.latency.Dist != "" {
+			delay = newDelayLine(ctx, s.latency, put)
+			put = delay.put
+		}
+		defer func() {
+			if delay != nil {
+				delay.close()
+			}
+			p.events.CloseWrite(err)
+			close(p.done)
+			if err == nil {
+				err = cut
+			}
+			s.recorder.finish(recording, err)
+		}()
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), s.maxLineBytes)
+		var lines []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line != "" {
+				lines = append(lines, line)
+				continue
+			}
+			if len(lines) == 0 {
+				continue
+			}
+			ev := sseEvent{lines: lines, readAt: time.Now()}
+			lines = nil
+			recording.Event(ev.readAt, ev.lines)
+			if cut = put(ev); cut != nil || ev.isDone() {
+				return
+			}
+		}
+		if len(lines) > 0 {
+			ev := sseEvent{lines: lines, readAt: time.Now()}
+			recording.Event(ev.readAt, ev.lines)
+			if cut = put(ev); cut != nil {
+				return
+			}
+		}
+		err = scanner.Err()
+	}()
+	return p
+}
+
+// stop ends the pump early, once the upstream body is closed, and waits
+// for it.
+func (p *upstreamPump) stop() {
+	p.events.Close()
+	<-p.done
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"bytes"
+	"horizon-sse-go/websocket"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handleWebSocket serves /sse over WebSocket. The query is the one /sse
+// takes; the first message is the body of a POST /sse, or, if empty, the
+// stream is the one GET /sse would serve. Later messages are commands to
+// the stream, as POST /streams/{id}/control takes them.
+func (s *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.websocketStreams, 1)
+	control := newStreamControl()
+	err := websocket.ServeSSE(w, r, func(body []byte) websocket.Route {
+		method := http.MethodPost
+		if b := bytes.TrimSpace(body); len(b) == 0 || bytes.Equal(b, []byte("{}")) {
+			method = http.MethodGet
+		}
+		return websocket.Route{
+			Method: method,
+			Path:   "/sse",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				s.handleSSEProxy(w, withStreamControl(r, control))
+			}),
+			Messages: s.webSocketCommands(control),
+		}
+	})
+	if err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"error":  err,
+			"remote": r.RemoteAddr,
+		}).Debug("WebSocket stream not started")
+	}
+}
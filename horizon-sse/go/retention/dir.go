@@ -0,0 +1,62 @@
+package retention
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dir is a store of the files and directories in Path, such as the
+// results directories of benchmark runs or rotated logs. A directory is
+// one item, as old as the newest file in it.
+type Dir struct {
+	Path string
+}
+
+func (d Dir) Items() ([]Item, error) {
+	entries, err := os.ReadDir(d.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	for _, e := range entries {
+		item := Item{Name: e.Name()}
+		err := filepath.WalkDir(filepath.Join(d.Path, e.Name()), func(_ string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := de.Info()
+			if err != nil {
+				return err
+			}
+			if !de.IsDir() {
+				item.Bytes += info.Size()
+			}
+			if info.ModTime().After(item.Time) {
+				item.Time = info.ModTime()
+			}
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed while we looked
+			continue
+		}
+		if err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (d Dir) Remove(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return errors.New("retention: invalid item name " + name)
+	}
+	return os.RemoveAll(filepath.Join(d.Path, name))
+}
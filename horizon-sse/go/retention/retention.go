@@ -0,0 +1,174 @@
+// Package retention keeps stored data within age and size limits. A
+// Janitor goes over classes of data, such as the replay sessions of a
+// proxy, its usage records or a directory of recorded runs, removing
+// what is older than the class's policy allows and then, oldest first,
+// what does not fit in its size.
+package retention
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policy is how long, and how much, of a class of data is kept. Zero
+// fields are no limit.
+type Policy struct {
+	MaxAge   time.Duration `json:"max_age,omitempty"`
+	MaxBytes int64         `json:"max_bytes,omitempty"`
+}
+
+// Item is one thing a Store holds.
+type Item struct {
+	Name string
+	// Time is when the item was last written or used.
+	Time  time.Time
+	Bytes int64
+}
+
+// Store is a class of data a Janitor manages.
+type Store interface {
+	// Items lists what the store holds that may be removed.
+	Items() ([]Item, error)
+	// Remove removes the item of that name. An item gone already is no
+	// error.
+	Remove(name string) error
+}
+
+// ClassStats are the items of a class the last pass found, and what the
+// janitor has removed of it so far.
+type ClassStats struct {
+	Policy         Policy `json:"policy"`
+	Items          int    `json:"items"`
+	Bytes          int64  `json:"bytes"`
+	RemovedItems   int64  `json:"removed_items"`
+	ReclaimedBytes int64  `json:"reclaimed_bytes"`
+	Errors         int64  `json:"errors"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// Stats are the passes of a Janitor and each of its classes.
+type Stats struct {
+	Passes   int64                 `json:"passes"`
+	LastPass time.Time             `json:"last_pass"`
+	Classes  map[string]ClassStats `json:"classes"`
+}
+
+// Janitor keeps classes of data within their policies.
+type Janitor struct {
+	pass sync.Mutex // one pass at a time
+
+	mu       sync.Mutex
+	classes  map[string]*class
+	passes   int64
+	lastPass time.Time
+}
+
+type class struct {
+	store  Store
+	policy Policy
+	stats  ClassStats
+}
+
+func NewJanitor() *Janitor {
+	return &Janitor{classes: make(map[string]*class)}
+}
+
+// Add has the janitor manage store as the class name, under p. A class
+// added again replaces the earlier one.
+func (j *Janitor) Add(name string, store Store, p Policy) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.classes[name] = &class{store: store, policy: p, stats: ClassStats{Policy: p}}
+}
+
+// Run makes a pass every interval until ctx is done.
+func (j *Janitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		j.Clean()
+	}
+}
+
+// Clean makes a pass now and returns the stats as of its end.
+func (j *Janitor) Clean() Stats {
+	j.pass.Lock()
+	defer j.pass.Unlock()
+
+	j.mu.Lock()
+	classes := make(map[string]*class, len(j.classes))
+	for name, c := range j.classes {
+		classes[name] = c
+	}
+	j.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range classes {
+		c.clean(j, now)
+	}
+	j.mu.Lock()
+	j.passes++
+	j.lastPass = now
+	j.mu.Unlock()
+	return j.Stats()
+}
+
+// clean removes the items of c its policy does not keep: those older than
+// MaxAge, then the oldest until the rest fit in MaxBytes.
+func (c *class) clean(j *Janitor, now time.Time) {
+	items, err := c.store.Items()
+	var removed, reclaimed, errs int64
+	var last error
+	if err != nil {
+		errs, last = 1, err
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a].Time.Before(items[b].Time) })
+	var total int64
+	for _, it := range items {
+		total += it.Bytes
+	}
+	kept := 0
+	for _, it := range items {
+		expired := c.policy.MaxAge > 0 && now.Sub(it.Time) > c.policy.MaxAge
+		over := c.policy.MaxBytes > 0 && total > c.policy.MaxBytes
+		if expired || over {
+			if err := c.store.Remove(it.Name); err != nil {
+				errs++
+				last = err
+			} else {
+				removed++
+				reclaimed += it.Bytes
+				total -= it.Bytes
+				continue
+			}
+		}
+		kept++
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c.stats.Items, c.stats.Bytes = kept, total
+	c.stats.RemovedItems += removed
+	c.stats.ReclaimedBytes += reclaimed
+	c.stats.Errors += errs
+	if last != nil {
+		c.stats.LastError = last.Error()
+	}
+}
+
+func (j *Janitor) Stats() Stats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stats := Stats{Passes: j.passes, LastPass: j.lastPass, Classes: make(map[string]ClassStats, len(j.classes))}
+	for name, c := range j.classes {
+		stats.Classes[name] = c.stats
+	}
+	return stats
+}
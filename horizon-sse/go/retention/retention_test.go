@@ -0,0 +1,106 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// memStore is a store of items in memory.
+type memStore map[string]Item
+
+func (m memStore) Items() ([]Item, error) {
+	var items []Item
+	for _, it := range m {
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+func (m memStore) Remove(name string) error {
+	delete(m, name)
+	return nil
+}
+
+func TestJanitorPolicies(t *testing.T) {
+	now := time.Now()
+	store := memStore{}
+	for i, age := range []time.Duration{1, 2, 3, 4, 5, 6} {
+		name := string(rune('a' + i))
+		store[name] = Item{Name: name, Time: now.Add(-age * time.Hour), Bytes: 100}
+	}
+
+	j := NewJanitor()
+	j.Add("sessions", store, Policy{MaxAge: 4*time.Hour + 30*time.Minute, MaxBytes: 250})
+	stats := j.Clean().Classes["sessions"]
+	// e and f are too old, then the oldest go until 250 bytes are left
+	if len(store) != 2 || store["a"].Name == "" || store["b"].Name == "" {
+		t.Errorf("kept %v", store)
+	}
+	if stats.Items != 2 || stats.Bytes != 200 || stats.RemovedItems != 4 || stats.ReclaimedBytes != 400 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Nothing more to remove; the totals stay
+	stats = j.Clean().Classes["sessions"]
+	if stats.RemovedItems != 4 || j.Stats().Passes != 2 {
+		t.Errorf("second pass: %+v", j.Stats())
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"run-1/deep-server.log", "run-1/metrics.jsonl", "run-2/deep-server.log", "capture.txt"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, make([]byte, 1000), 0644)
+		if filepath.Dir(name) == "run-1" {
+			os.Chtimes(path, old, old)
+		}
+	}
+	os.Chtimes(filepath.Join(dir, "run-1"), old, old)
+
+	j := NewJanitor()
+	j.Add("recordings", Dir{Path: dir}, Policy{MaxAge: 24 * time.Hour})
+	stats := j.Clean().Classes["recordings"]
+	if stats.RemovedItems != 1 || stats.ReclaimedBytes != 2000 || stats.Items != 2 || stats.Bytes != 2000 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "run-1")); !os.IsNotExist(err) {
+		t.Errorf("run-1 kept: %v", err)
+	}
+	if err := (Dir{Path: dir}).Remove(".."); err == nil {
+		t.Error("removed the parent directory")
+	}
+	// A directory not made yet holds nothing
+	if items, err := (Dir{Path: filepath.Join(dir, "none")}).Items(); err != nil || len(items) != 0 {
+		t.Errorf("got %v, %v", items, err)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("sessions=10m, usage=7d, recordings@/var/lib/horizon/results=30d:20GB, audit@/var/log/audit=:512MB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Class: "sessions", Policy: Policy{MaxAge: 10 * time.Minute}},
+		{Class: "usage", Policy: Policy{MaxAge: 7 * 24 * time.Hour}},
+		{Class: "recordings", Path: "/var/lib/horizon/results", Policy: Policy{MaxAge: 30 * 24 * time.Hour, MaxBytes: 20 << 30}},
+		{Class: "audit", Path: "/var/log/audit", Policy: Policy{MaxBytes: 512 << 20}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got %+v", rules)
+	}
+	for _, spec := range []string{"sessions", "=1h", "usage=-1h", "usage=1h:lots"} {
+		if _, err := ParseRules(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+	if err := NewJanitor().AddRules([]Rule{{Class: "audit"}}, map[string]Store{"usage": memStore{}}); err == nil {
+		t.Error("a class without a store or directory was added")
+	}
+}
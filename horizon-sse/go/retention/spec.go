@@ -0,0 +1,113 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule is a class of data and the policy it is kept under. Path is set
+// for a directory class.
+type Rule struct {
+	Class  string
+	Path   string
+	Policy Policy
+}
+
+// ParseRules parses a spec such as
+// "sessions=10m,usage=7d,recordings@/var/lib/horizon/results=30d:20GB".
+// Each entry is class[@dir]=age[:size]: classes with a directory are
+// Dirs, the others name stores of the server. An age of 0 or an empty
+// one is no limit, as is a missing size.
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("retention rule %q has no policy", entry)
+		}
+		var r Rule
+		r.Class, r.Path, _ = strings.Cut(strings.TrimSpace(name), "@")
+		if r.Class == "" {
+			return nil, fmt.Errorf("retention rule %q has no class", entry)
+		}
+		age, size, hasSize := strings.Cut(strings.TrimSpace(value), ":")
+		var err error
+		if r.Policy.MaxAge, err = parseAge(age); err != nil {
+			return nil, fmt.Errorf("retention rule %q: %w", entry, err)
+		}
+		if hasSize {
+			if r.Policy.MaxBytes, err = ParseSize(size); err != nil {
+				return nil, fmt.Errorf("retention rule %q: %w", entry, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseAge parses a duration, which may also be in days ("7d").
+func parseAge(s string) (time.Duration, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// ParseSize parses a number of bytes with an optional KB, MB, GB or TB
+// suffix, in powers of 1024.
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if n, ok := strings.CutSuffix(num, suffix); ok {
+			num, unit = n, int64(1)<<(10*(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// AddRules adds a class for each rule: a Dir for one with a Path, else
+// the store of its class in stores.
+func (j *Janitor) AddRules(rules []Rule, stores map[string]Store) error {
+	for _, r := range rules {
+		if r.Path != "" {
+			j.Add(r.Class, Dir{Path: r.Path}, r.Policy)
+			continue
+		}
+		store, ok := stores[r.Class]
+		if !ok {
+			names := make([]string, 0, len(stores))
+			for name := range stores {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown retention class %q: a directory must be given as %s@DIR (known classes: %s)",
+				r.Class, r.Class, strings.Join(names, ", "))
+		}
+		j.Add(r.Class, store, r.Policy)
+	}
+	return nil
+}
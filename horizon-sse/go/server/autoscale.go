@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AutoscaleTargets are the values per instance an autoscaler should keep
+// each saturation metric at. A zero target leaves its metric out of the
+// scale ratio.
+type AutoscaleTargets struct {
+	ActiveStreams float64 `json:"active_streams,omitempty"`
+	QueueDepth    float64 `json:"queue_depth,omitempty"`
+	ShedRate      float64 `json:"shed_rate,omitempty"`
+}
+
+// AutoscaleSignal is the saturation of one instance in the shape external
+// metrics scalers read. ScaleRatio is the highest value/target ratio: above
+// 1 the deployment needs more replicas, below 1 it has room to shrink, so
+// an HPA can target an average of 1 on it alone.
+type AutoscaleSignal struct {
+	ActiveStreams int64            `json:"active_streams"`
+	QueueDepth    int64            `json:"queue_depth"`
+	ShedRate      float64          `json:"shed_rate"`
+	Targets       AutoscaleTargets `json:"targets"`
+	ScaleRatio    float64          `json:"scale_ratio"`
+}
+
+// NewAutoscaleSignal computes the scale ratio of the given values.
+func NewAutoscaleSignal(activeStreams, queueDepth int64, shedRate float64, targets AutoscaleTargets) AutoscaleSignal {
+	sig := AutoscaleSignal{
+		ActiveStreams: activeStreams,
+		QueueDepth:    queueDepth,
+		ShedRate:      shedRate,
+		Targets:       targets,
+	}
+	for _, m := range []struct{ value, target float64 }{
+		{float64(activeStreams), targets.ActiveStreams},
+		{float64(queueDepth), targets.QueueDepth},
+		{shedRate, targets.ShedRate},
+	} {
+		if m.target > 0 && m.value/m.target > sig.ScaleRatio {
+			sig.ScaleRatio = m.value / m.target
+		}
+	}
+	return sig
+}
+
+// WritePrometheus writes the signal in the Prometheus text format, with
+// metric names starting with prefix, for adapters that scrape it.
+func (s AutoscaleSignal) WritePrometheus(w io.Writer, prefix string) {
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s gauge\n%s%s %g\n", prefix, name, help, prefix, name, prefix, name, value)
+	}
+	gauge("active_streams", "Client streams being served.", float64(s.ActiveStreams))
+	gauge("queue_depth", "Upstream events queued for clients.", float64(s.QueueDepth))
+	gauge("shed_rate", "Streams refused at capacity per second.", s.ShedRate)
+	gauge("scale_ratio", "Highest ratio of a saturation metric to its target.", s.ScaleRatio)
+	for _, t := range []struct {
+		name   string
+		target float64
+	}{
+		{"active_streams_target", s.Targets.ActiveStreams},
+		{"queue_depth_target", s.Targets.QueueDepth},
+		{"shed_rate_target", s.Targets.ShedRate},
+	} {
+		if t.target > 0 {
+			gauge(t.name, "Configured autoscaling target.", t.target)
+		}
+	}
+}
+
+// RateWindow counts occurrences in one-second buckets and reports their
+// rate over a sliding window.
+type RateWindow struct {
+	mu      sync.Mutex
+	counts  []int64
+	seconds []int64 // the second each bucket counts
+}
+
+func NewRateWindow(window time.Duration) *RateWindow {
+	n := int(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &RateWindow{counts: make([]int64, n), seconds: make([]int64, n)}
+}
+
+func (r *RateWindow) Add(n int64) {
+	now := time.Now().Unix()
+	i := int(now % int64(len(r.counts)))
+	r.mu.Lock()
+	if r.seconds[i] != now {
+		r.seconds[i], r.counts[i] = now, 0
+	}
+	r.counts[i] += n
+	r.mu.Unlock()
+}
+
+// Rate returns the occurrences per second over the window.
+func (r *RateWindow) Rate() float64 {
+	now := time.Now().Unix()
+	var total int64
+	r.mu.Lock()
+	for i, sec := range r.seconds {
+		if now-sec < int64(len(r.counts)) {
+			total += r.counts[i]
+		}
+	}
+	r.mu.Unlock()
+	return float64(total) / float64(len(r.counts))
+}
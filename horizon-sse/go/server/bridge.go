@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"horizon-sse-go/client"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// bridgeResubscribeDelay is the wait before following a source again after
+// its stream completed, and bridgeFailureDelay after it refused us (e.g. a
+// 4xx), which the pool does not retry on its own, or the pool refused to
+// subscribe. They are variables for tests.
+var (
+	bridgeResubscribeDelay = time.Second
+	bridgeFailureDelay     = 30 * time.Second
+)
+
+// BridgeConfig describes one remote SSE stream to mirror into the hub.
+type BridgeConfig struct {
+	// Source is the URL of the remote SSE endpoint, e.g. another horizon
+	// instance or a third-party feed.
+	Source string
+	// Channel is the local channel events are republished on. "{type}" is
+	// replaced by the event type ("message" if it has none), so one source
+	// can feed a family of channels.
+	Channel string
+}
+
+// ParseBridgeConfig parses "channel=url".
+func ParseBridgeConfig(spec string) (BridgeConfig, error) {
+	channel, source, ok := strings.Cut(spec, "=")
+	cfg := BridgeConfig{Source: strings.TrimSpace(source), Channel: strings.TrimSpace(channel)}
+	if !ok || cfg.Channel == "" {
+		return cfg, fmt.Errorf("bridge %q: expected channel=url", spec)
+	}
+	u, err := url.Parse(cfg.Source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return cfg, fmt.Errorf("bridge %q: source must be an http(s) URL", spec)
+	}
+	return cfg, nil
+}
+
+// Bridge follows a remote SSE stream and republishes its events on local
+// hub channels, keeping their IDs. Dropped connections are resumed with
+// Last-Event-ID by the client pool; when the source ends its stream the
+// bridge follows it again from the last event it saw.
+type Bridge struct {
+	cfg    BridgeConfig
+	hub    *Hub
+	pool   *client.Pool
+	logger logrus.FieldLogger
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	events       int64
+	resubscribes int64
+
+	mu          sync.Mutex
+	sub         *client.Subscription
+	waiting     bool // between a subscription attempt and the next
+	lastEventID string
+	lastErr     error
+}
+
+// BridgeStats describes the state of one bridge.
+type BridgeStats struct {
+	Source       string `json:"source"`
+	Channel      string `json:"channel"`
+	State        string `json:"state"`
+	Events       int64  `json:"events"`
+	Resubscribes int64  `json:"resubscribes"`
+	LastEventID  string `json:"last_event_id,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+func startBridge(ctx context.Context, cfg BridgeConfig, hub *Hub, pool *client.Pool, logger logrus.FieldLogger) *Bridge {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &Bridge{
+		cfg:    cfg,
+		hub:    hub,
+		pool:   pool,
+		logger: logger,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go b.run(ctx)
+	return b
+}
+
+// Close stops following the source.
+func (b *Bridge) Close() {
+	b.cancel()
+	<-b.done
+}
+
+func (b *Bridge) run(ctx context.Context) {
+	defer close(b.done)
+	fields := logrus.Fields{"source": b.cfg.Source, "channel": b.cfg.Channel}
+
+	for {
+		b.mu.Lock()
+		from := b.lastEventID
+		b.mu.Unlock()
+
+		sub, err := b.pool.SubscribeFrom(ctx, b.cfg.Source, from)
+		if errors.Is(err, client.ErrPoolClosed) {
+			return
+		}
+		if err != nil {
+			// Such as the host limit, which frees up as others close
+			b.mu.Lock()
+			b.waiting = true
+			b.lastErr = err
+			b.mu.Unlock()
+			b.logger.WithFields(fields).WithError(err).Error("Bridge could not subscribe")
+			if !b.wait(ctx, bridgeFailureDelay) {
+				return
+			}
+			continue
+		}
+		b.mu.Lock()
+		b.sub = sub
+		b.waiting = false
+		b.mu.Unlock()
+		b.logger.WithFields(fields).WithField("last_event_id", from).Info("Bridge following source")
+
+		for ev := range sub.Events {
+			b.republish(ev)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := bridgeResubscribeDelay
+		err = sub.Err()
+		b.mu.Lock()
+		b.waiting = true
+		if err != nil {
+			b.lastErr = err
+		}
+		b.mu.Unlock()
+		if err != nil {
+			delay = bridgeFailureDelay
+			b.logger.WithFields(fields).WithError(err).Warn("Bridge source failed")
+		} else {
+			b.logger.WithFields(fields).Info("Bridge source completed its stream")
+		}
+
+		if !b.wait(ctx, delay) {
+			return
+		}
+	}
+}
+
+// wait sleeps before the next subscription attempt. It returns false if
+// the bridge was closed meanwhile.
+func (b *Bridge) wait(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+	}
+	atomic.AddInt64(&b.resubscribes, 1)
+	return true
+}
+
+func (b *Bridge) republish(ev client.Event) {
+	eventType := ev.Type
+	if eventType == "" {
+		eventType = "message"
+	}
+	channel := strings.ReplaceAll(b.cfg.Channel, "{type}", eventType)
+	b.hub.Publish(channel, Event{ID: ev.ID, Type: ev.Type, Data: ev.Data})
+	atomic.AddInt64(&b.events, 1)
+
+	if ev.ID != "" {
+		b.mu.Lock()
+		b.lastEventID = ev.ID
+		b.mu.Unlock()
+	}
+}
+
+// Stats reports the bridge's connection state and counters.
+func (b *Bridge) Stats() BridgeStats {
+	st := BridgeStats{
+		Source:       b.cfg.Source,
+		Channel:      b.cfg.Channel,
+		State:        client.StateConnecting.String(),
+		Events:       atomic.LoadInt64(&b.events),
+		Resubscribes: atomic.LoadInt64(&b.resubscribes),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.waiting {
+		st.State = client.StateReconnecting.String()
+	} else if b.sub != nil {
+		st.State = b.sub.State().String()
+	}
+	st.LastEventID = b.lastEventID
+	if b.lastErr != nil {
+		st.LastError = b.lastErr.Error()
+	}
+	return st
+}
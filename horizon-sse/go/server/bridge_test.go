@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"horizon-sse-go/client"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A bridge the pool refuses to subscribe keeps retrying, reports why, and
+// follows the source once the pool has room.
+func TestBridgeRetriesRefusedSubscription(t *testing.T) {
+	defer func(d time.Duration) { bridgeFailureDelay = d }(bridgeFailureDelay)
+	bridgeFailureDelay = 20 * time.Millisecond
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "id: 1\ndata: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	pool := client.NewPool(client.PoolConfig{MaxConnsPerHost: 1})
+	defer pool.Close()
+	blocker, err := pool.Subscribe(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	b := startBridge(context.Background(), BridgeConfig{Source: ts.URL, Channel: "mirror"}, hub, pool, logger)
+	defer b.Close()
+
+	waitFor(t, func() bool {
+		st := b.Stats()
+		return st.State == "reconnecting" && strings.Contains(st.LastError, "limit") && st.Resubscribes > 0
+	})
+	blocker.Close()
+	waitFor(t, func() bool { return b.Stats().Events == 1 })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in 5s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
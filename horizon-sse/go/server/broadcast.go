@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxSubscribedChannels bounds the channels and patterns one /sse client
+// can subscribe to.
+const maxSubscribedChannels = 64
+
+// ServeHTTP serves the SSE server's routes, so it can be mounted behind an
+// application's own router as a broadcast component: clients subscribe
+// with GET /sse?channel=X, or to several channels and "prefix*" patterns
+// with /sse?channels=X,Y.*, and events arrive from POST /publish/X or
+// Publish.
+func (s *SSEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Run feeds /metrics/stream until ctx is done. Start runs it; embedders
+// serving the SSE server as a handler run it themselves.
+func (s *SSEServer) Run(ctx context.Context) {
+	s.publishMetrics(ctx)
+}
+
+// Publish delivers ev to the subscribers of channel, like POST
+// /publish/{channel} but without schema validation, and returns how many
+// received it. An event without an ID gets a snowflake ID.
+func (s *SSEServer) Publish(channel string, ev Event) int {
+	if ev.ID == "" {
+		ev.ID = snowflakeIDs{}.Next("")
+	}
+	return s.hub.Publish(channel, ev)
+}
+
+// subscribedChannels returns the channels a /sse request subscribes to,
+// from ?channel= and the comma-separated ?channels=, or nil for a chat
+// stream.
+func subscribedChannels(r *http.Request) ([]string, error) {
+	var channels []string
+	if channel := r.URL.Query().Get("channel"); channel != "" {
+		channels = append(channels, channel)
+	}
+	for _, list := range r.URL.Query()["channels"] {
+		for _, channel := range strings.Split(list, ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels = append(channels, channel)
+			}
+		}
+	}
+	if len(channels) > maxSubscribedChannels {
+		return nil, fmt.Errorf("at most %d channels per subscription", maxSubscribedChannels)
+	}
+	return channels, nil
+}
+
+// subscribe streams the events published on channels to a /sse?channel=
+// or ?channels= client until it disconnects. The client is subscribed
+// before the headers go out, so once it sees them it gets every event
+// published. Unless the client follows one channel by name, each event
+// starts with a channel field naming the one it was published on;
+// EventSource skips it as an unknown field, other parsers can use it.
+func (s *SSEServer) subscribe(w http.ResponseWriter, r *http.Request, flusher http.Flusher, clientID string, channels []string) {
+	sub := s.hub.SubscribeTopics(channels, s.streamBuffer)
+	defer sub.Close()
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tagged := len(channels) > 1 || strings.HasSuffix(channels[0], "*")
+	logger := s.logger.WithFields(logrus.Fields{"client_id": clientID, "channel": strings.Join(channels, ",")})
+	logger.Info("Client subscribed")
+	// delivered counts the events of each channel, as published
+	delivered := make(map[string]int)
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.WithField("delivered", delivered).Info("Subscriber disconnected")
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				// Only the channel's disconnect policy closes it
+				logger.WithError(sub.Err()).Warn("Disconnecting slow subscriber")
+				atomic.AddInt64(&s.failedStreams, 1)
+				return
+			}
+			frame := ev.Format()
+			if tagged {
+				frame = "channel: " + ev.Topic + "\n" + frame
+			}
+			if _, err := fmt.Fprint(w, frame); err != nil {
+				logger.WithFields(logrus.Fields{
+					"error":             err,
+					"write_error_class": s.writeErrors.Record(err),
+				}).Error("Failed to write to client")
+				atomic.AddInt64(&s.failedStreams, 1)
+				return
+			}
+			s.flushes.Flush(flusher)
+			delivered[ev.Topic]++
+		}
+	}
+}
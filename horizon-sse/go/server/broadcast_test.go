@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Every subscriber of a channel gets what is published on it, and nothing
+// published on others.
+func TestChannelBroadcast(t *testing.T) {
+	s := NewSSEServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	var readers []*bufio.Reader
+	for _, channel := range []string{"news", "news", "sports"} {
+		resp, err := http.Get(ts.URL + "/sse?channel=" + channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("subscribe: %s", resp.Status)
+		}
+		readers = append(readers, bufio.NewReader(resp.Body))
+	}
+
+	resp, err := http.Post(ts.URL+"/publish/news", "application/json", strings.NewReader(`{"id":"1","data":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := s.Publish("sports", Event{Type: "score", Data: "2-1"}); n != 1 {
+		t.Errorf("published to %d sports subscribers", n)
+	}
+
+	readEvent := func(r *bufio.Reader) string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return err.Error()
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, r := range readers[:2] {
+			if ev := readEvent(r); ev != "id: 1\ndata: hello\n" {
+				t.Errorf("news subscriber got %q", ev)
+			}
+		}
+		if ev := readEvent(readers[2]); !strings.Contains(ev, "event: score\ndata: 2-1\n") {
+			t.Errorf("sports subscriber got %q", ev)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not delivered")
+	}
+}
+
+// A client can follow several channels and families of them on one
+// connection; each event says which channel it came from, and is sent
+// once even when two of the client's channels match it.
+func TestChannelPatterns(t *testing.T) {
+	s := NewSSEServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/sse?channels=chat.*,alerts.critical,chat.room1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("subscribe: %s", resp.Status)
+	}
+	if s.hub.Subscribers("chat.room2") != 1 || s.hub.Subscribers("alerts.info") != 0 {
+		t.Errorf("subscribers: chat.room2 %d, alerts.info %d", s.hub.Subscribers("chat.room2"), s.hub.Subscribers("alerts.info"))
+	}
+
+	for _, p := range []struct{ channel, data string }{
+		{"chat.room1", "hi"},
+		{"alerts.info", "ignored"},
+		{"chat.room2", "hey"},
+		{"alerts.critical", "fire"},
+	} {
+		s.Publish(p.channel, Event{ID: p.data, Data: p.data})
+	}
+
+	got := make(chan []string, 1)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		var events []string
+		var lines []string
+		for len(events) < 3 {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if line == "\n" {
+				events = append(events, strings.Join(lines, ""))
+				lines = nil
+				continue
+			}
+			lines = append(lines, line)
+		}
+		got <- events
+	}()
+	var events []string
+	select {
+	case events = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not delivered")
+	}
+	want := []string{
+		"channel: chat.room1\nid: hi\ndata: hi\n",
+		"channel: chat.room2\nid: hey\ndata: hey\n",
+		"channel: alerts.critical\nid: fire\ndata: fire\n",
+	}
+	if strings.Join(events, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", events, want)
+	}
+
+	stats := s.hub.Stats()
+	if p := stats.Patterns["chat.*"]; p.Subscribers != 1 || p.Delivered != 1 {
+		t.Errorf("chat.* stats %+v", p)
+	}
+	if c := stats.Channels["chat.room1"]; c.Delivered != 1 {
+		t.Errorf("chat.room1 delivered %d", c.Delivered)
+	}
+
+	many := strings.TrimSuffix(strings.Repeat("c,", maxSubscribedChannels+1), ",")
+	resp, err = http.Get(ts.URL + "/sse?channels=" + many)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("too many channels: %s", resp.Status)
+	}
+}
+
+// A subscriber dropped for falling behind is told so, as a slow client.
+func TestSlowConsumer(t *testing.T) {
+	h := NewHub()
+	policies, err := ParseChannelPolicies("disconnect:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetChannelPolicies(policies)
+	sub := h.Subscribe("audit", 1)
+	h.Publish("audit", Event{Data: "1"})
+	h.Publish("audit", Event{Data: "2"})
+	for range sub.C {
+	}
+	if err := sub.Err(); err != ErrSlowConsumer || !errors.Is(err, ErrSlowClient) {
+		t.Errorf("dropped subscriber reports %v", err)
+	}
+}
+
+// Closing a topic ends its subscribers after what they have buffered,
+// even when the buffer is full, and leaves other topics alone.
+func TestCloseTopic(t *testing.T) {
+	h := NewHub()
+	sub := h.Subscribe("stream.a", 1)
+	other := h.Subscribe("stream.b", 1)
+	defer other.Close()
+	h.Publish("stream.a", Event{Data: "1"})
+	h.Publish("stream.a", Event{Data: "2"}) // dropped: the buffer is full
+	h.CloseTopic("stream.a")
+	var got []string
+	for ev := range sub.C {
+		got = append(got, ev.Data)
+	}
+	if strings.Join(got, ",") != "1" || sub.Err() != nil {
+		t.Errorf("got %v, err %v", got, sub.Err())
+	}
+	if h.Subscribers("stream.a") != 0 || h.Subscribers("stream.b") != 1 {
+		t.Errorf("subscribers a=%d b=%d", h.Subscribers("stream.a"), h.Subscribers("stream.b"))
+	}
+}
+
+// Start serves until its context is done, then returns nil.
+func TestStart(t *testing.T) {
+	s := NewSSEServer()
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	s.SetLogger(quiet)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx, "127.0.0.1:0") }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stopped with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still serving after its context was cancelled")
+	}
+	if err := s.Start(context.Background(), "127.0.0.1:-1"); err == nil {
+		t.Error("listening on an invalid address")
+	}
+}
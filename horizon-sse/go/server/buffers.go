@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HTTPBuffers size the buffers responses are written through. net/http
+// passes a response through a 2KB buffer, cutting it into chunks of that
+// size, and then through a 4KB buffer per connection, so a batch of events
+// flushed together takes several write syscalls once it outgrows them.
+// Zero values keep net/http's behaviour.
+type HTTPBuffers struct {
+	// WriteBuffer is how many bytes a response collects before handing
+	// them to net/http, which it otherwise does on every flush. A batch up
+	// to this size then leaves as one chunk. The buffer grows to the
+	// largest batch of each open response, up to this size.
+	WriteBuffer int
+	// MaxFrameSize is the largest HTTP/2 frame a server accepts and a
+	// transport asks its peer to send, between 16KB and 16MB. The frames
+	// a server sends are bounded by what the client asked for. It only
+	// matters on connections that speak HTTP/2.
+	MaxFrameSize int
+}
+
+const (
+	minFrameSize = 16 << 10
+	maxFrameSize = 16 << 20
+)
+
+// ParseHTTPBuffers parses a spec such as "write=32KB,h2-frame=64KB".
+func ParseHTTPBuffers(spec string) (HTTPBuffers, error) {
+	var b HTTPBuffers
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		var err error
+		switch strings.TrimSpace(name) {
+		case "write":
+			b.WriteBuffer, err = ParseSize(value)
+		case "h2-frame":
+			if !http2Configurable {
+				return b, fmt.Errorf("h2-frame needs a binary built with Go 1.24 or later")
+			}
+			b.MaxFrameSize, err = ParseSize(value)
+			if err == nil && (b.MaxFrameSize < minFrameSize || b.MaxFrameSize > maxFrameSize) {
+				err = fmt.Errorf("must be between 16KB and 16MB")
+			}
+		default:
+			return b, fmt.Errorf("unknown buffer option %q", name)
+		}
+		if err != nil {
+			return b, fmt.Errorf("invalid buffer option %q: %v", entry, err)
+		}
+	}
+	return b, nil
+}
+
+// Handler wraps h so that its responses are written through a buffer of
+// WriteBuffer bytes. It returns h itself if WriteBuffer is zero.
+func (b HTTPBuffers) Handler(h http.Handler) http.Handler {
+	if b.WriteBuffer <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := &bufferedResponse{ResponseWriter: w, size: b.WriteBuffer}
+		defer bw.release()
+		h.ServeHTTP(bw, r)
+	})
+}
+
+// Fields describes the buffers for the startup log.
+func (b HTTPBuffers) Fields() logrus.Fields {
+	f := logrus.Fields{}
+	if b.WriteBuffer > 0 {
+		f["write_buffer"] = b.WriteBuffer
+	}
+	if b.MaxFrameSize > 0 {
+		f["h2_max_frame"] = b.MaxFrameSize
+	}
+	return f
+}
+
+var responseBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// bufferedResponse holds back writes until it is flushed or size bytes are
+// waiting. Unwrap keeps http.ResponseController working through it.
+type bufferedResponse struct {
+	http.ResponseWriter
+	size int
+	buf  *bytes.Buffer
+}
+
+func (w *bufferedResponse) Write(p []byte) (int, error) {
+	if w.buf == nil {
+		w.buf = responseBuffers.Get().(*bytes.Buffer)
+	}
+	if w.buf.Len()+len(p) > w.size {
+		if err := w.writeOut(); err != nil {
+			return 0, err
+		}
+		if len(p) >= w.size {
+			return w.ResponseWriter.Write(p)
+		}
+	}
+	return w.buf.Write(p)
+}
+
+// writeOut hands what is buffered to net/http.
+func (w *bufferedResponse) writeOut() error {
+	if w.buf == nil || w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *bufferedResponse) Flush() {
+	w.writeOut()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *bufferedResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// release writes out what the handler left unflushed and returns the
+// buffer to the pool, unless it grew well past the buffer size.
+func (w *bufferedResponse) release() {
+	if w.buf == nil {
+		return
+	}
+	w.writeOut()
+	if w.buf.Cap() <= 2*w.size {
+		responseBuffers.Put(w.buf)
+	}
+	w.buf = nil
+}
@@ -0,0 +1,30 @@
+//go:build go1.24
+
+package server
+
+import "net/http"
+
+const http2Configurable = true
+
+// Apply sets the HTTP/2 frame size on srv.
+func (b HTTPBuffers) Apply(srv *http.Server) {
+	if b.MaxFrameSize <= 0 {
+		return
+	}
+	if srv.HTTP2 == nil {
+		srv.HTTP2 = &http.HTTP2Config{}
+	}
+	srv.HTTP2.MaxReadFrameSize = b.MaxFrameSize
+}
+
+// ApplyTransport has t ask servers for frames of up to the HTTP/2 frame
+// size, which is what bounds the frames of a streamed response.
+func (b HTTPBuffers) ApplyTransport(t *http.Transport) {
+	if b.MaxFrameSize <= 0 {
+		return
+	}
+	if t.HTTP2 == nil {
+		t.HTTP2 = &http.HTTP2Config{}
+	}
+	t.HTTP2.MaxReadFrameSize = b.MaxFrameSize
+}
@@ -0,0 +1,13 @@
+//go:build !go1.24
+
+package server
+
+import "net/http"
+
+// HTTP/2 settings are only exposed by net/http from Go 1.24 on, so
+// ParseHTTPBuffers refuses a frame size before it.
+const http2Configurable = false
+
+func (b HTTPBuffers) Apply(srv *http.Server) {}
+
+func (b HTTPBuffers) ApplyTransport(t *http.Transport) {}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseHTTPBuffers(t *testing.T) {
+	tests := []struct {
+		spec string
+		want HTTPBuffers
+		err  bool
+	}{
+		{"", HTTPBuffers{}, false},
+		{"write=32KB", HTTPBuffers{WriteBuffer: 32 << 10}, false},
+		{"write=64KB, h2-frame=1MB", HTTPBuffers{WriteBuffer: 64 << 10, MaxFrameSize: 1 << 20}, false},
+		{"h2-frame=4KB", HTTPBuffers{}, true},
+		{"h2-frame=32MB", HTTPBuffers{}, true},
+		{"write=lots", HTTPBuffers{}, true},
+		{"read=4KB", HTTPBuffers{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHTTPBuffers(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: err = %v", tt.spec, err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("%q = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// writeCounter counts the writes that reach it.
+type writeCounter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestHTTPBuffersCoalesceWrites(t *testing.T) {
+	const events = 20
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for batch := 0; batch < 2; batch++ {
+			for i := 0; i < events/2; i++ {
+				fmt.Fprintf(w, "data: %d\n\n", i)
+			}
+			http.NewResponseController(w).Flush()
+		}
+		// Left unflushed, written out when the handler returns
+		fmt.Fprint(w, "data: last\n\n")
+	})
+	tests := []struct {
+		size   int
+		writes int
+	}{
+		{0, events + 1},
+		{4 << 10, 3},
+		// Smaller than an event: every write goes straight through
+		{8, events + 1},
+	}
+	for _, tt := range tests {
+		rec := &writeCounter{ResponseRecorder: httptest.NewRecorder()}
+		HTTPBuffers{WriteBuffer: tt.size}.Handler(handler).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.writes != tt.writes {
+			t.Errorf("write buffer %d: %d writes, want %d", tt.size, rec.writes, tt.writes)
+		}
+		if got := strings.Count(rec.Body.String(), "data: "); got != events+1 {
+			t.Errorf("write buffer %d: %d events written, want %d", tt.size, got, events+1)
+		}
+		if !rec.Flushed {
+			t.Errorf("write buffer %d: flush did not reach the response", tt.size)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import "net/url"
+
+// CancelReasonHeader carries why a proxy cancelled an upstream stream, on
+// the DELETE of CancelPath it sends once the stream is torn down, so the
+// upstream can account the generation it wasted to a cause.
+const CancelReasonHeader = "X-Cancel-Reason"
+
+// Reasons a proxy cancels an upstream stream.
+const (
+	// CancelClientGone: the client disconnected.
+	CancelClientGone = "client_gone"
+	// CancelSlowClient: the client fell too far behind and was dropped.
+	CancelSlowClient = "slow_client"
+	// CancelUpstreamIdle: the upstream sent nothing for the idle timeout.
+	CancelUpstreamIdle = "upstream_idle"
+	// CancelShutdown: the proxy closed the stream as it shut down.
+	CancelShutdown = "shutdown"
+	// CancelClientCommand: the client cancelled the stream with a command.
+	CancelClientCommand = "client_cancel"
+)
+
+// CancelPath is where the cancellation of the stream with the X-Stream-ID
+// streamID is reported.
+func CancelPath(streamID string) string {
+	return "/v1/streams/" + url.PathEscape(streamID)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"sort"
+)
+
+// CapacityResource is the utilization of one limited resource. Limit is 0
+// when the resource is not limited, and then Utilization and Headroom are
+// left out.
+type CapacityResource struct {
+	Used        int64    `json:"used"`
+	Limit       int64    `json:"limit,omitempty"`
+	Utilization *float64 `json:"utilization,omitempty"`
+	Headroom    *int64   `json:"headroom,omitempty"`
+	// PerStream is what one more stream is expected to cost.
+	PerStream float64 `json:"per_stream,omitempty"`
+	// HeadroomStreams is how many more streams fit in Headroom.
+	HeadroomStreams *int64 `json:"headroom_streams,omitempty"`
+}
+
+// CapacityReport summarizes how close a server is to its limits, as a
+// single signal for autoscaling: Utilization is the highest utilization of
+// any limited resource, Bottleneck names it, and HeadroomStreams is the
+// number of additional streams the tightest resource leaves room for.
+type CapacityReport struct {
+	Streams         int64                       `json:"streams"`
+	Utilization     float64                     `json:"utilization"`
+	Bottleneck      string                      `json:"bottleneck,omitempty"`
+	HeadroomStreams *int64                      `json:"headroom_streams,omitempty"`
+	Resources       map[string]CapacityResource `json:"resources"`
+}
+
+// NewCapacityReport starts a report for a server carrying streams streams.
+func NewCapacityReport(streams int64) *CapacityReport {
+	return &CapacityReport{Streams: streams, Resources: make(map[string]CapacityResource)}
+}
+
+// Add records a resource. perStream is the expected cost of one stream in
+// the resource's unit, or 0 if it cannot be estimated yet.
+func (r *CapacityReport) Add(name string, used, limit int64, perStream float64) {
+	res := CapacityResource{Used: used, Limit: limit, PerStream: perStream}
+	if limit > 0 {
+		utilization, headroom := float64(used)/float64(limit), max(limit-used, 0)
+		res.Utilization, res.Headroom = &utilization, &headroom
+		if perStream > 0 {
+			streams := int64(math.Floor(float64(headroom) / perStream))
+			res.HeadroomStreams = &streams
+		}
+	}
+	r.Resources[name] = res
+}
+
+// Finish fills in the summary fields from the resources added.
+func (r *CapacityReport) Finish() *CapacityReport {
+	names := make([]string, 0, len(r.Resources))
+	for name := range r.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res := r.Resources[name]
+		if res.Limit == 0 {
+			continue
+		}
+		if r.Bottleneck == "" || *res.Utilization > r.Utilization {
+			r.Utilization, r.Bottleneck = *res.Utilization, name
+		}
+		if res.HeadroomStreams != nil && (r.HeadroomStreams == nil || *res.HeadroomStreams < *r.HeadroomStreams) {
+			r.HeadroomStreams = res.HeadroomStreams
+		}
+	}
+	return r
+}
+
+// ProcessMemory returns the memory the Go runtime holds from the OS, which
+// is what a container memory limit is measured against, less what it has
+// already given back.
+func ProcessMemory() int64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.Sys - m.HeapReleased)
+}
+
+// OpenFiles returns the number of open file descriptors of the process and
+// its soft limit, or -1 for the count where the platform does not expose
+// it.
+func OpenFiles() (open, limit int64) {
+	open = -1
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// One of the entries is the descriptor reading the directory
+			open = int64(len(entries)) - 1
+			break
+		}
+	}
+	return open, fileLimit()
+}
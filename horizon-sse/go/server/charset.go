@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// highHalf maps the bytes 0x80-0xFF of a single-byte charset to runes.
+type highHalf [128]rune
+
+// latin1Runes returns the ISO-8859-1 mapping, where every byte is the code
+// point of the same value.
+func latin1Runes() *highHalf {
+	var t highHalf
+	for i := range t {
+		t[i] = rune(0x80 + i)
+	}
+	return &t
+}
+
+var (
+	// windows1252 is Latin-1 with printable characters in 0x80-0x9F. As
+	// in browsers it also serves the "iso-8859-1" label: those bytes are
+	// C1 controls in real Latin-1 and in practice always mean this.
+	windows1252 = func() *highHalf {
+		t := latin1Runes()
+		for b, r := range map[byte]rune{
+			0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†',
+			0x87: '‡', 0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ',
+			0x8E: 'Ž', 0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•',
+			0x96: '–', 0x97: '—', 0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›',
+			0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+		} {
+			t[b-0x80] = r
+		}
+		return t
+	}()
+
+	// iso885915 is Latin-9, Latin-1 with the euro sign and a few letters
+	// replacing rarely used symbols.
+	iso885915 = func() *highHalf {
+		t := latin1Runes()
+		for b, r := range map[byte]rune{
+			0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ',
+			0xBD: 'œ', 0xBE: 'Ÿ',
+		} {
+			t[b-0x80] = r
+		}
+		return t
+	}()
+
+	charsets = map[string]*highHalf{
+		"iso-8859-1":   windows1252,
+		"iso8859-1":    windows1252,
+		"latin1":       windows1252,
+		"l1":           windows1252,
+		"windows-1252": windows1252,
+		"cp1252":       windows1252,
+		"iso-8859-15":  iso885915,
+		"iso8859-15":   iso885915,
+		"latin9":       iso885915,
+	}
+)
+
+// IsUTF8Charset reports whether a Content-Type charset needs no
+// transcoding.
+func IsUTF8Charset(charset string) bool {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// NewUTF8Reader returns a reader that decodes r from charset to UTF-8, or r
+// itself if charset is UTF-8 already. Only single-byte Latin charsets are
+// supported.
+func NewUTF8Reader(r io.Reader, charset string) (io.Reader, error) {
+	if IsUTF8Charset(charset) {
+		return r, nil
+	}
+	table, ok := charsets[strings.ToLower(strings.TrimSpace(charset))]
+	if !ok {
+		return nil, fmt.Errorf("charset %q is not supported", charset)
+	}
+	return &singleByteReader{r: r, table: table}, nil
+}
+
+type singleByteReader struct {
+	r     io.Reader
+	table *highHalf
+	in    []byte
+	out   []byte
+	off   int
+	err   error
+}
+
+func (t *singleByteReader) Read(p []byte) (int, error) {
+	for t.off == len(t.out) {
+		if t.err != nil {
+			return 0, t.err
+		}
+		// Each input byte becomes at most 3 output bytes
+		size := len(p) / 3
+		if size < 1 {
+			size = 1
+		}
+		if cap(t.in) < size {
+			t.in = make([]byte, size)
+		}
+		n, err := t.r.Read(t.in[:size])
+		t.out, t.off, t.err = t.out[:0], 0, err
+		for _, b := range t.in[:n] {
+			if b < 0x80 {
+				t.out = append(t.out, b)
+			} else {
+				t.out = utf8.AppendRune(t.out, t.table[b-0x80])
+			}
+		}
+	}
+	n := copy(p, t.out[t.off:])
+	t.off += n
+	return n, nil
+}
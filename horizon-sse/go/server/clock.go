@@ -0,0 +1,224 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a server's simulated timing: token delays,
+// stream lengths and tickers. Swapping it lets tests run a long stream in
+// a fraction of the time while its delays keep their proportions.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker a Clock hands out.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// NewScaledClock returns a clock that runs speed times faster than the
+// wall clock from now on: its delays are speed times shorter, and the
+// times it reports advance speed times faster. A speed of 1 or less
+// returns SystemClock.
+func NewScaledClock(speed float64) Clock {
+	if speed <= 1 {
+		return SystemClock
+	}
+	now := time.Now()
+	return &scaledClock{speed: speed, origin: now, virtual: now}
+}
+
+type scaledClock struct {
+	speed   float64
+	origin  time.Time // wall time the clock started at
+	virtual time.Time // the time it reported then
+}
+
+func (c *scaledClock) Now() time.Time {
+	return c.virtual.Add(c.scaleUp(time.Since(c.origin)))
+}
+
+func (c *scaledClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+func (c *scaledClock) scaleUp(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * c.speed)
+}
+
+func (c *scaledClock) scaleDown(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / c.speed)
+}
+
+func (c *scaledClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	time.AfterFunc(c.scaleDown(d), func() { ch <- c.Now() })
+	return ch
+}
+
+func (c *scaledClock) NewTicker(d time.Duration) Ticker {
+	t := &scaledTicker{c: make(chan time.Time, 1), stop: make(chan struct{})}
+	wall := time.NewTicker(max(c.scaleDown(d), time.Microsecond))
+	go func() {
+		defer wall.Stop()
+		for {
+			select {
+			case <-wall.C:
+				// Drop ticks for slow receivers, like time.Ticker
+				select {
+				case t.c <- c.Now():
+				default:
+				}
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+type scaledTicker struct {
+	c    chan time.Time
+	stop chan struct{}
+	once sync.Once
+}
+
+func (t *scaledTicker) C() <-chan time.Time { return t.c }
+func (t *scaledTicker) Stop()               { t.once.Do(func() { close(t.stop) }) }
+
+// FakeClock is a clock that only moves when told to, for tests that step
+// through time themselves. Timers and tickers fire during Advance, in
+// order of their deadlines.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	changed chan struct{} // closed and replaced when waiters are added
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration // for tickers
+	c      chan time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start, changed: make(chan struct{})}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).c
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("server: non-positive interval for FakeClock.NewTicker")
+	}
+	return &fakeTicker{clock: c, w: c.add(d, d)}
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w
+	}
+	c.waiters = append(c.waiters, w)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return w
+}
+
+// Advance moves the clock forward by d, firing what falls due on the way.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+		if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.at
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = end
+}
+
+// Waiters returns the number of pending timers and tickers.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil waits until at least n timers and tickers are pending, so a
+// test can advance the clock once the code under test is waiting on it.
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		pending, changed := len(c.waiters), c.changed
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+func (c *FakeClock) remove(w *fakeWaiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	w     *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.c }
+func (t *fakeTicker) Stop()               { t.clock.remove(t.w) }
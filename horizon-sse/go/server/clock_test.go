@@ -0,0 +1,79 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockFiresInDeadlineOrder(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	late := clock.After(3 * time.Second)
+	early := clock.After(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-early:
+		t.Fatal("timer fired before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case at := <-early:
+		if want := start.Add(time.Second); !at.Equal(want) {
+			t.Errorf("early fired at %v, want %v", at, want)
+		}
+	default:
+		t.Fatal("timer did not fire at its deadline")
+	}
+	select {
+	case <-late:
+		t.Fatal("later timer fired early")
+	default:
+	}
+
+	clock.Advance(10 * time.Second)
+	<-late
+	if got, want := clock.Since(start), 11500*time.Millisecond; got != want {
+		t.Errorf("Since = %v, want %v", got, want)
+	}
+	if n := clock.Waiters(); n != 0 {
+		t.Errorf("Waiters = %d after all fired, want 0", n)
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+	for i := 1; i <= 3; i++ {
+		clock.Advance(time.Second)
+		if at := <-ticker.C(); at.Unix() != int64(i) {
+			t.Errorf("tick %d at %v", i, at.Unix())
+		}
+	}
+	ticker.Stop()
+	if n := clock.Waiters(); n != 0 {
+		t.Errorf("Waiters = %d after Stop, want 0", n)
+	}
+}
+
+func TestScaledClock(t *testing.T) {
+	if NewScaledClock(1) != SystemClock {
+		t.Error("a speed of 1 should return SystemClock")
+	}
+
+	clock := NewScaledClock(1000)
+	begin, wall := clock.Now(), time.Now()
+	select {
+	case <-clock.After(5 * time.Second):
+	case <-time.After(2 * time.Second):
+		t.Fatal("5s at 1000x took more than 2s")
+	}
+	if elapsed := clock.Since(begin); elapsed < 5*time.Second {
+		t.Errorf("clock advanced %v, want at least 5s", elapsed)
+	}
+	if real := time.Since(wall); real > time.Second {
+		t.Errorf("took %v of wall time", real)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultIdleLeakAfter is how long a keep-alive connection may sit idle
+// before it counts as leaked unless configured otherwise.
+const DefaultIdleLeakAfter = 5 * time.Minute
+
+// ConnStates follows the connections of an http.Server through their
+// states, to be set as its ConnState hook. Unlike the stream counters it
+// sees connections that never reach a handler, and keep-alive connections
+// between requests: idle ones that are never reused nor closed, such as
+// those of a client that leaks its transports on a server without an
+// IdleTimeout, pile up here and nowhere else.
+type ConnStates struct {
+	leakAfter time.Duration
+	mu        sync.Mutex
+	conns     map[net.Conn]connState
+	entered   map[http.ConnState]int64
+}
+
+type connState struct {
+	state http.ConnState
+	since time.Time
+}
+
+// ConnStateStats are the open connections by state, the transitions into
+// each state so far and the idle connections held past the leak threshold.
+type ConnStateStats struct {
+	Open              map[string]int   `json:"open"`
+	Transitions       map[string]int64 `json:"transitions"`
+	LeakedIdle        int              `json:"leaked_idle"`
+	OldestIdleSeconds float64          `json:"oldest_idle_seconds"`
+	LeakAfterSeconds  float64          `json:"leak_after_seconds"`
+}
+
+// NewConnStates returns a tracker counting connections idle for longer
+// than leakAfter as leaked; DefaultIdleLeakAfter if it is not positive.
+func NewConnStates(leakAfter time.Duration) *ConnStates {
+	if leakAfter <= 0 {
+		leakAfter = DefaultIdleLeakAfter
+	}
+	return &ConnStates{
+		leakAfter: leakAfter,
+		conns:     make(map[net.Conn]connState),
+		entered:   make(map[http.ConnState]int64),
+	}
+}
+
+// Track records a state transition; it is an http.Server ConnState hook.
+// Hijacked and closed connections are no longer the server's, so they
+// are only counted.
+func (c *ConnStates) Track(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entered[state]++
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(c.conns, conn)
+	default:
+		c.conns[conn] = connState{state: state, since: time.Now()}
+	}
+}
+
+func (c *ConnStates) Stats() ConnStateStats {
+	stats := ConnStateStats{
+		Open:             make(map[string]int),
+		Transitions:      make(map[string]int64),
+		LeakAfterSeconds: c.leakAfter.Seconds(),
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for state, n := range c.entered {
+		stats.Transitions[state.String()] = n
+	}
+	for _, cs := range c.conns {
+		stats.Open[cs.state.String()]++
+		if cs.state != http.StateIdle {
+			continue
+		}
+		idle := now.Sub(cs.since)
+		stats.OldestIdleSeconds = max(stats.OldestIdleSeconds, idle.Seconds())
+		if idle > c.leakAfter {
+			stats.LeakedIdle++
+		}
+	}
+	return stats
+}
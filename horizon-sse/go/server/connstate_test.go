@@ -0,0 +1,51 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnStates(t *testing.T) {
+	conns := NewConnStates(50 * time.Millisecond)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	srv.Config.ConnState = conns.Track
+	srv.Start()
+	defer srv.Close()
+
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// Both requests went over one keep-alive connection, now idle
+	waitFor(t, func() bool { return conns.Stats().Open["idle"] == 1 })
+	stats := conns.Stats()
+	if stats.Transitions["new"] != 1 || stats.Transitions["active"] != 2 {
+		t.Errorf("transitions = %v, want 1 new and 2 active", stats.Transitions)
+	}
+	if stats.LeakedIdle != 0 {
+		t.Errorf("leaked_idle = %d before the threshold", stats.LeakedIdle)
+	}
+
+	waitFor(t, func() bool { return conns.Stats().LeakedIdle == 1 })
+	if oldest := conns.Stats().OldestIdleSeconds; oldest < 0.05 {
+		t.Errorf("oldest_idle_seconds = %v, want past the threshold", oldest)
+	}
+
+	transport.CloseIdleConnections()
+	waitFor(t, func() bool { return conns.Stats().Transitions["closed"] == 1 })
+	if stats := conns.Stats(); len(stats.Open) != 0 || stats.LeakedIdle != 0 {
+		t.Errorf("after close: open = %v, leaked_idle = %d", stats.Open, stats.LeakedIdle)
+	}
+}
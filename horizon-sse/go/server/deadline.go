@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// DeadlineWriter bounds every write and flush of a streaming response by
+// a deadline, so a client that stops reading cannot hold the handler, and
+// the upstream it relays, for as long as the connection stays up. The
+// deadline is lifted between writes, so a stream may be idle for any time.
+// A write that runs into it breaks the connection: TimedOut then reports
+// it, and every later write fails.
+type DeadlineWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	timeout  time.Duration
+	timedOut int32
+}
+
+// NewDeadlineWriter returns w with every write bounded by timeout; zero,
+// or a writer whose connection has no deadlines, leaves them unbounded.
+func NewDeadlineWriter(w http.ResponseWriter, timeout time.Duration) *DeadlineWriter {
+	return &DeadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}
+}
+
+func (w *DeadlineWriter) Write(p []byte) (int, error) {
+	start := w.arm()
+	n, err := w.ResponseWriter.Write(p)
+	w.disarm(start, err)
+	return n, err
+}
+
+func (w *DeadlineWriter) Flush() {
+	start := w.arm()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	w.disarm(start, nil)
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer.
+func (w *DeadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TimedOut reports whether a write or flush ran into the deadline.
+func (w *DeadlineWriter) TimedOut() bool {
+	return atomic.LoadInt32(&w.timedOut) != 0
+}
+
+func (w *DeadlineWriter) arm() time.Time {
+	start := time.Now()
+	if w.timeout > 0 && w.rc != nil {
+		if w.rc.SetWriteDeadline(start.Add(w.timeout)) != nil {
+			// Not a connection that has deadlines
+			w.rc = nil
+		}
+	}
+	return start
+}
+
+// disarm lifts the deadline after a write that started at start. A flush
+// that ran into it has no error to show, but took as long.
+func (w *DeadlineWriter) disarm(start time.Time, err error) {
+	if w.timeout <= 0 || w.rc == nil {
+		return
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) || time.Since(start) >= w.timeout {
+		atomic.StoreInt32(&w.timedOut, 1)
+		return
+	}
+	w.rc.SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadlineWriter(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	timedOut := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dw := NewDeadlineWriter(w, timeout)
+		if r.URL.Path == "/idle" {
+			// Idle time between writes is not bounded
+			fmt.Fprint(dw, "data: a\n\n")
+			dw.Flush()
+			time.Sleep(3 * timeout)
+			fmt.Fprint(dw, "data: b\n\n")
+			dw.Flush()
+			timedOut <- dw.TimedOut()
+			return
+		}
+		chunk := strings.Repeat("x", 64<<10)
+		for start := time.Now(); time.Since(start) < 10*time.Second; {
+			if _, err := fmt.Fprint(dw, chunk); err != nil || dw.TimedOut() {
+				break
+			}
+			dw.Flush()
+			if dw.TimedOut() {
+				break
+			}
+		}
+		timedOut <- dw.TimedOut()
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(resp.Body)
+	var body strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		body.WriteString(line)
+		if err != nil {
+			break
+		}
+	}
+	resp.Body.Close()
+	if <-timedOut || body.String() != "data: a\n\ndata: b\n\n" {
+		t.Errorf("idle stream timed out, got %q", body.String())
+	}
+
+	// A client that never reads
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /stuck HTTP/1.1\r\nHost: test\r\n\r\n")
+	select {
+	case got := <-timedOut:
+		if !got {
+			t.Error("stuck client not timed out")
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("handler still writing")
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventIDStrategy selects how the id: field of outgoing events is assigned.
+type EventIDStrategy string
+
+const (
+	// EventIDMonotonic numbers events 1, 2, 3... within each stream.
+	EventIDMonotonic EventIDStrategy = "monotonic"
+	// EventIDSnowflake gives every event a process-wide unique, time-ordered ID.
+	EventIDSnowflake EventIDStrategy = "snowflake"
+	// EventIDPassthrough keeps whatever ID the event already carries.
+	EventIDPassthrough EventIDStrategy = "passthrough"
+)
+
+// ParseEventIDStrategy validates a strategy name.
+func ParseEventIDStrategy(name string) (EventIDStrategy, error) {
+	switch st := EventIDStrategy(strings.TrimSpace(name)); st {
+	case EventIDMonotonic, EventIDSnowflake, EventIDPassthrough:
+		return st, nil
+	default:
+		return "", fmt.Errorf("unknown event id strategy %q", name)
+	}
+}
+
+// EventIDRoutes maps route paths to the strategy used for their streams.
+// Routes without an entry use Default.
+type EventIDRoutes struct {
+	Default EventIDStrategy
+	Routes  map[string]EventIDStrategy
+}
+
+// ParseEventIDRoutes parses a spec such as "monotonic" or
+// "passthrough,/sse=snowflake". Entries without a route set the default.
+func ParseEventIDRoutes(spec string, def EventIDStrategy) (EventIDRoutes, error) {
+	routes := EventIDRoutes{Default: def, Routes: map[string]EventIDStrategy{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, name, hasRoute := strings.Cut(entry, "=")
+		if !hasRoute {
+			name = route
+		}
+		st, err := ParseEventIDStrategy(name)
+		if err != nil {
+			return routes, err
+		}
+		if hasRoute {
+			routes.Routes[strings.TrimSpace(route)] = st
+		} else {
+			routes.Default = st
+		}
+	}
+	return routes, nil
+}
+
+// For returns the strategy configured for route.
+func (r EventIDRoutes) For(route string) EventIDStrategy {
+	if st, ok := r.Routes[route]; ok {
+		return st
+	}
+	if r.Default == "" {
+		return EventIDPassthrough
+	}
+	return r.Default
+}
+
+// EventIDGenerator assigns IDs to the events of a single stream.
+type EventIDGenerator interface {
+	// Next returns the ID for the next event. upstreamID is the ID the
+	// event arrived with, if any.
+	Next(upstreamID string) string
+}
+
+// NewGenerator returns a fresh generator for one stream.
+func (st EventIDStrategy) NewGenerator() EventIDGenerator {
+	switch st {
+	case EventIDMonotonic:
+		return &monotonicIDs{}
+	case EventIDSnowflake:
+		return snowflakeIDs{}
+	default:
+		return passthroughIDs{}
+	}
+}
+
+type monotonicIDs struct {
+	n int64
+}
+
+func (g *monotonicIDs) Next(string) string {
+	g.n++
+	return strconv.FormatInt(g.n, 10)
+}
+
+type passthroughIDs struct{}
+
+func (passthroughIDs) Next(upstreamID string) string {
+	return upstreamID
+}
+
+type snowflakeIDs struct{}
+
+func (snowflakeIDs) Next(string) string {
+	return strconv.FormatInt(globalSnowflake.next(), 10)
+}
+
+// Snowflake IDs are 41 bits of milliseconds since snowflakeEpoch, 10 bits
+// of node ID and 12 bits of per-millisecond sequence.
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeMaxNode  = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq   = 1<<snowflakeSeqBits - 1
+)
+
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var globalSnowflake = &snowflake{}
+
+type snowflake struct {
+	mu     sync.Mutex
+	node   int64
+	lastMs int64
+	seq    int64
+}
+
+// SetSnowflakeNodeID sets the node part of snowflake event IDs. Instances
+// sharing consumers should use distinct node IDs.
+func SetSnowflakeNodeID(node int64) error {
+	if node < 0 || node > snowflakeMaxNode {
+		return fmt.Errorf("snowflake node id must be between 0 and %d", snowflakeMaxNode)
+	}
+	globalSnowflake.mu.Lock()
+	globalSnowflake.node = node
+	globalSnowflake.mu.Unlock()
+	return nil
+}
+
+func (sf *snowflake) next() int64 {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	now := time.Since(snowflakeEpoch).Milliseconds()
+	if now < sf.lastMs {
+		// Clock went backwards; keep IDs ordered by staying on the last ms.
+		now = sf.lastMs
+	}
+	if now == sf.lastMs {
+		sf.seq = (sf.seq + 1) & snowflakeMaxSeq
+		if sf.seq == 0 {
+			for now <= sf.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				now = time.Since(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		sf.seq = 0
+	}
+	sf.lastMs = now
+
+	return now<<(snowflakeNodeBits+snowflakeSeqBits) | sf.node<<snowflakeSeqBits | sf.seq
+}
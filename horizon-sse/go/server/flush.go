@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSlowFlush is the flush duration past which a flush counts as slow
+// unless configured otherwise.
+const DefaultSlowFlush = 50 * time.Millisecond
+
+// flushBuckets are the upper bounds of the flush latency histogram. A
+// healthy flush copies into the kernel's send buffer in microseconds; one
+// that takes milliseconds waited for the buffer to drain.
+var flushBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// FlushMonitor times the flushes of streaming responses. A flush blocks
+// while the socket's send buffer is full, so slow flushes point at a slow
+// client or kernel buffer pressure rather than at the server.
+type FlushMonitor struct {
+	slowAfter time.Duration
+	latency   *LatencyRecorder
+	slow      int64
+}
+
+// FlushStats is the flush latency histogram and the number of flushes
+// slower than the threshold.
+type FlushStats struct {
+	Latency     Histogram `json:"latency"`
+	Slow        int64     `json:"slow"`
+	SlowAfterMs float64   `json:"slow_after_ms"`
+}
+
+// NewFlushMonitor returns a monitor counting flushes longer than slowAfter
+// as slow; DefaultSlowFlush if it is not positive.
+func NewFlushMonitor(slowAfter time.Duration) *FlushMonitor {
+	if slowAfter <= 0 {
+		slowAfter = DefaultSlowFlush
+	}
+	return &FlushMonitor{slowAfter: slowAfter, latency: NewLatencyRecorder(flushBuckets...)}
+}
+
+// Flush flushes f and records how long it took. It returns the duration
+// and whether it was slow, for the caller to log with its stream.
+func (m *FlushMonitor) Flush(f http.Flusher) (time.Duration, bool) {
+	start := time.Now()
+	f.Flush()
+	d := time.Since(start)
+	m.latency.Observe(d)
+	if d <= m.slowAfter {
+		return d, false
+	}
+	atomic.AddInt64(&m.slow, 1)
+	return d, true
+}
+
+// SlowAfter is the threshold past which a flush is slow.
+func (m *FlushMonitor) SlowAfter() time.Duration {
+	return m.slowAfter
+}
+
+func (m *FlushMonitor) Stats() FlushStats {
+	return FlushStats{
+		Latency:     m.latency.Snapshot(),
+		Slow:        atomic.LoadInt64(&m.slow),
+		SlowAfterMs: float64(m.slowAfter) / float64(time.Millisecond),
+	}
+}
+
+// StreamFlushes tracks the slow flushes of one stream, so its first slow
+// flush is logged as it happens and the rest only counted for the summary
+// at the end of the stream.
+type StreamFlushes struct {
+	Slow    int
+	Slowest time.Duration
+}
+
+// Record notes a flush of the stream. It returns true for the first slow
+// one, which the caller logs.
+func (s *StreamFlushes) Record(d time.Duration, slow bool) bool {
+	s.Slowest = max(s.Slowest, d)
+	if !slow {
+		return false
+	}
+	s.Slow++
+	return s.Slow == 1
+}
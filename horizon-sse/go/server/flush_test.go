@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+type sleepyFlusher time.Duration
+
+func (f sleepyFlusher) Flush() { time.Sleep(time.Duration(f)) }
+
+func TestFlushMonitor(t *testing.T) {
+	m := NewFlushMonitor(20 * time.Millisecond)
+	var stream StreamFlushes
+	var logged int
+	for _, f := range []sleepyFlusher{0, sleepyFlusher(30 * time.Millisecond), 0, sleepyFlusher(25 * time.Millisecond)} {
+		if stream.Record(m.Flush(f)) {
+			logged++
+		}
+	}
+	if logged != 1 || stream.Slow != 2 || stream.Slowest < 30*time.Millisecond {
+		t.Errorf("logged %d, stream %+v; want the first of 2 slow flushes logged", logged, stream)
+	}
+	st := m.Stats()
+	if st.Slow != 2 || st.Latency.Count != 4 || st.SlowAfterMs != 20 {
+		t.Errorf("stats = %+v", st)
+	}
+	if NewFlushMonitor(0).SlowAfter() != DefaultSlowFlush {
+		t.Error("zero threshold did not default")
+	}
+}
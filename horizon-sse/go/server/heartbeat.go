@@ -0,0 +1,161 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HeartbeatComment is what a heartbeat writes: an SSE comment, which
+// clients skip.
+const HeartbeatComment = ": ping\n\n"
+
+// Heartbeats keeps idle streams alive: a stream that has written nothing
+// for an interval, such as one waiting on a slow generation, gets a
+// HeartbeatComment, so proxies, load balancers and clients with idle
+// timeouts don't cut it off.
+type Heartbeats struct {
+	interval time.Duration
+	sent     int64
+}
+
+// HeartbeatStats is the heartbeat interval and how many have been sent.
+type HeartbeatStats struct {
+	IntervalMs float64 `json:"interval_ms"`
+	Sent       int64   `json:"sent"`
+}
+
+// NewHeartbeats returns heartbeats sent every interval of idleness; zero
+// disables them.
+func NewHeartbeats(interval time.Duration) *Heartbeats {
+	if interval < 0 {
+		interval = 0
+	}
+	return &Heartbeats{interval: interval}
+}
+
+// Interval is how long a stream may be idle before a heartbeat.
+func (h *Heartbeats) Interval() time.Duration {
+	return h.interval
+}
+
+// Wrap returns the writer a streaming handler writes w through, and the
+// func to call once it is done writing, before it returns. Heartbeats
+// only go out once the handler has flushed its headers, and only between
+// events: while something written is still waiting for a flush, the
+// stream isn't idle. With heartbeats disabled it returns w.
+func (h *Heartbeats) Wrap(w http.ResponseWriter) (http.ResponseWriter, func()) {
+	if h == nil || h.interval <= 0 {
+		return w, func() {}
+	}
+	hw := &heartbeatWriter{
+		ResponseWriter: w,
+		h:              h,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go hw.run()
+	return hw, hw.Stop
+}
+
+func (h *Heartbeats) Stats() HeartbeatStats {
+	if h == nil {
+		return HeartbeatStats{}
+	}
+	return HeartbeatStats{
+		IntervalMs: float64(h.interval) / float64(time.Millisecond),
+		Sent:       atomic.LoadInt64(&h.sent),
+	}
+}
+
+// heartbeatWriter serializes the handler's writes and flushes with the
+// heartbeats sent between them.
+type heartbeatWriter struct {
+	http.ResponseWriter
+	h *Heartbeats
+
+	mu      sync.Mutex
+	flushed bool      // the headers are out
+	pending bool      // written since the last flush
+	last    time.Time // of the last write or heartbeat
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (w *heartbeatWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = true
+	w.last = time.Now()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *heartbeatWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flush()
+}
+
+func (w *heartbeatWriter) flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	if !w.flushed {
+		w.last = time.Now()
+	}
+	w.flushed = true
+	w.pending = false
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer.
+func (w *heartbeatWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Stop ends the heartbeats and waits for one being written, so none is
+// written once the handler has returned.
+func (w *heartbeatWriter) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+	})
+}
+
+func (w *heartbeatWriter) run() {
+	defer close(w.done)
+	timer := time.NewTimer(w.h.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+		}
+		timer.Reset(w.beat())
+	}
+}
+
+// beat sends a heartbeat if the stream is idle, and returns how long to
+// wait before looking again.
+func (w *heartbeatWriter) beat() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.flushed || w.pending {
+		return w.h.interval
+	}
+	if idle := time.Since(w.last); idle < w.h.interval {
+		return w.h.interval - idle
+	}
+	if _, err := io.WriteString(w.ResponseWriter, HeartbeatComment); err != nil {
+		// The client is gone; the handler finds out on its next write
+		return w.h.interval
+	}
+	w.flush()
+	w.last = time.Now()
+	atomic.AddInt64(&w.h.sent, 1)
+	return w.h.interval
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeats(t *testing.T) {
+	h := NewHeartbeats(20 * time.Millisecond)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, stop := h.Wrap(w)
+		defer stop()
+		if r.URL.Path == "/fail" {
+			// Nothing goes out before the headers do
+			time.Sleep(70 * time.Millisecond)
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(70 * time.Millisecond)
+		// Nor in the middle of an event
+		fmt.Fprint(w, "data: a\n")
+		time.Sleep(70 * time.Millisecond)
+		fmt.Fprint(w, "\n")
+		w.(http.Flusher).Flush()
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	beats := strings.Count(string(body), HeartbeatComment)
+	if beats == 0 || string(body) != strings.Repeat(HeartbeatComment, beats)+"data: a\n\n" {
+		t.Errorf("body %q, want heartbeats then the event", body)
+	}
+	if st := h.Stats(); st.Sent != int64(beats) || st.IntervalMs != 20 {
+		t.Errorf("stats %+v, %d heartbeats received", st, beats)
+	}
+
+	resp, err = http.Get(srv.URL + "/fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || strings.Contains(string(body), "ping") {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+
+	w := httptest.NewRecorder()
+	if got, _ := NewHeartbeats(0).Wrap(w); got != http.ResponseWriter(w) {
+		t.Error("disabled heartbeats wrapped the writer")
+	}
+}
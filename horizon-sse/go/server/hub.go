@@ -0,0 +1,386 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a message published to a Hub topic.
+type Event struct {
+	ID   string
+	Type string
+	Data string
+	// Key identifies what the event describes on a state channel, which
+	// keeps the latest event per key. It is not sent to clients.
+	Key string
+	// Retry, if set, is sent as the client's reconnection delay.
+	Retry time.Duration
+	// Topic is the topic the event was published on, set by the hub on
+	// the events it delivers. Format does not send it.
+	Topic string
+}
+
+// Format renders the event in SSE wire format, including the blank line
+// that terminates it.
+func (e Event) Format() string {
+	var b strings.Builder
+	if e.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", e.ID)
+	}
+	if e.Type != "" {
+		fmt.Fprintf(&b, "event: %s\n", e.Type)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Hub fans events published on a topic out to every subscriber of that
+// topic. Delivery never blocks the publisher: what happens to a subscriber
+// whose buffer is full depends on the topic's ChannelPolicy.
+type Hub struct {
+	mu        sync.RWMutex
+	topics    map[string]map[*Subscription]struct{}
+	wildcards map[*Subscription]struct{} // subscribed to "prefix*" patterns
+	policies  ChannelPolicies
+	metrics   *hubMetrics
+
+	statePatterns map[string]struct{}
+	stateMu       sync.Mutex
+	states        map[string]*stateChannel
+}
+
+// Subscription receives the events of its topics on C until Close is
+// called.
+type Subscription struct {
+	C <-chan Event
+
+	ch       chan Event
+	hub      *Hub
+	topics   []string
+	patterns []string
+	policy   ChannelPolicy
+	once     sync.Once
+	err      error
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		topics:    make(map[string]map[*Subscription]struct{}),
+		wildcards: make(map[*Subscription]struct{}),
+		policies:  DefaultChannelPolicies(),
+		metrics:   newHubMetrics(),
+		states:    make(map[string]*stateChannel),
+	}
+}
+
+// SetChannelPolicies replaces the per-channel subscriber policies. Existing
+// subscriptions keep the policy they were created with.
+func (h *Hub) SetChannelPolicies(policies ChannelPolicies) {
+	h.mu.Lock()
+	h.policies = policies
+	h.mu.Unlock()
+}
+
+// Subscribe registers a subscriber for topic with room for buffer pending
+// events, unless the topic's policy sets its own buffer size. On a state
+// channel C starts with the snapshot, which does not count against buffer.
+func (h *Hub) Subscribe(topic string, buffer int) *Subscription {
+	return h.subscribe([]string{topic}, nil, buffer)
+}
+
+// SubscribeTopics registers one subscriber for several topics, each a name
+// or a "prefix*" pattern matching every topic with that prefix, so a
+// client can follow a family of topics on one connection. Events carry the
+// topic they were published on; one published on a topic the subscriber
+// matches twice is delivered once. The subscription takes the policy of
+// its first topic. On state channels C starts with the snapshot of each,
+// including those a pattern matches that have retained events.
+func (h *Hub) SubscribeTopics(topics []string, buffer int) *Subscription {
+	var names, patterns []string
+	for _, topic := range topics {
+		if strings.HasSuffix(topic, "*") {
+			patterns = append(patterns, topic)
+		} else {
+			names = append(names, topic)
+		}
+	}
+	return h.subscribe(names, patterns, buffer)
+}
+
+func (h *Hub) subscribe(topics, patterns []string, buffer int) *Subscription {
+	h.mu.Lock()
+	policy := h.policies.For(append(topics, patterns...)[0])
+	if policy.Buffer > 0 {
+		buffer = policy.Buffer
+	}
+	if buffer < 1 {
+		buffer = 1
+	}
+	var snapshot []Event
+	for _, topic := range h.snapshotTopics(topics, patterns) {
+		for _, ev := range h.snapshotEvents(topic) {
+			ev.Topic = topic
+			snapshot = append(snapshot, ev)
+		}
+	}
+	ch := make(chan Event, len(snapshot)+buffer)
+	for _, ev := range snapshot {
+		ch <- ev
+	}
+	sub := &Subscription{C: ch, ch: ch, hub: h, topics: topics, patterns: patterns, policy: policy}
+
+	for _, topic := range topics {
+		subs, ok := h.topics[topic]
+		if !ok {
+			subs = make(map[*Subscription]struct{})
+			h.topics[topic] = subs
+		}
+		subs[sub] = struct{}{}
+	}
+	if len(patterns) > 0 {
+		h.wildcards[sub] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	// Start tracking the channels so their subscribers are reported even
+	// before anything is published
+	for _, topic := range topics {
+		h.metrics.channel(topic)
+	}
+	for _, pattern := range patterns {
+		h.metrics.pattern(pattern)
+	}
+
+	return sub
+}
+
+// snapshotTopics lists the topics a new subscriber to topics and patterns
+// gets the snapshot of, each once: those named, and the state channels
+// with retained events that a pattern matches. Callers hold h.mu.
+func (h *Hub) snapshotTopics(topics, patterns []string) []string {
+	seen := make(map[string]bool, len(topics))
+	var out []string
+	for _, topic := range topics {
+		if !seen[topic] {
+			seen[topic] = true
+			out = append(out, topic)
+		}
+	}
+	if len(patterns) == 0 {
+		return out
+	}
+	h.stateMu.Lock()
+	var matched []string
+	for topic := range h.states {
+		if !seen[topic] && matchesPattern(patterns, topic) != "" {
+			matched = append(matched, topic)
+		}
+	}
+	h.stateMu.Unlock()
+	sort.Strings(matched)
+	return append(out, matched...)
+}
+
+// matchesPattern returns the first of patterns ("prefix*") that matches
+// topic, or "" if none does.
+func matchesPattern(patterns []string, topic string) string {
+	for _, p := range patterns {
+		if strings.HasPrefix(topic, strings.TrimSuffix(p, "*")) {
+			return p
+		}
+	}
+	return ""
+}
+
+// wildcardMatch returns the pattern by which sub, a wildcard subscriber,
+// gets the events of topic, or "" if it does not or already gets them by
+// name. Callers hold h.mu.
+func (h *Hub) wildcardMatch(sub *Subscription, topic string) string {
+	if _, named := h.topics[topic][sub]; named {
+		return ""
+	}
+	return matchesPattern(sub.patterns, topic)
+}
+
+// Close unsubscribes and closes C. It is safe to call more than once.
+func (sub *Subscription) Close() {
+	sub.close(nil)
+}
+
+// Err reports why C was closed: ErrSlowConsumer if the subscriber fell
+// behind on a disconnect-policy topic, nil if Close was called. Only call it
+// after C has been closed.
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+func (sub *Subscription) close(err error) {
+	sub.once.Do(func() {
+		sub.err = err
+		h := sub.hub
+		h.mu.Lock()
+		for _, topic := range sub.topics {
+			if subs, ok := h.topics[topic]; ok {
+				delete(subs, sub)
+				if len(subs) == 0 {
+					delete(h.topics, topic)
+				}
+			}
+		}
+		delete(h.wildcards, sub)
+		h.mu.Unlock()
+		close(sub.ch)
+	})
+}
+
+// Publish delivers ev to the current subscribers of topic and returns how
+// many of them received it.
+func (h *Hub) Publish(topic string, ev Event) int {
+	start := time.Now()
+	var d delivery
+	h.mu.RLock()
+	h.fanout(topic, ev, &d, nil)
+	h.mu.RUnlock()
+
+	// Closing takes the write lock, so evictions wait until delivery is done
+	for _, sub := range d.evicted {
+		sub.close(ErrSlowConsumer)
+	}
+	h.metrics.channel(topic).record(ev.Type, d, time.Since(start))
+	return d.delivered
+}
+
+// PublishBatch delivers events to the subscribers of topic as one unit: no
+// other event is published in between, so subscribers see the batch
+// contiguously and in order. It returns the total number of deliveries.
+func (h *Hub) PublishBatch(topic string, events []Event) int {
+	if len(events) == 0 {
+		return 0
+	}
+	start := time.Now()
+	results := make([]delivery, len(events))
+	evicted := make(map[*Subscription]bool)
+	h.mu.Lock()
+	for i, ev := range events {
+		h.fanout(topic, ev, &results[i], evicted)
+		for _, sub := range results[i].evicted {
+			evicted[sub] = true
+		}
+	}
+	h.mu.Unlock()
+
+	for sub := range evicted {
+		sub.close(ErrSlowConsumer)
+	}
+	total := 0
+	m := h.metrics.channel(topic)
+	took := time.Since(start) / time.Duration(len(events))
+	for i, ev := range events {
+		m.record(ev.Type, results[i], took)
+		total += results[i].delivered
+	}
+	return total
+}
+
+// fanout applies ev to the retained state of topic and hands it to every
+// subscriber not in skip, by name or by pattern. Callers hold h.mu, for
+// reading or writing, so that Subscribe sees each event either in the
+// snapshot or live.
+func (h *Hub) fanout(topic string, ev Event, d *delivery, skip map[*Subscription]bool) {
+	ev.Topic = topic
+	if st := h.state(topic, true); st != nil {
+		st.apply(ev)
+	}
+	for sub := range h.topics[topic] {
+		if !skip[sub] {
+			sub.deliver(ev, d)
+		}
+	}
+	for sub := range h.wildcards {
+		if skip[sub] {
+			continue
+		}
+		if pattern := h.wildcardMatch(sub, topic); pattern != "" {
+			before := d.delivered
+			sub.deliver(ev, d)
+			if d.delivered > before {
+				h.metrics.pattern(pattern).delivered(1)
+			}
+		}
+	}
+}
+
+// CloseTopic ends the subscriptions to topic by name, for a topic that
+// will publish nothing more: each gets the events it has buffered, then C
+// closes with a nil Err. Unlike a final event, the end cannot be dropped
+// by the topic's overflow policy.
+func (h *Hub) CloseTopic(topic string) {
+	h.mu.RLock()
+	subs := make([]*Subscription, 0, len(h.topics[topic]))
+	for sub := range h.topics[topic] {
+		subs = append(subs, sub)
+	}
+	h.mu.RUnlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// Subscribers returns the number of subscribers of topic, by name or by
+// pattern.
+func (h *Hub) Subscribers(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := len(h.topics[topic])
+	for sub := range h.wildcards {
+		if h.wildcardMatch(sub, topic) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// ServeSSE streams the events of topic to the client until it disconnects.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request, topic string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := h.Subscribe(topic, 16)
+	defer sub.Close()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprint(w, ev.Format()); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
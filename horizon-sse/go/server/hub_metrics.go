@@ -0,0 +1,401 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// OtherChannel collects the metrics of channels beyond the tracked
+	// limit, and OtherEventType those of event types beyond theirs.
+	OtherChannel   = "_other"
+	OtherEventType = "_other"
+
+	defaultMaxTrackedChannels = 100
+	maxTrackedEventTypes      = 20
+
+	// Publish rates are averaged over this many seconds.
+	rateWindow = 10
+)
+
+// fanoutBuckets are the upper bounds of the fan-out latency histogram: the
+// time one Publish takes to hand an event to every subscriber.
+var fanoutBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// ChannelStats describes the traffic of one channel.
+type ChannelStats struct {
+	Subscribers int `json:"subscribers"`
+	// RetainedKeys is the size of a state channel's snapshot.
+	RetainedKeys int   `json:"retained_keys,omitempty"`
+	Published    int64 `json:"published"`
+	Delivered    int64 `json:"delivered"`
+	// Dropped counts events subscribers lost to the overflow policy, either
+	// new ones or buffered ones evicted to make room.
+	Dropped int64 `json:"dropped"`
+	// Disconnected counts subscribers closed by OverflowDisconnect.
+	Disconnected int64 `json:"disconnected"`
+	// Policy is the channel's overflow policy and PolicyActivations how
+	// often each policy found a subscriber's buffer full.
+	Policy            OverflowPolicy   `json:"policy,omitempty"`
+	PolicyActivations map[string]int64 `json:"policy_activations,omitempty"`
+	PublishRate       float64          `json:"publish_rate"`
+	EventTypes        map[string]int64 `json:"event_types,omitempty"`
+	FanoutLatency     Histogram        `json:"fanout_latency"`
+}
+
+// Histogram is a cumulative latency histogram.
+type Histogram struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   int64             `json:"count"`
+	SumMs   float64           `json:"sum_ms"`
+}
+
+type HistogramBucket struct {
+	// LE is the bucket's upper bound in milliseconds, or "+Inf".
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// HubStats is a snapshot of a Hub's metrics. Channels holds at most
+// MaxChannels entries plus OtherChannel; Totals covers every channel.
+// Patterns, bounded the same way, covers the "prefix*" subscriptions.
+type HubStats struct {
+	Channels    map[string]ChannelStats `json:"channels"`
+	Totals      ChannelStats            `json:"totals"`
+	Patterns    map[string]PatternStats `json:"patterns,omitempty"`
+	MaxChannels int                     `json:"max_channels"`
+}
+
+// PatternStats describes the subscribers of one pattern: how many there
+// are and how many events of the topics it matches they were handed. Their
+// deliveries also count in the Delivered of each topic.
+type PatternStats struct {
+	Subscribers int   `json:"subscribers"`
+	Delivered   int64 `json:"delivered"`
+}
+
+// patternMetrics counts the deliveries to the subscribers of one pattern.
+type patternMetrics struct {
+	count int64
+}
+
+func (m *patternMetrics) delivered(n int64) {
+	atomic.AddInt64(&m.count, n)
+}
+
+// channelMetrics accumulates the metrics of one channel (or of the
+// OtherChannel aggregate).
+type channelMetrics struct {
+	published    int64
+	delivered    int64
+	dropped      int64
+	disconnected int64
+	fanoutNs     int64
+	fanout       []int64 // one count per bucket, plus +Inf
+
+	mu          sync.Mutex
+	eventTypes  map[string]int64
+	activations map[string]int64
+	rate        [rateWindow]int64
+	rateSec     int64
+}
+
+func newChannelMetrics() *channelMetrics {
+	return &channelMetrics{
+		fanout:      make([]int64, len(fanoutBuckets)+1),
+		eventTypes:  make(map[string]int64),
+		activations: make(map[string]int64),
+	}
+}
+
+func (m *channelMetrics) record(eventType string, d delivery, took time.Duration) {
+	atomic.AddInt64(&m.published, 1)
+	atomic.AddInt64(&m.delivered, int64(d.delivered))
+	atomic.AddInt64(&m.dropped, int64(d.dropped))
+	atomic.AddInt64(&m.disconnected, int64(len(d.evicted)))
+	atomic.AddInt64(&m.fanoutNs, int64(took))
+	i := sort.Search(len(fanoutBuckets), func(i int) bool { return took <= fanoutBuckets[i] })
+	atomic.AddInt64(&m.fanout[i], 1)
+
+	if eventType == "" {
+		eventType = "message"
+	}
+	now := time.Now().Unix()
+	m.mu.Lock()
+	if _, ok := m.eventTypes[eventType]; ok || len(m.eventTypes) < maxTrackedEventTypes {
+		m.eventTypes[eventType]++
+	} else {
+		m.eventTypes[OtherEventType]++
+	}
+	for p, n := range d.activations {
+		m.activations[string(p)] += int64(n)
+	}
+	m.advance(now)
+	m.rate[now%rateWindow]++
+	m.mu.Unlock()
+}
+
+// advance clears the rate buckets of the seconds that passed since the last
+// event. Callers hold mu.
+func (m *channelMetrics) advance(now int64) {
+	if now <= m.rateSec {
+		return
+	}
+	for sec := m.rateSec + 1; sec <= now && sec <= m.rateSec+rateWindow; sec++ {
+		m.rate[sec%rateWindow] = 0
+	}
+	m.rateSec = now
+}
+
+func (m *channelMetrics) snapshot() ChannelStats {
+	st := ChannelStats{
+		Published:    atomic.LoadInt64(&m.published),
+		Delivered:    atomic.LoadInt64(&m.delivered),
+		Dropped:      atomic.LoadInt64(&m.dropped),
+		Disconnected: atomic.LoadInt64(&m.disconnected),
+	}
+
+	m.mu.Lock()
+	m.advance(time.Now().Unix())
+	var recent int64
+	for _, n := range m.rate {
+		recent += n
+	}
+	st.PublishRate = float64(recent) / rateWindow
+	st.EventTypes = make(map[string]int64, len(m.eventTypes))
+	for t, n := range m.eventTypes {
+		st.EventTypes[t] = n
+	}
+	if len(m.activations) > 0 {
+		st.PolicyActivations = make(map[string]int64, len(m.activations))
+		for p, n := range m.activations {
+			st.PolicyActivations[p] = n
+		}
+	}
+	m.mu.Unlock()
+
+	counts := make([]int64, len(m.fanout))
+	for i := range counts {
+		counts[i] = atomic.LoadInt64(&m.fanout[i])
+	}
+	st.FanoutLatency = newHistogram(fanoutBuckets, counts, atomic.LoadInt64(&m.fanoutNs))
+	return st
+}
+
+// newHistogram builds a Histogram from per-bucket counts, one per bound
+// plus the overflow bucket.
+func newHistogram(bounds []time.Duration, counts []int64, sumNs int64) Histogram {
+	h := Histogram{SumMs: float64(sumNs) / float64(time.Millisecond)}
+	for i, n := range counts {
+		h.Count += n
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(float64(bounds[i])/float64(time.Millisecond), 'f', -1, 64)
+		}
+		h.Buckets = append(h.Buckets, HistogramBucket{LE: le, Count: h.Count})
+	}
+	return h
+}
+
+// add folds o into st, for totals and the OtherChannel aggregate.
+func (st *ChannelStats) add(o ChannelStats) {
+	st.Subscribers += o.Subscribers
+	st.RetainedKeys += o.RetainedKeys
+	st.Published += o.Published
+	st.Delivered += o.Delivered
+	st.Dropped += o.Dropped
+	st.Disconnected += o.Disconnected
+	st.PublishRate += o.PublishRate
+	st.EventTypes = addCounts(st.EventTypes, o.EventTypes)
+	st.PolicyActivations = addCounts(st.PolicyActivations, o.PolicyActivations)
+	if st.FanoutLatency.Buckets == nil {
+		st.FanoutLatency.Buckets = make([]HistogramBucket, len(o.FanoutLatency.Buckets))
+		for i, b := range o.FanoutLatency.Buckets {
+			st.FanoutLatency.Buckets[i].LE = b.LE
+		}
+	}
+	for i, b := range o.FanoutLatency.Buckets {
+		st.FanoutLatency.Buckets[i].Count += b.Count
+	}
+	st.FanoutLatency.Count += o.FanoutLatency.Count
+	st.FanoutLatency.SumMs += o.FanoutLatency.SumMs
+}
+
+func addCounts(dst, src map[string]int64) map[string]int64 {
+	if len(src) > 0 && dst == nil {
+		dst = make(map[string]int64)
+	}
+	for k, n := range src {
+		dst[k] += n
+	}
+	return dst
+}
+
+// hubMetrics tracks per-channel metrics for up to maxChannels channels.
+// Channels seen after that share the OtherChannel entry, which keeps the
+// metrics output bounded on deployments with many short-lived channels.
+type hubMetrics struct {
+	mu            sync.RWMutex
+	maxChannels   int
+	channels      map[string]*channelMetrics
+	other         *channelMetrics
+	patterns      map[string]*patternMetrics
+	otherPatterns *patternMetrics
+}
+
+func newHubMetrics() *hubMetrics {
+	return &hubMetrics{
+		maxChannels:   defaultMaxTrackedChannels,
+		channels:      make(map[string]*channelMetrics),
+		other:         newChannelMetrics(),
+		patterns:      make(map[string]*patternMetrics),
+		otherPatterns: &patternMetrics{},
+	}
+}
+
+// pattern returns the metrics of pattern, tracked like those of channels.
+func (hm *hubMetrics) pattern(pattern string) *patternMetrics {
+	hm.mu.RLock()
+	m, ok := hm.patterns[pattern]
+	hm.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	if m, ok := hm.patterns[pattern]; ok {
+		return m
+	}
+	if len(hm.patterns) >= hm.maxChannels {
+		return hm.otherPatterns
+	}
+	m = &patternMetrics{}
+	hm.patterns[pattern] = m
+	return m
+}
+
+func (hm *hubMetrics) channel(topic string) *channelMetrics {
+	hm.mu.RLock()
+	m, ok := hm.channels[topic]
+	hm.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	if m, ok := hm.channels[topic]; ok {
+		return m
+	}
+	if len(hm.channels) >= hm.maxChannels {
+		return hm.other
+	}
+	m = newChannelMetrics()
+	hm.channels[topic] = m
+	return m
+}
+
+// SetMaxTrackedChannels caps the number of channels reported individually in
+// Stats; the rest are aggregated under OtherChannel. Channels already
+// tracked stay tracked.
+func (h *Hub) SetMaxTrackedChannels(n int) {
+	h.metrics.mu.Lock()
+	h.metrics.maxChannels = n
+	h.metrics.mu.Unlock()
+}
+
+// Stats returns per-channel metrics and totals.
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	subscribers := make(map[string]int, len(h.topics))
+	for topic, subs := range h.topics {
+		subscribers[topic] = len(subs)
+	}
+	patternSubscribers := make(map[string]int)
+	for sub := range h.wildcards {
+		for _, p := range sub.patterns {
+			patternSubscribers[p]++
+		}
+	}
+	policies := h.policies
+	h.stateMu.Lock()
+	retained := make(map[string]int, len(h.states))
+	for topic, st := range h.states {
+		retained[topic] = st.keys()
+	}
+	h.stateMu.Unlock()
+	h.mu.RUnlock()
+
+	hm := h.metrics
+	hm.mu.RLock()
+	channels := make(map[string]*channelMetrics, len(hm.channels))
+	for topic, m := range hm.channels {
+		channels[topic] = m
+	}
+	maxChannels := hm.maxChannels
+	patterns := make(map[string]*patternMetrics, len(hm.patterns))
+	for p, m := range hm.patterns {
+		patterns[p] = m
+	}
+	hm.mu.RUnlock()
+
+	stats := HubStats{
+		Channels:    make(map[string]ChannelStats, len(channels)+1),
+		MaxChannels: maxChannels,
+	}
+	for topic, m := range channels {
+		st := m.snapshot()
+		st.Subscribers = subscribers[topic]
+		st.Policy = policies.For(topic).Overflow
+		st.RetainedKeys = retained[topic]
+		stats.Channels[topic] = st
+		stats.Totals.add(st)
+	}
+
+	other := hm.other.snapshot()
+	for topic, n := range subscribers {
+		if _, tracked := channels[topic]; !tracked {
+			other.Subscribers += n
+		}
+	}
+	for topic, n := range retained {
+		if _, tracked := channels[topic]; !tracked {
+			other.RetainedKeys += n
+		}
+	}
+	if other.Published > 0 || other.Subscribers > 0 || other.RetainedKeys > 0 {
+		stats.Channels[OtherChannel] = other
+		stats.Totals.add(other)
+	}
+
+	if len(patterns) > 0 || len(patternSubscribers) > 0 {
+		stats.Patterns = make(map[string]PatternStats, len(patterns)+1)
+		otherPattern := PatternStats{Delivered: atomic.LoadInt64(&hm.otherPatterns.count)}
+		for p, m := range patterns {
+			stats.Patterns[p] = PatternStats{Subscribers: patternSubscribers[p], Delivered: atomic.LoadInt64(&m.count)}
+		}
+		for p, n := range patternSubscribers {
+			if _, tracked := patterns[p]; !tracked {
+				otherPattern.Subscribers += n
+			}
+		}
+		if otherPattern.Delivered > 0 || otherPattern.Subscribers > 0 {
+			stats.Patterns[OtherChannel] = otherPattern
+		}
+	}
+	return stats
+}
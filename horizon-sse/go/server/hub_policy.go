@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrSlowClient is matched by the errors that report a client or
+// subscriber dropped for falling behind what it is sent.
+var ErrSlowClient = errors.New("server: slow client")
+
+// ErrSlowConsumer is reported by Subscription.Err when the subscription was
+// closed by the OverflowDisconnect policy. It matches ErrSlowClient.
+var ErrSlowConsumer error = slowClientError("server: subscriber disconnected for falling behind")
+
+type slowClientError string
+
+func (e slowClientError) Error() string        { return string(e) }
+func (e slowClientError) Is(target error) bool { return target == ErrSlowClient }
+
+// OverflowPolicy decides what happens to an event published to a
+// subscriber whose buffer is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropNewest discards the new event; the subscriber keeps the
+	// ones already buffered.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDropOldest evicts the oldest buffered event to make room.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowCompact discards everything buffered and keeps only the new
+	// event, for channels where only the latest value matters.
+	OverflowCompact OverflowPolicy = "compact"
+	// OverflowDisconnect closes the subscription instead of losing an
+	// event, for channels that must not drop.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// ParseOverflowPolicy validates a policy name.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(strings.TrimSpace(name)); p {
+	case OverflowDropNewest, OverflowDropOldest, OverflowCompact, OverflowDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// ChannelPolicy configures the subscribers of a channel.
+type ChannelPolicy struct {
+	// Buffer is the number of pending events per subscriber. Zero keeps the
+	// size the subscriber asked for.
+	Buffer   int
+	Overflow OverflowPolicy
+}
+
+// ChannelPolicies maps channels to their policy. A key ending in "*"
+// matches every channel with that prefix; an exact key wins over a prefix
+// and a longer prefix over a shorter one. Channels without a match use
+// Default.
+type ChannelPolicies struct {
+	Default  ChannelPolicy
+	Channels map[string]ChannelPolicy
+}
+
+// DefaultChannelPolicies drops new events for subscribers that fall behind,
+// which is how the hub has always behaved.
+func DefaultChannelPolicies() ChannelPolicies {
+	return ChannelPolicies{Default: ChannelPolicy{Overflow: OverflowDropNewest}}
+}
+
+// ParseChannelPolicies parses a spec such as
+// "drop-newest,prices.*=compact:1,audit=disconnect:1024". Each entry is
+// [channel=]policy[:buffer]; an entry without a channel sets the default.
+func ParseChannelPolicies(spec string) (ChannelPolicies, error) {
+	policies := DefaultChannelPolicies()
+	policies.Channels = map[string]ChannelPolicy{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		channel, value, hasChannel := strings.Cut(entry, "=")
+		if !hasChannel {
+			value = channel
+		}
+		name, buffer, hasBuffer := strings.Cut(value, ":")
+		overflow, err := ParseOverflowPolicy(name)
+		if err != nil {
+			return policies, err
+		}
+		p := ChannelPolicy{Overflow: overflow}
+		if hasBuffer {
+			if p.Buffer, err = strconv.Atoi(strings.TrimSpace(buffer)); err != nil || p.Buffer < 1 {
+				return policies, fmt.Errorf("invalid buffer size %q for %q", buffer, entry)
+			}
+		}
+		if hasChannel {
+			policies.Channels[strings.TrimSpace(channel)] = p
+		} else {
+			policies.Default = p
+		}
+	}
+	return policies, nil
+}
+
+// For returns the policy of channel.
+func (cp ChannelPolicies) For(channel string) ChannelPolicy {
+	if p, ok := lookupChannel(cp.Channels, channel); ok {
+		return cp.withDefaults(p)
+	}
+	return cp.withDefaults(cp.Default)
+}
+
+// lookupChannel finds the entry for channel in a map keyed by channel names
+// and "prefix*" patterns. An exact key wins, then the longest prefix.
+func lookupChannel[V any](m map[string]V, channel string) (V, bool) {
+	if v, ok := m[channel]; ok {
+		return v, true
+	}
+	best, found := "", false
+	for key := range m {
+		prefix, ok := strings.CutSuffix(key, "*")
+		if ok && strings.HasPrefix(channel, prefix) && (!found || len(prefix) > len(best)) {
+			best, found = prefix, true
+		}
+	}
+	if !found {
+		var zero V
+		return zero, false
+	}
+	return m[best+"*"], true
+}
+
+func (cp ChannelPolicies) withDefaults(p ChannelPolicy) ChannelPolicy {
+	if p.Overflow == "" {
+		p.Overflow = OverflowDropNewest
+	}
+	return p
+}
+
+// delivery is the outcome of handing one event to the subscribers of a
+// channel.
+type delivery struct {
+	delivered int
+	// dropped counts events lost to an overflow policy, including buffered
+	// events evicted to make room.
+	dropped int
+	// activations counts, per policy, the subscribers that were full.
+	activations map[OverflowPolicy]int
+	// evicted are subscribers to close under OverflowDisconnect.
+	evicted []*Subscription
+}
+
+func (d *delivery) activated(p OverflowPolicy) {
+	if d.activations == nil {
+		d.activations = make(map[OverflowPolicy]int)
+	}
+	d.activations[p]++
+}
+
+// deliver hands ev to sub according to its overflow policy. Concurrent
+// publishers and the reader may race for buffer slots, so the evicting
+// policies retry until the send succeeds.
+func (sub *Subscription) deliver(ev Event, d *delivery) {
+	select {
+	case sub.ch <- ev:
+		d.delivered++
+		return
+	default:
+	}
+
+	d.activated(sub.policy.Overflow)
+	switch sub.policy.Overflow {
+	case OverflowDisconnect:
+		d.evicted = append(d.evicted, sub)
+		return
+	case OverflowDropOldest, OverflowCompact:
+		for {
+			select {
+			case sub.ch <- ev:
+				d.delivered++
+				return
+			default:
+			}
+			n := 1
+			if sub.policy.Overflow == OverflowCompact {
+				n = len(sub.ch)
+			}
+			for ; n > 0; n-- {
+				select {
+				case <-sub.ch:
+					d.dropped++
+				default:
+				}
+			}
+		}
+	default:
+		d.dropped++
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SnapshotEndEvent is the type of the event sent to a new subscriber of a
+// state channel after the snapshot, before live updates. Its data is
+// {"keys":N}.
+const SnapshotEndEvent = "snapshot-end"
+
+// A state channel retains the latest event per Event.Key and replays them
+// to every new subscriber, so a dashboard can render current state without
+// waiting for each key to change. Publishing a key with empty Data removes
+// it; events without a Key are delivered but not retained.
+type stateChannel struct {
+	mu      sync.Mutex
+	seq     uint64
+	entries map[string]stateEntry
+}
+
+type stateEntry struct {
+	ev  Event
+	seq uint64
+}
+
+func newStateChannel() *stateChannel {
+	return &stateChannel{entries: make(map[string]stateEntry)}
+}
+
+func (st *stateChannel) apply(ev Event) {
+	if ev.Key == "" {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if ev.Data == "" {
+		delete(st.entries, ev.Key)
+		return
+	}
+	st.seq++
+	st.entries[ev.Key] = stateEntry{ev: ev, seq: st.seq}
+}
+
+// snapshot returns the retained events in the order they were last updated.
+func (st *stateChannel) snapshot() []Event {
+	st.mu.Lock()
+	entries := make([]stateEntry, 0, len(st.entries))
+	for _, e := range st.entries {
+		entries = append(entries, e)
+	}
+	st.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	events := make([]Event, len(entries))
+	for i, e := range entries {
+		events[i] = e.ev
+	}
+	return events
+}
+
+func (st *stateChannel) keys() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.entries)
+}
+
+// ParseStateChannels parses a comma-separated list of channel names and
+// "prefix*" patterns.
+func ParseStateChannels(spec string) []string {
+	var patterns []string
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// SetStateChannels makes the channels matching patterns (names or
+// "prefix*") retain their latest event per key. State kept for channels
+// that no longer match is discarded.
+func (h *Hub) SetStateChannels(patterns []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.statePatterns = make(map[string]struct{}, len(patterns))
+	for _, p := range patterns {
+		h.statePatterns[p] = struct{}{}
+	}
+
+	h.stateMu.Lock()
+	for topic := range h.states {
+		if !h.isStateChannel(topic) {
+			delete(h.states, topic)
+		}
+	}
+	h.stateMu.Unlock()
+}
+
+// isStateChannel reports whether topic retains state. Callers hold h.mu.
+func (h *Hub) isStateChannel(topic string) bool {
+	_, ok := lookupChannel(h.statePatterns, topic)
+	return ok
+}
+
+// state returns the retained state of topic, creating it if create is set.
+// It returns nil for channels that are not state channels. Callers hold h.mu
+// for reading or writing.
+func (h *Hub) state(topic string, create bool) *stateChannel {
+	h.stateMu.Lock()
+	defer h.stateMu.Unlock()
+	st, ok := h.states[topic]
+	if !ok && create && h.isStateChannel(topic) {
+		st = newStateChannel()
+		h.states[topic] = st
+	}
+	return st
+}
+
+// snapshotEvents returns what a new subscriber of topic receives before live
+// updates: the retained events and a SnapshotEndEvent. Callers hold h.mu.
+func (h *Hub) snapshotEvents(topic string) []Event {
+	if !h.isStateChannel(topic) {
+		return nil
+	}
+	var events []Event
+	if st := h.state(topic, false); st != nil {
+		events = st.snapshot()
+	}
+	return append(events, Event{
+		Type: SnapshotEndEvent,
+		Data: fmt.Sprintf(`{"keys":%d}`, len(events)),
+	})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader lets a publisher retry a request without
+	// publishing its events twice.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayHeader is set on responses served from the cache.
+	IdempotentReplayHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyTTL = 10 * time.Minute
+	maxIdempotencyEntries = 100000
+)
+
+// idempotencyCache remembers the response to each idempotency key for a
+// while. Keys are scoped to a channel. A retry with the same key and body
+// gets the original response, waiting for it if the first request is still
+// in flight; the same key with a different body is a conflict.
+type idempotencyCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	order   *list.List // oldest first
+
+	replays   int64
+	conflicts int64
+}
+
+type idempotencyEntry struct {
+	key     string
+	hash    [sha256.Size]byte
+	created time.Time
+	elem    *list.Element
+
+	done   chan struct{}
+	status int
+	body   []byte
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		ttl:        defaultIdempotencyTTL,
+		maxEntries: maxIdempotencyEntries,
+		entries:    make(map[string]*idempotencyEntry),
+		order:      list.New(),
+	}
+}
+
+// begin claims key for a request with the given body. If the key is new the
+// caller must call finish on the returned entry. Otherwise replay reports a
+// previous response to return, or conflict a key reused for another body.
+func (c *idempotencyCache) begin(channel, key string, body []byte) (e *idempotencyEntry, replay, conflict bool) {
+	hash := sha256.Sum256(body)
+	scoped := channel + "\x00" + key
+	now := time.Now()
+
+	c.mu.Lock()
+	c.expire(now)
+	if e, ok := c.entries[scoped]; ok {
+		c.mu.Unlock()
+		if e.hash != hash {
+			atomic.AddInt64(&c.conflicts, 1)
+			return nil, false, true
+		}
+		<-e.done
+		atomic.AddInt64(&c.replays, 1)
+		return e, true, false
+	}
+
+	e = &idempotencyEntry{key: scoped, hash: hash, created: now, done: make(chan struct{})}
+	e.elem = c.order.PushBack(e)
+	c.entries[scoped] = e
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Front().Value.(*idempotencyEntry))
+	}
+	c.mu.Unlock()
+	return e, false, false
+}
+
+// finish records the response for e and releases waiting retries.
+func (c *idempotencyCache) finish(e *idempotencyEntry, status int, body []byte) {
+	e.status = status
+	e.body = body
+	close(e.done)
+}
+
+// expire drops entries older than the TTL. Callers hold mu.
+func (c *idempotencyCache) expire(now time.Time) {
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		e := front.Value.(*idempotencyEntry)
+		if now.Sub(e.created) < c.ttl {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+func (c *idempotencyCache) remove(e *idempotencyEntry) {
+	c.order.Remove(e.elem)
+	delete(c.entries, e.key)
+}
+
+func (c *idempotencyCache) stats() map[string]int64 {
+	c.mu.Lock()
+	keys := len(c.entries)
+	c.mu.Unlock()
+	return map[string]int64{
+		"keys":      int64(keys),
+		"replays":   atomic.LoadInt64(&c.replays),
+		"conflicts": atomic.LoadInt64(&c.conflicts),
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A retried publish gets the first response without publishing again, and
+// the same key with another body is refused.
+func TestIdempotentPublish(t *testing.T) {
+	s := NewSSEServer()
+	sub := s.hub.Subscribe("news", 16)
+	defer sub.Close()
+	publish := func(key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/publish/news", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	first := publish("k1", `{"id":"1","data":"hello"}`)
+	if first.Code != http.StatusOK || first.Header().Get(IdempotentReplayHeader) != "" {
+		t.Fatalf("first: %d %s", first.Code, first.Body)
+	}
+	retry := publish("k1", `{"id":"1","data":"hello"}`)
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get(IdempotentReplayHeader) != "true" {
+		t.Errorf("retry: %d %q %v", retry.Code, retry.Body, retry.Header())
+	}
+	if w := publish("k1", `{"id":"1","data":"changed"}`); w.Code != http.StatusConflict {
+		t.Errorf("reused key: %d %s", w.Code, w.Body)
+	}
+	if w := publish("k2", `{"id":"2","data":"again"}`); w.Code != http.StatusOK || w.Header().Get(IdempotentReplayHeader) != "" {
+		t.Errorf("new key: %d %v", w.Code, w.Header())
+	}
+
+	if n := len(sub.C); n != 2 {
+		t.Errorf("published %d events, want 2", n)
+	}
+	if st := s.idempotency.stats(); st["keys"] != 2 || st["replays"] != 1 || st["conflicts"] != 1 {
+		t.Errorf("stats %v", st)
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	c := newIdempotencyCache()
+
+	// A retry of a request in flight waits for its response
+	e, replay, conflict := c.begin("news", "k", []byte("a"))
+	if e == nil || replay || conflict {
+		t.Fatalf("begin: %v %v %v", e, replay, conflict)
+	}
+	got := make(chan *idempotencyEntry)
+	go func() {
+		e, _, _ := c.begin("news", "k", []byte("a"))
+		got <- e
+	}()
+	select {
+	case <-got:
+		t.Fatal("retry returned before the first request finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.finish(e, http.StatusAccepted, []byte("done"))
+	if r := <-got; r.status != http.StatusAccepted || string(r.body) != "done" {
+		t.Errorf("replayed %d %q", r.status, r.body)
+	}
+
+	// Keys are scoped to a channel
+	if e, replay, _ := c.begin("sports", "k", []byte("b")); e == nil || replay {
+		t.Error("key shared across channels")
+	} else {
+		c.finish(e, http.StatusOK, nil)
+	}
+
+	// Entries expire after the TTL
+	c.ttl = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	if e, replay, conflict := c.begin("news", "k", []byte("c")); replay || conflict {
+		t.Error("expired key still held")
+	} else {
+		c.finish(e, http.StatusOK, nil)
+	}
+
+	// Past maxEntries the oldest keys are evicted
+	c.ttl = time.Hour
+	c.maxEntries = 2
+	for _, key := range []string{"x", "y"} {
+		e, _, _ := c.begin("news", key, []byte(key))
+		c.finish(e, http.StatusOK, nil)
+	}
+	if st := c.stats(); st["keys"] != 2 {
+		t.Errorf("keys %d, want 2", st["keys"])
+	}
+	if _, replay, conflict := c.begin("news", "k", []byte("other")); replay || conflict {
+		t.Error("evicted key still held")
+	}
+	if _, replay, _ := c.begin("news", "y", []byte("y")); !replay {
+		t.Error("newest key evicted")
+	}
+}
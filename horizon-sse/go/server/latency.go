@@ -0,0 +1,35 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyRecorder is a latency histogram with fixed bucket bounds that is
+// safe for concurrent use.
+type LatencyRecorder struct {
+	bounds []time.Duration
+	counts []int64
+	sumNs  int64
+}
+
+// NewLatencyRecorder returns a recorder with the given ascending bucket
+// upper bounds; larger values land in a final +Inf bucket.
+func NewLatencyRecorder(bounds ...time.Duration) *LatencyRecorder {
+	return &LatencyRecorder{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (l *LatencyRecorder) Observe(d time.Duration) {
+	i := sort.Search(len(l.bounds), func(i int) bool { return d <= l.bounds[i] })
+	atomic.AddInt64(&l.counts[i], 1)
+	atomic.AddInt64(&l.sumNs, int64(d))
+}
+
+func (l *LatencyRecorder) Snapshot() Histogram {
+	counts := make([]int64, len(l.counts))
+	for i := range counts {
+		counts[i] = atomic.LoadInt64(&l.counts[i])
+	}
+	return newHistogram(l.bounds, counts, atomic.LoadInt64(&l.sumNs))
+}
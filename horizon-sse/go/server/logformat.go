@@ -0,0 +1,22 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ParseLogFormat returns the formatter of a -log-format: text, the
+// default, for people reading a terminal, or json, one object per line
+// for a log shipper such as Filebeat or Promtail to index by field.
+func ParseLogFormat(name string) (logrus.Formatter, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "text":
+		return &logrus.TextFormatter{FullTimestamp: true}, nil
+	case "json":
+		return &logrus.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", name)
+	}
+}
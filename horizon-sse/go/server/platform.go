@@ -0,0 +1,53 @@
+package server
+
+import (
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Capabilities are the socket features of the platform a binary was built
+// for. Linux, where the servers run in production, has them all; macOS and
+// Windows, where developers run them, lack some, and servers leave those
+// out with a warning rather than fail to start.
+type Capabilities struct {
+	// ReusePort is SO_REUSEPORT, for several processes to listen on one
+	// port. macOS lets them bind but does not spread connections between
+	// them as Linux does.
+	ReusePort bool
+	// TCPBuffers are SO_SNDBUF and SO_RCVBUF, and TCPKeepAlive the
+	// keep-alive idle time, interval and count.
+	TCPBuffers   bool
+	TCPKeepAlive bool
+	// OpenFiles is the count of open descriptors /capacity reports.
+	OpenFiles bool
+}
+
+// Platform returns the capabilities of the running platform.
+func Platform() Capabilities {
+	c := tcpCapabilities
+	c.OpenFiles = runtime.GOOS != "windows"
+	return c
+}
+
+// Fields describes the capabilities for the startup log.
+func (c Capabilities) Fields() logrus.Fields {
+	return logrus.Fields{
+		"os":            runtime.GOOS,
+		"reuseport":     c.ReusePort,
+		"tcp_buffers":   c.TCPBuffers,
+		"tcp_keepalive": c.TCPKeepAlive,
+		"open_files":    c.OpenFiles,
+	}
+}
+
+// ForPlatform logs the platform's capabilities and returns o without the
+// options it lacks, warning about those, for a server to listen with.
+func (o TCPOptions) ForPlatform(logger logrus.FieldLogger) TCPOptions {
+	logger.WithFields(Platform().Fields()).Info("Platform capabilities")
+	o, dropped := o.Supported()
+	if len(dropped) > 0 {
+		logger.WithFields(logrus.Fields{"os": runtime.GOOS, "options": dropped}).Warn("Socket options not supported on this platform, ignored")
+	}
+	return o
+}
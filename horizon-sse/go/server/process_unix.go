@@ -0,0 +1,27 @@
+//go:build !windows
+
+package server
+
+import (
+	"math"
+	"syscall"
+	"time"
+)
+
+// processCPU returns the user and system CPU time of the process.
+func processCPU() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// fileLimit returns the soft limit on open files, or 0 if it is unlimited.
+func fileLimit() int64 {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil && rlimit.Cur < math.MaxInt64 {
+		return int64(rlimit.Cur)
+	}
+	return 0
+}
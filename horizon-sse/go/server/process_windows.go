@@ -0,0 +1,23 @@
+package server
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPU returns the user and kernel CPU time of the process.
+func processCPU() time.Duration {
+	var creation, exit, kernel, user syscall.Filetime
+	h, err := syscall.GetCurrentProcess()
+	if err != nil || syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user) != nil {
+		return 0
+	}
+	// Filetimes count 100ns intervals
+	ticks := func(t syscall.Filetime) int64 { return int64(t.HighDateTime)<<32 | int64(t.LowDateTime) }
+	return time.Duration(ticks(kernel)+ticks(user)) * 100
+}
+
+// fileLimit is 0: Windows has no limit on open handles to report.
+func fileLimit() int64 {
+	return 0
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"horizon-sse-go/client"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A protobuf body published to a channel reaches a subscriber with the
+// same bytes and schema.
+func TestProtoRoundTrip(t *testing.T) {
+	s := NewSSEServer()
+	mux := http.NewServeMux()
+	mux.Handle("/publish/", s.router)
+	mux.HandleFunc("/channels/orders", func(w http.ResponseWriter, r *http.Request) {
+		s.hub.ServeSSE(w, r, "orders")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	pool := client.NewPool(client.PoolConfig{DecodeProto: true})
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := pool.Subscribe(ctx, ts.URL+"/channels/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s.hub.Subscribers("orders") == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("subscriber never connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Not valid UTF-8, as serialized messages often are not
+	payload := []byte{0x08, 0x96, 0x01, 0x12, 0x00, 0xff, 0xfe, '\n', 0x00}
+	const schema = "acme.orders.v1.Order"
+	req, _ := http.NewRequest("POST", ts.URL+"/publish/orders?type=order.created&id=7", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", ProtoContentType)
+	req.Header.Set(ProtoSchemaHeader, schema)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("publish status %d", resp.StatusCode)
+	}
+
+	var ev client.Event
+	select {
+	case ev = <-sub.Events:
+	case <-ctx.Done():
+		t.Fatal("no event received")
+	}
+	if ev.Proto == nil {
+		t.Fatalf("event %+v was not decoded as protobuf", ev)
+	}
+	if !bytes.Equal(ev.Proto.Payload, payload) {
+		t.Errorf("payload = %x, want %x", ev.Proto.Payload, payload)
+	}
+	if ev.Proto.Schema != schema || ev.Type != "order.created" {
+		t.Errorf("schema %q, type %q", ev.Proto.Schema, ev.Type)
+	}
+
+	decoded, err := client.DecodeProtoEvent(client.Event{Data: ev.Data})
+	if err != nil || !bytes.Equal(decoded.Payload, payload) || decoded.Schema != schema {
+		t.Errorf("DecodeProtoEvent = %+v, %v", decoded, err)
+	}
+	if _, err := client.DecodeProtoEvent(client.Event{Data: `{"hello":"json"}`}); err != client.ErrNotProto {
+		t.Errorf("JSON event decoded with error %v, want ErrNotProto", err)
+	}
+}
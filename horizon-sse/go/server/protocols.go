@@ -0,0 +1,36 @@
+package server
+
+import "fmt"
+
+// HTTPVersion is the HTTP versions a server serves or a client speaks.
+type HTTPVersion string
+
+const (
+	// HTTPAuto serves HTTP/1.1 and HTTP/2, over TLS as negotiated and on
+	// plaintext as h2c for clients that start with the HTTP/2 preface.
+	// Clients speak HTTP/2 over TLS and HTTP/1.1 otherwise, as net/http
+	// does.
+	HTTPAuto HTTPVersion = "auto"
+	// HTTP1 serves and speaks HTTP/1.1 only, even over TLS.
+	HTTP1 HTTPVersion = "h1"
+	// HTTP2 serves and speaks HTTP/2 only: over TLS, and on plaintext as
+	// h2c with prior knowledge. WebSocket upgrades need HTTP/1.1, so a
+	// server restricted to HTTP/2 cannot take them.
+	HTTP2 HTTPVersion = "h2"
+)
+
+// ParseHTTPVersion parses "auto" (or ""), "h1" or "h2".
+func ParseHTTPVersion(s string) (HTTPVersion, error) {
+	switch v := HTTPVersion(s); v {
+	case "", HTTPAuto:
+		return HTTPAuto, nil
+	case HTTP1:
+		return v, nil
+	case HTTP2:
+		if !http2Configurable {
+			return v, fmt.Errorf("h2 needs a binary built with Go 1.24 or later")
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown HTTP version %q, want auto, h1 or h2", s)
+}
@@ -0,0 +1,34 @@
+//go:build go1.24
+
+package server
+
+import "net/http"
+
+// Apply sets the versions srv serves.
+func (v HTTPVersion) Apply(srv *http.Server) {
+	srv.Protocols = v.protocols()
+}
+
+// ApplyTransport sets the versions t speaks. HTTPAuto leaves t as it is.
+func (v HTTPVersion) ApplyTransport(t *http.Transport) {
+	if v == HTTPAuto || v == "" {
+		return
+	}
+	t.Protocols = v.protocols()
+}
+
+func (v HTTPVersion) protocols() *http.Protocols {
+	p := new(http.Protocols)
+	switch v {
+	case HTTP1:
+		p.SetHTTP1(true)
+	case HTTP2:
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	default:
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	}
+	return p
+}
@@ -0,0 +1,23 @@
+//go:build !go1.24
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// Before Go 1.24, net/http cannot serve h2c and ParseHTTPVersion refuses
+// HTTP2; HTTP1 turns off the HTTP/2 it negotiates over TLS.
+func (v HTTPVersion) Apply(srv *http.Server) {
+	if v == HTTP1 {
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+}
+
+func (v HTTPVersion) ApplyTransport(t *http.Transport) {
+	if v == HTTP1 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+}
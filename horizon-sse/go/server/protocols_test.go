@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPVersion(t *testing.T) {
+	if !http2Configurable {
+		t.Skip("needs Go 1.24")
+	}
+	proto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	for _, tc := range []struct {
+		server, client HTTPVersion
+		tls            bool
+		want           string // empty if the client cannot connect
+	}{
+		{HTTPAuto, HTTPAuto, false, "HTTP/1.1"},
+		{HTTPAuto, HTTP2, false, "HTTP/2.0"},
+		{HTTPAuto, HTTPAuto, true, "HTTP/2.0"},
+		{HTTPAuto, HTTP1, true, "HTTP/1.1"},
+		{HTTP1, HTTPAuto, true, "HTTP/1.1"},
+		{HTTP1, HTTP2, false, ""},
+		{HTTP2, HTTP2, false, "HTTP/2.0"},
+		{HTTP2, HTTP1, false, ""},
+	} {
+		srv := httptest.NewUnstartedServer(proto)
+		tc.server.Apply(srv.Config)
+		if tc.tls {
+			// httptest offers h2 whatever the server's protocols
+			srv.EnableHTTP2 = tc.server != HTTP1
+			srv.StartTLS()
+		} else {
+			srv.Start()
+		}
+		transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}
+		tc.client.ApplyTransport(transport)
+		got := ""
+		if resp, err := (&http.Client{Transport: transport}).Get(srv.URL); err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				got = string(body)
+			}
+		}
+		transport.CloseIdleConnections()
+		srv.Close()
+		if got != tc.want {
+			t.Errorf("%s server, %s client, tls %v: %q, want %q", tc.server, tc.client, tc.tls, got, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "auto", "h1", "h2"} {
+		if _, err := ParseHTTPVersion(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+	if _, err := ParseHTTPVersion("h3"); err == nil {
+		t.Error("h3 accepted")
+	}
+}
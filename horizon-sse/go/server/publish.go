@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPublishBody bounds the size of a /publish request.
+	maxPublishBody = 1 << 20
+	// maxBatchEvents bounds the number of events in one batch.
+	maxBatchEvents = 1000
+)
+
+// PublishRequest is one event in the body of POST /publish/{channel}. Data
+// is any JSON value: a string is sent to subscribers as is, anything else
+// as its compact JSON encoding. A protobuf event sets Schema and Proto
+// (base64 in JSON) instead of Data. Events without an ID get a snowflake
+// ID.
+type PublishRequest struct {
+	ID     string          `json:"id,omitempty"`
+	Type   string          `json:"type,omitempty"`
+	Key    string          `json:"key,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Schema string          `json:"schema,omitempty"`
+	Proto  []byte          `json:"proto,omitempty"`
+}
+
+// PublishResponse reports the outcome of a publish. IDs are the event IDs
+// in request order; Delivered counts deliveries over all events.
+type PublishResponse struct {
+	Channel   string   `json:"channel"`
+	IDs       []string `json:"ids"`
+	Delivered int      `json:"delivered"`
+}
+
+// PublishError is the body of a rejected publish. Errors lists every schema
+// violation when events did not match their channel's schema.
+type PublishError struct {
+	Error  string             `json:"error"`
+	Errors []PublishViolation `json:"errors,omitempty"`
+}
+
+// PublishViolation is a schema violation of one event. Index is the
+// event's position in a batch, and absent for a single event.
+type PublishViolation struct {
+	Index *int `json:"index,omitempty"`
+	ValidationError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handlePublish publishes one event, or a JSON array of events as a batch
+// that is delivered contiguously and rejected as a whole if any event is
+// invalid. A body of type application/x-protobuf is a single protobuf
+// event. With an Idempotency-Key header, a retry of the same request
+// returns the original response instead of publishing again.
+func (s *SSEServer) handlePublish(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPublishBody+1))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, PublishError{Error: err.Error()})
+		return
+	}
+	if len(body) > maxPublishBody {
+		writeJSON(w, http.StatusRequestEntityTooLarge, PublishError{Error: fmt.Sprintf("request body exceeds %d bytes", maxPublishBody)})
+		return
+	}
+
+	reqs, batch, err := parsePublishBody(r, body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, PublishError{Error: err.Error()})
+		return
+	}
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		status, resp := s.publish(channel, reqs, batch)
+		writeJSON(w, status, resp)
+		return
+	}
+
+	// Hash the parsed requests rather than the body, so the protobuf
+	// metadata passed in headers is part of what a retry must repeat
+	canonical, _ := json.Marshal(reqs)
+	entry, replay, conflict := s.idempotency.begin(channel, key, canonical)
+	switch {
+	case conflict:
+		writeJSON(w, http.StatusConflict, PublishError{Error: "idempotency key was already used with a different request"})
+		return
+	case replay:
+		w.Header().Set(IdempotentReplayHeader, "true")
+		writeRawJSON(w, entry.status, entry.body)
+		return
+	}
+	status, resp := s.publish(channel, reqs, batch)
+	data, _ := json.Marshal(resp)
+	s.idempotency.finish(entry, status, data)
+	writeRawJSON(w, status, data)
+}
+
+func writeRawJSON(w http.ResponseWriter, status int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// parsePublishBody reads the events of a publish request and whether they
+// form a batch.
+func parsePublishBody(r *http.Request, body []byte) ([]PublishRequest, bool, error) {
+	if isProtoContent(r.Header.Get("Content-Type")) {
+		q := r.URL.Query()
+		req := PublishRequest{
+			ID:     q.Get("id"),
+			Type:   q.Get("type"),
+			Key:    q.Get("key"),
+			Schema: r.Header.Get(ProtoSchemaHeader),
+			Proto:  body,
+		}
+		if req.Schema == "" {
+			return nil, false, fmt.Errorf("invalid event: protobuf body requires a %s header", ProtoSchemaHeader)
+		}
+		return []PublishRequest{req}, false, nil
+	}
+
+	if bytes.HasPrefix(bytes.TrimLeft(body, " \t\r\n"), []byte("[")) {
+		var reqs []PublishRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			return nil, true, fmt.Errorf("invalid batch: %v", err)
+		}
+		if len(reqs) == 0 || len(reqs) > maxBatchEvents {
+			return nil, true, fmt.Errorf("a batch must hold 1 to %d events", maxBatchEvents)
+		}
+		return reqs, true, nil
+	}
+	var req PublishRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false, fmt.Errorf("invalid event: %v", err)
+	}
+	return []PublishRequest{req}, false, nil
+}
+
+// publish validates and publishes events, returning the status and body of
+// the response.
+func (s *SSEServer) publish(channel string, reqs []PublishRequest, batch bool) (int, interface{}) {
+	events := make([]Event, len(reqs))
+	var violations []PublishViolation
+	for i, req := range reqs {
+		ev, errs, err := s.prepareEvent(channel, req)
+		if err != nil {
+			if batch {
+				err = fmt.Errorf("event %d: %w", i, err)
+			}
+			return http.StatusBadRequest, PublishError{Error: err.Error()}
+		}
+		for _, e := range errs {
+			v := PublishViolation{ValidationError: e}
+			if batch {
+				index := i
+				v.Index = &index
+			}
+			violations = append(violations, v)
+		}
+		events[i] = ev
+	}
+	if len(violations) > 0 {
+		s.logger.WithFields(logrus.Fields{
+			"channel": channel,
+			"events":  len(events),
+			"errors":  len(violations),
+		}).Warn("Rejected events not matching channel schema")
+		return http.StatusUnprocessableEntity, PublishError{
+			Error:  fmt.Sprintf("event does not match the schema of channel %q", channel),
+			Errors: violations,
+		}
+	}
+
+	resp := PublishResponse{Channel: channel, IDs: make([]string, len(events))}
+	for i, ev := range events {
+		resp.IDs[i] = ev.ID
+	}
+	if batch {
+		resp.Delivered = s.hub.PublishBatch(channel, events)
+	} else {
+		resp.Delivered = s.hub.Publish(channel, events[0])
+	}
+	return http.StatusOK, resp
+}
+
+// prepareEvent turns a request into an Event, checking its data against
+// the channel's schema.
+func (s *SSEServer) prepareEvent(channel string, req PublishRequest) (Event, []ValidationError, error) {
+	id := req.ID
+	if id == "" {
+		id = snowflakeIDs{}.Next("")
+	}
+	if req.Schema != "" || len(req.Proto) > 0 {
+		data, err := s.protoEventData(channel, req)
+		if err != nil {
+			return Event{}, nil, err
+		}
+		return Event{ID: id, Type: req.Type, Key: req.Key, Data: data}, nil, nil
+	}
+
+	if len(req.Data) == 0 {
+		return Event{}, nil, fmt.Errorf("invalid event: data is required")
+	}
+	var payload interface{}
+	if err := json.Unmarshal(req.Data, &payload); err != nil {
+		return Event{}, nil, fmt.Errorf("invalid event data: %v", err)
+	}
+	if errs := s.schemas.Validate(channel, payload); len(errs) > 0 {
+		return Event{}, errs, nil
+	}
+
+	data, ok := payload.(string)
+	if !ok {
+		var compact bytes.Buffer
+		json.Compact(&compact, req.Data)
+		data = compact.String()
+	}
+	return Event{ID: id, Type: req.Type, Key: req.Key, Data: data}, nil, nil
+}
+
+func (s *SSEServer) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	raw, ok := s.schemas.Get(mux.Vars(r)["channel"])
+	if !ok {
+		writeJSON(w, http.StatusNotFound, PublishError{Error: "no schema registered for channel"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(raw)
+}
+
+func (s *SSEServer) handlePutSchema(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	raw, err := io.ReadAll(io.LimitReader(r.Body, maxPublishBody))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, PublishError{Error: err.Error()})
+		return
+	}
+	if err := s.schemas.Set(channel, raw); err != nil {
+		writeJSON(w, http.StatusBadRequest, PublishError{Error: err.Error()})
+		return
+	}
+	s.logger.WithField("channel", channel).Info("Registered event schema")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *SSEServer) handleDeleteSchema(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if !s.schemas.Delete(channel) {
+		writeJSON(w, http.StatusNotFound, PublishError{Error: "no schema registered for channel"})
+		return
+	}
+	s.logger.WithField("channel", channel).Info("Removed event schema")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RechunkMode decides how streamed text is regrouped before it is sent to
+// clients.
+type RechunkMode string
+
+const (
+	// RechunkNone forwards text exactly as the upstream chunked it.
+	RechunkNone RechunkMode = "none"
+	// RechunkMarkdown only ends a chunk where a markdown renderer sees
+	// complete syntax: never inside a code fence, inline code or link.
+	RechunkMarkdown RechunkMode = "markdown"
+)
+
+func ParseRechunkMode(name string) (RechunkMode, error) {
+	switch m := RechunkMode(strings.ToLower(strings.TrimSpace(name))); m {
+	case RechunkNone, RechunkMarkdown:
+		return m, nil
+	case "":
+		return RechunkNone, nil
+	default:
+		return "", fmt.Errorf("unknown rechunk mode %q", name)
+	}
+}
+
+// RechunkRoutes maps route paths to the rechunk mode of their streams.
+type RechunkRoutes struct {
+	Default RechunkMode
+	Routes  map[string]RechunkMode
+}
+
+// ParseRechunkRoutes parses a spec such as "markdown" or
+// "none,/sse=markdown", like ParseEventIDRoutes.
+func ParseRechunkRoutes(spec string) (RechunkRoutes, error) {
+	routes := RechunkRoutes{Default: RechunkNone, Routes: map[string]RechunkMode{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, name, hasRoute := strings.Cut(entry, "=")
+		if !hasRoute {
+			name = route
+		}
+		mode, err := ParseRechunkMode(name)
+		if err != nil {
+			return routes, err
+		}
+		if hasRoute {
+			routes.Routes[strings.TrimSpace(route)] = mode
+		} else {
+			routes.Default = mode
+		}
+	}
+	return routes, nil
+}
+
+// For returns the mode configured for route.
+func (r RechunkRoutes) For(route string) RechunkMode {
+	if mode, ok := r.Routes[route]; ok {
+		return mode
+	}
+	if r.Default == "" {
+		return RechunkNone
+	}
+	return r.Default
+}
+
+// MarkdownChunker regroups the text of one stream so that every chunk it
+// releases ends on a boundary that is safe to render: after whitespace
+// outside inline code and links, or after the closing line of a code
+// fence. Text is held back until such a boundary arrives, up to MaxHold
+// bytes; past that it is released at the last line break (or all of it)
+// so a long code block still makes progress.
+type MarkdownChunker struct {
+	MaxHold int
+
+	pending string
+	// Scanner state at the start of pending. Cuts are made where inline
+	// state is clear, so only line and fence state carry over.
+	lineStart bool
+	inFence   bool
+}
+
+func NewMarkdownChunker(maxHold int) *MarkdownChunker {
+	return &MarkdownChunker{MaxHold: maxHold, lineStart: true}
+}
+
+// Write adds text to the stream and returns the text that can be sent now,
+// possibly empty.
+func (c *MarkdownChunker) Write(text string) string {
+	c.pending += text
+	cut := c.scan()
+	if cut.safe == 0 && c.MaxHold > 0 && len(c.pending) > c.MaxHold {
+		cut.safe, cut.lineStart, cut.inFence = cut.soft, cut.softLineStart, cut.softInFence
+		if cut.safe == 0 {
+			cut.safe, cut.lineStart, cut.inFence = len(c.pending), cut.endLineStart, cut.endInFence
+		}
+	}
+	if cut.safe == 0 {
+		return ""
+	}
+	out := c.pending[:cut.safe]
+	c.pending = c.pending[cut.safe:]
+	c.lineStart, c.inFence = cut.lineStart, cut.inFence
+	return out
+}
+
+// Flush returns whatever is still held, for the end of the stream.
+func (c *MarkdownChunker) Flush() string {
+	out := c.pending
+	c.pending = ""
+	c.lineStart, c.inFence = true, false
+	return out
+}
+
+// markdownCut describes where pending may be split: safe is the last clean
+// boundary, soft the last line break (whitespace outside a fence) to fall
+// back on when too much is held. Offsets are 0 when there is none.
+type markdownCut struct {
+	safe, soft               int
+	lineStart, softLineStart bool
+	inFence, softInFence     bool
+	endLineStart, endInFence bool
+}
+
+func (c *MarkdownChunker) scan() markdownCut {
+	s := c.pending
+	var cut markdownCut
+	lineStart, inFence := c.lineStart, c.inFence
+	inCode, afterLinkText := false, false
+	brackets, parens := 0, 0
+
+	for i := 0; i < len(s); i++ {
+		if lineStart {
+			j := i
+			for j < len(s) && j-i < 3 && s[j] == ' ' {
+				j++
+			}
+			rest := s[j:]
+			if strings.HasPrefix(rest, "```") || strings.HasPrefix(rest, "~~~") {
+				end := strings.IndexByte(rest, '\n')
+				if end < 0 {
+					// The fence line is not complete yet
+					break
+				}
+				inFence = !inFence
+				i = j + end
+				if !inFence {
+					cut.safe, cut.lineStart, cut.inFence = i+1, true, false
+				}
+				cut.soft, cut.softLineStart, cut.softInFence = i+1, true, inFence
+				continue
+			}
+			if len(rest) < 3 && (strings.HasPrefix("```", rest) || strings.HasPrefix("~~~", rest)) {
+				// Could still become a fence
+				break
+			}
+		}
+
+		ch := s[i]
+		lineStart = ch == '\n'
+		if inFence {
+			if lineStart {
+				cut.soft, cut.softLineStart, cut.softInFence = i+1, true, true
+			}
+			continue
+		}
+
+		if afterLinkText {
+			afterLinkText = false
+			if ch == '(' {
+				parens = 1
+				continue
+			}
+		}
+		switch {
+		case ch == '`':
+			inCode = !inCode
+		case inCode:
+		case parens > 0:
+			if ch == '(' {
+				parens++
+			} else if ch == ')' {
+				parens--
+			}
+		case ch == '[':
+			brackets++
+		case ch == ']' && brackets > 0:
+			brackets--
+			afterLinkText = brackets == 0
+		}
+
+		if ch == ' ' || ch == '\n' || ch == '\t' {
+			cut.soft, cut.softLineStart, cut.softInFence = i+1, lineStart, false
+			if !inCode && brackets == 0 && parens == 0 {
+				cut.safe, cut.lineStart, cut.inFence = i+1, lineStart, false
+			}
+		}
+	}
+	cut.endLineStart, cut.endInFence = lineStart, inFence
+	return cut
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"horizon-sse-go/artifact"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordingExt ends the name of a recording file, before artifact.Ext if
+// it is compressed. A recording is a stream as an upstream sent it, kept
+// as JSON lines: a RecordingHeader, then a RecordedEvent per event with
+// when it arrived, then one with End set, saying how the stream ended. A
+// recording cut short, by a crash, has no end line and replays as if it
+// ended cleanly.
+const RecordingExt = ".sse.jsonl"
+
+// RecordingEOF is the End of a recording whose upstream stream ended
+// cleanly.
+const RecordingEOF = "eof"
+
+// RecordingHeader is the first line of a recording: where its stream came
+// from.
+type RecordingHeader struct {
+	StreamID string    `json:"stream_id"`
+	Path     string    `json:"path"`
+	Model    string    `json:"model,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Started  time.Time `json:"started"`
+}
+
+// RecordedEvent is one event of a recording, as its raw lines without the
+// blank line ending it, AtMs milliseconds after the upstream request was
+// sent. On the last line, End is RecordingEOF or the error that ended the
+// stream, and Lines is empty.
+type RecordedEvent struct {
+	AtMs  float64  `json:"at_ms"`
+	Lines []string `json:"lines,omitempty"`
+	End   string   `json:"end,omitempty"`
+}
+
+// Recorder writes one recording. Its methods are safe for concurrent use,
+// and do nothing on a nil Recorder.
+type Recorder struct {
+	path  string
+	start time.Time
+
+	mu  sync.Mutex
+	w   io.WriteCloser
+	bw  *bufio.Writer
+	enc *json.Encoder
+	err error // the first write error, after which nothing is written
+}
+
+// CreateRecording starts the recording of the stream of h, whose upstream
+// request was sent at h.Started, in dir, named after its stream ID and
+// compressed with zstd if compress is set.
+func CreateRecording(dir string, h RecordingHeader, compress bool) (*Recorder, error) {
+	name := strings.NewReplacer("/", "_", `\`, "_").Replace(h.StreamID)
+	path := filepath.Join(dir, name+RecordingExt)
+	w, err := artifact.Create(path, compress)
+	if err != nil {
+		return nil, err
+	}
+	if compress {
+		path += artifact.Ext
+	}
+	r := &Recorder{path: path, start: h.Started, w: w}
+	r.bw = bufio.NewWriter(w)
+	r.enc = json.NewEncoder(r.bw)
+	r.err = r.enc.Encode(h)
+	return r, nil
+}
+
+// Path is the file the recording is written to.
+func (r *Recorder) Path() string {
+	if r == nil {
+		return ""
+	}
+	return r.path
+}
+
+// Event records an event received at.
+func (r *Recorder) Event(at time.Time, lines []string) {
+	if r == nil {
+		return
+	}
+	r.write(RecordedEvent{AtMs: ms(at.Sub(r.start)), Lines: lines})
+}
+
+// Close records how the stream ended, err or RecordingEOF if nil, and
+// closes the file.
+func (r *Recorder) Close(err error) error {
+	if r == nil {
+		return nil
+	}
+	end := RecordingEOF
+	if err != nil {
+		end = err.Error()
+	}
+	r.write(RecordedEvent{AtMs: ms(time.Since(r.start)), End: end})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return r.err
+	}
+	ferr := r.bw.Flush()
+	cerr := r.w.Close()
+	r.w = nil
+	if r.err == nil {
+		r.err = errors.Join(ferr, cerr)
+	}
+	return r.err
+}
+
+func (r *Recorder) write(ev RecordedEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w != nil && r.err == nil {
+		r.err = r.enc.Encode(ev)
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Recording is a recording read back.
+type Recording struct {
+	// Name is the file's name without RecordingExt and artifact.Ext.
+	Name   string
+	Header RecordingHeader
+	Events []RecordedEvent
+	// End is how the stream ended: RecordingEOF, or the error that cut it.
+	End string
+}
+
+// ReadRecording reads the recording at path, compressed or not.
+func ReadRecording(path string) (*Recording, error) {
+	f, err := artifact.Open(strings.TrimSuffix(path, artifact.Ext))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), artifact.Ext), RecordingExt)
+	rec := &Recording{Name: name, End: RecordingEOF}
+	dec := json.NewDecoder(f)
+	if err := dec.Decode(&rec.Header); err != nil {
+		return nil, fmt.Errorf("%s: header: %w", path, err)
+	}
+	for {
+		var ev RecordedEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: event %d: %w", path, len(rec.Events)+1, err)
+		}
+		if ev.End != "" {
+			rec.End = ev.End
+			break
+		}
+		rec.Events = append(rec.Events, ev)
+	}
+	return rec, nil
+}
+
+// LoadRecordings reads every recording in dir, sorted by name.
+func LoadRecordings(dir string) ([]*Recording, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var recs []*Recording
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(strings.TrimSuffix(name, artifact.Ext), RecordingExt) {
+			continue
+		}
+		rec, err := ReadRecording(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Name < recs[j].Name })
+	return recs, nil
+}
+
+// Replay writes the events of rec to w at the pace they were recorded,
+// the first after the delay it took the upstream to send it, on clock. It
+// returns ctx's error if ctx ends first, or else an error for a recording
+// that did not end cleanly, for the caller to cut the stream as its
+// upstream did.
+func (rec *Recording) Replay(ctx context.Context, w io.Writer, flusher http.Flusher, clock Clock) error {
+	start := clock.Now()
+	for _, ev := range rec.Events {
+		wait := time.Duration(ev.AtMs*float64(time.Millisecond)) - clock.Since(start)
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-clock.After(wait):
+			}
+		}
+		if _, err := io.WriteString(w, strings.Join(ev.Lines, "\n")+"\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+	}
+	if rec.End != RecordingEOF {
+		return fmt.Errorf("recorded stream ended with: %s", rec.End)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"horizon-sse-go/retention"
+	"sync"
+	"time"
+)
+
+// DefaultReplayTTL is how long the events of a client's stream are kept
+// after it last received one unless configured otherwise.
+const DefaultReplayTTL = 2 * time.Minute
+
+// ReplayStore keeps the latest events sent to each client, so that a
+// client reconnecting with Last-Event-ID can be sent the ones it missed:
+// those in flight when its connection dropped. Anyone presenting a
+// client's key can resume its log, and a client ID sent by the client is
+// no secret, so servers that authenticate clients should key logs by who
+// they authenticated as well.
+type ReplayStore struct {
+	size int
+	ttl  time.Duration
+	// SpillMemory, if set, is how many bytes of events a log keeps in
+	// memory; older ones are written to files in SpillDir (the system's
+	// temp directory if empty) in the background, compressed with zstd
+	// in the batches the writer takes them in, so very long streams
+	// stay resumable without holding every event in RAM. The files go with
+	// the log. Set both before the store is used.
+	SpillMemory int64
+	SpillDir    string
+
+	mu          sync.Mutex
+	logs        map[string]*ReplayLog
+	lastSweep   time.Time
+	resumes     int64
+	replayed    int64
+	misses      int64
+	diskEvents  int64
+	diskBytes   int64
+	spillErrors int64
+	closed      bool
+	writers     sync.WaitGroup // of the logs' spill files
+}
+
+// ReplayEvent is an event as it was sent, in SSE wire format.
+type ReplayEvent struct {
+	ID   string
+	Text string
+}
+
+// ReplayLog records the events of one client's stream. A nil log, which a
+// disabled store hands out, records nothing.
+type ReplayLog struct {
+	store    *ReplayStore
+	events   []replayEntry // the last store.size events, oldest first
+	sent     int
+	done     bool
+	lastSeen time.Time
+	spill    logSpill
+}
+
+// ReplayStats are the clients with buffered events and how resumes went:
+// a miss is a Last-Event-ID no longer buffered, answered with a new stream.
+// With SpillMemory set, they also count the events held on disk, the size
+// of their files, and the writes and reads of them that failed.
+type ReplayStats struct {
+	Clients        int   `json:"clients"`
+	Resumes        int64 `json:"resumes"`
+	ReplayedEvents int64 `json:"replayed_events"`
+	Misses         int64 `json:"misses"`
+	SpilledEvents  int64 `json:"spilled_events,omitempty"`
+	SpillBytes     int64 `json:"spill_bytes,omitempty"`
+	SpillErrors    int64 `json:"spill_errors,omitempty"`
+}
+
+// NewReplayStore keeps the last size events of each client for ttl after
+// its last one; DefaultReplayTTL if ttl is not positive. A size of zero
+// disables replay.
+func NewReplayStore(size int, ttl time.Duration) *ReplayStore {
+	if ttl <= 0 {
+		ttl = DefaultReplayTTL
+	}
+	return &ReplayStore{size: size, ttl: ttl, logs: make(map[string]*ReplayLog)}
+}
+
+// Enabled reports whether the store keeps any events.
+func (s *ReplayStore) Enabled() bool {
+	return s.size > 0
+}
+
+// Open starts the log of a new stream to clientID, replacing the log of an
+// earlier one.
+func (s *ReplayStore) Open(clientID string) *ReplayLog {
+	if !s.Enabled() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	l := &ReplayLog{store: s, lastSeen: time.Now()}
+	if old := s.logs[clientID]; old != nil {
+		old.drop()
+	}
+	s.logs[clientID] = l
+	return l
+}
+
+// Resume returns the log of clientID's stream and the events sent after
+// lastID, to be sent again before the stream goes on in the same log. It
+// returns false if lastID is not among the buffered events, or those of
+// them on disk cannot be read back.
+func (s *ReplayStore) Resume(clientID, lastID string) (*ReplayLog, []ReplayEvent, bool) {
+	if !s.Enabled() {
+		return nil, nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	l, ok := s.logs[clientID]
+	if ok {
+		for i := len(l.events) - 1; i >= 0; i-- {
+			if l.events[i].id != lastID {
+				continue
+			}
+			entries := append([]replayEntry(nil), l.events[i+1:]...)
+			l.lastSeen = time.Now()
+			// Spilled events are read without holding up the other
+			// streams; their files outlive the read unless the log is
+			// dropped meanwhile, which fails it
+			s.mu.Unlock()
+			missed, err := readEntries(entries)
+			s.mu.Lock()
+			if err != nil {
+				s.spillErrors++
+				break
+			}
+			s.resumes++
+			s.replayed += int64(len(missed))
+			return l, missed, true
+		}
+	}
+	s.misses++
+	return nil, nil, false
+}
+
+// sweep drops the logs of clients gone for longer than the TTL, at most a
+// few times per TTL. s.mu must be held.
+func (s *ReplayStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < s.ttl/4 {
+		return
+	}
+	s.lastSweep = now
+	for id, l := range s.logs {
+		if now.Sub(l.lastSeen) > s.ttl {
+			l.drop()
+			delete(s.logs, id)
+		}
+	}
+}
+
+// Items lists the clients' buffers for a retention.Janitor managing the
+// store's sessions: a buffer is as old as its last event or resume, and
+// its size is that of its events in memory and of its spill files.
+func (s *ReplayStore) Items() ([]retention.Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]retention.Item, 0, len(s.logs))
+	for id, l := range s.logs {
+		bytes := l.spill.memBytes
+		for _, seg := range l.spill.segments {
+			bytes += seg.size
+		}
+		items = append(items, retention.Item{Name: id, Time: l.lastSeen, Bytes: bytes})
+	}
+	return items, nil
+}
+
+// Remove drops the buffer of clientID, which can then no longer be
+// resumed; a stream still running goes on unbuffered.
+func (s *ReplayStore) Remove(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.logs[clientID]; ok {
+		l.drop()
+		delete(s.logs, clientID)
+	}
+	return nil
+}
+
+func (s *ReplayStore) Stats() ReplayStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ReplayStats{
+		Clients:        len(s.logs),
+		Resumes:        s.resumes,
+		ReplayedEvents: s.replayed,
+		Misses:         s.misses,
+		SpilledEvents:  s.diskEvents,
+		SpillBytes:     s.diskBytes,
+		SpillErrors:    s.spillErrors,
+	}
+}
+
+// Record notes an event sent on the stream. Events without an ID cannot
+// be resumed from, so they are only replayed after an earlier one.
+func (l *ReplayLog) Record(id, text string) {
+	if l == nil {
+		return
+	}
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(l.events) == s.size {
+		l.forget(l.events[0])
+		copy(l.events, l.events[1:])
+		l.events = l.events[:s.size-1]
+	}
+	l.events = append(l.events, replayEntry{id: id, text: text, seq: l.sent})
+	l.spill.memBytes += int64(len(text))
+	l.sent++
+	l.lastSeen = time.Now()
+	if s.SpillMemory > 0 {
+		l.queueSpill()
+	}
+}
+
+// Finish marks the stream as having ended, so a resume after its last
+// event has nothing left to wait for.
+func (l *ReplayLog) Finish() {
+	if l == nil {
+		return
+	}
+	l.store.mu.Lock()
+	l.done = true
+	l.store.mu.Unlock()
+}
+
+// Done reports whether the stream has ended.
+func (l *ReplayLog) Done() bool {
+	if l == nil {
+		return false
+	}
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	return l.done
+}
+
+// Sent is the number of events recorded on the stream so far, including
+// those no longer buffered.
+func (l *ReplayLog) Sent() int {
+	if l == nil {
+		return 0
+	}
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	return l.sent
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"errors"
+	"horizon-sse-go/artifact"
+	"os"
+)
+
+// replaySegmentBytes is the size past which a log's spill file is left
+// for a new one, so the files of events that have fallen out of the log
+// can be removed while its stream goes on for hours. Tests shrink it.
+var replaySegmentBytes int64 = 4 << 20
+
+// replayEntry is an event of a log: its text in memory or, once spilled,
+// where the text is on disk: the zstd frame the writer compressed its
+// batch into, and where in the batch it is. Its ID stays in memory to
+// resume from.
+type replayEntry struct {
+	id   string
+	text string
+	seq  int // the event's position in the stream
+	seg  *replaySegment
+	off  int64 // of the frame in seg
+	n    int   // of the frame
+	at   int   // of the text in the frame's batch
+	size int   // of the text
+}
+
+// replaySegment is one spill file of a log.
+type replaySegment struct {
+	f    *os.File
+	size int64 // bytes written; changed by the log's writer with s.mu held
+	live int   // entries of the log whose text is in it
+}
+
+// logSpill is how much of a log is on disk and what is on its way there.
+// Like the rest of the log, it is guarded by the store's mutex.
+type logSpill struct {
+	memBytes    int64 // text of the entries in memory
+	queuedBytes int64 // of that, text queued for the writer
+	next        int   // seq of the first entry neither queued nor spilled
+	pending     []replayEntry
+	segments    []*replaySegment // oldest first; the writer appends to the last
+	diskEvents  int64
+	wake        chan struct{} // to the writer, started with the first spill
+	dropped     bool
+	failed      bool // a write failed: the log keeps its events in memory
+}
+
+// queueSpill hands the writer the oldest events in memory past the
+// store's SpillMemory. s.mu must be held.
+func (l *ReplayLog) queueSpill() {
+	sp := &l.spill
+	if sp.failed || sp.dropped || l.store.closed {
+		return
+	}
+	first := l.events[0].seq
+	if sp.next < first {
+		sp.next = first
+	}
+	for sp.memBytes-sp.queuedBytes > l.store.SpillMemory && sp.next < l.sent {
+		e := l.events[sp.next-first]
+		sp.pending = append(sp.pending, e)
+		sp.queuedBytes += int64(len(e.text))
+		sp.next++
+	}
+	if len(sp.pending) > 0 {
+		l.wakeWriter()
+	}
+}
+
+func (l *ReplayLog) wakeWriter() {
+	if l.spill.wake == nil {
+		l.spill.wake = make(chan struct{}, 1)
+		l.store.writers.Add(1)
+		go l.writeSpills()
+	}
+	select {
+	case l.spill.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forget accounts for e falling out of the log. s.mu must be held.
+func (l *ReplayLog) forget(e replayEntry) {
+	sp := &l.spill
+	if sp.dropped {
+		// Its writer is done with it
+		return
+	}
+	if e.seg == nil {
+		sp.memBytes -= int64(len(e.text))
+		if e.seq < sp.next && !sp.failed {
+			// Queued: the writer skips it
+			sp.queuedBytes -= int64(len(e.text))
+		}
+		return
+	}
+	e.seg.live--
+	sp.diskEvents--
+	l.store.diskEvents--
+	if n := len(sp.segments); e.seg.live == 0 && n > 0 && e.seg != sp.segments[n-1] {
+		l.wakeWriter()
+	}
+}
+
+// drop discards the log, whose files the writer then removes. s.mu must
+// be held.
+func (l *ReplayLog) drop() {
+	l.spill.dropped = true
+	if l.spill.wake != nil {
+		l.wakeWriter()
+	}
+}
+
+// writeSpills is the writer of a log: it appends the queued events to the
+// log's files, points their entries there and drops their text, and
+// removes the files no entry is in any more, until the log is dropped.
+func (l *ReplayLog) writeSpills() {
+	s := l.store
+	sp := &l.spill
+	defer s.writers.Done()
+	for range sp.wake {
+		s.mu.Lock()
+		batch := sp.pending
+		sp.pending = nil
+		dropped := sp.dropped
+		var dead []*replaySegment
+		if dropped {
+			dead, sp.segments = sp.segments, nil
+			s.diskEvents -= sp.diskEvents
+			sp.diskEvents = 0
+		} else {
+			dead = l.deadSegments()
+		}
+		for _, seg := range dead {
+			s.diskBytes -= seg.size
+		}
+		s.mu.Unlock()
+
+		for _, seg := range dead {
+			seg.f.Close()
+			os.Remove(seg.f.Name())
+		}
+		if dropped {
+			return
+		}
+		if len(batch) > 0 {
+			l.write(batch)
+		}
+	}
+}
+
+// deadSegments takes the files no entry is in out of the log, but for the
+// one being written. s.mu must be held.
+func (l *ReplayLog) deadSegments() []*replaySegment {
+	sp := &l.spill
+	var dead, keep []*replaySegment
+	for i, seg := range sp.segments {
+		if seg.live == 0 && i < len(sp.segments)-1 {
+			dead = append(dead, seg)
+		} else {
+			keep = append(keep, seg)
+		}
+	}
+	sp.segments = keep
+	return dead
+}
+
+// write spills batch as one compressed frame, then moves the entries
+// still in the log to disk. A failed write leaves the rest of the log in
+// memory.
+func (l *ReplayLog) write(batch []replayEntry) {
+	s := l.store
+	sp := &l.spill
+	var text []byte
+	for _, e := range batch {
+		text = append(text, e.text...)
+	}
+	frame := artifact.Compress(nil, text)
+	seg, werr := l.segment()
+	var off int64
+	if werr == nil {
+		off = seg.size
+		_, werr = seg.f.Write(frame)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if werr == nil {
+		seg.size += int64(len(frame))
+		s.diskBytes += int64(len(frame))
+		at := 0
+		for _, b := range batch {
+			size := len(b.text)
+			at += size
+			if sp.dropped || len(l.events) == 0 || b.seq < l.events[0].seq {
+				continue
+			}
+			e := &l.events[b.seq-l.events[0].seq]
+			e.seg, e.off, e.n, e.at, e.size, e.text = seg, off, len(frame), at-size, size, ""
+			seg.live++
+			sp.memBytes -= int64(size)
+			sp.queuedBytes -= int64(size)
+			sp.diskEvents++
+			s.diskEvents++
+		}
+	}
+	if werr != nil {
+		s.spillErrors++
+		sp.failed = true
+		sp.queuedBytes = 0
+		sp.pending = nil
+	}
+}
+
+// segment returns the file to append to, starting a new one when the
+// last is full.
+func (l *ReplayLog) segment() (*replaySegment, error) {
+	s := l.store
+	s.mu.Lock()
+	segments := l.spill.segments
+	s.mu.Unlock()
+	if n := len(segments); n > 0 && segments[n-1].size < replaySegmentBytes {
+		return segments[n-1], nil
+	}
+	dir := s.SpillDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "horizon-replay-*")
+	if err != nil {
+		return nil, err
+	}
+	seg := &replaySegment{f: f}
+	s.mu.Lock()
+	l.spill.segments = append(l.spill.segments, seg)
+	s.mu.Unlock()
+	return seg, nil
+}
+
+// readEntries returns the events of entries, reading those spilled back
+// from disk. Entries spilled together share a frame, which is read and
+// decompressed once.
+func readEntries(entries []replayEntry) ([]ReplayEvent, error) {
+	events := make([]ReplayEvent, len(entries))
+	var batch []byte
+	var frameSeg *replaySegment
+	var frameOff int64
+	for i, e := range entries {
+		events[i] = ReplayEvent{ID: e.id, Text: e.text}
+		if e.seg == nil {
+			continue
+		}
+		if e.seg != frameSeg || e.off != frameOff {
+			frame := make([]byte, e.n)
+			if _, err := e.seg.f.ReadAt(frame, e.off); err != nil {
+				return nil, err
+			}
+			var err error
+			if batch, err = artifact.Decompress(batch[:0], frame); err != nil {
+				return nil, err
+			}
+			frameSeg, frameOff = e.seg, e.off
+		}
+		if e.at+e.size > len(batch) {
+			return nil, errors.New("server: replay spill file is corrupt")
+		}
+		events[i].Text = string(batch[e.at : e.at+e.size])
+	}
+	return events, nil
+}
+
+// Close discards every log and waits for their files to be removed, for
+// a proxy shutting down. Streams still running spill no more.
+func (s *ReplayStore) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for id, l := range s.logs {
+		l.drop()
+		delete(s.logs, id)
+	}
+	s.mu.Unlock()
+	s.writers.Wait()
+}
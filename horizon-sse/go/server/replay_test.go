@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func replayIDs(events []ReplayEvent) []string {
+	ids := make([]string, len(events))
+	for i, ev := range events {
+		ids[i] = ev.ID
+	}
+	return ids
+}
+
+func TestReplayStoreResume(t *testing.T) {
+	store := NewReplayStore(3, time.Minute)
+	log := store.Open("a")
+	for i := 1; i <= 5; i++ {
+		id := strconv.Itoa(i)
+		log.Record(id, "id: "+id+"\ndata: x\n\n")
+	}
+
+	resumed, missed, ok := store.Resume("a", "3")
+	if !ok || resumed != log {
+		t.Fatalf("resume from 3: ok = %v, same log = %v", ok, resumed == log)
+	}
+	if got := replayIDs(missed); !reflect.DeepEqual(got, []string{"4", "5"}) {
+		t.Errorf("missed = %v, want [4 5]", got)
+	}
+	if missed[0].Text != "id: 4\ndata: x\n\n" {
+		t.Errorf("replayed text = %q", missed[0].Text)
+	}
+	if log.Sent() != 5 || log.Done() {
+		t.Errorf("sent = %d, done = %v", log.Sent(), log.Done())
+	}
+
+	// 2 fell out of the buffer, and b never had a stream
+	if _, _, ok := store.Resume("a", "2"); ok {
+		t.Error("resumed from an event no longer buffered")
+	}
+	if _, _, ok := store.Resume("b", "5"); ok {
+		t.Error("resumed a client without a stream")
+	}
+
+	log.Finish()
+	if _, missed, ok := store.Resume("a", "5"); !ok || len(missed) != 0 || !log.Done() {
+		t.Errorf("resume from the last event: ok = %v, missed = %v, done = %v", ok, missed, log.Done())
+	}
+
+	// A new stream replaces the old one
+	store.Open("a").Record("1", "id: 1\n\n")
+	if _, missed, _ := store.Resume("a", "1"); len(missed) != 0 {
+		t.Errorf("new stream replayed %v", replayIDs(missed))
+	}
+
+	want := ReplayStats{Clients: 1, Resumes: 3, ReplayedEvents: 2, Misses: 2}
+	if got := store.Stats(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestReplayStoreExpires(t *testing.T) {
+	store := NewReplayStore(8, 20*time.Millisecond)
+	store.Open("a").Record("1", "id: 1\n\n")
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := store.Resume("a", "1"); ok {
+		t.Error("resumed a stream past its TTL")
+	}
+	if n := store.Stats().Clients; n != 0 {
+		t.Errorf("%d clients kept past the TTL", n)
+	}
+}
+
+func TestReplayStoreDisabled(t *testing.T) {
+	store := NewReplayStore(0, 0)
+	log := store.Open("a")
+	log.Record("1", "id: 1\n\n")
+	log.Finish()
+	if log != nil || log.Done() || log.Sent() != 0 {
+		t.Error("disabled store handed out a working log")
+	}
+	if _, _, ok := store.Resume("a", "1"); ok {
+		t.Error("disabled store resumed a stream")
+	}
+}
+
+// waitSpilled waits for the store's writers to have spilled n events.
+func waitSpilled(t *testing.T, store *ReplayStore, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for store.Stats().SpilledEvents != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("spilled %d events, want %d", store.Stats().SpilledEvents, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplayStoreSpill(t *testing.T) {
+	defer func(n int64) { replaySegmentBytes = n }(replaySegmentBytes)
+	replaySegmentBytes = 200
+
+	dir := t.TempDir()
+	store := NewReplayStore(40, time.Minute)
+	store.SpillMemory = 100
+	store.SpillDir = dir
+	text := func(i int) string { return fmt.Sprintf("id: %03d\ndata: %04d\n\n", i, i) } // 20 bytes
+	log := store.Open("a")
+	for i := 1; i <= 30; i++ {
+		log.Record(strconv.Itoa(i), text(i))
+	}
+	// 100 bytes, five events, stay in memory
+	waitSpilled(t, store, 25)
+
+	_, missed, ok := store.Resume("a", "2")
+	if !ok || len(missed) != 28 {
+		t.Fatalf("resume from 2: ok = %v, %d missed", ok, len(missed))
+	}
+	for i, ev := range missed {
+		if ev.ID != strconv.Itoa(i+3) || ev.Text != text(i+3) {
+			t.Fatalf("replayed %q as %q", ev.ID, ev.Text)
+		}
+	}
+
+	// Events falling out of the log take their files with them
+	for i := 31; i <= 200; i++ {
+		log.Record(strconv.Itoa(i), text(i))
+	}
+	waitSpilled(t, store, 35)
+	if _, missed, ok := store.Resume("a", "161"); !ok || len(missed) != 39 || missed[0].Text != text(162) {
+		t.Errorf("resume from 161: ok = %v, %d missed", ok, len(missed))
+	}
+	if files, _ := os.ReadDir(dir); len(files) > 5 {
+		t.Errorf("%d spill files for 35 events", len(files))
+	}
+
+	store.Close()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d spill files left after Close", len(files))
+	}
+	if stats := store.Stats(); stats.SpilledEvents != 0 || stats.SpillBytes != 0 || stats.SpillErrors != 0 {
+		t.Errorf("stats after Close = %+v", stats)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotatedSuffix is the time appended to the name of a rotated file, which
+// sorts the rotated files of a path by age.
+const rotatedSuffix = "20060102-150405.000"
+
+// RotatingFile is a log file that is moved aside, to its path with the
+// time of the move appended, and started afresh once it has grown past
+// maxSize bytes or been written to for maxAge; zero limits never rotate.
+// Retention rules on its directory keep the rotated files in check. It is
+// safe for concurrent use, and each Write goes whole to one file.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens path to append to, creating it if need be.
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past its
+// size, or it is past its age. A file is never rotated empty, so a write
+// larger than the size limit still goes out. If the file can't be moved
+// aside, p is appended to it all the same and the error returned.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rotateErr error
+	if f.f != nil && f.size > 0 && (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize || f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		rotateErr = f.rotate()
+	}
+	if f.f == nil {
+		return 0, errors.Join(os.ErrClosed, rotateErr)
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one at its path, or the
+// same one again if it can't be moved. f.mu must be held.
+func (f *RotatingFile) rotate() error {
+	if err := f.f.Close(); err != nil {
+		return err
+	}
+	f.f = nil
+	rotated := f.path + "." + time.Now().Format(rotatedSuffix)
+	for i := 1; fileExists(rotated); i++ {
+		// Rotated twice within the millisecond
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, time.Now().Format(rotatedSuffix), i)
+	}
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("rotate %s: %w", f.path, renameErr)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Close closes the file; later writes fail.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	os.WriteFile(path, []byte("old\n"), 0o644)
+
+	f, err := OpenRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "a line longer than the limit\n", "three\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if _, err := f.Write([]byte("late\n")); err == nil {
+		t.Error("write after Close succeeded")
+	}
+
+	names, _ := filepath.Glob(path + ".*")
+	var contents []string
+	for _, name := range append(names, path) {
+		data, _ := os.ReadFile(name)
+		contents = append(contents, string(data))
+	}
+	want := []string{"old\none\n", "two\n", "a line longer than the limit\n", "three\n"}
+	if strings.Join(contents, "|") != strings.Join(want, "|") {
+		t.Errorf("files %q, want %q", contents, want)
+	}
+
+	f, err = OpenRotatingFile(path, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	time.Sleep(2 * time.Millisecond)
+	f.Write([]byte("four\n"))
+	if names, _ := filepath.Glob(path + ".*"); len(names) != 4 {
+		t.Errorf("not rotated by age: %v", names)
+	}
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema is a compiled JSON Schema. It supports the keywords publishers
+// actually use to describe event payloads: type, enum, const, properties,
+// required, additionalProperties, items, min/maxItems, min/maxLength,
+// pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, allOf,
+// anyOf and oneOf. Other keywords are ignored, except $ref, which is
+// rejected rather than silently not enforced.
+type Schema struct {
+	never            bool
+	types            []string
+	enum             []interface{}
+	constant         interface{}
+	hasConst         bool
+	properties       map[string]*Schema
+	required         []string
+	additional       *Schema
+	noAdditional     bool
+	items            *Schema
+	minItems         *int
+	maxItems         *int
+	minLength        *int
+	maxLength        *int
+	pattern          *regexp.Regexp
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	allOf            []*Schema
+	anyOf            []*Schema
+	oneOf            []*Schema
+}
+
+// ValidationError is one way a value fails a schema. Path is a JSON pointer
+// to the offending value, relative to the event data.
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// CompileSchema parses a JSON Schema document.
+func CompileSchema(data []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid schema JSON: %w", err)
+	}
+	return compileSchema(doc, "")
+}
+
+func compileSchema(doc interface{}, path string) (*Schema, error) {
+	if b, ok := doc.(bool); ok {
+		// true accepts everything, false nothing
+		if b {
+			return &Schema{}, nil
+		}
+		return &Schema{never: true}, nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema at %q must be an object or boolean", pointer(path))
+	}
+	if _, ok := m["$ref"]; ok {
+		return nil, fmt.Errorf("schema at %q: $ref is not supported", pointer(path))
+	}
+
+	s := &Schema{}
+	var err error
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema at %q: type must be a string or array of strings", pointer(path))
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("schema at %q: type must be a string or array of strings", pointer(path))
+	}
+	if v, ok := m["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return nil, fmt.Errorf("schema at %q: enum must be an array", pointer(path))
+		}
+	}
+	s.constant, s.hasConst = m["const"]
+
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema at %q: properties must be an object", pointer(path))
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, p := range props {
+			if s.properties[name], err = compileSchema(p, path+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := m["required"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema at %q: required must be an array", pointer(path))
+		}
+		for _, r := range list {
+			name, ok := r.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema at %q: required must list property names", pointer(path))
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	switch v := m["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		s.noAdditional = !v
+	default:
+		if s.additional, err = compileSchema(v, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := m["items"]; ok {
+		if s.items, err = compileSchema(v, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, dst := range map[string]**int{
+		"minItems": &s.minItems, "maxItems": &s.maxItems,
+		"minLength": &s.minLength, "maxLength": &s.maxLength,
+	} {
+		if *dst, err = intKeyword(m, key, path); err != nil {
+			return nil, err
+		}
+	}
+	for key, dst := range map[string]**float64{
+		"minimum": &s.minimum, "maximum": &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum, "exclusiveMaximum": &s.exclusiveMaximum,
+	} {
+		if *dst, err = numberKeyword(m, key, path); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := m["pattern"]; ok {
+		expr, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("schema at %q: pattern must be a string", pointer(path))
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("schema at %q: %w", pointer(path), err)
+		}
+	}
+
+	for key, dst := range map[string]*[]*Schema{"allOf": &s.allOf, "anyOf": &s.anyOf, "oneOf": &s.oneOf} {
+		v, ok := m[key]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("schema at %q: %s must be a non-empty array", pointer(path), key)
+		}
+		for i, sub := range list {
+			compiled, err := compileSchema(sub, path+"/"+key+"/"+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			*dst = append(*dst, compiled)
+		}
+	}
+	return s, nil
+}
+
+func intKeyword(m map[string]interface{}, key, path string) (*int, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return nil, fmt.Errorf("schema at %q: %s must be a non-negative integer", pointer(path), key)
+	}
+	n := int(f)
+	return &n, nil
+}
+
+func numberKeyword(m map[string]interface{}, key, path string) (*float64, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("schema at %q: %s must be a number", pointer(path), key)
+	}
+	return &f, nil
+}
+
+// Validate checks a decoded JSON value (as produced by encoding/json into an
+// interface{}) and returns every violation found.
+func (s *Schema) Validate(v interface{}) []ValidationError {
+	var errs []ValidationError
+	s.validate(v, "", &errs)
+	return errs
+}
+
+func (s *Schema) validate(v interface{}, path string, errs *[]ValidationError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: pointer(path), Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.never {
+		fail("no value is allowed here")
+		return
+	}
+	if len(s.types) > 0 && !matchesType(v, s.types) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), jsonType(v))
+		return
+	}
+	if s.enum != nil && !containsValue(s.enum, v) {
+		fail("value is not one of the allowed values")
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, v) {
+		fail("value does not equal the required constant")
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := path + "/" + escapePointer(name)
+			if prop, ok := s.properties[name]; ok {
+				prop.validate(val[name], child, errs)
+			} else if s.noAdditional {
+				*errs = append(*errs, ValidationError{Path: pointer(child), Message: "additional property is not allowed"})
+			} else if s.additional != nil {
+				s.additional.validate(val[name], child, errs)
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(val) < *s.minItems {
+			fail("expected at least %d items, got %d", *s.minItems, len(val))
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			fail("expected at most %d items, got %d", *s.maxItems, len(val))
+		}
+		if s.items != nil {
+			for i, item := range val {
+				s.items.validate(item, path+"/"+strconv.Itoa(i), errs)
+			}
+		}
+	case string:
+		n := len([]rune(val))
+		if s.minLength != nil && n < *s.minLength {
+			fail("expected at least %d characters, got %d", *s.minLength, n)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("expected at most %d characters, got %d", *s.maxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("does not match pattern %q", s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && val < *s.minimum {
+			fail("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && val > *s.maximum {
+			fail("must be <= %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && val <= *s.exclusiveMinimum {
+			fail("must be > %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && val >= *s.exclusiveMaximum {
+			fail("must be < %v", *s.exclusiveMaximum)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if len(sub.Validate(v)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("does not match any of the allowed schemas")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if len(sub.Validate(v)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one schema, matched %d", matched)
+		}
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func matchesType(v interface{}, types []string) bool {
+	actual := jsonType(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SchemaRegistry holds the JSON Schemas that events published to a channel
+// must match. Keys are channel names or "prefix*" patterns, resolved like
+// ChannelPolicies. Channels without a schema accept any payload.
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*registeredSchema
+}
+
+type registeredSchema struct {
+	schema    *Schema
+	raw       json.RawMessage
+	validated int64
+	rejected  int64
+}
+
+// SchemaStats counts the events checked against one schema.
+type SchemaStats struct {
+	Validated int64 `json:"validated"`
+	Rejected  int64 `json:"rejected"`
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{schemas: make(map[string]*registeredSchema)}
+}
+
+// Set compiles and registers the schema for channel, replacing any
+// previous one.
+func (r *SchemaRegistry) Set(channel string, raw []byte) error {
+	schema, err := CompileSchema(raw)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.schemas[channel] = &registeredSchema{schema: schema, raw: append(json.RawMessage(nil), raw...)}
+	r.mu.Unlock()
+	return nil
+}
+
+// Get returns the schema document registered for channel itself.
+func (r *SchemaRegistry) Get(channel string) (json.RawMessage, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rs, ok := r.schemas[channel]
+	if !ok {
+		return nil, false
+	}
+	return rs.raw, true
+}
+
+// Delete removes the schema registered for channel and reports whether
+// there was one.
+func (r *SchemaRegistry) Delete(channel string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.schemas[channel]
+	delete(r.schemas, channel)
+	return ok
+}
+
+// LoadDir registers every *.json file in dir, using the file name without
+// the extension as the channel (e.g. orders.json, prices.*.json).
+func (r *SchemaRegistry) LoadDir(dir string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return 0, err
+		}
+		channel := strings.TrimSuffix(filepath.Base(file), ".json")
+		if err := r.Set(channel, raw); err != nil {
+			return 0, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return len(files), nil
+}
+
+// Has reports whether events published to channel must match a schema.
+func (r *SchemaRegistry) Has(channel string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := lookupChannel(r.schemas, channel)
+	return ok
+}
+
+// Validate checks data, an event payload in JSON, against the schema of
+// channel. It returns nil if the channel has no schema.
+func (r *SchemaRegistry) Validate(channel string, data interface{}) []ValidationError {
+	r.mu.RLock()
+	rs, ok := lookupChannel(r.schemas, channel)
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	errs := rs.schema.Validate(data)
+	atomic.AddInt64(&rs.validated, 1)
+	if len(errs) > 0 {
+		atomic.AddInt64(&rs.rejected, 1)
+	}
+	return errs
+}
+
+// Stats returns validation counts per registered schema key.
+func (r *SchemaRegistry) Stats() map[string]SchemaStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stats := make(map[string]SchemaStats, len(r.schemas))
+	for key, rs := range r.schemas {
+		stats[key] = SchemaStats{
+			Validated: atomic.LoadInt64(&rs.validated),
+			Rejected:  atomic.LoadInt64(&rs.rejected),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	const order = `{
+		"type": "object",
+		"required": ["id", "status"],
+		"properties": {
+			"id": {"type": "integer"},
+			"status": {"enum": ["open", "closed"]},
+			"version": {"const": 2},
+			"customer": {
+				"type": "object",
+				"required": ["name"],
+				"properties": {"name": {"type": "string"}}
+			},
+			"lines": {
+				"type": "array",
+				"items": {
+					"type": "object",
+					"properties": {"qty": {"type": "integer"}, "price": {"type": "number"}}
+				}
+			}
+		}
+	}`
+	tests := []struct {
+		name   string
+		schema string
+		data   string
+		want   []string // path: message prefix
+	}{
+		{"valid", order, `{"id": 1, "status": "open", "version": 2, "customer": {"name": "a"}, "lines": [{"qty": 1, "price": 2.5}]}`, nil},
+		{"wrong root type", order, `[1]`, []string{"/: expected object, got array"}},
+		{"missing required", order, `{"id": 1}`, []string{`/: missing required property "status"`}},
+		{"wrong property type", order, `{"id": "1", "status": "open"}`, []string{"/id: expected integer, got string"}},
+		// Numbers decode to float64, whole ones count as integers
+		{"integer written as float", order, `{"id": 1.0, "status": "open"}`, nil},
+		{"fraction is not an integer", order, `{"id": 1.5, "status": "open"}`, []string{"/id: expected integer, got number"}},
+		{"enum mismatch", order, `{"id": 1, "status": "lost"}`, []string{"/status: value is not one of the allowed values"}},
+		{"const matches float", order, `{"id": 1, "status": "open", "version": 2.0}`, nil},
+		{"const mismatch", order, `{"id": 1, "status": "open", "version": 3}`, []string{"/version: value does not equal the required constant"}},
+		{"nested required", order, `{"id": 1, "status": "open", "customer": {}}`, []string{`/customer: missing required property "name"`}},
+		{"nested type", order, `{"id": 1, "status": "open", "customer": {"name": 7}}`, []string{"/customer/name: expected string, got integer"}},
+		{"items", order, `{"id": 1, "status": "open", "lines": [{"qty": 1}, {"qty": 0.5}, {"price": "x"}]}`, []string{
+			"/lines/1/qty: expected integer, got number",
+			"/lines/2/price: expected number, got string",
+		}},
+		{"several at once", order, `{"id": "x", "status": "lost"}`, []string{
+			"/id: expected integer, got string",
+			"/status: value is not one of the allowed values",
+		}},
+		{"type list", `{"type": ["string", "null"]}`, `null`, nil},
+		{"integer enum", `{"enum": [1, 2]}`, `2.0`, nil},
+		{"false schema", `false`, `1`, []string{"/: no value is allowed here"}},
+		{"escaped path", `{"additionalProperties": false}`, `{"a/b": 1}`, []string{"/a~1b: additional property is not allowed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := CompileSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data interface{}
+			if err := json.Unmarshal([]byte(tt.data), &data); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range schema.Validate(data) {
+				got = append(got, e.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("errors = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	for _, schema := range []string{
+		`"string"`,
+		`{"type": 1}`,
+		`{"enum": "a"}`,
+		`{"required": [1]}`,
+		`{"properties": {"a": {"$ref": "#/x"}}}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+	} {
+		if _, err := CompileSchema([]byte(schema)); err == nil {
+			t.Errorf("%s compiled", schema)
+		}
+	}
+}
+
+// /publish answers events that break the channel's schema with a 422
+// listing each violation, by index within a batch.
+func TestPublishSchemaViolations(t *testing.T) {
+	s := NewSSEServer()
+	put := httptest.NewRecorder()
+	s.router.ServeHTTP(put, httptest.NewRequest("PUT", "/schemas/orders", strings.NewReader(
+		`{"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}, "tags": {"items": {"type": "string"}}}}`)))
+	if put.Code != http.StatusNoContent {
+		t.Fatalf("PUT schema: %d %s", put.Code, put.Body)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want []PublishViolation
+	}{
+		{"single", `{"data": {"tags": ["a", 1]}}`, []PublishViolation{
+			{ValidationError: ValidationError{Path: "/", Message: `missing required property "id"`}},
+			{ValidationError: ValidationError{Path: "/tags/1", Message: "expected string, got integer"}},
+		}},
+		{"batch", `[{"data": {"id": 1}}, {"data": {"id": "2"}}]`, []PublishViolation{
+			{Index: intPtr(1), ValidationError: ValidationError{Path: "/id", Message: "expected integer, got string"}},
+		}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("POST", "/publish/orders", strings.NewReader(tt.body)))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want 422", tt.name, w.Code)
+			continue
+		}
+		var resp PublishError
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.Errors, tt.want) {
+			t.Errorf("%s: violations = %+v, want %+v", tt.name, resp.Errors, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/publish/orders", strings.NewReader(`{"data": {"id": 3}}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("valid event: status %d %s", w.Code, w.Body)
+	}
+}
+
+func intPtr(n int) *int { return &n }
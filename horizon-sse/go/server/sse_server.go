@@ -1,8 +1,15 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"horizon-sse-go/client"
+	"horizon-sse-go/streamio"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -12,35 +19,225 @@ import (
 
 type SSEServer struct {
 	router            *mux.Router
-	logger            *logrus.Logger
+	logger            logrus.FieldLogger
 	activeConnections int64
 	totalConnections  int64
 	completedStreams  int64
 	failedStreams     int64
+	writeErrors       WriteErrorCounters
+	eventIDs          EventIDRoutes
+	hub               *Hub
+	schemas           *SchemaRegistry
+	idempotency       *idempotencyCache
+	bridgePool        *client.Pool
+	bridges           []*Bridge
+	webhookClient     *http.Client
+	webhooks          []*Webhook
+	metricsInterval   time.Duration
+	clock             Clock
+	flushes           *FlushMonitor
+	heartbeats        *Heartbeats
+	streamBuffer      int
+	streamOverflow    streamio.Overflow
+	streamBuffers     *streamio.Metrics
+	tcp               TCPOptions
+	buffers           HTTPBuffers
+	version           HTTPVersion
+	conns             *ConnStates
+	replay            *ReplayStore
 }
 
-func NewSSEServer() *SSEServer {
-	logger := logrus.New()
-	logger.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-	})
+// DefaultStreamBuffer is the number of events buffered per /sse client.
+const DefaultStreamBuffer = 64
+
+// metricsTopic is the hub topic /metrics/stream subscribers listen on.
+const metricsTopic = "metrics"
 
+// NewSSEServer returns a server logging to the standard logger until
+// SetLogger is called.
+func NewSSEServer() *SSEServer {
 	s := &SSEServer{
-		router: mux.NewRouter(),
-		logger: logger,
+		router:          mux.NewRouter(),
+		logger:          logrus.StandardLogger(),
+		eventIDs:        EventIDRoutes{Default: EventIDPassthrough},
+		hub:             NewHub(),
+		schemas:         NewSchemaRegistry(),
+		idempotency:     newIdempotencyCache(),
+		metricsInterval: 2 * time.Second,
+		clock:           SystemClock,
+		flushes:         NewFlushMonitor(DefaultSlowFlush),
+		heartbeats:      NewHeartbeats(0),
+		streamBuffer:    DefaultStreamBuffer,
+		streamOverflow:  streamio.OverflowBlock,
+		streamBuffers:   streamio.NewMetrics(),
+		tcp:             DefaultTCPOptions,
+		version:         HTTPAuto,
+		conns:           NewConnStates(DefaultIdleLeakAfter),
+		replay:          NewReplayStore(0, 0),
 	}
 
 	s.setupRoutes()
 	return s
 }
 
+// SetLogger makes the server log to logger, such as an application's own
+// or an entry carrying its fields. Call it before adding bridges and
+// webhooks, which log to the logger set when they are added.
+func (s *SSEServer) SetLogger(logger logrus.FieldLogger) {
+	s.logger = logger
+}
+
+// SetEventIDRoutes configures how event IDs are assigned per route. The
+// server's own numbering is what passthrough keeps.
+func (s *SSEServer) SetEventIDRoutes(routes EventIDRoutes) {
+	s.eventIDs = routes
+}
+
+// SetMetricsInterval sets how often /metrics/stream pushes a snapshot.
+func (s *SSEServer) SetMetricsInterval(d time.Duration) {
+	if d > 0 {
+		s.metricsInterval = d
+	}
+}
+
+// SetClock sets the clock that paces /sse streams and /metrics/stream
+// pushes. It must be called before Start.
+func (s *SSEServer) SetClock(c Clock) {
+	s.clock = c
+}
+
+// SetSlowFlush sets the flush duration past which a flush to an /sse
+// client is logged and counted as slow.
+func (s *SSEServer) SetSlowFlush(d time.Duration) {
+	s.flushes = NewFlushMonitor(d)
+}
+
+// SetHeartbeat has /sse and /metrics/stream send a heartbeat comment to
+// a client whose stream has been idle for interval. Zero disables it.
+func (s *SSEServer) SetHeartbeat(interval time.Duration) {
+	s.heartbeats = NewHeartbeats(interval)
+}
+
+// SetStreamBuffer sets how many events of a /sse stream may be buffered
+// for a client that is slow to take them, and what happens once they are:
+// streamio.OverflowBlock holds back the stream's generation.
+func (s *SSEServer) SetStreamBuffer(size int, overflow streamio.Overflow) {
+	s.streamBuffer, s.streamOverflow = size, overflow
+}
+
+// SetTCPOptions sets the socket options of the connections Start accepts.
+func (s *SSEServer) SetTCPOptions(o TCPOptions) {
+	s.tcp = o
+}
+
+// SetHTTPBuffers sets the buffers the responses of Start's server are
+// written through.
+func (s *SSEServer) SetHTTPBuffers(b HTTPBuffers) {
+	s.buffers = b
+}
+
+// SetHTTPVersion sets the HTTP versions Start's server serves; HTTPAuto
+// by default.
+func (s *SSEServer) SetHTTPVersion(v HTTPVersion) {
+	s.version = v
+}
+
+// SetIdleLeakAfter sets how long a keep-alive connection may sit idle
+// before /metrics counts it as leaked.
+func (s *SSEServer) SetIdleLeakAfter(d time.Duration) {
+	s.conns = NewConnStates(d)
+}
+
+// SetReplay keeps the last size events of each /sse client that passes a
+// client_id for ttl, so it can resume with Last-Event-ID. Zero disables it.
+func (s *SSEServer) SetReplay(size int, ttl time.Duration) {
+	s.replay = NewReplayStore(size, ttl)
+}
+
+// SetReplaySpill has each client's replay buffer, once set by SetReplay,
+// keep memory bytes of events in memory and spill older ones to files in
+// dir, so long streams stay resumable. Zero keeps them all in memory.
+func (s *SSEServer) SetReplaySpill(memory int64, dir string) {
+	s.replay.SpillMemory = memory
+	s.replay.SpillDir = dir
+}
+
+// SetMaxTrackedChannels caps the number of broker channels reported
+// individually in /metrics.
+func (s *SSEServer) SetMaxTrackedChannels(n int) {
+	s.hub.SetMaxTrackedChannels(n)
+}
+
+// SetChannelPolicies configures buffer sizes and overflow behaviour of
+// broker subscribers per channel.
+func (s *SSEServer) SetChannelPolicies(policies ChannelPolicies) {
+	s.hub.SetChannelPolicies(policies)
+}
+
+// SetStateChannels makes the matching broker channels retain their latest
+// event per key and replay it to new subscribers.
+func (s *SSEServer) SetStateChannels(patterns []string) {
+	s.hub.SetStateChannels(patterns)
+}
+
+// LoadSchemas registers the event schemas in dir; see
+// SchemaRegistry.LoadDir.
+func (s *SSEServer) LoadSchemas(dir string) (int, error) {
+	return s.schemas.LoadDir(dir)
+}
+
+// AddBridge starts mirroring a remote SSE stream into the hub, until ctx
+// is done or the bridge is closed.
+func (s *SSEServer) AddBridge(ctx context.Context, cfg BridgeConfig) *Bridge {
+	if s.bridgePool == nil {
+		s.bridgePool = client.NewPool(client.PoolConfig{EventBuffer: 256, Logger: s.logger})
+	}
+	b := startBridge(ctx, cfg, s.hub, s.bridgePool, s.logger)
+	s.bridges = append(s.bridges, b)
+	return b
+}
+
+// AddWebhook starts delivering the events of a channel to a URL, until ctx
+// is done or the webhook is closed.
+func (s *SSEServer) AddWebhook(ctx context.Context, cfg WebhookConfig) *Webhook {
+	if s.webhookClient == nil {
+		s.webhookClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	wh := startWebhook(ctx, cfg, s.hub, s.webhookClient, s.logger)
+	s.webhooks = append(s.webhooks, wh)
+	return wh
+}
+
+func (s *SSEServer) webhookStats() []WebhookStats {
+	stats := make([]WebhookStats, len(s.webhooks))
+	for i, wh := range s.webhooks {
+		stats[i] = wh.Stats()
+	}
+	return stats
+}
+
+func (s *SSEServer) bridgeStats() []BridgeStats {
+	stats := make([]BridgeStats, len(s.bridges))
+	for i, b := range s.bridges {
+		stats[i] = b.Stats()
+	}
+	return stats
+}
+
 func (s *SSEServer) setupRoutes() {
 	s.router.HandleFunc("/sse", s.handleSSE).Methods("GET")
 	s.router.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+	s.router.HandleFunc("/metrics/stream", s.handleMetricsStream).Methods("GET")
 	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
+	s.router.HandleFunc("/publish/{channel}", s.handlePublish).Methods("POST")
+	s.router.HandleFunc("/schemas/{channel}", s.handleGetSchema).Methods("GET")
+	s.router.HandleFunc("/schemas/{channel}", s.handlePutSchema).Methods("PUT")
+	s.router.HandleFunc("/schemas/{channel}", s.handleDeleteSchema).Methods("DELETE")
 }
 
 func (s *SSEServer) handleSSE(w http.ResponseWriter, r *http.Request) {
+	w, stopHeartbeat := s.heartbeats.Wrap(w)
+	defer stopHeartbeat()
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
@@ -54,6 +251,8 @@ func (s *SSEServer) handleSSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	clientID := r.URL.Query().Get("client_id")
+	// Only a client that names itself can come back for its stream
+	resumable := clientID != ""
 	if clientID == "" {
 		clientID = fmt.Sprintf("client-%d", time.Now().UnixNano())
 	}
@@ -67,80 +266,219 @@ func (s *SSEServer) handleSSE(w http.ResponseWriter, r *http.Request) {
 		"active_connections": atomic.LoadInt64(&s.activeConnections),
 	}).Info("Client connected")
 
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	if channels, err := subscribedChannels(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(channels) > 0 {
+		s.subscribe(w, r, flusher, clientID, channels)
+		return
+	}
 
-	timeout := time.After(10 * time.Second)
 	messageCount := 0
+	ids := s.eventIDs.For("/sse").NewGenerator()
+	var flushes StreamFlushes
+	flush := func() {
+		d, slow := s.flushes.Flush(flusher)
+		if flushes.Record(d, slow) {
+			s.logger.WithFields(logrus.Fields{
+				"client_id": clientID,
+				"flush_ms":  d.Milliseconds(),
+			}).Warn("Slow flush to client")
+		}
+	}
+
+	var replay *ReplayLog
+	if resumable {
+		replay, messageCount = s.resume(w, r, clientID, ids)
+		if replay != nil && replay.Done() {
+			return
+		}
+	}
+	if replay == nil {
+		replay = s.replay.Open(clientID)
+	}
+
+	// The events are generated on their own schedule and written at the
+	// client's pace, with the stream buffer in between
+	events := streamio.NewBuffer[string](s.streamBuffer, s.streamOverflow, s.streamBuffers)
+	defer events.Close()
+	go s.generate(r.Context(), events, clientID, ids, replay, &messageCount)
 
 	for {
-		select {
-		case <-r.Context().Done():
+		data, err := events.Get(r.Context())
+		switch {
+		case err == io.EOF:
+			s.logger.WithFields(logrus.Fields{
+				"client_id":        clientID,
+				"total_messages":   messageCount,
+				"dropped_events":   events.Dropped(),
+				"slow_flushes":     flushes.Slow,
+				"slowest_flush_ms": flushes.Slowest.Milliseconds(),
+			}).Info("Stream completed successfully")
+			atomic.AddInt64(&s.completedStreams, 1)
+			return
+		case err == streamio.ErrOverflow:
+			s.logger.WithField("client_id", clientID).Warn("Disconnecting slow client")
+			atomic.AddInt64(&s.failedStreams, 1)
+			return
+		case err != nil:
 			s.logger.WithField("client_id", clientID).Info("Client disconnected")
 			atomic.AddInt64(&s.failedStreams, 1)
 			return
+		}
+
+		if _, err := fmt.Fprint(w, data); err != nil {
+			s.logger.WithFields(logrus.Fields{
+				"client_id":         clientID,
+				"error":             err,
+				"write_error_class": s.writeErrors.Record(err),
+			}).Error("Failed to write to client")
+			atomic.AddInt64(&s.failedStreams, 1)
+			return
+		}
+		flush()
+	}
+}
 
-		case <-ticker.C:
-			messageCount++
-			data := fmt.Sprintf("id: %d\ndata: {\"client_id\": \"%s\", \"message\": \"Stream message %d\", \"timestamp\": \"%s\", \"active_connections\": %d}\n\n",
-				messageCount,
+// generate produces the events of a /sse stream into events: one every
+// tick, counting on from *messageCount, until the stream's time is up and
+// the final one. *messageCount is the total once events ends.
+func (s *SSEServer) generate(ctx context.Context, events *streamio.Buffer[string], clientID string, ids EventIDGenerator, replay *ReplayLog, messageCount *int) {
+	ticker := s.clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeout := s.clock.After(10 * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C():
+			*messageCount++
+			id := ids.Next(strconv.Itoa(*messageCount))
+			data := fmt.Sprintf("id: %s\ndata: {\"client_id\": \"%s\", \"message\": \"Stream message %d\", \"timestamp\": \"%s\", \"active_connections\": %d}\n\n",
+				id,
 				clientID,
-				messageCount,
-				time.Now().Format(time.RFC3339),
+				*messageCount,
+				s.clock.Now().Format(time.RFC3339),
 				atomic.LoadInt64(&s.activeConnections),
 			)
-
-			_, err := fmt.Fprint(w, data)
-			if err != nil {
-				s.logger.WithFields(logrus.Fields{
-					"client_id": clientID,
-					"error":     err,
-				}).Error("Failed to write to client")
-				atomic.AddInt64(&s.failedStreams, 1)
+			replay.Record(id, data)
+			if events.Put(ctx, data) != nil {
 				return
 			}
-			flusher.Flush()
 
 		case <-timeout:
-			finalMessage := fmt.Sprintf("id: final\ndata: {\"client_id\": \"%s\", \"message\": \"Stream completed\", \"total_messages\": %d}\n\n",
+			id := ids.Next("final")
+			finalMessage := fmt.Sprintf("id: %s\ndata: {\"client_id\": \"%s\", \"message\": \"Stream completed\", \"total_messages\": %d}\n\n",
+				id,
 				clientID,
-				messageCount,
+				*messageCount,
 			)
-			fmt.Fprint(w, finalMessage)
-			flusher.Flush()
-
-			s.logger.WithFields(logrus.Fields{
-				"client_id":      clientID,
-				"total_messages": messageCount,
-			}).Info("Stream completed successfully")
-			atomic.AddInt64(&s.completedStreams, 1)
+			replay.Record(id, finalMessage)
+			replay.Finish()
+			if events.Put(ctx, finalMessage) == nil {
+				events.CloseWrite(nil)
+			}
 			return
 		}
 	}
 }
 
-func (s *SSEServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	metrics := map[string]int64{
+// resume picks up the stream of a client reconnecting with Last-Event-ID:
+// it sends the events the client missed and returns the stream's log and
+// message count to go on from. It returns a nil log if the client has no
+// stream to resume, and a finished one if the stream has been answered in
+// full, with a 204 when there was nothing left to send, which tells
+// EventSource clients to stop reconnecting.
+func (s *SSEServer) resume(w http.ResponseWriter, r *http.Request, clientID string, ids EventIDGenerator) (*ReplayLog, int) {
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		return nil, 0
+	}
+	replay, missed, ok := s.replay.Resume(clientID, lastID)
+	if !ok {
+		return nil, 0
+	}
+	if len(missed) == 0 && replay.Done() {
+		w.WriteHeader(http.StatusNoContent)
+		return replay, 0
+	}
+	for _, ev := range missed {
+		fmt.Fprint(w, ev.Text)
+	}
+	w.(http.Flusher).Flush()
+
+	s.logger.WithFields(logrus.Fields{
+		"client_id":     clientID,
+		"last_event_id": lastID,
+		"replayed":      len(missed),
+	}).Info("Client resumed stream")
+
+	// Generators that count, like monotonic ones, go on from the
+	// events already sent
+	sent := replay.Sent()
+	for i := 0; i < sent; i++ {
+		ids.Next("")
+	}
+	return replay, sent
+}
+
+func (s *SSEServer) metricsSnapshot() map[string]interface{} {
+	return map[string]interface{}{
 		"active_connections": atomic.LoadInt64(&s.activeConnections),
 		"total_connections":  atomic.LoadInt64(&s.totalConnections),
 		"completed_streams":  atomic.LoadInt64(&s.completedStreams),
 		"failed_streams":     atomic.LoadInt64(&s.failedStreams),
+		"write_errors":       s.writeErrors.Snapshot(),
+		"flushes":            s.flushes.Stats(),
+		"heartbeats":         s.heartbeats.Stats(),
+		"stream_buffers":     s.streamBuffers.Stats(),
+		"connections":        s.conns.Stats(),
+		"replay":             s.replay.Stats(),
+		"hub":                s.hub.Stats(),
+		"schemas":            s.schemas.Stats(),
+		"idempotency":        s.idempotency.stats(),
+		"bridges":            s.bridgeStats(),
+		"webhooks":           s.webhookStats(),
+		"timestamp":          time.Now().Format(time.RFC3339),
 	}
+}
 
+func (s *SSEServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{
-		"active_connections": %d,
-		"total_connections": %d,
-		"completed_streams": %d,
-		"failed_streams": %d,
-		"timestamp": "%s"
-	}`,
-		metrics["active_connections"],
-		metrics["total_connections"],
-		metrics["completed_streams"],
-		metrics["failed_streams"],
-		time.Now().Format(time.RFC3339),
-	)
+	json.NewEncoder(w).Encode(s.metricsSnapshot())
+}
+
+// handleMetricsStream pushes a metrics snapshot to the client every
+// metricsInterval instead of making it poll /metrics.
+func (s *SSEServer) handleMetricsStream(w http.ResponseWriter, r *http.Request) {
+	w, stopHeartbeat := s.heartbeats.Wrap(w)
+	defer stopHeartbeat()
+	s.hub.ServeSSE(w, r, metricsTopic)
+}
+
+// publishMetrics feeds the metrics topic until ctx is done.
+func (s *SSEServer) publishMetrics(ctx context.Context) {
+	ticker := s.clock.NewTicker(s.metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if s.hub.Subscribers(metricsTopic) == 0 {
+			continue
+		}
+		data, err := json.Marshal(s.metricsSnapshot())
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to marshal metrics snapshot")
+			continue
+		}
+		s.hub.Publish(metricsTopic, Event{Type: "metrics", Data: string(data)})
+	}
 }
 
 func (s *SSEServer) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -148,7 +486,37 @@ func (s *SSEServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `{"status": "healthy", "timestamp": "%s"}`, time.Now().Format(time.RFC3339))
 }
 
-func (s *SSEServer) Start(addr string) error {
-	s.logger.WithField("address", addr).Info("Starting SSE server")
-	return http.ListenAndServe(addr, s.router)
+// Handle serves h on path besides the server's own routes.
+func (s *SSEServer) Handle(path string, h http.Handler) {
+	s.router.Handle(path, h)
+}
+
+// Start serves the server on addr, running it as Run does, until ctx is
+// done. Its streams are then ended and Start returns nil once they have
+// been; a listener or server failure is returned as is.
+func (s *SSEServer) Start(ctx context.Context, addr string) error {
+	s.logger.WithField("address", addr).WithFields(s.tcp.Fields()).WithFields(s.buffers.Fields()).WithField("http_version", s.version).Info("Starting SSE server")
+	ln, err := s.tcp.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:   s.buffers.Handler(s.router),
+		ConnState: s.conns.Track,
+		// Streams run until the client leaves, so requests end with ctx
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	s.buffers.Apply(srv)
+	s.version.Apply(srv)
+	go s.Run(ctx)
+
+	stopped := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		stopped <- srv.Shutdown(context.Background())
+	}()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return <-stopped
 }
\ No newline at end of file
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TCPOptions tune the sockets a listener accepts. Zero values keep the
+// defaults of Go and the OS. Many tiny SSE writes are what these servers
+// do, so the send buffer and Nagle's algorithm matter more than usual.
+type TCPOptions struct {
+	// NoDelay disables Nagle's algorithm, as Go does by default, so each
+	// event leaves as soon as it is flushed. Turning it off trades latency
+	// for fewer packets.
+	NoDelay bool
+	// SendBuffer and ReceiveBuffer set SO_SNDBUF and SO_RCVBUF in bytes.
+	// Linux doubles what it is given and caps it at net.core.wmem_max and
+	// rmem_max.
+	SendBuffer    int
+	ReceiveBuffer int
+	// KeepAliveIdle is the idle time before the first keep-alive probe,
+	// KeepAliveInterval the time between probes and KeepAliveCount the
+	// unanswered probes after which the connection is dropped.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// ReusePort sets SO_REUSEPORT, so several processes can listen on the
+	// port and the kernel spreads new connections between them.
+	ReusePort bool
+}
+
+// DefaultTCPOptions are Go's own: no delay and its keep-alive defaults.
+var DefaultTCPOptions = TCPOptions{NoDelay: true}
+
+// ParseTCPOptions parses a spec such as
+// "nodelay=false,sndbuf=64KB,rcvbuf=64KB,keepalive=30s,keepalive-interval=10s,keepalive-count=3,reuseport=true".
+// Options not named keep DefaultTCPOptions.
+func ParseTCPOptions(spec string) (TCPOptions, error) {
+	o := DefaultTCPOptions
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		value = strings.TrimSpace(value)
+		var err error
+		switch strings.TrimSpace(name) {
+		case "nodelay":
+			o.NoDelay, err = strconv.ParseBool(value)
+		case "sndbuf":
+			o.SendBuffer, err = ParseSize(value)
+		case "rcvbuf":
+			o.ReceiveBuffer, err = ParseSize(value)
+		case "keepalive":
+			o.KeepAliveIdle, err = positiveDuration(value)
+		case "keepalive-interval":
+			o.KeepAliveInterval, err = positiveDuration(value)
+		case "reuseport":
+			o.ReusePort, err = strconv.ParseBool(value)
+		case "keepalive-count":
+			if o.KeepAliveCount, err = strconv.Atoi(value); err == nil && o.KeepAliveCount < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		default:
+			return o, fmt.Errorf("unknown tcp option %q", name)
+		}
+		if err != nil {
+			return o, fmt.Errorf("invalid tcp option %q: %v", entry, err)
+		}
+	}
+	return o, nil
+}
+
+func positiveDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err == nil && d < time.Second {
+		err = fmt.Errorf("must be at least 1s")
+	}
+	return d, err
+}
+
+// ParseSize parses a byte size such as 512, 64KB or 5MB.
+func ParseSize(v string) (int, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	unit := 1
+	for _, u := range []struct {
+		suffix string
+		size   int
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if n, ok := strings.CutSuffix(v, u.suffix); ok {
+			v, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n * unit, nil
+}
+
+func (o TCPOptions) keepAlive() bool {
+	return o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+// Supported returns o without the options the platform lacks, and their
+// names, for a server to warn about and start without.
+func (o TCPOptions) Supported() (TCPOptions, []string) {
+	caps := Platform()
+	var dropped []string
+	if o.ReusePort && !caps.ReusePort {
+		o.ReusePort = false
+		dropped = append(dropped, "reuseport")
+	}
+	if o.SendBuffer > 0 && !caps.TCPBuffers {
+		o.SendBuffer = 0
+		dropped = append(dropped, "sndbuf")
+	}
+	if o.ReceiveBuffer > 0 && !caps.TCPBuffers {
+		o.ReceiveBuffer = 0
+		dropped = append(dropped, "rcvbuf")
+	}
+	if o.keepAlive() && !caps.TCPKeepAlive {
+		o.KeepAliveIdle, o.KeepAliveInterval, o.KeepAliveCount = 0, 0, 0
+		dropped = append(dropped, "keepalive")
+	}
+	return o, dropped
+}
+
+// ListenConfig returns a ListenConfig that sets the options on the
+// listening socket, from which accepted sockets inherit them.
+func (o TCPOptions) ListenConfig() net.ListenConfig {
+	lc := net.ListenConfig{Control: o.control}
+	if o.keepAlive() {
+		// Go would otherwise overwrite the inherited keep-alive settings
+		// of every accepted connection with its own
+		lc.KeepAlive = -1
+	}
+	return lc
+}
+
+// Listen opens a listener whose connections get the options.
+func (o TCPOptions) Listen(network, addr string) (net.Listener, error) {
+	lc := o.ListenConfig()
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return o.Wrap(ln), nil
+}
+
+// Wrap applies the options that do not carry over from the listening
+// socket to each accepted connection: Go turns on TCP_NODELAY for every
+// new connection, so turning it off has to happen after Accept.
+func (o TCPOptions) Wrap(ln net.Listener) net.Listener {
+	if o.NoDelay {
+		return ln
+	}
+	return delayListener{ln}
+}
+
+type delayListener struct {
+	net.Listener
+}
+
+func (l delayListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(false)
+	}
+	return c, err
+}
+
+// Fields describes the options for the startup log.
+func (o TCPOptions) Fields() logrus.Fields {
+	f := logrus.Fields{"tcp_nodelay": o.NoDelay}
+	if o.SendBuffer > 0 {
+		f["tcp_sndbuf"] = o.SendBuffer
+	}
+	if o.ReceiveBuffer > 0 {
+		f["tcp_rcvbuf"] = o.ReceiveBuffer
+	}
+	if o.KeepAliveIdle > 0 {
+		f["tcp_keepalive"] = o.KeepAliveIdle.String()
+	}
+	if o.KeepAliveInterval > 0 {
+		f["tcp_keepalive_interval"] = o.KeepAliveInterval.String()
+	}
+	if o.KeepAliveCount > 0 {
+		f["tcp_keepalive_count"] = o.KeepAliveCount
+	}
+	if o.ReusePort {
+		f["tcp_reuseport"] = true
+	}
+	return f
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// macOS binds several listeners with SO_REUSEPORT but sends every
+// connection to one of them.
+var tcpCapabilities = Capabilities{ReusePort: true, TCPBuffers: true, TCPKeepAlive: true}
+
+// control sets the socket options on a listening socket before it binds.
+// macOS names the keep-alive idle time TCP_KEEPALIVE.
+func (o TCPOptions) control(network, address string, c syscall.RawConn) error {
+	var err error
+	set := func(fd, level, opt, value int) {
+		if err == nil {
+			err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, level, opt, value))
+		}
+	}
+	ctrlErr := c.Control(func(s uintptr) {
+		fd := int(s)
+		if o.SendBuffer > 0 {
+			set(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer)
+		}
+		if o.ReceiveBuffer > 0 {
+			set(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReceiveBuffer)
+		}
+		if o.ReusePort {
+			set(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+		if !o.keepAlive() {
+			return
+		}
+		set(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1)
+		if o.KeepAliveIdle > 0 {
+			set(fd, unix.IPPROTO_TCP, unix.TCP_KEEPALIVE, int(o.KeepAliveIdle.Seconds()))
+		}
+		if o.KeepAliveInterval > 0 {
+			set(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(o.KeepAliveInterval.Seconds()))
+		}
+		if o.KeepAliveCount > 0 {
+			set(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.KeepAliveCount)
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var tcpCapabilities = Capabilities{ReusePort: true, TCPBuffers: true, TCPKeepAlive: true}
+
+// control sets the socket options on a listening socket before it binds.
+func (o TCPOptions) control(network, address string, c syscall.RawConn) error {
+	var err error
+	set := func(fd, level, opt, value int) {
+		if err == nil {
+			err = os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, level, opt, value))
+		}
+	}
+	ctrlErr := c.Control(func(s uintptr) {
+		fd := int(s)
+		if o.SendBuffer > 0 {
+			set(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer)
+		}
+		if o.ReceiveBuffer > 0 {
+			set(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.ReceiveBuffer)
+		}
+		if o.ReusePort {
+			set(fd, syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+		if !o.keepAlive() {
+			return
+		}
+		set(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+		if o.KeepAliveIdle > 0 {
+			set(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, int(o.KeepAliveIdle.Seconds()))
+		}
+		if o.KeepAliveInterval > 0 {
+			set(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(o.KeepAliveInterval.Seconds()))
+		}
+		if o.KeepAliveCount > 0 {
+			set(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.KeepAliveCount)
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Accepted connections inherit the options set on the listening socket.
+func TestTCPOptionsApplyToAcceptedConns(t *testing.T) {
+	o := TCPOptions{SendBuffer: 64 << 10, KeepAliveIdle: 42 * time.Second, KeepAliveInterval: 7 * time.Second, KeepAliveCount: 3}
+	ln, err := o.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(level, opt int) int {
+		var v int
+		raw.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), level, opt)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// Linux doubles the buffer size it is given
+	if v := get(syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < 64<<10 {
+		t.Errorf("SO_SNDBUF = %d", v)
+	}
+	if v := get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 1 {
+		t.Errorf("SO_KEEPALIVE = %d", v)
+	}
+	if v := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 42 {
+		t.Errorf("TCP_KEEPIDLE = %d", v)
+	}
+	if v := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); v != 7 {
+		t.Errorf("TCP_KEEPINTVL = %d", v)
+	}
+	if v := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); v != 3 {
+		t.Errorf("TCP_KEEPCNT = %d", v)
+	}
+	if v := get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Errorf("TCP_NODELAY = %d with nodelay=false", v)
+	}
+}
+
+// With reuseport, a second listener can bind the port of the first.
+func TestTCPReusePort(t *testing.T) {
+	o := TCPOptions{NoDelay: true, ReusePort: true}
+	first, err := o.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := o.Listen("tcp", first.Addr().String())
+	if err != nil {
+		t.Fatalf("second listener: %v", err)
+	}
+	second.Close()
+	if _, err := DefaultTCPOptions.Listen("tcp", first.Addr().String()); err == nil {
+		t.Error("listener without reuseport bound the port too")
+	}
+}
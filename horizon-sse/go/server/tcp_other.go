@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+var tcpCapabilities = Capabilities{}
+
+// control refuses socket options other than TCP_NODELAY, which are only
+// implemented for Linux and macOS. Servers drop them first with Supported.
+func (o TCPOptions) control(network, address string, c syscall.RawConn) error {
+	if o.SendBuffer > 0 || o.ReceiveBuffer > 0 || o.keepAlive() || o.ReusePort {
+		return errors.New("tcp buffer, keep-alive and reuseport options are only supported on Linux and macOS")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTCPOptions(t *testing.T) {
+	tests := []struct {
+		spec string
+		want TCPOptions
+		err  bool
+	}{
+		{"", DefaultTCPOptions, false},
+		{"nodelay=false", TCPOptions{}, false},
+		{"sndbuf=64KB, rcvbuf=1MB", TCPOptions{NoDelay: true, SendBuffer: 64 << 10, ReceiveBuffer: 1 << 20}, false},
+		{"keepalive=30s,keepalive-interval=10s,keepalive-count=3", TCPOptions{NoDelay: true, KeepAliveIdle: 30 * time.Second, KeepAliveInterval: 10 * time.Second, KeepAliveCount: 3}, false},
+		{"nodelay=maybe", TCPOptions{}, true},
+		{"sndbuf=-1", TCPOptions{}, true},
+		{"keepalive=500ms", TCPOptions{}, true},
+		{"keepalive-count=0", TCPOptions{}, true},
+		{"reuseport=true", TCPOptions{NoDelay: true, ReusePort: true}, false},
+		{"cork=true", TCPOptions{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTCPOptions(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: err = %v", tt.spec, err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("%q = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestTCPOptionsSupported(t *testing.T) {
+	o := TCPOptions{NoDelay: true, SendBuffer: 1 << 16, KeepAliveCount: 3, ReusePort: true}
+	got, dropped := o.Supported()
+	caps := Platform()
+	want := o
+	var wantDropped []string
+	if !caps.ReusePort {
+		want.ReusePort = false
+		wantDropped = append(wantDropped, "reuseport")
+	}
+	if !caps.TCPBuffers {
+		want.SendBuffer = 0
+		wantDropped = append(wantDropped, "sndbuf")
+	}
+	if !caps.TCPKeepAlive {
+		want.KeepAliveCount = 0
+		wantDropped = append(wantDropped, "keepalive")
+	}
+	if got != want || strings.Join(dropped, ",") != strings.Join(wantDropped, ",") {
+		t.Errorf("Supported() = %+v %v, want %+v %v", got, dropped, want, wantDropped)
+	}
+	// What is left can be listened with
+	ln, err := got.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// traceComment starts the SSE comments a proxy running with event tracing
+// interleaves with its events. Clients ignore comments, so a traced stream
+// stays a valid stream.
+const traceComment = ": trace "
+
+// FormatEventTrace is the comment written before an event: when the proxy
+// read it from the upstream and when it came out of the transforms.
+func FormatEventTrace(read, transform time.Time) string {
+	return fmt.Sprintf("%sread=%d transform=%d\n", traceComment, read.UnixNano(), transform.UnixNano())
+}
+
+// FormatFlushTrace is the comment written after a batch of events has gone
+// out: when the write of the batch started and when its flush returned. It
+// applies to every event since the previous flush comment.
+func FormatFlushTrace(write, flush time.Time) string {
+	return fmt.Sprintf("%swrite=%d flush=%d\n\n", traceComment, write.UnixNano(), flush.UnixNano())
+}
+
+// EventTrace is when one event passed each stage of the proxy pipeline.
+// Stages a capture did not record are zero.
+type EventTrace struct {
+	Read      time.Time
+	Transform time.Time
+	Write     time.Time
+	Flush     time.Time
+	// Receive is when the capturing client read the end of the event.
+	Receive time.Time
+}
+
+// ReadTrace reads a traced stream from r and returns the trace of every
+// event carrying data. If now is not nil it stamps the receive time of
+// each event, for captures taken live rather than from a file.
+func ReadTrace(r io.Reader, now func() time.Time) ([]EventTrace, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 8<<20)
+	var (
+		traces    []EventTrace
+		next      EventTrace // stamps for the event being read
+		hasData   bool
+		unflushed int // events since the last flush comment
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if hasData {
+				if now != nil {
+					next.Receive = now()
+				}
+				traces = append(traces, next)
+				unflushed++
+			}
+			next, hasData = EventTrace{}, false
+		case strings.HasPrefix(line, traceComment):
+			stamps, err := parseTraceStamps(strings.TrimPrefix(line, traceComment))
+			if err != nil {
+				return traces, err
+			}
+			if w, ok := stamps["write"]; ok {
+				for i := len(traces) - unflushed; i < len(traces); i++ {
+					traces[i].Write, traces[i].Flush = w, stamps["flush"]
+				}
+				unflushed = 0
+				continue
+			}
+			next.Read, next.Transform = stamps["read"], stamps["transform"]
+		case strings.HasPrefix(line, "data:"):
+			hasData = true
+		}
+	}
+	return traces, scanner.Err()
+}
+
+func parseTraceStamps(s string) (map[string]time.Time, error) {
+	stamps := make(map[string]time.Time)
+	for _, field := range strings.Fields(s) {
+		name, value, _ := strings.Cut(field, "=")
+		ns, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trace stamp %q", field)
+		}
+		stamps[name] = time.Unix(0, ns)
+	}
+	return stamps, nil
+}
+
+// StageLatency summarizes the time events spent in one stage.
+type StageLatency struct {
+	Stage string        `json:"stage"`
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// traceStages are the spans a trace report breaks event latency into.
+var traceStages = []struct {
+	name       string
+	from, to   func(EventTrace) time.Time
+	definition string
+}{
+	{"pump", func(t EventTrace) time.Time { return t.Read }, func(t EventTrace) time.Time { return t.Transform },
+		"upstream read to transformed: queued in the pump, then transformed"},
+	{"batch", func(t EventTrace) time.Time { return t.Transform }, func(t EventTrace) time.Time { return t.Write },
+		"transformed to written: waiting for the rest of its batch"},
+	{"flush", func(t EventTrace) time.Time { return t.Write }, func(t EventTrace) time.Time { return t.Flush },
+		"written to flushed: the write and flush to the socket"},
+	{"delivery", func(t EventTrace) time.Time { return t.Flush }, func(t EventTrace) time.Time { return t.Receive },
+		"flushed to received by the client (needs a live capture on the same clock)"},
+	{"total", func(t EventTrace) time.Time { return t.Read }, func(t EventTrace) time.Time {
+		if !t.Receive.IsZero() {
+			return t.Receive
+		}
+		return t.Flush
+	}, "upstream read to received, or to flushed without receive stamps"},
+}
+
+// TraceReport breaks the latency of traced events down by stage. Stages
+// none of the events recorded are left out.
+func TraceReport(traces []EventTrace) []StageLatency {
+	var report []StageLatency
+	for _, stage := range traceStages {
+		var spans []time.Duration
+		for _, t := range traces {
+			from, to := stage.from(t), stage.to(t)
+			if from.IsZero() || to.IsZero() {
+				continue
+			}
+			spans = append(spans, max(to.Sub(from), 0))
+		}
+		if len(spans) == 0 {
+			continue
+		}
+		sort.Slice(spans, func(i, j int) bool { return spans[i] < spans[j] })
+		report = append(report, StageLatency{
+			Stage: stage.name,
+			Count: len(spans),
+			P50:   nearestRank(spans, 50),
+			P95:   nearestRank(spans, 95),
+			P99:   nearestRank(spans, 99),
+			Max:   spans[len(spans)-1],
+		})
+	}
+	return report
+}
+
+// RenderTraceReport writes report as a table, with what each stage spans.
+func RenderTraceReport(w io.Writer, report []StageLatency) {
+	fmt.Fprintf(w, "%-9s %7s %12s %12s %12s %12s\n", "stage", "events", "p50", "p95", "p99", "max")
+	for _, st := range report {
+		fmt.Fprintf(w, "%-9s %7d %12v %12v %12v %12v\n", st.Stage, st.Count, st.P50, st.P95, st.P99, st.Max)
+	}
+	fmt.Fprintln(w)
+	for _, stage := range traceStages {
+		fmt.Fprintf(w, "%-9s %s\n", stage.name, stage.definition)
+	}
+}
+
+// nearestRank returns the p-th percentile (0-100) of sorted durations.
+func nearestRank(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTrace(t *testing.T) {
+	at := func(us int) time.Time { return time.Unix(100, int64(us)*1000) }
+	var b strings.Builder
+	// Two events flushed together, then one on its own
+	b.WriteString(FormatEventTrace(at(0), at(10)) + "id: 1\ndata: a\n\n")
+	b.WriteString(FormatEventTrace(at(5), at(20)) + "data: b\n\n")
+	b.WriteString(FormatFlushTrace(at(30), at(40)))
+	b.WriteString(": keep-alive\n\n")
+	b.WriteString(FormatEventTrace(at(50), at(60)) + "data: c\n\n")
+	b.WriteString(FormatFlushTrace(at(70), at(100)))
+	// Untraced and unflushed events still count
+	b.WriteString("data: d\n\n")
+
+	traces, err := ReadTrace(strings.NewReader(b.String()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EventTrace{
+		{Read: at(0), Transform: at(10), Write: at(30), Flush: at(40)},
+		{Read: at(5), Transform: at(20), Write: at(30), Flush: at(40)},
+		{Read: at(50), Transform: at(60), Write: at(70), Flush: at(100)},
+		{},
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("read %d traces, want %d", len(traces), len(want))
+	}
+	for i := range want {
+		if traces[i] != want[i] {
+			t.Errorf("trace %d = %+v, want %+v", i, traces[i], want[i])
+		}
+	}
+
+	report := TraceReport(traces)
+	stages := make(map[string]StageLatency)
+	for _, st := range report {
+		stages[st.Stage] = st
+	}
+	if _, ok := stages["delivery"]; ok || len(report) != 4 {
+		t.Errorf("report has stages %v, want pump, batch, flush and total", report)
+	}
+	if st := stages["batch"]; st.Count != 3 || st.P50 != 10*time.Microsecond || st.Max != 20*time.Microsecond {
+		t.Errorf("batch = %+v", st)
+	}
+	if st := stages["total"]; st.Max != 50*time.Microsecond {
+		t.Errorf("total = %+v", st)
+	}
+
+	if _, err := ReadTrace(strings.NewReader(": trace read=x\n"), nil); err == nil {
+		t.Error("malformed stamp accepted")
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// UpstreamErrorMode decides what a client is told when the upstream answers
+// a stream request with an error status.
+type UpstreamErrorMode string
+
+const (
+	// ErrorsGateway answers every upstream error with a plain 502.
+	ErrorsGateway UpstreamErrorMode = "gateway"
+	// ErrorsGeneric keeps client errors (4xx) and maps server errors to
+	// 502, with the standard status text instead of the upstream body.
+	ErrorsGeneric UpstreamErrorMode = "generic"
+	// ErrorsPassthrough relays the upstream status and body, redacted.
+	ErrorsPassthrough UpstreamErrorMode = "passthrough"
+	// ErrorsSSE opens the stream and reports the failure as an error
+	// event, for clients such as EventSource that cannot read error
+	// responses.
+	ErrorsSSE UpstreamErrorMode = "sse"
+)
+
+func ParseUpstreamErrorMode(name string) (UpstreamErrorMode, error) {
+	switch m := UpstreamErrorMode(strings.ToLower(strings.TrimSpace(name))); m {
+	case ErrorsGateway, ErrorsGeneric, ErrorsPassthrough, ErrorsSSE:
+		return m, nil
+	case "":
+		return ErrorsGateway, nil
+	default:
+		return "", fmt.Errorf("unknown upstream error mode %q", name)
+	}
+}
+
+// UpstreamErrorRoutes maps route paths to their upstream error mode.
+type UpstreamErrorRoutes struct {
+	Default UpstreamErrorMode
+	Routes  map[string]UpstreamErrorMode
+}
+
+// ParseUpstreamErrorRoutes parses a spec such as "generic" or
+// "gateway,/sse=sse", like ParseEventIDRoutes.
+func ParseUpstreamErrorRoutes(spec string) (UpstreamErrorRoutes, error) {
+	routes := UpstreamErrorRoutes{Default: ErrorsGateway, Routes: map[string]UpstreamErrorMode{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, name, hasRoute := strings.Cut(entry, "=")
+		if !hasRoute {
+			name = route
+		}
+		mode, err := ParseUpstreamErrorMode(name)
+		if err != nil {
+			return routes, err
+		}
+		if hasRoute {
+			routes.Routes[strings.TrimSpace(route)] = mode
+		} else {
+			routes.Default = mode
+		}
+	}
+	return routes, nil
+}
+
+// For returns the mode configured for route.
+func (r UpstreamErrorRoutes) For(route string) UpstreamErrorMode {
+	if mode, ok := r.Routes[route]; ok {
+		return mode
+	}
+	if r.Default == "" {
+		return ErrorsGateway
+	}
+	return r.Default
+}
+
+// ClientStatus returns the status a client gets for an upstream status in
+// the generic mode.
+func ClientStatus(upstream int) int {
+	if upstream >= 400 && upstream < 500 {
+		return upstream
+	}
+	return http.StatusBadGateway
+}
+
+// UpstreamError is the data of the error event sent to stream clients.
+type UpstreamError struct {
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message"`
+}
+
+// Event returns the error as an SSE event of type "error".
+func (e UpstreamError) Event() Event {
+	data, _ := json.Marshal(e)
+	return Event{Type: "error", Data: string(data)}
+}
+
+// defaultRedactions hide the upstream details that most often leak through
+// error bodies: addresses, URLs and cluster-internal host names.
+var defaultRedactions = []string{
+	`https?://[^\s"'<>]+`,
+	`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`,
+	`\b[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.(internal|local|svc|cluster\.local|corp|lan)\b(:\d+)?`,
+}
+
+// Redactor replaces the parts of upstream error bodies that match its
+// patterns with "[redacted]".
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor compiles the default patterns plus extra.
+func NewRedactor(extra ...string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, expr := range append(append([]string(nil), defaultRedactions...), extra...) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", expr, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func (r *Redactor) Redact(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, "[redacted]")
+	}
+	return s
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"horizon-sse-go/retention"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TenantHeader names the tenant a request is accounted to. A proxy sets it
+// on upstream requests so both sides attribute a stream alike.
+const TenantHeader = "X-Tenant-ID"
+
+// TenantOf returns the tenant a request is accounted to: its X-Tenant-ID,
+// else a fingerprint of its API key (from X-API-Key or a bearer token),
+// else "anonymous". Keys are never reported as such.
+func TenantOf(r *http.Request) string {
+	if tenant := strings.TrimSpace(r.Header.Get(TenantHeader)); tenant != "" {
+		return tenant
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = token
+		}
+	}
+	if key = strings.TrimSpace(key); key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:6])
+}
+
+// UsageMeter attributes the CPU time of the process and the bytes sent to
+// the tenants of its streams. Per-goroutine CPU time is not available, so
+// at every sample the CPU used since the last one is split between the
+// streams that were open, in proportion to the bytes each sent.
+type UsageMeter struct {
+	// WattsPerCore, if set, converts CPU time to an energy estimate.
+	WattsPerCore float64
+
+	mu      sync.Mutex
+	active  map[*StreamUsage]struct{}
+	retired []*StreamUsage // finished since the last sample
+	tenants map[string]*tenantUsage
+	since   time.Time
+	// Process CPU time when the meter started and at the last sample
+	startCPU, lastCPU time.Duration
+	idleCPU           time.Duration
+}
+
+// StreamUsage accounts one stream. AddBytes may be called from any
+// goroutine.
+type StreamUsage struct {
+	meter   *UsageMeter
+	tenant  string
+	pending int64 // bytes since the last sample
+}
+
+type tenantUsage struct {
+	streams, active, bytes int64
+	cpu                    time.Duration
+	last                   time.Time // a stream of it last started or ended
+}
+
+// TenantUsage is what a tenant has used since the meter started.
+type TenantUsage struct {
+	Streams       int64   `json:"streams"`
+	ActiveStreams int64   `json:"active_streams"`
+	Bytes         int64   `json:"bytes"`
+	CPUMs         float64 `json:"cpu_ms"`
+	EnergyWh      float64 `json:"energy_wh,omitempty"`
+}
+
+// UsageReport is the usage of all tenants. IdleCPUMs is CPU time used
+// while no stream was open, which no tenant is charged for.
+type UsageReport struct {
+	Since     time.Time              `json:"since"`
+	CPUMs     float64                `json:"cpu_ms"`
+	IdleCPUMs float64                `json:"idle_cpu_ms"`
+	Tenants   map[string]TenantUsage `json:"tenants"`
+}
+
+func NewUsageMeter() *UsageMeter {
+	cpu := processCPU()
+	return &UsageMeter{
+		active:   make(map[*StreamUsage]struct{}),
+		tenants:  make(map[string]*tenantUsage),
+		since:    time.Now(),
+		startCPU: cpu,
+		lastCPU:  cpu,
+	}
+}
+
+// Start begins accounting a stream to tenant.
+func (m *UsageMeter) Start(tenant string) *StreamUsage {
+	u := &StreamUsage{meter: m, tenant: tenant}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active[u] = struct{}{}
+	t := m.tenant(tenant)
+	t.streams++
+	t.active++
+	t.last = time.Now()
+	return u
+}
+
+func (u *StreamUsage) AddBytes(n int) {
+	atomic.AddInt64(&u.pending, int64(n))
+}
+
+// Finish ends the stream. It still shares in the next sample, which covers
+// the CPU it used since the last one.
+func (u *StreamUsage) Finish() {
+	m := u.meter
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.active[u]; !ok {
+		return
+	}
+	delete(m.active, u)
+	m.retired = append(m.retired, u)
+	t := m.tenant(u.tenant)
+	t.active--
+	t.last = time.Now()
+}
+
+// Wrap returns w counting the bytes written through it to the stream.
+func (u *StreamUsage) Wrap(w http.ResponseWriter) http.ResponseWriter {
+	return &usageWriter{ResponseWriter: w, usage: u}
+}
+
+type usageWriter struct {
+	http.ResponseWriter
+	usage *StreamUsage
+}
+
+func (w *usageWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.usage.AddBytes(n)
+	return n, err
+}
+
+func (w *usageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Run samples every interval until ctx is done.
+func (m *UsageMeter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		m.mu.Lock()
+		m.sample()
+		m.mu.Unlock()
+	}
+}
+
+// sample attributes the CPU used since the last sample. m.mu must be held.
+func (m *UsageMeter) sample() {
+	cpu := processCPU()
+	delta := cpu - m.lastCPU
+	m.lastCPU = cpu
+
+	streams := m.retired
+	for u := range m.active {
+		streams = append(streams, u)
+	}
+	m.retired = nil
+
+	bytes := make([]int64, len(streams))
+	var total int64
+	for i, u := range streams {
+		bytes[i] = atomic.SwapInt64(&u.pending, 0)
+		total += bytes[i]
+		m.tenant(u.tenant).bytes += bytes[i]
+	}
+	if len(streams) == 0 {
+		m.idleCPU += delta
+		return
+	}
+	for i, u := range streams {
+		share := delta / time.Duration(len(streams))
+		if total > 0 {
+			share = time.Duration(float64(delta) * float64(bytes[i]) / float64(total))
+		}
+		m.tenant(u.tenant).cpu += share
+	}
+}
+
+func (m *UsageMeter) tenant(name string) *tenantUsage {
+	t, ok := m.tenants[name]
+	if !ok {
+		t = &tenantUsage{}
+		m.tenants[name] = t
+	}
+	return t
+}
+
+// Snapshot samples and returns the usage so far.
+func (m *UsageMeter) Snapshot() UsageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample()
+
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	report := UsageReport{
+		Since:     m.since,
+		CPUMs:     ms(m.lastCPU - m.startCPU),
+		IdleCPUMs: ms(m.idleCPU),
+		Tenants:   make(map[string]TenantUsage, len(m.tenants)),
+	}
+	for name, t := range m.tenants {
+		report.Tenants[name] = TenantUsage{
+			Streams:       t.streams,
+			ActiveStreams: t.active,
+			Bytes:         t.bytes,
+			CPUMs:         ms(t.cpu),
+			EnergyWh:      t.cpu.Hours() * m.WattsPerCore,
+		}
+	}
+	return report
+}
+
+// Items lists the tenants without open streams for a retention.Janitor
+// managing usage records, as old as their last stream's end.
+func (m *UsageMeter) Items() ([]retention.Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var items []retention.Item
+	for name, t := range m.tenants {
+		if t.active == 0 {
+			items = append(items, retention.Item{Name: name, Time: t.last})
+		}
+	}
+	return items, nil
+}
+
+// Remove forgets the usage of tenant, unless a stream of it has started
+// since it was listed. The streams it finished are sampled first, so the
+// CPU they used is not charged to others.
+func (m *UsageMeter) Remove(tenant string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tenants[tenant]; ok && t.active == 0 {
+		m.sample()
+		delete(m.tenants, tenant)
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookSignatureHeader carries the HMAC-SHA256 signature of a webhook
+// body as "t=<unix seconds>,v1=<hex>", computed over "<t>.<body>" with the
+// target's secret. Receivers should recompute it and reject stale t.
+const WebhookSignatureHeader = "X-Horizon-Signature"
+
+// WebhookConfig registers a URL that receives the events of a channel.
+type WebhookConfig struct {
+	Channel string
+	URL     string
+	// Secret signs every request; empty leaves requests unsigned.
+	Secret string
+	// Events are sent in batches of up to BatchSize, waiting at most
+	// BatchWait for a batch to fill.
+	BatchSize int
+	BatchWait time.Duration
+	// MaxAttempts bounds the deliveries of one batch; failed attempts are
+	// retried with exponential backoff from RetryDelay up to MaxRetryDelay,
+	// which also caps the wait a Retry-After asks for.
+	MaxAttempts   int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Buffer is the number of events queued while a delivery is in flight.
+	Buffer int
+}
+
+// ParseWebhookConfig parses "channel=url"; the other settings get their
+// defaults.
+func ParseWebhookConfig(spec string) (WebhookConfig, error) {
+	channel, target, ok := strings.Cut(spec, "=")
+	cfg := WebhookConfig{Channel: strings.TrimSpace(channel), URL: strings.TrimSpace(target)}
+	if !ok || cfg.Channel == "" {
+		return cfg, fmt.Errorf("webhook %q: expected channel=url", spec)
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return cfg, fmt.Errorf("webhook %q: target must be an http(s) URL", spec)
+	}
+	return cfg, nil
+}
+
+func (cfg *WebhookConfig) setDefaults() {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if cfg.BatchWait <= 0 {
+		cfg.BatchWait = 100 * time.Millisecond
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = 500 * time.Millisecond
+	}
+	if cfg.MaxRetryDelay <= 0 {
+		cfg.MaxRetryDelay = 30 * time.Second
+	}
+	if cfg.MaxRetryDelay < cfg.RetryDelay {
+		cfg.MaxRetryDelay = cfg.RetryDelay
+	}
+	if cfg.Buffer < 1 {
+		cfg.Buffer = 1024
+	}
+}
+
+// WebhookPayload is the JSON body POSTed to a webhook target.
+type WebhookPayload struct {
+	Channel string         `json:"channel"`
+	Events  []WebhookEvent `json:"events"`
+}
+
+type WebhookEvent struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type,omitempty"`
+	Data string `json:"data"`
+}
+
+// WebhookStats counts the deliveries to one target.
+type WebhookStats struct {
+	Channel string `json:"channel"`
+	URL     string `json:"url"`
+	// Delivered and Failed count events; Failed ones were in a batch that
+	// exhausted MaxAttempts or was rejected with a 4xx.
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+	Batches   int64 `json:"batches"`
+	Attempts  int64 `json:"attempts"`
+	Retries   int64 `json:"retries"`
+	// Resubscribes counts the times the target fell so far behind that the
+	// channel's policy disconnected it.
+	Resubscribes  int64   `json:"resubscribes"`
+	AvgLatencyMs  float64 `json:"avg_latency_ms"`
+	LastStatus    int     `json:"last_status,omitempty"`
+	LastError     string  `json:"last_error,omitempty"`
+	LastDelivered string  `json:"last_delivered,omitempty"`
+}
+
+// Webhook delivers the events of one channel to one URL, in order. It
+// holds an ordinary hub subscription, so while a slow target is being
+// retried events queue in its buffer and the channel's overflow policy
+// applies once it is full.
+type Webhook struct {
+	cfg    WebhookConfig
+	hub    *Hub
+	client *http.Client
+	logger logrus.FieldLogger
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	delivered    int64
+	failed       int64
+	batches      int64
+	attempts     int64
+	retries      int64
+	resubscribes int64
+	latencyNs    int64
+
+	mu            sync.Mutex
+	lastStatus    int
+	lastErr       string
+	lastDelivered time.Time
+}
+
+func startWebhook(ctx context.Context, cfg WebhookConfig, hub *Hub, client *http.Client, logger logrus.FieldLogger) *Webhook {
+	cfg.setDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	wh := &Webhook{
+		cfg:    cfg,
+		hub:    hub,
+		client: client,
+		logger: logger,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go wh.run(ctx)
+	return wh
+}
+
+// Close stops the webhook; a delivery in progress is abandoned.
+func (wh *Webhook) Close() {
+	wh.cancel()
+	<-wh.done
+}
+
+func (wh *Webhook) run(ctx context.Context) {
+	defer close(wh.done)
+	for {
+		sub := wh.hub.Subscribe(wh.cfg.Channel, wh.cfg.Buffer)
+		wh.consume(ctx, sub)
+		sub.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		atomic.AddInt64(&wh.resubscribes, 1)
+		wh.logger.WithFields(logrus.Fields{
+			"channel": wh.cfg.Channel,
+			"url":     wh.cfg.URL,
+		}).Warn("Webhook fell behind and was disconnected, resubscribing")
+	}
+}
+
+// consume batches events from sub and delivers them until ctx is done or
+// sub is closed.
+func (wh *Webhook) consume(ctx context.Context, sub *Subscription) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	var batch []Event
+	for {
+		var flush bool
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				wh.deliver(ctx, batch)
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(wh.cfg.BatchWait)
+			}
+			batch = append(batch, ev)
+			flush = len(batch) >= wh.cfg.BatchSize
+		case <-timer.C:
+			flush = true
+		}
+		if flush && len(batch) > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			wh.deliver(ctx, batch)
+			batch = nil
+		}
+	}
+}
+
+func (wh *Webhook) deliver(ctx context.Context, batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+	payload := WebhookPayload{Channel: wh.cfg.Channel, Events: make([]WebhookEvent, len(batch))}
+	for i, ev := range batch {
+		payload.Events[i] = WebhookEvent{ID: ev.ID, Type: ev.Type, Data: ev.Data}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		wh.logger.WithError(err).Error("Failed to encode webhook payload")
+		return
+	}
+	atomic.AddInt64(&wh.batches, 1)
+
+	delay := wh.cfg.RetryDelay
+	for attempt := 1; ; attempt++ {
+		atomic.AddInt64(&wh.attempts, 1)
+		status, retryAfter, err := wh.post(ctx, body)
+		wh.mu.Lock()
+		wh.lastStatus = status
+		wh.lastErr = ""
+		if err != nil {
+			wh.lastErr = err.Error()
+		} else {
+			wh.lastDelivered = time.Now()
+		}
+		wh.mu.Unlock()
+
+		if err == nil {
+			atomic.AddInt64(&wh.delivered, int64(len(batch)))
+			return
+		}
+		retryable := status == 0 || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt >= wh.cfg.MaxAttempts || ctx.Err() != nil {
+			atomic.AddInt64(&wh.failed, int64(len(batch)))
+			wh.logger.WithFields(logrus.Fields{
+				"channel":  wh.cfg.Channel,
+				"url":      wh.cfg.URL,
+				"events":   len(batch),
+				"attempts": attempt,
+				"status":   status,
+			}).WithError(err).Error("Webhook delivery failed")
+			return
+		}
+
+		wait := delay
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > wh.cfg.MaxRetryDelay {
+			wait = wh.cfg.MaxRetryDelay
+		}
+		atomic.AddInt64(&wh.retries, 1)
+		select {
+		case <-ctx.Done():
+			atomic.AddInt64(&wh.failed, int64(len(batch)))
+			return
+		case <-time.After(wait):
+		}
+		if delay *= 2; delay > wh.cfg.MaxRetryDelay {
+			delay = wh.cfg.MaxRetryDelay
+		}
+	}
+}
+
+// post makes one delivery attempt. status is 0 if no response arrived.
+func (wh *Webhook) post(ctx context.Context, body []byte) (status int, retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.cfg.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(wh.cfg.Secret, time.Now(), body))
+	}
+
+	start := time.Now()
+	resp, err := wh.client.Do(req)
+	atomic.AddInt64(&wh.latencyNs, int64(time.Since(start)))
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return resp.StatusCode, retryAfter, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+}
+
+// SignWebhook returns the WebhookSignatureHeader value for body sent at t.
+func SignWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Stats reports the target's delivery counters.
+func (wh *Webhook) Stats() WebhookStats {
+	st := WebhookStats{
+		Channel:      wh.cfg.Channel,
+		URL:          wh.cfg.URL,
+		Delivered:    atomic.LoadInt64(&wh.delivered),
+		Failed:       atomic.LoadInt64(&wh.failed),
+		Batches:      atomic.LoadInt64(&wh.batches),
+		Attempts:     atomic.LoadInt64(&wh.attempts),
+		Retries:      atomic.LoadInt64(&wh.retries),
+		Resubscribes: atomic.LoadInt64(&wh.resubscribes),
+	}
+	if st.Attempts > 0 {
+		st.AvgLatencyMs = float64(atomic.LoadInt64(&wh.latencyNs)) / float64(st.Attempts) / float64(time.Millisecond)
+	}
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	st.LastStatus = wh.lastStatus
+	st.LastError = wh.lastErr
+	if !wh.lastDelivered.IsZero() {
+		st.LastDelivered = wh.lastDelivered.Format(time.RFC3339)
+	}
+	return st
+}
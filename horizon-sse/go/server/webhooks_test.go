@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"channel":"news","events":[{"data":"hi"}]}`)
+	sig := SignWebhook("s3cret", time.Unix(1700000000, 0), body)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	if want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Errorf("signature %s, want %s", sig, want)
+	}
+	if SignWebhook("other", time.Unix(1700000000, 0), body) == sig || SignWebhook("s3cret", time.Unix(1700000001, 0), body) == sig {
+		t.Error("signature ignores the secret or the time")
+	}
+}
+
+// startTestWebhook delivers the events of channel "news" to url and waits
+// until it has subscribed.
+func startTestWebhook(t *testing.T, hub *Hub, cfg WebhookConfig) *Webhook {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg.Channel = "news"
+	wh := startWebhook(context.Background(), cfg, hub, &http.Client{Timeout: time.Second}, logger)
+	t.Cleanup(wh.Close)
+	deadline := time.Now().Add(time.Second)
+	for hub.Subscribers("news") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("webhook did not subscribe")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return wh
+}
+
+// waitWebhook waits until the webhook has finished with n events.
+func waitWebhook(t *testing.T, wh *Webhook, n int64) WebhookStats {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st := wh.Stats()
+		if st.Delivered+st.Failed >= n {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("webhook stuck: %+v", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A failing target is retried, without waiting longer than MaxRetryDelay
+// whatever its Retry-After says, and gets signed requests.
+func TestWebhookRetry(t *testing.T) {
+	var calls int32
+	var got WebhookPayload
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sig := r.Header.Get(WebhookSignatureHeader)
+		ts := strings.TrimPrefix(strings.Split(sig, ",")[0], "t=")
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(ts + "." + string(body)))
+		if !strings.HasSuffix(sig, ",v1="+hex.EncodeToString(mac.Sum(nil))) {
+			t.Errorf("bad signature %q", sig)
+		}
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			json.Unmarshal(body, &got)
+		}
+	}))
+	defer target.Close()
+
+	hub := NewHub()
+	wh := startTestWebhook(t, hub, WebhookConfig{URL: target.URL, Secret: "s3cret", BatchSize: 2,
+		RetryDelay: time.Millisecond, MaxRetryDelay: 20 * time.Millisecond})
+	hub.Publish("news", Event{ID: "1", Data: "a"})
+	hub.Publish("news", Event{ID: "2", Type: "t", Data: "b"})
+	start := time.Now()
+	st := waitWebhook(t, wh, 2)
+	if st.Delivered != 2 || st.Failed != 0 || st.Batches != 1 || st.Attempts != 3 || st.Retries != 2 || st.LastStatus != 200 {
+		t.Errorf("stats %+v", st)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retry-After held the delivery for %v", elapsed)
+	}
+	if len(got.Events) != 2 || got.Channel != "news" || got.Events[1] != (WebhookEvent{ID: "2", Type: "t", Data: "b"}) {
+		t.Errorf("payload %+v", got)
+	}
+}
+
+// A target that is gone is given MaxAttempts, and one that rejects a
+// request with a 4xx only one.
+func TestWebhookFailure(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	hub := NewHub()
+	wh := startTestWebhook(t, hub, WebhookConfig{URL: dead.URL, MaxAttempts: 3, RetryDelay: time.Millisecond})
+	hub.Publish("news", Event{Data: "a"})
+	if st := waitWebhook(t, wh, 1); st.Failed != 1 || st.Attempts != 3 || st.Retries != 2 || st.LastStatus != 0 || st.LastError == "" {
+		t.Errorf("dead target: %+v", st)
+	}
+	wh.Close()
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	hub = NewHub()
+	wh = startTestWebhook(t, hub, WebhookConfig{URL: rejecting.URL, MaxAttempts: 3, RetryDelay: time.Millisecond})
+	hub.Publish("news", Event{Data: "a"})
+	if st := waitWebhook(t, wh, 1); st.Failed != 1 || st.Attempts != 1 || st.Retries != 0 || st.LastStatus != 400 {
+		t.Errorf("rejecting target: %+v", st)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// WriteErrorClass names the reason a write to an SSE client failed.
+type WriteErrorClass string
+
+const (
+	WriteErrorBrokenPipe  WriteErrorClass = "broken_pipe"
+	WriteErrorConnReset   WriteErrorClass = "connection_reset"
+	WriteErrorTimeout     WriteErrorClass = "timeout"
+	WriteErrorHTTP2Stream WriteErrorClass = "http2_stream_error"
+	WriteErrorClientGone  WriteErrorClass = "client_gone"
+	WriteErrorOther       WriteErrorClass = "other"
+)
+
+// ClassifyWriteError maps an error returned while writing to a client onto
+// a WriteErrorClass. Broken pipes and resets usually come from clients on
+// flaky networks dropping the socket, timeouts from write deadlines, and
+// HTTP/2 stream errors from the client cancelling a single stream.
+func ClassifyWriteError(err error) WriteErrorClass {
+	if err == nil {
+		return ""
+	}
+
+	switch {
+	case errors.Is(err, syscall.EPIPE):
+		return WriteErrorBrokenPipe
+	case errors.Is(err, syscall.ECONNRESET):
+		return WriteErrorConnReset
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, http.ErrHandlerTimeout):
+		return WriteErrorTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, net.ErrClosed):
+		return WriteErrorClientGone
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return WriteErrorTimeout
+	}
+
+	// The bundled http2 server does not export its error types, so the
+	// message is all there is to go on.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "http2:"), strings.Contains(msg, "stream error"),
+		strings.Contains(msg, "client disconnected"):
+		return WriteErrorHTTP2Stream
+	case strings.Contains(msg, "broken pipe"):
+		return WriteErrorBrokenPipe
+	case strings.Contains(msg, "connection reset"):
+		return WriteErrorConnReset
+	}
+	return WriteErrorOther
+}
+
+// WriteErrorCounters counts client write failures per WriteErrorClass.
+// The zero value is ready to use.
+type WriteErrorCounters struct {
+	brokenPipe  int64
+	connReset   int64
+	timeout     int64
+	http2Stream int64
+	clientGone  int64
+	other       int64
+}
+
+// Record classifies err, counts it and returns its class.
+func (c *WriteErrorCounters) Record(err error) WriteErrorClass {
+	class := ClassifyWriteError(err)
+	switch class {
+	case WriteErrorBrokenPipe:
+		atomic.AddInt64(&c.brokenPipe, 1)
+	case WriteErrorConnReset:
+		atomic.AddInt64(&c.connReset, 1)
+	case WriteErrorTimeout:
+		atomic.AddInt64(&c.timeout, 1)
+	case WriteErrorHTTP2Stream:
+		atomic.AddInt64(&c.http2Stream, 1)
+	case WriteErrorClientGone:
+		atomic.AddInt64(&c.clientGone, 1)
+	case WriteErrorOther:
+		atomic.AddInt64(&c.other, 1)
+	}
+	return class
+}
+
+// Snapshot returns the current counts keyed by class name.
+func (c *WriteErrorCounters) Snapshot() map[string]int64 {
+	return map[string]int64{
+		string(WriteErrorBrokenPipe):  atomic.LoadInt64(&c.brokenPipe),
+		string(WriteErrorConnReset):   atomic.LoadInt64(&c.connReset),
+		string(WriteErrorTimeout):     atomic.LoadInt64(&c.timeout),
+		string(WriteErrorHTTP2Stream): atomic.LoadInt64(&c.http2Stream),
+		string(WriteErrorClientGone):  atomic.LoadInt64(&c.clientGone),
+		string(WriteErrorOther):       atomic.LoadInt64(&c.other),
+	}
+}
@@ -0,0 +1,273 @@
+// Package streamio sits between what a streaming handler reads, from an
+// upstream or a generator, and the client it writes to: a bounded ring
+// buffer per connection, so a client that falls behind costs a fixed
+// amount of memory, with an overflow policy deciding what gives once it is
+// full, and metrics of how full the buffers of a server run.
+package streamio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Overflow decides what a Put into a full buffer does.
+type Overflow string
+
+const (
+	// OverflowBlock makes the writer wait for room, so the upstream it
+	// reads slows down to the client's pace.
+	OverflowBlock Overflow = "block"
+	// OverflowDropOldest evicts the oldest item to make room, so the
+	// upstream keeps flowing and the client skips ahead.
+	OverflowDropOldest Overflow = "drop-oldest"
+	// OverflowDropNewest discards the new item and keeps those buffered.
+	OverflowDropNewest Overflow = "drop-newest"
+	// OverflowDisconnect fails the buffer: the writer's Put and the
+	// reader's next Get return ErrOverflow, for the handler to drop the
+	// client.
+	OverflowDisconnect Overflow = "disconnect"
+)
+
+// ParseOverflow validates a policy name.
+func ParseOverflow(name string) (Overflow, error) {
+	switch o := Overflow(strings.TrimSpace(name)); o {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+		return o, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+var (
+	// ErrOverflow is returned once a buffer with OverflowDisconnect has
+	// overflowed.
+	ErrOverflow = errors.New("streamio: reader fell a full buffer behind")
+	// ErrClosed is returned by Put once the reader has closed the buffer
+	// or the writer has.
+	ErrClosed = errors.New("streamio: buffer closed")
+)
+
+// Buffer is a bounded FIFO of items from one writer to one reader.
+type Buffer[T any] struct {
+	overflow Overflow
+	metrics  *Metrics
+
+	mu       sync.Mutex
+	items    []T // a ring of len(items) slots
+	head, n  int
+	err      error // the writer's, once it has closed
+	written  bool  // the writer has closed
+	failed   bool  // overflowed under OverflowDisconnect
+	stalls   int64
+	dropped  int64
+	ready    chan struct{} // to the reader: there are items, or an end
+	room     chan struct{} // to a blocked writer: an item was taken
+	closed   chan struct{} // the reader is gone
+	shutOnce sync.Once
+}
+
+// NewBuffer returns a buffer of size items, at least one, reporting to m
+// if it is not nil.
+func NewBuffer[T any](size int, overflow Overflow, m *Metrics) *Buffer[T] {
+	if size < 1 {
+		size = 1
+	}
+	if overflow == "" {
+		overflow = OverflowBlock
+	}
+	m.open(size)
+	return &Buffer[T]{
+		overflow: overflow,
+		metrics:  m,
+		items:    make([]T, size),
+		ready:    make(chan struct{}, 1),
+		room:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Put adds v, doing as the overflow policy says if the buffer is full.
+// Under OverflowBlock it waits until there is room, ctx is done or the
+// reader closes the buffer.
+func (b *Buffer[T]) Put(ctx context.Context, v T) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.metrics.observeFill(b.n, len(b.items))
+	var stalled time.Time
+	for {
+		if b.failed {
+			return ErrOverflow
+		}
+		if b.written || b.isClosed() {
+			return ErrClosed
+		}
+		if b.n < len(b.items) {
+			break
+		}
+		switch b.overflow {
+		case OverflowDropOldest:
+			b.pop()
+			b.dropped++
+			b.metrics.drop()
+		case OverflowDropNewest:
+			b.dropped++
+			b.metrics.drop()
+			return nil
+		case OverflowDisconnect:
+			b.failed = true
+			for b.n > 0 {
+				b.pop()
+			}
+			b.metrics.disconnect()
+			b.signal(b.ready)
+			return ErrOverflow
+		default:
+			if stalled.IsZero() {
+				stalled = time.Now()
+				b.stalls++
+			}
+			b.mu.Unlock()
+			select {
+			case <-b.room:
+			case <-b.closed:
+			case <-ctx.Done():
+			}
+			b.mu.Lock()
+			if err := ctx.Err(); err != nil {
+				b.metrics.stall(time.Since(stalled))
+				return err
+			}
+			continue
+		}
+	}
+	if !stalled.IsZero() {
+		b.metrics.stall(time.Since(stalled))
+	}
+	b.items[(b.head+b.n)%len(b.items)] = v
+	b.n++
+	b.metrics.push(b.n)
+	b.signal(b.ready)
+	return nil
+}
+
+// CloseWrite tells the reader there is nothing more: once it has taken the
+// items left, Get returns err, or io.EOF if it is nil.
+func (b *Buffer[T]) CloseWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	b.mu.Lock()
+	if !b.written {
+		b.written, b.err = true, err
+	}
+	b.mu.Unlock()
+	b.signal(b.ready)
+}
+
+// Ready is signalled when there may be items to take or the buffer has
+// ended, for readers that wait on other channels as well: on a receive,
+// take items with TryGet until it has none.
+func (b *Buffer[T]) Ready() <-chan struct{} {
+	return b.ready
+}
+
+// TryGet takes the next item if there is one. err is set once there will
+// be none: the writer's error or io.EOF once the items are taken, and
+// ErrOverflow, with the items dropped, once the buffer has overflowed.
+func (b *Buffer[T]) TryGet() (v T, ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failed {
+		return v, false, ErrOverflow
+	}
+	if b.n == 0 {
+		if b.written {
+			return v, false, b.err
+		}
+		return v, false, nil
+	}
+	v = b.pop()
+	b.signal(b.room)
+	return v, true, nil
+}
+
+// Get waits for the next item, with TryGet's errors or ctx's.
+func (b *Buffer[T]) Get(ctx context.Context) (T, error) {
+	for {
+		v, ok, err := b.TryGet()
+		if ok || err != nil {
+			return v, err
+		}
+		select {
+		case <-b.ready:
+		case <-ctx.Done():
+			return v, ctx.Err()
+		}
+	}
+}
+
+// Close is the reader going away: a blocked Put returns ErrClosed, and the
+// buffer's items no longer count in its metrics. It is safe to call more
+// than once.
+func (b *Buffer[T]) Close() {
+	b.shutOnce.Do(func() {
+		b.mu.Lock()
+		close(b.closed)
+		b.metrics.close(len(b.items), b.n)
+		b.n = 0
+		b.mu.Unlock()
+	})
+}
+
+// Len is the number of items buffered.
+func (b *Buffer[T]) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// Stalls is the number of Puts that waited for room.
+func (b *Buffer[T]) Stalls() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stalls
+}
+
+// Dropped is the number of items the overflow policy dropped.
+func (b *Buffer[T]) Dropped() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// pop takes the oldest item. b.mu must be held and b.n positive.
+func (b *Buffer[T]) pop() T {
+	var zero T
+	v := b.items[b.head]
+	b.items[b.head] = zero
+	b.head = (b.head + 1) % len(b.items)
+	b.n--
+	b.metrics.pop()
+	return v
+}
+
+func (b *Buffer[T]) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Buffer[T]) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
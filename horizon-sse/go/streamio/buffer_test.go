@@ -0,0 +1,160 @@
+package streamio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fill puts 0..n-1 into b.
+func fill(t *testing.T, b *Buffer[int], n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := b.Put(context.Background(), i); err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+	}
+}
+
+// drain takes the items left in b and how it ended.
+func drain(b *Buffer[int]) ([]int, error) {
+	var got []int
+	for {
+		v, err := b.Get(context.Background())
+		if err != nil {
+			return got, err
+		}
+		got = append(got, v)
+	}
+}
+
+func TestBufferOrderAndEnd(t *testing.T) {
+	b := NewBuffer[int](4, OverflowBlock, nil)
+	fill(t, b, 3)
+	b.CloseWrite(nil)
+	if got, err := drain(b); !reflect.DeepEqual(got, []int{0, 1, 2}) || err != io.EOF {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if err := b.Put(context.Background(), 3); err != ErrClosed {
+		t.Errorf("put after CloseWrite: %v", err)
+	}
+
+	upstream := errors.New("upstream reset")
+	b = NewBuffer[int](4, OverflowBlock, nil)
+	fill(t, b, 1)
+	b.CloseWrite(upstream)
+	if got, err := drain(b); len(got) != 1 || err != upstream {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		overflow Overflow
+		kept     []int
+		dropped  int64
+		err      error
+	}{
+		{OverflowDropOldest, []int{3, 4}, 3, io.EOF},
+		{OverflowDropNewest, []int{0, 1}, 3, io.EOF},
+		{OverflowDisconnect, nil, 0, ErrOverflow},
+	} {
+		m := NewMetrics()
+		b := NewBuffer[int](2, tc.overflow, m)
+		var putErr error
+		for i := 0; i < 5 && putErr == nil; i++ {
+			putErr = b.Put(context.Background(), i)
+		}
+		if tc.overflow == OverflowDisconnect && putErr != ErrOverflow {
+			t.Errorf("%s: put past a full buffer: %v", tc.overflow, putErr)
+		}
+		b.CloseWrite(nil)
+		got, err := drain(b)
+		if !reflect.DeepEqual(got, tc.kept) || err != tc.err || b.Dropped() != tc.dropped {
+			t.Errorf("%s: kept %v, %v, dropped %d", tc.overflow, got, err, b.Dropped())
+		}
+		st := m.Stats()
+		if st.Dropped != tc.dropped || (tc.overflow == OverflowDisconnect) != (st.Disconnected == 1) {
+			t.Errorf("%s: stats %+v", tc.overflow, st)
+		}
+	}
+}
+
+// Under OverflowBlock a full buffer holds the writer until the reader
+// takes something, or goes away.
+func TestBufferBlock(t *testing.T) {
+	m := NewMetrics()
+	b := NewBuffer[int](1, OverflowBlock, m)
+	fill(t, b, 1)
+	put := make(chan error, 1)
+	go func() { put <- b.Put(context.Background(), 1) }()
+	select {
+	case err := <-put:
+		t.Fatalf("put into a full buffer returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if v, _ := b.Get(context.Background()); v != 0 {
+		t.Errorf("got %d", v)
+	}
+	if err := <-put; err != nil {
+		t.Fatal(err)
+	}
+	if b.Stalls() != 1 || m.Stats().Stalls != 1 || m.Stats().StallMs < 40 {
+		t.Errorf("stalls %d, stats %+v", b.Stalls(), m.Stats())
+	}
+
+	go func() { put <- b.Put(context.Background(), 2) }()
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	if err := <-put; err != ErrClosed {
+		t.Errorf("put after Close: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	b = NewBuffer[int](1, OverflowBlock, nil)
+	fill(t, b, 1)
+	if err := b.Put(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("put past its context: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	a := NewBuffer[int](4, OverflowBlock, m)
+	b := NewBuffer[int](4, OverflowBlock, m)
+	fill(t, a, 3)
+	fill(t, b, 1)
+	st := m.Stats()
+	if st.Buffers != 2 || st.Capacity != 8 || st.Queued != 4 || st.Occupancy != 0.5 || st.Peak != 3 {
+		t.Errorf("stats %+v", st)
+	}
+	// Puts into a buffer holding 0, 1 and 2 of 4 items, then 0
+	if st.Fill["0-25%"] != 2 || st.Fill["25-50%"] != 1 || st.Fill["50-75%"] != 1 {
+		t.Errorf("fill %v", st.Fill)
+	}
+
+	a.Get(context.Background())
+	a.Close()
+	if st := m.Stats(); st.Buffers != 1 || st.Capacity != 4 || st.Queued != 1 {
+		t.Errorf("stats after close %+v", st)
+	}
+
+	var none *Metrics
+	NewBuffer[int](1, OverflowDropOldest, none).Put(context.Background(), 0)
+	if st := none.Stats(); st.Buffers != 0 {
+		t.Errorf("nil metrics counted %+v", st)
+	}
+}
+
+func TestParseOverflow(t *testing.T) {
+	if o, err := ParseOverflow(" drop-newest"); err != nil || o != OverflowDropNewest {
+		t.Errorf("got %q, %v", o, err)
+	}
+	if _, err := ParseOverflow("wait"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package streamio
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// fillBuckets label the fill histogram: how full a buffer was when
+// something was put into it.
+var fillBuckets = [...]string{"0-25%", "25-50%", "50-75%", "75-100%", "full"}
+
+// Metrics adds up the buffers of a server. Its methods may be called on a
+// nil *Metrics, which counts nothing.
+type Metrics struct {
+	buffers    int64
+	queued     int64
+	capacity   int64
+	peak       int64
+	stalls     int64
+	stallNanos int64
+	dropped    int64
+	overflowed int64
+	fill       [len(fillBuckets)]int64
+}
+
+// Stats is a snapshot of Metrics. Occupancy is the share of the open
+// buffers' room in use; Peak is the most items any one buffer has held.
+type Stats struct {
+	Buffers      int64            `json:"buffers"`
+	Queued       int64            `json:"queued"`
+	Capacity     int64            `json:"capacity"`
+	Occupancy    float64          `json:"occupancy"`
+	Peak         int64            `json:"peak"`
+	Fill         map[string]int64 `json:"fill"`
+	Stalls       int64            `json:"stalls"`
+	StallMs      float64          `json:"stall_ms"`
+	Dropped      int64            `json:"dropped"`
+	Disconnected int64            `json:"disconnected"`
+}
+
+// NewMetrics returns metrics with nothing counted.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Stats returns the metrics so far.
+func (m *Metrics) Stats() Stats {
+	if m == nil {
+		return Stats{}
+	}
+	st := Stats{
+		Buffers:      atomic.LoadInt64(&m.buffers),
+		Queued:       atomic.LoadInt64(&m.queued),
+		Capacity:     atomic.LoadInt64(&m.capacity),
+		Peak:         atomic.LoadInt64(&m.peak),
+		Fill:         make(map[string]int64, len(fillBuckets)),
+		Stalls:       atomic.LoadInt64(&m.stalls),
+		StallMs:      float64(atomic.LoadInt64(&m.stallNanos)) / float64(time.Millisecond),
+		Dropped:      atomic.LoadInt64(&m.dropped),
+		Disconnected: atomic.LoadInt64(&m.overflowed),
+	}
+	if st.Capacity > 0 {
+		st.Occupancy = float64(st.Queued) / float64(st.Capacity)
+	}
+	for i, label := range fillBuckets {
+		st.Fill[label] = atomic.LoadInt64(&m.fill[i])
+	}
+	return st
+}
+
+func (m *Metrics) open(size int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.buffers, 1)
+	atomic.AddInt64(&m.capacity, int64(size))
+}
+
+func (m *Metrics) close(size, queued int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.buffers, -1)
+	atomic.AddInt64(&m.capacity, -int64(size))
+	atomic.AddInt64(&m.queued, -int64(queued))
+}
+
+func (m *Metrics) observeFill(n, size int) {
+	if m == nil {
+		return
+	}
+	i := len(fillBuckets) - 1
+	if n < size {
+		i = n * (len(fillBuckets) - 1) / size
+	}
+	atomic.AddInt64(&m.fill[i], 1)
+}
+
+// push counts an item put into a buffer now holding n.
+func (m *Metrics) push(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.queued, 1)
+	for {
+		peak := atomic.LoadInt64(&m.peak)
+		if int64(n) <= peak || atomic.CompareAndSwapInt64(&m.peak, peak, int64(n)) {
+			return
+		}
+	}
+}
+
+func (m *Metrics) pop() {
+	if m != nil {
+		atomic.AddInt64(&m.queued, -1)
+	}
+}
+
+func (m *Metrics) stall(d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.stalls, 1)
+	atomic.AddInt64(&m.stallNanos, int64(d))
+}
+
+func (m *Metrics) drop() {
+	if m != nil {
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+func (m *Metrics) disconnect() {
+	if m != nil {
+		atomic.AddInt64(&m.overflowed, 1)
+	}
+}
@@ -0,0 +1,369 @@
+// Package websocket is the small part of RFC 6455 the load-test stack
+// needs to compare WebSocket delivery with SSE: a server upgrade, a client
+// dial, and unfragmented text messages. There are no extensions or
+// subprotocols.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// WebSocket close codes. Codes from 4000 up are the application's: a stream
+// refused with an HTTP status is closed with 4000 plus the status.
+const (
+	CloseNormal     = 1000
+	CloseGoingAway  = 1001
+	CloseProtocol   = 1002
+	CloseTooBig     = 1009
+	CloseInternal   = 1011
+	CloseStatusBase = 4000
+)
+
+const (
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	maxMessageBytes  = 1 << 20
+	maxControlBytes  = 125
+	handshakeTimeout = 10 * time.Second
+)
+
+// CloseError is the close frame a WebSocket connection ended with.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Conn is one end of a WebSocket connection, as much of RFC 6455 as
+// streaming text messages needs: no extensions or subprotocols. Writes may
+// come from several goroutines; reads from one.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // clients mask their frames
+
+	mu     sync.Mutex // serializes writes
+	closed bool       // a close frame was sent
+}
+
+// acceptKey is the Sec-WebSocket-Accept answer to key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerHasToken reports whether the comma-separated header contains
+// token, case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade completes the WebSocket handshake of r and takes over
+// its connection. On failure it has answered r with an error status.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket unsupported", http.StatusInternalServerError)
+		return nil, err
+	}
+	// The server's read and write timeouts were meant for the request
+	conn.SetDeadline(time.Time{})
+	// Headers set before the upgrade, such as cookies, go out with it
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n", acceptKey(key))
+	w.Header().Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: brw.Reader}, nil
+}
+
+// Dial opens a WebSocket connection to rawURL (ws, wss, http or
+// https) with the extra handshake header. If the server answers with
+// anything but a switch to WebSocket, its response is returned with the
+// error. The connection is closed when ctx is done.
+func Dial(ctx context.Context, rawURL string, header http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	secure := false
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme, secure = "https", true
+	default:
+		return nil, nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), map[bool]string{false: "80", true: "443"}[secure])
+	}
+
+	var conn net.Conn
+	if secure {
+		conn, err = (&tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{Method: "GET", URL: u, Header: header.Clone(), Host: u.Host}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := req.Write(conn); err != nil {
+		stop()
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		stop()
+		conn.Close()
+		return nil, resp, fmt.Errorf("websocket handshake failed with status %d", resp.StatusCode)
+	}
+	conn.SetDeadline(time.Time{})
+	return &Conn{conn: conn, br: br, client: true}, resp, nil
+}
+
+// writeFrame sends one unfragmented frame.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if c.client {
+		header[1] |= 0x80
+		var mask [4]byte
+		rand.Read(mask[:])
+		header = append(header, mask[:]...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ mask[i%4]
+		}
+		payload = masked
+	}
+	if opcode == opClose {
+		c.closed = true
+	}
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends data as a text message.
+func (c *Conn) WriteText(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// WriteClose starts the closing handshake with code and reason.
+func (c *Conn) WriteClose(code int, reason string) error {
+	if len(reason) > maxControlBytes-2 {
+		reason = reason[:maxControlBytes-2]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(opClose, append(payload, reason...))
+}
+
+// ReadMessage returns the next text or binary message, answering pings on
+// the way. A close frame is answered and returned as a *CloseError.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case opPing:
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			closeErr := &CloseError{Code: 1005}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.WriteClose(closeErr.Code, "")
+			return nil, closeErr
+		case opText, opBinary:
+			if started {
+				return nil, errors.New("websocket: new message inside a fragmented one")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, errors.New("websocket: continuation without a message")
+			}
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+		if len(message)+len(payload) > maxMessageBytes {
+			c.WriteClose(CloseTooBig, "")
+			return nil, fmt.Errorf("websocket: message larger than %d bytes", maxMessageBytes)
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0F
+	masked := head[1]&0x80 != 0
+	if masked == c.client {
+		// Clients mask every frame and servers none (RFC 6455 §5.1)
+		c.WriteClose(CloseProtocol, "")
+		if c.client {
+			err = errors.New("websocket: masked server frame")
+		} else {
+			err = errors.New("websocket: unmasked client frame")
+		}
+		return
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= opClose && (n > maxControlBytes || !fin) {
+		err = errors.New("websocket: invalid control frame")
+		return
+	}
+	if n > maxMessageBytes {
+		c.WriteClose(CloseTooBig, "")
+		err = fmt.Errorf("websocket: frame larger than %d bytes", maxMessageBytes)
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// SetReadDeadline bounds the next reads.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Close closes the connection without a closing handshake.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
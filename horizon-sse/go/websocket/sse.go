@@ -0,0 +1,282 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is one SSE event sent as a WebSocket text message.
+type Message struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+	// Retry is the reconnection delay in milliseconds, if the event set one.
+	Retry int64 `json:"retry,omitempty"`
+}
+
+// Format renders the message back in SSE wire format.
+func (m Message) Format() string {
+	var b strings.Builder
+	if m.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", m.ID)
+	}
+	if m.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", m.Event)
+	}
+	if m.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", m.Retry)
+	}
+	for _, line := range strings.Split(m.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Route says how a WebSocket stream is served: as a Method request for
+// Path, with the first message as its body, answered by Handler.
+// Messages, if set, is given each later message of the client, such as a
+// command to the stream; the Message it returns, if any, is sent back.
+// Without it later messages are ignored.
+type Route struct {
+	Method   string
+	Path     string
+	Handler  http.Handler
+	Messages func(message []byte) *Message
+}
+
+// closeWait is how long a finished stream waits for the client to answer
+// its close frame before dropping the connection.
+const closeWait = time.Second
+
+// ServeSSE serves an SSE handler over WebSocket, so the same stream
+// can be compared on both transports. The client opens the connection and
+// sends the request body as its first message; route picks the handler,
+// whose events are sent one message each as a JSON Message. The stream
+// ends with a normal close, or, if the handler answered with an error
+// status, a close with CloseStatusBase plus the status and its body as
+// the reason. The handler's request is cancelled when the client closes.
+func ServeSSE(w http.ResponseWriter, r *http.Request, route func(body []byte) Route) error {
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	body, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("reading websocket request: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	rt := route(body)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	inner := r.Clone(ctx)
+	inner.Method = rt.Method
+	inner.URL.Path = rt.Path
+	inner.RequestURI = inner.URL.RequestURI()
+	for _, name := range []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions"} {
+		inner.Header.Del(name)
+	}
+	inner.Body = io.NopCloser(bytes.NewReader(body))
+	inner.ContentLength = int64(len(body))
+	inner.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	if len(body) > 0 && inner.Header.Get("Content-Type") == "" {
+		inner.Header.Set("Content-Type", "application/json")
+	}
+
+	// Past the request the client only sends what rt.Messages takes, and
+	// its close, which, like the connection dropping, ends the stream
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if rt.Messages == nil {
+				continue
+			}
+			if reply := rt.Messages(message); reply != nil {
+				if b, err := json.Marshal(reply); err == nil {
+					conn.WriteText(b)
+				}
+			}
+		}
+	}()
+
+	rw := &responseWriter{conn: conn, header: make(http.Header)}
+	func() {
+		// A handler aborting its response ends the stream as broken
+		defer func() {
+			if p := recover(); p != nil {
+				conn.WriteClose(CloseInternal, "")
+				if p != http.ErrAbortHandler {
+					panic(p)
+				}
+			}
+		}()
+		rt.Handler.ServeHTTP(rw, inner)
+		rw.finish()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(closeWait):
+	}
+	return nil
+}
+
+// responseWriter turns what an SSE handler writes into WebSocket
+// messages, one per event.
+type responseWriter struct {
+	conn    *Conn
+	header  http.Header
+	status  int
+	pending []byte       // SSE text short of a whole event
+	errBody bytes.Buffer // the body of an error response
+	err     error
+}
+
+func (w *responseWriter) Header() http.Header { return w.header }
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.status != http.StatusOK {
+		if w.errBody.Len() < maxControlBytes {
+			w.errBody.Write(p)
+		}
+		return len(p), nil
+	}
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.Index(w.pending, []byte("\n\n"))
+		if i < 0 {
+			break
+		}
+		block := string(w.pending[:i])
+		w.pending = w.pending[i+2:]
+		if err := w.send(block); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush does nothing: each event is sent as soon as it is whole.
+func (w *responseWriter) Flush() {}
+
+// send sends one SSE event block as a message.
+func (w *responseWriter) send(block string) error {
+	var msg Message
+	var data []string
+	for _, line := range strings.Split(block, "\n") {
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "id":
+			msg.ID = value
+		case "event":
+			msg.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			msg.Retry, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	// As in SSE, a block without data dispatches nothing
+	if data == nil && msg.ID == "" && msg.Retry == 0 {
+		return nil
+	}
+	msg.Data = strings.Join(data, "\n")
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return w.conn.WriteText(b)
+}
+
+// finish closes the stream with the handler's outcome.
+func (w *responseWriter) finish() {
+	switch {
+	case w.err != nil:
+	case w.status == 0 || w.status == http.StatusOK:
+		if len(bytes.TrimSpace(w.pending)) > 0 {
+			w.send(string(w.pending))
+		}
+		w.conn.WriteClose(CloseNormal, "")
+	default:
+		w.conn.WriteClose(CloseStatusBase+w.status, strings.TrimSpace(w.errBody.String()))
+	}
+}
+
+// EventReader reads a stream served by ServeSSE back as SSE text,
+// so it can be parsed like any other. It ends with io.EOF on a normal
+// close; a close for an error status is returned as a *CloseError.
+type EventReader struct {
+	conn *Conn
+	buf  bytes.Buffer
+	err  error
+}
+
+// NewEventReader reads the events of conn.
+func NewEventReader(conn *Conn) *EventReader {
+	return &EventReader{conn: conn}
+}
+
+func (r *EventReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		message, err := r.conn.ReadMessage()
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == CloseNormal {
+				err = io.EOF
+			}
+			r.err = err
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(message, &msg); err != nil {
+			r.err = fmt.Errorf("websocket message: %w", err)
+			continue
+		}
+		r.buf.WriteString(msg.Format())
+	}
+	return r.buf.Read(p)
+}
+
+// Close ends the stream, telling the server the client has gone.
+func (r *EventReader) Close() error {
+	r.conn.WriteClose(CloseGoingAway, "")
+	return r.conn.Close()
+}
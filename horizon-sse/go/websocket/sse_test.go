@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, h http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeSSE(w, r, func(body []byte) Route {
+			return Route{Method: http.MethodPost, Path: "/stream", Handler: h}
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, url, body string) *EventReader {
+	t.Helper()
+	conn, _, err := Dial(context.Background(), url, http.Header{"X-Test": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteText([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	r := NewEventReader(conn)
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestServeSSE(t *testing.T) {
+	url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Path != "/stream" || r.URL.Query().Get("q") != "1" || r.Header.Get("X-Test") != "1" {
+			t.Errorf("handler got %s %s with X-Test %q", r.Method, r.URL, r.Header.Get("X-Test"))
+		}
+		fmt.Fprintf(w, ": comment\n\nid: 1\nevent: delta\ndata: %s\n\n", body)
+		w.(http.Flusher).Flush()
+		// Split across writes, and a payload too long for a short frame
+		fmt.Fprint(w, "data: line one\ndata: ")
+		fmt.Fprintf(w, "%s\n\n", strings.Repeat("x", 70000))
+		fmt.Fprint(w, "retry: 500\ndata: [DONE]\n\n")
+	})
+
+	got, err := io.ReadAll(dial(t, url+"?q=1", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "id: 1\nevent: delta\ndata: hello\n\n" +
+		"data: line one\ndata: " + strings.Repeat("x", 70000) + "\n\n" +
+		"retry: 500\ndata: [DONE]\n\n"
+	if string(got) != want {
+		t.Errorf("got %.200q", got)
+	}
+}
+
+func TestServeSSEErrorStatus(t *testing.T) {
+	url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	})
+
+	_, err := io.ReadAll(dial(t, url, ""))
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseStatusBase+http.StatusServiceUnavailable || closeErr.Reason != "overloaded" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestServeSSEClientClose(t *testing.T) {
+	cancelled := make(chan struct{})
+	url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: first\n\n")
+		<-r.Context().Done()
+		close(cancelled)
+	})
+
+	r := dial(t, url, "")
+	buf := make([]byte, 64)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "data: first\n\n" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	r.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("handler not cancelled when the client closed")
+	}
+}
+
+func TestUpgradeRefusesPlainRequests(t *testing.T) {
+	url := serve(t, func(http.ResponseWriter, *http.Request) {})
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// A server closes the connection on a frame its client did not mask.
+func TestUnmaskedClientFrame(t *testing.T) {
+	called := false
+	url := serve(t, func(http.ResponseWriter, *http.Request) { called = true })
+	conn, _, err := Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.conn.Write([]byte{0x81, 5, 'h', 'e', 'l', 'l', 'o'}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseProtocol || called {
+		t.Errorf("got %v, handler called %v", err, called)
+	}
+}